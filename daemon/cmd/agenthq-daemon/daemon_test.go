@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agenthq/daemon/daemontest"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// TestMain runs the daemon instead of the tests when startDaemon starts
+// this binary as one.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("AGENTHQ_TEST_DAEMON_ARGS"); ok {
+		os.Args = append(os.Args[:1], strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// syncBuffer is a bytes.Buffer the daemon's output can be written to while
+// a test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startDaemon runs a daemon with args, connected to srv and with a home
+// directory of its own. It is stopped when the test ends, and its log is
+// printed if the test failed.
+func startDaemon(t *testing.T, srv *daemontest.Server, args ...string) {
+	t.Helper()
+	var out syncBuffer
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "HOME="+t.TempDir(), "AGENTHQ_TEST_DAEMON_ARGS="+strings.Join(args, " "))
+	cmd.Env = append(cmd.Env, srv.Env()...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		done := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(daemontest.Timeout):
+			cmd.Process.Kill()
+			<-done
+		}
+		if t.Failed() {
+			t.Logf("daemon log:\n%s", out.String())
+		}
+	})
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	srv := daemontest.NewServer(t, "token")
+	dir := t.TempDir()
+	startDaemon(t, srv, "--workspace", dir)
+
+	if reg := srv.WaitRegister(); reg.Workspace != dir {
+		t.Errorf("registered workspace = %q, want %q", reg.Workspace, dir)
+	}
+
+	srv.Spawn(protocol.ServerMessage{ProcessID: "p1", Agent: protocol.AgentBash, WorktreePath: dir})
+	srv.Resize("p1", 100, 30)
+	srv.Input("p1", "stty size; echo done-$((6*7))\n")
+	srv.ExpectOutput("p1", "done-42")
+	if out := srv.Output("p1"); !strings.Contains(out, "30 100") {
+		t.Errorf("stty size after resize printed %q, want 30 100", out)
+	}
+
+	srv.Kill("p1")
+	if ack := srv.Request(protocol.ServerMessage{Type: protocol.MsgTypeKill, ProcessID: "p1"}); ack.Error == "" {
+		t.Error("killing an exited process was acked without an error")
+	}
+}
+
+func TestInvalidMessageIsRejected(t *testing.T) {
+	srv := daemontest.NewServer(t, "")
+	startDaemon(t, srv)
+	srv.WaitRegister()
+
+	srv.SendRaw([]byte(`{"type":"spawn","requestId":"r1","processId":"p1","bogus":true}`))
+	ack := srv.Expect(protocol.MsgTypeAck, func(m protocol.DaemonMessage) bool { return m.RequestID == "r1" })
+	if ack.ErrorCode != protocol.ErrorCodeInvalidMessage {
+		t.Errorf("ack = %+v, want errorCode %s", ack, protocol.ErrorCodeInvalidMessage)
+	}
+}
+
+func TestSignedMessages(t *testing.T) {
+	const secret = "s3cret"
+	t.Setenv("AGENTHQ_SIGNING_SECRET", secret)
+	srv := daemontest.NewServer(t, "")
+	startDaemon(t, srv)
+	srv.WaitRegister()
+
+	// sign returns a signed kill request, sent now
+	sign := func(requestID string) []byte {
+		payload := fmt.Sprintf(`{"type":"kill","requestId":%q,"processId":"p1","ts":%d,"nonce":%q}`, requestID, time.Now().UnixMilli(), requestID)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		frame, _ := json.Marshal(map[string]string{"type": "signed", "payload": payload, "sig": hex.EncodeToString(mac.Sum(nil))})
+		return frame
+	}
+	acked := func(requestID string) int {
+		n := 0
+		for _, m := range srv.Messages() {
+			if m.Type == protocol.MsgTypeAck && m.RequestID == requestID {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Messages are handled in order, so each ack shows the frames before
+	// it were dropped
+	srv.SendRaw([]byte(`{"type":"kill","requestId":"unsigned","processId":"p1"}`))
+	first := sign("r1")
+	srv.SendRaw(first)
+	srv.Expect(protocol.MsgTypeAck, func(m protocol.DaemonMessage) bool { return m.RequestID == "r1" })
+	srv.SendRaw(first)
+	srv.SendRaw(sign("r2"))
+	srv.Expect(protocol.MsgTypeAck, func(m protocol.DaemonMessage) bool { return m.RequestID == "r2" })
+
+	if n := acked("unsigned"); n != 0 {
+		t.Errorf("unsigned message acked %d times, want dropped", n)
+	}
+	if n := acked("r1"); n != 1 {
+		t.Errorf("signed message acked %d times, want once and its replay dropped", n)
+	}
+}
+
+func TestChunkedMessage(t *testing.T) {
+	srv := daemontest.NewServer(t, "")
+	startDaemon(t, srv)
+	srv.WaitRegister()
+
+	message := []byte(`{"type":"kill","requestId":"r1","processId":"` + strings.Repeat("p", 200) + `"}`)
+	frames := protocol.SplitMessage(message, 120, "m1")
+	if len(frames) < 2 {
+		t.Fatalf("split into %d frames, want several", len(frames))
+	}
+	for _, frame := range frames {
+		srv.SendRaw(frame)
+	}
+	if ack := srv.Expect(protocol.MsgTypeAck, func(m protocol.DaemonMessage) bool { return m.RequestID == "r1" }); ack.Error == "" {
+		t.Errorf("ack = %+v, want the error killing an unknown process", ack)
+	}
+}
+
+func TestScopedServer(t *testing.T) {
+	srv := daemontest.NewServer(t, "")
+	config := filepath.Join(t.TempDir(), "config.json")
+	data, _ := json.Marshal(map[string]any{"servers": []map[string]any{{"url": srv.URL, "scopes": []string{"read"}}}})
+	if err := os.WriteFile(config, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	startDaemon(t, srv, "--config", config, "--workspace", t.TempDir())
+	srv.WaitRegister()
+
+	if ack := srv.Request(protocol.ServerMessage{Type: protocol.MsgTypeListRepos}); ack.ErrorCode == protocol.ErrorCodeOutOfScope {
+		t.Errorf("list-repos with read scope: ack = %+v", ack)
+	}
+	for _, msg := range []protocol.ServerMessage{
+		{Type: protocol.MsgTypeKill, ProcessID: "p1"},
+		{Type: protocol.MsgTypeSpawn, ProcessID: "p1", Agent: protocol.AgentBash, WorktreePath: "/tmp"},
+		{Type: protocol.MsgTypePtyInput, ProcessID: "p1", Data: "x"},
+	} {
+		if ack := srv.Request(msg); ack.ErrorCode != protocol.ErrorCodeOutOfScope {
+			t.Errorf("%s with read scope: ack = %+v, want errorCode %s", msg.Type, ack, protocol.ErrorCodeOutOfScope)
+		}
+	}
+}
+
+func TestDrainOverAPI(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.Addr().String()
+	l.Close()
+
+	srv := daemontest.NewServer(t, "")
+	config := filepath.Join(t.TempDir(), "config.json")
+	data, _ := json.Marshal(map[string]any{"tokens": []map[string]any{{"name": "ci", "token": "ci-token", "scopes": []string{"spawn", "manage"}}}})
+	if err := os.WriteFile(config, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	startDaemon(t, srv, "--config", config, "--workspace", dir, "--api", "--token", "token", "--listen", listen)
+	srv.WaitRegister()
+	srv.Spawn(protocol.ServerMessage{ProcessID: "p1", Agent: protocol.AgentBash, WorktreePath: dir})
+
+	// drain posts to /api/drain with token, returning the status code
+	drain := func(token string) (int, protocol.Draining) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "http://"+listen+"/api/drain", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status protocol.Draining
+		json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, status
+	}
+	if code, _ := drain("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("drain with a wrong token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := drain("ci-token"); code != http.StatusForbidden {
+		t.Errorf("drain with a scoped token: status %d, want %d", code, http.StatusForbidden)
+	}
+	if msgs := srv.Messages(); slices.ContainsFunc(msgs, func(m protocol.DaemonMessage) bool { return m.Type == protocol.MsgTypeDaemonDraining }) {
+		t.Fatal("refused drain requests started a drain")
+	}
+	code, status := drain("token")
+	if code != http.StatusAccepted || status.Sessions != 1 || status.Deadline == 0 {
+		t.Errorf("drain: status %d %+v, want %d and one session", code, status, http.StatusAccepted)
+	}
+	srv.Expect(protocol.MsgTypeDaemonDraining, nil)
+	if ack := srv.Request(protocol.ServerMessage{Type: protocol.MsgTypeSpawn, ProcessID: "p2", Agent: protocol.AgentBash, WorktreePath: dir, Cols: 80, Rows: 24}); ack.ErrorCode != protocol.ErrorCodeDraining {
+		t.Errorf("spawn while draining: ack = %+v, want errorCode %s", ack, protocol.ErrorCodeDraining)
+	}
+
+	// Once its last session ends the daemon stops, closing its listener
+	srv.Kill("p1")
+	deadline := time.Now().Add(daemontest.Timeout)
+	for {
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("the daemon didn't stop after draining")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/clipboard"
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/docker"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/pty"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/tmux"
+	"github.com/agenthq/daemon/pkg/agenthqd"
+)
+
+// minGitVersion is the oldest git with everything worktrees use
+// (rev-parse --path-format).
+var minGitVersion = [2]int{2, 31}
+
+// doctorTimeout bounds each check that talks to another process.
+const doctorTimeout = 10 * time.Second
+
+// checkStatus is the outcome of a doctor check.
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	// checkWarn is a problem that only matters for some uses, e.g. an
+	// agent that isn't installed
+	checkWarn
+	checkFail
+)
+
+func (s checkStatus) String() string {
+	return [...]string{"ok", "warn", "FAIL"}[s]
+}
+
+// doctor runs checks and prints each outcome with a hint on fixing it.
+type doctor struct {
+	workspace string
+	failed    bool
+}
+
+// report prints a check's outcome; hint, if any, says how to fix it.
+func (d *doctor) report(status checkStatus, name, detail, hint string) {
+	fmt.Printf("[%-4s] %s: %s\n", status, name, detail)
+	if hint != "" && status != checkOK {
+		fmt.Printf("       %s\n", hint)
+	}
+	if status == checkFail {
+		d.failed = true
+	}
+}
+
+// runDoctor checks what the daemon needs to connect and spawn sessions,
+// printing what to fix. It returns the exit status: 1 if a check failed.
+func runDoctor(args []string) int {
+	d := &doctor{}
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	flags.StringVar(&d.workspace, "workspace", "", "Workspace directory containing repositories")
+	configPath := flags.String("config", config.DefaultPath(), "Path to daemon config file (JSON)")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		d.report(checkFail, "config", err.Error(), "Fix or remove "+*configPath+".")
+		cfg = &config.Config{}
+	} else if _, err := os.Stat(*configPath); err != nil {
+		d.report(checkOK, "config", *configPath+" not found, using defaults", "")
+	} else {
+		d.report(checkOK, "config", *configPath, "")
+	}
+
+	d.checkGit()
+	d.checkPTY()
+	d.checkAgents()
+	d.checkWorkspace()
+	d.checkServers(cfg)
+	d.checkBackends(cfg)
+	d.checkClipboard(cfg)
+
+	if d.failed {
+		fmt.Println("\nSome checks failed.")
+		return 1
+	}
+	fmt.Println("\nAll checks passed.")
+	return 0
+}
+
+var gitVersionRe = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+func (d *doctor) checkGit() {
+	out, err := exec.Command("git", "--version").Output()
+	if err != nil {
+		d.report(checkFail, "git", err.Error(), "Install git and make sure it is on the daemon's PATH.")
+		return
+	}
+	version := strings.TrimSpace(string(out))
+	m := gitVersionRe.FindStringSubmatch(version)
+	if m == nil {
+		d.report(checkWarn, "git", version+" (version not recognized)", "")
+		return
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	if major < minGitVersion[0] || major == minGitVersion[0] && minor < minGitVersion[1] {
+		d.report(checkFail, "git", version, fmt.Sprintf("Worktrees need git %d.%d or later; upgrade git.", minGitVersion[0], minGitVersion[1]))
+		return
+	}
+	d.report(checkOK, "git", version, "")
+}
+
+// checkPTY starts bash on a terminal, as every session is started.
+func (d *doctor) checkPTY() {
+	proc, err := pty.Spawn("bash", []string{"-c", "exit 0"}, os.TempDir(), nil, 80, 24)
+	if err != nil {
+		d.report(checkFail, "pty", err.Error(), "Sessions need bash and a free pseudo-terminal; check that bash is installed and /dev/ptmx is usable.")
+		return
+	}
+	defer proc.Close()
+	proc.StartReadLoop(func([]byte) {})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := proc.Wait()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			d.report(checkFail, "pty", err.Error(), "")
+			return
+		}
+	case <-time.After(doctorTimeout):
+		proc.Kill()
+		d.report(checkFail, "pty", "bash did not exit", "")
+		return
+	}
+	d.report(checkOK, "pty", "started bash on a terminal", "")
+}
+
+// checkAgents looks for each agent's command the way sessions start it:
+// on the daemon's PATH, or else on a login shell's.
+func (d *doctor) checkAgents() {
+	var agents []protocol.AgentType
+	for agent := range protocol.AgentCommands {
+		if agent != protocol.AgentBash && agent != protocol.AgentShell {
+			agents = append(agents, agent)
+		}
+	}
+	slices.Sort(agents)
+
+	for _, agent := range agents {
+		name := "agent " + string(agent)
+		command := strings.Fields(protocol.AgentCommands[agent])[0]
+		if path, err := exec.LookPath(command); err == nil {
+			d.report(checkOK, name, path, "")
+			continue
+		}
+		out, err := exec.Command("bash", "-l", "-c", `command -v -- "$1"`, "bash", command).Output()
+		if path := lastLine(string(out)); err == nil && path != "" {
+			d.report(checkOK, name, path+" (login shell PATH)", "")
+			continue
+		}
+		d.report(checkWarn, name, command+" not found", "Install "+command+" or add it to PATH to run "+string(agent)+" sessions.")
+	}
+}
+
+// lastLine returns the last non-empty line of s, skipping what login
+// scripts print first.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// checkWorkspace checks that worktrees can be created in the workspace's
+// repos, which takes writing inside each repo.
+func (d *doctor) checkWorkspace() {
+	if d.workspace == "" {
+		d.report(checkWarn, "workspace", "not set", "Pass --workspace so the server can list repos and create worktrees.")
+		return
+	}
+	info, err := os.Stat(d.workspace)
+	if err != nil || !info.IsDir() {
+		d.report(checkFail, "workspace", d.workspace+" is not a directory", "Pass an existing directory as --workspace.")
+		return
+	}
+	if err := checkWritable(d.workspace); err != nil {
+		d.report(checkFail, "workspace", err.Error(), "Give the daemon's user write access to "+d.workspace+".")
+		return
+	}
+
+	repos := agenthqd.WorkspaceRepos(d.workspace)
+	var readOnly []string
+	for _, repo := range repos {
+		if err := checkWritable(repo); err != nil {
+			readOnly = append(readOnly, filepath.Base(repo))
+		}
+	}
+	if len(readOnly) > 0 {
+		d.report(checkFail, "workspace", "can't write to "+strings.Join(readOnly, ", "), "Worktrees are created inside each repo; give the daemon's user write access.")
+		return
+	}
+	d.report(checkOK, "workspace", fmt.Sprintf("%s (%d repos)", d.workspace, len(repos)), "")
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".agenthq-doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (d *doctor) checkServers(cfg *config.Config) {
+	for _, server := range agenthqd.ConfiguredServers(cfg) {
+		for _, url := range server.URLs() {
+			name := "server " + url
+			err := client.Probe(url, server.Token)
+			switch {
+			case err == nil && server.Token == "":
+				d.report(checkOK, name, "reachable (no auth token)", "")
+			case err == nil:
+				d.report(checkOK, name, "reachable, token accepted", "")
+			case errors.Is(err, client.ErrUnauthorized):
+				d.report(checkFail, name, err.Error(), "Check AGENTHQ_AUTH_TOKEN (or the server's token in the config file).")
+			default:
+				d.report(checkFail, name, err.Error(), "Check the URL (AGENTHQ_SERVER_URL or the config file) and that the server is running and reachable from here.")
+			}
+		}
+	}
+}
+
+// checkBackends checks the tmux and docker session backends. They are
+// optional unless the config makes one the default.
+func (d *doctor) checkBackends(cfg *config.Config) {
+	status := func(backend string) checkStatus {
+		if cfg.SessionBackend == backend {
+			return checkFail
+		}
+		return checkWarn
+	}
+
+	if _, err := tmux.NewServer(tmux.SocketName); err != nil {
+		d.report(status(session.BackendTmux), "tmux backend", err.Error(), "Install tmux for sessions that survive daemon restarts.")
+	} else {
+		d.report(checkOK, "tmux backend", "available", "")
+	}
+
+	dockerClient, err := docker.NewClient(cfg.Docker.Host, cfg.Docker.Engine, cfg.Docker.CertPath)
+	if err != nil {
+		d.report(status(session.BackendDocker), "docker backend", err.Error(), "Fix docker.host in the config file.")
+		return
+	}
+	defer dockerClient.Close()
+	engine, err := dockerClient.Detect()
+	if err != nil {
+		d.report(status(session.BackendDocker), "docker backend", err.Error(), "Start Docker or Podman, or set docker.host, for sandboxed sessions.")
+		return
+	}
+	d.report(checkOK, "docker backend", fmt.Sprintf("%s at %s", engine, dockerClient.Host()), "")
+}
+
+// checkClipboard checks the host's clipboard, if the config bridges it.
+func (d *doctor) checkClipboard(cfg *config.Config) {
+	if !cfg.Clipboard.Get && !cfg.Clipboard.Set {
+		return
+	}
+	if err := clipboard.Available(); err != nil {
+		d.report(checkWarn, "clipboard", err.Error(), "Run the daemon in a desktop session with pbcopy, wl-clipboard, xclip or xsel installed, or turn off clipboard in the config file.")
+		return
+	}
+	d.report(checkOK, "clipboard", "available", "")
+}
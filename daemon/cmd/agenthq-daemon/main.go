@@ -2,336 +2,132 @@
 package main
 
 import (
-	"encoding/base64"
 	"flag"
-	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/agenthq/daemon/internal/client"
-	"github.com/agenthq/daemon/internal/protocol"
-	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/console"
+	"github.com/agenthq/daemon/pkg/agenthqd"
 )
 
 var version = "dev"
 
-// Global workspace path
-var workspace string
+// restartGrace bounds the shutdown before a watchdog restart; whatever is
+// wedged may keep it from finishing.
+const restartGrace = 10 * time.Second
 
 func main() {
-	// Parse command line flags
-	flag.StringVar(&workspace, "workspace", "", "Workspace directory containing repositories")
-	flag.Parse()
-
-	// Get server URL from environment
-	serverURL := os.Getenv("AGENTHQ_SERVER_URL")
-	if serverURL == "" {
-		serverURL = "ws://localhost:3000/ws/daemon"
+	// "serve" is the default subcommand; accept it explicitly too
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
 	}
-
-	// Get auth token for remote connections
-	authToken := os.Getenv("AGENTHQ_AUTH_TOKEN")
-
-	// Get environment ID from environment variable or generate one
-	hostname, _ := os.Hostname()
-	envID := os.Getenv("AGENTHQ_ENV_ID")
-	if envID == "" {
-		envID = fmt.Sprintf("daemon-%s-%d", hostname, time.Now().Unix())
+	if len(args) > 0 && args[0] == "protocol-schema" {
+		printProtocolSchema()
+		return
 	}
-	envName := hostname
-
-	log.Printf("Agent HQ Daemon %s", version)
-	log.Printf("Environment: %s (%s)", envName, envID)
-	log.Printf("Connecting to: %s", serverURL)
-	if authToken != "" {
-		log.Printf("Auth token: configured")
+	if len(args) > 0 && args[0] == "doctor" {
+		os.Exit(runDoctor(args[1:]))
 	}
-	if workspace != "" {
-		log.Printf("Workspace: %s", workspace)
+	if len(args) > 0 && args[0] == "replay" {
+		os.Exit(runReplay(args[1:]))
 	}
-
-	var wsClient *client.Client
-	var sessionMgr *session.Manager
-
-	// Create session manager with callbacks
-	sessionMgr = session.NewManager(
-		// onData callback - send PTY output to server
-		func(processID string, data []byte) {
-			// Encode as base64 to safely transmit binary data
-			encoded := base64.StdEncoding.EncodeToString(data)
-			wsClient.Send(protocol.DaemonMessage{
-				Type:      protocol.MsgTypePtyData,
-				ProcessID: processID,
-				Data:      encoded,
-			})
-		},
-		// onExit callback - notify server of process exit
-		func(processID string, exitCode int) {
-			wsClient.Send(protocol.DaemonMessage{
-				Type:      protocol.MsgTypeProcessExit,
-				ProcessID: processID,
-				ExitCode:  exitCode,
-			})
-		},
-	)
-
-	// Channel to signal reconnection needed
-	reconnectChan := make(chan struct{}, 1)
-
-	// Create WebSocket client with reconnect callback
-	wsClient = client.New(serverURL, authToken, envID, envName, workspace,
-		func(msg protocol.ServerMessage) {
-			handleServerMessage(wsClient, sessionMgr, msg)
-		},
-		func() {
-			// Signal reconnection needed (non-blocking)
-			select {
-			case reconnectChan <- struct{}{}:
-			default:
-			}
-		},
-	)
-
-	// Handle shutdown signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Connection loop with auto-reconnect
-	go func() {
-		for {
-			// Connect with retry
-			for {
-				if err := wsClient.Connect(); err != nil {
-					log.Printf("Failed to connect: %v. Retrying in 5s...", err)
-					time.Sleep(5 * time.Second)
-					continue
-				}
-				log.Printf("Connected to server")
-				break
-			}
-
-			// Wait for disconnection or shutdown
-			select {
-			case <-reconnectChan:
-				log.Printf("Disconnected. Reconnecting in 2s...")
-				time.Sleep(2 * time.Second)
-				// For sprites environments, keep the same ID
-				// For local, generate new one if not explicitly set
-				if os.Getenv("AGENTHQ_ENV_ID") == "" {
-					envID = fmt.Sprintf("daemon-%s-%d", hostname, time.Now().Unix())
-				}
-				wsClient = client.New(serverURL, authToken, envID, envName, workspace,
-					func(msg protocol.ServerMessage) {
-						handleServerMessage(wsClient, sessionMgr, msg)
-					},
-					func() {
-						select {
-						case reconnectChan <- struct{}{}:
-						default:
-						}
-					},
-				)
-			case <-sigChan:
-				return
-			}
-		}
-	}()
-
-	<-sigChan
-	log.Println("Shutting down...")
-
-	// Clean up
-	sessionMgr.KillAll()
-	wsClient.Close()
-}
-
-func handleServerMessage(wsClient *client.Client, mgr *session.Manager, msg protocol.ServerMessage) {
-	switch msg.Type {
-	case protocol.MsgTypeCreateWorktree:
-		log.Printf("Create worktree request: worktreeId=%s repoName=%s", msg.WorktreeID, msg.RepoName)
-		go createWorktree(wsClient, msg.WorktreeID, msg.RepoName, msg.RepoPath)
-
-	case protocol.MsgTypeSpawn:
-		log.Printf("Spawn request: processId=%s agent=%s cols=%d rows=%d yoloMode=%v", msg.ProcessID, msg.Agent, msg.Cols, msg.Rows, msg.YoloMode)
-		if err := mgr.Spawn(msg.ProcessID, msg.Agent, msg.WorktreePath, msg.Task, msg.Cols, msg.Rows, msg.YoloMode); err != nil {
-			log.Printf("Failed to spawn process: %v", err)
-		} else {
-			// Notify server that process started successfully
-			wsClient.Send(protocol.DaemonMessage{
-				Type:      protocol.MsgTypeProcessStarted,
-				ProcessID: msg.ProcessID,
-			})
-			sendPtySize(wsClient, mgr, msg.ProcessID)
-		}
-
-	case protocol.MsgTypePtyInput:
-		// Decode base64 input
-		data, err := base64.StdEncoding.DecodeString(msg.Data)
-		if err != nil {
-			log.Printf("Failed to decode input: %v", err)
-			return
-		}
-		if err := mgr.Input(msg.ProcessID, data); err != nil {
-			log.Printf("Failed to send input: %v", err)
-		}
-
-	case protocol.MsgTypeResize:
-		if err := mgr.Resize(msg.ProcessID, msg.Cols, msg.Rows); err != nil {
-			log.Printf("Failed to resize: %v", err)
-		} else {
-			sendPtySize(wsClient, mgr, msg.ProcessID)
-		}
-
-	case protocol.MsgTypeQueryPtySize:
-		sendPtySize(wsClient, mgr, msg.ProcessID)
-
-	case protocol.MsgTypeKill:
-		log.Printf("Kill request: processId=%s", msg.ProcessID)
-		if err := mgr.Kill(msg.ProcessID); err != nil {
-			log.Printf("Failed to kill process: %v", err)
-		}
-
-	case protocol.MsgTypeRemoveWorktree:
-		log.Printf("Remove worktree request: worktreeId=%s path=%s", msg.WorktreeID, msg.WorktreePath)
-		go removeWorktree(msg.WorktreePath)
-
-	case protocol.MsgTypeListRepos:
-		log.Printf("List repos request")
-		repos := scanWorkspace()
-		wsClient.Send(protocol.DaemonMessage{
-			Type:  protocol.MsgTypeReposList,
-			Repos: repos,
-		})
-
-	default:
-		log.Printf("Unknown message type: %s", msg.Type)
+	if len(args) > 0 && args[0] == "pair" {
+		os.Exit(runPair(args[1:]))
 	}
-}
 
-func sendPtySize(wsClient *client.Client, mgr *session.Manager, processID string) {
-	cols, rows, err := mgr.Size(processID)
+	// Parse command line flags
+	opts := agenthqd.Options{Version: version}
+	flag.StringVar(&opts.Workspace, "workspace", "", "Workspace directory containing repositories")
+	configPath := flag.String("config", agenthqd.DefaultConfigPath(), "Path to daemon config file (JSON)")
+	flag.BoolVar(&opts.Local, "local", false, "Serve the protocol locally instead of connecting to a server")
+	flag.BoolVar(&opts.API, "api", false, "Serve the REST API on the control listener (requires --token)")
+	flag.StringVar(&opts.Listen, "listen", "localhost:7777", "Control listener address for --local and --api")
+	flag.StringVar(&opts.Token, "token", os.Getenv("AGENTHQ_LOCAL_TOKEN"), "Token clients of the control listener must present")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Report what spawns, kills and worktree removals would do instead of doing them")
+	flag.BoolVar(&opts.Discover, "discover", false, "Find the server on the local network (mDNS service _agenthq._tcp) instead of using AGENTHQ_SERVER_URL")
+	flag.StringVar(&opts.CredentialStore, "credential-store", client.StoreAuto, "Where server tokens are kept: keychain (moving AGENTHQ_AUTH_TOKEN and config file tokens there), file, or auto (the keychain if available)")
+	flag.StringVar(&opts.RecordProtocol, "record-protocol", "", "Append every protocol message sent and received to this file, for replay")
+	color := flag.String("color", console.ColorAuto, "Color the log, tagging each session's records in a color of its own: auto (when logging to a terminal), always or never")
+	echoSessions := flag.Bool("echo-sessions", false, "Echo sessions' output into the log, a line at a time")
+	flag.CommandLine.Parse(args)
+
+	useColor, err := console.UseColor(*color, os.Stderr)
 	if err != nil {
-		log.Printf("Failed to get PTY size for process %s: %v", processID, err)
-		return
+		log.Fatalf("--color: %v", err)
 	}
-
-	wsClient.Send(protocol.DaemonMessage{
-		Type:      protocol.MsgTypePtySize,
-		ProcessID: processID,
-		Cols:      cols,
-		Rows:      rows,
-	})
-}
-
-// createWorktree creates a new git worktree
-func createWorktree(wsClient *client.Client, worktreeID, repoName, repoPath string) {
-	worktreesDir := filepath.Join(repoPath, ".agenthq-worktrees")
-	worktreePath := filepath.Join(worktreesDir, worktreeID)
-	branch := fmt.Sprintf("agent/%s", worktreeID)
-
-	// Create the worktrees directory if it doesn't exist
-	if err := os.MkdirAll(worktreesDir, 0755); err != nil {
-		log.Printf("Failed to create worktrees directory: %v", err)
-		return
+	logOutput := console.New(os.Stderr, useColor)
+	log.SetOutput(logOutput)
+	if *echoSessions {
+		opts.OnOutput = logOutput.Echo
+		opts.OnExit = func(processID string, _ agenthqd.ExitInfo) { logOutput.Exited(processID) }
 	}
 
-	// Create the git worktree
-	cmd := exec.Command("git", "worktree", "add", worktreePath, "-b", branch)
-	cmd.Dir = repoPath
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Failed to create worktree: %v\n%s", err, output)
-		return
+	if opts.API && opts.Token == "" {
+		log.Fatalf("--api requires --token (or AGENTHQ_LOCAL_TOKEN)")
 	}
 
-	log.Printf("Created worktree %s at %s", worktreeID, worktreePath)
-
-	// Notify server that worktree is ready
-	wsClient.Send(protocol.DaemonMessage{
-		Type:       protocol.MsgTypeWorktreeReady,
-		WorktreeID: worktreeID,
-		Path:       worktreePath,
-		Branch:     branch,
-	})
-}
-
-// removeWorktree removes a git worktree
-func removeWorktree(worktreePath string) {
-	if worktreePath == "" {
-		log.Printf("Cannot remove worktree: empty path")
-		return
+	cfg, err := agenthqd.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
 	}
+	opts.Config = cfg
+	opts.ConfigPath = *configPath
 
-	// Get the parent repo path (two levels up from .agenthq-worktrees/<id>)
-	repoPath := filepath.Dir(filepath.Dir(worktreePath))
-
-	cmd := exec.Command("git", "worktree", "remove", "--force", worktreePath)
-	cmd.Dir = repoPath
-	output, err := cmd.CombinedOutput()
+	daemon, err := agenthqd.New(opts)
 	if err != nil {
-		log.Printf("Failed to remove worktree: %v\n%s", err, output)
-		return
+		log.Fatalf("%v", err)
 	}
 
-	log.Printf("Removed worktree at %s", worktreePath)
-}
-
-// scanWorkspace scans the workspace directory for git repositories
-func scanWorkspace() []protocol.RepoInfo {
-	var repos []protocol.RepoInfo
-
-	if workspace == "" {
-		log.Printf("No workspace configured, returning empty repos list")
-		return repos
-	}
+	// Handle shutdown signals; SIGUSR1, like POST /api/drain, drains first.
+	// SIGHUP reloads the config.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	drainChan := make(chan os.Signal, 1)
+	signal.Notify(drainChan, syscall.SIGUSR1)
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
 
-	entries, err := os.ReadDir(workspace)
-	if err != nil {
-		log.Printf("Failed to read workspace directory: %v", err)
-		return repos
+	if err := daemon.Start(); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	for _, entry := range entries {
-		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+	for {
+		select {
+		case <-drainChan:
+			daemon.Drain()
 			continue
+		case <-reloadChan:
+			if _, err := daemon.Reload(); err != nil {
+				log.Printf("Config reload failed: %v", err)
+			}
+			continue
+		case <-daemon.Drained():
+			log.Println("Shutting down after draining...")
+			daemon.Stop()
+		case <-sigChan:
+			log.Println("Shutting down...")
+			daemon.Stop()
+		case trip := <-daemon.WatchdogTrips():
+			log.Printf("Restarting after watchdog trip: %s: %s", trip.Check, trip.Reason)
+			done := make(chan struct{})
+			go func() {
+				daemon.Stop()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(restartGrace):
+				log.Printf("Shutdown didn't finish in %s; restarting anyway", restartGrace)
+			}
+			if err := agenthqd.RestartProcess(); err != nil {
+				log.Fatalf("Failed to restart: %v", err)
+			}
 		}
-
-		repoPath := filepath.Join(workspace, entry.Name())
-		gitPath := filepath.Join(repoPath, ".git")
-
-		// Check if it's a git repo
-		if info, err := os.Stat(gitPath); err == nil && info.IsDir() {
-			defaultBranch := getDefaultBranch(repoPath)
-			repos = append(repos, protocol.RepoInfo{
-				Name:          entry.Name(),
-				Path:          repoPath,
-				DefaultBranch: defaultBranch,
-			})
-		}
-	}
-
-	log.Printf("Found %d repositories in workspace", len(repos))
-	return repos
-}
-
-// getDefaultBranch reads the default branch from .git/HEAD
-func getDefaultBranch(repoPath string) string {
-	headPath := filepath.Join(repoPath, ".git", "HEAD")
-	content, err := os.ReadFile(headPath)
-	if err != nil {
-		return "main"
-	}
-
-	line := strings.TrimSpace(string(content))
-	if strings.HasPrefix(line, "ref: refs/heads/") {
-		return strings.TrimPrefix(line, "ref: refs/heads/")
+		return
 	}
-
-	return "main"
 }
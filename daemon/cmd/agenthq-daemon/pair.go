@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/qr"
+)
+
+// runPair pairs the daemon with a server: it shows a one-time code to
+// approve in the server UI, waits for the approval and stores the
+// credential the server issues, which the daemon then uses for that
+// server. It returns the exit status.
+func runPair(args []string) int {
+	hostname, _ := os.Hostname()
+	defaultServer, _, _ := strings.Cut(os.Getenv("AGENTHQ_SERVER_URL"), ",")
+	if defaultServer == "" {
+		defaultServer = "ws://localhost:3000/ws/daemon"
+	}
+	flags := flag.NewFlagSet("pair", flag.ExitOnError)
+	server := flags.String("server", strings.TrimSpace(defaultServer), "Server URL to pair with, as for AGENTHQ_SERVER_URL")
+	name := flags.String("name", hostname, "Name the server shows for this daemon")
+	noQR := flags.Bool("no-qr", false, "Don't print the approval URL as a QR code")
+	storeFlag := flags.String("credential-store", client.StoreAuto, "Where the token is kept: keychain, file, or auto (the keychain if available)")
+	flags.Parse(args)
+
+	store, err := client.ResolveStore(*storeFlag)
+	if err != nil {
+		log.Printf("Pair: credential store: %v", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	code, err := client.RequestDeviceCode(ctx, *server, *name)
+	if err != nil {
+		log.Printf("Pair: %v", err)
+		return 1
+	}
+
+	fmt.Printf("To pair %q with %s, open\n\n    %s\n\nand confirm the code\n\n    %s\n\n", *name, *server, code.ApprovalURL(), code.UserCode)
+	if !*noQR {
+		if symbol, err := qr.Encode(code.ApprovalURL()); err == nil {
+			fmt.Printf("or scan:\n\n%s\n", symbol.Terminal())
+		}
+	}
+	if code.ExpiresIn > 0 {
+		fmt.Printf("Waiting for approval (the code expires in %s)...\n", time.Duration(code.ExpiresIn)*time.Second)
+	} else {
+		fmt.Println("Waiting for approval...")
+	}
+
+	cred, err := client.PollDeviceToken(ctx, *server, code)
+	if errors.Is(err, client.ErrPairingDenied) || errors.Is(err, client.ErrPairingExpired) {
+		fmt.Printf("Not paired: %v\n", err)
+		return 1
+	}
+	if err != nil {
+		log.Printf("Pair: %v", err)
+		return 1
+	}
+	credentials := client.DefaultCredentialsPath()
+	if err := client.SaveCredential(credentials, store, *cred); err != nil {
+		log.Printf("Pair: storing the credential: %v", err)
+		return 1
+	}
+
+	if store == client.StoreKeychain {
+		fmt.Printf("Paired. The token is stored in the keychain, the rest of the credential in %s", credentials)
+	} else {
+		fmt.Printf("Paired. The credential is stored in %s", credentials)
+	}
+	if len(cred.Scopes) > 0 {
+		fmt.Printf(" (scopes: %s)", strings.Join(cred.Scopes, ", "))
+	}
+	fmt.Println(".")
+	return 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/traffic"
+	"github.com/gorilla/websocket"
+)
+
+// replayConnectTimeout bounds how long replay waits for its daemon to
+// start and register.
+const replayConnectTimeout = 30 * time.Second
+
+// runReplay plays the messages servers sent in a protocol recording
+// (--record-protocol) to a new daemon, with the recorded timing, and prints
+// what the daemon sends back as JSON lines. Daemon flags after the
+// recording are passed on. It returns the exit status.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "Replay this many times faster than recorded; 0 sends every message at once")
+	grace := flags.Duration("grace", 5*time.Second, "How long the daemon keeps running after the last message")
+	server := flags.String("server", "", "Only replay messages from this server URL (default: all)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: agenthq-daemon replay [flags] recording [-- daemon flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	records, err := traffic.Read(flags.Arg(0))
+	if err != nil {
+		log.Printf("Replay: %v", err)
+		return 1
+	}
+	var inbound []traffic.Record
+	for _, r := range records {
+		if r.Dir == traffic.In && (*server == "" || r.Server == *server) {
+			inbound = append(inbound, r)
+		}
+	}
+	daemonArgs := flags.Args()[1:]
+	if len(daemonArgs) > 0 && daemonArgs[0] == "--" {
+		daemonArgs = daemonArgs[1:]
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("Replay: %v", err)
+		return 1
+	}
+	defer ln.Close()
+	conns := make(chan *websocket.Conn, 1)
+	go http.Serve(ln, replayHandler(conns))
+
+	// The daemon connects only to the replay, without a config file's
+	// servers, token or signing
+	dir, err := os.MkdirTemp("", "agenthq-replay-")
+	if err != nil {
+		log.Printf("Replay: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, []byte("{}"), 0o600); err != nil {
+		log.Printf("Replay: %v", err)
+		return 1
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Replay: %v", err)
+		return 1
+	}
+	cmd := exec.Command(exe, slices.Concat([]string{"serve", "--config", configPath}, daemonArgs)...)
+	cmd.Env = append(os.Environ(),
+		"AGENTHQ_SERVER_URL=ws://"+ln.Addr().String()+"/ws/daemon",
+		"AGENTHQ_AUTH_TOKEN=",
+		"AGENTHQ_SIGNING_SECRET=",
+	)
+	// Stdout is for the daemon's messages
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Printf("Replay: starting daemon: %v", err)
+		return 1
+	}
+	defer func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+	}()
+
+	var conn *websocket.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(replayConnectTimeout):
+		log.Printf("Replay: the daemon did not register within %s", replayConnectTimeout)
+		return 1
+	}
+
+	log.Printf("Replay: sending %d messages", len(inbound))
+	for i, r := range inbound {
+		if i > 0 && *speed > 0 {
+			time.Sleep(time.Duration(float64(r.Time-inbound[i-1].Time) / *speed * float64(time.Millisecond)))
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, r.Raw()); err != nil {
+			log.Printf("Replay: daemon disconnected after %d messages: %v", i, err)
+			return 1
+		}
+	}
+	log.Printf("Replay: done; stopping the daemon in %s", *grace)
+	time.Sleep(*grace)
+	return 0
+}
+
+// replayHandler serves the daemon replay starts. It prints every message
+// the daemon sends and hands over the connection once the daemon has
+// registered; later connections are only printed, not replayed to.
+func replayHandler(conns chan<- *websocket.Conn) http.Handler {
+	var (
+		mu       sync.Mutex
+		upgrader websocket.Upgrader
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		chunks := protocol.NewReassembler()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if chunk, ok := protocol.ParseChunk(data); ok {
+				if data, err = chunks.Add(chunk); err != nil || data == nil {
+					continue
+				}
+			}
+
+			mu.Lock()
+			os.Stdout.Write(append(data, '\n'))
+			mu.Unlock()
+
+			if msg, err := protocol.DecodeDaemonMessage(data); err == nil && msg.Type == protocol.MsgTypeRegister {
+				select {
+				case conns <- conn:
+				default:
+				}
+			}
+		}
+	})
+}
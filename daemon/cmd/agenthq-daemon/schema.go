@@ -0,0 +1,19 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// printProtocolSchema prints the protocol's JSON Schema, for generating the
+// server's message types.
+func printProtocolSchema() {
+	out, err := json.MarshalIndent(protocol.Schema(), "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode protocol schema: %v", err)
+	}
+	os.Stdout.Write(append(out, '\n'))
+}
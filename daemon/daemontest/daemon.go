@@ -0,0 +1,128 @@
+package daemontest
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Daemon is a fake daemon connected to a server under test. It sends what
+// the test tells it to and records what the server sends.
+type Daemon struct {
+	t     testing.TB
+	inbox *inbox[protocol.ServerMessage]
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// Dial connects a fake daemon to the server at url, with token if it isn't
+// empty, and registers with register. Its type is set, and envId, envName
+// and capabilities default to a bash-only "daemontest" environment. The
+// connection is closed when the test ends.
+func Dial(t testing.TB, url, token string, register protocol.DaemonMessage) *Daemon {
+	t.Helper()
+	conn, _, err := client.Dial(url, token)
+	if err != nil {
+		t.Fatalf("daemontest: connecting to %s: %v", url, err)
+	}
+
+	d := &Daemon{
+		t:     t,
+		inbox: newInbox(func(m protocol.ServerMessage) string { return m.Type }),
+		conn:  conn,
+	}
+	t.Cleanup(d.Close)
+	go d.readLoop()
+
+	register.Type = protocol.MsgTypeRegister
+	if register.EnvID == "" {
+		register.EnvID = "daemontest"
+	}
+	if register.EnvName == "" {
+		register.EnvName = "daemontest"
+	}
+	if register.Capabilities == nil {
+		register.Capabilities = []string{string(protocol.AgentBash)}
+	}
+	d.Send(register)
+	return d
+}
+
+func (d *Daemon) readLoop() {
+	chunks := protocol.NewReassembler()
+	for {
+		_, data, err := d.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if chunk, ok := protocol.ParseChunk(data); ok {
+			if data, err = chunks.Add(chunk); err != nil {
+				d.t.Errorf("daemontest: bad chunk from server: %v", err)
+				continue
+			}
+			if data == nil {
+				continue
+			}
+		}
+
+		msg, err := protocol.DecodeServerMessage(data)
+		if err != nil {
+			d.t.Errorf("daemontest: server sent %s: %v", data, err)
+			continue
+		}
+		d.inbox.add(msg)
+	}
+}
+
+// Close disconnects from the server.
+func (d *Daemon) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conn.Close()
+}
+
+// Send sends msg to the server. Messages are sent as they are, so a test
+// can also send ones a real daemon never would.
+func (d *Daemon) Send(msg protocol.DaemonMessage) {
+	d.t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		d.t.Fatalf("daemontest: %v", err)
+	}
+	d.mu.Lock()
+	err = d.conn.WriteMessage(websocket.TextMessage, data)
+	d.mu.Unlock()
+	if err != nil {
+		d.t.Fatalf("daemontest: sending to server: %v", err)
+	}
+}
+
+// Expect waits for the next message of type msgType that match accepts (a
+// nil match accepts any) and returns it, as Server.Expect does.
+func (d *Daemon) Expect(msgType string, match func(protocol.ServerMessage) bool) protocol.ServerMessage {
+	d.t.Helper()
+	msg, ok := d.inbox.expect(func(m protocol.ServerMessage) bool {
+		return m.Type == msgType && (match == nil || match(m))
+	})
+	if !ok {
+		d.t.Fatalf("daemontest: no matching %s within %s; pending: %s", msgType, Timeout, d.inbox.pendingTypes())
+	}
+	return msg
+}
+
+// Messages returns every message the server sent so far, expected or not.
+func (d *Daemon) Messages() []protocol.ServerMessage {
+	return d.inbox.messages()
+}
+
+// Ack acknowledges a server request as the daemon does once it is done,
+// with errMsg as its error if it isn't empty.
+func (d *Daemon) Ack(msg protocol.ServerMessage, errMsg string) {
+	d.t.Helper()
+	d.Send(protocol.DaemonMessage{Type: protocol.MsgTypeAck, RequestID: msg.RequestID, Error: errMsg})
+}
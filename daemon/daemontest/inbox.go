@@ -0,0 +1,104 @@
+// Package daemontest helps test the daemon protocol end to end. Server is a
+// protocol server for integration tests of the daemon, with helpers for
+// the usual flows (spawn, input, resize, kill) and for waiting on the
+// messages the daemon sends. Daemon is the other side: a fake daemon for
+// testing servers that implement the protocol.
+//
+// Both check every message they receive strictly against the protocol
+// (see protocol.DecodeDaemonMessage) and fail the test on one that doesn't
+// match, so tests also guard the wire format.
+package daemontest
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout is how long helpers wait for an expected message before failing
+// the test.
+var Timeout = 10 * time.Second
+
+// inbox holds the messages received on a connection. Expect takes them out
+// in order, so a test can wait for each message it cares about while
+// others arrive in between.
+type inbox[M any] struct {
+	mu      sync.Mutex
+	all     []M
+	pending []M
+	changed chan struct{}
+	// typeOf returns a message's type, for failures
+	typeOf func(M) string
+}
+
+func newInbox[M any](typeOf func(M) string) *inbox[M] {
+	return &inbox[M]{changed: make(chan struct{}), typeOf: typeOf}
+}
+
+// add records a received message and wakes waiters.
+func (in *inbox[M]) add(msg M) {
+	in.mu.Lock()
+	in.all = append(in.all, msg)
+	in.pending = append(in.pending, msg)
+	close(in.changed)
+	in.changed = make(chan struct{})
+	in.mu.Unlock()
+}
+
+// messages returns every message received so far, expected or not.
+func (in *inbox[M]) messages() []M {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]M(nil), in.all...)
+}
+
+// expect waits for the first pending message match accepts, takes it out
+// and returns it; ok is false if none arrives within Timeout.
+func (in *inbox[M]) expect(match func(M) bool) (msg M, ok bool) {
+	deadline := timeAfter()
+	for {
+		in.mu.Lock()
+		for i, m := range in.pending {
+			if match(m) {
+				in.pending = append(in.pending[:i], in.pending[i+1:]...)
+				in.mu.Unlock()
+				return m, true
+			}
+		}
+		changed := in.changed
+		in.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return msg, false
+		}
+	}
+}
+
+// wait returns a channel closed when the next message is received.
+func (in *inbox[M]) wait() <-chan struct{} {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.changed
+}
+
+// pendingTypes lists the types of the messages not yet expected, for
+// failures.
+func (in *inbox[M]) pendingTypes() string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.pending) == 0 {
+		return "none"
+	}
+	types := make([]string, len(in.pending))
+	for i, m := range in.pending {
+		types[i] = in.typeOf(m)
+	}
+	return strings.Join(types, ", ")
+}
+
+// timeAfter returns a channel that fires after Timeout.
+func timeAfter() <-chan time.Time {
+	return time.After(Timeout)
+}
@@ -0,0 +1,268 @@
+package daemontest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Server is a protocol server on a loopback port for a daemon under test
+// to connect to. It talks to the daemon that connected last.
+type Server struct {
+	// URL is the WebSocket URL for the daemon (AGENTHQ_SERVER_URL).
+	URL string
+
+	t     testing.TB
+	token string
+	http  *httptest.Server
+	inbox *inbox[protocol.DaemonMessage]
+
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	connected chan struct{}
+	// output is the terminal output of each process so far
+	output map[string][]byte
+
+	requestID atomic.Uint64
+}
+
+// NewServer starts a server that requires token of daemons, unless it is
+// empty. It is closed when the test ends.
+func NewServer(t testing.TB, token string) *Server {
+	s := &Server{
+		t:         t,
+		token:     token,
+		inbox:     newInbox(func(m protocol.DaemonMessage) string { return m.Type }),
+		connected: make(chan struct{}),
+		output:    make(map[string][]byte),
+	}
+	s.http = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = "ws" + strings.TrimPrefix(s.http.URL, "http") + "/ws/daemon"
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Env returns the environment variables that point a daemon at the server.
+func (s *Server) Env() []string {
+	env := []string{"AGENTHQ_SERVER_URL=" + s.URL}
+	if s.token != "" {
+		env = append(env, "AGENTHQ_AUTH_TOKEN="+s.token)
+	}
+	return env
+}
+
+// Close disconnects the daemon and stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	s.http.Close()
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && r.URL.Query().Get("token") != s.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = conn
+	select {
+	case <-s.connected:
+	default:
+		close(s.connected)
+	}
+	s.mu.Unlock()
+
+	chunks := protocol.NewReassembler()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if chunk, ok := protocol.ParseChunk(data); ok {
+			if data, err = chunks.Add(chunk); err != nil {
+				s.t.Errorf("daemontest: bad chunk from daemon: %v", err)
+				continue
+			}
+			if data == nil {
+				continue
+			}
+		}
+
+		msg, err := protocol.DecodeDaemonMessage(data)
+		if err != nil {
+			s.t.Errorf("daemontest: daemon sent %s: %v", data, err)
+			continue
+		}
+		if msg.Type == protocol.MsgTypePtyData && !msg.Snapshot {
+			if b, err := base64.StdEncoding.DecodeString(msg.Data); err == nil {
+				s.mu.Lock()
+				s.output[msg.ProcessID] = append(s.output[msg.ProcessID], b...)
+				s.mu.Unlock()
+			}
+		}
+		s.inbox.add(msg)
+	}
+}
+
+// WaitRegister waits for a daemon to connect and returns its register
+// message.
+func (s *Server) WaitRegister() protocol.DaemonMessage {
+	s.t.Helper()
+	return s.Expect(protocol.MsgTypeRegister, nil)
+}
+
+// Send sends msg to the daemon, waiting for one to connect first.
+func (s *Server) Send(msg protocol.ServerMessage) {
+	s.t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.t.Fatalf("daemontest: %v", err)
+	}
+	s.SendRaw(data)
+}
+
+// SendRaw sends data to the daemon as is, e.g. to test how it handles
+// messages that aren't valid.
+func (s *Server) SendRaw(data []byte) {
+	s.t.Helper()
+	select {
+	case <-s.connected:
+	case <-timeAfter():
+		s.t.Fatalf("daemontest: no daemon connected within %s", Timeout)
+	}
+
+	s.mu.Lock()
+	err := s.conn.WriteMessage(websocket.TextMessage, data)
+	s.mu.Unlock()
+	if err != nil {
+		s.t.Fatalf("daemontest: sending to daemon: %v", err)
+	}
+}
+
+// Request sends msg with a requestId, unless it has one, and waits for its
+// ack, which it returns.
+func (s *Server) Request(msg protocol.ServerMessage) protocol.DaemonMessage {
+	s.t.Helper()
+	if msg.RequestID == "" {
+		msg.RequestID = "daemontest-" + strconv.FormatUint(s.requestID.Add(1), 10)
+	}
+	s.Send(msg)
+	return s.Expect(protocol.MsgTypeAck, func(m protocol.DaemonMessage) bool {
+		return m.RequestID == msg.RequestID
+	})
+}
+
+// Expect waits for the next message of type msgType that match accepts (a
+// nil match accepts any) and returns it. Messages it passes over are kept
+// for later calls. The test fails if none arrives within Timeout.
+func (s *Server) Expect(msgType string, match func(protocol.DaemonMessage) bool) protocol.DaemonMessage {
+	s.t.Helper()
+	msg, ok := s.inbox.expect(func(m protocol.DaemonMessage) bool {
+		return m.Type == msgType && (match == nil || match(m))
+	})
+	if !ok {
+		s.t.Fatalf("daemontest: no matching %s within %s; pending: %s", msgType, Timeout, s.inbox.pendingTypes())
+	}
+	return msg
+}
+
+// ExpectFor is Expect for a message about processID.
+func (s *Server) ExpectFor(msgType, processID string) protocol.DaemonMessage {
+	s.t.Helper()
+	return s.Expect(msgType, func(m protocol.DaemonMessage) bool { return m.ProcessID == processID })
+}
+
+// Messages returns every message the daemon sent so far, expected or not.
+func (s *Server) Messages() []protocol.DaemonMessage {
+	return s.inbox.messages()
+}
+
+// Output returns the terminal output of processID so far.
+func (s *Server) Output(processID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.output[processID])
+}
+
+// ExpectOutput waits until the terminal output of processID contains want,
+// returning the output.
+func (s *Server) ExpectOutput(processID, want string) string {
+	s.t.Helper()
+	deadline := timeAfter()
+	for {
+		// Output is added before its pty-data, so none is missed between
+		// the two
+		changed := s.inbox.wait()
+		if out := s.Output(processID); strings.Contains(out, want) {
+			return out
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			s.t.Fatalf("daemontest: output of %s has no %q within %s; output: %q", processID, want, Timeout, s.Output(processID))
+		}
+	}
+}
+
+// Spawn starts a session, defaulting the terminal to 80x24, and returns its
+// process-started message. The test fails if the spawn does.
+func (s *Server) Spawn(msg protocol.ServerMessage) protocol.DaemonMessage {
+	s.t.Helper()
+	msg.Type = protocol.MsgTypeSpawn
+	if msg.Cols <= 0 || msg.Rows <= 0 {
+		msg.Cols, msg.Rows = 80, 24
+	}
+	if ack := s.Request(msg); ack.Error != "" {
+		s.t.Fatalf("daemontest: spawn %s: %s", msg.ProcessID, ack.Error)
+	}
+	return s.ExpectFor(protocol.MsgTypeProcessStarted, msg.ProcessID)
+}
+
+// Input types data into processID's terminal.
+func (s *Server) Input(processID, data string) {
+	s.t.Helper()
+	s.Send(protocol.ServerMessage{
+		Type:      protocol.MsgTypePtyInput,
+		ProcessID: processID,
+		Data:      base64.StdEncoding.EncodeToString([]byte(data)),
+	})
+}
+
+// Resize resizes processID's terminal and waits for the daemon to report
+// the new size.
+func (s *Server) Resize(processID string, cols, rows int) {
+	s.t.Helper()
+	s.Send(protocol.ServerMessage{Type: protocol.MsgTypeResize, ProcessID: processID, Cols: cols, Rows: rows})
+	s.Expect(protocol.MsgTypePtySize, func(m protocol.DaemonMessage) bool {
+		return m.ProcessID == processID && m.Cols == cols && m.Rows == rows
+	})
+}
+
+// Kill kills processID and returns its process-exit message.
+func (s *Server) Kill(processID string) protocol.DaemonMessage {
+	s.t.Helper()
+	if ack := s.Request(protocol.ServerMessage{Type: protocol.MsgTypeKill, ProcessID: processID}); ack.Error != "" {
+		s.t.Fatalf("daemontest: kill %s: %s", processID, ack.Error)
+	}
+	return s.ExpectFor(protocol.MsgTypeProcessExit, processID)
+}
@@ -0,0 +1,265 @@
+// Package agent describes the agent CLIs the daemon can launch and the named
+// profiles layered on top of them.
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Spec describes how to launch an agent CLI.
+type Spec struct {
+	// Command is the shell command that starts the agent.
+	Command string
+	// YoloFlags disable the agent's permission prompts.
+	YoloFlags string
+	// PromptFlag precedes the initial prompt; empty means positional.
+	PromptFlag string
+	// ModelFlag selects the model; empty means the agent has no model choice.
+	ModelFlag string
+	// HeadlessArgs run the agent non-interactively: it works on the prompt
+	// and exits. They directly follow Command (codex uses a subcommand).
+	HeadlessArgs string
+	// HeadlessYoloFlags replace YoloFlags in headless mode, if set.
+	HeadlessYoloFlags string
+
+	// SessionIDFlag assigns a caller-chosen conversation id at launch.
+	SessionIDFlag string
+	// ResumeArgs resume a specific conversation (the id is appended).
+	ResumeArgs string
+	// ContinueArgs continue the most recent conversation in the cwd. Used
+	// when the earlier conversation id is unknown (e.g. after a daemon restart).
+	ContinueArgs string
+
+	// MCPConfigFile is the project-level MCP config file, relative to the
+	// worktree, that the agent reads at startup.
+	MCPConfigFile string
+	// ConfigOverrideFlag passes `key=value` config overrides (codex `-c`).
+	// Agents without an MCP config file receive MCP servers this way.
+	ConfigOverrideFlag string
+
+	// ImagePaste is how an image file's path is typed into the agent, with
+	// %s for the path; agents that attach pasted image paths get it as a
+	// bracketed paste. Empty types the path followed by a space.
+	ImagePaste string
+
+	// Install is the shell command that installs the agent CLI, suggested
+	// when Command isn't found.
+	Install string
+
+	// Cwd is where the agent starts: one of the Cwd strategies, or a path
+	// template relative to the worktree. Empty means CwdPackageDir.
+	Cwd string
+
+	// Writes marks agents that edit the worktree on their own, which
+	// would trip over each other's changes if two ran in one worktree.
+	Writes bool
+}
+
+// Cwd strategies: where an agent starts in a worktree.
+const (
+	// CwdPackageDir starts agents in the targeted package's directory, or
+	// the worktree without one.
+	CwdPackageDir = "package-dir"
+	// CwdWorktreeRoot starts agents in the worktree, whatever package
+	// they target.
+	CwdWorktreeRoot = "worktree-root"
+	// CwdRepoRoot starts agents at the top of the git checkout the
+	// worktree is in, for agents that look for their config upward from
+	// there.
+	CwdRepoRoot = "repo-root"
+)
+
+// SupportsMCP reports whether MCP servers can be passed to the agent.
+func (s Spec) SupportsMCP() bool {
+	return s.MCPConfigFile != "" || s.ConfigOverrideFlag != ""
+}
+
+// ImageInput returns the input that hands the image at path to the agent.
+func (s Spec) ImageInput(path string) string {
+	if s.ImagePaste == "" {
+		return path + " "
+	}
+	return fmt.Sprintf(s.ImagePaste, path)
+}
+
+// CanResume reports whether the agent can pick up an earlier conversation.
+func (s Spec) CanResume() bool {
+	return s.ResumeArgs != "" || s.ContinueArgs != ""
+}
+
+// Profile is a named agent configuration, e.g. "claude-opus".
+type Profile struct {
+	Name  string
+	Agent protocol.AgentType
+	Model string
+	Args  []string
+}
+
+// bracketedPaste wraps input in the terminal's paste markers.
+const bracketedPaste = "\x1b[200~%s\x1b[201~"
+
+// builtinSpecs are the agent launch settings for each known agent CLI.
+var builtinSpecs = map[protocol.AgentType]Spec{
+	protocol.AgentBash:  {Command: protocol.AgentCommands[protocol.AgentBash]},
+	protocol.AgentShell: {Command: protocol.AgentCommands[protocol.AgentShell]},
+	protocol.AgentClaudeCode: {
+		Command:       protocol.AgentCommands[protocol.AgentClaudeCode],
+		YoloFlags:     "--dangerously-skip-permissions",
+		ModelFlag:     "--model",
+		HeadlessArgs:  "-p",
+		SessionIDFlag: "--session-id",
+		ResumeArgs:    "--resume",
+		ContinueArgs:  "--continue",
+		MCPConfigFile: ".mcp.json",
+		ImagePaste:    bracketedPaste,
+		Install:       "npm install -g @anthropic-ai/claude-code",
+		Writes:        true,
+	},
+	protocol.AgentCodexCLI: {
+		Command: protocol.AgentCommands[protocol.AgentCodexCLI],
+		// `--full-auto` is still sandboxed (workspace-write). For YOLO mode we need
+		// unrestricted execution to match user expectation.
+		YoloFlags:         "--ask-for-approval never --sandbox danger-full-access",
+		ModelFlag:         "--model",
+		HeadlessArgs:      "exec",
+		HeadlessYoloFlags: "--dangerously-bypass-approvals-and-sandbox",
+		// codex takes resume as a subcommand, so these must directly follow
+		// the binary name.
+		ResumeArgs:         "resume",
+		ContinueArgs:       "resume --last",
+		ConfigOverrideFlag: "-c",
+		ImagePaste:         bracketedPaste,
+		Install:            "npm install -g @openai/codex",
+		Writes:             true,
+	},
+	protocol.AgentCursorAgent: {
+		Command:       protocol.AgentCommands[protocol.AgentCursorAgent],
+		YoloFlags:     "--force",
+		ModelFlag:     "--model",
+		HeadlessArgs:  "-p",
+		ResumeArgs:    "--resume",
+		ContinueArgs:  "resume",
+		MCPConfigFile: ".cursor/mcp.json",
+		Install:       "curl https://cursor.com/install -fsS | bash",
+		Writes:        true,
+	},
+	protocol.AgentKimiCLI: {
+		Command:      protocol.AgentCommands[protocol.AgentKimiCLI],
+		YoloFlags:    "--yolo",
+		PromptFlag:   "-p",
+		ModelFlag:    "--model",
+		HeadlessArgs: "--print",
+		ContinueArgs: "--continue",
+		Install:      "uv tool install --python 3.13 kimi-cli",
+		Writes:       true,
+	},
+	protocol.AgentDroidCLI: {
+		Command:      protocol.AgentCommands[protocol.AgentDroidCLI],
+		HeadlessArgs: "exec",
+		Install:      "curl -fsSL https://app.factory.ai/cli | sh",
+		Writes:       true,
+	},
+	protocol.AgentInkTest: {Command: protocol.AgentCommands[protocol.AgentInkTest]},
+}
+
+// builtinProfiles are available without any configuration.
+var builtinProfiles = map[string]config.Profile{
+	"claude-opus":   {Agent: protocol.AgentClaudeCode, Model: "opus"},
+	"claude-sonnet": {Agent: protocol.AgentClaudeCode, Model: "sonnet"},
+	"claude-haiku":  {Agent: protocol.AgentClaudeCode, Model: "haiku"},
+	"codex":         {Agent: protocol.AgentCodexCLI, Model: "gpt-5-codex"},
+	"codex-mini":    {Agent: protocol.AgentCodexCLI, Model: "gpt-5-codex-mini"},
+}
+
+// Registry resolves agent types and profile names to launch settings.
+type Registry struct {
+	mu         sync.RWMutex
+	agents     map[protocol.AgentType]Spec
+	profiles   map[string]Profile
+	mcpServers map[string]protocol.MCPServer
+}
+
+// NewRegistry builds a registry from the built-in agents and profiles plus
+// any profiles defined in cfg.
+func NewRegistry(cfg *config.Config) *Registry {
+	r := &Registry{
+		agents:   make(map[protocol.AgentType]Spec, len(builtinSpecs)),
+		profiles: make(map[string]Profile),
+	}
+
+	for agentType, spec := range builtinSpecs {
+		r.agents[agentType] = spec
+	}
+
+	addProfile := func(name string, p config.Profile) {
+		r.profiles[name] = Profile{Name: name, Agent: p.Agent, Model: p.Model, Args: p.Args}
+	}
+	for name, p := range builtinProfiles {
+		addProfile(name, p)
+	}
+	if cfg != nil {
+		for name, p := range cfg.Profiles {
+			addProfile(name, p)
+		}
+		for agentType, a := range cfg.Agents {
+			if spec, ok := r.agents[agentType]; ok && a.Cwd != "" {
+				spec.Cwd = a.Cwd
+				r.agents[agentType] = spec
+			}
+		}
+		r.mcpServers = cfg.MCPServers
+	}
+
+	return r
+}
+
+// Update rebuilds the registry from a reloaded cfg. Sessions already
+// started keep the settings they were launched with.
+func (r *Registry) Update(cfg *config.Config) {
+	next := NewRegistry(cfg)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agents, r.profiles, r.mcpServers = next.agents, next.profiles, next.mcpServers
+}
+
+// Agent returns the launch settings for an agent type.
+func (r *Registry) Agent(agentType protocol.AgentType) (Spec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	spec, ok := r.agents[agentType]
+	return spec, ok
+}
+
+// Profile returns a profile by name.
+func (r *Registry) Profile(name string) (Profile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.profiles[name]
+	return p, ok
+}
+
+// MCPServers returns the MCP servers configured for all agents.
+func (r *Registry) MCPServers() map[string]protocol.MCPServer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mcpServers
+}
+
+// Profiles returns all profiles whose agent is known, sorted by name.
+func (r *Registry) Profiles() []Profile {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	profiles := make([]Profile, 0, len(r.profiles))
+	for _, p := range r.profiles {
+		if _, ok := r.agents[p.Agent]; ok {
+			profiles = append(profiles, p)
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
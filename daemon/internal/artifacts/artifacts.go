@@ -0,0 +1,192 @@
+// Package artifacts collects files matching a repo's artifact globs from a
+// worktree and streams them to the server in chunks.
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Collection limits
+const (
+	MaxFiles = 1000
+	MaxBytes = 256 << 20
+)
+
+// ChunkSize is the most file data carried by one artifact-chunk message.
+const ChunkSize = 256 << 10
+
+// ErrLimit is returned (wrapped) by Collect when the matching files exceed
+// MaxFiles or MaxBytes; the files up to the limit are still returned.
+var ErrLimit = errors.New("artifact limit reached")
+
+// File is a collected artifact.
+type File struct {
+	// Name is the slash-separated path relative to the collection dir
+	Name string
+	Size int64
+}
+
+// ValidPattern reports whether pattern is a usable artifact glob: a
+// relative, slash-separated path.Match pattern in which "**" may stand for
+// any number of directories.
+func ValidPattern(pattern string) bool {
+	if pattern == "" || strings.HasPrefix(pattern, "/") {
+		return false
+	}
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg == ".." {
+			return false
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the slash-separated name matches pattern.
+func Match(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Collect returns the regular files under dir that match any of patterns,
+// in lexical order. Symlinks and .git are skipped.
+func Collect(dir string, patterns []string) ([]File, error) {
+	var files []File
+	var total int64
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !matchAny(patterns, name) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if len(files) == MaxFiles || total+info.Size() > MaxBytes {
+			return fmt.Errorf("%w (%d files, %d MB)", ErrLimit, MaxFiles, MaxBytes>>20)
+		}
+		total += info.Size()
+		files = append(files, File{Name: name, Size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send streams files from dir as artifact-chunk messages built on msg,
+// with transfer IDs prefixed by idPrefix. It stops at the first error
+// and returns the files sent completely.
+func Send(send func(protocol.DaemonMessage) error, msg protocol.DaemonMessage, idPrefix, dir string, files []File) ([]protocol.ArtifactInfo, error) {
+	var sent []protocol.ArtifactInfo
+	for i, file := range files {
+		sum, err := sendFile(send, msg, fmt.Sprintf("%s-%d", idPrefix, i), dir, file)
+		if err != nil {
+			return sent, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		sent = append(sent, protocol.ArtifactInfo{Name: file.Name, Size: file.Size, SHA256: sum})
+	}
+	return sent, nil
+}
+
+// sendFile sends one file's chunks and returns its SHA-256.
+func sendFile(send func(protocol.DaemonMessage) error, msg protocol.DaemonMessage, id, dir string, file File) (string, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Name)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	total := int((file.Size + ChunkSize - 1) / ChunkSize)
+	if total == 0 {
+		// An empty file is still one chunk
+		total = 1
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, ChunkSize)
+	for index := 0; index < total; index++ {
+		n, err := io.ReadFull(f, buf[:min(ChunkSize, file.Size-int64(index)*ChunkSize)])
+		if err != nil {
+			return "", fmt.Errorf("changed while being sent: %w", err)
+		}
+		hash.Write(buf[:n])
+
+		chunk := &protocol.ArtifactChunk{
+			ID:    id,
+			Name:  file.Name,
+			Size:  file.Size,
+			Index: index,
+			Total: total,
+		}
+		if index == total-1 {
+			chunk.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		msg.Artifact = chunk
+		msg.Data = base64.StdEncoding.EncodeToString(buf[:n])
+		if err := send(msg); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,80 @@
+// Package budget limits the compute a session may use: the CPU time of its
+// processes and how long it runs. Exceeding a limit warns, pauses the
+// session or kills it, so agent loops can't hog a shared machine.
+package budget
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Limits a session can exceed
+const (
+	LimitCPU       = "cpu"
+	LimitWallClock = "wall-clock"
+)
+
+// Merge returns base with the limits set in over replacing its own.
+func Merge(base, over protocol.Budget) protocol.Budget {
+	if over.CPUSeconds != 0 {
+		base.CPUSeconds = over.CPUSeconds
+	}
+	if over.WallClockSeconds != 0 {
+		base.WallClockSeconds = over.WallClockSeconds
+	}
+	if over.Action != "" {
+		base.Action = over.Action
+	}
+	return base
+}
+
+// Validate checks a budget's values.
+func Validate(b protocol.Budget) error {
+	if b.CPUSeconds < 0 || b.WallClockSeconds < 0 {
+		return fmt.Errorf("cpuSeconds and wallClockSeconds must not be negative")
+	}
+	switch b.Action {
+	case "", protocol.BudgetWarn, protocol.BudgetPause, protocol.BudgetKill:
+	default:
+		return fmt.Errorf("action %q: must be warn, pause or kill", b.Action)
+	}
+	return nil
+}
+
+// Action returns what exceeding b does; kill unless it says otherwise.
+func Action(b protocol.Budget) string {
+	if b.Action == "" {
+		return protocol.BudgetKill
+	}
+	return b.Action
+}
+
+// Enabled reports whether b sets any limit.
+func Enabled(b protocol.Budget) bool {
+	return b.CPUSeconds > 0 || b.WallClockSeconds > 0
+}
+
+// Exceeded returns the limits of b that cpu and elapsed are over, CPU
+// first, skipping those in done.
+func Exceeded(b protocol.Budget, cpu, elapsed time.Duration, done map[string]bool) []protocol.BudgetExceeded {
+	var over []protocol.BudgetExceeded
+	if b.CPUSeconds > 0 && !done[LimitCPU] && cpu >= time.Duration(b.CPUSeconds)*time.Second {
+		over = append(over, protocol.BudgetExceeded{
+			Limit:   LimitCPU,
+			Used:    int64(cpu / time.Second),
+			Allowed: b.CPUSeconds,
+			Action:  Action(b),
+		})
+	}
+	if b.WallClockSeconds > 0 && !done[LimitWallClock] && elapsed >= time.Duration(b.WallClockSeconds)*time.Second {
+		over = append(over, protocol.BudgetExceeded{
+			Limit:   LimitWallClock,
+			Used:    int64(elapsed / time.Second),
+			Allowed: b.WallClockSeconds,
+			Action:  Action(b),
+		})
+	}
+	return over
+}
@@ -0,0 +1,175 @@
+package checks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Coverage report formats
+const (
+	FormatGoCover   = "go-cover"
+	FormatLcov      = "lcov"
+	FormatCobertura = "cobertura-xml"
+)
+
+// coverageFiles are where coverage reports are looked for, relative to
+// where the tests ran, when the repo doesn't name one.
+var coverageFiles = []string{
+	"coverage.out",
+	"cover.out",
+	"coverage.txt",
+	"lcov.info",
+	"coverage/lcov.info",
+	"coverage.xml",
+	"coverage/cobertura-coverage.xml",
+}
+
+// collectCoverage parses the coverage report the test run wrote: report if
+// set, or else the first well-known file. Files older than since are left
+// over from an earlier run and ignored. It returns nil if there's none.
+func collectCoverage(dir, report string, since time.Time) *protocol.Coverage {
+	candidates := coverageFiles
+	if report != "" {
+		candidates = []string{report}
+	}
+
+	for _, name := range candidates {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.ModTime().Before(since) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if cov := parseCoverage(data); cov != nil {
+			cov.File = filepath.ToSlash(name)
+			return cov
+		}
+	}
+	return nil
+}
+
+// parseCoverage detects the format of a coverage report and summarizes it.
+func parseCoverage(data []byte) *protocol.Coverage {
+	trimmed := bytes.TrimSpace(data)
+	var cov *protocol.Coverage
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("mode:")):
+		cov = parseGoCover(trimmed)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		cov = parseCobertura(trimmed)
+	default:
+		cov = parseLcov(trimmed)
+	}
+	if cov != nil && cov.Total > 0 {
+		cov.Percent = float64(cov.Covered) * 100 / float64(cov.Total)
+	}
+	return cov
+}
+
+// parseGoCover reads a `go test -coverprofile` profile, counting
+// statements. Blocks listed more than once (e.g. with -coverpkg) are
+// counted once.
+func parseGoCover(data []byte) *protocol.Coverage {
+	type block struct {
+		stmts   int
+		covered bool
+	}
+	blocks := make(map[string]*block)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Scan() // mode line
+	for scanner.Scan() {
+		// file.go:line.col,line.col numStmts count
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		stmts, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		b, ok := blocks[fields[0]]
+		if !ok {
+			b = &block{stmts: stmts}
+			blocks[fields[0]] = b
+		}
+		b.covered = b.covered || count > 0
+	}
+
+	cov := &protocol.Coverage{Format: FormatGoCover}
+	for _, b := range blocks {
+		cov.Total += b.stmts
+		if b.covered {
+			cov.Covered += b.stmts
+		}
+	}
+	return cov
+}
+
+// parseLcov reads an lcov tracefile, counting lines.
+func parseLcov(data []byte) *protocol.Coverage {
+	cov := &protocol.Coverage{Format: FormatLcov}
+	found := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "LF":
+			cov.Total += n
+			found = true
+		case "LH":
+			cov.Covered += n
+		}
+	}
+	if !found {
+		return nil
+	}
+	return cov
+}
+
+// coberturaReport is the root of a Cobertura coverage.xml (as written by
+// coverage.py, jest and others).
+type coberturaReport struct {
+	XMLName      xml.Name `xml:"coverage"`
+	LinesCovered *int     `xml:"lines-covered,attr"`
+	LinesValid   *int     `xml:"lines-valid,attr"`
+	LineRate     float64  `xml:"line-rate,attr"`
+}
+
+// parseCobertura reads a Cobertura XML report, counting lines.
+func parseCobertura(data []byte) *protocol.Coverage {
+	var report coberturaReport
+	if xml.Unmarshal(data, &report) != nil {
+		return nil
+	}
+
+	cov := &protocol.Coverage{Format: FormatCobertura}
+	if report.LinesCovered != nil && report.LinesValid != nil {
+		cov.Covered = *report.LinesCovered
+		cov.Total = *report.LinesValid
+		return cov
+	}
+	// Older writers only give the rate
+	cov.Percent = report.LineRate * 100
+	return cov
+}
@@ -0,0 +1,104 @@
+// Package checks runs a repo's configured verification commands, such as
+// its tests, in a worktree and parses their results.
+package checks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout bounds a check command.
+const DefaultTimeout = 30 * time.Minute
+
+// outputTail is how much of a command's combined output is kept for display.
+const outputTail = 8 * 1024
+
+// CommandResult is the outcome of a check command.
+type CommandResult struct {
+	ExitCode int
+	Duration time.Duration
+	// Output is the end of stdout and stderr, interleaved.
+	Output string
+}
+
+// RunCommand runs command with sh in dir without a terminal. A command that
+// can't be started or times out returns an error; a failing one doesn't.
+func RunCommand(dir, command string, timeout time.Duration) (CommandResult, error) {
+	res, err := run(dir, command, timeout)
+	return CommandResult{
+		ExitCode: res.exitCode,
+		Duration: res.duration,
+		Output:   string(res.output),
+	}, err
+}
+
+// execResult is the outcome of a check command.
+type execResult struct {
+	stdout   []byte
+	output   []byte // stdout and stderr interleaved, truncated to outputTail
+	exitCode int
+	duration time.Duration
+}
+
+// run is RunCommand, also returning the command's full stdout.
+func run(dir, command string, timeout time.Duration) (execResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	var combined lockedBuffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Stdout = io.MultiWriter(&stdout, &combined)
+	cmd.Stderr = &combined
+	// Kill the whole process group so test runners' children die too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	result := execResult{
+		stdout:   stdout.Bytes(),
+		output:   tail(combined.buf.Bytes(), outputTail),
+		duration: time.Since(start),
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return result, errors.New("timed out after " + timeout.String())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.exitCode = exitErr.ExitCode()
+		return result, nil
+	}
+	return result, err
+}
+
+// lockedBuffer is written to by the stdout and stderr copying goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// tail returns the last n bytes of b.
+func tail(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[len(b)-n:]
+	}
+	return b
+}
@@ -0,0 +1,163 @@
+package checks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Lint output formats
+const (
+	FormatESLintJSON   = "eslint-json"
+	FormatGolangciJSON = "golangci-lint-json"
+)
+
+// maxDiagnostics bounds the diagnostics reported for one run; the counts
+// still cover all of them.
+const maxDiagnostics = 1000
+
+// RunLint runs a lint command in dir and parses diagnostics from its
+// stdout. Diagnostic files are relative to dir. When the format isn't
+// recognized only the exit code is reported.
+func RunLint(dir, command string, timeout time.Duration) (*protocol.LintResult, error) {
+	res, err := run(dir, command, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("lint command: %w", err)
+	}
+
+	result := &protocol.LintResult{
+		ExitCode:   res.exitCode,
+		DurationMs: res.duration.Milliseconds(),
+		Output:     string(res.output),
+	}
+
+	data := bytes.TrimSpace(res.stdout)
+	switch {
+	case parseESLint(dir, data, result):
+		result.Format = FormatESLintJSON
+	case parseGolangci(data, result):
+		result.Format = FormatGolangciJSON
+	}
+	return result, nil
+}
+
+// addDiagnostic counts d and records it unless there are already too many.
+func addDiagnostic(result *protocol.LintResult, d protocol.Diagnostic) {
+	if d.Severity == protocol.SeverityError {
+		result.Errors++
+	} else {
+		result.Warnings++
+	}
+	if len(result.Diagnostics) < maxDiagnostics {
+		result.Diagnostics = append(result.Diagnostics, d)
+	} else {
+		result.Truncated = true
+	}
+}
+
+// eslintFile is one file's entry in `eslint -f json` output.
+type eslintFile struct {
+	FilePath string `json:"filePath"`
+	Messages []struct {
+		RuleID   string `json:"ruleId"`
+		Severity int    `json:"severity"` // 1 warning, 2 error
+		Message  string `json:"message"`
+		Line     int    `json:"line"`
+		Column   int    `json:"column"`
+	} `json:"messages"`
+}
+
+// parseESLint reads eslint's JSON formatter output. Its paths are absolute,
+// so they are made relative to dir.
+func parseESLint(dir string, data []byte, result *protocol.LintResult) bool {
+	if !bytes.HasPrefix(data, []byte("[")) {
+		return false
+	}
+	var files []eslintFile
+	if json.NewDecoder(bytes.NewReader(data)).Decode(&files) != nil {
+		return false
+	}
+	for _, f := range files {
+		if f.FilePath == "" {
+			// Not eslint output after all
+			return false
+		}
+	}
+
+	for _, f := range files {
+		file := f.FilePath
+		if rel, err := filepath.Rel(dir, file); err == nil && filepath.IsLocal(rel) {
+			file = rel
+		}
+		for _, m := range f.Messages {
+			severity := protocol.SeverityWarning
+			if m.Severity == 2 {
+				severity = protocol.SeverityError
+			}
+			addDiagnostic(result, protocol.Diagnostic{
+				File:     filepath.ToSlash(file),
+				Line:     m.Line,
+				Column:   m.Column,
+				Severity: severity,
+				Message:  m.Message,
+				Rule:     m.RuleID,
+			})
+		}
+	}
+	return true
+}
+
+// golangciReport is the part of golangci-lint's JSON output we use.
+type golangciReport struct {
+	Issues []struct {
+		FromLinter string `json:"FromLinter"`
+		Text       string `json:"Text"`
+		Severity   string `json:"Severity"`
+		Pos        struct {
+			Filename string `json:"Filename"`
+			Line     int    `json:"Line"`
+			Column   int    `json:"Column"`
+		} `json:"Pos"`
+	} `json:"Issues"`
+}
+
+// parseGolangci reads golangci-lint's JSON output. Newer versions print a
+// text summary after the JSON, which is ignored.
+func parseGolangci(data []byte, result *protocol.LintResult) bool {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return false
+	}
+	var raw map[string]json.RawMessage
+	if json.NewDecoder(bytes.NewReader(data)).Decode(&raw) != nil {
+		return false
+	}
+	if _, ok := raw["Issues"]; !ok {
+		return false
+	}
+	var report golangciReport
+	if json.NewDecoder(bytes.NewReader(data)).Decode(&report) != nil {
+		return false
+	}
+
+	for _, issue := range report.Issues {
+		// golangci-lint leaves severity unset unless configured; every
+		// issue fails the run, so treat unset as an error.
+		severity := protocol.SeverityError
+		if issue.Severity == "warning" || issue.Severity == "info" {
+			severity = protocol.SeverityWarning
+		}
+		addDiagnostic(result, protocol.Diagnostic{
+			File:     filepath.ToSlash(issue.Pos.Filename),
+			Line:     issue.Pos.Line,
+			Column:   issue.Pos.Column,
+			Severity: severity,
+			Message:  issue.Text,
+			Rule:     issue.FromLinter,
+		})
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+package checks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Test result formats
+const (
+	FormatGoTestJSON = "go-test-json"
+	FormatJestJSON   = "jest-json"
+	FormatJUnitXML   = "junit-xml"
+)
+
+// RunTests runs a test command in dir and parses its results from report
+// (a file relative to dir, e.g. junit XML) if set, or else from the
+// command's stdout. The format is detected from the content; when it isn't
+// recognized only the exit code is reported. Coverage is summarized from
+// the coverage file (relative to dir) if set, or else from a well-known
+// report file the run wrote.
+func RunTests(dir, command, report, coverage string, timeout time.Duration) (*protocol.TestResult, error) {
+	if report != "" {
+		// Don't parse a stale report from an earlier run
+		os.Remove(filepath.Join(dir, report))
+	}
+
+	// Truncate to the filesystem's likely mtime granularity so a report
+	// written right away isn't mistaken for a stale one
+	start := time.Now().Truncate(time.Second)
+	res, err := run(dir, command, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("test command: %w", err)
+	}
+
+	result := &protocol.TestResult{
+		ExitCode:   res.exitCode,
+		DurationMs: res.duration.Milliseconds(),
+		Output:     string(res.output),
+		Coverage:   collectCoverage(dir, coverage, start),
+	}
+
+	data := res.stdout
+	if report != "" {
+		if data, err = os.ReadFile(filepath.Join(dir, report)); err != nil {
+			return result, fmt.Errorf("test report: %w", err)
+		}
+	}
+	parseTestResults(data, result)
+	return result, nil
+}
+
+// parseTestResults detects the format of data and fills in the counts.
+func parseTestResults(data []byte, result *protocol.TestResult) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		if parseJUnit(trimmed, result) {
+			result.Format = FormatJUnitXML
+		}
+	case parseJest(trimmed, result):
+		result.Format = FormatJestJSON
+	case parseGoTest(trimmed, result):
+		result.Format = FormatGoTestJSON
+	}
+}
+
+// goTestEvent is a line of `go test -json` output.
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+}
+
+// parseGoTest counts test2json pass/fail/skip events. Other lines, such as
+// build errors, are ignored.
+func parseGoTest(data []byte, result *protocol.TestResult) bool {
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var event goTestEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || event.Action == "" {
+			continue
+		}
+		found = true
+		if event.Test == "" {
+			continue
+		}
+		switch event.Action {
+		case "pass":
+			result.Passed++
+		case "fail":
+			result.Failed++
+			result.FailedTests = append(result.FailedTests, event.Package+"."+event.Test)
+		case "skip":
+			result.Skipped++
+		}
+	}
+	return found
+}
+
+// jestReport is the part of `jest --json` output we use.
+type jestReport struct {
+	NumTotalTests   *int `json:"numTotalTests"`
+	NumPassedTests  int  `json:"numPassedTests"`
+	NumFailedTests  int  `json:"numFailedTests"`
+	NumPendingTests int  `json:"numPendingTests"`
+	TestResults     []struct {
+		Name             string `json:"name"`
+		Message          string `json:"message"`
+		Status           string `json:"status"`
+		AssertionResults []struct {
+			FullName string `json:"fullName"`
+			Status   string `json:"status"`
+		} `json:"assertionResults"`
+	} `json:"testResults"`
+}
+
+// parseJest reads a jest (or vitest) JSON report.
+func parseJest(data []byte, result *protocol.TestResult) bool {
+	var report jestReport
+	if json.Unmarshal(data, &report) != nil || report.NumTotalTests == nil {
+		return false
+	}
+
+	result.Passed = report.NumPassedTests
+	result.Failed = report.NumFailedTests
+	result.Skipped = report.NumPendingTests
+	for _, file := range report.TestResults {
+		failed := false
+		for _, assertion := range file.AssertionResults {
+			if assertion.Status == "failed" {
+				failed = true
+				result.FailedTests = append(result.FailedTests, assertion.FullName)
+			}
+		}
+		// A suite that failed to run has no failing assertions
+		if file.Status == "failed" && !failed {
+			result.FailedTests = append(result.FailedTests, file.Name)
+		}
+	}
+	return true
+}
+
+// junitSuite is a <testsuites> or <testsuite> element; suites nest.
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []struct {
+		Name      string    `xml:"name,attr"`
+		Classname string    `xml:"classname,attr"`
+		Failure   *struct{} `xml:"failure"`
+		Error     *struct{} `xml:"error"`
+		Skipped   *struct{} `xml:"skipped"`
+	} `xml:"testcase"`
+}
+
+// parseJUnit reads a JUnit XML report.
+func parseJUnit(data []byte, result *protocol.TestResult) bool {
+	var root junitSuite
+	if xml.Unmarshal(data, &root) != nil {
+		return false
+	}
+	countJUnit(root, result)
+	return true
+}
+
+func countJUnit(suite junitSuite, result *protocol.TestResult) {
+	for _, c := range suite.Cases {
+		switch {
+		case c.Failure != nil || c.Error != nil:
+			result.Failed++
+			name := c.Name
+			if c.Classname != "" {
+				name = c.Classname + "." + c.Name
+			}
+			result.FailedTests = append(result.FailedTests, name)
+		case c.Skipped != nil:
+			result.Skipped++
+		default:
+			result.Passed++
+		}
+	}
+	for _, s := range suite.Suites {
+		countJUnit(s, result)
+	}
+}
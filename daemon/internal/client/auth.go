@@ -0,0 +1,217 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Pairing follows the OAuth device authorization flow (RFC 8628): the
+// daemon asks the server for a device code, the user approves its short
+// user code in the server UI, and the daemon polls until the server hands
+// over a credential.
+const (
+	pairPath      = "/api/daemon/pair"
+	pairTokenPath = "/api/daemon/pair/token"
+)
+
+// defaultPollInterval is how often PollDeviceToken asks by default, and
+// slowDownStep how much longer it waits each time the server says slow_down.
+const (
+	defaultPollInterval = 5 * time.Second
+	slowDownStep        = 5 * time.Second
+)
+
+// pairRequestTimeout bounds each pairing HTTP request.
+const pairRequestTimeout = 15 * time.Second
+
+var (
+	// ErrPairingDenied is returned by PollDeviceToken when the user rejects
+	// the pairing.
+	ErrPairingDenied = errors.New("pairing was denied")
+	// ErrPairingExpired is returned by PollDeviceToken when the device code
+	// expires before the user approves it.
+	ErrPairingExpired = errors.New("pairing code expired")
+)
+
+// DeviceCode is a pairing request waiting for the user's approval.
+type DeviceCode struct {
+	// DeviceCode identifies the request when polling; it is not shown.
+	DeviceCode string `json:"deviceCode"`
+	// UserCode is the one-time code the user confirms in the server UI.
+	UserCode string `json:"userCode"`
+	// VerificationURI is where the user approves the code, and
+	// VerificationURIComplete, if the server sets it, the same page with
+	// the code filled in.
+	VerificationURI         string `json:"verificationUri"`
+	VerificationURIComplete string `json:"verificationUriComplete,omitempty"`
+	// ExpiresIn and Interval are in seconds.
+	ExpiresIn int `json:"expiresIn"`
+	Interval  int `json:"interval,omitempty"`
+}
+
+// ApprovalURL returns the page to open to approve the code, with the code
+// filled in if the server offers that.
+func (d *DeviceCode) ApprovalURL() string {
+	if d.VerificationURIComplete != "" {
+		return d.VerificationURIComplete
+	}
+	return d.VerificationURI
+}
+
+// RequestDeviceCode starts pairing with the server at serverURL (a daemon
+// WebSocket URL, as for Dial), naming the device deviceName.
+func RequestDeviceCode(ctx context.Context, serverURL, deviceName string) (*DeviceCode, error) {
+	hostname, _ := os.Hostname()
+	var code DeviceCode
+	status, err := postJSON(ctx, serverURL, pairPath, map[string]string{
+		"deviceName": deviceName,
+		"hostname":   hostname,
+	}, &code)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return nil, fmt.Errorf("server refused to pair: HTTP %d", status)
+	}
+	if code.DeviceCode == "" || code.UserCode == "" || code.VerificationURI == "" {
+		return nil, errors.New("server sent an incomplete pairing code")
+	}
+	// A relative page is on the server itself
+	base, _, err := httpBase(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, uri := range []*string{&code.VerificationURI, &code.VerificationURIComplete} {
+		if *uri == "" {
+			continue
+		}
+		if ref, err := url.Parse(*uri); err == nil {
+			*uri = base.ResolveReference(ref).String()
+		}
+	}
+	return &code, nil
+}
+
+// PollDeviceToken waits for the user to approve code and returns the
+// credential the server issues. It fails with ErrPairingDenied or
+// ErrPairingExpired, or when ctx is done.
+func PollDeviceToken(ctx context.Context, serverURL string, code *DeviceCode) (*Credential, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if code.ExpiresIn > 0 && time.Now().After(deadline) {
+			return nil, ErrPairingExpired
+		}
+
+		var resp struct {
+			Token  string   `json:"token"`
+			Scopes []string `json:"scopes"`
+			EnvID  string   `json:"envId"`
+			Error  string   `json:"error"`
+		}
+		status, err := postJSON(ctx, serverURL, pairTokenPath, map[string]string{"deviceCode": code.DeviceCode}, &resp)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// The server may be restarting; keep polling until the code expires
+			continue
+		}
+		switch {
+		case status == http.StatusOK && resp.Token != "":
+			return &Credential{
+				ServerURL: serverURL,
+				Token:     resp.Token,
+				Scopes:    resp.Scopes,
+				EnvID:     resp.EnvID,
+				PairedAt:  time.Now().UnixMilli(),
+			}, nil
+		case resp.Error == "authorization_pending":
+		case resp.Error == "slow_down":
+			interval += slowDownStep
+		case resp.Error == "access_denied":
+			return nil, ErrPairingDenied
+		case resp.Error == "expired_token":
+			return nil, ErrPairingExpired
+		case resp.Error != "":
+			return nil, fmt.Errorf("pairing failed: %s", resp.Error)
+		default:
+			return nil, fmt.Errorf("pairing failed: HTTP %d", status)
+		}
+	}
+}
+
+// postJSON posts body to path on the server at serverURL and decodes the
+// JSON response, whatever its status, into out.
+func postJSON(ctx context.Context, serverURL, path string, body, out any) (int, error) {
+	base, httpClient, err := httpBase(serverURL)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, pairRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base.JoinPath(path).String(), bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(respData, out); err != nil {
+		return resp.StatusCode, fmt.Errorf("server sent an invalid response (HTTP %d)", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// httpBase returns the HTTP origin of the server at serverURL (ws becomes
+// http, wss https) and a client for it; a Unix socket server is reached
+// through the socket.
+func httpBase(serverURL string) (*url.URL, *http.Client, error) {
+	u, err := ParseURL(serverURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		return &url.URL{Scheme: "http", Host: u.Host}, http.DefaultClient, nil
+	case "wss":
+		return &url.URL{Scheme: "https", Host: u.Host}, http.DefaultClient, nil
+	}
+	socket := u.Path
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &url.URL{Scheme: "http", Host: "localhost"}, &http.Client{Transport: transport}, nil
+}
@@ -2,16 +2,31 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/signing"
+	"github.com/agenthq/daemon/internal/traffic"
 	"github.com/gorilla/websocket"
 )
 
+// Capabilities are the agent types a daemon registers as able to spawn,
+// besides those of its plugins.
+var Capabilities = []string{"bash", "claude-code", "codex-cli", "cursor-agent"}
+
 // Client manages the WebSocket connection to the server.
 type Client struct {
 	url          string
@@ -22,8 +37,47 @@ type Client struct {
 	conn         *websocket.Conn
 	mu           sync.Mutex
 	done         chan struct{}
+	closeOnce    sync.Once
 	onMessage    func(protocol.ServerMessage)
 	onDisconnect func()
+	onRegister   func(*protocol.DaemonMessage)
+	onHeartbeat  func(*protocol.DaemonMessage)
+	// onHeartbeatAck, when set, is called for each heartbeat-ack
+	onHeartbeatAck func()
+	// online, when set, reports whether the network is up; heartbeats are
+	// skipped while it isn't.
+	online func() bool
+	// namespace prefixes processIDs from this server so several servers can
+	// share one session manager without collisions.
+	namespace string
+	// verifier, when set, requires every server message to be signed.
+	verifier *signing.Verifier
+	// handling is the message the read loop is handling, if any
+	handling atomic.Pointer[handling]
+	// sending counts the messages being written or waiting to be
+	sending atomic.Int32
+	// written is the time spent writing to the connection, and writing
+	// when the write in progress started (Unix nanoseconds), or 0
+	written atomic.Int64
+	writing atomic.Int64
+	// maxMessageSize is the largest message sent whole; larger ones are
+	// chunked. Not positive means never chunk.
+	maxMessageSize int
+	// chunkID numbers chunked messages
+	chunkID atomic.Uint64
+	// recorder, when set, records every message sent and received
+	recorder *traffic.Recorder
+	// onTraffic, when set, counts the bytes of every message sent and
+	// received
+	onTraffic func(dir, processID string, n int)
+	// latency is the round-trip time to the server
+	latency latency
+}
+
+// handling records when the read loop started on a message.
+type handling struct {
+	msgType string
+	since   time.Time
 }
 
 // New creates a new client.
@@ -37,22 +91,186 @@ func New(url, authToken, envID, envName, workspace string, onMessage func(protoc
 		done:         make(chan struct{}),
 		onMessage:    onMessage,
 		onDisconnect: onDisconnect,
+
+		maxMessageSize: protocol.DefaultMaxMessageSize,
 	}
 }
 
-// Connect establishes connection to the server.
-func (c *Client) Connect() error {
-	// Add auth token as query parameter if provided
-	url := c.url
-	if c.authToken != "" {
-		if strings.Contains(url, "?") {
-			url += "&token=" + c.authToken
-		} else {
-			url += "?token=" + c.authToken
+// OnRegister sets a hook that can add fields to the registration message
+// before it is sent. Must be called before Connect.
+func (c *Client) OnRegister(fn func(*protocol.DaemonMessage)) {
+	c.onRegister = fn
+}
+
+// OnHeartbeat sets a hook that can add stats to each heartbeat before it is
+// sent. Must be called before Connect.
+func (c *Client) OnHeartbeat(fn func(*protocol.DaemonMessage)) {
+	c.onHeartbeat = fn
+}
+
+// OnHeartbeatAck sets a hook called whenever the server acknowledges a
+// heartbeat; heartbeat-acks aren't passed on as messages. Must be called
+// before Connect.
+func (c *Client) OnHeartbeatAck(fn func()) {
+	c.onHeartbeatAck = fn
+}
+
+// SetOnline sets a check for whether the machine is online; heartbeats,
+// which can't arrive while it isn't, are skipped until it is again. Must be
+// called before Connect.
+func (c *Client) SetOnline(online func() bool) {
+	c.online = online
+}
+
+// SetNamespace makes the client translate processIDs and group names between
+// the server's view ("abc") and the daemon's ("<namespace>/abc"). Must be
+// called before Connect.
+func (c *Client) SetNamespace(namespace string) {
+	c.namespace = namespace
+}
+
+// SetVerifier makes the client drop server messages that are not signed
+// with the verifier's secret, or that are stale or replayed. Must be called
+// before Connect.
+func (c *Client) SetVerifier(v *signing.Verifier) {
+	c.verifier = v
+}
+
+// SetRecorder records every message sent and received, whole and after
+// checking signatures. Must be called before Connect.
+func (c *Client) SetRecorder(r *traffic.Recorder) {
+	c.recorder = r
+}
+
+// OnTraffic sets a hook called with the size on the wire of every message
+// sent (traffic.Out) and received (traffic.In), chunks and signature
+// envelopes included, and the daemon-side processID it carries, if any.
+// Must be called before Connect.
+func (c *Client) OnTraffic(fn func(dir, processID string, n int)) {
+	c.onTraffic = fn
+}
+
+// SetMaxMessageSize sets the largest message sent whole; larger ones are
+// sent in chunks of at most that size. Not positive means never chunk.
+// Must be called before Connect.
+func (c *Client) SetMaxMessageSize(n int) {
+	c.maxMessageSize = n
+}
+
+// LocalID returns the daemon-side ID for an ID used by this server.
+func (c *Client) LocalID(id string) string {
+	if c.namespace == "" || id == "" {
+		return id
+	}
+	return c.namespace + "/" + id
+}
+
+// RemoteID returns the server-side ID for a daemon-side ID.
+func (c *Client) RemoteID(id string) string {
+	if c.namespace == "" {
+		return id
+	}
+	return strings.TrimPrefix(id, c.namespace+"/")
+}
+
+// Owns reports whether a daemon-side ID belongs to this server.
+func (c *Client) Owns(id string) bool {
+	return c.namespace == "" || strings.HasPrefix(id, c.namespace+"/")
+}
+
+// DialURL adds the auth token as query parameter if provided, as daemons
+// present it.
+func DialURL(url, authToken string) string {
+	if authToken == "" {
+		return url
+	}
+	if strings.Contains(url, "?") {
+		return url + "&token=" + authToken
+	}
+	return url + "?token=" + authToken
+}
+
+// unixRequestPath is the path requested over a Unix socket: the server's
+// daemon endpoint.
+const unixRequestPath = "/ws/daemon"
+
+// ParseURL checks a server URL: ws:// or wss://, with IPv6 hosts in
+// brackets (ws://[::1]:3000/ws/daemon), or unix:// and a socket path
+// (unix:///run/agenthq.sock), optionally with a query.
+func ParseURL(serverURL string) (*url.URL, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		if u.Host == "" {
+			return nil, fmt.Errorf("server URL %q has no host", serverURL)
 		}
+		if strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[") {
+			return nil, fmt.Errorf("server URL %q: put IPv6 addresses in brackets, e.g. ws://[::1]:3000/ws/daemon", serverURL)
+		}
+	case "unix":
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("server URL %q: a Unix socket URL is unix:// and an absolute path, e.g. unix:///run/agenthq.sock", serverURL)
+		}
+	default:
+		return nil, fmt.Errorf("server URL %q: scheme must be ws, wss or unix", serverURL)
 	}
+	return u, nil
+}
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+// Dial opens a WebSocket connection to a server, presenting authToken if
+// it isn't empty. A unix:// URL connects to the socket and requests the
+// server's daemon endpoint over it.
+func Dial(serverURL, authToken string) (*websocket.Conn, *http.Response, error) {
+	u, err := ParseURL(serverURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "unix" {
+		return websocket.DefaultDialer.Dial(DialURL(serverURL, authToken), nil)
+	}
+
+	dialer := *websocket.DefaultDialer
+	socket := u.Path
+	dialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	wsURL := url.URL{Scheme: "ws", Host: "localhost", Path: unixRequestPath, RawQuery: u.RawQuery}
+	return dialer.Dial(DialURL(wsURL.String(), authToken), nil)
+}
+
+// ErrUnauthorized is returned by Probe when the server rejects the auth
+// token.
+var ErrUnauthorized = errors.New("server rejected the auth token")
+
+// Probe checks that a server accepts WebSocket connections without
+// registering with it.
+func Probe(serverURL, authToken string) error {
+	conn, resp, err := Dial(serverURL, authToken)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return fmt.Errorf("%w (HTTP %s)", ErrUnauthorized, resp.Status)
+		}
+		if resp != nil {
+			return fmt.Errorf("%w (HTTP %s)", err, resp.Status)
+		}
+		return err
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "probe"))
+	return conn.Close()
+}
+
+// URL returns the server URL the client connects to.
+func (c *Client) URL() string {
+	return c.url
+}
+
+// Connect establishes connection to the server.
+func (c *Client) Connect() error {
+	conn, _, err := Dial(c.url, c.authToken)
 	if err != nil {
 		return err
 	}
@@ -60,15 +278,21 @@ func (c *Client) Connect() error {
 	c.mu.Lock()
 	c.conn = conn
 	c.mu.Unlock()
+	c.latency.reset()
+	conn.SetPongHandler(c.handlePong)
 
 	// Send registration message
-	c.Send(protocol.DaemonMessage{
+	register := protocol.DaemonMessage{
 		Type:         protocol.MsgTypeRegister,
 		EnvID:        c.envID,
 		EnvName:      c.envName,
 		Workspace:    c.workspace,
-		Capabilities: []string{"bash", "claude-code", "codex-cli", "cursor-agent"},
-	})
+		Capabilities: slices.Clone(Capabilities),
+	}
+	if c.onRegister != nil {
+		c.onRegister(&register)
+	}
+	c.Send(register)
 
 	// Start message reader
 	go c.readLoop()
@@ -81,6 +305,8 @@ func (c *Client) Connect() error {
 
 // Send sends a message to the server.
 func (c *Client) Send(msg protocol.DaemonMessage) error {
+	c.sending.Add(1)
+	defer c.sending.Add(-1)
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -88,17 +314,77 @@ func (c *Client) Send(msg protocol.DaemonMessage) error {
 		return nil
 	}
 
+	processID := msg.ProcessID
+	if c.namespace != "" {
+		msg.ProcessID = c.RemoteID(msg.ProcessID)
+		if len(msg.Results) > 0 {
+			results := make([]protocol.CompareResult, len(msg.Results))
+			for i, r := range msg.Results {
+				r.ProcessID = c.RemoteID(r.ProcessID)
+				results[i] = r
+			}
+			msg.Results = results
+		}
+		if len(msg.Stats) > 0 {
+			stats := make([]protocol.SessionStats, len(msg.Stats))
+			for i, st := range msg.Stats {
+				st.ProcessID = c.RemoteID(st.ProcessID)
+				stats[i] = st
+			}
+			msg.Stats = stats
+		}
+	}
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
+	c.recorder.Record(traffic.Out, c.url, data)
 
-	return c.conn.WriteMessage(websocket.TextMessage, data)
+	id := ""
+	if c.maxMessageSize > 0 && len(data) > c.maxMessageSize {
+		id = strconv.FormatUint(c.chunkID.Add(1), 36)
+	}
+	sent := 0
+	defer func() {
+		if c.onTraffic != nil && sent > 0 {
+			c.onTraffic(traffic.Out, processID, sent)
+		}
+	}()
+	for _, frame := range protocol.SplitMessage(data, c.maxMessageSize, id) {
+		start := time.Now()
+		c.writing.Store(start.UnixNano())
+		err := c.conn.WriteMessage(websocket.TextMessage, frame)
+		c.written.Add(int64(time.Since(start)))
+		c.writing.Store(0)
+		if err != nil {
+			return err
+		}
+		sent += len(frame)
+	}
+	return nil
+}
+
+// Writing returns the time spent writing to the connection, the write in
+// progress included. When it grows nearly as fast as the clock, the
+// connection can't keep up with what is sent.
+func (c *Client) Writing() time.Duration {
+	d := time.Duration(c.written.Load())
+	if start := c.writing.Load(); start != 0 {
+		d += time.Since(time.Unix(0, start))
+	}
+	return d
 }
 
-// Close closes the connection.
+// Sending returns the number of messages being written or waiting their
+// turn; it grows when the connection can't keep up.
+func (c *Client) Sending() int {
+	return int(c.sending.Load())
+}
+
+// Close closes the connection. Closing a closed client does nothing.
 func (c *Client) Close() {
-	close(c.done)
+	c.closeOnce.Do(func() { close(c.done) })
 
 	c.mu.Lock()
 	if c.conn != nil {
@@ -123,6 +409,15 @@ func (c *Client) readLoop() {
 		}
 	}()
 
+	chunks := protocol.NewReassembler()
+	// received is the size of the message being read, over all its chunks
+	received := 0
+	countReceived := func(processID string) {
+		if c.onTraffic != nil {
+			c.onTraffic(traffic.In, processID, received)
+		}
+		received = 0
+	}
 	for {
 		select {
 		case <-c.done:
@@ -143,29 +438,97 @@ func (c *Client) readLoop() {
 			log.Printf("Read error: %v", err)
 			return
 		}
+		received += len(data)
+
+		// Chunking wraps everything else, signatures included
+		if chunk, ok := protocol.ParseChunk(data); ok {
+			data, err = chunks.Add(chunk)
+			if err != nil {
+				log.Printf("Dropped chunked server message: %v", err)
+				countReceived("")
+				continue
+			}
+			if data == nil {
+				continue
+			}
+		}
 
-		var msg protocol.ServerMessage
-		if err := json.Unmarshal(data, &msg); err != nil {
-			log.Printf("Failed to parse message: %v", err)
+		if c.verifier != nil {
+			data, err = c.verifier.Open(data)
+			if err != nil {
+				log.Printf("Rejected server message: %v", err)
+				countReceived("")
+				continue
+			}
+		}
+
+		c.recorder.Record(traffic.In, c.url, data)
+
+		msg, err := protocol.DecodeServerMessage(data)
+		if err != nil {
+			log.Printf("Rejected server message: %v", err)
+			countReceived("")
+			c.Send(protocol.InvalidMessageReply(msg, err))
 			continue
 		}
 
+		if msg.Type == protocol.MsgTypeHeartbeatAck {
+			countReceived("")
+			if c.onHeartbeatAck != nil {
+				c.onHeartbeatAck()
+			}
+			continue
+		}
+
+		msg.ProcessID = c.LocalID(msg.ProcessID)
+		countReceived(msg.ProcessID)
+		msg.ResumeOf = c.LocalID(msg.ResumeOf)
+		msg.Group = c.LocalID(msg.Group)
+
+		c.handling.Store(&handling{msgType: msg.Type, since: time.Now()})
 		c.onMessage(msg)
+		c.handling.Store(nil)
+	}
+}
+
+// Handling returns the type of the message the read loop is handling and
+// for how long, or "" when it is waiting for the next one.
+func (c *Client) Handling() (string, time.Duration) {
+	h := c.handling.Load()
+	if h == nil {
+		return "", 0
 	}
+	return h.msgType, time.Since(h.since)
 }
 
 func (c *Client) heartbeatLoop() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
+	pings := time.NewTicker(pingInterval)
+	defer pings.Stop()
 
+	c.ping()
 	for {
 		select {
 		case <-c.done:
 			return
+		case <-pings.C:
+			if c.online == nil || c.online() {
+				c.ping()
+			}
 		case <-ticker.C:
-			c.Send(protocol.DaemonMessage{
-				Type: protocol.MsgTypeHeartbeat,
-			})
+			if c.online != nil && !c.online() {
+				continue
+			}
+			heartbeat := protocol.DaemonMessage{
+				Type:      protocol.MsgTypeHeartbeat,
+				Timestamp: time.Now().UnixMilli(),
+				Latency:   c.Latency(),
+			}
+			if c.onHeartbeat != nil {
+				c.onHeartbeat(&heartbeat)
+			}
+			c.Send(heartbeat)
 		}
 	}
 }
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/keychain"
+)
+
+// Where stored credentials keep their tokens.
+const (
+	// StoreAuto uses the keychain when it is available and the file
+	// otherwise.
+	StoreAuto = "auto"
+	// StoreKeychain keeps tokens in the OS keychain and only the rest of
+	// the credential in the file.
+	StoreKeychain = "keychain"
+	// StoreFile keeps tokens in the credentials file, readable only by its
+	// owner.
+	StoreFile = "file"
+)
+
+// keychainService is the keychain service tokens are stored under; the
+// account is the server URL.
+const keychainService = "agenthq-daemon"
+
+// Credential is a server's token for the daemon, issued by pairing or
+// moved from AGENTHQ_AUTH_TOKEN or the config file.
+type Credential struct {
+	ServerURL string `json:"serverUrl"`
+	// Token is empty in the file when the keychain holds it.
+	Token string `json:"token,omitempty"`
+	// Keychain is set when the token is in the OS keychain.
+	Keychain bool `json:"keychain,omitempty"`
+	// Scopes are what the server allows the token to do.
+	Scopes []string `json:"scopes,omitempty"`
+	// EnvID is the environment the server paired the daemon as, if it
+	// chose one.
+	EnvID    string `json:"envId,omitempty"`
+	PairedAt int64  `json:"pairedAt,omitempty"`
+}
+
+// ResolveStore returns where tokens are stored for a --credential-store
+// value: StoreAuto becomes StoreKeychain or StoreFile. Asking for the
+// keychain where it can't be used is an error.
+func ResolveStore(store string) (string, error) {
+	switch store {
+	case StoreFile:
+		return StoreFile, nil
+	case StoreKeychain:
+		if err := keychain.Available(); err != nil {
+			return "", err
+		}
+		return StoreKeychain, nil
+	case StoreAuto, "":
+		if keychain.Available() == nil {
+			return StoreKeychain, nil
+		}
+		return StoreFile, nil
+	}
+	return "", fmt.Errorf("credential store %q: must be auto, keychain or file", store)
+}
+
+// DefaultCredentialsPath returns where credentials are stored by default
+// (~/.agenthq/credentials.json).
+func DefaultCredentialsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".agenthq", "credentials.json")
+}
+
+// LoadCredentials reads the credentials stored at path, by server URL,
+// without the tokens the keychain holds; a missing file has none.
+func LoadCredentials(path string) (map[string]Credential, error) {
+	creds := make(map[string]Credential)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Credential
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, c := range list {
+		creds[c.ServerURL] = c
+	}
+	return creds, nil
+}
+
+// StoredCredential returns the credential stored at path for serverURL,
+// with its token fetched from the keychain if need be.
+func StoredCredential(path, serverURL string) (Credential, bool, error) {
+	creds, err := LoadCredentials(path)
+	if err != nil {
+		return Credential{}, false, err
+	}
+	c, ok := creds[serverURL]
+	if !ok {
+		return Credential{}, false, nil
+	}
+	if c.Keychain {
+		token, err := keychain.Get(keychainService, serverURL)
+		if errors.Is(err, keychain.ErrNotFound) {
+			return Credential{}, false, nil
+		}
+		if err != nil {
+			return Credential{}, false, err
+		}
+		c.Token = token
+	}
+	return c, c.Token != "", nil
+}
+
+// SaveCredential stores c at path, replacing any credential for the same
+// server, with its token in store (StoreKeychain or StoreFile, as from
+// ResolveStore). The file is readable only by its owner.
+func SaveCredential(path, store string, c Credential) error {
+	creds, err := LoadCredentials(path)
+	if err != nil {
+		return err
+	}
+	switch store {
+	case StoreKeychain:
+		if err := keychain.Set(keychainService, c.ServerURL, c.Token); err != nil {
+			return err
+		}
+		c.Token, c.Keychain = "", true
+	case StoreFile:
+		c.Keychain = false
+		if creds[c.ServerURL].Keychain {
+			// Don't leave the old token behind
+			if err := keychain.Delete(keychainService, c.ServerURL); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("credential store %q: must be keychain or file", store)
+	}
+	creds[c.ServerURL] = c
+
+	list := make([]Credential, 0, len(creds))
+	for _, c := range creds {
+		list = append(list, c)
+	}
+	// Sorted, so the file doesn't churn
+	slices.SortFunc(list, func(a, b Credential) int {
+		return strings.Compare(a.ServerURL, b.ServerURL)
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// Written aside and renamed, so a failed write keeps the old file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// pingInterval is how often the round-trip time to the server is measured
+// with a WebSocket ping, which the server's WebSocket library answers
+// without its code getting involved.
+const pingInterval = 10 * time.Second
+
+// latency is the round-trip time to the server, smoothed as TCP does
+// (RFC 6298), and its jitter: the smoothed difference between consecutive
+// round trips (RFC 3550).
+type latency struct {
+	mu       sync.Mutex
+	measured bool
+	last     time.Duration
+	rtt      time.Duration
+	jitter   time.Duration
+	// onRTT, when set, is told each round-trip time measured
+	onRTT func(time.Duration)
+}
+
+// observe adds a round trip to the measurements.
+func (l *latency) observe(rtt time.Duration) {
+	l.mu.Lock()
+	if !l.measured {
+		l.measured = true
+		l.rtt = rtt
+	} else {
+		l.rtt += (rtt - l.rtt) / 8
+		l.jitter += (abs(rtt-l.last) - l.jitter) / 16
+	}
+	l.last = rtt
+	onRTT := l.onRTT
+	l.mu.Unlock()
+
+	if onRTT != nil {
+		onRTT(rtt)
+	}
+}
+
+// reset forgets the measurements, for a new connection.
+func (l *latency) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.measured = false
+	l.last, l.rtt, l.jitter = 0, 0, 0
+}
+
+// milliseconds returns d in ms, to the µs.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// OnRTT sets a hook told each round-trip time measured to the server. Must
+// be called before Connect.
+func (c *Client) OnRTT(fn func(time.Duration)) {
+	c.latency.onRTT = fn
+}
+
+// Latency returns the smoothed round-trip time to the server and its
+// jitter, or nil before the first measurement on the current connection.
+func (c *Client) Latency() *protocol.Latency {
+	c.latency.mu.Lock()
+	defer c.latency.mu.Unlock()
+	if !c.latency.measured {
+		return nil
+	}
+	return &protocol.Latency{RTTMs: milliseconds(c.latency.rtt), JitterMs: milliseconds(c.latency.jitter)}
+}
+
+// ping sends a WebSocket ping carrying the time it was sent, which the
+// server's pong echoes for handlePong.
+func (c *Client) ping() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	sent := strconv.FormatInt(time.Now().UnixNano(), 10)
+	conn.WriteControl(websocket.PingMessage, []byte(sent), time.Now().Add(pingInterval))
+}
+
+// handlePong measures the round trip of a ping from its pong.
+func (c *Client) handlePong(data string) error {
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		// Not one of ours
+		return nil
+	}
+	c.latency.observe(time.Since(time.Unix(0, sent)))
+	return nil
+}
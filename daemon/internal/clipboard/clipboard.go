@@ -0,0 +1,130 @@
+// Package clipboard reads and writes the clipboard of the daemon's host:
+// through pbcopy(1) and pbpaste(1) on macOS, and through wl-copy and
+// wl-paste under Wayland or xclip or xsel under X11 elsewhere.
+package clipboard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ErrUnavailable is returned when the host has no clipboard the daemon can
+// use.
+var ErrUnavailable = errors.New("clipboard: not available")
+
+// MaxSize is the most text, in bytes, the clipboard is read or written
+// with.
+const MaxSize = 1 << 20
+
+// commandTimeout bounds each clipboard command; one that can't reach the
+// display server may hang.
+const commandTimeout = 5 * time.Second
+
+// tool is how the host's clipboard is written (copy) and read (paste).
+type tool struct {
+	copy, paste []string
+}
+
+// find returns the tool for the host's clipboard.
+func find() (tool, error) {
+	if runtime.GOOS == "darwin" {
+		if _, err := exec.LookPath("pbcopy"); err != nil {
+			return tool{}, fmt.Errorf("%w: pbcopy not found", ErrUnavailable)
+		}
+		return tool{copy: []string{"pbcopy"}, paste: []string{"pbpaste"}}, nil
+	}
+
+	wayland, x11 := os.Getenv("WAYLAND_DISPLAY") != "", os.Getenv("DISPLAY") != ""
+	if wayland {
+		if _, err := exec.LookPath("wl-copy"); err == nil {
+			return tool{
+				copy:  []string{"wl-copy"},
+				paste: []string{"wl-paste", "--no-newline", "--type", "text"},
+			}, nil
+		}
+	}
+	if x11 {
+		if _, err := exec.LookPath("xclip"); err == nil {
+			return tool{
+				copy:  []string{"xclip", "-selection", "clipboard", "-in"},
+				paste: []string{"xclip", "-selection", "clipboard", "-out"},
+			}, nil
+		}
+		if _, err := exec.LookPath("xsel"); err == nil {
+			return tool{
+				copy:  []string{"xsel", "--clipboard", "--input"},
+				paste: []string{"xsel", "--clipboard", "--output"},
+			}, nil
+		}
+	}
+	switch {
+	case wayland:
+		return tool{}, fmt.Errorf("%w: wl-copy not found (install wl-clipboard)", ErrUnavailable)
+	case x11:
+		return tool{}, fmt.Errorf("%w: xclip or xsel not found", ErrUnavailable)
+	}
+	return tool{}, fmt.Errorf("%w: no display (DISPLAY and WAYLAND_DISPLAY are unset)", ErrUnavailable)
+}
+
+// Available reports whether the clipboard can be used, with the reason if
+// not.
+func Available() error {
+	_, err := find()
+	return err
+}
+
+// Read returns the text on the clipboard.
+func Read() ([]byte, error) {
+	t, err := find()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.paste[0], t.paste[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, commandError(t.paste[0], strings.TrimSpace(stderr.String()), err)
+	}
+	if stdout.Len() > MaxSize {
+		return nil, fmt.Errorf("clipboard: holds %d bytes, more than %d", stdout.Len(), MaxSize)
+	}
+	return stdout.Bytes(), nil
+}
+
+// Write puts data on the clipboard.
+func Write(data []byte) error {
+	if len(data) > MaxSize {
+		return fmt.Errorf("clipboard: %d bytes is more than %d", len(data), MaxSize)
+	}
+	t, err := find()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	// xclip and wl-copy leave a process behind that serves the clipboard,
+	// so their output isn't waited for
+	cmd := exec.CommandContext(ctx, t.copy[0], t.copy[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	if err := cmd.Run(); err != nil {
+		return commandError(t.copy[0], "", err)
+	}
+	return nil
+}
+
+func commandError(name, stderr string, err error) error {
+	if stderr != "" {
+		return fmt.Errorf("clipboard: %s: %s", name, stderr)
+	}
+	return fmt.Errorf("clipboard: %s: %w", name, err)
+}
@@ -0,0 +1,881 @@
+// Package config loads the daemon's optional JSON configuration file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/artifacts"
+	"github.com/agenthq/daemon/internal/budget"
+	"github.com/agenthq/daemon/internal/docker"
+	"github.com/agenthq/daemon/internal/history"
+	"github.com/agenthq/daemon/internal/logship"
+	"github.com/agenthq/daemon/internal/macro"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/scope"
+)
+
+// Config is the daemon configuration. Every field is optional; a missing
+// config file is equivalent to an empty one.
+type Config struct {
+	// Servers lists the servers to connect to. When empty, the
+	// AGENTHQ_SERVER_URL, AGENTHQ_AUTH_TOKEN and AGENTHQ_ENV_ID environment
+	// variables describe a single server.
+	Servers []Server `json:"servers,omitempty"`
+
+	// Tokens are scoped tokens for clients of the control listener, besides
+	// the --token that allows everything.
+	Tokens []Token `json:"tokens,omitempty"`
+
+	// Profiles are named agent/model presets selectable per spawn, merged
+	// over the built-in profiles.
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+
+	// Agents adjust how each agent CLI is launched, by agent type.
+	Agents map[protocol.AgentType]Agent `json:"agents,omitempty"`
+
+	// MCPServers are made available to every agent that supports MCP.
+	MCPServers map[string]protocol.MCPServer `json:"mcpServers,omitempty"`
+
+	// Macros are named input sequences for send-macro, merged over the
+	// built-in macros.
+	Macros map[string]macro.Macro `json:"macros,omitempty"`
+
+	// Tags and Metadata are sent in registration so servers can route tasks
+	// to suitable environments (e.g. tags "gpu", "macos").
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// SessionBackend is the default session backend: "pty" (the default),
+	// "tmux", which runs sessions in a daemon-managed tmux server so they
+	// survive daemon restarts, or "docker", which runs them in containers.
+	// Spawns may pick another one.
+	SessionBackend string `json:"sessionBackend,omitempty"`
+
+	// Docker configures the docker session backend.
+	Docker Docker `json:"docker,omitempty"`
+
+	// WorktreeDiskMarginMB is the free space that must remain after a new
+	// worktree is checked out (default 1024); -1 disables the check.
+	WorktreeDiskMarginMB int `json:"worktreeDiskMarginMb,omitempty"`
+
+	// WorktreeRoot, if set, is the directory that holds agent worktrees,
+	// in a directory per repo (e.g. ~/.agenthq/worktrees/<repo>/<id>),
+	// instead of .agenthq-worktrees inside each repo. A leading ~/ is the
+	// home directory.
+	WorktreeRoot string `json:"worktreeRoot,omitempty"`
+
+	// ProtectedPaths are files and directories, relative to a worktree's
+	// root (e.g. ".github/workflows"), that the daemon never writes and
+	// reports when a session changed them. Repos can add more in
+	// .agenthq.yml.
+	ProtectedPaths []string `json:"protectedPaths,omitempty"`
+
+	// SensitivePaths are categories (name to globs) of files whose changes
+	// are flagged in a session's summary, over the defaults: license,
+	// governance, ci and lockfile. A category with no globs turns one off.
+	// See internal/sensitive.
+	SensitivePaths map[string][]string `json:"sensitivePaths,omitempty"`
+
+	// WorktreeRetention limits how many agent worktrees are kept in the
+	// workspace's repos. Unset limits are not enforced.
+	WorktreeRetention Retention `json:"worktreeRetention,omitempty"`
+
+	// InputLimits caps the input each session accepts.
+	InputLimits InputLimits `json:"inputLimits,omitempty"`
+
+	// Budget limits every session's CPU time and running time; spawns may
+	// override its limits and action. Unset, sessions are unlimited.
+	Budget protocol.Budget `json:"budget,omitempty"`
+
+	// Clipboard lets servers use the clipboard of the daemon's host.
+	Clipboard Clipboard `json:"clipboard,omitempty"`
+
+	// Redact masks secrets in session output before it is sent anywhere.
+	Redact Redaction `json:"redact,omitempty"`
+
+	// History is the daemon's own record of sessions and worktrees.
+	History History `json:"history,omitempty"`
+
+	// Telemetry exports traces and metrics to an OpenTelemetry collector.
+	Telemetry Telemetry `json:"telemetry,omitempty"`
+
+	// Watchdog restarts the daemon when it stops making progress.
+	Watchdog Watchdog `json:"watchdog,omitempty"`
+
+	// SafeMode refuses commands from a server that stopped acknowledging
+	// heartbeats.
+	SafeMode SafeMode `json:"safeMode,omitempty"`
+
+	// Drain bounds how long a drain waits for sessions before shutdown.
+	Drain Drain `json:"drain,omitempty"`
+
+	// Scheduler caps the sessions running at once, sharing them fairly
+	// between repos.
+	Scheduler Scheduler `json:"scheduler,omitempty"`
+
+	// Summarizer digests each agent session's transcript after it exits.
+	Summarizer Summarizer `json:"summarizer,omitempty"`
+
+	// LogShipping forwards log records to the servers.
+	LogShipping LogShipping `json:"logShipping,omitempty"`
+
+	// Monitor alerts when the daemon's own resource use gets out of hand.
+	Monitor Monitor `json:"monitor,omitempty"`
+
+	// AdaptiveOutput sends session output as screen updates over server
+	// connections that can't keep up with it.
+	AdaptiveOutput AdaptiveOutput `json:"adaptiveOutput,omitempty"`
+
+	// Output tunes how session output is read, sent and kept.
+	Output Output `json:"output,omitempty"`
+
+	// ShellHistory gives each session a bash history of its own.
+	ShellHistory ShellHistory `json:"shellHistory,omitempty"`
+
+	// Fetch fetches the workspace's repos on a schedule, so worktrees
+	// start from their remotes' latest commits.
+	Fetch Fetch `json:"fetch,omitempty"`
+
+	// Plugins are external programs the daemon runs to extend it: agent
+	// launchers, policy checks and event sinks. See internal/plugin.
+	Plugins []Plugin `json:"plugins,omitempty"`
+
+	// MaxMessageSize is the largest message, in bytes, sent whole over a
+	// WebSocket (default 1 MiB); larger ones are sent in chunks. -1 never
+	// chunks.
+	MaxMessageSize int `json:"maxMessageSize,omitempty"`
+}
+
+// Monitor configures the daemon's self-monitoring. Zero thresholds use the
+// defaults; -1 disables a check.
+type Monitor struct {
+	// Disabled turns self-monitoring off.
+	Disabled bool `json:"disabled,omitempty"`
+	// Interval is how often resource use is sampled (default "30s").
+	Interval string `json:"interval,omitempty"`
+	// MaxGoroutines (default 10000), MaxHeapMB (default 2048) and
+	// MaxSendQueue, the messages waiting to be sent to the servers
+	// (default 100), raise a daemon-alert when exceeded.
+	MaxGoroutines int `json:"maxGoroutines,omitempty"`
+	MaxHeapMB     int `json:"maxHeapMb,omitempty"`
+	MaxSendQueue  int `json:"maxSendQueue,omitempty"`
+	// DumpDir is where goroutine stacks are dumped on an alert (default
+	// ~/.agenthq/diagnostics).
+	DumpDir string `json:"dumpDir,omitempty"`
+}
+
+// IntervalDuration returns the parsed Interval, or 0 if unset.
+func (m Monitor) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(m.Interval)
+	return d
+}
+
+// AdaptiveOutput configures condensing the output of a backed-up server
+// connection's sessions into periodic screen updates.
+type AdaptiveOutput struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// After is how long a connection must be backed up before its output
+	// is condensed (default "5s").
+	After string `json:"after,omitempty"`
+	// Interval is how often condensed sessions send what changed on their
+	// screen (default "1s").
+	Interval string `json:"interval,omitempty"`
+	// Recover is how long a connection must keep up again before its
+	// output is streamed again (default "30s").
+	Recover string `json:"recover,omitempty"`
+}
+
+// AfterDuration returns the parsed After, or 0 if unset.
+func (a AdaptiveOutput) AfterDuration() time.Duration {
+	d, _ := time.ParseDuration(a.After)
+	return d
+}
+
+// IntervalDuration returns the parsed Interval, or 0 if unset.
+func (a AdaptiveOutput) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(a.Interval)
+	return d
+}
+
+// RecoverDuration returns the parsed Recover, or 0 if unset.
+func (a AdaptiveOutput) RecoverDuration() time.Duration {
+	d, _ := time.ParseDuration(a.Recover)
+	return d
+}
+
+// Output tunes how session output is read from terminals, sent to the
+// servers and kept for resyncs. A local link does best with small, prompt
+// messages; a high-latency relay with fewer, larger ones.
+type Output struct {
+	// ReadBufferSize is the most output, in bytes, read from a terminal at
+	// once (default 4096).
+	ReadBufferSize int `json:"readBufferSize,omitempty"`
+	// CoalesceInterval is how long output is held to go out in one
+	// pty-data with the output that follows it (default "0", sending each
+	// read as it comes).
+	CoalesceInterval string `json:"coalesceInterval,omitempty"`
+	// ReplayBufferSize is how much of each session's recent output, in
+	// bytes, is kept to answer resync requests (default 256 KiB).
+	ReplayBufferSize int `json:"replayBufferSize,omitempty"`
+}
+
+// CoalesceDuration returns the parsed CoalesceInterval, or 0 if unset.
+func (o Output) CoalesceDuration() time.Duration {
+	d, _ := time.ParseDuration(o.CoalesceInterval)
+	return d
+}
+
+// ShellHistory configures the bash history of sessions: their own, kept
+// with their worktree, instead of the user's.
+type ShellHistory struct {
+	// Shared lets sessions share the user's bash history instead.
+	Shared bool `json:"shared,omitempty"`
+	// Retention is how long a session's history is kept after it was last
+	// written (default "168h"); removing the worktree removes it sooner.
+	Retention string `json:"retention,omitempty"`
+}
+
+// RetentionDuration returns the parsed Retention, or 0 if unset.
+func (s ShellHistory) RetentionDuration() time.Duration {
+	d, _ := time.ParseDuration(s.Retention)
+	return d
+}
+
+// Fetch configures fetching repos on a schedule.
+type Fetch struct {
+	// Interval is how often repos are fetched (e.g. "15m"); unset, they
+	// are only fetched on fetch-repo.
+	Interval string `json:"interval,omitempty"`
+	// Repos names the workspace's repos to fetch, by directory name; empty
+	// fetches all of them.
+	Repos []string `json:"repos,omitempty"`
+}
+
+// IntervalDuration returns the parsed Interval, or 0 if unset.
+func (f Fetch) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(f.Interval)
+	return d
+}
+
+// LogShipping configures forwarding log records as daemon-log messages.
+type LogShipping struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Level is the lowest level forwarded: "info", "warn" (the default) or
+	// "error".
+	Level string `json:"level,omitempty"`
+}
+
+// Plugin declares a plugin: an executable the daemon starts and talks
+// JSON-RPC with over its stdin and stdout.
+type Plugin struct {
+	// Name identifies the plugin in logs and errors.
+	Name    string   `json:"name"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// Env is added to the daemon's environment for the plugin.
+	Env map[string]string `json:"env,omitempty"`
+	// Timeout bounds each call to the plugin (default "5s").
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// TimeoutDuration returns the parsed Timeout, or 0 if unset.
+func (p Plugin) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(p.Timeout)
+	return d
+}
+
+// Watchdog configures the watchdog over the read loops and session manager.
+type Watchdog struct {
+	// Disabled turns the watchdog off.
+	Disabled bool `json:"disabled,omitempty"`
+	// Timeout is how long a read loop may spend on one message, or the
+	// session manager stay locked, before the watchdog trips (default
+	// "2m").
+	Timeout string `json:"timeout,omitempty"`
+	// LogOnly reports trips without restarting the daemon.
+	LogOnly bool `json:"logOnly,omitempty"`
+}
+
+// TimeoutDuration returns the parsed Timeout, or 0 if unset.
+func (w Watchdog) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(w.Timeout)
+	return d
+}
+
+// SafeMode configures safe mode, which a server connection enters when a
+// server that acknowledges heartbeats stops doing so.
+type SafeMode struct {
+	// Disabled never enters safe mode.
+	Disabled bool `json:"disabled,omitempty"`
+	// After is how long without a heartbeat-ack enters safe mode (default
+	// "90s").
+	After string `json:"after,omitempty"`
+}
+
+// AfterDuration returns the parsed After, or 0 if unset.
+func (s SafeMode) AfterDuration() time.Duration {
+	d, _ := time.ParseDuration(s.After)
+	return d
+}
+
+// Drain configures draining, which stops the daemon taking new work and
+// waits for its sessions to finish before it shuts down.
+type Drain struct {
+	// Timeout is how long to wait for sessions (default "10m"); those
+	// still running then are ended by the shutdown.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// TimeoutDuration returns the parsed Timeout, or 0 if unset.
+func (d Drain) TimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(d.Timeout)
+	return timeout
+}
+
+// Scheduler configures how spawns wait for a free slot when many sessions
+// are asked for at once. Repos cap their own sessions in .agenthq.yml.
+type Scheduler struct {
+	// MaxSessions is how many sessions may run at once; 0 (the default)
+	// is no limit. Spawns beyond it wait, and slots that free up go to
+	// the repos waiting in turn.
+	MaxSessions int `json:"maxSessions,omitempty"`
+}
+
+// Summarizer configures a command, such as a local LLM CLI, run on the
+// transcript of each agent session that exits. What it prints is sent as
+// the session's summary. See internal/summarize.
+type Summarizer struct {
+	// Command is the executable to run; unset, sessions aren't summarized.
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	// Env is added to the daemon's environment for the command.
+	Env map[string]string `json:"env,omitempty"`
+	// Timeout bounds each run (default "2m").
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// TimeoutDuration returns the parsed Timeout, or 0 if unset.
+func (s Summarizer) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(s.Timeout)
+	return d
+}
+
+// Telemetry configures OTLP export. The OTEL_EXPORTER_OTLP_ENDPOINT,
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME environment variables
+// fill in unset fields.
+type Telemetry struct {
+	// Endpoint is the collector's OTLP/HTTP base URL (e.g.
+	// "http://localhost:4318"); nothing is exported without one.
+	Endpoint string            `json:"endpoint,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	// ServiceName defaults to "agenthq-daemon".
+	ServiceName string `json:"serviceName,omitempty"`
+	// MetricInterval is how often metrics are exported (default "30s").
+	MetricInterval string `json:"metricInterval,omitempty"`
+}
+
+// MetricIntervalDuration returns the parsed MetricInterval, or 0 if unset.
+func (t Telemetry) MetricIntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(t.MetricInterval)
+	return d
+}
+
+// History configures the event history answering query-history.
+type History struct {
+	// Disabled records nothing.
+	Disabled bool `json:"disabled,omitempty"`
+	// Path is the history file (default ~/.agenthq/history.jsonl).
+	Path string `json:"path,omitempty"`
+	// Retention is how long events are kept (e.g. "720h"; default 90
+	// days).
+	Retention string `json:"retention,omitempty"`
+}
+
+// RetentionDuration returns the parsed Retention, or the default if unset.
+func (h History) RetentionDuration() time.Duration {
+	if d, err := time.ParseDuration(h.Retention); err == nil {
+		return d
+	}
+	return history.DefaultRetention
+}
+
+// InputLimits caps the input a session accepts, against controllers
+// paste-bombing a shell. Zero uses the default; -1 removes the limit.
+type InputLimits struct {
+	// MaxMessageBytes caps one input message (default 1 MiB).
+	MaxMessageBytes int `json:"maxMessageBytes,omitempty"`
+	// BytesPerSecond is the sustained input rate (default 256 KiB/s), and
+	// BurstBytes how much may arrive at once (default 1 MiB).
+	BytesPerSecond int `json:"bytesPerSecond,omitempty"`
+	BurstBytes     int `json:"burstBytes,omitempty"`
+}
+
+// Clipboard opts in to bridging the clipboard of the daemon's host with
+// the servers' UI; both directions are off by default.
+type Clipboard struct {
+	// Get lets servers read the clipboard (get-clipboard).
+	Get bool `json:"get,omitempty"`
+	// Set lets servers replace it (set-clipboard).
+	Set bool `json:"set,omitempty"`
+}
+
+// Docker configures the docker session backend, which is available
+// whenever a container engine is reachable.
+type Docker struct {
+	// Engine is "docker" or "podman"; empty detects whichever is running,
+	// preferring Docker.
+	Engine string `json:"engine,omitempty"`
+	// Host is the engine's API socket ("unix://path", "tcp://host:port" or
+	// "ssh://[user@]host[:port]");
+	// defaults to DOCKER_HOST/CONTAINER_HOST or the engine's rootful or
+	// rootless socket.
+	Host string `json:"host,omitempty"`
+	// CertPath is the directory with the TLS certificates (ca.pem,
+	// cert.pem, key.pem) for a tcp host; defaults to DOCKER_CERT_PATH when
+	// DOCKER_TLS_VERIFY is set.
+	CertPath string `json:"certPath,omitempty"`
+	// PathMap maps directories on this machine to the same directories on
+	// a remote engine's machine, e.g. a shared volume mounted on both.
+	// Sessions on a remote engine need their worktree under one.
+	PathMap map[string]string `json:"pathMap,omitempty"`
+	// Image is the default container image, and Images override it per
+	// agent. A repo's .agenthq.yml image wins over both.
+	Image  string                        `json:"image,omitempty"`
+	Images map[protocol.AgentType]string `json:"images,omitempty"`
+	// Mounts are extra bind mounts ("hostPath:containerPath[:ro]"), e.g.
+	// to give agents their credentials.
+	Mounts []string `json:"mounts,omitempty"`
+	// Devcontainer runs sessions in the repo's .devcontainer/devcontainer.json
+	// container, built if need be, unless .agenthq.yml names an image.
+	Devcontainer bool `json:"devcontainer,omitempty"`
+	// Sandbox limits containers' CPUs, memory and network; Sandboxes
+	// override it per agent, field by field.
+	Sandbox   protocol.Sandbox                        `json:"sandbox,omitempty"`
+	Sandboxes map[protocol.AgentType]protocol.Sandbox `json:"sandboxes,omitempty"`
+}
+
+// Redaction selects the secrets masked in session output.
+type Redaction struct {
+	// Builtin masks common credential formats (API keys, tokens).
+	Builtin bool `json:"builtin,omitempty"`
+	// Patterns are regular expressions (RE2 syntax) whose matches are masked.
+	Patterns []string `json:"patterns,omitempty"`
+	// EnvVars name environment variables of the daemon whose values are
+	// masked.
+	EnvVars []string `json:"envVars,omitempty"`
+}
+
+// Enabled reports whether anything is to be masked.
+func (r Redaction) Enabled() bool {
+	return r.Builtin || len(r.Patterns) > 0 || len(r.EnvVars) > 0
+}
+
+// Retention is a worktree retention policy. Worktrees with a running
+// session or uncommitted changes are never removed.
+type Retention struct {
+	// MaxPerRepo and MaxTotal cap the number of worktrees; the least
+	// recently used idle ones are removed first.
+	MaxPerRepo int `json:"maxPerRepo,omitempty"`
+	MaxTotal   int `json:"maxTotal,omitempty"`
+	// TTL removes worktrees this long (e.g. "72h") after their last session
+	// exited.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// TTLDuration returns the parsed TTL, or 0 if unset.
+func (r Retention) TTLDuration() time.Duration {
+	d, _ := time.ParseDuration(r.TTL)
+	return d
+}
+
+// Enabled reports whether any limit is set.
+func (r Retention) Enabled() bool {
+	return r.MaxPerRepo > 0 || r.MaxTotal > 0 || r.TTLDuration() > 0
+}
+
+// Server is one agenthq server the daemon connects to.
+type Server struct {
+	// Name identifies the server in logs and, when several servers are
+	// configured, namespaces its processIDs. Required with multiple servers.
+	Name string `json:"name,omitempty"`
+	// URL is the primary server URL.
+	URL string `json:"url"`
+	// FailoverURLs are tried in order when the primary keeps failing; the
+	// daemon fails back to the primary once it is reachable again.
+	FailoverURLs []string `json:"failoverUrls,omitempty"`
+	Token        string   `json:"token,omitempty"`
+	// EnvID is the environment ID to register as; generated when empty.
+	EnvID string `json:"envId,omitempty"`
+	// EnvName defaults to the hostname.
+	EnvName string `json:"envName,omitempty"`
+	// SigningSecret, when set, makes the daemon accept only server messages
+	// signed with it.
+	SigningSecret string `json:"signingSecret,omitempty"`
+	// Scopes limit what the server may ask of the daemon; empty allows
+	// everything. See package scope.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Token is a token clients of the control listener may present to be
+// allowed its scopes only.
+type Token struct {
+	// Name identifies the token's clients in logs.
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// URLs returns the primary URL followed by the failover URLs.
+func (s Server) URLs() []string {
+	return append([]string{s.URL}, s.FailoverURLs...)
+}
+
+// Profile selects an agent together with a model and extra CLI arguments.
+type Profile struct {
+	Agent protocol.AgentType `json:"agent"`
+	Model string             `json:"model,omitempty"`
+	Args  []string           `json:"args,omitempty"`
+}
+
+// Agent adjusts how an agent CLI is launched.
+type Agent struct {
+	// Cwd is where the agent starts: "package-dir" (the default: the
+	// targeted package's directory, or the worktree), "worktree-root",
+	// "repo-root" (the top of the git checkout), or a path, which may use
+	// placeholders such as {{.WorktreePath}}, relative to the worktree.
+	Cwd string `json:"cwd,omitempty"`
+}
+
+// DefaultPath returns the default config file location (~/.agenthq/daemon.json).
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".agenthq", "daemon.json")
+}
+
+// Load reads the config file at path. A missing file yields an empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i, server := range cfg.Servers {
+		if server.URL == "" {
+			return nil, fmt.Errorf("servers[%d]: url is required", i)
+		}
+		if len(cfg.Servers) > 1 {
+			if server.Name == "" || strings.Contains(server.Name, "/") {
+				return nil, fmt.Errorf("servers[%d]: a name without '/' is required when several servers are configured", i)
+			}
+			if names[server.Name] {
+				return nil, fmt.Errorf("servers[%d]: duplicate name %q", i, server.Name)
+			}
+			names[server.Name] = true
+		}
+		for _, s := range server.Scopes {
+			if err := scope.Valid(s); err != nil {
+				return nil, fmt.Errorf("servers[%d]: %w", i, err)
+			}
+		}
+	}
+
+	tokenNames := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for i, token := range cfg.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return nil, fmt.Errorf("tokens[%d]: name and token are required", i)
+		}
+		if tokenNames[token.Name] {
+			return nil, fmt.Errorf("tokens[%d]: duplicate name %q", i, token.Name)
+		}
+		if tokens[token.Token] {
+			return nil, fmt.Errorf("tokens[%d]: token is used by another entry", i)
+		}
+		tokenNames[token.Name], tokens[token.Token] = true, true
+		if len(token.Scopes) == 0 {
+			return nil, fmt.Errorf("tokens[%d]: at least one scope is required", i)
+		}
+		for _, s := range token.Scopes {
+			if err := scope.Valid(s); err != nil {
+				return nil, fmt.Errorf("tokens[%d]: %w", i, err)
+			}
+		}
+	}
+
+	for name, profile := range cfg.Profiles {
+		if profile.Agent == "" {
+			return nil, fmt.Errorf("profile %q: agent is required", name)
+		}
+	}
+	for agentType := range cfg.Agents {
+		if _, ok := protocol.AgentCommands[agentType]; !ok {
+			return nil, fmt.Errorf("agents: unknown agent %q", agentType)
+		}
+	}
+	for name, server := range cfg.MCPServers {
+		if server.Command == "" && server.URL == "" {
+			return nil, fmt.Errorf("mcp server %q: command or url is required", name)
+		}
+	}
+
+	for name, m := range cfg.Macros {
+		if len(m.Steps) == 0 {
+			return nil, fmt.Errorf("macro %q: steps are required", name)
+		}
+	}
+
+	for i, tag := range cfg.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return nil, fmt.Errorf("tags[%d]: tag is empty", i)
+		}
+	}
+
+	switch cfg.SessionBackend {
+	case "", "pty", "tmux", "docker":
+	default:
+		return nil, fmt.Errorf("sessionBackend %q: must be pty, tmux or docker", cfg.SessionBackend)
+	}
+
+	switch cfg.Docker.Engine {
+	case "", "docker", "podman":
+	default:
+		return nil, fmt.Errorf("docker.engine %q: must be docker or podman", cfg.Docker.Engine)
+	}
+	for agent, image := range cfg.Docker.Images {
+		if image == "" {
+			return nil, fmt.Errorf("docker.images.%s: image is empty", agent)
+		}
+	}
+	if err := docker.ValidateSandbox(cfg.Docker.Sandbox); err != nil {
+		return nil, fmt.Errorf("docker.sandbox: %w", err)
+	}
+	for agent, sandbox := range cfg.Docker.Sandboxes {
+		if err := docker.ValidateSandbox(docker.MergeSandbox(cfg.Docker.Sandbox, sandbox)); err != nil {
+			return nil, fmt.Errorf("docker.sandboxes.%s: %w", agent, err)
+		}
+	}
+	for local, remote := range cfg.Docker.PathMap {
+		if !filepath.IsAbs(local) || !filepath.IsAbs(remote) {
+			return nil, fmt.Errorf("docker.pathMap %q: %q: paths must be absolute", local, remote)
+		}
+	}
+	for i, mount := range cfg.Docker.Mounts {
+		host, container, _ := strings.Cut(mount, ":")
+		if !filepath.IsAbs(host) || !filepath.IsAbs(strings.Split(container, ":")[0]) {
+			return nil, fmt.Errorf("docker.mounts[%d] %q: must be hostPath:containerPath with absolute paths", i, mount)
+		}
+	}
+
+	if cfg.History.Retention != "" {
+		if d, err := time.ParseDuration(cfg.History.Retention); err != nil || d <= 0 {
+			return nil, fmt.Errorf("history.retention %q: must be a positive duration", cfg.History.Retention)
+		}
+	}
+
+	if cfg.Telemetry.MetricInterval != "" {
+		if d, err := time.ParseDuration(cfg.Telemetry.MetricInterval); err != nil || d < time.Second {
+			return nil, fmt.Errorf("telemetry.metricInterval %q: must be a duration of at least 1s", cfg.Telemetry.MetricInterval)
+		}
+	}
+	if cfg.Telemetry.Endpoint != "" && !strings.HasPrefix(cfg.Telemetry.Endpoint, "http://") && !strings.HasPrefix(cfg.Telemetry.Endpoint, "https://") {
+		return nil, fmt.Errorf("telemetry.endpoint %q: must be an http or https URL", cfg.Telemetry.Endpoint)
+	}
+
+	if cfg.LogShipping.Level != "" && !logship.ValidLevel(cfg.LogShipping.Level) {
+		return nil, fmt.Errorf("logShipping.level %q: must be info, warn or error", cfg.LogShipping.Level)
+	}
+
+	if cfg.Monitor.Interval != "" {
+		if d, err := time.ParseDuration(cfg.Monitor.Interval); err != nil || d < time.Second {
+			return nil, fmt.Errorf("monitor.interval %q: must be a duration of at least 1s", cfg.Monitor.Interval)
+		}
+	}
+	for name, v := range map[string]int{
+		"maxGoroutines": cfg.Monitor.MaxGoroutines,
+		"maxHeapMb":     cfg.Monitor.MaxHeapMB,
+		"maxSendQueue":  cfg.Monitor.MaxSendQueue,
+	} {
+		if v < -1 {
+			return nil, fmt.Errorf("monitor.%s %d: must be -1 or more", name, v)
+		}
+	}
+
+	for name, v := range map[string]string{
+		"after":    cfg.AdaptiveOutput.After,
+		"interval": cfg.AdaptiveOutput.Interval,
+		"recover":  cfg.AdaptiveOutput.Recover,
+	} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d < 100*time.Millisecond {
+			return nil, fmt.Errorf("adaptiveOutput.%s %q: must be a duration of at least 100ms", name, v)
+		}
+	}
+
+	if size := cfg.Output.ReadBufferSize; size != 0 && (size < 256 || size > 1<<20) {
+		return nil, fmt.Errorf("output.readBufferSize %d: must be between 256 and 1048576", size)
+	}
+	if cfg.Output.CoalesceInterval != "" {
+		if d, err := time.ParseDuration(cfg.Output.CoalesceInterval); err != nil || d < 0 || d > time.Second {
+			return nil, fmt.Errorf("output.coalesceInterval %q: must be a duration of at most 1s", cfg.Output.CoalesceInterval)
+		}
+	}
+	if size := cfg.Output.ReplayBufferSize; size != 0 && size < 4096 {
+		return nil, fmt.Errorf("output.replayBufferSize %d: must be at least 4096", size)
+	}
+
+	if cfg.ShellHistory.Retention != "" {
+		if d, err := time.ParseDuration(cfg.ShellHistory.Retention); err != nil || d < time.Hour {
+			return nil, fmt.Errorf("shellHistory.retention %q: must be a duration of at least 1h", cfg.ShellHistory.Retention)
+		}
+	}
+
+	if cfg.Fetch.Interval != "" {
+		if d, err := time.ParseDuration(cfg.Fetch.Interval); err != nil || d < time.Minute {
+			return nil, fmt.Errorf("fetch.interval %q: must be a duration of at least 1m", cfg.Fetch.Interval)
+		}
+	}
+	for _, name := range cfg.Fetch.Repos {
+		if name == "" || strings.ContainsRune(name, filepath.Separator) {
+			return nil, fmt.Errorf("fetch.repos %q: must be the name of a directory in the workspace", name)
+		}
+	}
+
+	if cfg.Watchdog.Timeout != "" {
+		if d, err := time.ParseDuration(cfg.Watchdog.Timeout); err != nil || d < 10*time.Second {
+			return nil, fmt.Errorf("watchdog.timeout %q: must be a duration of at least 10s", cfg.Watchdog.Timeout)
+		}
+	}
+
+	if cfg.SafeMode.After != "" {
+		if d, err := time.ParseDuration(cfg.SafeMode.After); err != nil || d < time.Minute {
+			return nil, fmt.Errorf("safeMode.after %q: must be a duration of at least 1m", cfg.SafeMode.After)
+		}
+	}
+	if cfg.Drain.Timeout != "" {
+		if d, err := time.ParseDuration(cfg.Drain.Timeout); err != nil || d <= 0 {
+			return nil, fmt.Errorf("drain.timeout %q: must be a positive duration", cfg.Drain.Timeout)
+		}
+	}
+
+	if cfg.Scheduler.MaxSessions < 0 {
+		return nil, fmt.Errorf("scheduler.maxSessions %d: must not be negative", cfg.Scheduler.MaxSessions)
+	}
+
+	if cfg.Summarizer.Command == "" && (len(cfg.Summarizer.Args) > 0 || len(cfg.Summarizer.Env) > 0 || cfg.Summarizer.Timeout != "") {
+		return nil, fmt.Errorf("summarizer: command is required")
+	}
+	if cfg.Summarizer.Timeout != "" {
+		if d, err := time.ParseDuration(cfg.Summarizer.Timeout); err != nil || d <= 0 {
+			return nil, fmt.Errorf("summarizer.timeout %q: must be a positive duration", cfg.Summarizer.Timeout)
+		}
+	}
+
+	pluginNames := make(map[string]bool)
+	for i, p := range cfg.Plugins {
+		if p.Name == "" || p.Command == "" {
+			return nil, fmt.Errorf("plugins[%d]: name and command are required", i)
+		}
+		if pluginNames[p.Name] {
+			return nil, fmt.Errorf("plugins[%d]: duplicate name %q", i, p.Name)
+		}
+		pluginNames[p.Name] = true
+		if p.Timeout != "" {
+			if d, err := time.ParseDuration(p.Timeout); err != nil || d <= 0 {
+				return nil, fmt.Errorf("plugins[%d].timeout %q: must be a positive duration", i, p.Timeout)
+			}
+		}
+	}
+
+	if cfg.MaxMessageSize != 0 && cfg.MaxMessageSize != -1 && cfg.MaxMessageSize < 4096 {
+		return nil, fmt.Errorf("maxMessageSize %d: must be -1 or at least 4096", cfg.MaxMessageSize)
+	}
+
+	for _, p := range cfg.ProtectedPaths {
+		if !filepath.IsLocal(p) || filepath.Clean(p) == "." {
+			return nil, fmt.Errorf("protectedPaths: %q must be a relative path inside the repo", p)
+		}
+	}
+
+	for category, globs := range cfg.SensitivePaths {
+		if category == "" {
+			return nil, fmt.Errorf("sensitivePaths: category name is required")
+		}
+		for _, pattern := range globs {
+			if !artifacts.ValidPattern(pattern) {
+				return nil, fmt.Errorf("sensitivePaths.%s %q: must be a relative, slash-separated glob", category, pattern)
+			}
+		}
+	}
+
+	if cfg.WorktreeDiskMarginMB < -1 {
+		return nil, fmt.Errorf("worktreeDiskMarginMb %d: must be -1 or more", cfg.WorktreeDiskMarginMB)
+	}
+	if rest, ok := strings.CutPrefix(cfg.WorktreeRoot, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("worktreeRoot %q: %w", cfg.WorktreeRoot, err)
+		}
+		cfg.WorktreeRoot = filepath.Join(home, rest)
+	}
+	if cfg.WorktreeRoot != "" && !filepath.IsAbs(cfg.WorktreeRoot) {
+		return nil, fmt.Errorf("worktreeRoot %q: must be an absolute path or start with ~/", cfg.WorktreeRoot)
+	}
+
+	retention := cfg.WorktreeRetention
+	if retention.MaxPerRepo < 0 || retention.MaxTotal < 0 {
+		return nil, fmt.Errorf("worktreeRetention: limits must not be negative")
+	}
+	if retention.TTL != "" {
+		if d, err := time.ParseDuration(retention.TTL); err != nil || d <= 0 {
+			return nil, fmt.Errorf("worktreeRetention.ttl %q: must be a positive duration such as 72h", retention.TTL)
+		}
+	}
+
+	limits := cfg.InputLimits
+	for name, v := range map[string]int{
+		"maxMessageBytes": limits.MaxMessageBytes,
+		"bytesPerSecond":  limits.BytesPerSecond,
+		"burstBytes":      limits.BurstBytes,
+	} {
+		if v < -1 {
+			return nil, fmt.Errorf("inputLimits.%s %d: must be -1 or more", name, v)
+		}
+	}
+
+	if err := budget.Validate(cfg.Budget); err != nil {
+		return nil, fmt.Errorf("budget: %w", err)
+	}
+
+	for i, pattern := range cfg.Redact.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("redact.patterns[%d]: %w", i, err)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,228 @@
+// Package console makes the daemon's log easier to follow for a developer
+// running it in a terminal: records are colored by level and tagged with
+// the session they are about, each session in a color of its own, and
+// sessions' output can be echoed inline, tagged the same way.
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/agenthq/daemon/internal/logship"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Color modes
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// maxPartial bounds the echoed output of a session kept waiting for a
+// newline; a longer line is echoed as it is.
+const maxPartial = 4096
+
+var (
+	// timestampRe matches the standard logger's date and time prefix
+	timestampRe = regexp.MustCompile(`^\d{4}/\d\d/\d\d (\d\d:\d\d:\d\d(\.\d+)?) `)
+	// processIDRe matches the way log records name a session
+	processIDRe = regexp.MustCompile(`\bprocessId=([^\s,]+)`)
+	// ansiRe matches terminal escape sequences (CSI, OSC, and two-byte escapes).
+	ansiRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+)
+
+// palette are the colors sessions are told apart by, leaving red and
+// yellow to errors and warnings.
+var palette = []string{"36", "32", "35", "34", "96", "92", "95", "94"}
+
+var levelColors = map[string]string{
+	protocol.LogLevelError: "31",
+	protocol.LogLevelWarn:  "33",
+}
+
+// UseColor resolves a color mode for f: auto colors a terminal, unless
+// NO_COLOR is set or TERM is dumb.
+func UseColor(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case ColorAlways:
+		return true, nil
+	case ColorNever:
+		return false, nil
+	case ColorAuto, "":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		info, err := f.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("unknown color mode %q (want %s, %s or %s)", mode, ColorAuto, ColorAlways, ColorNever)
+}
+
+// Writer is an io.Writer for the standard logger. Without color it passes
+// records through as they are.
+type Writer struct {
+	out   io.Writer
+	color bool
+
+	mu sync.Mutex
+	// sessions is the color of each session seen, by processId
+	sessions map[string]string
+	// partial is each session's echoed output since its last newline
+	partial map[string][]byte
+}
+
+// New returns a Writer writing to out, in color if color is set.
+func New(out io.Writer, color bool) *Writer {
+	return &Writer{
+		out:      out,
+		color:    color,
+		sessions: make(map[string]string),
+		partial:  make(map[string][]byte),
+	}
+}
+
+// Write writes a log record. In color, the date is left out, the time is
+// dimmed, a record about a session starts with its tag, and warnings and
+// errors are colored as such.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.color {
+		return w.out.Write(p)
+	}
+
+	record := strings.TrimSuffix(string(p), "\n")
+	var b strings.Builder
+	if m := timestampRe.FindStringSubmatch(record); m != nil {
+		b.WriteString(paint("2", m[1]) + " ")
+		record = record[len(m[0]):]
+	}
+	if processID := w.sessionOfLocked(record); processID != "" {
+		b.WriteString(w.tagLocked(processID) + " ")
+	}
+	if color, ok := levelColors[logship.Classify(record)]; ok {
+		record = paint(color, record)
+	}
+	b.WriteString(record + "\n")
+	if _, err := io.WriteString(w.out, b.String()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Echo writes a session's output into the log, a line at a time, each
+// starting with the session's tag. Escape sequences are left out, and of a
+// line redrawn with carriage returns, such as a progress bar, only what it
+// ended up as.
+func (w *Writer) Echo(processID string, data []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf := append(w.partial[processID], ansiRe.ReplaceAll(data, nil)...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.echoLineLocked(processID, buf[:i])
+		buf = buf[i+1:]
+	}
+	if len(buf) > maxPartial {
+		w.echoLineLocked(processID, buf)
+		buf = nil
+	}
+	if len(buf) == 0 {
+		delete(w.partial, processID)
+		return
+	}
+	w.partial[processID] = bytes.Clone(buf)
+}
+
+// Exited echoes what is left of a session's output.
+func (w *Writer) Exited(processID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if buf, ok := w.partial[processID]; ok {
+		w.echoLineLocked(processID, buf)
+		delete(w.partial, processID)
+	}
+}
+
+// echoLineLocked writes a line of a session's output; w.mu is held.
+func (w *Writer) echoLineLocked(processID string, line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if i := bytes.LastIndexByte(line, '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+	line = bytes.Map(func(r rune) rune {
+		if r < ' ' && r != '\t' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, line)
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+	fmt.Fprintf(w.out, "%s | %s\n", w.tagLocked(processID), line)
+}
+
+// sessionOfLocked returns the session a record is about: the one it names
+// with processId=, or else a session seen before whose processId is a word
+// of it; w.mu is held.
+func (w *Writer) sessionOfLocked(record string) string {
+	if m := processIDRe.FindStringSubmatch(record); m != nil {
+		return m[1]
+	}
+	for processID := range w.sessions {
+		if containsWord(record, processID) {
+			return processID
+		}
+	}
+	return ""
+}
+
+// tagLocked returns a session's tag, giving the session a color if it
+// hasn't one yet; w.mu is held.
+func (w *Writer) tagLocked(processID string) string {
+	tag := "[" + processID + "]"
+	if !w.color {
+		return tag
+	}
+	color, ok := w.sessions[processID]
+	if !ok {
+		color = palette[len(w.sessions)%len(palette)]
+		w.sessions[processID] = color
+	}
+	return paint(color, tag)
+}
+
+// paint wraps s in an SGR color.
+func paint(color, s string) string {
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// containsWord reports whether word occurs in s between characters that
+// can't be part of a processId.
+func containsWord(s, word string) bool {
+	for i := 0; ; {
+		j := strings.Index(s[i:], word)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(word)
+		if (start == 0 || !idChar(s[start-1])) && (end == len(s) || !idChar(s[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+func idChar(c byte) bool {
+	return c == '-' || c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
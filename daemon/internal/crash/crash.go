@@ -0,0 +1,72 @@
+// Package crash keeps a panic in one session or message from taking the
+// whole daemon down. Goroutines defer Recover, which logs a crash report
+// and hands it to the daemon's handler to notify the server and clean up
+// whatever the panic left behind.
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Report describes a recovered panic.
+type Report struct {
+	Time int64 `json:"ts"`
+	// Where names the goroutine or message that panicked.
+	Where string `json:"where"`
+	// ProcessID is the session affected, if any.
+	ProcessID string `json:"processId,omitempty"`
+	Panic     string `json:"panic"`
+	Stack     string `json:"stack"`
+}
+
+var handler atomic.Pointer[func(Report)]
+
+// SetHandler sets the function called with each crash report, after it has
+// been logged. It is called on the goroutine that panicked.
+func SetHandler(fn func(Report)) {
+	handler.Store(&fn)
+}
+
+// Recover recovers a panic in the calling goroutine and reports it. It must
+// be deferred directly:
+//
+//	defer crash.Recover("spawn", processID)
+func Recover(where, processID string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	report := Report{
+		Time:      time.Now().UnixMilli(),
+		Where:     where,
+		ProcessID: processID,
+		Panic:     fmt.Sprint(r),
+		Stack:     string(debug.Stack()),
+	}
+	log.Printf("Recovered panic in %s: %s", where, report.Panic)
+	if data, err := json.Marshal(report); err == nil {
+		log.Printf("Crash report: %s", data)
+	}
+	if fn := handler.Load(); fn != nil {
+		// A panicking handler must not undo the recovery
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Crash handler panicked: %v", r)
+			}
+		}()
+		(*fn)(report)
+	}
+}
+
+// Go runs fn in a new goroutine that recovers from panics.
+func Go(where, processID string, fn func()) {
+	go func() {
+		defer Recover(where, processID)
+		fn()
+	}()
+}
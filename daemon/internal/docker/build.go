@@ -0,0 +1,100 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Build builds an image from the Dockerfile at dockerfile (slash-separated,
+// relative to contextDir) and tags it. The context is sent without its .git
+// directory.
+func (c *Client) Build(contextDir, dockerfile string, args map[string]string, tag string) error {
+	buildArgs, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	query := url.Values{
+		"t":          {tag},
+		"dockerfile": {dockerfile},
+		"buildargs":  {string(buildArgs)},
+		"rm":         {"1"},
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeContext(pw, contextDir))
+	}()
+	defer pr.Close()
+
+	resp, err := c.send(context.Background(), http.MethodPost, "/build", query, pr)
+	if err != nil {
+		return fmt.Errorf("failed to build %s: %w", tag, err)
+	}
+	defer resp.Body.Close()
+	if err := readProgress(resp.Body); err != nil {
+		return fmt.Errorf("failed to build %s: %w", tag, err)
+	}
+	return nil
+}
+
+// writeContext writes dir as a tar archive, skipping .git.
+func writeContext(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() == ".git" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil // a worktree's .git file
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
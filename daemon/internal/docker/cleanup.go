@@ -0,0 +1,114 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// LabelOwner labels containers with the daemon that created them, so that
+// daemons sharing an engine leave each other's containers alone.
+const LabelOwner = "agenthq.owner"
+
+// ErrClosed is returned by Run once the client is closed.
+var ErrClosed = errors.New("container engine client is closed")
+
+// ownerID identifies this daemon: one runs per user and host.
+func ownerID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", hostname, os.Getuid())
+}
+
+// track records a container the client created, until it is removed. A
+// closed client removes it straight away instead.
+func (c *Client) track(container *Container) error {
+	c.mu.Lock()
+	closed := c.closed
+	if !closed {
+		c.containers[container.id] = container
+	}
+	c.mu.Unlock()
+
+	if closed {
+		container.remove()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (c *Client) untrack(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.containers, id)
+}
+
+// Orphan is a container left behind by an earlier run of the daemon.
+type Orphan struct {
+	ID        string
+	ProcessID string
+}
+
+// RemoveOrphans removes this daemon's containers that no session owns,
+// such as those of sessions that were running when it crashed, and
+// containers from before they were labelled with their owner.
+func (c *Client) RemoveOrphans() ([]Orphan, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	filters, _ := json.Marshal(map[string][]string{"label": {LabelProcessID}})
+	query := url.Values{"all": {"1"}, "filters": {string(filters)}}
+	var list []struct {
+		ID     string `json:"Id"`
+		Labels map[string]string
+	}
+	if err := c.do(ctx, http.MethodGet, "/containers/json", query, nil, &list); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var removed []Orphan
+	var errs []error
+	for _, container := range list {
+		if owner := container.Labels[LabelOwner]; owner != "" && owner != c.owner {
+			continue
+		}
+		c.mu.Lock()
+		_, live := c.containers[container.ID]
+		c.mu.Unlock()
+		if live {
+			continue
+		}
+		query := url.Values{"force": {"1"}, "v": {"1"}}
+		err := c.do(ctx, http.MethodDelete, "/containers/"+container.ID, query, nil, nil)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("container %.12s: %w", container.ID, err))
+			continue
+		}
+		removed = append(removed, Orphan{ID: container.ID, ProcessID: container.Labels[LabelProcessID]})
+	}
+	return removed, errors.Join(errs...)
+}
+
+// Close removes every container the client created that is still around,
+// and makes Run remove containers it creates from now on, which catches
+// spawns still pulling an image when the daemon shuts down.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	containers := make([]*Container, 0, len(c.containers))
+	for _, container := range c.containers {
+		containers = append(containers, container)
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for _, container := range containers {
+		if err := container.Close(); err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("container %.12s: %w", container.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
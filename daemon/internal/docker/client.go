@@ -0,0 +1,348 @@
+// Package docker runs sessions in containers. It talks to the Docker Engine
+// API directly over its socket, so the daemon needs neither the docker CLI
+// nor the Docker SDK, and works the same with podman, which serves a
+// compatible API.
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHost is the Docker daemon used when neither the config nor
+// DOCKER_HOST names one and no other engine's socket is found.
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// Engines
+const (
+	EngineDocker = "docker"
+	EnginePodman = "podman"
+)
+
+// apiVersion is the Engine API version requests are made against (Docker
+// 20.10 and later, and podman's Docker-compatible API).
+const apiVersion = "v1.41"
+
+// requestTimeout bounds API calls other than image pulls and waits.
+const requestTimeout = 30 * time.Second
+
+// ErrNotFound is returned for missing containers and images.
+var ErrNotFound = errors.New("not found")
+
+// Client is a client for the Docker Engine API, as served by Docker or
+// podman.
+type Client struct {
+	host    string
+	network string
+	addr    string
+	http    *http.Client
+
+	// engine and rootless are set by Detect
+	engine   string
+	rootless bool
+
+	egressMu    sync.Mutex
+	egressProxy *egressProxy
+
+	// tls is set for tcp engines that require TLS
+	tls *tls.Config
+
+	// owner labels the client's containers; containers are those it
+	// created that haven't been removed yet
+	owner      string
+	mu         sync.Mutex
+	containers map[string]*Container
+	closed     bool
+}
+
+// NewClient returns a client for the container engine at host
+// ("unix://path", "tcp://host:port" or "ssh://[user@]host[:port]").
+// Without a host it uses the engine's environment variable (DOCKER_HOST, or
+// CONTAINER_HOST for podman) or the first of its rootful and rootless
+// sockets that exists; engine "" considers both engines, preferring
+// Docker. A tcp engine is spoken to over TLS with the certificates in
+// certPath, or as DOCKER_TLS_VERIFY and DOCKER_CERT_PATH say.
+func NewClient(host, engine, certPath string) (*Client, error) {
+	if host == "" {
+		host = defaultHost(engine)
+	}
+
+	scheme, addr, ok := strings.Cut(host, "://")
+	if !ok || addr == "" {
+		return nil, fmt.Errorf("invalid container engine host %q", host)
+	}
+	var network string
+	switch scheme {
+	case "unix":
+		network = "unix"
+	case "tcp":
+		network = "tcp"
+	case "ssh":
+		network = "ssh"
+	default:
+		return nil, fmt.Errorf("container engine host %q: unsupported scheme %s", host, scheme)
+	}
+
+	c := &Client{
+		host:       host,
+		network:    network,
+		addr:       addr,
+		engine:     engine,
+		owner:      ownerID(),
+		containers: make(map[string]*Container),
+	}
+	if certPath := tlsCertPath(certPath); network == "tcp" && certPath != "" {
+		var err error
+		if c.tls, err = loadTLS(certPath, addr); err != nil {
+			return nil, err
+		}
+	}
+	c.http = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return c.dial(ctx)
+			},
+		},
+	}
+	return c, nil
+}
+
+// defaultHost finds the engine's socket.
+func defaultHost(engine string) string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	candidates := map[string][]string{
+		EngineDocker: {DefaultHost, "unix://" + filepath.Join(runtimeDir, "docker.sock")},
+		EnginePodman: {"unix://" + filepath.Join(runtimeDir, "podman", "podman.sock"), "unix:///run/podman/podman.sock"},
+	}
+	envVars := map[string]string{EngineDocker: "DOCKER_HOST", EnginePodman: "CONTAINER_HOST"}
+
+	engines := []string{engine}
+	if engine == "" {
+		engines = []string{EngineDocker, EnginePodman}
+	}
+	for _, e := range engines {
+		if host := os.Getenv(envVars[e]); host != "" {
+			return host
+		}
+	}
+	for _, e := range engines {
+		for _, host := range candidates[e] {
+			if _, err := os.Stat(strings.TrimPrefix(host, "unix://")); err == nil {
+				return host
+			}
+		}
+	}
+	return candidates[engines[0]][0]
+}
+
+// Host returns the container engine's address.
+func (c *Client) Host() string {
+	return c.host
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	if c.network == "ssh" {
+		return c.dialSSH()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil || c.tls == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, c.tls)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Engine describes the container engine a client talks to.
+type Engine struct {
+	Name     string // EngineDocker or EnginePodman
+	Version  string
+	Rootless bool
+}
+
+func (e Engine) String() string {
+	s := e.Name + " " + e.Version
+	if e.Rootless {
+		s += " (rootless)"
+	}
+	return s
+}
+
+// Detect checks that the engine is reachable and finds out which engine
+// it is and whether it runs rootless, which decides how containers map
+// users. It fails if the engine isn't the one the client was created for.
+func (c *Client) Detect() (Engine, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var version struct {
+		Version    string
+		Components []struct{ Name string }
+	}
+	if err := c.do(ctx, http.MethodGet, "/version", nil, nil, &version); err != nil {
+		return Engine{}, err
+	}
+	var info struct {
+		SecurityOptions []string
+	}
+	if err := c.do(ctx, http.MethodGet, "/info", nil, nil, &info); err != nil {
+		return Engine{}, err
+	}
+
+	engine := Engine{Name: EngineDocker, Version: version.Version}
+	for _, component := range version.Components {
+		if strings.HasPrefix(component.Name, "Podman") {
+			engine.Name = EnginePodman
+		}
+	}
+	engine.Rootless = slices.Contains(info.SecurityOptions, "name=rootless")
+	if c.engine != "" && c.engine != engine.Name {
+		return engine, fmt.Errorf("%s is %s, not %s", c.host, engine.Name, c.engine)
+	}
+
+	c.engine, c.rootless = engine.Name, engine.Rootless
+	return engine, nil
+}
+
+// request builds an API request. The host part of the URL is ignored by
+// the transport, which always dials the daemon.
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, body any) (*http.Request, error) {
+	u := "http://docker/" + apiVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	// body is sent as JSON, or as a tar archive if it is a reader
+	var r io.Reader
+	contentType := "application/json"
+	switch body := body.(type) {
+	case nil:
+	case io.Reader:
+		r = body
+		contentType = "application/x-tar"
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// do makes an API call and decodes its JSON response into out, if set.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	resp, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send makes an API call and returns its response, or an error carrying
+// the daemon's message if it failed.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	req, err := c.request(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.host, err)
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// responseError returns the error described by a failed API response.
+func responseError(resp *http.Response) error {
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, apiErr.Message)
+	}
+	return fmt.Errorf("%s (HTTP %d)", apiErr.Message, resp.StatusCode)
+}
+
+// hijack makes an API call that upgrades the connection to a raw stream,
+// as attach does, and returns the connection and a reader for the stream.
+func (c *Client) hijack(path string, query url.Values) (net.Conn, *bufio.Reader, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := c.request(ctx, http.MethodPost, path, query, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", c.host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, nil, responseError(resp)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, br, nil
+}
@@ -0,0 +1,383 @@
+package docker
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/pty"
+)
+
+// LabelProcessID labels containers with the processID of their session.
+const LabelProcessID = "agenthq.processId"
+
+// namePrefix marks containers created by the daemon.
+const namePrefix = "agenthq-"
+
+// ContainerName returns the container name for a processID. Docker allows
+// only [a-zA-Z0-9_.-] in names.
+func ContainerName(processID string) string {
+	name := []byte(namePrefix + processID)
+	for i, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '.' || c == '-') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// RunOptions describes a container to run a session in.
+type RunOptions struct {
+	ProcessID string
+	Image     string
+	// Command and Args are run in Dir, with the terminal settings of
+	// pty.TerminalEnv and Env.
+	Command string
+	Args    []string
+	Dir     string
+	Env     []string
+	// Mounts are bind mounts in docker's "host:container[:options]" form.
+	Mounts []string
+	// User is the user ("name" or "uid:gid") to run as. By default the
+	// session runs as whichever user keeps files it writes to bind mounts
+	// owned by the daemon's user.
+	User       string
+	Cols, Rows int
+	// OnPull receives progress if the image has to be pulled.
+	OnPull func(*protocol.ImagePull)
+	// Sandbox limits the container's resources and network.
+	Sandbox protocol.Sandbox
+}
+
+type containerConfig struct {
+	Image        string
+	Cmd          []string
+	Env          []string
+	WorkingDir   string
+	User         string
+	Labels       map[string]string
+	Tty          bool
+	OpenStdin    bool
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+	HostConfig   hostConfig
+}
+
+type hostConfig struct {
+	Binds []string
+	// Init runs an init process as PID 1 that reaps zombies and forwards
+	// signals.
+	Init        bool
+	UsernsMode  string   `json:",omitempty"`
+	SecurityOpt []string `json:",omitempty"`
+	NanoCPUs    int64    `json:"NanoCpus,omitempty"`
+	Memory      int64    `json:",omitempty"`
+	MemorySwap  int64    `json:",omitempty"`
+	NetworkMode string   `json:",omitempty"`
+}
+
+// Run creates a container, pulling its image if it isn't present, attaches
+// to its terminal and starts it.
+func (c *Client) Run(opts RunOptions) (*Container, error) {
+	if err := c.ensureImage(opts.Image, opts.OnPull); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	config := containerConfig{
+		Image:        opts.Image,
+		Cmd:          append([]string{opts.Command}, opts.Args...),
+		Env:          append(append([]string(nil), pty.TerminalEnv...), opts.Env...),
+		WorkingDir:   opts.Dir,
+		User:         opts.User,
+		Labels:       map[string]string{LabelProcessID: opts.ProcessID, LabelOwner: c.owner},
+		Tty:          true,
+		OpenStdin:    true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		HostConfig:   hostConfig{Binds: opts.Mounts, Init: true},
+	}
+	c.mapUser(&config)
+	egress, err := c.applySandbox(&config, opts.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	query := url.Values{"name": {ContainerName(opts.ProcessID)}}
+	if err := c.do(ctx, http.MethodPost, "/containers/create", query, config, &created); err != nil {
+		return nil, fmt.Errorf("failed to create container: %w", err)
+	}
+
+	container := &Container{client: c, id: created.ID, cols: opts.Cols, rows: opts.Rows, done: make(chan struct{})}
+	if err := c.track(container); err != nil {
+		return nil, err
+	}
+	if err := container.start(); err != nil {
+		container.remove()
+		return nil, err
+	}
+	if egress != nil {
+		// Until registered, the proxy denies the container everything
+		ip, err := c.containerIP(created.ID, EgressNetwork)
+		if err != nil {
+			container.Close()
+			return nil, fmt.Errorf("egress allowlist: %w", err)
+		}
+		egress.register(ip, egressSession{processID: opts.ProcessID, allowHosts: opts.Sandbox.AllowHosts})
+		container.egress, container.egressIP = egress, ip
+	}
+	return container, nil
+}
+
+// mapUser picks the container's user and user namespace so that the
+// daemon's user owns files the session writes to bind mounts.
+func (c *Client) mapUser(config *containerConfig) {
+	hostUser := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	switch {
+	case c.engine == EnginePodman && c.rootless:
+		// keep-id maps the daemon's user to the same uid in the container
+		config.HostConfig.UsernsMode = "keep-id"
+		config.User = cmp.Or(config.User, hostUser)
+	case c.rootless:
+		// Rootless Docker maps the container's root to the daemon's user
+		config.User = cmp.Or(config.User, "0:0")
+	default:
+		config.User = cmp.Or(config.User, hostUser)
+	}
+	if c.engine == EnginePodman {
+		// Don't let SELinux deny access to the worktree, and don't relabel it
+		config.HostConfig.SecurityOpt = []string{"label=disable"}
+	}
+}
+
+// ensureImage pulls an image unless it is present, reporting the pull's
+// progress to onPull if set.
+func (c *Client) ensureImage(image string, onPull func(*protocol.ImagePull)) error {
+	if exists, err := c.imageExists(image); err != nil || exists {
+		return err
+	}
+	return c.Pull(image, onPull)
+}
+
+// imageExists reports whether an image is present.
+func (c *Client) imageExists(image string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err := c.do(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readProgress reads the progress messages that pulls and builds stream,
+// returning the error one of them reports.
+func readProgress(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// WorktreeMounts returns the bind mounts that make a worktree available in
+// a container at its host path, together with the repository's git
+// directory that a linked worktree refers to, so git works inside.
+func WorktreeMounts(worktreePath string) ([]string, error) {
+	paths := []string{worktreePath}
+	out, err := exec.Command("git", "-C", worktreePath, "rev-parse", "--path-format=absolute", "--git-common-dir").Output()
+	if err == nil {
+		gitDir := strings.TrimSpace(string(out))
+		if rel, err := filepath.Rel(worktreePath, gitDir); err != nil || !filepath.IsLocal(rel) {
+			paths = append(paths, gitDir)
+		}
+	}
+
+	var mounts []string
+	for _, path := range paths {
+		if strings.Contains(path, ":") {
+			return nil, fmt.Errorf("cannot mount %s: path contains ':'", path)
+		}
+		mounts = append(mounts, path+":"+path)
+	}
+	return mounts, nil
+}
+
+// Container is a session running in a container, attached to its
+// terminal.
+type Container struct {
+	client *Client
+	id     string
+	conn   net.Conn
+	stream *bufio.Reader
+	// egress is the proxy the container is registered with at egressIP
+	egress   *egressProxy
+	egressIP string
+
+	mu     sync.Mutex
+	cols   int
+	rows   int
+	code   int
+	signal string
+	err    error
+	done   chan struct{}
+}
+
+// start attaches to the container, starts it and waits for it to exit in
+// the background.
+func (c *Container) start() error {
+	query := url.Values{"stream": {"1"}, "stdin": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+	conn, stream, err := c.client.hijack("/containers/"+c.id+"/attach", query)
+	if err != nil {
+		return fmt.Errorf("failed to attach to container: %w", err)
+	}
+	c.conn, c.stream = conn, stream
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := c.client.do(ctx, http.MethodPost, "/containers/"+c.id+"/start", nil, nil, nil); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+	if err := c.Resize(uint16(c.cols), uint16(c.rows)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	go c.wait()
+	return nil
+}
+
+// wait blocks until the container stops and records its exit status.
+func (c *Container) wait() {
+	var result struct {
+		StatusCode int
+		Error      *struct{ Message string }
+	}
+	query := url.Values{"condition": {"not-running"}}
+	err := c.client.do(context.Background(), http.MethodPost, "/containers/"+c.id+"/wait", query, nil, &result)
+	if err == nil && result.Error != nil && result.Error.Message != "" {
+		err = errors.New(result.Error.Message)
+	}
+
+	c.mu.Lock()
+	c.code, c.err = result.StatusCode, err
+	// As in a shell, a command killed by a signal exits with 128+n
+	if c.code > 128 && c.code < 128+32 {
+		c.code, c.signal = -1, pty.SignalName(syscall.Signal(result.StatusCode-128))
+	}
+	c.mu.Unlock()
+	close(c.done)
+}
+
+// ID returns the container ID.
+func (c *Container) ID() string {
+	return c.id
+}
+
+func (c *Container) Write(data []byte) (int, error) {
+	return c.conn.Write(data)
+}
+
+func (c *Container) Resize(cols, rows uint16) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	query := url.Values{"w": {strconv.Itoa(int(cols))}, "h": {strconv.Itoa(int(rows))}}
+	if err := c.client.do(ctx, http.MethodPost, "/containers/"+c.id+"/resize", query, nil, nil); err != nil {
+		return fmt.Errorf("failed to resize container: %w", err)
+	}
+	c.mu.Lock()
+	c.cols, c.rows = int(cols), int(rows)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Container) Size() (cols, rows int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cols, c.rows, nil
+}
+
+// StartReadLoop streams the container's terminal output to onData.
+func (c *Container) StartReadLoop(onData func([]byte)) {
+	go pty.ReadLoop(c.stream, onData)
+}
+
+// Wait blocks until the container stops and returns its exit code.
+func (c *Container) Wait() (int, error) {
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.code, c.err
+}
+
+// Signal returns the name of the signal that stopped the container's
+// command, or "".
+func (c *Container) Signal() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.signal
+}
+
+// Kill stops the container.
+func (c *Container) Kill() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.client.do(ctx, http.MethodPost, "/containers/"+c.id+"/kill", nil, nil, nil)
+}
+
+// Close detaches from the container and removes it, killing it if it is
+// still running.
+func (c *Container) Close() error {
+	c.conn.Close()
+	if c.egress != nil {
+		c.egress.unregister(c.egressIP)
+	}
+	return c.remove()
+}
+
+func (c *Container) remove() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	query := url.Values{"force": {"1"}, "v": {"1"}}
+	err := c.client.do(ctx, http.MethodDelete, "/containers/"+c.id, query, nil, nil)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		c.client.untrack(c.id)
+	}
+	return err
+}
+
+func (c *Container) Done() <-chan struct{} {
+	return c.done
+}
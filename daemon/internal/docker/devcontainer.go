@@ -0,0 +1,244 @@
+package docker
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DevcontainerFile is where a repo describes its development container.
+const DevcontainerFile = ".devcontainer/devcontainer.json"
+
+// Devcontainer is the subset of devcontainer.json the daemon supports: an
+// image or a Dockerfile to build, the user, environment and mounts.
+// Lifecycle commands, features and forwarded ports are ignored, and the
+// worktree is mounted at its host path rather than workspaceFolder.
+type Devcontainer struct {
+	Image string `json:"image"`
+	Build struct {
+		Dockerfile string            `json:"dockerfile"`
+		Context    string            `json:"context"`
+		Args       map[string]string `json:"args"`
+	} `json:"build"`
+	// DockerFile is the older spelling of build.dockerfile
+	DockerFile    string            `json:"dockerFile"`
+	ContainerUser string            `json:"containerUser"`
+	RemoteUser    string            `json:"remoteUser"`
+	ContainerEnv  map[string]string `json:"containerEnv"`
+	RemoteEnv     map[string]string `json:"remoteEnv"`
+	Mounts        []json.RawMessage `json:"mounts"`
+
+	// dir is the directory devcontainer.json is in
+	dir string
+}
+
+// LoadDevcontainer reads a worktree's devcontainer.json, returning nil if
+// there is none. ${localEnv:NAME[:default]}, ${localWorkspaceFolder} and
+// ${containerWorkspaceFolder} are substituted.
+func LoadDevcontainer(worktreePath string) (*Devcontainer, error) {
+	path := filepath.Join(worktreePath, filepath.FromSlash(DevcontainerFile))
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data = substituteVariables(stripJSONC(data), worktreePath)
+	dc := &Devcontainer{dir: filepath.Dir(path)}
+	if err := json.Unmarshal(data, dc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", DevcontainerFile, err)
+	}
+	if dc.Build.Dockerfile == "" {
+		dc.Build.Dockerfile = dc.DockerFile
+	}
+	if dc.Image == "" && dc.Build.Dockerfile == "" {
+		return nil, fmt.Errorf("%s: image or build.dockerfile is required", DevcontainerFile)
+	}
+	return dc, nil
+}
+
+// User returns the user to run as, or "" for the default.
+func (dc *Devcontainer) User() string {
+	if dc.RemoteUser != "" {
+		return dc.RemoteUser
+	}
+	return dc.ContainerUser
+}
+
+// Env returns the container's environment variables as KEY=value, sorted.
+func (dc *Devcontainer) Env() []string {
+	vars := make(map[string]string)
+	for k, v := range dc.ContainerEnv {
+		vars[k] = v
+	}
+	for k, v := range dc.RemoteEnv {
+		vars[k] = v
+	}
+
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// BindMounts returns the bind and volume mounts in docker's
+// "source:target[:ro]" form. Mounts may be strings
+// ("source=...,target=...,type=bind") or objects.
+func (dc *Devcontainer) BindMounts() ([]string, error) {
+	var mounts []string
+	for _, raw := range dc.Mounts {
+		var m struct {
+			Source   string `json:"source"`
+			Target   string `json:"target"`
+			Type     string `json:"type"`
+			ReadOnly bool   `json:"readonly"`
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			for _, field := range strings.Split(s, ",") {
+				key, value, _ := strings.Cut(field, "=")
+				switch key {
+				case "source", "src":
+					m.Source = value
+				case "target", "dst", "destination":
+					m.Target = value
+				case "type":
+					m.Type = value
+				case "readonly", "ro":
+					m.ReadOnly = value == "" || value == "true"
+				}
+			}
+		} else if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("%s: invalid mount %s", DevcontainerFile, raw)
+		}
+
+		if m.Type != "" && m.Type != "bind" && m.Type != "volume" {
+			return nil, fmt.Errorf("%s: unsupported mount type %q", DevcontainerFile, m.Type)
+		}
+		if m.Source == "" || m.Target == "" {
+			return nil, fmt.Errorf("%s: mount needs a source and target", DevcontainerFile)
+		}
+		mount := m.Source + ":" + m.Target
+		if m.ReadOnly {
+			mount += ":ro"
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// PrepareImage returns the devcontainer's image, building its Dockerfile
+// first if it has one. Built images are tagged by the Dockerfile's content
+// and build args and reused while that tag exists.
+func (c *Client) PrepareImage(dc *Devcontainer) (string, error) {
+	if dc.Build.Dockerfile == "" {
+		return dc.Image, nil
+	}
+
+	contextDir := filepath.Join(dc.dir, cmp.Or(dc.Build.Context, "."))
+	dockerfile := filepath.Join(dc.dir, dc.Build.Dockerfile)
+	rel, err := filepath.Rel(contextDir, dockerfile)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s: dockerfile must be inside the build context", DevcontainerFile)
+	}
+	content, err := os.ReadFile(dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", DevcontainerFile, err)
+	}
+
+	h := sha256.New()
+	h.Write(content)
+	args, _ := json.Marshal(dc.Build.Args) // map keys marshal sorted
+	h.Write(args)
+	tag := "agenthq-devcontainer:" + hex.EncodeToString(h.Sum(nil))[:12]
+
+	if exists, err := c.imageExists(tag); err != nil || exists {
+		return tag, err
+	}
+	if err := c.Build(contextDir, filepath.ToSlash(rel), dc.Build.Args, tag); err != nil {
+		return "", err
+	}
+	return tag, nil
+}
+
+// stripJSONC turns JSON with comments and trailing commas, as
+// devcontainer.json allows, into JSON.
+func stripJSONC(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '"':
+			// Copy the string, minding escapes
+			j := i + 1
+			for j < len(data) && data[j] != '"' {
+				if data[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j, len(data)-1)
+			out = append(out, data[i:j+1]...)
+			i = j
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := strings.Index(string(data[i+2:]), "*/")
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+		case c == '}' || c == ']':
+			// Drop a trailing comma before the closing bracket
+			k := len(out) - 1
+			for k >= 0 && (out[k] == ' ' || out[k] == '\t' || out[k] == '\n' || out[k] == '\r') {
+				k--
+			}
+			if k >= 0 && out[k] == ',' {
+				out = append(out[:k], out[k+1:]...)
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+var variablePattern = regexp.MustCompile(`\$\{(localEnv:[^}:]+(?::[^}]*)?|localWorkspaceFolder|containerWorkspaceFolder)\}`)
+
+// substituteVariables replaces the devcontainer.json variables the daemon
+// supports. The workspace folder is the worktree in both cases, since
+// that's where it is mounted.
+func substituteVariables(data []byte, worktreePath string) []byte {
+	return variablePattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		name := string(match[2 : len(match)-1])
+		var value string
+		if env, ok := strings.CutPrefix(name, "localEnv:"); ok {
+			key, fallback, _ := strings.Cut(env, ":")
+			value = cmp.Or(os.Getenv(key), fallback)
+		} else {
+			value = worktreePath
+		}
+		// The value lands inside a JSON string
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+}
@@ -0,0 +1,136 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// pullReportInterval throttles pull progress reports.
+const pullReportInterval = 500 * time.Millisecond
+
+// Pull pulls an image from its registry. If onProgress is set it receives
+// the pull's progress every pullReportInterval while layers change, and a
+// final report when the pull completes or fails.
+func (c *Client) Pull(image string, onProgress func(*protocol.ImagePull)) error {
+	progress := &pullProgress{image: image, report: onProgress, layers: make(map[string]*protocol.ImageLayer)}
+
+	name, tag := splitImage(image)
+	query := url.Values{"fromImage": {name}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	resp, err := c.send(context.Background(), http.MethodPost, "/images/create", query, nil)
+	if err == nil {
+		err = progress.read(resp.Body)
+		resp.Body.Close()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to pull %s: %w", image, err)
+		progress.finish(protocol.ImagePullFailed, err)
+		return err
+	}
+	progress.finish(protocol.ImagePullComplete, nil)
+	return nil
+}
+
+// splitImage splits an image reference into the name and tag to pull.
+// References without a tag pull "latest"; digest references pull as is.
+func splitImage(image string) (name, tag string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+// pullProgress tracks a pull's layers from the engine's progress stream.
+type pullProgress struct {
+	image  string
+	report func(*protocol.ImagePull)
+
+	layers   map[string]*protocol.ImageLayer
+	order    []string
+	reported time.Time
+}
+
+// read consumes the progress stream, returning the error it reports.
+func (p *pullProgress) read(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			ID             string `json:"id"`
+			Status         string `json:"status"`
+			Error          string `json:"error"`
+			ProgressDetail struct {
+				Current int64 `json:"current"`
+				Total   int64 `json:"total"`
+			} `json:"progressDetail"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+		// Messages without an id are about the whole image ("Pulling from
+		// library/node", "Digest: ...")
+		if msg.ID == "" || p.report == nil || strings.HasPrefix(msg.Status, "Pulling from") {
+			continue
+		}
+
+		layer, ok := p.layers[msg.ID]
+		if !ok {
+			layer = &protocol.ImageLayer{ID: msg.ID}
+			p.layers[msg.ID] = layer
+			p.order = append(p.order, msg.ID)
+		}
+		layer.Status = msg.Status
+		if d := msg.ProgressDetail; d.Total > 0 {
+			// Extraction restarts the count; keep reporting the download
+			if msg.Status == "Downloading" || layer.Total == 0 {
+				layer.Current, layer.Total = d.Current, d.Total
+			}
+		}
+		if msg.Status == "Download complete" || msg.Status == "Pull complete" {
+			layer.Current = layer.Total
+		}
+
+		if time.Since(p.reported) >= pullReportInterval {
+			p.send(protocol.ImagePullPulling, nil)
+		}
+	}
+}
+
+// finish sends the final report.
+func (p *pullProgress) finish(status string, err error) {
+	if p.report != nil {
+		p.send(status, err)
+	}
+}
+
+func (p *pullProgress) send(status string, err error) {
+	p.reported = time.Now()
+	pull := &protocol.ImagePull{Image: p.image, Status: status}
+	if err != nil {
+		pull.Error = err.Error()
+	}
+	for _, id := range p.order {
+		layer := *p.layers[id]
+		pull.Layers = append(pull.Layers, layer)
+		pull.Current += layer.Current
+		pull.Total += layer.Total
+	}
+	p.report(pull)
+}
@@ -0,0 +1,167 @@
+package docker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// loadTLS returns the TLS configuration for a tcp engine from the CA
+// certificate and client key pair in certPath (ca.pem, cert.pem and
+// key.pem, as docker expects them).
+func loadTLS(certPath, addr string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("container engine TLS: %w", err)
+	}
+	ca, err := os.ReadFile(filepath.Join(certPath, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("container engine TLS: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("container engine TLS: no certificates in %s", filepath.Join(certPath, "ca.pem"))
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ServerName: host}, nil
+}
+
+// tlsCertPath returns the directory of the TLS certificates for a tcp
+// engine: certPath if set, else DOCKER_CERT_PATH or ~/.docker when
+// DOCKER_TLS_VERIFY is set, else "" for plain TCP.
+func tlsCertPath(certPath string) string {
+	if certPath != "" || os.Getenv("DOCKER_TLS_VERIFY") == "" {
+		return certPath
+	}
+	if path := os.Getenv("DOCKER_CERT_PATH"); path != "" {
+		return path
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// dialSSH connects to the engine on an ssh host the way the docker CLI
+// does: by running "<engine> system dial-stdio" there and talking to it
+// over ssh's stdin and stdout. ssh uses the daemon user's ssh config and
+// keys, and must not need a password.
+func (c *Client) dialSSH() (net.Conn, error) {
+	// addr is [user@]host[:port]
+	target, port := c.addr, ""
+	if i := strings.LastIndex(target, ":"); i > strings.LastIndex(target, "]") {
+		target, port = target[:i], target[i+1:]
+	}
+	args := []string{"-o", "BatchMode=yes"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	engine := c.engine
+	if engine == "" {
+		engine = EngineDocker
+	}
+	args = append(args, "--", target, engine, "system", "dial-stdio")
+
+	cmd := exec.Command("ssh", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// commandConn is a connection over a command's stdin and stdout.
+// Deadlines aren't supported; closing the connection ends the command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr               { return commandAddr{} }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "ssh" }
+func (commandAddr) String() string  { return "ssh" }
+
+// Remote reports whether the engine may be on another machine, in which
+// case it can't see the daemon's files.
+func (c *Client) Remote() bool {
+	switch c.network {
+	case "unix":
+		return false
+	case "tcp":
+		host, _, err := net.SplitHostPort(c.addr)
+		if err != nil {
+			host = c.addr
+		}
+		ip := net.ParseIP(host)
+		return host != "localhost" && (ip == nil || !ip.IsLoopback())
+	}
+	return true
+}
+
+// RemotePath translates a path on the daemon's machine to where the engine
+// sees it, using pathMap, which maps local directories to the same
+// directories on the engine's machine (e.g. an NFS share mounted on
+// both). ok is false if no entry covers the path.
+func RemotePath(pathMap map[string]string, path string) (remote string, ok bool) {
+	// The longest matching prefix wins
+	best := ""
+	for local := range pathMap {
+		rel, err := filepath.Rel(local, path)
+		if err == nil && filepath.IsLocal(rel) && len(local) > len(best) {
+			best = local
+		}
+	}
+	if best == "" {
+		return path, false
+	}
+	rel, _ := filepath.Rel(best, path)
+	return filepath.Join(pathMap[best], rel), true
+}
+
+// MapMounts rewrites the host side of bind mounts ("host:container[:opts]")
+// with RemotePath. On a remote engine every mount must be mapped.
+func MapMounts(pathMap map[string]string, mounts []string, remote bool) ([]string, error) {
+	mapped := make([]string, len(mounts))
+	for i, mount := range mounts {
+		host, rest, _ := strings.Cut(mount, ":")
+		path, ok := RemotePath(pathMap, host)
+		if !ok && remote {
+			return nil, fmt.Errorf("%s is not shared with the remote container engine; add it to docker.pathMap", host)
+		}
+		mapped[i] = path + ":" + rest
+	}
+	return mapped, nil
+}
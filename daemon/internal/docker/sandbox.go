@@ -0,0 +1,298 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// EgressNetwork is the internal network that containers with an egress
+// allowlist join. It has no route out; the daemon's proxy on its gateway
+// is the only way out.
+const EgressNetwork = "agenthq-egress"
+
+// MergeSandbox returns base with the fields set in over replacing its own.
+func MergeSandbox(base, over protocol.Sandbox) protocol.Sandbox {
+	if over.CPUs != 0 {
+		base.CPUs = over.CPUs
+	}
+	if over.MemoryMB != 0 {
+		base.MemoryMB = over.MemoryMB
+	}
+	if over.Network != "" {
+		base.Network = over.Network
+	}
+	if over.AllowHosts != nil {
+		base.AllowHosts = over.AllowHosts
+	}
+	return base
+}
+
+// ValidateSandbox checks a sandbox's values.
+func ValidateSandbox(s protocol.Sandbox) error {
+	if s.CPUs < 0 || s.MemoryMB < 0 {
+		return fmt.Errorf("cpus and memoryMb must not be negative")
+	}
+	if s.MemoryMB != 0 && s.MemoryMB < 6 {
+		return fmt.Errorf("memoryMb %d: the minimum is 6", s.MemoryMB)
+	}
+	switch s.Network {
+	case "", protocol.NetworkNone, protocol.NetworkEgressAllowlist, protocol.NetworkFull:
+	default:
+		return fmt.Errorf("network %q: must be none, egress-allowlist or full", s.Network)
+	}
+	for _, host := range s.AllowHosts {
+		if strings.TrimPrefix(host, "*.") == "" || strings.ContainsAny(host, ":/ ") {
+			return fmt.Errorf("allowHosts: invalid host %q", host)
+		}
+	}
+	return nil
+}
+
+// applySandbox sets a container's resource limits and network.
+func (c *Client) applySandbox(config *containerConfig, s protocol.Sandbox) (*egressProxy, error) {
+	config.HostConfig.NanoCPUs = int64(s.CPUs * 1e9)
+	if s.MemoryMB > 0 {
+		config.HostConfig.Memory = int64(s.MemoryMB) << 20
+		// The same limit for memory and swap means no swap
+		config.HostConfig.MemorySwap = config.HostConfig.Memory
+	}
+
+	switch s.Network {
+	case protocol.NetworkNone:
+		config.HostConfig.NetworkMode = "none"
+	case protocol.NetworkEgressAllowlist:
+		if c.Remote() {
+			return nil, fmt.Errorf("egress allowlist needs the container engine on this machine")
+		}
+		proxy, err := c.egress()
+		if err != nil {
+			return nil, fmt.Errorf("egress allowlist: %w", err)
+		}
+		config.HostConfig.NetworkMode = EgressNetwork
+		for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+			config.Env = append(config.Env, name+"="+proxy.url)
+		}
+		config.Env = append(config.Env, "NO_PROXY=localhost,127.0.0.1", "no_proxy=localhost,127.0.0.1")
+		return proxy, nil
+	}
+	return nil, nil
+}
+
+// egress returns the client's egress proxy, creating the egress network
+// and starting the proxy on its gateway on first use.
+func (c *Client) egress() (*egressProxy, error) {
+	c.egressMu.Lock()
+	defer c.egressMu.Unlock()
+	if c.egressProxy != nil {
+		return c.egressProxy, nil
+	}
+
+	gateway, err := c.egressGateway()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(gateway, "0"))
+	if err != nil {
+		return nil, err
+	}
+	p := &egressProxy{url: "http://" + ln.Addr().String(), sessions: make(map[string]egressSession)}
+	go http.Serve(ln, p)
+	log.Printf("Egress proxy listening on %s", ln.Addr())
+
+	c.egressProxy = p
+	return p, nil
+}
+
+// egressGateway creates the egress network if need be and returns its
+// gateway address, which is the host's address on it.
+func (c *Client) egressGateway() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var network struct {
+		IPAM struct {
+			Config []struct{ Gateway string }
+		}
+	}
+	err := c.do(ctx, http.MethodGet, "/networks/"+EgressNetwork, nil, nil, &network)
+	if errors.Is(err, ErrNotFound) {
+		create := map[string]any{
+			"Name":     EgressNetwork,
+			"Driver":   "bridge",
+			"Internal": true,
+			"Labels":   map[string]string{"agenthq": "egress"},
+		}
+		if err = c.do(ctx, http.MethodPost, "/networks/create", nil, create, nil); err == nil {
+			err = c.do(ctx, http.MethodGet, "/networks/"+EgressNetwork, nil, nil, &network)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("network %s: %w", EgressNetwork, err)
+	}
+	for _, config := range network.IPAM.Config {
+		if config.Gateway != "" {
+			return config.Gateway, nil
+		}
+	}
+	return "", fmt.Errorf("network %s has no gateway", EgressNetwork)
+}
+
+// containerIP returns a container's address on a network.
+func (c *Client) containerIP(id, network string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var inspect struct {
+		NetworkSettings struct {
+			Networks map[string]struct{ IPAddress string }
+		}
+	}
+	if err := c.do(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, &inspect); err != nil {
+		return "", err
+	}
+	ip := inspect.NetworkSettings.Networks[network].IPAddress
+	if ip == "" {
+		return "", fmt.Errorf("container has no address on %s", network)
+	}
+	return ip, nil
+}
+
+// egressProxy is an HTTP proxy that lets each container on the egress
+// network reach only its allowed hosts. Containers are told apart by their
+// address; unknown addresses are denied.
+type egressProxy struct {
+	url string
+
+	mu       sync.Mutex
+	sessions map[string]egressSession // by container IP
+}
+
+type egressSession struct {
+	processID  string
+	allowHosts []string
+}
+
+func (p *egressProxy) register(ip string, session egressSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[ip] = session
+}
+
+func (p *egressProxy) unregister(ip string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, ip)
+}
+
+// hostAllowed reports whether host matches one of the patterns: a host
+// name, or "*.domain" for its subdomains.
+func hostAllowed(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	p.mu.Lock()
+	session, known := p.sessions[clientIP]
+	p.mu.Unlock()
+
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		target = r.URL.Host
+	}
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	if !known || !hostAllowed(session.allowHosts, host) {
+		log.Printf("Egress denied: %s (%s) -> %s", processLabel(session.processID), clientIP, host)
+		http.Error(w, "agenthq: egress to "+host+" is not allowed", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, target)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "agenthq: not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects a CONNECT request to its target.
+func (p *egressProxy) tunnel(w http.ResponseWriter, target string) {
+	upstream, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	go func() {
+		// Bytes the client sent after the CONNECT request
+		if n := buf.Reader.Buffered(); n > 0 {
+			data, _ := buf.Reader.Peek(n)
+			upstream.Write(data)
+		}
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+func processLabel(processID string) string {
+	if processID == "" {
+		return "unknown container"
+	}
+	return processID
+}
@@ -0,0 +1,121 @@
+// Package dotenv reads .env files: KEY=value lines, optionally prefixed
+// with "export", with # comments. Values may be single-quoted (taken
+// literally) or double-quoted (\n, \t, \", \\ and \$ are unescaped);
+// unquoted values end at " #". Variables in values are not expanded.
+package dotenv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// keyRe matches a valid variable name.
+var keyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// Var is a variable read from a file.
+type Var struct {
+	Key   string
+	Value string
+}
+
+// Parse parses the contents of a .env file.
+func Parse(data string) ([]Var, error) {
+	var vars []Var
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !keyRe.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected KEY=value", i+1)
+		}
+		value, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", i+1, key, err)
+		}
+		vars = append(vars, Var{Key: key, Value: value})
+	}
+	return vars, nil
+}
+
+func parseValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	switch quote := s[0]; quote {
+	case '\'', '"':
+		end := closingQuote(s, quote)
+		if end < 0 {
+			return "", errors.New("unterminated quote")
+		}
+		if rest := strings.TrimSpace(s[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", errors.New("unexpected text after quoted value")
+		}
+		if quote == '\'' {
+			return s[1:end], nil
+		}
+		return unescape(s[1:end]), nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// closingQuote returns the index of the quote closing s, which starts with
+// quote, or -1. Backslashes escape within double quotes.
+func closingQuote(s string, quote byte) int {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+var unescaper = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`, `\$`, `$`)
+
+func unescape(s string) string {
+	return unescaper.Replace(s)
+}
+
+// Load reads files, relative to dir, in order and returns their variables
+// as KEY=value; a later file's value for a key replaces an earlier one's.
+// Missing files are skipped.
+func Load(dir string, files []string) ([]string, error) {
+	index := make(map[string]int)
+	var env []string
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		vars, err := Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for _, v := range vars {
+			kv := v.Key + "=" + v.Value
+			if i, ok := index[v.Key]; ok {
+				env[i] = kv
+				continue
+			}
+			index[v.Key] = len(env)
+			env = append(env, kv)
+		}
+	}
+	return env, nil
+}
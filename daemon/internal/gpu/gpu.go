@@ -0,0 +1,192 @@
+// Package gpu detects the machine's GPUs so the server can route ML-heavy
+// tasks to environments that have them.
+package gpu
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Vendors reported in protocol.GPUInfo
+const (
+	VendorNVIDIA = "nvidia"
+	VendorApple  = "apple"
+	VendorAMD    = "amd"
+	VendorIntel  = "intel"
+)
+
+// queryTimeout bounds each detection command; system_profiler can be slow.
+const queryTimeout = 10 * time.Second
+
+// Detect returns the machine's GPUs, or nil if none were found. NVIDIA GPUs
+// are found with nvidia-smi, others on macOS with system_profiler.
+func Detect() []protocol.GPUInfo {
+	gpus := queryNVIDIA()
+	if runtime.GOOS == "darwin" {
+		gpus = append(gpus, queryDisplays()...)
+	}
+	return gpus
+}
+
+// Refresh returns gpus with current memory usage. Only NVIDIA GPUs report
+// usage, so nvidia-smi is queried again only if one was detected.
+func Refresh(gpus []protocol.GPUInfo) []protocol.GPUInfo {
+	hasNVIDIA := false
+	for _, g := range gpus {
+		if g.Vendor == VendorNVIDIA {
+			hasNVIDIA = true
+		}
+	}
+	if !hasNVIDIA {
+		return gpus
+	}
+
+	current := queryNVIDIA()
+	if current == nil {
+		// Keep reporting what was detected if the query fails
+		return gpus
+	}
+	for _, g := range gpus {
+		if g.Vendor != VendorNVIDIA {
+			current = append(current, g)
+		}
+	}
+	return current
+}
+
+// output runs a command with a timeout and returns its stdout.
+func output(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+// queryNVIDIA lists GPUs reported by nvidia-smi.
+func queryNVIDIA() []protocol.GPUInfo {
+	out, err := output("nvidia-smi", "--query-gpu=name,memory.total,memory.used", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil
+	}
+	return parseNVIDIA(string(out))
+}
+
+// parseNVIDIA parses nvidia-smi CSV lines of "name, total MiB, used MiB".
+func parseNVIDIA(out string) []protocol.GPUInfo {
+	var gpus []protocol.GPUInfo
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			continue
+		}
+		total, _ := strconv.Atoi(strings.TrimSpace(fields[1]))
+		used, _ := strconv.Atoi(strings.TrimSpace(fields[2]))
+		gpus = append(gpus, protocol.GPUInfo{
+			Vendor:       VendorNVIDIA,
+			Model:        strings.TrimSpace(fields[0]),
+			MemoryMB:     total,
+			MemoryUsedMB: used,
+		})
+	}
+	return gpus
+}
+
+// displaysReport is the part of `system_profiler SPDisplaysDataType -json`
+// we use.
+type displaysReport struct {
+	Displays []struct {
+		Model      string `json:"sppci_model"`
+		Vendor     string `json:"spdisplays_vendor"`
+		VRAM       string `json:"spdisplays_vram"`
+		SharedVRAM string `json:"spdisplays_vram_shared"`
+	} `json:"SPDisplaysDataType"`
+}
+
+// queryDisplays lists non-NVIDIA GPUs reported by system_profiler (macOS).
+func queryDisplays() []protocol.GPUInfo {
+	out, err := output("system_profiler", "SPDisplaysDataType", "-json")
+	if err != nil {
+		return nil
+	}
+	var report displaysReport
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil
+	}
+
+	var gpus []protocol.GPUInfo
+	for _, d := range report.Displays {
+		vendor := vendorOf(d.Vendor + " " + d.Model)
+		if vendor == VendorNVIDIA {
+			// Already reported by nvidia-smi if its driver is installed
+			continue
+		}
+		gpu := protocol.GPUInfo{
+			Vendor:   vendor,
+			Model:    d.Model,
+			MemoryMB: parseMemory(d.VRAM),
+		}
+		if gpu.MemoryMB == 0 {
+			gpu.MemoryMB = parseMemory(d.SharedVRAM)
+		}
+		if gpu.MemoryMB == 0 && vendor == VendorApple {
+			// Apple silicon GPUs use unified memory
+			gpu.MemoryMB = systemMemoryMB()
+		}
+		gpus = append(gpus, gpu)
+	}
+	return gpus
+}
+
+// vendorOf guesses the vendor from system_profiler's vendor and model text.
+func vendorOf(s string) string {
+	s = strings.ToLower(s)
+	switch {
+	case strings.Contains(s, "apple"):
+		return VendorApple
+	case strings.Contains(s, "nvidia"):
+		return VendorNVIDIA
+	case strings.Contains(s, "amd"), strings.Contains(s, "radeon"):
+		return VendorAMD
+	case strings.Contains(s, "intel"):
+		return VendorIntel
+	}
+	return ""
+}
+
+// parseMemory converts a size such as "1536 MB" or "8 GB" to MB.
+func parseMemory(s string) int {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "MB":
+		return n
+	case "GB":
+		return n * 1024
+	}
+	return 0
+}
+
+// systemMemoryMB returns the macOS physical memory size, or 0.
+func systemMemoryMB() int {
+	out, err := output("sysctl", "-n", "hw.memsize")
+	if err != nil {
+		return 0
+	}
+	bytes, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return int(bytes >> 20)
+}
@@ -0,0 +1,266 @@
+// Package history keeps the daemon's own record of session lifecycles,
+// worktree operations, agent transcripts and usage, so that it can be
+// queried even when the server's database doesn't have it. Events are
+// appended to a JSON lines file, one event per line.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Query limits
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// DefaultRetention is how long events are kept by default.
+const DefaultRetention = 90 * 24 * time.Hour
+
+// maxLine bounds the length of an event read back from the file; longer
+// lines are skipped.
+const maxLine = 1 << 20
+
+// maxEvent bounds the length of an event recorded, and maxField that of
+// each free-form field cut to fit it.
+const (
+	maxEvent = 64 << 10
+	maxField = 4 << 10
+)
+
+// DefaultPath returns the default history file (~/.agenthq/history.jsonl).
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".agenthq", "history.jsonl")
+}
+
+// Store is an append-only event history. A nil Store records nothing.
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the history file at path, creating it if need be, after
+// dropping events older than retention (0 keeps everything).
+func Open(path string, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if retention > 0 {
+		if err := prune(path, time.Now().Add(-retention).UnixMilli()); err != nil {
+			return nil, fmt.Errorf("failed to prune history: %w", err)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, file: file}, nil
+}
+
+// prune rewrites the history file without the events before cutoff, if it
+// has any.
+func prune(path string, cutoff int64) error {
+	var kept [][]byte
+	dropped := 0
+	err := scan(path, func(line []byte, e protocol.HistoryEvent) {
+		if e.Time < cutoff {
+			dropped++
+			return
+		}
+		kept = append(kept, slices.Clone(line))
+	})
+	if errors.Is(err, os.ErrNotExist) || err == nil && dropped == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range kept {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// scan calls fn with each event in the history file, in the order they
+// were recorded. Lines that don't parse, or are longer than maxLine, are
+// skipped.
+func scan(path string, fn func(line []byte, e protocol.HistoryEvent)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	var line []byte
+	tooLong, skipped := false, 0
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			tooLong = len(line) > maxLine
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if tooLong {
+			skipped++
+		} else {
+			var e protocol.HistoryEvent
+			if json.Unmarshal(line, &e) == nil {
+				fn(bytes.TrimSuffix(line, []byte("\n")), e)
+			}
+		}
+		line, tooLong = line[:0], false
+
+		if err != nil {
+			if skipped > 0 {
+				log.Printf("Skipped %d history events over %d bytes in %s", skipped, maxLine, path)
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Record appends an event, stamping it with the current time unless it has
+// one. Failures are logged; history is not worth failing an operation for.
+func (s *Store) Record(e protocol.HistoryEvent) {
+	if s == nil {
+		return
+	}
+	if e.Time == 0 {
+		e.Time = time.Now().UnixMilli()
+	}
+	data, err := json.Marshal(e)
+	if err == nil && len(data) > maxEvent {
+		data, err = json.Marshal(shorten(e))
+		if err == nil && len(data) > maxEvent {
+			err = fmt.Errorf("event is over %d bytes", maxEvent)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to record %s event: %v", e.Kind, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to record %s event: %v", e.Kind, err)
+	}
+}
+
+// shorten cuts an event's free-form fields to maxField bytes each, and its
+// list of files to as many as fit in maxField.
+func shorten(e protocol.HistoryEvent) protocol.HistoryEvent {
+	for _, field := range []*string{&e.Error, &e.Reason, &e.Note, &e.Command, &e.Transcript} {
+		if len(*field) > maxField {
+			*field = strings.ToValidUTF8((*field)[:maxField], "") + "…"
+		}
+	}
+	size := 0
+	for i, path := range e.TouchedProtected {
+		if size += len(path); size > maxField {
+			e.TouchedProtected = e.TouchedProtected[:i]
+			break
+		}
+	}
+	return e
+}
+
+// Query returns the events matching q, newest first.
+func (s *Store) Query(q protocol.HistoryQuery) ([]protocol.HistoryEvent, error) {
+	if s == nil {
+		return nil, errors.New("history is disabled")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	// Events are in the order they were recorded, so the newest matches
+	// are the last ones
+	var events []protocol.HistoryEvent
+	err := scan(s.path, func(_ []byte, e protocol.HistoryEvent) {
+		if !matches(q, e) {
+			return
+		}
+		events = append(events, e)
+		if len(events) >= 2*limit {
+			events = append(events[:0], events[len(events)-limit:]...)
+		}
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	slices.Reverse(events)
+	return events, nil
+}
+
+func matches(q protocol.HistoryQuery, e protocol.HistoryEvent) bool {
+	switch {
+	case len(q.Kinds) > 0 && !slices.Contains(q.Kinds, e.Kind),
+		q.ProcessID != "" && e.ProcessID != q.ProcessID,
+		q.WorktreeID != "" && e.WorktreeID != q.WorktreeID,
+		q.Agent != "" && e.Agent != q.Agent,
+		q.Path != "" && e.Path != q.Path,
+		q.Since != 0 && e.Time < q.Since,
+		q.Until != 0 && e.Time > q.Until:
+		return false
+	}
+	return true
+}
+
+// Close closes the history file.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
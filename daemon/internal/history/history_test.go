@@ -0,0 +1,53 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+func TestOversizedEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	s, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record(protocol.HistoryEvent{Kind: protocol.HistorySessionStarted, ProcessID: "p1"})
+	s.Record(protocol.HistoryEvent{Kind: protocol.HistorySessionAnnotated, ProcessID: "p2", Note: strings.Repeat("n", 2*maxEvent)})
+
+	// A line too long to read, as an earlier daemon could write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ts":1,"kind":"session-started","processId":"huge","note":"` + strings.Repeat("x", 2*maxLine) + "\"}\n")
+	f.Close()
+	s.Record(protocol.HistoryEvent{Kind: protocol.HistorySessionStarted, ProcessID: "p3"})
+	s.Close()
+
+	for _, retention := range []time.Duration{0, time.Hour} {
+		s, err := Open(path, retention)
+		if err != nil {
+			t.Fatalf("Open with retention %s: %v", retention, err)
+		}
+		events, err := s.Query(protocol.HistoryQuery{})
+		s.Close()
+		if err != nil {
+			t.Fatalf("Query with retention %s: %v", retention, err)
+		}
+		var ids []string
+		for _, e := range events {
+			ids = append(ids, e.ProcessID)
+			if e.ProcessID == "p2" && (len(e.Note) > maxField+len("…") || !strings.HasPrefix(e.Note, "nnnn")) {
+				t.Errorf("annotation recorded as %d bytes, want it cut to %d", len(e.Note), maxField)
+			}
+		}
+		if got := strings.Join(ids, " "); got != "p3 p2 p1" {
+			t.Errorf("with retention %s, Query returned %q, want %q", retention, got, "p3 p2 p1")
+		}
+	}
+}
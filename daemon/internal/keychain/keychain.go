@@ -0,0 +1,150 @@
+// Package keychain keeps secrets in the OS keychain: the macOS Keychain
+// through security(1), or a Secret Service (GNOME Keyring, KWallet) through
+// secret-tool(1) on Linux. Secrets are passed on stdin, never on a command
+// line.
+package keychain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get when no secret is stored for the account.
+var ErrNotFound = errors.New("keychain: not found")
+
+// ErrUnavailable is returned when the platform has no keychain the daemon
+// can use.
+var ErrUnavailable = errors.New("keychain: not available")
+
+// commandTimeout bounds each keychain command; a locked keychain may wait
+// for the user.
+const commandTimeout = 30 * time.Second
+
+// notFoundStatus is security(1)'s exit status for a missing item.
+const notFoundStatus = 44
+
+// Available reports whether the keychain can be used, with the reason if
+// not: the tool is missing, or on Linux no Secret Service is running.
+func Available() error {
+	switch runtime.GOOS {
+	case "darwin":
+		if _, err := exec.LookPath("security"); err != nil {
+			return fmt.Errorf("%w: security not found", ErrUnavailable)
+		}
+		return nil
+	case "linux":
+		if _, err := exec.LookPath("secret-tool"); err != nil {
+			return fmt.Errorf("%w: secret-tool not found (install libsecret-tools)", ErrUnavailable)
+		}
+		// A lookup that finds nothing fails quietly; one without a Secret
+		// Service says why
+		_, stderr, err := run(nil, "secret-tool", "lookup", "service", "agenthq-probe")
+		if err != nil && stderr != "" {
+			return fmt.Errorf("%w: %s", ErrUnavailable, stderr)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w on %s", ErrUnavailable, runtime.GOOS)
+}
+
+// Get returns the secret stored for account under service.
+func Get(service, account string) (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		out, stderr, err := run(nil, "security", "find-generic-password", "-s", service, "-a", account, "-w")
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == notFoundStatus {
+			return "", ErrNotFound
+		}
+		if err != nil {
+			return "", commandError("security", stderr, err)
+		}
+		return strings.TrimSuffix(out, "\n"), nil
+	case "linux":
+		out, stderr, err := run(nil, "secret-tool", "lookup", "service", service, "account", account)
+		if err != nil && stderr == "" {
+			return "", ErrNotFound
+		}
+		if err != nil {
+			return "", commandError("secret-tool", stderr, err)
+		}
+		return out, nil
+	}
+	return "", fmt.Errorf("%w on %s", ErrUnavailable, runtime.GOOS)
+}
+
+// Set stores secret for account under service, replacing any secret
+// already stored.
+func Set(service, account, secret string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		// Interactive mode reads the command, and so the secret, from stdin
+		command := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", quote(service), quote(account), quote(secret))
+		if _, stderr, err := run([]byte(command), "security", "-i"); err != nil || stderr != "" {
+			return commandError("security", stderr, err)
+		}
+		return nil
+	case "linux":
+		label := service + " " + account
+		if _, stderr, err := run([]byte(secret), "secret-tool", "store", "--label", label, "service", service, "account", account); err != nil {
+			return commandError("secret-tool", stderr, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w on %s", ErrUnavailable, runtime.GOOS)
+}
+
+// Delete removes the secret stored for account under service, if any.
+func Delete(service, account string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		_, stderr, err := run(nil, "security", "delete-generic-password", "-s", service, "-a", account)
+		var exit *exec.ExitError
+		if err != nil && !(errors.As(err, &exit) && exit.ExitCode() == notFoundStatus) {
+			return commandError("security", stderr, err)
+		}
+		return nil
+	case "linux":
+		// clear succeeds whether or not anything matched
+		if _, stderr, err := run(nil, "secret-tool", "clear", "service", service, "account", account); err != nil {
+			return commandError("secret-tool", stderr, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w on %s", ErrUnavailable, runtime.GOOS)
+}
+
+// run runs a keychain command with stdin, returning its output and its
+// trimmed error output.
+func run(stdin []byte, name string, args ...string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.String(), strings.TrimSpace(stderr.String()), err
+}
+
+func commandError(name, stderr string, err error) error {
+	if stderr != "" {
+		return fmt.Errorf("keychain: %s: %s", name, stderr)
+	}
+	return fmt.Errorf("keychain: %s: %w", name, err)
+}
+
+// quote quotes s for security(1)'s interactive mode, which splits commands
+// like a shell.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,223 @@
+// Package keys encodes input given by name, such as "up" or "ctrl+c", and
+// pastes, as the bytes an xterm-compatible terminal sends for them, so
+// front ends needn't know terminal escape sequences.
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Bracketed paste markers (DEC private mode 2004)
+const (
+	PasteStart = "\x1b[200~"
+	PasteEnd   = "\x1b[201~"
+)
+
+// pasteMinBytes is the size from which raw input of several lines is
+// taken for a paste.
+const pasteMinBytes = 64
+
+// named are the keys without modifiers that aren't a character of their
+// own.
+var named = map[string]string{
+	"enter":     "\r",
+	"return":    "\r",
+	"tab":       "\t",
+	"backspace": "\x7f",
+	"escape":    "\x1b",
+	"esc":       "\x1b",
+	"space":     " ",
+}
+
+// cursorKeys are the keys sent as CSI with a final letter, which take a
+// modifier as "CSI 1 ; m X".
+var cursorKeys = map[string]byte{
+	"up":    'A',
+	"down":  'B',
+	"right": 'C',
+	"left":  'D',
+	"home":  'H',
+	"end":   'F',
+}
+
+// tildeKeys are the keys sent as "CSI n ~", which take a modifier as
+// "CSI n ; m ~".
+var tildeKeys = map[string]int{
+	"insert":   2,
+	"delete":   3,
+	"pageup":   5,
+	"pagedown": 6,
+	"f5":       15,
+	"f6":       17,
+	"f7":       18,
+	"f8":       19,
+	"f9":       20,
+	"f10":      21,
+	"f11":      23,
+	"f12":      24,
+}
+
+// ss3Keys are F1 to F4, sent as SS3 with a final letter without a
+// modifier, and as "CSI 1 ; m X" with one.
+var ss3Keys = map[string]byte{
+	"f1": 'P',
+	"f2": 'Q',
+	"f3": 'R',
+	"f4": 'S',
+}
+
+// Encode returns the bytes typing names, in order, sends. A name is a key,
+// optionally after modifiers joined with "+": "enter", "up", "ctrl+c",
+// "alt+left", "shift+tab", "ctrl+shift+f5". A key is a single character,
+// one of enter (or return), tab, backspace, escape (or esc), space, up,
+// down, left, right, home, end, insert, delete, pageup, pagedown and f1 to
+// f12. Names are case-insensitive, except single characters.
+func Encode(names []string) ([]byte, error) {
+	var out []byte
+	for _, name := range names {
+		b, err := encode(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// encode returns the bytes typing a named key sends.
+func encode(name string) ([]byte, error) {
+	parts := strings.Split(name, "+")
+	key := parts[len(parts)-1]
+	if key == "" && len(parts) > 1 {
+		// "ctrl++" and the like
+		key, parts = "+", parts[:len(parts)-1]
+	}
+	var shift, alt, ctrl bool
+	for _, mod := range parts[:len(parts)-1] {
+		switch strings.ToLower(mod) {
+		case "shift":
+			shift = true
+		case "alt", "meta", "option":
+			alt = true
+		case "ctrl", "control":
+			ctrl = true
+		default:
+			return nil, fmt.Errorf("key %q: unknown modifier %q", name, mod)
+		}
+	}
+	// xterm's modifier parameter
+	mod := 1
+	if shift {
+		mod++
+	}
+	if alt {
+		mod += 2
+	}
+	if ctrl {
+		mod += 4
+	}
+
+	lower := strings.ToLower(key)
+	if final, ok := cursorKeys[lower]; ok {
+		if mod == 1 {
+			return []byte{0x1b, '[', final}, nil
+		}
+		return []byte(fmt.Sprintf("\x1b[1;%d%c", mod, final)), nil
+	}
+	if n, ok := tildeKeys[lower]; ok {
+		if mod == 1 {
+			return []byte(fmt.Sprintf("\x1b[%d~", n)), nil
+		}
+		return []byte(fmt.Sprintf("\x1b[%d;%d~", n, mod)), nil
+	}
+	if final, ok := ss3Keys[lower]; ok {
+		if mod == 1 {
+			return []byte{0x1b, 'O', final}, nil
+		}
+		return []byte(fmt.Sprintf("\x1b[1;%d%c", mod, final)), nil
+	}
+
+	var b []byte
+	switch {
+	case lower == "tab" && shift && !ctrl:
+		b, shift = []byte("\x1b[Z"), false
+	case named[lower] != "":
+		b = []byte(named[lower])
+	case len([]rune(key)) == 1:
+		b = []byte(key)
+	default:
+		return nil, fmt.Errorf("unknown key %q", name)
+	}
+	if ctrl {
+		c, ok := control(b)
+		if !ok {
+			return nil, fmt.Errorf("key %q: no control character for %q", name, key)
+		}
+		b = []byte{c}
+	}
+	if shift && !ctrl {
+		// Of the rest, only letters have a shifted form of their own
+		upper := bytes.ToUpper(b)
+		if bytes.Equal(upper, bytes.ToLower(b)) {
+			return nil, fmt.Errorf("key %q: shift only applies to letters, tab and special keys", name)
+		}
+		b = upper
+	}
+	if alt {
+		// Meta sends ESC first
+		b = append([]byte{0x1b}, b...)
+	}
+	return b, nil
+}
+
+// control returns the control character ctrl with a key sends: that of a
+// letter or of @ [ \ ] ^ _ ? and space.
+func control(b []byte) (byte, bool) {
+	if len(b) != 1 {
+		return 0, false
+	}
+	c := b[0]
+	switch {
+	case 'a' <= c && c <= 'z':
+		return c - 'a' + 1, true
+	case '@' <= c && c <= '_':
+		return c - '@', true
+	case c == ' ':
+		return 0, true
+	case c == '?':
+		return 0x7f, true
+	}
+	return 0, false
+}
+
+// Paste returns text wrapped in bracketed paste markers, which tell a
+// program that enabled bracketed paste that it was pasted rather than
+// typed: newlines in it don't submit a prompt. An end marker in text is
+// left out, so the paste can't end early and have the rest typed.
+func Paste(text string) []byte {
+	text = strings.ReplaceAll(text, PasteEnd, "")
+	return []byte(PasteStart + text + PasteEnd)
+}
+
+// AsPaste returns raw input as a paste if it looks pasted rather than
+// typed: text of at least 64 bytes over several lines, without escape
+// sequences or other control characters. Line endings it ends with are
+// left after the paste, so input that ends by submitting still submits.
+// Other input is returned as it is.
+func AsPaste(data []byte) []byte {
+	if len(data) < pasteMinBytes {
+		return data
+	}
+	text := bytes.TrimRight(data, "\r\n")
+	if bytes.IndexAny(text, "\r\n") < 0 {
+		return data
+	}
+	for _, c := range text {
+		if c < ' ' && c != '\t' && c != '\r' && c != '\n' || c == 0x7f {
+			return data
+		}
+	}
+	return append(Paste(string(text)), data[len(text):]...)
+}
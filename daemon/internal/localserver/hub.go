@@ -0,0 +1,309 @@
+// Package localserver serves the daemon protocol over WebSocket so clients
+// can drive the daemon directly, without an agenthq server in between.
+// Clients send ServerMessages and receive DaemonMessages, exactly as a server
+// would.
+package localserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/scope"
+	"github.com/agenthq/daemon/internal/traffic"
+	"github.com/gorilla/websocket"
+)
+
+// Hub accepts local WebSocket clients and broadcasts daemon messages to all
+// of them.
+type Hub struct {
+	token     string
+	tokens    []config.Token
+	hello     func() protocol.DaemonMessage
+	onMessage func(protocol.ServerMessage, scope.Scopes)
+
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	conns    map[*websocket.Conn]*sync.Mutex
+	// viewers maps read-only connections to the processID they follow
+	viewers map[*websocket.Conn]string
+
+	// maxMessageSize is the largest message sent whole; larger ones are
+	// chunked. Not positive means never chunk.
+	maxMessageSize int
+	chunkID        atomic.Uint64
+
+	// recorder, when set, records every message sent and received
+	recorder *traffic.Recorder
+}
+
+// NewHub creates a hub. If token is non-empty clients must present it, or
+// one of the scoped tokens set with SetTokens, as a bearer token or ?token=
+// query parameter. hello builds the register message sent to each client
+// when it connects; onMessage gets each message with its client's scopes.
+func NewHub(token string, hello func() protocol.DaemonMessage, onMessage func(protocol.ServerMessage, scope.Scopes)) *Hub {
+	return &Hub{
+		token:     token,
+		hello:     hello,
+		onMessage: onMessage,
+		conns:     make(map[*websocket.Conn]*sync.Mutex),
+		viewers:   make(map[*websocket.Conn]string),
+
+		maxMessageSize: protocol.DefaultMaxMessageSize,
+		upgrader: websocket.Upgrader{
+			// Browsers on other origins may only connect when a token
+			// protects the hub.
+			CheckOrigin: func(r *http.Request) bool {
+				return token != "" || isLocalOrigin(r)
+			},
+		},
+	}
+}
+
+// SetMaxMessageSize sets the largest message sent whole; larger ones are
+// sent in chunks of at most that size. Not positive means never chunk.
+// Must be called before the hub serves.
+func (h *Hub) SetMaxMessageSize(n int) {
+	h.maxMessageSize = n
+}
+
+// SetRecorder records every message sent and received, as server "local".
+// Must be called before the hub serves.
+func (h *Hub) SetRecorder(r *traffic.Recorder) {
+	h.recorder = r
+}
+
+// SetTokens sets the scoped tokens clients may present instead of the
+// hub's token. Clients already connected keep the scopes they connected
+// with.
+func (h *Hub) SetTokens(tokens []config.Token) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens = tokens
+}
+
+// Authorized reports whether a request carries the hub's token, or one of
+// its scoped tokens.
+func (h *Hub) Authorized(r *http.Request) bool {
+	_, _, ok := h.Scopes(r)
+	return ok
+}
+
+// Scopes returns the name and scopes of the scoped token a request
+// carries, no scopes for the hub's token, and whether it carries either.
+// A hub without a token allows everything to requests made to a loopback
+// address, and nothing to others.
+func (h *Hub) Scopes(r *http.Request) (string, scope.Scopes, bool) {
+	if h.token == "" {
+		return "", nil, isLoopbackHost(r.Host)
+	}
+	h.mu.Lock()
+	tokens := h.tokens
+	h.mu.Unlock()
+	return Scopes(r, h.token, tokens)
+}
+
+// Scopes returns the name and scopes of the token among tokens a request
+// presents, no scopes if it presents token, and whether it presents
+// either.
+func Scopes(r *http.Request, token string, tokens []config.Token) (string, scope.Scopes, bool) {
+	if Authorized(r, token) {
+		return "", nil, true
+	}
+	for _, t := range tokens {
+		if Authorized(r, t.Token) {
+			return t.Name, t.Scopes, true
+		}
+	}
+	return "", nil, false
+}
+
+// Authorized reports whether a request presents token, as a bearer token or
+// ?token= query parameter. An empty token never matches.
+func Authorized(r *http.Request, token string) bool {
+	presented := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		presented = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// ServeHTTP upgrades the request to a WebSocket and serves it.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, scopes, ok := h.Scopes(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Local client upgrade failed: %v", err)
+		return
+	}
+
+	writeMu := &sync.Mutex{}
+	h.mu.Lock()
+	h.conns[conn] = writeMu
+	h.mu.Unlock()
+	if name != "" {
+		log.Printf("Local client connected from %s with token %s (scopes %s)", r.RemoteAddr, name, strings.Join(scopes, ", "))
+	} else {
+		log.Printf("Local client connected from %s", r.RemoteAddr)
+	}
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.conns, conn)
+		h.mu.Unlock()
+		conn.Close()
+		log.Printf("Local client %s disconnected", r.RemoteAddr)
+	}()
+
+	if h.hello != nil {
+		if data, err := json.Marshal(h.hello()); err == nil {
+			h.recorder.Record(traffic.Out, "local", data)
+			writeMu.Lock()
+			writeFrames(conn, h.frames(data))
+			writeMu.Unlock()
+		}
+	}
+
+	chunks := protocol.NewReassembler()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if chunk, ok := protocol.ParseChunk(data); ok {
+			data, err = chunks.Add(chunk)
+			if err != nil {
+				log.Printf("Dropped chunked local message: %v", err)
+				continue
+			}
+			if data == nil {
+				continue
+			}
+		}
+
+		h.recorder.Record(traffic.In, "local", data)
+
+		msg, err := protocol.DecodeServerMessage(data)
+		if err != nil {
+			log.Printf("Rejected local message: %v", err)
+			if reply, err := json.Marshal(protocol.InvalidMessageReply(msg, err)); err == nil {
+				h.recorder.Record(traffic.Out, "local", reply)
+				writeMu.Lock()
+				writeFrames(conn, h.frames(reply))
+				writeMu.Unlock()
+			}
+			continue
+		}
+		h.onMessage(msg, scopes)
+	}
+}
+
+// Send broadcasts a message to every connected client.
+func (h *Hub) Send(msg protocol.DaemonMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	h.recorder.Record(traffic.Out, "local", data)
+	frames := h.frames(data)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn, writeMu := range h.conns {
+		writeMu.Lock()
+		err := writeFrames(conn, frames)
+		writeMu.Unlock()
+		if err != nil {
+			// The read loop notices the broken connection and cleans up
+			conn.Close()
+		}
+	}
+
+	// Viewers only follow their session's output
+	if msg.Type != protocol.MsgTypePtyData && msg.Type != protocol.MsgTypeProcessExit {
+		return nil
+	}
+	for conn, processID := range h.viewers {
+		if processID != msg.ProcessID {
+			continue
+		}
+		if err := writeFrames(conn, frames); err != nil {
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// frames splits an encoded message into the frames to send it as.
+func (h *Hub) frames(data []byte) [][]byte {
+	id := ""
+	if h.maxMessageSize > 0 && len(data) > h.maxMessageSize {
+		id = strconv.FormatUint(h.chunkID.Add(1), 36)
+	}
+	return protocol.SplitMessage(data, h.maxMessageSize, id)
+}
+
+// writeFrames writes a message's frames; the caller holds the
+// connection's write lock so no other message comes between them.
+func writeFrames(conn *websocket.Conn, frames [][]byte) error {
+	for _, frame := range frames {
+		if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalID returns id unchanged; local clients share one namespace.
+func (h *Hub) LocalID(id string) string {
+	return id
+}
+
+// Owns reports true: local clients see every session.
+func (h *Hub) Owns(id string) bool {
+	return true
+}
+
+// isLocalOrigin allows non-browser clients, and pages served from this
+// machine to requests made to it. The request's Host is checked too: a page
+// whose domain was rebound to 127.0.0.1 (DNS rebinding) sends its own
+// domain as Host and as its origin.
+func isLocalOrigin(r *http.Request) bool {
+	if !isLoopbackHost(r.Host) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && isLoopbackHost(u.Host)
+}
+
+// isLoopbackHost reports whether host, with or without a port, is
+// localhost or a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,34 @@
+package localserver
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsLocalOrigin(t *testing.T) {
+	tests := []struct {
+		host, origin string
+		want         bool
+	}{
+		{"localhost:7777", "", true},
+		{"127.0.0.1:7777", "http://localhost:5173", true},
+		{"[::1]:7777", "http://[::1]:5173", true},
+		{"localhost:7777", "https://127.0.0.1", true},
+		{"localhost:7777", "http://localhost.evil.com", false},
+		{"localhost:7777", "http://evil.com", false},
+		{"localhost:7777", "file://localhost", false},
+		{"evil.com:7777", "http://evil.com:7777", false},
+		{"evil.com:7777", "", false},
+		{"192.168.1.2:7777", "http://localhost", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := isLocalOrigin(r); got != tt.want {
+			t.Errorf("isLocalOrigin(Host %q, Origin %q) = %v, want %v", tt.host, tt.origin, got, tt.want)
+		}
+	}
+}
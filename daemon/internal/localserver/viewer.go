@@ -0,0 +1,145 @@
+package localserver
+
+import (
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/scope"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/gorilla/websocket"
+)
+
+// viewer holds the terminal page and its assets. xterm.js and xterm.css are
+// copied in from the web package by `make build-daemon`; without them the
+// page falls back to plain text.
+//
+//go:embed viewer
+var viewerFiles embed.FS
+
+// Sessions is what the viewer needs from the session manager. RecentOutput
+// is what new viewers are replayed, so it must be masked as live output is.
+type Sessions interface {
+	List() []session.Info
+	RecentOutput(processID string) ([]byte, error)
+}
+
+var sessionListPage = template.Must(template.New("sessions").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Agent HQ sessions</title>
+<style>body{font-family:system-ui,sans-serif;margin:2rem;background:#111;color:#ddd}a{color:#7cf}td{padding:.2rem 1rem .2rem 0}</style>
+</head>
+<body>
+<h1>Sessions</h1>
+{{if .Sessions}}<table>
+{{range .Sessions}}<tr><td><a href="{{.ID}}{{$.Query}}">{{.ID}}</a></td><td>{{.Agent}}</td><td>{{.WorktreePath}}</td></tr>
+{{end}}</table>{{else}}<p>No running sessions.</p>{{end}}
+</body>
+</html>
+`))
+
+// ViewerHandler serves a read-only web terminal for each session under
+// /view/: a session list, a page per session, and the output stream the page
+// follows. Nothing a viewer sends reaches the session.
+func (h *Hub) ViewerHandler(sessions Sessions) http.Handler {
+	assets, _ := fs.Sub(viewerFiles, "viewer")
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /view/assets/", http.StripPrefix("/view/assets/", http.FileServerFS(assets)))
+
+	mux.HandleFunc("GET /view/{$}", func(w http.ResponseWriter, r *http.Request) {
+		if !h.mayView(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		query := ""
+		if r.URL.RawQuery != "" {
+			query = "?" + r.URL.RawQuery
+		}
+		sessionListPage.Execute(w, map[string]any{
+			"Sessions": sessions.List(),
+			"Query":    query,
+		})
+	})
+
+	mux.HandleFunc("GET /view/{processId}", func(w http.ResponseWriter, r *http.Request) {
+		if !h.mayView(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.ServeFileFS(w, r, assets, "index.html")
+	})
+
+	mux.HandleFunc("GET /view/stream/{processId}", func(w http.ResponseWriter, r *http.Request) {
+		if !h.mayView(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.serveViewer(w, r, r.PathValue("processId"), sessions)
+	})
+
+	return mux
+}
+
+// mayView reports whether a request carries a token allowed to read
+// sessions.
+func (h *Hub) mayView(r *http.Request) bool {
+	_, scopes, ok := h.Scopes(r)
+	return ok && scopes.Has(scope.Read)
+}
+
+// serveViewer streams one session's output to a viewer, starting with the
+// recent output the daemon has buffered.
+func (h *Hub) serveViewer(w http.ResponseWriter, r *http.Request, processID string, sessions Sessions) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Viewer upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Replay and register under the hub lock, which also serializes all
+	// writes to viewers, so no output is lost between the two; a chunk in
+	// flight may be shown twice.
+	h.mu.Lock()
+	replay, err := sessions.RecentOutput(processID)
+	if err != nil {
+		h.mu.Unlock()
+		data, _ := json.Marshal(protocol.DaemonMessage{
+			Type:      protocol.MsgTypeProcessExit,
+			ProcessID: processID,
+			ExitCode:  -1,
+		})
+		conn.WriteMessage(websocket.TextMessage, data)
+		return
+	}
+	if len(replay) > 0 {
+		data, _ := json.Marshal(protocol.DaemonMessage{
+			Type:      protocol.MsgTypePtyData,
+			ProcessID: processID,
+			Data:      base64.StdEncoding.EncodeToString(replay),
+		})
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+	h.viewers[conn] = processID
+	h.mu.Unlock()
+
+	log.Printf("Viewer for process %s connected from %s", processID, r.RemoteAddr)
+	defer func() {
+		h.mu.Lock()
+		delete(h.viewers, conn)
+		h.mu.Unlock()
+	}()
+
+	// Discard anything the viewer sends; reading notices disconnects.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
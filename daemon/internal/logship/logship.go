@@ -0,0 +1,143 @@
+// Package logship forwards the daemon's log records to the server, so an
+// operator can see why a remote daemon failed without logging into its
+// machine. The daemon logs with the standard log package, which has no
+// levels; records are classified by their wording instead.
+package logship
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// queueSize bounds the records waiting to be sent; more are dropped and
+// counted.
+const queueSize = 256
+
+var (
+	errorRe = regexp.MustCompile(`^(Recovered panic|Crash report|Crash handler panicked|Watchdog tripped|Restarting after)`)
+	warnRe  = regexp.MustCompile(`^(Unknown|Alert:) |(?i)\b(fail(ed|s|ure|ing)?|error|rejected|unavailable|invalid|ignoring|aborted|stalled|dropped|denied|refused|not found|no such|exit status|timed out|didn't|couldn't|can't|cannot)\b`)
+	// timestampRe matches the standard logger's date and time prefix
+	timestampRe = regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d(\.\d+)? `)
+)
+
+var levels = map[string]int{
+	protocol.LogLevelInfo:  0,
+	protocol.LogLevelWarn:  1,
+	protocol.LogLevelError: 2,
+}
+
+// ValidLevel reports whether level is a log level records can be shipped
+// from.
+func ValidLevel(level string) bool {
+	_, ok := levels[level]
+	return ok
+}
+
+// Classify returns the level of a log message.
+func Classify(message string) string {
+	switch {
+	case errorRe.MatchString(message):
+		return protocol.LogLevelError
+	case warnRe.MatchString(message):
+		return protocol.LogLevelWarn
+	}
+	return protocol.LogLevelInfo
+}
+
+// Shipper is an io.Writer for the standard logger that sends the records
+// at or above a level. Sending happens on its own goroutine, so logging
+// never waits on the network.
+type Shipper struct {
+	queue chan protocol.LogRecord
+
+	mu      sync.Mutex
+	min     int
+	off     bool
+	partial []byte
+	dropped int
+}
+
+// New starts a shipper that passes records at or above level (default
+// warn) to send.
+func New(level string, send func(protocol.LogRecord)) (*Shipper, error) {
+	if level == "" {
+		level = protocol.LogLevelWarn
+	}
+	min, ok := levels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	s := &Shipper{min: min, queue: make(chan protocol.LogRecord, queueSize)}
+	go func() {
+		for record := range s.queue {
+			send(record)
+		}
+	}()
+	return s, nil
+}
+
+// SetLevel changes the lowest level passed on (default warn).
+func (s *Shipper) SetLevel(level string) error {
+	if level == "" {
+		level = protocol.LogLevelWarn
+	}
+	min, ok := levels[level]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.min = min
+	return nil
+}
+
+// SetEnabled turns shipping on or off; records logged while it is off
+// aren't sent later.
+func (s *Shipper) SetEnabled(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.off = !enabled
+}
+
+// Write queues the complete lines in p that are at or above the level.
+func (s *Shipper) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.ship(string(s.partial[:i]))
+		s.partial = s.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// ship queues one line, or counts it as dropped if the queue is full.
+func (s *Shipper) ship(line string) {
+	message := timestampRe.ReplaceAllString(line, "")
+	level := Classify(message)
+	if s.off || levels[level] < s.min {
+		return
+	}
+	record := protocol.LogRecord{
+		Time:    time.Now().UnixMilli(),
+		Level:   level,
+		Message: message,
+		Dropped: s.dropped,
+	}
+	select {
+	case s.queue <- record:
+		s.dropped = 0
+	default:
+		s.dropped++
+	}
+}
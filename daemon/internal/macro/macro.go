@@ -0,0 +1,111 @@
+// Package macro defines named input sequences that can be typed into a
+// session with a single request (e.g. "approve", "/compact").
+package macro
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Step is one part of a macro: an optional pause followed by input bytes.
+type Step struct {
+	// DelayMs is how long to wait before writing Input.
+	DelayMs int `json:"delayMs,omitempty"`
+	// Input is written to the PTY as-is. Use "\r" for Enter and "\u001b"
+	// for Escape.
+	Input string `json:"input,omitempty"`
+}
+
+// Macro is a named sequence of steps.
+type Macro struct {
+	Description string `json:"description,omitempty"`
+	Steps       []Step `json:"steps"`
+}
+
+// maxDelay caps a single step's delay so a bad config can't wedge a session.
+const maxDelay = 30 * time.Second
+
+// builtins are available without any configuration.
+var builtins = map[string]Macro{
+	"approve":   {Description: "Accept the highlighted option", Steps: []Step{{Input: "\r"}}},
+	"cancel":    {Description: "Dismiss the current prompt", Steps: []Step{{Input: "\x1b"}}},
+	"interrupt": {Description: "Send Ctrl-C", Steps: []Step{{Input: "\x03"}}},
+	"compact": {Description: "Compact the conversation", Steps: []Step{
+		{Input: "/compact"},
+		// Give slash-command autocomplete a moment before submitting.
+		{DelayMs: 150, Input: "\r"},
+	}},
+}
+
+// Set is the collection of macros available to the server.
+type Set struct {
+	mu     sync.RWMutex
+	macros map[string]Macro
+}
+
+// NewSet returns the built-in macros merged with configured ones.
+func NewSet(configured map[string]Macro) *Set {
+	s := &Set{macros: make(map[string]Macro, len(builtins)+len(configured))}
+	for name, m := range builtins {
+		s.macros[name] = m
+	}
+	for name, m := range configured {
+		s.macros[name] = m
+	}
+	return s
+}
+
+// Update replaces the configured macros, as after a config reload.
+func (s *Set) Update(configured map[string]Macro) {
+	next := NewSet(configured)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.macros = next.macros
+}
+
+// Get returns a macro by name.
+func (s *Set) Get(name string) (Macro, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.macros[name]
+	return m, ok
+}
+
+// Names returns all macro names, sorted.
+func (s *Set) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.macros))
+	for name := range s.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run plays the macro, writing each step's input with write. It stops early
+// if ctx is cancelled or a write fails.
+func (m Macro) Run(ctx context.Context, write func([]byte) error) error {
+	for i, step := range m.Steps {
+		if step.DelayMs > 0 {
+			delay := min(time.Duration(step.DelayMs)*time.Millisecond, maxDelay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if step.Input == "" {
+			continue
+		}
+		if err := write([]byte(step.Input)); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
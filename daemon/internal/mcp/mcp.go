@@ -0,0 +1,273 @@
+// Package mcp makes configured MCP servers available to agent sessions, either
+// by merging them into the agent's project config file in the worktree or by
+// turning them into command-line config overrides.
+package mcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Merge returns base overlaid with overrides. Neither input is modified.
+func Merge(base, overrides map[string]protocol.MCPServer) map[string]protocol.MCPServer {
+	merged := make(map[string]protocol.MCPServer, len(base)+len(overrides))
+	for name, server := range base {
+		merged[name] = server
+	}
+	for name, server := range overrides {
+		merged[name] = server
+	}
+	return merged
+}
+
+// projectFile tracks a config file in a worktree that one or more sessions
+// have added servers to.
+type projectFile struct {
+	existed  bool
+	original []byte
+	// servers added by each session, keyed by processID
+	servers map[string]map[string]protocol.MCPServer
+}
+
+var (
+	filesMu sync.Mutex
+	files   = make(map[string]*projectFile)
+)
+
+// Install merges servers into the JSON config file at path (e.g. a worktree's
+// .mcp.json) on behalf of processID. Entries already in the file are kept
+// unless a server of the same name is installed. Release undoes it.
+func Install(path, processID string, servers map[string]protocol.MCPServer) error {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	filesMu.Lock()
+	defer filesMu.Unlock()
+
+	pf, ok := files[path]
+	if !ok {
+		pf = &projectFile{servers: make(map[string]map[string]protocol.MCPServer)}
+		original, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			pf.existed = true
+			pf.original = original
+		case !errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+
+	pf.servers[processID] = servers
+	if err := pf.write(path); err != nil {
+		delete(pf.servers, processID)
+		return err
+	}
+	files[path] = pf
+	return nil
+}
+
+// Release removes the servers processID installed into path. Once no session
+// needs the file any more it is restored to its original content, or deleted
+// if the daemon created it.
+func Release(path, processID string) error {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+
+	pf, ok := files[path]
+	if !ok {
+		return nil
+	}
+	if _, ok := pf.servers[processID]; !ok {
+		return nil
+	}
+	delete(pf.servers, processID)
+
+	if len(pf.servers) > 0 {
+		return pf.write(path)
+	}
+
+	delete(files, path)
+	if pf.existed {
+		return os.WriteFile(path, pf.original, 0644)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Remove the parent directory too if we created it and it's now empty
+	// (e.g. .cursor/). Errors mean it's not empty or not ours.
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// write renders the original file plus every session's servers to path.
+func (pf *projectFile) write(path string) error {
+	doc := map[string]any{}
+	if pf.existed && len(pf.original) > 0 {
+		if err := json.Unmarshal(pf.original, &doc); err != nil {
+			return fmt.Errorf("failed to parse existing %s: %w", path, err)
+		}
+	}
+
+	existing, _ := doc["mcpServers"].(map[string]any)
+	merged := make(map[string]any, len(existing))
+	for name, server := range existing {
+		merged[name] = server
+	}
+
+	// Apply sessions in a stable order so concurrent sessions that declare the
+	// same server name produce deterministic output.
+	processIDs := make([]string, 0, len(pf.servers))
+	for processID := range pf.servers {
+		processIDs = append(processIDs, processID)
+	}
+	sort.Strings(processIDs)
+	for _, processID := range processIDs {
+		for name, server := range pf.servers[processID] {
+			// Claude treats entries without a type as stdio servers.
+			if server.Type == "" && server.URL != "" {
+				server.Type = "http"
+			}
+			merged[name] = server
+		}
+	}
+	doc["mcpServers"] = merged
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// ConfigOverrides renders servers as codex-style `key=value` TOML config
+// overrides (mcp_servers.<name>.<field>=...), one per returned element, and
+// the variables to start codex with for them. Servers' env and headers may
+// hold secrets, which anyone on the machine could read in a command line, so
+// they are passed in codex's environment: the overrides name the variables
+// for codex to pass on to each server. Servers that set a variable to
+// different values can't both have it, and fail.
+func ConfigOverrides(servers map[string]protocol.MCPServer) (overrides, env []string, err error) {
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// setBy names the server each variable's value came from
+	values, setBy := map[string]string{}, map[string]string{}
+	headers := 0
+	for _, name := range names {
+		server := servers[name]
+		prefix := "mcp_servers." + tomlKey(name) + "."
+		if server.URL != "" {
+			overrides = append(overrides, prefix+"url="+tomlString(server.URL))
+			if len(server.Headers) > 0 {
+				vars := make(map[string]string, len(server.Headers))
+				for _, header := range sortedKeys(server.Headers) {
+					// Named to be masked wherever variables are shown, as
+					// headers are in the daemon's config
+					headers++
+					key := fmt.Sprintf("AGENTHQ_MCP_SECRET_%d", headers)
+					vars[header] = key
+					env = append(env, key+"="+server.Headers[header])
+				}
+				overrides = append(overrides, prefix+"env_http_headers="+tomlTable(vars))
+			}
+			continue
+		}
+		overrides = append(overrides, prefix+"command="+tomlString(server.Command))
+		if len(server.Args) > 0 {
+			quoted := make([]string, len(server.Args))
+			for i, arg := range server.Args {
+				quoted[i] = tomlString(arg)
+			}
+			overrides = append(overrides, prefix+"args=["+strings.Join(quoted, ", ")+"]")
+		}
+		if len(server.Env) > 0 {
+			keys := sortedKeys(server.Env)
+			quoted := make([]string, len(keys))
+			for i, key := range keys {
+				value := server.Env[key]
+				if other, ok := setBy[key]; ok {
+					if values[key] != value {
+						return nil, nil, fmt.Errorf("MCP servers %s and %s set %s differently, which codex can't pass on", other, name, key)
+					}
+				} else {
+					values[key], setBy[key] = value, name
+					env = append(env, key+"="+value)
+				}
+				quoted[i] = tomlString(key)
+			}
+			overrides = append(overrides, prefix+"env_vars=["+strings.Join(quoted, ", ")+"]")
+		}
+	}
+	return overrides, env, nil
+}
+
+// tomlString quotes s as a TOML basic string.
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\b':
+			b.WriteString(`\b`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func tomlKey(s string) string {
+	for _, r := range s {
+		if !(r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return tomlString(s)
+		}
+	}
+	return s
+}
+
+func tomlTable(m map[string]string) string {
+	keys := sortedKeys(m)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = tomlKey(k) + " = " + tomlString(m[k])
+	}
+	return "{ " + strings.Join(parts, ", ") + " }"
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
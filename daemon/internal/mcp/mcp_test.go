@@ -0,0 +1,61 @@
+package mcp
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+func TestTOMLString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", `"plain"`},
+		{`say "hi" \ bye`, `"say \"hi\" \\ bye"`},
+		{"tab\tnewline\ncr\rbs\bff\f", `"tab\tnewline\ncr\rbs\bff\f"`},
+		{"\x1b[0m\x00\x7f", `"\u001B[0m\u0000\u007F"`},
+		{"héllo ✓", `"héllo ✓"`},
+		{"bad \xff byte", "\"bad � byte\""},
+	}
+	for _, tt := range tests {
+		if got := tomlString(tt.in); got != tt.want {
+			t.Errorf("tomlString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	overrides, env, err := ConfigOverrides(map[string]protocol.MCPServer{
+		"github": {Command: "gh-mcp", Args: []string{"--stdio"}, Env: map[string]string{"GITHUB_TOKEN": "ghp_secret", "LOG": "debug"}},
+		"docs":   {URL: "https://docs.example/mcp", Headers: map[string]string{"Authorization": "Bearer abc"}},
+		"my.srv": {Command: "srv", Env: map[string]string{"LOG": "debug"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOverrides := []string{
+		`mcp_servers.docs.url="https://docs.example/mcp"`,
+		`mcp_servers.docs.env_http_headers={ Authorization = "AGENTHQ_MCP_SECRET_1" }`,
+		`mcp_servers.github.command="gh-mcp"`,
+		`mcp_servers.github.args=["--stdio"]`,
+		`mcp_servers.github.env_vars=["GITHUB_TOKEN", "LOG"]`,
+		`mcp_servers."my.srv".command="srv"`,
+		`mcp_servers."my.srv".env_vars=["LOG"]`,
+	}
+	if !slices.Equal(overrides, wantOverrides) {
+		t.Errorf("overrides = %q, want %q", overrides, wantOverrides)
+	}
+	wantEnv := []string{"AGENTHQ_MCP_SECRET_1=Bearer abc", "GITHUB_TOKEN=ghp_secret", "LOG=debug"}
+	if !slices.Equal(env, wantEnv) {
+		t.Errorf("env = %q, want %q", env, wantEnv)
+	}
+
+	_, _, err = ConfigOverrides(map[string]protocol.MCPServer{
+		"a": {Command: "a", Env: map[string]string{"LOG": "debug"}},
+		"b": {Command: "b", Env: map[string]string{"LOG": "info"}},
+	})
+	if err == nil {
+		t.Error("servers setting LOG differently: want an error")
+	}
+}
@@ -0,0 +1,375 @@
+// Package mdns browses for services advertised with multicast DNS service
+// discovery (RFC 6762, RFC 6763) on the local network.
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Record types and classes used in queries and answers.
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+
+	classIN = 1
+	// classUnicast in a question asks for a unicast response (the QU bit);
+	// in an answer the same bit flushes the cache
+	classUnicast = 0x8000
+)
+
+// The mDNS multicast groups.
+var (
+	groupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	groupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// queryInterval is how often the query is repeated while browsing, as
+// responses to a multicast query can be lost.
+const queryInterval = time.Second
+
+// Service is a discovered service instance.
+type Service struct {
+	// Instance is the instance's full name, e.g.
+	// "Office._agenthq._tcp.local."
+	Instance string
+	// Host is the target host name, and Addrs its addresses, IPv4 first.
+	Host  string
+	Addrs []net.IP
+	Port  int
+	// Text holds the instance's TXT record key=value pairs.
+	Text map[string]string
+}
+
+// Addr returns the host:port to connect to, or "" if no address is known.
+func (s Service) Addr() string {
+	if len(s.Addrs) == 0 {
+		return ""
+	}
+	return net.JoinHostPort(s.Addrs[0].String(), fmt.Sprint(s.Port))
+}
+
+// Browse queries for instances of service (e.g. "_agenthq._tcp") in the
+// local domain until ctx is done, and returns those whose port and address
+// were learned, in the order they answered.
+func Browse(ctx context.Context, service string) ([]Service, error) {
+	domain := strings.TrimSuffix(service, ".") + ".local."
+	query := encodeQuery(domain)
+
+	// Queries from an ephemeral port get unicast replies to it, so no
+	// socket on 5353 (which a system responder may hold) is needed
+	type socket struct {
+		conn  *net.UDPConn
+		group *net.UDPAddr
+	}
+	var sockets []socket
+	for _, group := range []*net.UDPAddr{groupIPv4, groupIPv6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			continue
+		}
+		defer conn.Close()
+		if _, err := conn.WriteToUDP(query, group); err != nil {
+			continue
+		}
+		sockets = append(sockets, socket{conn, group})
+	}
+	if len(sockets) == 0 {
+		return nil, errors.New("mdns: no multicast-capable network")
+	}
+
+	answers := make(chan []record)
+	for _, s := range sockets {
+		go read(ctx, s.conn, answers)
+	}
+	ticker := time.NewTicker(queryInterval)
+	defer ticker.Stop()
+
+	c := newCollector(domain)
+	for {
+		select {
+		case records := <-answers:
+			c.add(records)
+		case <-ticker.C:
+			for _, s := range sockets {
+				s.conn.WriteToUDP(query, s.group)
+			}
+		case <-ctx.Done():
+			return c.services(), nil
+		}
+	}
+}
+
+// read sends the records of each response received on conn to answers
+// until conn is closed or ctx is done.
+func read(ctx context.Context, conn *net.UDPConn, answers chan<- []record) {
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		records, err := parseResponse(buf[:n])
+		if err != nil || len(records) == 0 {
+			continue
+		}
+		select {
+		case answers <- records:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collector assembles services from records, which may arrive in any
+// order and across responses.
+type collector struct {
+	domain    string
+	instances []string
+	srv       map[string]record
+	txt       map[string]map[string]string
+	addrs     map[string][]net.IP
+}
+
+func newCollector(domain string) *collector {
+	return &collector{
+		domain: strings.ToLower(domain),
+		srv:    make(map[string]record),
+		txt:    make(map[string]map[string]string),
+		addrs:  make(map[string][]net.IP),
+	}
+}
+
+func (c *collector) add(records []record) {
+	for _, r := range records {
+		name := strings.ToLower(r.name)
+		switch r.typ {
+		case typePTR:
+			if name == c.domain && !containsFold(c.instances, r.target) {
+				c.instances = append(c.instances, r.target)
+			}
+		case typeSRV:
+			c.srv[name] = r
+		case typeTXT:
+			c.txt[name] = r.text
+		case typeA, typeAAAA:
+			if !containsIP(c.addrs[name], r.ip) {
+				c.addrs[name] = append(c.addrs[name], r.ip)
+			}
+		}
+	}
+}
+
+func (c *collector) services() []Service {
+	var services []Service
+	for _, instance := range c.instances {
+		srv, ok := c.srv[strings.ToLower(instance)]
+		if !ok {
+			continue
+		}
+		s := Service{
+			Instance: instance,
+			Host:     srv.target,
+			Port:     srv.port,
+			Text:     c.txt[strings.ToLower(instance)],
+		}
+		// IPv4 first: link-local IPv6 addresses need a zone to be dialed
+		for _, ip := range c.addrs[strings.ToLower(srv.target)] {
+			if ip.To4() != nil {
+				s.Addrs = append([]net.IP{ip}, s.Addrs...)
+			} else {
+				s.Addrs = append(s.Addrs, ip)
+			}
+		}
+		if len(s.Addrs) > 0 {
+			services = append(services, s)
+		}
+	}
+	return services
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// record is a resource record of one of the types Browse uses.
+type record struct {
+	name string
+	typ  uint16
+	// target is a PTR's name or an SRV's host
+	target string
+	port   int
+	text   map[string]string
+	ip     net.IP
+}
+
+// encodeQuery returns a query for the PTR records of domain, asking for a
+// unicast response.
+func encodeQuery(domain string) []byte {
+	// ID 0, no flags, one question
+	msg := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, typePTR)
+	return binary.BigEndian.AppendUint16(msg, classIN|classUnicast)
+}
+
+var errMalformed = errors.New("mdns: malformed message")
+
+// parseResponse returns the A, AAAA, PTR, SRV and TXT records in every
+// section of a response.
+func parseResponse(msg []byte) ([]record, error) {
+	if len(msg) < 12 {
+		return nil, errMalformed
+	}
+	if msg[2]&0x80 == 0 {
+		// A query, not a response
+		return nil, nil
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for range questions {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+	}
+
+	var records []record
+	for range count {
+		name, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, errMalformed
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, errMalformed
+		}
+		data := msg[off : off+length]
+
+		r := record{name: name, typ: typ}
+		switch typ {
+		case typeA:
+			if length != 4 {
+				return nil, errMalformed
+			}
+			r.ip = net.IP(append([]byte(nil), data...))
+		case typeAAAA:
+			if length != 16 {
+				return nil, errMalformed
+			}
+			r.ip = net.IP(append([]byte(nil), data...))
+		case typePTR:
+			if r.target, _, err = readName(msg, off); err != nil {
+				return nil, err
+			}
+		case typeSRV:
+			if length < 7 {
+				return nil, errMalformed
+			}
+			r.port = int(binary.BigEndian.Uint16(data[4:]))
+			if r.target, _, err = readName(msg, off+6); err != nil {
+				return nil, err
+			}
+		case typeTXT:
+			r.text = parseText(data)
+		default:
+			off += length
+			continue
+		}
+		records = append(records, r)
+		off += length
+	}
+	return records, nil
+}
+
+// readName reads the possibly compressed name at off, returning it with a
+// trailing dot and the offset after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// parseText returns the key=value pairs of a TXT record's strings; a key
+// without "=" has an empty value.
+func parseText(data []byte) map[string]string {
+	text := make(map[string]string)
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			break
+		}
+		key, value, _ := strings.Cut(string(data[1:1+n]), "=")
+		if key != "" {
+			text[strings.ToLower(key)] = value
+		}
+		data = data[1+n:]
+	}
+	return text
+}
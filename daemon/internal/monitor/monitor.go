@@ -0,0 +1,184 @@
+// Package monitor watches the daemon's own resource use: goroutines, heap
+// and the depth of its send queues. When one crosses its threshold it
+// raises an alert and dumps diagnostics, so that leaks such as a read loop
+// that never exits are noticed before they take the machine down.
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Defaults
+const (
+	DefaultInterval      = 30 * time.Second
+	DefaultMaxGoroutines = 10000
+	DefaultMaxHeapMB     = 2048
+	DefaultMaxSendQueue  = 100
+)
+
+// dumpCooldown is the least time between diagnostics dumps.
+const dumpCooldown = 10 * time.Minute
+
+// DefaultDumpDir returns the default diagnostics directory
+// (~/.agenthq/diagnostics).
+func DefaultDumpDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".agenthq", "diagnostics")
+}
+
+// Thresholds are the values that raise an alert; zero uses the default and
+// a negative value disables the check.
+type Thresholds struct {
+	Goroutines int
+	HeapMB     int
+	SendQueue  int
+}
+
+// Monitor samples the daemon's resource use.
+type Monitor struct {
+	interval   time.Duration
+	thresholds Thresholds
+	dumpDir    string
+	// sendQueue returns the current send queue depth
+	sendQueue func() int
+	onAlert   func(protocol.DaemonAlert)
+
+	// over holds the metrics currently above their threshold, which
+	// alert again only after falling back below it
+	over     map[string]bool
+	lastDump time.Time
+}
+
+// New creates a monitor that samples every interval (0 for the default)
+// and calls onAlert for each threshold crossed. Diagnostics are written to
+// dumpDir, unless it is empty.
+func New(interval time.Duration, thresholds Thresholds, dumpDir string, sendQueue func() int, onAlert func(protocol.DaemonAlert)) *Monitor {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	thresholds.Goroutines = orDefault(thresholds.Goroutines, DefaultMaxGoroutines)
+	thresholds.HeapMB = orDefault(thresholds.HeapMB, DefaultMaxHeapMB)
+	thresholds.SendQueue = orDefault(thresholds.SendQueue, DefaultMaxSendQueue)
+	return &Monitor{
+		interval:   interval,
+		thresholds: thresholds,
+		dumpDir:    dumpDir,
+		sendQueue:  sendQueue,
+		onAlert:    onAlert,
+		over:       make(map[string]bool),
+	}
+}
+
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// Run samples until stop is closed.
+func (m *Monitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// check takes a sample and alerts on the metrics that crossed their
+// thresholds since the last one.
+func (m *Monitor) check() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	samples := []struct {
+		metric           string
+		value, threshold int
+	}{
+		{protocol.AlertGoroutines, runtime.NumGoroutine(), m.thresholds.Goroutines},
+		{protocol.AlertHeapMB, int(mem.HeapAlloc >> 20), m.thresholds.HeapMB},
+		{protocol.AlertSendQueue, m.sendQueue(), m.thresholds.SendQueue},
+	}
+
+	var alerts []protocol.DaemonAlert
+	for _, s := range samples {
+		if s.threshold < 0 || s.value <= s.threshold {
+			delete(m.over, s.metric)
+			continue
+		}
+		if m.over[s.metric] {
+			continue
+		}
+		m.over[s.metric] = true
+		alerts = append(alerts, protocol.DaemonAlert{
+			Time:      time.Now().UnixMilli(),
+			Metric:    s.metric,
+			Value:     s.value,
+			Threshold: s.threshold,
+		})
+	}
+	if len(alerts) == 0 {
+		return
+	}
+
+	dump := m.dump(&mem)
+	for _, alert := range alerts {
+		alert.Dump = dump
+		m.onAlert(alert)
+	}
+}
+
+// dump writes goroutine stacks and memory statistics to a new file in the
+// dump directory, returning its path, or "" if there is no directory, a
+// dump was written recently or writing failed.
+func (m *Monitor) dump(mem *runtime.MemStats) string {
+	if m.dumpDir == "" || time.Since(m.lastDump) < dumpCooldown {
+		return ""
+	}
+	m.lastDump = time.Now()
+	path, err := WriteDump(m.dumpDir, mem)
+	if err != nil {
+		log.Printf("Failed to write diagnostics: %v", err)
+		return ""
+	}
+	return path
+}
+
+// WriteDump writes goroutine stacks and memory statistics to a new file in
+// dir and returns its path.
+func WriteDump(dir string, mem *runtime.MemStats) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "agenthq-daemon-"+time.Now().Format("20060102-150405")+".txt")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(f, "goroutines: %d\nheap alloc: %d\nheap objects: %d\nsys: %d\nnum gc: %d\n\n",
+		runtime.NumGoroutine(), mem.HeapAlloc, mem.HeapObjects, mem.Sys, mem.NumGC)
+	err = pprof.Lookup("goroutine").WriteTo(f, 2)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
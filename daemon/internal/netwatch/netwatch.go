@@ -0,0 +1,137 @@
+// Package netwatch notices when the machine wakes from sleep or its
+// network changes, so connections that died meanwhile can be replaced at
+// once instead of after the TCP timeouts.
+package netwatch
+
+import (
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Change is something that likely broke open connections.
+type Change int
+
+const (
+	// Wake is a resume from system sleep.
+	Wake Change = iota
+	// NetworkChange is a change of the machine's addresses, e.g. joining
+	// another Wi-Fi network, that leaves it online.
+	NetworkChange
+)
+
+func (c Change) String() string {
+	return [...]string{"woke from sleep", "network changed"}[c]
+}
+
+// pollInterval is how often the clock and the interfaces are checked.
+const pollInterval = 2 * time.Second
+
+// sleepThreshold is how far the wall clock must run ahead of the
+// monotonic clock, which stops while the machine sleeps, between two polls
+// to count as a wake.
+const sleepThreshold = 5 * time.Second
+
+// Watcher reports changes until stopped.
+type Watcher struct {
+	changes chan Change
+	online  atomic.Bool
+	stop    chan struct{}
+}
+
+// Start starts watching.
+func Start() *Watcher {
+	w := &Watcher{
+		changes: make(chan Change, 1),
+		stop:    make(chan struct{}),
+	}
+	addrs := addresses()
+	w.online.Store(len(addrs) > 0)
+	go w.run(addrs)
+	return w
+}
+
+// Changes receives each change; changes the receiver hasn't taken yet are
+// merged.
+func (w *Watcher) Changes() <-chan Change {
+	return w.changes
+}
+
+// Online reports whether the machine has an address other than loopback
+// and link-local ones, i.e. could reach a server.
+func (w *Watcher) Online() bool {
+	return w.online.Load()
+}
+
+// Stop stops watching.
+func (w *Watcher) Stop() {
+	close(w.stop)
+}
+
+func (w *Watcher) run(addrs []string) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		// Round(0) strips the monotonic reading, leaving wall clock time
+		slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if slept > sleepThreshold {
+			w.report(Wake)
+		}
+
+		current := addresses()
+		online := len(current) > 0
+		w.online.Store(online)
+		// Going offline breaks nothing that reconnecting would fix; coming
+		// back, or moving, does
+		if online && !slices.Equal(current, addrs) {
+			w.report(NetworkChange)
+		}
+		addrs = current
+	}
+}
+
+func (w *Watcher) report(c Change) {
+	select {
+	case w.changes <- c:
+	default:
+	}
+}
+
+// addresses returns the machine's routable addresses, sorted; loopback and
+// link-local ones, which come and go with virtual interfaces, are left out.
+func addresses() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaceAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			addrs = append(addrs, iface.Name+" "+ipNet.IP.String())
+		}
+	}
+	slices.Sort(addrs)
+	return addrs
+}
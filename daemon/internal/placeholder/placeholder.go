@@ -0,0 +1,88 @@
+// Package placeholder expands {{.Name}} placeholders in tasks, setup
+// commands and agent arguments with values only the daemon knows, such as
+// where a worktree is checked out, so server-side task templates can refer
+// to them.
+package placeholder
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Vars are the values placeholders expand to. Empty values expand to the
+// empty string.
+type Vars struct {
+	// WorktreePath is the worktree's directory, Branch its branch
+	WorktreePath string
+	Branch       string
+	// RepoName and RepoPath are the repo the worktree belongs to
+	RepoName string
+	RepoPath string
+	// Package is the monorepo package targeted, and Dir where the agent
+	// starts: the worktree or the package's directory in it
+	Package string
+	Dir     string
+	// ProcessID and WorktreeID are the server's IDs
+	ProcessID  string
+	WorktreeID string
+	// Workspace is the daemon's workspace directory
+	Workspace string
+}
+
+// placeholderRe matches {{.Name}}, allowing spaces inside the braces.
+var placeholderRe = regexp.MustCompile(`\{\{\s*\.([A-Za-z]+)\s*\}\}`)
+
+// Expand replaces the placeholders in s. Anything else, including
+// placeholders for unknown names, is left as it is: a task may well
+// mention templates of its own.
+func (v *Vars) Expand(s string) string {
+	return v.expand(s, func(value string) string { return value })
+}
+
+// ExpandShell is Expand for a shell command: each value is quoted, so a
+// branch or path can't change what the command does.
+func (v *Vars) ExpandShell(s string) string {
+	return v.expand(s, shellQuote)
+}
+
+func (v *Vars) expand(s string, quote func(string) string) string {
+	if v == nil || !strings.Contains(s, "{{") {
+		return s
+	}
+	return placeholderRe.ReplaceAllStringFunc(s, func(match string) string {
+		value, ok := v.lookup(placeholderRe.FindStringSubmatch(match)[1])
+		if !ok {
+			return match
+		}
+		return quote(value)
+	})
+}
+
+func (v *Vars) lookup(name string) (string, bool) {
+	switch name {
+	case "WorktreePath":
+		return v.WorktreePath, true
+	case "Branch":
+		return v.Branch, true
+	case "RepoName":
+		return v.RepoName, true
+	case "RepoPath":
+		return v.RepoPath, true
+	case "Package":
+		return v.Package, true
+	case "Dir":
+		return v.Dir, true
+	case "ProcessID":
+		return v.ProcessID, true
+	case "WorktreeID":
+		return v.WorktreeID, true
+	case "Workspace":
+		return v.Workspace, true
+	}
+	return "", false
+}
+
+// shellQuote wraps s in single quotes for use in a shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
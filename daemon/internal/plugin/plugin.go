@@ -0,0 +1,484 @@
+// Package plugin runs the external plugins declared in the daemon's config.
+// A plugin is an executable the daemon starts and exchanges JSON-RPC 2.0
+// with over its stdin and stdout, one message per line; what it writes to
+// stderr is logged. Plugins extend the daemon without growing its core: they
+// can launch agents, allow or deny server messages, and receive the
+// daemon's history events.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Methods the daemon calls. initialize, launch and check are requests;
+// event and shutdown are notifications.
+const (
+	MethodInitialize = "initialize"
+	MethodLaunch     = "launch"
+	MethodCheck      = "check"
+	MethodEvent      = "event"
+	MethodShutdown   = "shutdown"
+)
+
+// CheckAll in a plugin's checks asks for every server message.
+const CheckAll = "*"
+
+const (
+	// defaultTimeout bounds a call to a plugin without a configured timeout
+	defaultTimeout = 5 * time.Second
+	// shutdownGrace is how long a plugin has to exit after shutdown before
+	// it is killed
+	shutdownGrace = 2 * time.Second
+	// queueSize is how many messages may wait to be written to a plugin;
+	// notifications beyond it are dropped
+	queueSize = 256
+	// maxLineSize bounds a message from a plugin
+	maxLineSize = 16 * 1024 * 1024
+)
+
+// InitializeParams are the params of initialize.
+type InitializeParams struct {
+	// Version is the daemon's version
+	Version   string `json:"version"`
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// Capabilities is a plugin's reply to initialize: what it extends.
+type Capabilities struct {
+	// Launchers are the agent types the plugin launches, built-in ones
+	// included; it is called with launch to spawn them.
+	Launchers []protocol.AgentType `json:"launchers,omitempty"`
+	// Checks are the server message types the plugin must allow before
+	// they are handled, or CheckAll; it is called with check for each.
+	Checks []string `json:"checks,omitempty"`
+	// Events asks for every history event, as event notifications.
+	Events bool `json:"events,omitempty"`
+}
+
+// LaunchParams are the params of launch: the spawn to launch an agent for.
+type LaunchParams struct {
+	ProcessID    string             `json:"processId"`
+	Agent        protocol.AgentType `json:"agent"`
+	WorktreePath string             `json:"worktreePath"`
+	// Dir is where the agent starts: the worktree or a package in it
+	Dir      string `json:"dir"`
+	Task     string `json:"task,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Model    string `json:"model,omitempty"`
+	YoloMode bool   `json:"yoloMode,omitempty"`
+	Headless bool   `json:"headless,omitempty"`
+	ResumeOf string `json:"resumeOf,omitempty"`
+}
+
+// Launch is a plugin's reply to launch: the command that starts the agent
+// in Dir, run as it is on the session's backend.
+type Launch struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// CheckParams are the params of check.
+type CheckParams struct {
+	Type    string                 `json:"type"`
+	Message protocol.ServerMessage `json:"message"`
+}
+
+// CheckResult is a plugin's reply to check.
+type CheckResult struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DeniedError is a server message a plugin didn't allow, or couldn't be
+// asked about.
+type DeniedError struct {
+	Plugin string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("denied by plugin %s: %s", e.Plugin, e.Reason)
+}
+
+// message is a JSON-RPC 2.0 request, notification or response.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  any             `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// codeMethodNotFound answers plugin requests; the daemon serves none.
+const codeMethodNotFound = -32601
+
+// Plugin is a running plugin.
+type Plugin struct {
+	name    string
+	timeout time.Duration
+	caps    Capabilities
+	cmd     *exec.Cmd
+	out     chan []byte
+	// quit is closed to stop writing to the plugin
+	quit     chan struct{}
+	quitOnce sync.Once
+	// done is closed when the plugin's stdout closes, normally because it
+	// exited
+	done chan struct{}
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan message
+}
+
+// start starts the plugin cfg describes and initializes it.
+func start(cfg config.Plugin, params InitializeParams) (*Plugin, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &Plugin{
+		name:    cfg.Name,
+		timeout: cfg.TimeoutDuration(),
+		cmd:     cmd,
+		out:     make(chan []byte, queueSize),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[int64]chan message),
+	}
+	if p.timeout == 0 {
+		p.timeout = defaultTimeout
+	}
+	go p.writeLoop(stdin)
+	go p.readLoop(stdout)
+	go p.logStderr(stderr)
+
+	if err := p.call(context.Background(), MethodInitialize, params, &p.caps); err != nil {
+		p.close()
+		return nil, fmt.Errorf("initialize: %w", err)
+	}
+	return p, nil
+}
+
+// writeLoop writes queued messages to the plugin's stdin. Once quit is
+// closed it writes what is still queued and closes stdin.
+func (p *Plugin) writeLoop(stdin io.WriteCloser) {
+	defer stdin.Close()
+	for {
+		select {
+		case line := <-p.out:
+			if _, err := stdin.Write(line); err != nil {
+				return
+			}
+		case <-p.quit:
+			for {
+				select {
+				case line := <-p.out:
+					if _, err := stdin.Write(line); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// readLoop hands responses to their calls and refuses requests.
+func (p *Plugin) readLoop(stdout io.Reader) {
+	defer func() {
+		p.mu.Lock()
+		p.pending = nil
+		p.mu.Unlock()
+		close(p.done)
+	}()
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("Plugin %s: invalid message: %v", p.name, err)
+			continue
+		}
+		switch {
+		case msg.Method != "" && msg.ID != nil:
+			p.notify(message{ID: msg.ID, Error: &rpcError{Code: codeMethodNotFound, Message: "method not found: " + msg.Method}})
+		case msg.Method == "" && msg.ID != nil:
+			p.mu.Lock()
+			ch := p.pending[*msg.ID]
+			delete(p.pending, *msg.ID)
+			p.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+		}
+	}
+}
+
+// logStderr logs what the plugin writes to stderr, line by line.
+func (p *Plugin) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Printf("Plugin %s: %s", p.name, scanner.Text())
+	}
+}
+
+// encode frames msg as a line, or returns nil if it can't be or the plugin
+// is no longer written to.
+func (p *Plugin) encode(msg message) []byte {
+	select {
+	case <-p.quit:
+		return nil
+	case <-p.done:
+		return nil
+	default:
+	}
+	msg.JSONRPC = "2.0"
+	line, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Plugin %s: %v", p.name, err)
+		return nil
+	}
+	return append(line, '\n')
+}
+
+// send queues msg for the plugin, waiting until ctx is done for room in
+// the queue. It reports whether msg was queued.
+func (p *Plugin) send(ctx context.Context, msg message) bool {
+	line := p.encode(msg)
+	if line == nil {
+		return false
+	}
+	select {
+	case p.out <- line:
+		return true
+	case <-p.quit:
+	case <-p.done:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// notify queues msg for the plugin unless the queue is full. It reports
+// whether msg was queued.
+func (p *Plugin) notify(msg message) bool {
+	line := p.encode(msg)
+	if line == nil {
+		return false
+	}
+	select {
+	case p.out <- line:
+		return true
+	default:
+		return false
+	}
+}
+
+// call calls method and decodes its result into result.
+func (p *Plugin) call(ctx context.Context, method string, params, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	ch := make(chan message, 1)
+	p.mu.Lock()
+	if p.pending == nil {
+		p.mu.Unlock()
+		return errors.New("plugin exited")
+	}
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	if !p.send(ctx, message{ID: &id, Method: method, Params: params}) {
+		return fmt.Errorf("%s: plugin exited or isn't reading its input", method)
+	}
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return fmt.Errorf("%s: %s", method, resp.Error.Message)
+		}
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("%s: invalid result: %w", method, err)
+		}
+		return nil
+	case <-p.done:
+		return errors.New("plugin exited")
+	case <-ctx.Done():
+		return fmt.Errorf("%s: no reply within %s", method, p.timeout)
+	}
+}
+
+// close shuts the plugin down: it is told to, its stdin is closed, and it
+// is killed if it hasn't exited within shutdownGrace.
+func (p *Plugin) close() {
+	p.notify(message{Method: MethodShutdown})
+	p.quitOnce.Do(func() { close(p.quit) })
+
+	exited := make(chan struct{})
+	go func() {
+		p.cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(shutdownGrace):
+		p.cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// Host runs the configured plugins. A nil Host has no plugins.
+type Host struct {
+	plugins []*Plugin
+}
+
+// Start starts and initializes the plugins cfgs declare. If one fails, those
+// already started are shut down again.
+func Start(cfgs []config.Plugin, params InitializeParams) (*Host, error) {
+	h := &Host{}
+	for _, cfg := range cfgs {
+		p, err := start(cfg, params)
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("plugin %s: %w", cfg.Name, err)
+		}
+		log.Printf("Plugin %s: launchers=%v checks=%v events=%v", p.name, p.caps.Launchers, p.caps.Checks, p.caps.Events)
+		h.plugins = append(h.plugins, p)
+	}
+	return h, nil
+}
+
+// Launchers returns the agent types plugins launch.
+func (h *Host) Launchers() []protocol.AgentType {
+	if h == nil {
+		return nil
+	}
+	var agents []protocol.AgentType
+	for _, p := range h.plugins {
+		for _, agent := range p.caps.Launchers {
+			if !slices.Contains(agents, agent) {
+				agents = append(agents, agent)
+			}
+		}
+	}
+	return agents
+}
+
+// Launch asks the first plugin that launches params.Agent for its command
+// line. It returns nil if no plugin launches the agent.
+func (h *Host) Launch(ctx context.Context, params LaunchParams) (*Launch, error) {
+	if h == nil {
+		return nil, nil
+	}
+	for _, p := range h.plugins {
+		if !slices.Contains(p.caps.Launchers, params.Agent) {
+			continue
+		}
+		var launch Launch
+		if err := p.call(ctx, MethodLaunch, params, &launch); err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", p.name, err)
+		}
+		if launch.Command == "" {
+			return nil, fmt.Errorf("plugin %s: launch returned no command", p.name)
+		}
+		return &launch, nil
+	}
+	return nil, nil
+}
+
+// Check asks every plugin that checks msg's type whether to handle it. It
+// returns a *DeniedError if one doesn't allow it, or can't answer: a policy
+// that can't be checked denies.
+func (h *Host) Check(ctx context.Context, msg protocol.ServerMessage) error {
+	if h == nil {
+		return nil
+	}
+	for _, p := range h.plugins {
+		if !slices.Contains(p.caps.Checks, msg.Type) && !slices.Contains(p.caps.Checks, CheckAll) {
+			continue
+		}
+		var result CheckResult
+		if err := p.call(ctx, MethodCheck, CheckParams{Type: msg.Type, Message: msg}, &result); err != nil {
+			return &DeniedError{Plugin: p.name, Reason: err.Error()}
+		}
+		if !result.Allow {
+			return &DeniedError{Plugin: p.name, Reason: result.Reason}
+		}
+	}
+	return nil
+}
+
+// Notify sends e to the plugins that asked for events. Events a plugin
+// hasn't kept up with are dropped.
+func (h *Host) Notify(e protocol.HistoryEvent) {
+	if h == nil {
+		return
+	}
+	for _, p := range h.plugins {
+		if p.caps.Events && !p.notify(message{Method: MethodEvent, Params: e}) {
+			log.Printf("Plugin %s: dropped %s event", p.name, e.Kind)
+		}
+	}
+}
+
+// Close shuts the plugins down.
+func (h *Host) Close() {
+	if h == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, p := range h.plugins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.close()
+		}()
+	}
+	wg.Wait()
+	h.plugins = nil
+}
@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MsgTypeChunk frames part of a message too large to send whole, in either
+// direction. The chunks of a message are sent in order, with no other
+// message between them.
+const MsgTypeChunk = "chunk"
+
+const (
+	// DefaultMaxMessageSize is the largest message sent whole.
+	DefaultMaxMessageSize = 1 << 20
+	// MaxReassembledSize bounds a chunked message and the partial messages
+	// held for one connection.
+	MaxReassembledSize = 64 << 20
+	// chunkTimeout is how long a partial message waits for its next chunk.
+	chunkTimeout = time.Minute
+	// chunkOverhead bounds the JSON around a chunk's data, besides its ID.
+	chunkOverhead = 96
+)
+
+// ErrChunkTooLarge is returned when a chunked message would exceed
+// MaxReassembledSize.
+var ErrChunkTooLarge = errors.New("chunked message too large")
+
+// Chunk is one frame of a chunked message: Data is the base64 of part of
+// the message's encoding, and Index counts from 0 to Total-1.
+type Chunk struct {
+	Type      string `json:"type"`
+	MessageID string `json:"messageId"`
+	Index     int    `json:"index"`
+	Total     int    `json:"total"`
+	Data      string `json:"data"`
+}
+
+// SplitMessage returns the frames to send an encoded message as: the
+// message itself if it is at most maxSize bytes or maxSize is not positive,
+// otherwise chunks of at most maxSize bytes each identified by messageID.
+func SplitMessage(data []byte, maxSize int, messageID string) [][]byte {
+	if maxSize <= 0 || len(data) <= maxSize {
+		return [][]byte{data}
+	}
+	// base64 turns every 3 bytes into 4
+	size := (maxSize - chunkOverhead - len(messageID)) / 4 * 3
+	if size < 3 {
+		size = 3
+	}
+	total := (len(data) + size - 1) / size
+	frames := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		part := data[i*size : min((i+1)*size, len(data))]
+		frame, _ := json.Marshal(Chunk{
+			Type:      MsgTypeChunk,
+			MessageID: messageID,
+			Index:     i,
+			Total:     total,
+			Data:      base64.StdEncoding.EncodeToString(part),
+		})
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// chunkMarker is a key of every chunk frame and of no other message, so
+// other messages are not parsed twice. Quotes in JSON strings are escaped,
+// so no string value contains it.
+var chunkMarker = []byte(`"messageId"`)
+
+// ParseChunk returns the chunk data frames, if it is one.
+func ParseChunk(data []byte) (Chunk, bool) {
+	if !bytes.Contains(data, chunkMarker) {
+		return Chunk{}, false
+	}
+	var c Chunk
+	if err := json.Unmarshal(data, &c); err != nil || c.Type != MsgTypeChunk || c.MessageID == "" {
+		return Chunk{}, false
+	}
+	return c, true
+}
+
+// Reassembler puts chunked messages back together. It is safe for
+// concurrent use; a connection needs one of its own.
+type Reassembler struct {
+	mu      sync.Mutex
+	partial map[string]*partialMessage
+	size    int
+}
+
+type partialMessage struct {
+	data    []byte
+	next    int
+	updated time.Time
+}
+
+// NewReassembler returns an empty Reassembler.
+func NewReassembler() *Reassembler {
+	return &Reassembler{partial: make(map[string]*partialMessage)}
+}
+
+// Add adds a chunk, returning the whole message once its last chunk is
+// added and nil before. A chunk out of order, or one that would make the
+// message or the partial messages too large, discards its message.
+func (r *Reassembler) Add(c Chunk) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(c.Data)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d of %s: %w", c.Index, c.MessageID, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, p := range r.partial {
+		if now.Sub(p.updated) > chunkTimeout {
+			r.drop(id)
+		}
+	}
+
+	p := r.partial[c.MessageID]
+	if p == nil {
+		p = &partialMessage{}
+		r.partial[c.MessageID] = p
+	}
+	if c.Index != p.next || c.Index >= c.Total {
+		r.drop(c.MessageID)
+		return nil, fmt.Errorf("chunk %d of %s: expected chunk %d of %d", c.Index, c.MessageID, p.next, c.Total)
+	}
+	if r.size+len(data) > MaxReassembledSize {
+		r.drop(c.MessageID)
+		return nil, fmt.Errorf("chunk %d of %s: %w", c.Index, c.MessageID, ErrChunkTooLarge)
+	}
+	p.data = append(p.data, data...)
+	p.next++
+	p.updated = now
+	r.size += len(data)
+
+	if p.next < c.Total {
+		return nil, nil
+	}
+	whole := p.data
+	r.drop(c.MessageID)
+	return whole, nil
+}
+
+// drop discards a partial message; r.mu must be held.
+func (r *Reassembler) drop(messageID string) {
+	if p := r.partial[messageID]; p != nil {
+		r.size -= len(p.data)
+		delete(r.partial, messageID)
+	}
+}
@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunksOf splits data into chunks as SplitMessage frames them.
+func chunksOf(t *testing.T, data []byte, maxSize int, messageID string) []Chunk {
+	t.Helper()
+	var chunks []Chunk
+	for _, frame := range SplitMessage(data, maxSize, messageID) {
+		if len(frame) > maxSize {
+			t.Errorf("frame of %d bytes, over the max of %d", len(frame), maxSize)
+		}
+		c, ok := ParseChunk(frame)
+		if !ok {
+			t.Fatalf("frame %s isn't a chunk", frame)
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	message := []byte(`{"type":"pty-input","processId":"p1","data":"` + strings.Repeat("0123456789", 100) + `"}`)
+	for _, maxSize := range []int{200, 256, 333, 1000} {
+		t.Run(fmt.Sprint(maxSize), func(t *testing.T) {
+			chunks := chunksOf(t, message, maxSize, "m1")
+			if len(chunks) < 2 {
+				t.Fatalf("split into %d chunks, want several", len(chunks))
+			}
+			r := NewReassembler()
+			for i, c := range chunks {
+				whole, err := r.Add(c)
+				if err != nil {
+					t.Fatalf("Add chunk %d: %v", i, err)
+				}
+				if last := i == len(chunks)-1; last != (whole != nil) {
+					t.Fatalf("Add chunk %d of %d returned %d bytes", i, len(chunks), len(whole))
+				}
+				if whole != nil && !bytes.Equal(whole, message) {
+					t.Errorf("reassembled %s, want %s", whole, message)
+				}
+			}
+			if len(r.partial) != 0 || r.size != 0 {
+				t.Errorf("kept %d partial messages of %d bytes", len(r.partial), r.size)
+			}
+		})
+	}
+}
+
+func TestSplitMessageSendsSmallMessagesWhole(t *testing.T) {
+	message := []byte(`{"type":"kill","processId":"p1"}`)
+	for _, maxSize := range []int{0, -1, len(message)} {
+		frames := SplitMessage(message, maxSize, "m1")
+		if len(frames) != 1 || !bytes.Equal(frames[0], message) {
+			t.Errorf("SplitMessage with max %d = %q, want the message whole", maxSize, frames)
+		}
+	}
+}
+
+func TestParseChunk(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  bool
+	}{
+		{`{"type":"chunk","messageId":"m1","index":0,"total":2,"data":"e30="}`, true},
+		{`{"type":"kill","processId":"p1"}`, false},
+		{`{"type":"pty-input","processId":"p1","data":"\"messageId\""}`, false},
+		{`{"type":"pty-input","messageId":"m1"}`, false},
+		{`{"type":"chunk","messageId":"","index":0,"total":1,"data":""}`, false},
+		{`{"type":"chunk","messageId":`, false},
+	}
+	for _, tt := range tests {
+		if _, ok := ParseChunk([]byte(tt.frame)); ok != tt.want {
+			t.Errorf("ParseChunk(%s) = %v, want %v", tt.frame, ok, tt.want)
+		}
+	}
+}
+
+func TestReassemblerDropsBrokenMessages(t *testing.T) {
+	message := []byte(strings.Repeat("x", 1000))
+	chunks := chunksOf(t, message, 200, "m1")
+
+	past, bad := chunks[0], chunks[0]
+	past.Total = 0
+	bad.Data = "!!!"
+	tests := []struct {
+		name   string
+		chunks []Chunk
+	}{
+		{"out of order", []Chunk{chunks[0], chunks[2]}},
+		{"repeated", []Chunk{chunks[0], chunks[1], chunks[1]}},
+		{"not from the start", []Chunk{chunks[1]}},
+		{"index past total", []Chunk{past}},
+		{"bad base64", []Chunk{bad}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler()
+			var err error
+			for _, c := range tt.chunks {
+				if _, err = r.Add(c); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				t.Fatal("Add: want an error")
+			}
+			if len(r.partial) != 0 || r.size != 0 {
+				t.Errorf("kept %d partial messages of %d bytes after an error", len(r.partial), r.size)
+			}
+		})
+	}
+}
+
+func TestReassemblerInterleavesMessages(t *testing.T) {
+	a := []byte(strings.Repeat("a", 500))
+	b := []byte(strings.Repeat("b", 500))
+	ca, cb := chunksOf(t, a, 200, "a"), chunksOf(t, b, 200, "b")
+	r := NewReassembler()
+	var got [][]byte
+	for i := range max(len(ca), len(cb)) {
+		for _, chunks := range [][]Chunk{ca, cb} {
+			if i >= len(chunks) {
+				continue
+			}
+			whole, err := r.Add(chunks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if whole != nil {
+				got = append(got, whole)
+			}
+		}
+	}
+	if len(got) != 2 || !bytes.Equal(got[0], a) || !bytes.Equal(got[1], b) {
+		t.Errorf("reassembled %d messages, want both", len(got))
+	}
+}
+
+func TestReassemblerDropsStalledMessages(t *testing.T) {
+	chunks := chunksOf(t, []byte(strings.Repeat("x", 1000)), 200, "m1")
+	r := NewReassembler()
+	if _, err := r.Add(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	r.partial["m1"].updated = time.Now().Add(-chunkTimeout - time.Second)
+	if _, err := r.Add(chunks[1]); err == nil {
+		t.Error("Add after the timeout: want an error")
+	}
+	if len(r.partial) != 0 || r.size != 0 {
+		t.Errorf("kept %d partial messages of %d bytes", len(r.partial), r.size)
+	}
+}
+
+func TestReassemblerBoundsPartialMessages(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocates over MaxReassembledSize")
+	}
+	half := MaxReassembledSize/2 + 1
+	big := func(id string) Chunk {
+		return chunksOf(t, make([]byte, 2*half), half*4/3+chunkOverhead+len(id), id)[0]
+	}
+	r := NewReassembler()
+	if _, err := r.Add(big("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(big("b")); !errors.Is(err, ErrChunkTooLarge) {
+		t.Errorf("Add past the bound: error = %v, want %v", err, ErrChunkTooLarge)
+	}
+	if _, ok := r.partial["a"]; !ok || r.size != half {
+		t.Errorf("partial messages hold %d bytes, want the first message's %d", r.size, half)
+	}
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// ErrInvalidMessage is returned for a server message that doesn't match its
+// type's payload.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// messageFields is the fields a message type may carry, and which of them
+// it must.
+type messageFields struct {
+	allowed  map[string]bool
+	required []string
+}
+
+var (
+	serverFields = fieldsByType(ServerEnvelope{}, ServerPayloads)
+	daemonFields = fieldsByType(DaemonEnvelope{}, DaemonPayloads)
+)
+
+func init() {
+	checkPayloads(reflect.TypeOf(ServerMessage{}), ServerEnvelope{}, ServerPayloads)
+	checkPayloads(reflect.TypeOf(DaemonMessage{}), DaemonEnvelope{}, DaemonPayloads)
+}
+
+// DecodeServerMessage decodes a server message strictly: its type must be
+// known, it may only carry its payload's fields and the envelope's, it must
+// carry the payload's required fields, and every field must have the right
+// type, in nested objects too. On error, msg still has the message's type
+// and requestId if they could be read.
+func DecodeServerMessage(data []byte) (msg ServerMessage, err error) {
+	err = decodeStrict(data, serverFields, &msg.Type, &msg.RequestID, &msg)
+	return msg, err
+}
+
+// DecodeDaemonMessage decodes a daemon message as strictly as
+// DecodeServerMessage does server messages, for servers and tests that
+// check what a daemon sends.
+func DecodeDaemonMessage(data []byte) (msg DaemonMessage, err error) {
+	err = decodeStrict(data, daemonFields, &msg.Type, &msg.RequestID, &msg)
+	return msg, err
+}
+
+// decodeStrict decodes data into msg if it is a valid message of one of
+// fields' types, else only its type and requestId.
+func decodeStrict[M any](data []byte, byType map[string]messageFields, msgType, requestID *string, msg *M) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	json.Unmarshal(raw["type"], msgType)
+	json.Unmarshal(raw["requestId"], requestID)
+
+	fields, ok := byType[*msgType]
+	if !ok {
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidMessage, *msgType)
+	}
+	for key := range raw {
+		if !fields.allowed[key] {
+			return fmt.Errorf("%w: %s has no field %q", ErrInvalidMessage, *msgType, key)
+		}
+	}
+	for _, key := range fields.required {
+		if _, ok := raw[key]; !ok {
+			return fmt.Errorf("%w: %s is missing %q", ErrInvalidMessage, *msgType, key)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var strict M
+	if err := dec.Decode(&strict); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidMessage, *msgType, err)
+	}
+	*msg = strict
+	return nil
+}
+
+// InvalidMessageReply is the reply to a server message DecodeServerMessage
+// rejected with err: an ack if the message has a requestId, else an error.
+func InvalidMessageReply(msg ServerMessage, err error) DaemonMessage {
+	reply := DaemonMessage{
+		Type:      MsgTypeError,
+		Error:     err.Error(),
+		ErrorCode: ErrorCodeInvalidMessage,
+	}
+	if msg.RequestID != "" {
+		reply.Type = MsgTypeAck
+		reply.RequestID = msg.RequestID
+	}
+	return reply
+}
+
+// fieldsByType returns the fields of each message type.
+func fieldsByType(envelope any, payloads map[string]any) map[string]messageFields {
+	common := jsonFields(reflect.TypeOf(envelope))
+	byType := make(map[string]messageFields, len(payloads))
+	for msgType, payload := range payloads {
+		fields := messageFields{allowed: make(map[string]bool)}
+		for _, f := range common {
+			fields.allowed[f.name] = true
+		}
+		for _, f := range jsonFields(reflect.TypeOf(payload)) {
+			fields.allowed[f.name] = true
+			if f.required {
+				fields.required = append(fields.required, f.name)
+			}
+		}
+		byType[msgType] = fields
+	}
+	return byType
+}
+
+// jsonField is a struct field as it appears in JSON.
+type jsonField struct {
+	name     string
+	required bool
+	field    reflect.StructField
+}
+
+// jsonFields returns the JSON fields of struct type t; those without
+// omitempty are required.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{
+			name:     name,
+			required: !slices.Contains(strings.Split(opts, ","), "omitempty"),
+			field:    f,
+		})
+	}
+	return fields
+}
+
+// checkPayloads panics unless every envelope and payload field is a field
+// of the flat message type with the same JSON name and Go type, so that
+// decoding the flat message decodes every payload.
+func checkPayloads(flat reflect.Type, envelope any, payloads map[string]any) {
+	byName := make(map[string]reflect.Type)
+	for _, f := range jsonFields(flat) {
+		byName[f.name] = f.field.Type
+	}
+	check := func(where string, t reflect.Type) {
+		for _, f := range jsonFields(t) {
+			if byName[f.name] != f.field.Type {
+				panic(fmt.Sprintf("protocol: %s field %q is not a %s field of %s", where, f.name, f.field.Type, flat.Name()))
+			}
+		}
+	}
+	check(reflect.TypeOf(envelope).Name(), reflect.TypeOf(envelope))
+	for msgType, payload := range payloads {
+		check(msgType, reflect.TypeOf(payload))
+	}
+}
@@ -1,6 +1,8 @@
 // Package protocol defines WebSocket message types for daemon-server communication.
 package protocol
 
+import "encoding/json"
+
 // AgentType represents the type of agent to spawn.
 type AgentType string
 
@@ -20,27 +22,847 @@ type RepoInfo struct {
 	Name          string `json:"name"`
 	Path          string `json:"path"`
 	DefaultBranch string `json:"defaultBranch"`
+	// Config summarizes the repo's .agenthq.yml, if it has one
+	Config *RepoConfig `json:"config,omitempty"`
+	// Sync is how the repo's default branch compared to its upstream
+	// after the last fetch, if it was fetched
+	Sync *RepoSync `json:"sync,omitempty"`
+}
+
+// RepoSync says how a repo's branch compares to its upstream after a
+// fetch: the commits each has that the other doesn't. Upstream is empty if
+// the branch has none. Error is why the last fetch failed.
+type RepoSync struct {
+	Branch    string `json:"branch"`
+	Upstream  string `json:"upstream,omitempty"`
+	Ahead     int    `json:"ahead"`
+	Behind    int    `json:"behind"`
+	FetchedAt int64  `json:"fetchedAt"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RepoConfig summarizes a repo's .agenthq.yml. Error is set instead when
+// the file is invalid.
+type RepoConfig struct {
+	Setup        []string  `json:"setup,omitempty"`
+	EnvFiles     []string  `json:"envFiles,omitempty"`
+	SparsePaths  []string  `json:"sparsePaths,omitempty"`
+	DefaultAgent AgentType `json:"defaultAgent,omitempty"`
+	Image        string    `json:"image,omitempty"`
+	Test         string    `json:"test,omitempty"`
+	TestReport   string    `json:"testReport,omitempty"`
+	Coverage     string    `json:"coverage,omitempty"`
+	Lint         string    `json:"lint,omitempty"`
+	Artifacts    []string  `json:"artifacts,omitempty"`
+	// Verify names the verification pipeline's steps
+	Verify []string `json:"verify,omitempty"`
+	// Hooks names the git hooks installed in new worktrees
+	Hooks []string `json:"hooks,omitempty"`
+	// ProtectedPaths are the repo's own protected paths
+	ProtectedPaths []string `json:"protectedPaths,omitempty"`
+	// SensitivePaths are the repo's own sensitive path categories
+	SensitivePaths map[string][]string `json:"sensitivePaths,omitempty"`
+	// MaxSessions and Weight are the repo's session cap and share
+	MaxSessions int `json:"maxSessions,omitempty"`
+	Weight      int `json:"weight,omitempty"`
+	// Packages lists the monorepo packages a worktree or spawn can target
+	Packages []PackageInfo `json:"packages,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// PackageInfo is a monorepo package; Dir is relative to the repo root.
+type PackageInfo struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir"`
+}
+
+// GPUInfo describes a GPU on the daemon's machine. Apple GPUs share system
+// memory, so MemoryMB is the unified memory size and MemoryUsedMB is unset.
+type GPUInfo struct {
+	Vendor       string `json:"vendor"`
+	Model        string `json:"model"`
+	MemoryMB     int    `json:"memoryMb,omitempty"`
+	MemoryUsedMB int    `json:"memoryUsedMb,omitempty"`
+}
+
+// WatchdogTrip describes a part of the daemon the watchdog found stalled.
+type WatchdogTrip struct {
+	Time   int64  `json:"ts"`
+	Check  string `json:"check"`
+	Reason string `json:"reason"`
+	// Restarted is set if the daemon restarted itself over it
+	Restarted bool `json:"restarted,omitempty"`
+}
+
+// LogRecord is a daemon log record forwarded to the server.
+type LogRecord struct {
+	Time    int64  `json:"ts"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	// Dropped counts the records before this one that were dropped
+	// because they were logged faster than they could be sent
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// Log levels of forwarded log records
+const (
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// DaemonAlert reports a daemon resource metric over its threshold.
+type DaemonAlert struct {
+	Time      int64  `json:"ts"`
+	Metric    string `json:"metric"`
+	Value     int    `json:"value"`
+	Threshold int    `json:"threshold"`
+	// Dump is the diagnostics file written on the daemon's machine, if any
+	Dump string `json:"dump,omitempty"`
+}
+
+// Metrics a daemon-alert can be about
+const (
+	AlertGoroutines = "goroutines"
+	AlertHeapMB     = "heapMb"
+	AlertSendQueue  = "sendQueue"
+)
+
+// ProfileInfo describes an agent profile the daemon can spawn.
+type ProfileInfo struct {
+	Name  string    `json:"name"`
+	Agent AgentType `json:"agent"`
+	Model string    `json:"model,omitempty"`
+}
+
+// MCPServer describes an MCP server to make available to an agent. Stdio
+// servers set Command; remote servers set URL (Type "http" or "sse").
+type MCPServer struct {
+	Type    string            `json:"type,omitempty"`
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Sandbox limits a container-backed session's resources and network.
+// Zero fields are unlimited or, when merged, inherited.
+type Sandbox struct {
+	CPUs     float64 `json:"cpus,omitempty"`
+	MemoryMB int     `json:"memoryMb,omitempty"`
+	// Network is one of the Network* constants; empty means full.
+	Network string `json:"network,omitempty"`
+	// AllowHosts are the hosts ("example.com", "*.example.com") reachable
+	// with NetworkEgressAllowlist.
+	AllowHosts []string `json:"allowHosts,omitempty"`
+}
+
+// Sandbox network modes
+const (
+	NetworkNone            = "none"
+	NetworkEgressAllowlist = "egress-allowlist"
+	NetworkFull            = "full"
+)
+
+// Budget limits the compute a session may use. Zero limits are unset or,
+// when merged, inherited.
+type Budget struct {
+	// CPUSeconds caps the CPU time of the session's processes together
+	CPUSeconds int64 `json:"cpuSeconds,omitempty"`
+	// WallClockSeconds caps how long the session runs
+	WallClockSeconds int64 `json:"wallClockSeconds,omitempty"`
+	// Action is what exceeding a limit does, one of the Budget*
+	// constants; empty means kill.
+	Action string `json:"action,omitempty"`
+}
+
+// Budget actions
+const (
+	BudgetWarn  = "warn"
+	BudgetPause = "pause"
+	BudgetKill  = "kill"
+)
+
+// BudgetExceeded reports a session going over a limit of its budget.
+// Used and Allowed are seconds of CPU time or of running.
+type BudgetExceeded struct {
+	Limit   string `json:"limit"` // "cpu" or "wall-clock"
+	Used    int64  `json:"used"`
+	Allowed int64  `json:"allowed"`
+	Action  string `json:"action"`
+}
+
+// CompareAgent selects one contender in a compare-run.
+type CompareAgent struct {
+	Agent   AgentType `json:"agent,omitempty"`
+	Profile string    `json:"profile,omitempty"`
+	Model   string    `json:"model,omitempty"`
+}
+
+// CompareResult reports how one contender in a compare-run did.
+type CompareResult struct {
+	Agent        AgentType `json:"agent,omitempty"`
+	Profile      string    `json:"profile,omitempty"`
+	Model        string    `json:"model,omitempty"`
+	ProcessID    string    `json:"processId,omitempty"`
+	WorktreeID   string    `json:"worktreeId"`
+	Path         string    `json:"path,omitempty"`
+	Branch       string    `json:"branch,omitempty"`
+	ExitCode     int       `json:"exitCode"`
+	ExitReason   string    `json:"exitReason,omitempty"`
+	DurationMs   int64     `json:"durationMs"`
+	FilesChanged int       `json:"filesChanged"`
+	Insertions   int       `json:"insertions"`
+	Deletions    int       `json:"deletions"`
+	Untracked    int       `json:"untracked"`
+	Error        string    `json:"error,omitempty"`
 }
 
-// DaemonMessage is sent from daemon to server.
+// SessionDiff is how a session changed its worktree since the commit it
+// started at, including uncommitted changes.
+type SessionDiff struct {
+	Base         string `json:"base"`
+	FilesChanged int    `json:"filesChanged"`
+	Insertions   int    `json:"insertions"`
+	Deletions    int    `json:"deletions"`
+	Untracked    int    `json:"untracked"`
+	// Sensitive are the changed files in a sensitive category, such as
+	// licenses, CI workflows or lockfiles
+	Sensitive []SensitiveChange `json:"sensitive,omitempty"`
+}
+
+// SensitiveChange is a changed file in a sensitive category.
+type SensitiveChange struct {
+	Path     string `json:"path"`
+	Category string `json:"category"`
+}
+
+// DaemonMessage is sent from daemon to server. It has the fields of every
+// daemon message type; DaemonPayloads says which each type carries, and
+// DecodeDaemonMessage checks messages against that.
 type DaemonMessage struct {
-	Type         string     `json:"type"`
-	EnvID        string     `json:"envId,omitempty"`
-	EnvName      string     `json:"envName,omitempty"`
-	Capabilities []string   `json:"capabilities,omitempty"`
-	Workspace    string     `json:"workspace,omitempty"`
-	ProcessID    string     `json:"processId,omitempty"`
-	WorktreeID   string     `json:"worktreeId,omitempty"`
-	Data         string     `json:"data,omitempty"`
-	Cols         int        `json:"cols,omitempty"`
-	Rows         int        `json:"rows,omitempty"`
-	ExitCode     int        `json:"exitCode,omitempty"`
-	Branch       string     `json:"branch,omitempty"`
-	Path         string     `json:"path,omitempty"`
-	Repos        []RepoInfo `json:"repos,omitempty"`
-}
-
-// ServerMessage is received from server by daemon.
+	Type         string        `json:"type"`
+	EnvID        string        `json:"envId,omitempty"`
+	EnvName      string        `json:"envName,omitempty"`
+	Capabilities []string      `json:"capabilities,omitempty"`
+	Workspace    string        `json:"workspace,omitempty"`
+	ProcessID    string        `json:"processId,omitempty"`
+	WorktreeID   string        `json:"worktreeId,omitempty"`
+	Data         string        `json:"data,omitempty"`
+	Cols         int           `json:"cols,omitempty"`
+	Rows         int           `json:"rows,omitempty"`
+	ExitCode     int           `json:"exitCode,omitempty"`
+	Branch       string        `json:"branch,omitempty"`
+	Path         string        `json:"path,omitempty"`
+	Repos        []RepoInfo    `json:"repos,omitempty"`
+	Profiles     []ProfileInfo `json:"profiles,omitempty"`
+	Macros       []string      `json:"macros,omitempty"`
+	Backends     []string      `json:"backends,omitempty"`
+	// Clipboard are the clipboard operations servers may ask for, "get"
+	// and "set" (register)
+	Clipboard []string `json:"clipboard,omitempty"`
+	// Seq numbers a session's pty-data messages from 1; Snapshot marks one
+	// that redraws the terminal from scratch, up to Seq (see resync-request)
+	Seq      uint64 `json:"seq,omitempty"`
+	Snapshot bool   `json:"snapshot,omitempty"`
+	// Condensed marks pty-data that updates the terminal to show the
+	// screen as of Seq, standing in for the output since the last one
+	Condensed bool `json:"condensed,omitempty"`
+	// Tags and Metadata describe the environment for task routing
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// GPUs is sent on register and refreshed on every heartbeat
+	GPUs []GPUInfo `json:"gpus,omitempty"`
+	// WatchdogTrips are the most recent watchdog trips, including those
+	// from before a restart; sent on register and every heartbeat
+	WatchdogTrips []WatchdogTrip `json:"watchdogTrips,omitempty"`
+
+	// Log is a daemon-log record
+	Log *LogRecord `json:"log,omitempty"`
+	// Alert is a daemon-alert
+	Alert *DaemonAlert `json:"alert,omitempty"`
+
+	AgentSessionID string            `json:"agentSessionId,omitempty"`
+	Agent          AgentType         `json:"agent,omitempty"`
+	Transcript     []json.RawMessage `json:"transcript,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	// ErrorCode classifies Error for errors the server can act on; see
+	// ErrorCode* constants
+	ErrorCode string `json:"errorCode,omitempty"`
+
+	// Package is the monorepo package a worktree or session targets
+	Package string `json:"package,omitempty"`
+	// ReadOnly reports a session that ignores input (process-started)
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Holder is the user holding a session's input lease (input-lease)
+	Holder string `json:"holder,omitempty"`
+	// Reason is why a worktree was removed (worktree-removed)
+	Reason string `json:"reason,omitempty"`
+	// Environment says how ready a new worktree is (worktree-ready)
+	Environment *WorktreeEnvironment `json:"environment,omitempty"`
+	// Removal says how removing a worktree went (worktree-removed,
+	// worktree-error)
+	Removal *WorktreeRemoval `json:"removal,omitempty"`
+	// Repo is a repo that appeared in the workspace (repo-added) or was
+	// fetched (repo-fetched)
+	Repo *RepoInfo `json:"repo,omitempty"`
+	// RepoName names a repo that left the workspace (repo-removed)
+	RepoName string `json:"repoName,omitempty"`
+	// Timestamp is when a heartbeat was sent (Unix ms), and Latency the
+	// round-trip time to the server measured so far (heartbeat)
+	Timestamp int64    `json:"ts,omitempty"`
+	Latency   *Latency `json:"latency,omitempty"`
+	// Draining is set while the daemon drains before shutting down
+	// (daemon-draining, register, heartbeat)
+	Draining *Draining `json:"draining,omitempty"`
+	// Markers are a session's annotations, oldest first (agent-transcript)
+	Markers []SessionMarker `json:"markers,omitempty"`
+	// Summary is the configured summarizer's digest of what a session's
+	// agent did (session-summary)
+	Summary string `json:"summary,omitempty"`
+	// Diff is how a session changed its worktree (session-summary)
+	Diff *SessionDiff `json:"diff,omitempty"`
+
+	ExitReason string `json:"exitReason,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	ExitDetail string `json:"exitDetail,omitempty"`
+	// TouchedProtected are the files under protected paths a session
+	// added, changed or removed (process-exit)
+	TouchedProtected []string `json:"touchedProtected,omitempty"`
+
+	RunID   string          `json:"runId,omitempty"`
+	Base    string          `json:"base,omitempty"`
+	Results []CompareResult `json:"results,omitempty"`
+	Tests   *TestResult     `json:"tests,omitempty"`
+	Lint    *LintResult     `json:"lint,omitempty"`
+	// Step is a verification pipeline step's outcome (verification-result)
+	Step *VerificationStep `json:"step,omitempty"`
+
+	// Artifact is the chunk of an artifact file in Data (artifact-chunk)
+	Artifact *ArtifactChunk `json:"artifact,omitempty"`
+	// Artifacts lists the files sent after a session (artifacts-collected)
+	Artifacts []ArtifactInfo `json:"artifacts,omitempty"`
+	// Files are the staged files' paths relative to the worktree
+	// (files-staged)
+	Files []string `json:"files,omitempty"`
+	// Pull is a container image pull's progress (image-pull-progress)
+	Pull *ImagePull `json:"pull,omitempty"`
+	// Stage is the stage a spawn reached (spawn-progress)
+	Stage string `json:"stage,omitempty"`
+	// SpawnMs is how long a session took to start from its spawn request
+	// (process-started)
+	SpawnMs int64 `json:"spawnMs,omitempty"`
+	// FirstOutputMs is how long a session took to first output from its
+	// spawn request (spawn-progress, stage "ready")
+	FirstOutputMs int64 `json:"firstOutputMs,omitempty"`
+	// Diagnosis says why an agent couldn't be run and how to fix it
+	// (spawn-progress, process-exit)
+	Diagnosis *AgentDiagnosis `json:"diagnosis,omitempty"`
+	// History holds the events matching a query-history, newest first
+	// (history-results)
+	History []HistoryEvent `json:"history,omitempty"`
+	// Commands are a session's shell history, oldest first
+	// (shell-history)
+	Commands []ShellCommand `json:"commands,omitempty"`
+	// Session describes a session's command line and process
+	// (session-info)
+	Session *SessionInfo `json:"session,omitempty"`
+	// Stats are sessions' traffic, and Connection this server
+	// connection's (session-stats)
+	Stats      []SessionStats   `json:"stats,omitempty"`
+	Connection *ConnectionStats `json:"connection,omitempty"`
+	// Plan is what a message sent with dryRun would have done (dry-run)
+	Plan *DryRunPlan `json:"plan,omitempty"`
+	// Budget is the limit a session went over (budget-exceeded)
+	Budget *BudgetExceeded `json:"budget,omitempty"`
+	// DaemonConfig is the daemon's effective configuration (daemon-config)
+	DaemonConfig *DaemonConfig `json:"daemonConfig,omitempty"`
+
+	// RequestID is the requestId of the server message this replies to
+	RequestID string `json:"requestId,omitempty"`
+	// Duplicate marks the ack of a request whose idempotency key was seen
+	// before; the replies were replayed from the first attempt
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// ShellCommand is a command line in a session's shell history. Time is
+// Unix ms, when the shell recorded it (with HISTTIMEFORMAT set).
+type ShellCommand struct {
+	Command string `json:"command"`
+	Time    int64  `json:"time,omitempty"`
+}
+
+// HistoryEvent is an entry in the daemon's history of sessions and
+// worktrees. Time is Unix ms; which other fields are set depends on Kind.
+type HistoryEvent struct {
+	Time       int64     `json:"ts"`
+	Kind       string    `json:"kind"` // one of the History* constants
+	ProcessID  string    `json:"processId,omitempty"`
+	WorktreeID string    `json:"worktreeId,omitempty"`
+	Agent      AgentType `json:"agent,omitempty"`
+	Profile    string    `json:"profile,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	// Path is the worktree's path, Branch its branch
+	Path    string `json:"path,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Package string `json:"package,omitempty"`
+
+	// Exit, usage and failure (session-exited, worktree-created)
+	ExitCode    int    `json:"exitCode,omitempty"`
+	ExitReason  string `json:"exitReason,omitempty"`
+	Signal      string `json:"signal,omitempty"`
+	DurationMs  int64  `json:"durationMs,omitempty"`
+	InputBytes  int64  `json:"inputBytes,omitempty"`
+	OutputBytes int64  `json:"outputBytes,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// TouchedProtected are the protected files the session touched
+	// (session-exited)
+	TouchedProtected []string `json:"touchedProtected,omitempty"`
+
+	// The agent's own conversation and its transcript file, when found
+	// (agent-session)
+	AgentSessionID string `json:"agentSessionId,omitempty"`
+	Transcript     string `json:"transcript,omitempty"`
+	// Reason is why a worktree was removed (worktree-removed), or the
+	// limit a session went over (budget-exceeded)
+	Reason string `json:"reason,omitempty"`
+	// SourceUser is who used the clipboard (clipboard-set, clipboard-get)
+	// or annotated the session (session-annotated)
+	SourceUser string `json:"sourceUser,omitempty"`
+	// Note is an annotation of the session, and Seq the session's last
+	// pty-data when it was made (session-annotated)
+	Note string `json:"note,omitempty"`
+	Seq  uint64 `json:"seq,omitempty"`
+	// Server is the server connection that entered or left safe mode
+	// (safe-mode-entered, safe-mode-left)
+	Server string `json:"server,omitempty"`
+	// PID and Command are a process an earlier daemon run left running
+	// (orphan-killed)
+	PID     int    `json:"pid,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+// SessionMarker is an annotation of a session, such as "tests started",
+// made at Time (Unix ms) after the session's pty-data Seq.
+type SessionMarker struct {
+	Time       int64  `json:"ts"`
+	Note       string `json:"note"`
+	Seq        uint64 `json:"seq,omitempty"`
+	SourceUser string `json:"sourceUser,omitempty"`
+}
+
+// SessionInfo describes how a session was started and the process it runs,
+// for debugging it remotely. Command, Args and Cwd are unknown for sessions
+// adopted from a previous daemon. Env is KEY=value pairs, read from the
+// process where the OS allows and otherwise those it was started with, with
+// secrets masked. PID and PGID are 0 when the process doesn't run on the
+// daemon's host (docker). StartedAt is Unix ms.
+type SessionInfo struct {
+	Agent     AgentType `json:"agent"`
+	Backend   string    `json:"backend"`
+	Command   string    `json:"command,omitempty"`
+	Args      []string  `json:"args,omitempty"`
+	Cwd       string    `json:"cwd,omitempty"`
+	Env       []string  `json:"env,omitempty"`
+	PID       int       `json:"pid,omitempty"`
+	PGID      int       `json:"pgid,omitempty"`
+	StartedAt int64     `json:"startedAt"`
+}
+
+// SessionStats is a session's traffic. BytesIn and BytesOut are the
+// protocol bytes received from and sent to servers for the session, as
+// they went over the wire (chunks and signatures included). InputBytes and
+// OutputBytes are its terminal input and output. StartedAt is Unix ms.
+type SessionStats struct {
+	ProcessID   string    `json:"processId"`
+	Agent       AgentType `json:"agent"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+	InputBytes  int64     `json:"inputBytes"`
+	OutputBytes int64     `json:"outputBytes"`
+	StartedAt   int64     `json:"startedAt"`
+}
+
+// ConnectionStats is the protocol bytes exchanged with a server since
+// Since (Unix ms), over every reconnect, whatever session they were for,
+// and the round-trip time to it once measured.
+type ConnectionStats struct {
+	BytesIn  int64    `json:"bytesIn"`
+	BytesOut int64    `json:"bytesOut"`
+	Since    int64    `json:"since"`
+	Latency  *Latency `json:"latency,omitempty"`
+}
+
+// DaemonConfig is the configuration a daemon runs with, for telling why
+// one environment behaves differently from another. Settings is its config
+// file as in effect, secrets masked; Pending are the file's keys changed
+// since, which take effect when the daemon restarts.
+type DaemonConfig struct {
+	Version    string          `json:"version"`
+	Workspace  string          `json:"workspace,omitempty"`
+	ConfigPath string          `json:"configPath,omitempty"`
+	Settings   json.RawMessage `json:"settings"`
+	Pending    []string        `json:"pending,omitempty"`
+	// Backends are the session backends available and DefaultBackend the
+	// one spawns use unless they pick another
+	Backends       []string `json:"backends"`
+	DefaultBackend string   `json:"defaultBackend"`
+	// Capabilities are the agent types the daemon can spawn, as in register
+	Capabilities []string     `json:"capabilities"`
+	Limits       DaemonLimits `json:"limits"`
+	// Features are the optional features turned on, one of the Feature*
+	// constants each
+	Features []string `json:"features"`
+	// Connection is how the daemon talks to the client that asked
+	Connection ConnectionConfig `json:"connection"`
+}
+
+// DaemonLimits are a daemon's limits, defaults applied; 0 is no limit.
+type DaemonLimits struct {
+	// MaxSessions caps the sessions running at once
+	MaxSessions int `json:"maxSessions"`
+	// MaxMessageSize is the largest message sent whole, in bytes
+	MaxMessageSize int `json:"maxMessageSize"`
+	// InputMaxMessage caps one input message, InputRate and InputBurst
+	// the input a session accepts per second and at once; in bytes
+	InputMaxMessage int `json:"inputMaxMessage"`
+	InputRate       int `json:"inputRate"`
+	InputBurst      int `json:"inputBurst"`
+	// Budget caps each session's CPU and wall-clock time
+	Budget Budget `json:"budget"`
+	// SafeModeAfterMs is how long without a heartbeat-ack enters safe
+	// mode, and DrainTimeoutMs how long a drain waits for sessions
+	SafeModeAfterMs int64 `json:"safeModeAfterMs"`
+	DrainTimeoutMs  int64 `json:"drainTimeoutMs"`
+	// WorktreeDiskMarginMB is the free disk space new worktrees must leave
+	WorktreeDiskMarginMB int64 `json:"worktreeDiskMarginMb"`
+}
+
+// ConnectionConfig is what a daemon and one of its clients use on their
+// connection. Server is the server's name or URL, empty for a client of
+// the control listener; Scopes are empty if everything is allowed.
+type ConnectionConfig struct {
+	Server    string   `json:"server,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	// Failover is set while connected to one of the server's failover URLs
+	Failover bool `json:"failover,omitempty"`
+	// Signed is set if the server's messages must be signed
+	Signed bool `json:"signed,omitempty"`
+	// HeartbeatAcks is set once the server acknowledged a heartbeat, which
+	// makes safe mode apply to it; SafeMode while it is in safe mode
+	HeartbeatAcks bool `json:"heartbeatAcks,omitempty"`
+	SafeMode      bool `json:"safeMode,omitempty"`
+}
+
+// Optional daemon features (DaemonConfig.Features)
+const (
+	FeatureLocal              = "local"
+	FeatureAPI                = "api"
+	FeatureDiscover           = "discover"
+	FeatureDryRun             = "dry-run"
+	FeatureRecordProtocol     = "record-protocol"
+	FeatureHistory            = "history"
+	FeatureTelemetry          = "telemetry"
+	FeatureWatchdog           = "watchdog"
+	FeatureMonitor            = "monitor"
+	FeatureSafeMode           = "safe-mode"
+	FeatureAdaptiveOutput     = "adaptive-output"
+	FeatureRedaction          = "redaction"
+	FeatureLogShipping        = "log-shipping"
+	FeatureSummarizer         = "summarizer"
+	FeatureBudget             = "budget"
+	FeatureSharedShellHistory = "shared-shell-history"
+	FeatureClipboardGet       = "clipboard-get"
+	FeatureClipboardSet       = "clipboard-set"
+	FeaturePlugins            = "plugins"
+)
+
+// Latency is the round-trip time to a server over the current connection,
+// measured with WebSocket pings every 10s and smoothed, and its jitter,
+// how much consecutive round trips differ; both in ms. A UI can tell from
+// them whether a slow terminal is down to the network.
+type Latency struct {
+	RTTMs    float64 `json:"rttMs"`
+	JitterMs float64 `json:"jitterMs"`
+}
+
+// Draining is how far along a drain is: the daemon refuses new spawns and
+// worktree commands, and shuts down once Sessions, the sessions still
+// running, reaches 0, or at Deadline (Unix ms) at the latest.
+type Draining struct {
+	Deadline int64 `json:"deadline"`
+	Sessions int   `json:"sessions"`
+}
+
+// DryRunPlan describes what a message would have done. Action is its type
+// and Summary says what would happen. For a spawn, Backend, Command, Args,
+// Cwd and Env (the variables the daemon would add, secrets masked) are the
+// session it would start.
+type DryRunPlan struct {
+	Action  string   `json:"action"`
+	Summary string   `json:"summary"`
+	Backend string   `json:"backend,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Cwd     string   `json:"cwd,omitempty"`
+	Env     []string `json:"env,omitempty"`
+}
+
+// History event kinds
+const (
+	HistorySessionStarted   = "session-started"
+	HistorySessionExited    = "session-exited"
+	HistoryAgentSession     = "agent-session"
+	HistoryWorktreeCreated  = "worktree-created"
+	HistoryWorktreeRemoved  = "worktree-removed"
+	HistoryClipboardSet     = "clipboard-set"
+	HistoryClipboardGet     = "clipboard-get"
+	HistorySafeModeEntered  = "safe-mode-entered"
+	HistorySafeModeLeft     = "safe-mode-left"
+	HistoryOrphanKilled     = "orphan-killed"
+	HistoryBudgetExceeded   = "budget-exceeded"
+	HistorySessionAnnotated = "session-annotated"
+)
+
+// HistoryQuery selects history events: those of the given kinds (any if
+// empty) matching every filter that is set, between Since and Until (Unix
+// ms, inclusive). Limit caps the result (default 100, at most 1000).
+type HistoryQuery struct {
+	Kinds      []string  `json:"kinds,omitempty"`
+	ProcessID  string    `json:"processId,omitempty"`
+	WorktreeID string    `json:"worktreeId,omitempty"`
+	Agent      AgentType `json:"agent,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Since      int64     `json:"since,omitempty"`
+	Until      int64     `json:"until,omitempty"`
+	Limit      int       `json:"limit,omitempty"`
+}
+
+// ImagePull is the progress of a container image pull that a spawn waits
+// for. Current and Total sum the bytes of the layers whose size is known.
+type ImagePull struct {
+	Image   string       `json:"image"`
+	Status  string       `json:"status"` // one of the ImagePull* constants
+	Layers  []ImageLayer `json:"layers,omitempty"`
+	Current int64        `json:"current"`
+	Total   int64        `json:"total"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// Image pull statuses
+const (
+	ImagePullPulling  = "pulling"
+	ImagePullComplete = "complete"
+	ImagePullFailed   = "failed"
+)
+
+// AgentDiagnosis explains a session whose wrapper shell couldn't run the
+// agent's command, with what would fix it.
+type AgentDiagnosis struct {
+	Command string `json:"command"`
+	Problem string `json:"problem"` // one of the Diagnosis* constants
+	// FoundAt is where the command is, though the session's login shell
+	// doesn't have it on its PATH
+	FoundAt string `json:"foundAt,omitempty"`
+	// PathHint says how to put FoundAt on the login shell's PATH
+	PathHint string `json:"pathHint,omitempty"`
+	// Install is the command that installs the agent
+	Install string `json:"install,omitempty"`
+	// DaemonOnlyPath are the directories on the daemon's PATH that the
+	// login shell's PATH lacks
+	DaemonOnlyPath []string `json:"daemonOnlyPath,omitempty"`
+}
+
+// Agent diagnosis problems
+const (
+	DiagnosisNotFound     = "command-not-found"
+	DiagnosisNoSuchFile   = "no-such-file"
+	DiagnosisNotPermitted = "permission-denied"
+)
+
+// ImageLayer is one layer of an image pull. Status is the engine's (e.g.
+// "Downloading", "Extracting", "Pull complete").
+type ImageLayer struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+// ArtifactChunk identifies the part of an artifact file carried by an
+// artifact-chunk message. A file's chunks share ID and are sent in order;
+// the last one carries the file's SHA256.
+type ArtifactChunk struct {
+	ID string `json:"id"`
+	// Name is the slash-separated path relative to the session's directory
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Index  int    `json:"index"`
+	Total  int    `json:"total"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ArtifactInfo describes an artifact file that was sent completely.
+type ArtifactInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// TestResult summarizes a test run. Format is empty when the output wasn't
+// recognized; then only ExitCode tells whether the tests passed.
+type TestResult struct {
+	Format      string   `json:"format,omitempty"`
+	Passed      int      `json:"passed"`
+	Failed      int      `json:"failed"`
+	Skipped     int      `json:"skipped"`
+	FailedTests []string `json:"failedTests,omitempty"`
+	ExitCode    int      `json:"exitCode"`
+	DurationMs  int64    `json:"durationMs"`
+	// Output is the end of the command's output
+	Output string `json:"output,omitempty"`
+	// Coverage summarizes the coverage report the run wrote, if any
+	Coverage *Coverage `json:"coverage,omitempty"`
+}
+
+// Coverage summarizes a coverage report. Covered and Total count
+// statements (go-cover) or lines; they are zero when the report only gives
+// a percentage.
+type Coverage struct {
+	Format  string  `json:"format"`
+	File    string  `json:"file"`
+	Covered int     `json:"covered"`
+	Total   int     `json:"total"`
+	Percent float64 `json:"percent"`
+}
+
+// Diagnostic severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is one issue reported by a linter. File is relative to the
+// worktree root.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Rule     string `json:"rule,omitempty"`
+}
+
+// LintResult summarizes a lint run. Format is empty when the output wasn't
+// recognized; then only ExitCode tells whether the lint passed. Truncated
+// is set when Diagnostics was cut short; the counts are still complete.
+type LintResult struct {
+	Format      string       `json:"format,omitempty"`
+	Errors      int          `json:"errors"`
+	Warnings    int          `json:"warnings"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+	Truncated   bool         `json:"truncated,omitempty"`
+	ExitCode    int          `json:"exitCode"`
+	DurationMs  int64        `json:"durationMs"`
+	// Output is the end of the command's output
+	Output string `json:"output,omitempty"`
+}
+
+// WorktreeRemoval says how removing a worktree went: the repo it belonged
+// to, the sessions in it that were killed first, and each step tried, in
+// order, until one removed it. Removed is set once the worktree's directory
+// is gone and git no longer lists it.
+type WorktreeRemoval struct {
+	Repo           string        `json:"repo,omitempty"`
+	KilledSessions []string      `json:"killedSessions,omitempty"`
+	Steps          []RemovalStep `json:"steps,omitempty"`
+	Removed        bool          `json:"removed"`
+}
+
+// Worktree removal steps
+const (
+	// RemovalRemove is git worktree remove --force
+	RemovalRemove = "remove"
+	// RemovalForce is git worktree remove --force --force, which also
+	// removes locked worktrees
+	RemovalForce = "force"
+	// RemovalDelete deletes the directory and prunes git's record of it
+	RemovalDelete = "delete"
+)
+
+// RemovalStep is a step tried to remove a worktree, with why it failed.
+type RemovalStep struct {
+	Step  string `json:"step"`
+	Error string `json:"error,omitempty"`
+}
+
+// WorktreeEnvironment describes how ready a new worktree is for an agent
+// to run its tests in. Ready is set when every setup step passed and the
+// dependencies of every ecosystem found are installed.
+type WorktreeEnvironment struct {
+	// BaseCommit is the commit the worktree was created at
+	BaseCommit string `json:"baseCommit,omitempty"`
+	// Setup are the repo's setup commands, in order; those after a failed
+	// one are skipped
+	Setup        []SetupStep  `json:"setup,omitempty"`
+	Toolchains   []Toolchain  `json:"toolchains,omitempty"`
+	Dependencies []Dependency `json:"dependencies,omitempty"`
+	Ready        bool         `json:"ready"`
+}
+
+// SetupStep is the outcome of a setup command. Status is one of the Step*
+// constants; Output is the end of the command's output, for a failure.
+type SetupStep struct {
+	Command    string `json:"command"`
+	Status     string `json:"status"`
+	ExitCode   int    `json:"exitCode"`
+	DurationMs int64  `json:"durationMs"`
+	Output     string `json:"output,omitempty"`
+}
+
+// Toolchain is a language version a worktree asks for in a version file
+// (e.g. "node" "20.11.0" from .nvmrc). File is relative to the worktree.
+type Toolchain struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	File    string `json:"file"`
+}
+
+// Dependency says whether a worktree's dependencies of an ecosystem
+// ("node", "python") are installed. Manifest is the file declaring them,
+// relative to the worktree.
+type Dependency struct {
+	Ecosystem string `json:"ecosystem"`
+	Manifest  string `json:"manifest"`
+	Installed bool   `json:"installed"`
+}
+
+// Verification step statuses
+const (
+	StepPassed  = "passed"
+	StepFailed  = "failed"
+	StepSkipped = "skipped" // an earlier step failed
+)
+
+// VerificationStep is the outcome of step Index (of Total) of a
+// verification pipeline.
+type VerificationStep struct {
+	Name       string      `json:"name"`
+	Index      int         `json:"index"`
+	Total      int         `json:"total"`
+	Status     string      `json:"status"`
+	ExitCode   int         `json:"exitCode"`
+	DurationMs int64       `json:"durationMs"`
+	Output     string      `json:"output,omitempty"`
+	Tests      *TestResult `json:"tests,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// ServerMessage is received from server by daemon. It has the fields of
+// every server message type; ServerPayloads says which each type carries,
+// and DecodeServerMessage holds messages to that.
 type ServerMessage struct {
 	Type         string    `json:"type"`
 	ProcessID    string    `json:"processId,omitempty"`
@@ -56,31 +878,167 @@ type ServerMessage struct {
 	Rows         int       `json:"rows,omitempty"`
 	Command      string    `json:"command,omitempty"`
 	YoloMode     bool      `json:"yoloMode,omitempty"`
+	ResumeOf     string    `json:"resumeOf,omitempty"`
+	Profile      string    `json:"profile,omitempty"`
+	Model        string    `json:"model,omitempty"`
+
+	MCPServers map[string]MCPServer `json:"mcpServers,omitempty"`
+	Macro      string               `json:"macro,omitempty"`
+	Group      string               `json:"group,omitempty"`
+	// Package targets a monorepo package (create-worktree, spawn)
+	Package string `json:"package,omitempty"`
+	// ReadOnly makes a session ignore input (spawn, set-readonly)
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// AllowShared lets a spawn's agent edit a worktree another agent is
+	// already editing
+	AllowShared bool `json:"allowShared,omitempty"`
+	// Force makes a remove-worktree kill the sessions running in the
+	// worktree instead of refusing
+	Force bool `json:"force,omitempty"`
+	// SourceUser attributes input to a viewer (pty-input, send-macro,
+	// paste-image, acquire-input, release-input, set-clipboard,
+	// get-clipboard)
+	SourceUser string `json:"sourceUser,omitempty"`
+	// Paste is text to paste, Keys are keys to type by name (e.g. "up",
+	// "ctrl+c"), and Signal a signal for the foreground process (e.g.
+	// "SIGINT"), as input after Data (pty-input)
+	Paste  string   `json:"paste,omitempty"`
+	Keys   []string `json:"keys,omitempty"`
+	Signal string   `json:"signal,omitempty"`
+	// Note annotates a session (annotate-session)
+	Note string `json:"note,omitempty"`
+
+	RunID  string         `json:"runId,omitempty"`
+	Base   string         `json:"base,omitempty"`
+	Agents []CompareAgent `json:"agents,omitempty"`
+
+	// Files are written into the worktree's staging directory (stage-files)
+	Files []StageFile `json:"files,omitempty"`
+
+	// Backend selects the session backend for a spawn (e.g. "pty", "tmux")
+	Backend string `json:"backend,omitempty"`
+	// Sandbox overrides the container limits and network policy of a
+	// spawn on a container backend
+	Sandbox *Sandbox `json:"sandbox,omitempty"`
+	// Budget overrides the configured budget of a spawn, or replaces a
+	// session's budget (resume-session)
+	Budget *Budget `json:"budget,omitempty"`
+
+	// Query selects the events a query-history returns
+	Query *HistoryQuery `json:"query,omitempty"`
+
+	// Traceparent is the W3C trace context of the server's span, so the
+	// daemon's spans for the message join the server's trace
+	Traceparent string `json:"traceparent,omitempty"`
+
+	// Seq is the first pty-data sequence number a resync-request is
+	// missing
+	Seq uint64 `json:"seq,omitempty"`
+
+	// RequestID, when set, is echoed in every reply to the message and in
+	// the ack that ends them
+	RequestID string `json:"requestId,omitempty"`
+	// IdempotencyKey makes a retried spawn or create-worktree get the
+	// replies to the first attempt instead of running again
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// DryRun makes a spawn, kill, remove-worktree or compare-run reply
+	// with what it would do (dry-run) instead of doing it
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Timestamp (Unix ms) and Nonce guard signed messages against replay
+	Timestamp int64  `json:"ts,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+// StageFile is a file sent by the server for a task. Name is relative to
+// the staging directory; Data is base64.
+type StageFile struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
 }
 
 // Message types from daemon to server
 const (
-	MsgTypeRegister       = "register"
-	MsgTypeHeartbeat      = "heartbeat"
-	MsgTypePtyData        = "pty-data"
-	MsgTypePtySize        = "pty-size"
-	MsgTypeProcessStarted = "process-started"
-	MsgTypeProcessExit    = "process-exit"
-	MsgTypeWorktreeReady  = "worktree-ready"
-	MsgTypeBranchChanged  = "branch-changed"
-	MsgTypeReposList      = "repos-list"
+	MsgTypeRegister        = "register"
+	MsgTypeHeartbeat       = "heartbeat"
+	MsgTypePtyData         = "pty-data"
+	MsgTypePtySize         = "pty-size"
+	MsgTypeProcessStarted  = "process-started"
+	MsgTypeProcessExit     = "process-exit"
+	MsgTypeWorktreeReady   = "worktree-ready"
+	MsgTypeWorktreeError   = "worktree-error"
+	MsgTypeWorktreeRemoved = "worktree-removed"
+	MsgTypeBranchChanged   = "branch-changed"
+	MsgTypeReposList       = "repos-list"
+	MsgTypeRepoAdded       = "repo-added"
+	MsgTypeRepoRemoved     = "repo-removed"
+	MsgTypeRepoFetched     = "repo-fetched"
+	MsgTypeAgentSession    = "agent-session"
+	MsgTypeAgentTranscript = "agent-transcript"
+	MsgTypeCompareReport   = "compare-report"
+	MsgTypeTestResults     = "test-results"
+	MsgTypeLintResults     = "lint-results"
+	MsgTypeVerification    = "verification-result"
+	MsgTypeArtifactChunk   = "artifact-chunk"
+	MsgTypeArtifacts       = "artifacts-collected"
+	MsgTypeSessionSummary  = "session-summary"
+	MsgTypeFilesStaged     = "files-staged"
+	MsgTypeImagePasted     = "image-pasted"
+	MsgTypeClipboard       = "clipboard"
+	MsgTypeInputLease      = "input-lease"
+	MsgTypeInputRejected   = "input-rejected"
+	MsgTypeImagePull       = "image-pull-progress"
+	MsgTypeSpawnProgress   = "spawn-progress"
+	MsgTypeHistoryResults  = "history-results"
+	MsgTypeShellHistory    = "shell-history"
+	MsgTypeSessionInfo     = "session-info"
+	MsgTypeSessionStats    = "session-stats"
+	MsgTypeDryRun          = "dry-run"
+	MsgTypeBudgetExceeded  = "budget-exceeded"
+	MsgTypeError           = "error"
+	MsgTypeDaemonLog       = "daemon-log"
+	MsgTypeDaemonAlert     = "daemon-alert"
+	MsgTypeDaemonDraining  = "daemon-draining"
+	MsgTypeDaemonConfig    = "daemon-config"
+	MsgTypeAck             = "ack"
 )
 
 // Message types from server to daemon
 const (
-	MsgTypeCreateWorktree = "create-worktree"
-	MsgTypeSpawn          = "spawn"
-	MsgTypePtyInput       = "pty-input"
-	MsgTypeResize         = "resize"
-	MsgTypeQueryPtySize   = "query-pty-size"
-	MsgTypeKill           = "kill"
-	MsgTypeRemoveWorktree = "remove-worktree"
-	MsgTypeListRepos      = "list-repos"
+	MsgTypeCreateWorktree     = "create-worktree"
+	MsgTypeSpawn              = "spawn"
+	MsgTypePtyInput           = "pty-input"
+	MsgTypeResize             = "resize"
+	MsgTypeQueryPtySize       = "query-pty-size"
+	MsgTypeKill               = "kill"
+	MsgTypeRemoveWorktree     = "remove-worktree"
+	MsgTypeListRepos          = "list-repos"
+	MsgTypeFetchRepo          = "fetch-repo"
+	MsgTypeGetAgentTranscript = "get-agent-transcript"
+	MsgTypeGetSessionInfo     = "get-session-info"
+	MsgTypeGetSessionStats    = "get-session-stats"
+	MsgTypeSendMacro          = "send-macro"
+	MsgTypeGroup              = "group"
+	MsgTypeBroadcastInput     = "broadcast-input"
+	MsgTypeCompareRun         = "compare-run"
+	MsgTypeRunTests           = "run-tests"
+	MsgTypeRunLinter          = "run-linter"
+	MsgTypeStageFiles         = "stage-files"
+	MsgTypePasteImage         = "paste-image"
+	MsgTypeSetClipboard       = "set-clipboard"
+	MsgTypeGetClipboard       = "get-clipboard"
+	MsgTypeSetReadOnly        = "set-readonly"
+	MsgTypeAcquireInput       = "acquire-input"
+	MsgTypeReleaseInput       = "release-input"
+	MsgTypeQueryHistory       = "query-history"
+	MsgTypeGetHistory         = "get-history"
+	MsgTypeResyncRequest      = "resync-request"
+	MsgTypeHeartbeatAck       = "heartbeat-ack"
+	MsgTypeResumeSession      = "resume-session"
+	MsgTypeAnnotateSession    = "annotate-session"
+	MsgTypeGetDaemonConfig    = "get-daemon-config"
+	// MsgTypeSigned wraps another message with an HMAC signature
+	MsgTypeSigned = "signed"
 )
 
 // Agent command mappings
@@ -94,3 +1052,33 @@ var AgentCommands = map[AgentType]string{
 	AgentDroidCLI:    "droid",
 	AgentInkTest:     "node /tmp/ink-test/test.js",
 }
+
+// Error codes
+const (
+	// ErrorCodeInsufficientDisk: not enough free disk space for a worktree
+	ErrorCodeInsufficientDisk = "insufficient-disk"
+	// ErrorCodeInternal: the daemon recovered from a panic; any session it
+	// affected has been ended
+	ErrorCodeInternal = "internal-error"
+	// ErrorCodeInvalidMessage: a server message didn't match its type's
+	// payload and was dropped
+	ErrorCodeInvalidMessage = "invalid-message"
+	// ErrorCodePolicyDenied: a plugin's policy check didn't allow a server
+	// message, or couldn't be made, and it was dropped
+	ErrorCodePolicyDenied = "policy-denied"
+	// ErrorCodeOutOfScope: the connection's scopes don't allow a server
+	// message, and it was dropped
+	ErrorCodeOutOfScope = "out-of-scope"
+	// ErrorCodeSafeMode: the server's connection is in safe mode, after it
+	// stopped acknowledging heartbeats, and a command that starts or ends
+	// sessions or worktrees was dropped
+	ErrorCodeSafeMode = "safe-mode"
+	// ErrorCodeWorktreeInUse: a spawn's agent would edit a worktree
+	// another agent is editing, or a remove-worktree targets a worktree
+	// with sessions running in it
+	ErrorCodeWorktreeInUse = "worktree-in-use"
+	// ErrorCodeDraining: the daemon is draining before it shuts down, and a
+	// command that starts sessions or worktrees, or removes worktrees, was
+	// dropped
+	ErrorCodeDraining = "draining"
+)
@@ -0,0 +1,646 @@
+package protocol
+
+import "encoding/json"
+
+// Each message type's payload is a struct of the fields it carries, which
+// sit beside "type" in the message. A field without omitempty must be
+// present; an absent one is its zero value. Payloads name the fields of
+// ServerMessage and DaemonMessage that a type uses, and must agree with
+// them (see checkPayloads).
+
+// ServerEnvelope holds the fields any server message may carry besides its
+// payload.
+type ServerEnvelope struct {
+	Type        string `json:"type"`
+	RequestID   string `json:"requestId,omitempty"`
+	Traceparent string `json:"traceparent,omitempty"`
+	Timestamp   int64  `json:"ts,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+}
+
+// DaemonEnvelope holds the fields any daemon message may carry besides its
+// payload.
+type DaemonEnvelope struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// ServerPayloads maps each server message type to its payload.
+var ServerPayloads = map[string]any{
+	MsgTypeCreateWorktree:     CreateWorktreePayload{},
+	MsgTypeSpawn:              SpawnPayload{},
+	MsgTypePtyInput:           PtyInputPayload{},
+	MsgTypeAcquireInput:       InputLeaseRequestPayload{},
+	MsgTypeReleaseInput:       InputLeaseRequestPayload{},
+	MsgTypeResize:             ResizePayload{},
+	MsgTypeQueryPtySize:       ProcessPayload{},
+	MsgTypeResyncRequest:      ResyncRequestPayload{},
+	MsgTypeCompareRun:         CompareRunPayload{},
+	MsgTypeRunTests:           RunChecksPayload{},
+	MsgTypeRunLinter:          RunChecksPayload{},
+	MsgTypePasteImage:         InputPayload{},
+	MsgTypeSetClipboard:       SetClipboardPayload{},
+	MsgTypeGetClipboard:       GetClipboardPayload{},
+	MsgTypeStageFiles:         StageFilesPayload{},
+	MsgTypeGroup:              GroupPayload{},
+	MsgTypeSetReadOnly:        SetReadOnlyPayload{},
+	MsgTypeBroadcastInput:     BroadcastInputPayload{},
+	MsgTypeSendMacro:          SendMacroPayload{},
+	MsgTypeKill:               KillPayload{},
+	MsgTypeRemoveWorktree:     RemoveWorktreePayload{},
+	MsgTypeListRepos:          struct{}{},
+	MsgTypeGetAgentTranscript: ProcessPayload{},
+	MsgTypeGetSessionInfo:     ProcessPayload{},
+	MsgTypeGetSessionStats:    SessionStatsRequestPayload{},
+	MsgTypeQueryHistory:       QueryHistoryPayload{},
+	MsgTypeGetHistory:         GetHistoryPayload{},
+	MsgTypeFetchRepo:          FetchRepoPayload{},
+	MsgTypeHeartbeatAck:       struct{}{},
+	MsgTypeResumeSession:      ResumeSessionPayload{},
+	MsgTypeAnnotateSession:    AnnotateSessionPayload{},
+	MsgTypeGetDaemonConfig:    struct{}{},
+}
+
+// DaemonPayloads maps each daemon message type to its payload.
+var DaemonPayloads = map[string]any{
+	MsgTypeRegister:        RegisterPayload{},
+	MsgTypeHeartbeat:       HeartbeatPayload{},
+	MsgTypePtyData:         PtyDataPayload{},
+	MsgTypePtySize:         PtySizePayload{},
+	MsgTypeProcessStarted:  ProcessStartedPayload{},
+	MsgTypeProcessExit:     ProcessExitPayload{},
+	MsgTypeImagePull:       ImagePullPayload{},
+	MsgTypeSpawnProgress:   SpawnProgressPayload{},
+	MsgTypeAgentSession:    AgentSessionPayload{},
+	MsgTypeAgentTranscript: AgentTranscriptPayload{},
+	MsgTypeBranchChanged:   BranchChangedPayload{},
+	MsgTypeCompareReport:   CompareReportPayload{},
+	MsgTypeTestResults:     TestResultsPayload{},
+	MsgTypeLintResults:     LintResultsPayload{},
+	MsgTypeVerification:    VerificationPayload{},
+	MsgTypeArtifactChunk:   ArtifactChunkPayload{},
+	MsgTypeArtifacts:       ArtifactsPayload{},
+	MsgTypeSessionSummary:  SessionSummaryPayload{},
+	MsgTypeFilesStaged:     FilesStagedPayload{},
+	MsgTypeInputLease:      InputLeasePayload{},
+	MsgTypeInputRejected:   InputRejectedPayload{},
+	MsgTypeImagePasted:     ImagePastedPayload{},
+	MsgTypeClipboard:       ClipboardPayload{},
+	MsgTypeWorktreeReady:   WorktreeReadyPayload{},
+	MsgTypeWorktreeRemoved: WorktreeRemovedPayload{},
+	MsgTypeWorktreeError:   WorktreeErrorPayload{},
+	MsgTypeHistoryResults:  HistoryResultsPayload{},
+	MsgTypeShellHistory:    ShellHistoryPayload{},
+	MsgTypeSessionInfo:     SessionInfoPayload{},
+	MsgTypeSessionStats:    SessionStatsPayload{},
+	MsgTypeDryRun:          DryRunPayload{},
+	MsgTypeBudgetExceeded:  BudgetExceededPayload{},
+	MsgTypeError:           ErrorPayload{},
+	MsgTypeDaemonLog:       DaemonLogPayload{},
+	MsgTypeDaemonAlert:     DaemonAlertPayload{},
+	MsgTypeDaemonDraining:  DaemonDrainingPayload{},
+	MsgTypeDaemonConfig:    DaemonConfigPayload{},
+	MsgTypeAck:             AckPayload{},
+	MsgTypeReposList:       ReposListPayload{},
+	MsgTypeRepoAdded:       RepoAddedPayload{},
+	MsgTypeRepoRemoved:     RepoRemovedPayload{},
+	MsgTypeRepoFetched:     RepoFetchedPayload{},
+}
+
+// Server message payloads
+
+// ProcessPayload names a session (query-pty-size, get-agent-transcript,
+// get-session-info).
+type ProcessPayload struct {
+	ProcessID string `json:"processId"`
+}
+
+// SessionStatsRequestPayload is the payload of get-session-stats; without
+// a processId it asks for every session of the server.
+type SessionStatsRequestPayload struct {
+	ProcessID string `json:"processId,omitempty"`
+}
+
+// CreateWorktreePayload is the payload of create-worktree.
+type CreateWorktreePayload struct {
+	WorktreeID     string `json:"worktreeId"`
+	RepoName       string `json:"repoName"`
+	RepoPath       string `json:"repoPath"`
+	Package        string `json:"package,omitempty"`
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+}
+
+// SpawnPayload starts a session; Agent may come from Profile instead, and
+// Args is ignored.
+type SpawnPayload struct {
+	ProcessID      string               `json:"processId"`
+	WorktreeID     string               `json:"worktreeId,omitempty"`
+	WorktreePath   string               `json:"worktreePath"`
+	Agent          AgentType            `json:"agent,omitempty"`
+	Args           []string             `json:"args,omitempty"`
+	Task           string               `json:"task,omitempty"`
+	Cols           int                  `json:"cols,omitempty"`
+	Rows           int                  `json:"rows,omitempty"`
+	YoloMode       bool                 `json:"yoloMode,omitempty"`
+	ResumeOf       string               `json:"resumeOf,omitempty"`
+	Profile        string               `json:"profile,omitempty"`
+	Model          string               `json:"model,omitempty"`
+	MCPServers     map[string]MCPServer `json:"mcpServers,omitempty"`
+	Group          string               `json:"group,omitempty"`
+	Backend        string               `json:"backend,omitempty"`
+	Package        string               `json:"package,omitempty"`
+	ReadOnly       bool                 `json:"readOnly,omitempty"`
+	AllowShared    bool                 `json:"allowShared,omitempty"`
+	Sandbox        *Sandbox             `json:"sandbox,omitempty"`
+	Budget         *Budget              `json:"budget,omitempty"`
+	IdempotencyKey string               `json:"idempotencyKey,omitempty"`
+	DryRun         bool                 `json:"dryRun,omitempty"`
+}
+
+// KillPayload is the payload of kill.
+type KillPayload struct {
+	ProcessID string `json:"processId"`
+	DryRun    bool   `json:"dryRun,omitempty"`
+}
+
+// InputPayload is base64 data for a session (paste-image).
+type InputPayload struct {
+	ProcessID  string `json:"processId"`
+	Data       string `json:"data"`
+	SourceUser string `json:"sourceUser,omitempty"`
+}
+
+// PtyInputPayload is input for a session: base64 data, text to paste, keys
+// by name and a signal, each optional, applied in that order.
+type PtyInputPayload struct {
+	ProcessID  string   `json:"processId"`
+	Data       string   `json:"data,omitempty"`
+	Keys       []string `json:"keys,omitempty"`
+	Paste      string   `json:"paste,omitempty"`
+	Signal     string   `json:"signal,omitempty"`
+	SourceUser string   `json:"sourceUser,omitempty"`
+}
+
+// SetClipboardPayload puts data (base64) on the daemon host's clipboard,
+// copied in a session if processId is set.
+type SetClipboardPayload struct {
+	ProcessID  string `json:"processId,omitempty"`
+	Data       string `json:"data"`
+	SourceUser string `json:"sourceUser,omitempty"`
+}
+
+// GetClipboardPayload asks for the daemon host's clipboard, to paste into a
+// session if processId is set.
+type GetClipboardPayload struct {
+	ProcessID  string `json:"processId,omitempty"`
+	SourceUser string `json:"sourceUser,omitempty"`
+}
+
+// InputLeaseRequestPayload takes or gives up an input lease
+// (acquire-input, release-input).
+type InputLeaseRequestPayload struct {
+	ProcessID  string `json:"processId"`
+	SourceUser string `json:"sourceUser"`
+}
+
+// ResizePayload is the payload of resize.
+type ResizePayload struct {
+	ProcessID string `json:"processId"`
+	Cols      int    `json:"cols"`
+	Rows      int    `json:"rows"`
+}
+
+// ResyncRequestPayload is the payload of resync-request.
+type ResyncRequestPayload struct {
+	ProcessID string `json:"processId"`
+	Seq       uint64 `json:"seq"`
+}
+
+// CompareRunPayload is the payload of compare-run.
+type CompareRunPayload struct {
+	RunID    string         `json:"runId"`
+	RepoName string         `json:"repoName"`
+	RepoPath string         `json:"repoPath"`
+	Task     string         `json:"task"`
+	Agents   []CompareAgent `json:"agents"`
+	Base     string         `json:"base,omitempty"`
+	Cols     int            `json:"cols,omitempty"`
+	Rows     int            `json:"rows,omitempty"`
+	YoloMode bool           `json:"yoloMode,omitempty"`
+	DryRun   bool           `json:"dryRun,omitempty"`
+}
+
+// RunChecksPayload runs a worktree's checks (run-tests, run-linter).
+type RunChecksPayload struct {
+	RunID        string `json:"runId"`
+	WorktreePath string `json:"worktreePath"`
+	Package      string `json:"package,omitempty"`
+}
+
+// StageFilesPayload is the payload of stage-files.
+type StageFilesPayload struct {
+	RunID        string      `json:"runId"`
+	WorktreePath string      `json:"worktreePath"`
+	Files        []StageFile `json:"files"`
+}
+
+// GroupPayload puts a session in a group; no group leaves the current one.
+type GroupPayload struct {
+	ProcessID string `json:"processId"`
+	Group     string `json:"group,omitempty"`
+}
+
+// SetReadOnlyPayload is the payload of set-readonly.
+type SetReadOnlyPayload struct {
+	ProcessID string `json:"processId"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// ResumeSessionPayload is the payload of resume-session. Budget, if set,
+// replaces the session's budget; otherwise the limits it went over stay
+// spent.
+type ResumeSessionPayload struct {
+	ProcessID string  `json:"processId"`
+	Budget    *Budget `json:"budget,omitempty"`
+}
+
+// BroadcastInputPayload is the payload of broadcast-input.
+type BroadcastInputPayload struct {
+	Group string `json:"group"`
+	Data  string `json:"data"`
+}
+
+// SendMacroPayload is the payload of send-macro.
+type SendMacroPayload struct {
+	ProcessID  string `json:"processId"`
+	Macro      string `json:"macro"`
+	SourceUser string `json:"sourceUser,omitempty"`
+}
+
+// RemoveWorktreePayload is the payload of remove-worktree.
+type RemoveWorktreePayload struct {
+	WorktreeID   string `json:"worktreeId"`
+	WorktreePath string `json:"worktreePath"`
+	Force        bool   `json:"force,omitempty"`
+	DryRun       bool   `json:"dryRun,omitempty"`
+}
+
+// QueryHistoryPayload is the payload of query-history.
+type QueryHistoryPayload struct {
+	RunID string        `json:"runId"`
+	Query *HistoryQuery `json:"query,omitempty"`
+}
+
+// GetHistoryPayload is the payload of get-history. WorktreePath finds the
+// history of a session the daemon no longer knows of.
+type GetHistoryPayload struct {
+	ProcessID    string `json:"processId"`
+	WorktreePath string `json:"worktreePath,omitempty"`
+}
+
+// AnnotateSessionPayload is the payload of annotate-session.
+type AnnotateSessionPayload struct {
+	ProcessID  string `json:"processId"`
+	Note       string `json:"note"`
+	SourceUser string `json:"sourceUser,omitempty"`
+}
+
+// FetchRepoPayload is the payload of fetch-repo.
+type FetchRepoPayload struct {
+	RepoName string `json:"repoName,omitempty"`
+	RepoPath string `json:"repoPath"`
+}
+
+// Daemon message payloads
+
+// RegisterPayload is the payload of register.
+type RegisterPayload struct {
+	EnvID         string            `json:"envId"`
+	EnvName       string            `json:"envName"`
+	Capabilities  []string          `json:"capabilities"`
+	Workspace     string            `json:"workspace,omitempty"`
+	Profiles      []ProfileInfo     `json:"profiles,omitempty"`
+	Macros        []string          `json:"macros,omitempty"`
+	Backends      []string          `json:"backends,omitempty"`
+	Clipboard     []string          `json:"clipboard,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	GPUs          []GPUInfo         `json:"gpus,omitempty"`
+	WatchdogTrips []WatchdogTrip    `json:"watchdogTrips,omitempty"`
+	Draining      *Draining         `json:"draining,omitempty"`
+}
+
+// HeartbeatPayload is the payload of heartbeat.
+type HeartbeatPayload struct {
+	GPUs          []GPUInfo      `json:"gpus,omitempty"`
+	WatchdogTrips []WatchdogTrip `json:"watchdogTrips,omitempty"`
+	Timestamp     int64          `json:"ts,omitempty"`
+	Latency       *Latency       `json:"latency,omitempty"`
+	Draining      *Draining      `json:"draining,omitempty"`
+}
+
+// PtyDataPayload is the payload of pty-data.
+type PtyDataPayload struct {
+	ProcessID string `json:"processId"`
+	Data      string `json:"data"`
+	Seq       uint64 `json:"seq"`
+	Snapshot  bool   `json:"snapshot,omitempty"`
+	Condensed bool   `json:"condensed,omitempty"`
+}
+
+// PtySizePayload is the payload of pty-size.
+type PtySizePayload struct {
+	ProcessID string `json:"processId"`
+	Cols      int    `json:"cols"`
+	Rows      int    `json:"rows"`
+}
+
+// ProcessStartedPayload is the payload of process-started.
+type ProcessStartedPayload struct {
+	ProcessID string `json:"processId"`
+	Package   string `json:"package,omitempty"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+	SpawnMs   int64  `json:"spawnMs,omitempty"`
+}
+
+// ProcessExitPayload is the payload of process-exit.
+type ProcessExitPayload struct {
+	ProcessID  string `json:"processId"`
+	ExitCode   int    `json:"exitCode,omitempty"`
+	ExitReason string `json:"exitReason,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	ExitDetail string `json:"exitDetail,omitempty"`
+	// TouchedProtected are the files under protected paths the session
+	// added, changed or removed
+	TouchedProtected []string `json:"touchedProtected,omitempty"`
+	// Diagnosis explains an exit because the agent couldn't be run
+	Diagnosis *AgentDiagnosis `json:"diagnosis,omitempty"`
+}
+
+// ImagePullPayload is the payload of image-pull-progress.
+type ImagePullPayload struct {
+	ProcessID string     `json:"processId"`
+	Pull      *ImagePull `json:"pull"`
+}
+
+// SpawnProgressPayload is the payload of spawn-progress. Error says why
+// the spawn failed, at stage "failed".
+type SpawnProgressPayload struct {
+	ProcessID     string `json:"processId"`
+	Stage         string `json:"stage"`
+	Error         string `json:"error,omitempty"`
+	FirstOutputMs int64  `json:"firstOutputMs,omitempty"`
+	// Diagnosis explains a failed stage because the agent couldn't be run
+	Diagnosis *AgentDiagnosis `json:"diagnosis,omitempty"`
+}
+
+// AgentSessionPayload is the payload of agent-session.
+type AgentSessionPayload struct {
+	ProcessID      string `json:"processId"`
+	AgentSessionID string `json:"agentSessionId"`
+}
+
+// AgentTranscriptPayload is the payload of agent-transcript.
+type AgentTranscriptPayload struct {
+	ProcessID      string            `json:"processId"`
+	Agent          AgentType         `json:"agent,omitempty"`
+	AgentSessionID string            `json:"agentSessionId,omitempty"`
+	Transcript     []json.RawMessage `json:"transcript,omitempty"`
+	Markers        []SessionMarker   `json:"markers,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// BranchChangedPayload is the payload of branch-changed.
+type BranchChangedPayload struct {
+	WorktreeID string `json:"worktreeId"`
+	Branch     string `json:"branch"`
+}
+
+// CompareReportPayload is the payload of compare-report.
+type CompareReportPayload struct {
+	RunID   string          `json:"runId"`
+	Base    string          `json:"base,omitempty"`
+	Results []CompareResult `json:"results,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// TestResultsPayload is the payload of test-results.
+type TestResultsPayload struct {
+	RunID   string      `json:"runId"`
+	Path    string      `json:"path"`
+	Package string      `json:"package,omitempty"`
+	Tests   *TestResult `json:"tests,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// LintResultsPayload is the payload of lint-results.
+type LintResultsPayload struct {
+	RunID   string      `json:"runId"`
+	Path    string      `json:"path"`
+	Package string      `json:"package,omitempty"`
+	Lint    *LintResult `json:"lint,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// VerificationPayload is the payload of verification-result.
+type VerificationPayload struct {
+	ProcessID string            `json:"processId"`
+	Path      string            `json:"path"`
+	Package   string            `json:"package,omitempty"`
+	Step      *VerificationStep `json:"step"`
+}
+
+// ArtifactChunkPayload is the payload of artifact-chunk.
+type ArtifactChunkPayload struct {
+	ProcessID string         `json:"processId"`
+	Path      string         `json:"path"`
+	Package   string         `json:"package,omitempty"`
+	Artifact  *ArtifactChunk `json:"artifact"`
+	Data      string         `json:"data"`
+}
+
+// ArtifactsPayload is the payload of artifacts-collected.
+type ArtifactsPayload struct {
+	ProcessID string         `json:"processId"`
+	Path      string         `json:"path"`
+	Package   string         `json:"package,omitempty"`
+	Artifacts []ArtifactInfo `json:"artifacts,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// SessionSummaryPayload is the payload of session-summary.
+type SessionSummaryPayload struct {
+	ProcessID string       `json:"processId"`
+	Path      string       `json:"path"`
+	Agent     AgentType    `json:"agent"`
+	Diff      *SessionDiff `json:"diff,omitempty"`
+	Summary   string       `json:"summary,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// FilesStagedPayload is the payload of files-staged.
+type FilesStagedPayload struct {
+	RunID string   `json:"runId"`
+	Path  string   `json:"path"`
+	Files []string `json:"files,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// InputLeasePayload is the payload of input-lease.
+type InputLeasePayload struct {
+	ProcessID string `json:"processId"`
+	Holder    string `json:"holder,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// InputRejectedPayload is the payload of input-rejected.
+type InputRejectedPayload struct {
+	ProcessID string `json:"processId"`
+	Error     string `json:"error"`
+}
+
+// ImagePastedPayload is the payload of image-pasted.
+type ImagePastedPayload struct {
+	ProcessID string `json:"processId"`
+	Path      string `json:"path,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ClipboardPayload is the payload of clipboard, the reply to set-clipboard
+// and get-clipboard; data (base64) is the clipboard for a get.
+type ClipboardPayload struct {
+	ProcessID string `json:"processId,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// WorktreeReadyPayload is the payload of worktree-ready.
+type WorktreeReadyPayload struct {
+	WorktreeID  string               `json:"worktreeId"`
+	Path        string               `json:"path"`
+	Branch      string               `json:"branch"`
+	Package     string               `json:"package,omitempty"`
+	Environment *WorktreeEnvironment `json:"environment,omitempty"`
+	Error       string               `json:"error,omitempty"`
+}
+
+// WorktreeRemovedPayload is the payload of worktree-removed.
+type WorktreeRemovedPayload struct {
+	WorktreeID string           `json:"worktreeId"`
+	Path       string           `json:"path"`
+	Reason     string           `json:"reason"`
+	Removal    *WorktreeRemoval `json:"removal,omitempty"`
+}
+
+// WorktreeErrorPayload is the payload of worktree-error.
+type WorktreeErrorPayload struct {
+	WorktreeID string           `json:"worktreeId"`
+	Error      string           `json:"error"`
+	ErrorCode  string           `json:"errorCode,omitempty"`
+	Removal    *WorktreeRemoval `json:"removal,omitempty"`
+}
+
+// HistoryResultsPayload is the payload of history-results.
+type HistoryResultsPayload struct {
+	RunID   string         `json:"runId"`
+	History []HistoryEvent `json:"history,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// ShellHistoryPayload is the payload of shell-history.
+type ShellHistoryPayload struct {
+	ProcessID string         `json:"processId"`
+	Commands  []ShellCommand `json:"commands,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// SessionInfoPayload is the payload of session-info.
+type SessionInfoPayload struct {
+	ProcessID string       `json:"processId"`
+	Session   *SessionInfo `json:"session,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// SessionStatsPayload is the payload of session-stats.
+type SessionStatsPayload struct {
+	ProcessID  string           `json:"processId,omitempty"`
+	Stats      []SessionStats   `json:"stats,omitempty"`
+	Connection *ConnectionStats `json:"connection,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// DryRunPayload is the payload of dry-run. It names what the message acted
+// on, as its own replies would.
+type DryRunPayload struct {
+	ProcessID  string      `json:"processId,omitempty"`
+	WorktreeID string      `json:"worktreeId,omitempty"`
+	Path       string      `json:"path,omitempty"`
+	RunID      string      `json:"runId,omitempty"`
+	Plan       *DryRunPlan `json:"plan,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// BudgetExceededPayload is the payload of budget-exceeded. Error is why
+// the budget's action couldn't be taken, if it couldn't.
+type BudgetExceededPayload struct {
+	ProcessID string          `json:"processId"`
+	Budget    *BudgetExceeded `json:"budget"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// ErrorPayload is the payload of error.
+type ErrorPayload struct {
+	ProcessID string `json:"processId,omitempty"`
+	Error     string `json:"error"`
+	ErrorCode string `json:"errorCode"`
+}
+
+// DaemonLogPayload is the payload of daemon-log.
+type DaemonLogPayload struct {
+	Log *LogRecord `json:"log"`
+}
+
+// DaemonAlertPayload is the payload of daemon-alert.
+type DaemonAlertPayload struct {
+	Alert *DaemonAlert `json:"alert"`
+}
+
+// DaemonDrainingPayload is the payload of daemon-draining.
+type DaemonDrainingPayload struct {
+	Draining *Draining `json:"draining"`
+}
+
+// DaemonConfigPayload is the payload of daemon-config.
+type DaemonConfigPayload struct {
+	DaemonConfig *DaemonConfig `json:"daemonConfig"`
+}
+
+// AckPayload is the payload of ack.
+type AckPayload struct {
+	RequestID string `json:"requestId"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// ReposListPayload is the payload of repos-list.
+type ReposListPayload struct {
+	Repos []RepoInfo `json:"repos,omitempty"`
+}
+
+// RepoAddedPayload is the payload of repo-added.
+type RepoAddedPayload struct {
+	Repo *RepoInfo `json:"repo"`
+}
+
+// RepoFetchedPayload is the payload of repo-fetched.
+type RepoFetchedPayload struct {
+	Repo  *RepoInfo `json:"repo"`
+	Error string    `json:"error,omitempty"`
+}
+
+// RepoRemovedPayload is the payload of repo-removed.
+type RepoRemovedPayload struct {
+	RepoName string `json:"repoName"`
+	Path     string `json:"path"`
+}
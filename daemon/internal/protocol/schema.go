@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+)
+
+// signedFrame is the envelope of a signed server message, for the schema;
+// package signing encodes it.
+type signedFrame struct {
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+	Sig     string `json:"sig"`
+}
+
+// Schema returns a JSON Schema (draft 2020-12) of the protocol for server
+// code generation. Its $defs hold ServerMessage and DaemonMessage, unions
+// of the messages each side sends discriminated by "type", with each
+// message and the types they use; the schema itself accepts either.
+func Schema() map[string]any {
+	g := &schemaGen{defs: make(map[string]any)}
+	server := g.union(ServerEnvelope{}, ServerPayloads)
+	daemon := g.union(DaemonEnvelope{}, DaemonPayloads)
+	chunk := g.frame(Chunk{}, MsgTypeChunk)
+	server["oneOf"] = append(server["oneOf"].([]any), chunk, g.frame(signedFrame{}, MsgTypeSigned))
+	daemon["oneOf"] = append(daemon["oneOf"].([]any), chunk)
+	g.defs["ServerMessage"] = server
+	g.defs["DaemonMessage"] = daemon
+
+	return map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "agenthq daemon protocol",
+		"anyOf": []any{
+			map[string]any{"$ref": "#/$defs/ServerMessage"},
+			map[string]any{"$ref": "#/$defs/DaemonMessage"},
+		},
+		"$defs": g.defs,
+	}
+}
+
+type schemaGen struct {
+	defs map[string]any
+}
+
+// union returns the schema of a message union, adding a definition for
+// each message type.
+func (g *schemaGen) union(envelope any, payloads map[string]any) map[string]any {
+	types := make([]string, 0, len(payloads))
+	for msgType := range payloads {
+		types = append(types, msgType)
+	}
+	slices.Sort(types)
+
+	var oneOf []any
+	for _, msgType := range types {
+		def := g.object(reflect.TypeOf(envelope), reflect.TypeOf(payloads[msgType]))
+		def["properties"].(map[string]any)["type"] = map[string]any{"const": msgType}
+		g.defs[msgType] = def
+		oneOf = append(oneOf, map[string]any{"$ref": "#/$defs/" + msgType})
+	}
+	return map[string]any{
+		"oneOf": oneOf,
+	}
+}
+
+// frame returns a reference to the definition of a frame that wraps
+// messages, whose "type" is msgType.
+func (g *schemaGen) frame(v any, msgType string) map[string]any {
+	ref := g.ref(reflect.TypeOf(v))
+	def := g.defs[reflect.TypeOf(v).Name()].(map[string]any)
+	def["properties"].(map[string]any)["type"] = map[string]any{"const": msgType}
+	return ref
+}
+
+// object returns the schema of a JSON object with the fields of structs ts.
+func (g *schemaGen) object(ts ...reflect.Type) map[string]any {
+	props := make(map[string]any)
+	var required []string
+	for _, t := range ts {
+		for _, f := range jsonFields(t) {
+			props[f.name] = g.schema(f.field.Type)
+			if f.required && !slices.Contains(required, f.name) {
+				required = append(required, f.name)
+			}
+		}
+	}
+	obj := map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
+
+// ref returns a reference to the definition of named struct type t, adding
+// it first.
+func (g *schemaGen) ref(t reflect.Type) map[string]any {
+	name := t.Name()
+	if _, ok := g.defs[name]; !ok {
+		g.defs[name] = nil // placeholder for recursive types
+		g.defs[name] = g.object(t)
+	}
+	return map[string]any{"$ref": "#/$defs/" + name}
+}
+
+// schema returns the schema of values of Go type t.
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return g.ref(t)
+	}
+	return map[string]any{}
+}
@@ -2,21 +2,39 @@
 package pty
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
 
 	"github.com/creack/pty"
 )
 
+// DefaultReadBufferSize is the most terminal output ReadLoop reads at once,
+// unless SetReadBufferSize says otherwise.
+const DefaultReadBufferSize = 4096
+
+var readBufferSize atomic.Int64
+
+// SetReadBufferSize sets the most terminal output ReadLoops started from
+// now on read at once, and so the largest chunk they pass on; 0 restores
+// DefaultReadBufferSize.
+func SetReadBufferSize(size int) {
+	readBufferSize.Store(int64(size))
+}
+
 // Process represents a running PTY process.
 type Process struct {
-	cmd  *exec.Cmd
-	pty  *os.File
-	done chan struct{}
-	mu   sync.Mutex
+	cmd    *exec.Cmd
+	pty    *os.File
+	done   chan struct{}
+	mu     sync.Mutex
+	signal string
 }
 
 // setEnv sets or overrides an environment variable in the slice.
@@ -45,31 +63,47 @@ func removeEnv(env []string, key string) []string {
 	return filtered
 }
 
+// TerminalEnv are the terminal and color settings every session runs with.
+var TerminalEnv = []string{
+	"TERM=xterm-256color",
+	"CLICOLOR=1",          // BSD ls colors (macOS)
+	"CLICOLOR_FORCE=1",    // Force BSD colors
+	"COLORTERM=truecolor", // 24-bit color support
+	"FORCE_COLOR=3",       // Force colors for Node.js CLI tools (level 3 = 256 colors)
 
-// Spawn starts a new process with a PTY.
-func Spawn(command string, args []string, dir string, env []string, cols, rows int) (*Process, error) {
-	cmd := exec.Command(command, args...)
-	cmd.Dir = dir
+	// Disable CI detection for TUI apps like Ink
+	// Many CLI frameworks (Ink, inquirer, etc) check for CI env vars and disable
+	// interactive rendering when they think they're in CI. Setting CI=false
+	// is sufficient as is-in-ci checks this value first before other conditions.
+	"CI=false",
+}
 
+// Env returns the environment sessions run with: the daemon's own
+// environment with terminal and color settings forced, overridden by extra.
+func Env(extra []string) []string {
 	// Start with base environment
 	baseEnv := os.Environ()
 
 	// Override terminal and color settings (filter duplicates first)
-	baseEnv = setEnv(baseEnv, "TERM", "xterm-256color")
-	baseEnv = setEnv(baseEnv, "CLICOLOR", "1")           // BSD ls colors (macOS)
-	baseEnv = setEnv(baseEnv, "CLICOLOR_FORCE", "1")     // Force BSD colors
-	baseEnv = setEnv(baseEnv, "COLORTERM", "truecolor")  // 24-bit color support
-	baseEnv = removeEnv(baseEnv, "NO_COLOR")             // Remove NO_COLOR to allow colors
-	baseEnv = setEnv(baseEnv, "FORCE_COLOR", "3")        // Force colors for Node.js CLI tools (level 3 = 256 colors)
+	baseEnv = removeEnv(baseEnv, "NO_COLOR") // Remove NO_COLOR to allow colors
+	for _, kv := range TerminalEnv {
+		key, value, _ := strings.Cut(kv, "=")
+		baseEnv = setEnv(baseEnv, key, value)
+	}
 
-	// Disable CI detection for TUI apps like Ink
-	// Many CLI frameworks (Ink, inquirer, etc) check for CI env vars and disable
-	// interactive rendering when they think they're in CI. Setting CI=false
-	// is sufficient as is-in-ci checks this value first before other conditions.
-	baseEnv = setEnv(baseEnv, "CI", "false")
+	// Add any additional env vars, replacing inherited values
+	for _, kv := range extra {
+		key, value, _ := strings.Cut(kv, "=")
+		baseEnv = setEnv(baseEnv, key, value)
+	}
+	return baseEnv
+}
 
-	// Add any additional env vars
-	cmd.Env = append(baseEnv, env...)
+// Spawn starts a new process with a PTY.
+func Spawn(command string, args []string, dir string, env []string, cols, rows int) (*Process, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	cmd.Env = Env(env)
 
 	// Set initial terminal size
 	winSize := &pty.Winsize{
@@ -89,6 +123,11 @@ func Spawn(command string, args []string, dir string, env []string, cols, rows i
 	}, nil
 }
 
+// PID returns the process id of the command.
+func (p *Process) PID() int {
+	return p.cmd.Process.Pid
+}
+
 // Read reads from the PTY.
 func (p *Process) Read(buf []byte) (int, error) {
 	return p.pty.Read(buf)
@@ -126,17 +165,55 @@ func (p *Process) Size() (cols, rows int, err error) {
 // Wait waits for the process to exit and returns the exit code.
 func (p *Process) Wait() (int, error) {
 	err := p.cmd.Wait()
-	close(p.done)
 
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				p.mu.Lock()
+				p.signal = SignalName(status.Signal())
+				p.mu.Unlock()
+			}
+			close(p.done)
 			return exitErr.ExitCode(), nil
 		}
+		close(p.done)
 		return -1, err
 	}
+	close(p.done)
 	return 0, nil
 }
 
+// signalNames maps common terminating signals to their names.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+// SignalName returns the name of a signal, e.g. "SIGKILL".
+func SignalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+// Signal returns the name of the signal that terminated the process (e.g.
+// "SIGKILL"), or "" if it exited normally or is still running.
+func (p *Process) Signal() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.signal
+}
+
 // Kill terminates the process.
 func (p *Process) Kill() error {
 	p.mu.Lock()
@@ -148,6 +225,29 @@ func (p *Process) Kill() error {
 	return nil
 }
 
+// SignalForeground sends sig to the terminal's foreground process group:
+// the program running in the foreground of the session's shell, or the
+// shell itself. Unlike typing Ctrl-C, it works when that program turned
+// the terminal's signal keys off.
+func (p *Process) SignalForeground(sig syscall.Signal) error {
+	conn, err := p.pty.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var pgrp int32
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return fmt.Errorf("foreground process group: %w", errno)
+	}
+	return syscall.Kill(-int(pgrp), sig)
+}
+
 // Close closes the PTY file descriptor.
 func (p *Process) Close() error {
 	return p.pty.Close()
@@ -216,48 +316,56 @@ func incompleteUTF8Len(data []byte) int {
 // StartReadLoop starts a goroutine that reads from PTY and sends data via callback.
 // It handles UTF-8 boundaries to prevent multi-byte characters from being split.
 func (p *Process) StartReadLoop(onData func([]byte)) {
-	go func() {
-		buf := make([]byte, 4096)
-		var pending []byte // Buffer for incomplete UTF-8 sequences
-
-		for {
-			n, err := p.Read(buf)
-			if n > 0 {
-				// Prepend any pending bytes from previous read
-				var data []byte
-				if len(pending) > 0 {
-					data = make([]byte, len(pending)+n)
-					copy(data, pending)
-					copy(data[len(pending):], buf[:n])
-					pending = nil
-				} else {
-					data = make([]byte, n)
-					copy(data, buf[:n])
-				}
+	go ReadLoop(p, onData)
+}
 
-				// Check for incomplete UTF-8 at the end
-				incomplete := incompleteUTF8Len(data)
-				if incomplete > 0 {
-					// Save incomplete bytes for next iteration
-					pending = make([]byte, incomplete)
-					copy(pending, data[len(data)-incomplete:])
-					data = data[:len(data)-incomplete]
-				}
+// ReadLoop reads terminal output from r until it fails, passing it to
+// onData without splitting UTF-8 sequences across calls.
+func ReadLoop(r io.Reader, onData func([]byte)) {
+	size := int(readBufferSize.Load())
+	if size <= 0 {
+		size = DefaultReadBufferSize
+	}
+	buf := make([]byte, size)
+	var pending []byte // Buffer for incomplete UTF-8 sequences
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			// Prepend any pending bytes from previous read
+			var data []byte
+			if len(pending) > 0 {
+				data = make([]byte, len(pending)+n)
+				copy(data, pending)
+				copy(data[len(pending):], buf[:n])
+				pending = nil
+			} else {
+				data = make([]byte, n)
+				copy(data, buf[:n])
+			}
 
-				if len(data) > 0 {
-					onData(data)
-				}
+			// Check for incomplete UTF-8 at the end
+			incomplete := incompleteUTF8Len(data)
+			if incomplete > 0 {
+				// Save incomplete bytes for next iteration
+				pending = make([]byte, incomplete)
+				copy(pending, data[len(data)-incomplete:])
+				data = data[:len(data)-incomplete]
 			}
-			if err != nil {
-				// Send any remaining pending bytes before exiting
-				if len(pending) > 0 {
-					onData(pending)
-				}
-				if err != io.EOF {
-					// Log error but don't crash
-				}
-				return
+
+			if len(data) > 0 {
+				onData(data)
 			}
 		}
-	}()
+		if err != nil {
+			// Send any remaining pending bytes before exiting
+			if len(pending) > 0 {
+				onData(pending)
+			}
+			if err != io.EOF {
+				// Log error but don't crash
+			}
+			return
+		}
+	}
 }
@@ -0,0 +1,138 @@
+// Package ptylog numbers each session's pty-data messages and keeps the
+// most recent ones, so a server that finds a gap in the sequence, such as
+// after a lossy reconnect, can be sent what it missed.
+package ptylog
+
+import "sync"
+
+// DefaultLimit is how much output is kept per session by default.
+const DefaultLimit = 256 * 1024
+
+// Chunk is one pty-data message's output.
+type Chunk struct {
+	Seq  uint64
+	Data []byte
+}
+
+// Log keeps the recent output of every session.
+type Log struct {
+	limit int
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+type stream struct {
+	// mu is held while sending, so output and resyncs don't interleave
+	mu     sync.Mutex
+	last   uint64
+	chunks []Chunk
+	size   int
+}
+
+// New creates a log keeping up to limit bytes of output per session (0 for
+// the default).
+func New(limit int) *Log {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	return &Log{limit: limit, streams: make(map[string]*stream)}
+}
+
+func (l *Log) stream(processID string) *stream {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.streams[processID]
+	if !ok {
+		s = &stream{}
+		l.streams[processID] = s
+	}
+	return s
+}
+
+// Write numbers a session's next output, keeps it and passes it to send.
+// Sequence numbers start at 1.
+func (l *Log) Write(processID string, data []byte, send func(Chunk)) {
+	s := l.stream(processID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last++
+	chunk := Chunk{Seq: s.last, Data: data}
+	s.chunks = append(s.chunks, chunk)
+	s.size += len(data)
+	for s.size > l.limit && len(s.chunks) > 1 {
+		s.size -= len(s.chunks[0].Data)
+		s.chunks[0] = Chunk{}
+		s.chunks = s.chunks[1:]
+	}
+	send(chunk)
+}
+
+// Resync brings a server that is missing a session's output from seq on up
+// to date. If all of it is still kept it is passed to send again, in
+// order; otherwise snapshot is called with the kept output and the last
+// sequence number, and must send something that stands on its own. The
+// session's new output waits meanwhile. It returns false if the session
+// has no output.
+func (l *Log) Resync(processID string, seq uint64, send func(Chunk), snapshot func(kept []Chunk, last uint64)) bool {
+	l.mu.Lock()
+	s, ok := l.streams[processID]
+	l.mu.Unlock()
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case seq > s.last:
+		// Nothing is missing
+	case s.chunks[0].Seq > seq:
+		snapshot(s.chunks, s.last)
+	default:
+		for _, chunk := range s.chunks[seq-s.chunks[0].Seq:] {
+			send(chunk)
+		}
+	}
+	return true
+}
+
+// Last returns the sequence number of a session's last output, 0 if it
+// had none.
+func (l *Log) Last(processID string) uint64 {
+	l.mu.Lock()
+	s, ok := l.streams[processID]
+	l.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Recent returns the output kept of a session, oldest first; nil if it had
+// none.
+func (l *Log) Recent(processID string) []byte {
+	l.mu.Lock()
+	s, ok := l.streams[processID]
+	l.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]byte, 0, s.size)
+	for _, chunk := range s.chunks {
+		out = append(out, chunk.Data...)
+	}
+	return out
+}
+
+// Forget drops a session's output.
+func (l *Log) Forget(processID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.streams, processID)
+}
@@ -0,0 +1,463 @@
+// Package qr encodes short texts, such as pairing URLs, as QR codes
+// (ISO/IEC 18004) for printing on a terminal. It supports byte mode at
+// error correction level M in versions 1 to 10, up to 213 bytes.
+package qr
+
+import (
+	"errors"
+	"strings"
+)
+
+// Code is an encoded QR code: Modules[y][x] is true for a dark module.
+type Code struct {
+	Size    int
+	Modules [][]bool
+}
+
+// version describes the codeword layout of a version at level M.
+type version struct {
+	// ecPerBlock is the error correction codewords in every block
+	ecPerBlock int
+	// blocks are the data codewords of each block
+	blocks []int
+	// align are the alignment pattern centers
+	align []int
+}
+
+var versions = [...]version{
+	1:  {10, []int{16}, nil},
+	2:  {16, []int{28}, []int{6, 18}},
+	3:  {26, []int{44}, []int{6, 22}},
+	4:  {18, []int{32, 32}, []int{6, 26}},
+	5:  {24, []int{43, 43}, []int{6, 30}},
+	6:  {16, []int{27, 27, 27, 27}, []int{6, 34}},
+	7:  {18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	8:  {22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	9:  {22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	10: {26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// levelM is level M's format bits
+const levelM = 0
+
+// ErrTooLong is returned for a text no supported version can hold.
+var ErrTooLong = errors.New("qr: text too long")
+
+// Encode encodes text in the smallest version that holds it.
+func Encode(text string) (*Code, error) {
+	for v := 1; v < len(versions); v++ {
+		capacity := 0
+		for _, n := range versions[v].blocks {
+			capacity += n
+		}
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) > 8*capacity {
+			continue
+		}
+		return encode(v, capacity, countBits, []byte(text)), nil
+	}
+	return nil, ErrTooLong
+}
+
+func encode(v, capacity, countBits int, data []byte) *Code {
+	// Byte mode segment, terminator and padding
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	bits.append(len(data), countBits)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, 8*capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	codewords := bits.bytes()
+	for pad := 0xEC; len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, byte(pad))
+	}
+
+	c := newCode(v)
+	c.place(interleave(versions[v], codewords))
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return &Code{Size: c.size, Modules: c.modules}
+}
+
+// interleave splits codewords into blocks, adds each block's error
+// correction, and interleaves them.
+func interleave(ver version, codewords []byte) []byte {
+	divisor := rsDivisor(ver.ecPerBlock)
+	var data, ec [][]byte
+	for _, n := range ver.blocks {
+		block := codewords[:n]
+		codewords = codewords[n:]
+		data = append(data, block)
+		ec = append(ec, rsRemainder(block, divisor))
+	}
+	var out []byte
+	for i := 0; i < ver.blocks[len(ver.blocks)-1]; i++ {
+		for _, block := range data {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := range ver.ecPerBlock {
+		for _, block := range ec {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// code is a symbol being built; function marks the modules that aren't
+// data.
+type code struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func newCode(v int) *code {
+	size := 17 + 4*v
+	c := &code{version: v, size: size}
+	c.modules = make([][]bool, size)
+	c.function = make([][]bool, size)
+	for y := range size {
+		c.modules[y] = make([]bool, size)
+		c.function[y] = make([]bool, size)
+	}
+
+	// Timing patterns
+	for i := range size {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	// Finder patterns with their separators
+	for _, at := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := at[0]+dx, at[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				c.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+	// Alignment patterns, except where they'd overlap the finders
+	align := versions[v].align
+	for i, ay := range align {
+		for j, ax := range align {
+			if i == 0 && j == 0 || i == 0 && j == len(align)-1 || i == len(align)-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(ax+dx, ay+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format areas; drawFormat fills them in
+	c.drawFormat(0)
+	// Version information
+	if v >= 7 {
+		rem := v
+		for range 12 {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := v<<12 | rem
+		for i := range 18 {
+			dark := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			c.set(a, b, dark)
+			c.set(b, a, dark)
+		}
+	}
+	return c
+}
+
+// set sets a function module.
+func (c *code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// drawFormat draws both copies of the format information for mask.
+func (c *code) drawFormat(mask int) {
+	data := levelM<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := range 6 {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := range 8 {
+		c.set(c.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.size-15+i, bit(i))
+	}
+	// The dark module
+	c.set(8, c.size-8, true)
+}
+
+// place fills the data modules with codewords, in two-column zigzags from
+// the bottom right.
+func (c *code) place(codewords []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := range c.size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert
+				}
+				if c.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules mask selects; applying it again
+// undoes it.
+func (c *code) applyMask(mask int) {
+	for y := range c.size {
+		for x := range c.size {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to scan; the mask with the lowest
+// score is used.
+func (c *code) penalty() int {
+	score := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return c.modules[x][y]
+		}
+		return c.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, transpose := range []bool{false, true} {
+		for y := range c.size {
+			// Runs of five or more modules of one color
+			run := 1
+			for x := 1; x < c.size; x++ {
+				if at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				score += run - 2
+			}
+			// Finder-like patterns with four light modules on a side
+			for x := 0; x+7 <= c.size; x++ {
+				match := true
+				for k, dark := range finderLike {
+					if at(x+k, y, transpose) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (c.light(x-4, x, y, transpose) || c.light(x+7, x+11, y, transpose)) {
+					score += 40
+				}
+			}
+		}
+	}
+	// 2x2 blocks of one color
+	dark := 0
+	for y := range c.size {
+		for x := range c.size {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				m := c.modules[y][x]
+				if c.modules[y-1][x] == m && c.modules[y][x-1] == m && c.modules[y-1][x-1] == m {
+					score += 3
+				}
+			}
+		}
+	}
+	// Balance of dark and light
+	total := c.size * c.size
+	score += 10 * (abs(dark*20-total*10) / total)
+	return score
+}
+
+// light reports whether the modules from x0 to x1 (exclusive) on row y are
+// light, counting those outside the symbol as light.
+func (c *code) light(x0, x1, y int, transpose bool) bool {
+	for x := x0; x < x1; x++ {
+		if x < 0 || x >= c.size {
+			continue
+		}
+		m := c.modules[y][x]
+		if transpose {
+			m = c.modules[x][y]
+		}
+		if m {
+			return false
+		}
+	}
+	return true
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of degree n,
+// highest coefficient (always 1) omitted.
+func rsDivisor(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+	root := byte(1)
+	for range n {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords for data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// quietZone is the light border around a printed code, in modules.
+const quietZone = 4
+
+// Terminal renders the code with half-block characters, two module rows
+// per line, in black on white so it scans on dark terminals too.
+func (c *Code) Terminal() string {
+	dark := func(x, y int) bool {
+		x, y = x-quietZone, y-quietZone
+		return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.Modules[y][x]
+	}
+	var b strings.Builder
+	width := c.Size + 2*quietZone
+	for y := 0; y < width; y += 2 {
+		b.WriteString("\x1b[30;47m")
+		for x := range width {
+			top, bottom := dark(x, y), dark(x, y+1) && y+1 < width
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,332 @@
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// formatBits are level M's format information for each mask, from the
+// standard's table.
+var formatBits = [8]int{
+	0b101010000010010,
+	0b101000100100101,
+	0b101111001111100,
+	0b101101101001011,
+	0b100010111111001,
+	0b100000011001110,
+	0b100111110010111,
+	0b100101010100000,
+}
+
+// versionBits are the version information of versions 7 to 10, from the
+// standard's table.
+var versionBits = map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+
+// masks are the data mask conditions, from the standard.
+var masks = [8]func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%2 == 0 },
+	func(x, y int) bool { return y%2 == 0 },
+	func(x, y int) bool { return x%3 == 0 },
+	func(x, y int) bool { return (x+y)%3 == 0 },
+	func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+	func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+	func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+	func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+}
+
+func TestEncodeCapacity(t *testing.T) {
+	// The most bytes each version holds at level M
+	capacity := []int{1: 14, 26, 42, 62, 84, 106, 122, 152, 180, 213}
+	for v := 1; v < len(capacity); v++ {
+		for _, n := range []int{capacity[v-1] + 1, capacity[v]} {
+			if n == 1 && v > 1 {
+				continue
+			}
+			c, err := Encode(strings.Repeat("a", n))
+			if err != nil {
+				t.Fatalf("Encode of %d bytes: %v", n, err)
+			}
+			if want := 17 + 4*v; c.Size != want || len(c.Modules) != want {
+				t.Errorf("%d bytes encoded in a %d module code, want version %d's %d", n, c.Size, v, want)
+			}
+		}
+	}
+	if _, err := Encode(strings.Repeat("a", capacity[10]+1)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Encode of %d bytes: error = %v, want %v", capacity[10]+1, err, ErrTooLong)
+	}
+}
+
+func TestEncodeDecodes(t *testing.T) {
+	texts := []string{
+		"",
+		"a",
+		"https://agenthq.example/pair?code=ABC123&host=my-laptop",
+		"héllo, 世界",
+		strings.Repeat("0123456789", 10),
+		strings.Repeat("x", 122),
+		strings.Repeat("y", 123),
+		strings.Repeat("z", 213),
+	}
+	for _, text := range texts {
+		t.Run(fmt.Sprintf("%.20q", text), func(t *testing.T) {
+			c, err := Encode(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := (c.Size - 17) / 4
+			checkFunctionPatterns(t, c)
+			mask := readFormat(t, c)
+			if v >= 7 {
+				checkVersion(t, c, v)
+			}
+			if mask < 0 {
+				return
+			}
+			if got := decode(t, c, v, mask); got != text {
+				t.Errorf("decoded %q", got)
+			}
+		})
+	}
+}
+
+// checkFunctionPatterns checks the finder and timing patterns.
+func checkFunctionPatterns(t *testing.T, c *Code) {
+	t.Helper()
+	for _, at := range [][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+		for dy := range 7 {
+			for dx := range 7 {
+				ring := max(abs(dx-3), abs(dy-3))
+				if want := ring != 2; c.Modules[at[1]+dy][at[0]+dx] != want {
+					t.Fatalf("finder at %v wrong at %d,%d", at, dx, dy)
+				}
+			}
+		}
+	}
+	for i := 8; i < c.Size-8; i++ {
+		if c.Modules[6][i] != (i%2 == 0) || c.Modules[i][6] != (i%2 == 0) {
+			t.Fatalf("timing patterns wrong at %d", i)
+		}
+	}
+	if !c.Modules[c.Size-8][8] {
+		t.Error("dark module is light")
+	}
+}
+
+// readFormat returns the mask both copies of the format information name,
+// or -1 if they don't.
+func readFormat(t *testing.T, c *Code) int {
+	t.Helper()
+	bit := func(x, y int) int {
+		if c.Modules[y][x] {
+			return 1
+		}
+		return 0
+	}
+	// Bit i of the first copy is at first[i], of the second at second[i]
+	var first, second [15][2]int
+	for i := range 6 {
+		first[i] = [2]int{8, i}
+	}
+	first[6], first[7], first[8] = [2]int{8, 7}, [2]int{8, 8}, [2]int{7, 8}
+	for i := 9; i < 15; i++ {
+		first[i] = [2]int{14 - i, 8}
+	}
+	for i := range 8 {
+		second[i] = [2]int{c.Size - 1 - i, 8}
+	}
+	for i := 8; i < 15; i++ {
+		second[i] = [2]int{8, c.Size - 15 + i}
+	}
+	var a, b int
+	for i := range 15 {
+		a |= bit(first[i][0], first[i][1]) << i
+		b |= bit(second[i][0], second[i][1]) << i
+	}
+	if a != b {
+		t.Errorf("format information copies differ: %015b and %015b", a, b)
+		return -1
+	}
+	for mask, bits := range formatBits {
+		if bits == a {
+			return mask
+		}
+	}
+	t.Errorf("format information %015b isn't level M's", a)
+	return -1
+}
+
+// checkVersion checks both copies of the version information.
+func checkVersion(t *testing.T, c *Code, v int) {
+	t.Helper()
+	var a, b int
+	for i := range 18 {
+		x, y := c.Size-11+i%3, i/3
+		if c.Modules[y][x] {
+			a |= 1 << i
+		}
+		if c.Modules[x][y] {
+			b |= 1 << i
+		}
+	}
+	if a != versionBits[v] || b != versionBits[v] {
+		t.Errorf("version information %018b and %018b, want %018b", a, b, versionBits[v])
+	}
+}
+
+// decode reads the text back out of c the way a reader would.
+func decode(t *testing.T, c *Code, v, mask int) string {
+	t.Helper()
+	function := newCode(v).function
+
+	// Read the modules in two-column zigzags from the bottom right,
+	// skipping the vertical timing pattern
+	var bits []bool
+	upward := true
+	for right := c.Size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for i := range c.Size {
+			y := i
+			if upward {
+				y = c.Size - 1 - i
+			}
+			for _, x := range []int{right, right - 1} {
+				if !function[y][x] {
+					bits = append(bits, c.Modules[y][x] != masks[mask](x, y))
+				}
+			}
+		}
+		upward = !upward
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i := range codewords {
+		for _, bit := range bits[8*i : 8*i+8] {
+			codewords[i] <<= 1
+			if bit {
+				codewords[i] |= 1
+			}
+		}
+	}
+
+	// Deinterleave, checking each block's error correction
+	ver := versions[v]
+	blocks := make([][]byte, len(ver.blocks))
+	i := 0
+	for col := 0; col < ver.blocks[len(ver.blocks)-1]; col++ {
+		for b, n := range ver.blocks {
+			if col < n {
+				blocks[b] = append(blocks[b], codewords[i])
+				i++
+			}
+		}
+	}
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, block...)
+	}
+	for range ver.ecPerBlock {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[i])
+			i++
+		}
+	}
+	for b, block := range blocks {
+		if !syndromesZero(block, ver.ecPerBlock) {
+			t.Errorf("block %d fails its error correction", b)
+		}
+	}
+
+	// A byte mode segment
+	read := func(pos, n int) int {
+		value := 0
+		for i := pos; i < pos+n; i++ {
+			value = value<<1 | int(data[i/8]>>(7-i%8)&1)
+		}
+		return value
+	}
+	if mode := read(0, 4); mode != 0b0100 {
+		t.Fatalf("mode %04b, want byte mode", mode)
+	}
+	countBits := 8
+	if v >= 10 {
+		countBits = 16
+	}
+	n := read(4, countBits)
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(read(4+countBits+8*i, 8))
+	}
+	return string(out)
+}
+
+// syndromesZero reports whether block, data then ec error correction
+// codewords, is a Reed-Solomon codeword: it has the generator's roots 2^0
+// to 2^(ec-1) as roots too.
+func syndromesZero(block []byte, ec int) bool {
+	var exp [255]int
+	x := 1
+	for i := range exp {
+		exp[i] = x
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	mul := func(a, b int) int {
+		p := 0
+		for ; b > 0; b >>= 1 {
+			if b&1 != 0 {
+				p ^= a
+			}
+			a <<= 1
+			if a&0x100 != 0 {
+				a ^= 0x11D
+			}
+		}
+		return p
+	}
+	for i := range ec {
+		s := 0
+		for _, b := range block {
+			s = mul(s, exp[i]) ^ int(b)
+		}
+		if s != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTerminal(t *testing.T) {
+	c, err := Encode("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	width := c.Size + 2*quietZone
+	if len(lines) != (width+1)/2 {
+		t.Errorf("%d lines, want %d", len(lines), (width+1)/2)
+	}
+	// Each character is two modules, the top one then the bottom one
+	halves := map[rune][2]bool{' ': {false, false}, '▀': {true, false}, '▄': {false, true}, '█': {true, true}}
+	dark := func(x, y int) bool {
+		x, y = x-quietZone, y-quietZone
+		return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.Modules[y][x]
+	}
+	for i, line := range lines {
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "\x1b[30;47m"), "\x1b[0m")
+		row := []rune(line)
+		if len(row) != width {
+			t.Fatalf("line %d is %d wide, want %d", i, len(row), width)
+		}
+		for x, r := range row {
+			half, ok := halves[r]
+			if !ok || half[0] != dark(x, 2*i) || half[1] != dark(x, 2*i+1) {
+				t.Fatalf("line %d column %d is %q, want modules %v and %v", i, x, r, dark(x, 2*i), dark(x, 2*i+1))
+			}
+		}
+	}
+}
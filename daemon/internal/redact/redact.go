@@ -0,0 +1,256 @@
+// Package redact masks secrets in session output before it leaves the
+// daemon.
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mask replaces every redacted secret.
+const Mask = "[REDACTED]"
+
+// MinValueLength is the shortest secret value that is masked; shorter ones
+// would mask ordinary output.
+const MinValueLength = 6
+
+// Builtin are patterns for common credentials.
+var Builtin = []string{
+	`sk-ant-[A-Za-z0-9_-]{20,}`,       // Anthropic
+	`sk-(?:proj-)?[A-Za-z0-9_-]{20,}`, // OpenAI
+	`(?:AKIA|ASIA)[0-9A-Z]{16}`,       // AWS access key ID
+	`gh[pousr]_[A-Za-z0-9]{36,}`,      // GitHub token
+	`github_pat_[A-Za-z0-9_]{22,}`,    // GitHub fine-grained token
+	`xox[abposr]-[A-Za-z0-9-]{10,}`,   // Slack token
+	`AIza[0-9A-Za-z_-]{35}`,           // Google API key
+	privateKey,                        // PEM private key
+	`eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`, // JWT
+}
+
+// privateKey matches a PEM private key, header to footer.
+const privateKey = `(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`
+
+var (
+	// keyHeader and keyFooter match the lines around a PEM private key
+	keyHeader = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	keyFooter = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+)
+
+// maxKey bounds the output a Stream drops after a private key's header
+// while waiting for its footer; a key isn't longer.
+const maxKey = 16 << 10
+
+// secretName matches names of environment variables that usually hold
+// secrets.
+var secretName = regexp.MustCompile(`(?i)TOKEN|SECRET|PASSW|PASSPHRASE|CREDENTIAL|PRIVATE|COOKIE|(^|_)(API_?)?KEY(_|$)|DSN|DATABASE_URL`)
+
+// builtin masks Builtin patterns.
+var builtin = must(New(Builtin, nil))
+
+func must(r *Redactor, err error) *Redactor {
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Env returns a copy of env (KEY=value pairs) with secrets masked: the
+// values of variables whose names suggest secrets, and matches of Builtin
+// patterns in the others.
+func Env(env []string) []string {
+	masked := make([]string, len(env))
+	for i, kv := range env {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			masked[i] = kv
+			continue
+		}
+		masked[i] = key + "=" + Value(key, value)
+	}
+	return masked
+}
+
+// Value returns a named value, such as a variable or setting, with secrets
+// masked as Env masks them.
+func Value(name, value string) string {
+	if secretName.MatchString(name) && value != "" {
+		return Mask
+	}
+	return string(builtin.Redact([]byte(value)))
+}
+
+// Redactor masks matches of its patterns and occurrences of its secret
+// values.
+type Redactor struct {
+	patterns []*regexp.Regexp
+	// keys is set if private keys are masked
+	keys bool
+	// values are sorted longest first so a value containing another is
+	// masked whole
+	values [][]byte
+}
+
+// New compiles patterns and returns a Redactor for them and values.
+// Values shorter than MinValueLength are ignored.
+func New(patterns, values []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+		r.keys = r.keys || p == privateKey
+	}
+	for _, v := range values {
+		if len(v) >= MinValueLength {
+			r.values = append(r.values, []byte(v))
+		}
+	}
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+	return r, nil
+}
+
+// Redact returns data with secrets masked. A private key cut off before
+// its footer is masked to the end of data.
+func (r *Redactor) Redact(data []byte) []byte {
+	for _, v := range r.values {
+		if bytes.Contains(data, v) {
+			data = bytes.ReplaceAll(data, v, []byte(Mask))
+		}
+	}
+	for _, re := range r.patterns {
+		data = re.ReplaceAllLiteral(data, []byte(Mask))
+	}
+	if r.keys {
+		if i := openKey(data); i >= 0 {
+			data = append(data[:i:i], Mask...)
+		}
+	}
+	return data
+}
+
+// openKey returns where the private key in data that has no footer starts,
+// or -1 if there is none.
+func openKey(data []byte) int {
+	headers := keyHeader.FindAllIndex(data, -1)
+	if len(headers) == 0 {
+		return -1
+	}
+	last := headers[len(headers)-1]
+	if keyFooter.Match(data[last[1]:]) {
+		return -1
+	}
+	return last[0]
+}
+
+// maxHold bounds how much output a Stream holds back.
+const maxHold = 256
+
+// flushDelay is how long held-back output waits for the next chunk.
+const flushDelay = 20 * time.Millisecond
+
+// Stream redacts one session's output, which arrives in arbitrary chunks.
+// A chunk's tail that may be the start of a secret is held back until the
+// next chunk arrives, or briefly, so a secret split across chunks is still
+// masked. The output after a private key's header is dropped until its
+// footer, however many chunks the key spans.
+type Stream struct {
+	r    *Redactor
+	emit func([]byte)
+
+	mu      sync.Mutex
+	pending []byte
+	timer   *time.Timer
+	// inKey counts the output dropped since a private key's header, -1
+	// outside a key
+	inKey int
+}
+
+// NewStream returns a Stream that passes redacted output to emit.
+func (r *Redactor) NewStream(emit func([]byte)) *Stream {
+	return &Stream{r: r, emit: emit, inKey: -1}
+}
+
+// Write redacts data and emits all of it except a held-back tail.
+func (s *Stream) Write(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	buf := append(s.pending, data...)
+	if s.inKey >= 0 {
+		loc := keyFooter.FindIndex(buf)
+		if loc == nil && s.inKey+len(buf) <= maxKey {
+			// Keep what may be the start of the footer
+			keep := min(len(buf), maxHold)
+			s.inKey += len(buf) - keep
+			s.pending = append([]byte(nil), buf[len(buf)-keep:]...)
+			return
+		}
+		if loc != nil {
+			buf = buf[loc[1]:]
+		} else if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			// Too long for a key: drop it to the end of its last line
+			buf = buf[i+1:]
+		} else {
+			buf = nil
+		}
+		s.inKey = -1
+	}
+	hold := s.r.holdLen(buf)
+	out := buf[:len(buf)-hold]
+	s.pending = append([]byte(nil), buf[len(buf)-hold:]...)
+
+	if len(out) > 0 {
+		if s.r.keys && openKey(out) >= 0 {
+			s.inKey = 0
+		}
+		s.emit(s.r.Redact(out))
+	}
+	if len(s.pending) > 0 {
+		s.timer = time.AfterFunc(flushDelay, s.Flush)
+	}
+}
+
+// Flush emits any held-back output.
+func (s *Stream) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.pending) > 0 && s.inKey < 0 {
+		s.emit(s.r.Redact(s.pending))
+	}
+	s.pending = nil
+}
+
+// holdLen returns how much of buf's end may be an incomplete secret: the
+// unfinished last line, which a pattern may go on matching, or the longest
+// suffix that begins a secret value, whichever is longer.
+func (r *Redactor) holdLen(buf []byte) int {
+	n := 0
+	if len(r.patterns) > 0 {
+		n = len(buf) - bytes.LastIndexByte(buf, '\n') - 1
+		n = min(n, maxHold)
+	}
+	for _, v := range r.values {
+		for k := min(len(v)-1, len(buf), maxHold); k > n; k-- {
+			if bytes.HasSuffix(buf, v[:k]) {
+				n = k
+				break
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,230 @@
+package repoconfig
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Package is a subproject of a monorepo.
+type Package struct {
+	Name string
+	// Dir is the package directory relative to the repo root.
+	Dir string
+}
+
+// Packages lists the packages of the repo checked out at root: those named
+// in .agenthq.yml, then those declared by package.json workspaces,
+// pnpm-workspace.yaml and go.work. The first package found for a directory
+// wins.
+func (c *Config) Packages(root string) []Package {
+	var packages []Package
+	seen := make(map[string]bool)
+	add := func(p Package) {
+		if !seen[p.Dir] {
+			seen[p.Dir] = true
+			packages = append(packages, p)
+		}
+	}
+
+	names := make([]string, 0, len(c.PackageDirs))
+	for name := range c.PackageDirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(Package{Name: name, Dir: filepath.Clean(c.PackageDirs[name])})
+	}
+
+	for _, dir := range expandGlobs(root, npmWorkspaces(root)) {
+		add(Package{Name: npmPackageName(root, dir), Dir: dir})
+	}
+	for _, dir := range goWorkModules(root) {
+		add(Package{Name: goModuleName(root, dir), Dir: dir})
+	}
+	return packages
+}
+
+// FindPackage resolves a package by name, by directory, or by the last
+// element of its directory if that is unambiguous.
+func (c *Config) FindPackage(root, name string) (Package, error) {
+	packages := c.Packages(root)
+	for _, p := range packages {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	for _, p := range packages {
+		if p.Dir == filepath.Clean(name) {
+			return p, nil
+		}
+	}
+
+	var matches []Package
+	for _, p := range packages {
+		if filepath.Base(p.Dir) == name {
+			matches = append(matches, p)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Package{}, fmt.Errorf("unknown package %q", name)
+	case 1:
+		return matches[0], nil
+	}
+	return Package{}, fmt.Errorf("ambiguous package %q: %s and %s", name, matches[0].Dir, matches[1].Dir)
+}
+
+// npmWorkspaces returns the workspace globs from package.json and
+// pnpm-workspace.yaml.
+func npmWorkspaces(root string) []string {
+	var globs []string
+
+	if data, err := os.ReadFile(filepath.Join(root, "package.json")); err == nil {
+		var pkg struct {
+			Workspaces json.RawMessage `json:"workspaces"`
+		}
+		if json.Unmarshal(data, &pkg) == nil && pkg.Workspaces != nil {
+			// Either a list of globs or { "packages": [...] } (yarn)
+			var list []string
+			var object struct {
+				Packages []string `json:"packages"`
+			}
+			if json.Unmarshal(pkg.Workspaces, &list) == nil {
+				globs = append(globs, list...)
+			} else if json.Unmarshal(pkg.Workspaces, &object) == nil {
+				globs = append(globs, object.Packages...)
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "pnpm-workspace.yaml")); err == nil {
+		var workspace struct {
+			Packages []string `yaml:"packages"`
+		}
+		if yaml.Unmarshal(data, &workspace) == nil {
+			globs = append(globs, workspace.Packages...)
+		}
+	}
+
+	return globs
+}
+
+// expandGlobs returns the directories matching workspace globs that contain
+// a package.json, relative to root. Exclusions ("!glob") are honored.
+func expandGlobs(root string, globs []string) []string {
+	excluded := make(map[string]bool)
+	for _, glob := range globs {
+		if rest, ok := strings.CutPrefix(glob, "!"); ok {
+			for _, dir := range matchDirs(root, rest) {
+				excluded[dir] = true
+			}
+		}
+	}
+
+	var dirs []string
+	for _, glob := range globs {
+		if strings.HasPrefix(glob, "!") {
+			continue
+		}
+		for _, dir := range matchDirs(root, glob) {
+			if excluded[dir] {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(root, dir, "package.json")); err == nil {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// matchDirs matches one glob against root. "**" is treated like "*".
+func matchDirs(root, glob string) []string {
+	glob = strings.ReplaceAll(strings.TrimSuffix(glob, "/"), "**", "*")
+	if !filepath.IsLocal(glob) {
+		return nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(root, glob))
+
+	var dirs []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			if rel, err := filepath.Rel(root, match); err == nil {
+				dirs = append(dirs, rel)
+			}
+		}
+	}
+	return dirs
+}
+
+// npmPackageName returns the name in dir's package.json, or the directory
+// name.
+func npmPackageName(root, dir string) string {
+	var pkg struct {
+		Name string `json:"name"`
+	}
+	if data, err := os.ReadFile(filepath.Join(root, dir, "package.json")); err == nil {
+		json.Unmarshal(data, &pkg)
+	}
+	if pkg.Name != "" {
+		return pkg.Name
+	}
+	return filepath.Base(dir)
+}
+
+// goWorkModules returns the module directories listed by go.work's use
+// directives, relative to root.
+func goWorkModules(root string) []string {
+	f, err := os.Open(filepath.Join(root, "go.work"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var dirs []string
+	inBlock := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "//")
+		line = strings.TrimSpace(line)
+
+		var dir string
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+		case inBlock:
+			dir = line
+		case line == "use (":
+			inBlock = true
+		case strings.HasPrefix(line, "use "):
+			dir = strings.TrimSpace(strings.TrimPrefix(line, "use "))
+		}
+
+		dir = filepath.Clean(strings.Trim(dir, `"`))
+		if dir != "." && filepath.IsLocal(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// goModuleName returns the module path in dir's go.mod, or the directory
+// name.
+func goModuleName(root, dir string) string {
+	data, err := os.ReadFile(filepath.Join(root, dir, "go.mod"))
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "module "); ok {
+				return strings.Trim(strings.TrimSpace(rest), `"`)
+			}
+		}
+	}
+	return filepath.Base(dir)
+}
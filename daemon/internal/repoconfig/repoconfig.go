@@ -0,0 +1,239 @@
+// Package repoconfig loads the per-repo .agenthq.yml file, which tells the
+// daemon how to prepare worktrees of the repo and how to work in them.
+package repoconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/agenthq/daemon/internal/artifacts"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// FileName is the config file at the root of a repo.
+const FileName = ".agenthq.yml"
+
+// Config is a repo's .agenthq.yml. Every field is optional.
+type Config struct {
+	// Setup commands run, in order, in every new worktree (e.g. "npm ci").
+	Setup []string `yaml:"setup"`
+	// EnvFiles are copied from the repo into new worktrees, since they are
+	// usually git-ignored (e.g. ".env.local").
+	EnvFiles []string `yaml:"envFiles"`
+	// SparsePaths limits new worktrees to these directories (cone mode
+	// sparse checkout).
+	SparsePaths []string `yaml:"sparsePaths"`
+	// DefaultAgent is the agent to use when a task doesn't pick one.
+	DefaultAgent protocol.AgentType `yaml:"defaultAgent"`
+	// Image is the container image sessions run in on the docker backend,
+	// so the repo's toolchain comes with it.
+	Image string `yaml:"image"`
+	// Test is the command that runs the repo's tests (run-tests), from
+	// the worktree or package directory.
+	Test string `yaml:"test"`
+	// TestReport is a report file the test command writes (e.g. junit
+	// XML), relative to where it runs; otherwise its stdout is parsed.
+	TestReport string `yaml:"testReport"`
+	// Coverage is the coverage report the test command writes, relative to
+	// where it runs. If unset, well-known report files are looked for.
+	Coverage string `yaml:"coverage"`
+	// Lint is the command that lints or format-checks the repo
+	// (run-linter), from the worktree or package directory. Diagnostics
+	// are parsed from its stdout (eslint or golangci-lint JSON).
+	Lint string `yaml:"lint"`
+	// Artifacts are globs (relative, slash-separated; "**" matches any
+	// number of directories) of files sent to the server after a session
+	// and its verification, e.g. "dist/**".
+	Artifacts []string `yaml:"artifacts"`
+	// Verify is the pipeline run in a worktree after an agent session there
+	// exits successfully.
+	Verify []Step `yaml:"verify"`
+	// PackageDirs names monorepo packages (name to directory) in addition
+	// to those found in workspace files; see Packages.
+	PackageDirs map[string]string `yaml:"packages"`
+	// Dotenv, if set, loads env files from the worktree into the
+	// environment of sessions spawned there.
+	Dotenv *Dotenv `yaml:"dotenv"`
+	// Hooks are git hooks (hook name to shell command) installed in new
+	// worktrees only, e.g. a pre-push check that blocks protected
+	// branches.
+	Hooks map[string]string `yaml:"hooks"`
+	// ProtectedPaths are files and directories the daemon never writes in
+	// the repo's worktrees and reports when a session changed them, in
+	// addition to the daemon's own.
+	ProtectedPaths []string `yaml:"protectedPaths"`
+	// SensitivePaths are categories (name to globs) of files whose changes
+	// are flagged in a session's summary, over the daemon's; a category
+	// with no globs turns one off. See internal/sensitive.
+	SensitivePaths map[string][]string `yaml:"sensitivePaths"`
+	// MaxSessions caps the repo's sessions running at once; further spawns
+	// wait. 0 is no cap.
+	MaxSessions int `yaml:"maxSessions"`
+	// Weight is the repo's share of the daemon's sessions when spawns of
+	// several repos wait for them (default 1): a repo of weight 2 gets
+	// twice the sessions of one of weight 1.
+	Weight int `yaml:"weight"`
+}
+
+// DefaultDotenvFiles are read when dotenv names no files.
+var DefaultDotenvFiles = []string{".env", ".env.local"}
+
+// Dotenv configures loading env files into sessions.
+type Dotenv struct {
+	// Files are read in order from the worktree root, later ones
+	// overriding earlier ones; missing files are skipped.
+	Files []string `yaml:"files"`
+	// Exclude are globs of keys (e.g. "AWS_*") only sessions on the docker
+	// backend get; others run outside a sandbox.
+	Exclude []string `yaml:"exclude"`
+}
+
+// Step is a verification pipeline step: a command, or the repo's test
+// command with its results parsed.
+type Step struct {
+	Name  string `yaml:"name"`
+	Run   string `yaml:"run"`
+	Tests bool   `yaml:"tests"`
+}
+
+// Load reads repoPath's .agenthq.yml. A missing file yields an empty config.
+func Load(repoPath string) (*Config, error) {
+	cfg := &Config{}
+
+	data, err := os.ReadFile(filepath.Join(repoPath, FileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", FileName, err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", FileName, err)
+	}
+
+	for i, cmd := range cfg.Setup {
+		if strings.TrimSpace(cmd) == "" {
+			return nil, fmt.Errorf("%s: setup[%d] is empty", FileName, i)
+		}
+	}
+	for i, step := range cfg.Verify {
+		if step.Name == "" {
+			return nil, fmt.Errorf("%s: verify[%d]: name is required", FileName, i)
+		}
+		if (step.Run == "") == !step.Tests {
+			return nil, fmt.Errorf("%s: verify[%d]: exactly one of run and tests is required", FileName, i)
+		}
+		if step.Tests && cfg.Test == "" {
+			return nil, fmt.Errorf("%s: verify[%d]: tests needs a test command", FileName, i)
+		}
+	}
+
+	if cfg.MaxSessions < 0 {
+		return nil, fmt.Errorf("%s: maxSessions must not be negative", FileName)
+	}
+	if cfg.Weight < 0 {
+		return nil, fmt.Errorf("%s: weight must not be negative", FileName)
+	}
+
+	for name, command := range cfg.Hooks {
+		if !worktree.ValidHookName(name) {
+			return nil, fmt.Errorf("%s: hooks: unknown git hook %q", FileName, name)
+		}
+		if strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("%s: hooks: %s is empty", FileName, name)
+		}
+	}
+
+	for _, pattern := range cfg.Artifacts {
+		if !artifacts.ValidPattern(pattern) {
+			return nil, fmt.Errorf("%s: invalid artifact glob %q", FileName, pattern)
+		}
+	}
+	for category, globs := range cfg.SensitivePaths {
+		if category == "" {
+			return nil, fmt.Errorf("%s: sensitivePaths: category name is required", FileName)
+		}
+		for _, pattern := range globs {
+			if !artifacts.ValidPattern(pattern) {
+				return nil, fmt.Errorf("%s: sensitivePaths.%s: invalid glob %q", FileName, category, pattern)
+			}
+		}
+	}
+
+	if cfg.Dotenv != nil {
+		if len(cfg.Dotenv.Files) == 0 {
+			cfg.Dotenv.Files = DefaultDotenvFiles
+		}
+		for _, pattern := range cfg.Dotenv.Exclude {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: dotenv: invalid exclude glob %q", FileName, pattern)
+			}
+		}
+	}
+
+	paths := slices.Concat(cfg.EnvFiles, cfg.SparsePaths, cfg.ProtectedPaths)
+	if cfg.Dotenv != nil {
+		paths = append(paths, cfg.Dotenv.Files...)
+	}
+	for _, path := range []string{cfg.TestReport, cfg.Coverage} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	for _, dir := range cfg.PackageDirs {
+		paths = append(paths, dir)
+	}
+	for _, path := range paths {
+		if !local(path) {
+			return nil, fmt.Errorf("%s: %q must be a relative path inside the repo", FileName, path)
+		}
+	}
+
+	return cfg, nil
+}
+
+// local reports whether path is relative and stays inside the repo.
+func local(path string) bool {
+	return path != "" && filepath.IsLocal(path)
+}
+
+// Summary returns the config, with the packages of the repo at root, as
+// reported in RepoInfo.
+func (c *Config) Summary(root string) *protocol.RepoConfig {
+	summary := &protocol.RepoConfig{
+		Setup:          c.Setup,
+		EnvFiles:       c.EnvFiles,
+		SparsePaths:    c.SparsePaths,
+		DefaultAgent:   c.DefaultAgent,
+		Image:          c.Image,
+		Test:           c.Test,
+		TestReport:     c.TestReport,
+		Coverage:       c.Coverage,
+		Lint:           c.Lint,
+		Artifacts:      c.Artifacts,
+		ProtectedPaths: c.ProtectedPaths,
+		SensitivePaths: c.SensitivePaths,
+		MaxSessions:    c.MaxSessions,
+		Weight:         c.Weight,
+	}
+	for _, step := range c.Verify {
+		summary.Verify = append(summary.Verify, step.Name)
+	}
+	for name := range c.Hooks {
+		summary.Hooks = append(summary.Hooks, name)
+	}
+	slices.Sort(summary.Hooks)
+	for _, p := range c.Packages(root) {
+		summary.Packages = append(summary.Packages, protocol.PackageInfo{Name: p.Name, Dir: p.Dir})
+	}
+	return summary
+}
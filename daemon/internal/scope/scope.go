@@ -0,0 +1,145 @@
+// Package scope limits what a connection to the daemon may ask of it, so
+// access to a personal machine can be shared without handing over all of
+// it. A connection holds scopes such as "read", "spawn:claude-code" or
+// "worktree:create"; each server message type needs one of them.
+package scope
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Scope names
+const (
+	// All allows every message; with NoYolo, every message but YOLO spawns.
+	All = "*"
+	// Read allows listing repos and reading sessions' output, transcripts,
+	// info, stats and the history.
+	Read = "read"
+	// Input allows typing into sessions and resizing them.
+	Input = "input"
+	// Spawn allows spawning any agent, bash and shell included. SpawnPrefix
+	// followed by an agent type allows spawning that agent only.
+	Spawn       = "spawn"
+	SpawnPrefix = "spawn:"
+	// SpawnReadOnly allows spawning agents (not bash or shell) as read-only
+	// sessions, which run on their task and ignore input.
+	SpawnReadOnly = "spawn:read-only-agents"
+	// Manage allows killing sessions, making them read-only, grouping them
+	// and resuming them when paused over their budget.
+	Manage = "manage"
+	// WorktreeCreate and WorktreeRemove allow creating and removing
+	// worktrees; WorktreeCreate also allows fetching the repos they are
+	// created from.
+	WorktreeCreate = "worktree:create"
+	WorktreeRemove = "worktree:remove"
+	// Files allows staging files in worktrees.
+	Files = "files"
+	// Checks allows running tests and linters.
+	Checks = "checks"
+	// Compare allows compare runs, which create worktrees and spawn agents.
+	Compare = "compare"
+	// Clipboard allows using the host's clipboard, as far as the config
+	// does.
+	Clipboard = "clipboard"
+	// NoYolo refuses spawns and compare runs in YOLO mode, whatever else
+	// is allowed.
+	NoYolo = "no-yolo"
+)
+
+// required is the scope each server message type needs; spawn also takes
+// the narrower spawn scopes. Types missing here are refused to connections
+// with scopes.
+var required = map[string]string{
+	protocol.MsgTypeListRepos:          Read,
+	protocol.MsgTypeQueryPtySize:       Read,
+	protocol.MsgTypeResyncRequest:      Read,
+	protocol.MsgTypeGetAgentTranscript: Read,
+	protocol.MsgTypeGetSessionInfo:     Read,
+	protocol.MsgTypeGetSessionStats:    Read,
+	protocol.MsgTypeQueryHistory:       Read,
+	protocol.MsgTypeGetHistory:         Read,
+
+	protocol.MsgTypePtyInput:        Input,
+	protocol.MsgTypeResize:          Input,
+	protocol.MsgTypeSendMacro:       Input,
+	protocol.MsgTypeBroadcastInput:  Input,
+	protocol.MsgTypePasteImage:      Input,
+	protocol.MsgTypeAcquireInput:    Input,
+	protocol.MsgTypeReleaseInput:    Input,
+	protocol.MsgTypeAnnotateSession: Input,
+
+	protocol.MsgTypeSpawn:         Spawn,
+	protocol.MsgTypeKill:          Manage,
+	protocol.MsgTypeSetReadOnly:   Manage,
+	protocol.MsgTypeGroup:         Manage,
+	protocol.MsgTypeResumeSession: Manage,
+
+	protocol.MsgTypeCreateWorktree: WorktreeCreate,
+	protocol.MsgTypeFetchRepo:      WorktreeCreate,
+	protocol.MsgTypeRemoveWorktree: WorktreeRemove,
+	protocol.MsgTypeStageFiles:     Files,
+	protocol.MsgTypeRunTests:       Checks,
+	protocol.MsgTypeRunLinter:      Checks,
+	protocol.MsgTypeCompareRun:     Compare,
+	protocol.MsgTypeSetClipboard:   Clipboard,
+	protocol.MsgTypeGetClipboard:   Clipboard,
+}
+
+// Scopes are the scopes a connection holds. Empty allows everything.
+type Scopes []string
+
+// Valid returns an error if s isn't a known scope.
+func Valid(s string) error {
+	if agent, ok := strings.CutPrefix(s, SpawnPrefix); ok {
+		if agent == "" {
+			return fmt.Errorf("scope %q names no agent", s)
+		}
+		return nil
+	}
+	switch s {
+	case All, Read, Input, Spawn, Manage, WorktreeCreate, WorktreeRemove, Files, Checks, Compare, Clipboard, NoYolo:
+		return nil
+	}
+	return fmt.Errorf("unknown scope %q", s)
+}
+
+// Has reports whether s holds scope, or All.
+func (s Scopes) Has(scope string) bool {
+	return len(s) == 0 || slices.Contains(s, All) || slices.Contains(s, scope)
+}
+
+// Check returns why msg is out of s, or nil if it may be handled. agent is
+// the agent a spawn starts, with its profile applied.
+func (s Scopes) Check(msg protocol.ServerMessage, agent protocol.AgentType) error {
+	if len(s) == 0 {
+		return nil
+	}
+	if msg.YoloMode && slices.Contains(s, NoYolo) && (msg.Type == protocol.MsgTypeSpawn || msg.Type == protocol.MsgTypeCompareRun) {
+		return fmt.Errorf("%s in YOLO mode is out of scope (%s)", msg.Type, NoYolo)
+	}
+	scope, ok := required[msg.Type]
+	if !ok {
+		if slices.Contains(s, All) {
+			return nil
+		}
+		return fmt.Errorf("%s is out of scope", msg.Type)
+	}
+	if s.Has(scope) {
+		return nil
+	}
+	if msg.Type == protocol.MsgTypeSpawn {
+		if agent != "" && slices.Contains(s, SpawnPrefix+string(agent)) {
+			return nil
+		}
+		if msg.ReadOnly && agent != "" && agent != protocol.AgentBash && agent != protocol.AgentShell && slices.Contains(s, SpawnReadOnly) {
+			return nil
+		}
+		return fmt.Errorf("spawning %s is out of scope (needs %s or %s%s)", cmp.Or(string(agent), "an unknown agent"), Spawn, SpawnPrefix, cmp.Or(string(agent), "<agent>"))
+	}
+	return fmt.Errorf("%s is out of scope (needs %s)", msg.Type, scope)
+}
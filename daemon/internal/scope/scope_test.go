@@ -0,0 +1,72 @@
+package scope
+
+import (
+	"testing"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+func TestCheck(t *testing.T) {
+	spawn := func(agent protocol.AgentType) protocol.ServerMessage {
+		return protocol.ServerMessage{Type: protocol.MsgTypeSpawn, Agent: agent}
+	}
+	readOnly := protocol.ServerMessage{Type: protocol.MsgTypeSpawn, ReadOnly: true}
+	yolo := protocol.ServerMessage{Type: protocol.MsgTypeSpawn, YoloMode: true}
+	yoloCompare := protocol.ServerMessage{Type: protocol.MsgTypeCompareRun, YoloMode: true}
+	unlisted := protocol.ServerMessage{Type: "some-future-message"}
+
+	tests := []struct {
+		name   string
+		scopes Scopes
+		msg    protocol.ServerMessage
+		agent  protocol.AgentType
+		allow  bool
+	}{
+		{"no scopes allow anything", nil, unlisted, "", true},
+		{"no scopes allow yolo", nil, yolo, protocol.AgentClaudeCode, true},
+		{"all allows unlisted types", Scopes{All}, unlisted, "", true},
+		{"unlisted types need all", Scopes{Read, Input, Spawn, Manage}, unlisted, "", false},
+		{"read", Scopes{Read}, protocol.ServerMessage{Type: protocol.MsgTypeGetSessionInfo}, "", true},
+		{"read isn't input", Scopes{Read}, protocol.ServerMessage{Type: protocol.MsgTypePtyInput}, "", false},
+		{"input", Scopes{Input}, protocol.ServerMessage{Type: protocol.MsgTypeResize}, "", true},
+		{"input isn't manage", Scopes{Input}, protocol.ServerMessage{Type: protocol.MsgTypeKill}, "", false},
+		{"spawn allows any agent", Scopes{Spawn}, spawn(protocol.AgentBash), protocol.AgentBash, true},
+		{"spawn agent", Scopes{SpawnPrefix + "claude-code"}, spawn(protocol.AgentClaudeCode), protocol.AgentClaudeCode, true},
+		{"spawn other agent", Scopes{SpawnPrefix + "claude-code"}, spawn(protocol.AgentCodexCLI), protocol.AgentCodexCLI, false},
+		{"spawn agent a profile resolves to", Scopes{SpawnPrefix + "codex-cli"}, protocol.ServerMessage{Type: protocol.MsgTypeSpawn, Profile: "codex"}, protocol.AgentCodexCLI, true},
+		{"spawn unknown agent", Scopes{SpawnPrefix + "claude-code"}, spawn(""), "", false},
+		{"read-only agent", Scopes{SpawnReadOnly}, readOnly, protocol.AgentClaudeCode, true},
+		{"read-only spawn needs read-only", Scopes{SpawnReadOnly}, spawn(protocol.AgentClaudeCode), protocol.AgentClaudeCode, false},
+		{"read-only bash", Scopes{SpawnReadOnly}, readOnly, protocol.AgentBash, false},
+		{"read-only shell", Scopes{SpawnReadOnly}, readOnly, protocol.AgentShell, false},
+		{"agent scope isn't kill", Scopes{SpawnPrefix + "claude-code"}, protocol.ServerMessage{Type: protocol.MsgTypeKill}, "", false},
+		{"no-yolo refuses yolo spawn", Scopes{All, NoYolo}, yolo, protocol.AgentClaudeCode, false},
+		{"no-yolo refuses yolo compare", Scopes{All, NoYolo}, yoloCompare, "", false},
+		{"no-yolo allows other spawns", Scopes{All, NoYolo}, spawn(protocol.AgentClaudeCode), protocol.AgentClaudeCode, true},
+		{"no-yolo alone allows nothing", Scopes{NoYolo}, protocol.ServerMessage{Type: protocol.MsgTypeListRepos}, "", false},
+		{"worktree create", Scopes{WorktreeCreate}, protocol.ServerMessage{Type: protocol.MsgTypeFetchRepo}, "", true},
+		{"worktree create isn't remove", Scopes{WorktreeCreate}, protocol.ServerMessage{Type: protocol.MsgTypeRemoveWorktree}, "", false},
+		{"clipboard", Scopes{Clipboard}, protocol.ServerMessage{Type: protocol.MsgTypeGetClipboard}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.scopes.Check(tt.msg, tt.agent)
+			if allowed := err == nil; allowed != tt.allow {
+				t.Errorf("%v.Check(%s) = %v, want allowed %v", tt.scopes, tt.msg.Type, err, tt.allow)
+			}
+		})
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, s := range []string{All, Read, Spawn, SpawnPrefix + "claude-code", SpawnReadOnly, NoYolo, Clipboard} {
+		if err := Valid(s); err != nil {
+			t.Errorf("Valid(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "write", SpawnPrefix, "READ"} {
+		if Valid(s) == nil {
+			t.Errorf("Valid(%q) = nil, want an error", s)
+		}
+	}
+}
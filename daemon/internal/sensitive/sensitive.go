@@ -0,0 +1,90 @@
+// Package sensitive classifies the files a session changed into categories
+// a reviewer should know were touched: licensing, project governance, CI
+// and lockfiles. A change to these is rarely what an agent was asked for,
+// and one to CI or a lockfile can change what runs with the project's
+// credentials or what ships in its dependencies.
+package sensitive
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/agenthq/daemon/internal/artifacts"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Default categories
+const (
+	CategoryLicense    = "license"
+	CategoryGovernance = "governance"
+	CategoryCI         = "ci"
+	CategoryLockfile   = "lockfile"
+)
+
+// Defaults are the categories and their globs used unless configured
+// otherwise. Globs are relative to the worktree root and slash-separated;
+// "**" matches any number of directories.
+var Defaults = map[string][]string{
+	CategoryLicense: {
+		"**/LICENSE", "**/LICENSE.*", "**/LICENSE-*", "**/LICENCE", "**/LICENCE.*",
+		"**/COPYING", "**/COPYING.*", "**/NOTICE", "**/NOTICE.*",
+		"**/CLA.md", "**/CLA.txt", "**/.clabot",
+	},
+	CategoryGovernance: {
+		"**/SECURITY.md", "**/CODEOWNERS", "**/CODE_OF_CONDUCT.md",
+		"**/CONTRIBUTING.md", "**/GOVERNANCE.md",
+	},
+	CategoryCI: {
+		".github/workflows/**", ".github/actions/**", ".gitlab-ci.yml",
+		".circleci/**", ".buildkite/**", "azure-pipelines.yml", "Jenkinsfile",
+		".travis.yml", "bitbucket-pipelines.yml",
+	},
+	CategoryLockfile: {
+		"**/package-lock.json", "**/npm-shrinkwrap.json", "**/pnpm-lock.yaml",
+		"**/yarn.lock", "**/bun.lockb", "**/bun.lock", "**/go.sum",
+		"**/Cargo.lock", "**/poetry.lock", "**/Pipfile.lock", "**/uv.lock",
+		"**/Gemfile.lock", "**/composer.lock", "**/flake.lock",
+	},
+}
+
+// Merge returns the categories of base with those of each override in
+// turn replacing them; a category overridden with no globs is dropped.
+func Merge(base map[string][]string, overrides ...map[string][]string) map[string][]string {
+	merged := maps.Clone(base)
+	for _, o := range overrides {
+		for category, globs := range o {
+			if len(globs) == 0 {
+				delete(merged, category)
+				continue
+			}
+			merged[category] = globs
+		}
+	}
+	return merged
+}
+
+// Classify returns the files among changed, slash-separated paths relative
+// to the worktree root, that fall in a category, in the order given. A
+// file in several categories is reported in the first by name.
+func Classify(categories map[string][]string, changed []string) []protocol.SensitiveChange {
+	names := slices.Sorted(maps.Keys(categories))
+	var found []protocol.SensitiveChange
+	for _, file := range changed {
+		for _, category := range names {
+			if matchAny(categories[category], file) {
+				found = append(found, protocol.SensitiveChange{Path: file, Category: category})
+				break
+			}
+		}
+	}
+	return found
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if artifacts.Match(glob, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,312 @@
+package session
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/agenthq/daemon/internal/docker"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/pty"
+	"github.com/agenthq/daemon/internal/tmux"
+)
+
+// Built-in backend names
+const (
+	BackendPTY    = "pty"
+	BackendTmux   = "tmux"
+	BackendDocker = "docker"
+)
+
+// Terminal is a session's running terminal as provided by a backend.
+type Terminal interface {
+	// Write sends input to the session.
+	Write(data []byte) (int, error)
+	Resize(cols, rows uint16) error
+	Size() (cols, rows int, err error)
+	// StartReadLoop streams the session's output to onData.
+	StartReadLoop(onData func([]byte))
+	// Wait blocks until the session ends and returns its exit code.
+	Wait() (int, error)
+	// Signal names the signal that ended the session, if any.
+	Signal() string
+	Kill() error
+	// Close releases the daemon's side of the terminal. For persistent
+	// backends this detaches and leaves the session running.
+	Close() error
+	Done() <-chan struct{}
+}
+
+// TerminalSpec describes the command a backend should run for a session.
+type TerminalSpec struct {
+	ProcessID string
+	Agent     protocol.AgentType
+	Command   string
+	Args      []string
+	Dir       string
+	Cols      int
+	Rows      int
+	// WorktreePath is the session's worktree, which Dir is in.
+	WorktreePath string
+	// Image is the container image requested for the session, for
+	// container backends; empty means the backend's default.
+	Image string
+	// Sandbox overrides the container backend's limits and network policy.
+	Sandbox *protocol.Sandbox
+	// Env are KEY=value variables for the session, overriding inherited
+	// ones.
+	Env []string
+}
+
+// Backend runs session terminals. Backends are registered with the manager
+// and chosen per spawn, falling back to the manager's default.
+type Backend interface {
+	Name() string
+	Spawn(spec TerminalSpec) (Terminal, error)
+	// Persistent reports whether sessions outlive the daemon. Their
+	// terminals are detached rather than killed on shutdown.
+	Persistent() bool
+}
+
+// Adopter is implemented by persistent backends that can find sessions a
+// previous daemon left running.
+type Adopter interface {
+	Adopt() ([]Adopted, error)
+}
+
+// Adopted is a running session found by an Adopter, already attached.
+type Adopted struct {
+	TerminalSpec
+	Terminal Terminal
+}
+
+// RegisterBackend makes a backend available to spawn requests.
+func (m *Manager) RegisterBackend(b Backend) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backends[b.Name()] = b
+}
+
+// SetDefaultBackend selects the backend used when a spawn doesn't name one.
+func (m *Manager) SetDefaultBackend(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.backends[name]; !ok {
+		return fmt.Errorf("unknown session backend: %s", name)
+	}
+	m.defaultBackend = name
+	return nil
+}
+
+// Backends returns the names of the registered backends, sorted.
+func (m *Manager) Backends() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.backends))
+	for name := range m.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backend returns the named backend, or the default. Must be called with
+// m.mu held.
+func (m *Manager) backend(name string) (Backend, error) {
+	if name == "" {
+		name = m.defaultBackend
+	}
+	b, ok := m.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown session backend: %s", name)
+	}
+	return b, nil
+}
+
+// Adopt attaches to sessions that persistent backends kept running across
+// a daemon restart and returns their processIDs.
+func (m *Manager) Adopt() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var adopted []string
+	for _, b := range m.backends {
+		adopter, ok := b.(Adopter)
+		if !ok {
+			continue
+		}
+		found, err := adopter.Adopt()
+		if err != nil {
+			log.Printf("Failed to adopt %s sessions: %v", b.Name(), err)
+			continue
+		}
+
+		for _, a := range found {
+			if _, exists := m.sessions[a.ProcessID]; exists {
+				a.Terminal.Close()
+				continue
+			}
+			session := &Session{
+				ID:           a.ProcessID,
+				Agent:        a.Agent,
+				WorktreePath: a.Dir,
+				Process:      a.Terminal,
+				Started:      time.Now(),
+				backend:      b,
+				output:       newRingBuffer(crashTailSize),
+			}
+			session.budget.limits = m.budget
+			m.sessions[a.ProcessID] = session
+			m.follow(session)
+			adopted = append(adopted, a.ProcessID)
+		}
+	}
+	sort.Strings(adopted)
+	return adopted
+}
+
+// ptyBackend runs sessions on raw PTYs owned by the daemon.
+type ptyBackend struct{}
+
+func (ptyBackend) Name() string     { return BackendPTY }
+func (ptyBackend) Persistent() bool { return false }
+
+func (ptyBackend) Spawn(spec TerminalSpec) (Terminal, error) {
+	return pty.Spawn(spec.Command, spec.Args, spec.Dir, spec.Env, spec.Cols, spec.Rows)
+}
+
+// TmuxBackend runs sessions in a daemon-managed tmux server.
+type TmuxBackend struct {
+	Server *tmux.Server
+}
+
+func (b TmuxBackend) Name() string     { return BackendTmux }
+func (b TmuxBackend) Persistent() bool { return true }
+
+func (b TmuxBackend) Spawn(spec TerminalSpec) (Terminal, error) {
+	meta := tmux.Meta{ProcessID: spec.ProcessID, Agent: string(spec.Agent), WorktreePath: spec.Dir}
+	return b.Server.Start(meta, spec.Command, spec.Args, spec.Dir, spec.Env, spec.Cols, spec.Rows)
+}
+
+func (b TmuxBackend) Adopt() ([]Adopted, error) {
+	found, err := b.Server.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	var adopted []Adopted
+	for _, t := range found {
+		cols, rows := t.Cols, t.Rows
+		if cols <= 0 || rows <= 0 {
+			cols, rows = 120, 30
+		}
+		term, err := b.Server.Attach(t.Name, "", cols, rows)
+		if err != nil {
+			log.Printf("Failed to adopt tmux session %s: %v", t.Name, err)
+			continue
+		}
+		adopted = append(adopted, Adopted{
+			TerminalSpec: TerminalSpec{
+				ProcessID: t.ProcessID,
+				Agent:     protocol.AgentType(t.Agent),
+				Dir:       t.WorktreePath,
+				Cols:      cols,
+				Rows:      rows,
+			},
+			Terminal: term,
+		})
+	}
+	return adopted, nil
+}
+
+// DockerBackend runs sessions in containers of a Docker-compatible engine
+// (Docker or podman), with the worktree bind-mounted at its host path.
+type DockerBackend struct {
+	Client *docker.Client
+	// Image is the default image, and Images override it per agent. An
+	// image requested by the spawn (from the repo's .agenthq.yml) wins.
+	Image  string
+	Images map[protocol.AgentType]string
+	// Mounts are extra bind mounts ("host:container[:options]"), e.g. for
+	// agent credentials.
+	Mounts []string
+	// PathMap maps local directories to where a remote engine sees them;
+	// see docker.RemotePath.
+	PathMap map[string]string
+	// Devcontainer runs sessions in the worktree's devcontainer, if it has
+	// one and the spawn requested no image.
+	Devcontainer bool
+	// Sandbox limits every container, and Sandboxes override it per agent
+	// field by field. A spawn's sandbox overrides both.
+	Sandbox   protocol.Sandbox
+	Sandboxes map[protocol.AgentType]protocol.Sandbox
+	// OnPull, if set, receives the progress of image pulls a spawn waits
+	// for.
+	OnPull func(processID string, pull *protocol.ImagePull)
+}
+
+func (b DockerBackend) Name() string     { return BackendDocker }
+func (b DockerBackend) Persistent() bool { return false }
+
+func (b DockerBackend) Spawn(spec TerminalSpec) (Terminal, error) {
+	if spec.WorktreePath == "" {
+		return nil, fmt.Errorf("docker sessions need a worktree")
+	}
+	mounts, err := docker.WorktreeMounts(spec.WorktreePath)
+	if err != nil {
+		return nil, err
+	}
+	// The worktree keeps its local path inside the container, wherever
+	// the engine's machine has it
+	if mounts, err = docker.MapMounts(b.PathMap, mounts, b.Client.Remote()); err != nil {
+		return nil, err
+	}
+	opts := docker.RunOptions{
+		ProcessID: spec.ProcessID,
+		Image:     cmp.Or(spec.Image, b.Images[spec.Agent], b.Image),
+		Command:   spec.Command,
+		Args:      spec.Args,
+		Dir:       spec.Dir,
+		Mounts:    slices.Concat(mounts, b.Mounts),
+		Cols:      spec.Cols,
+		Rows:      spec.Rows,
+		Sandbox:   docker.MergeSandbox(b.Sandbox, b.Sandboxes[spec.Agent]),
+	}
+	if spec.Sandbox != nil {
+		opts.Sandbox = docker.MergeSandbox(opts.Sandbox, *spec.Sandbox)
+	}
+	if b.OnPull != nil {
+		opts.OnPull = func(pull *protocol.ImagePull) { b.OnPull(spec.ProcessID, pull) }
+	}
+
+	if b.Devcontainer && spec.Image == "" {
+		dc, err := docker.LoadDevcontainer(spec.WorktreePath)
+		if err != nil {
+			return nil, err
+		}
+		if dc != nil {
+			if opts.Image, err = b.Client.PrepareImage(dc); err != nil {
+				return nil, err
+			}
+			dcMounts, err := dc.BindMounts()
+			if err != nil {
+				return nil, err
+			}
+			opts.Mounts = append(opts.Mounts, dcMounts...)
+			opts.Env = dc.Env()
+			opts.User = dc.User()
+		}
+	}
+
+	opts.Env = append(opts.Env, spec.Env...)
+
+	if opts.Image == "" {
+		return nil, fmt.Errorf("no container image configured for agent %s", spec.Agent)
+	}
+	return b.Client.Run(opts)
+}
@@ -0,0 +1,212 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/agenthq/daemon/internal/budget"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// budgetState is a session's budget and what it spent of it.
+type budgetState struct {
+	mu     sync.Mutex
+	limits protocol.Budget
+	// spent are the limits the session went over, which don't fire again
+	spent map[string]bool
+	// cpu is the most CPU time seen, as processes that end take theirs
+	// with them unless waited for
+	cpu    time.Duration
+	paused bool
+	// killed says which limit the session was killed over, if any
+	killed string
+}
+
+// killedOver describes the limit the session was killed over, if any.
+func (b *budgetState) killedOver() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.killed
+}
+
+// BudgetEvent is a session going over a limit of its budget, and what was
+// done about it.
+type BudgetEvent struct {
+	ProcessID string
+	Exceeded  protocol.BudgetExceeded
+	// Err is why the action couldn't be taken, if it couldn't
+	Err error
+}
+
+// SetBudget sets the budget of sessions spawned from now on, and of those
+// adopted, unless their spawn overrides it.
+func (m *Manager) SetBudget(b protocol.Budget) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.budget = b
+}
+
+// CheckBudgets acts on the sessions that went over a limit of their budget
+// since the last check: it warns (does nothing), pauses or kills them as
+// their budget says, and returns what it did. CPU time is that of the
+// session's processes the daemon can see, so the processes of docker
+// sessions don't count; err is why it couldn't be measured, while the
+// other limits are still checked.
+func (m *Manager) CheckBudgets() (events []BudgetEvent, err error) {
+	m.mu.RLock()
+	var sessions []*Session
+	needCPU := false
+	for _, s := range m.sessions {
+		s.budget.mu.Lock()
+		limits := s.budget.limits
+		s.budget.mu.Unlock()
+		if budget.Enabled(limits) {
+			sessions = append(sessions, s)
+			needCPU = needCPU || limits.CPUSeconds > 0
+		}
+	}
+	m.mu.RUnlock()
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+
+	var cpu map[string]time.Duration
+	if needCPU {
+		cpu, err = sessionCPU()
+	}
+	for _, s := range sessions {
+		s.budget.mu.Lock()
+		s.budget.cpu = max(s.budget.cpu, cpu[s.ID])
+		over := budget.Exceeded(s.budget.limits, s.budget.cpu, time.Since(s.Started), s.budget.spent)
+		if len(over) == 0 {
+			s.budget.mu.Unlock()
+			continue
+		}
+		if s.budget.spent == nil {
+			s.budget.spent = make(map[string]bool)
+		}
+		for _, e := range over {
+			s.budget.spent[e.Limit] = true
+		}
+		s.budget.mu.Unlock()
+
+		// One action covers every limit gone over at once
+		actErr := actOnBudget(s, over[0])
+		for _, e := range over {
+			events = append(events, BudgetEvent{ProcessID: s.ID, Exceeded: e, Err: actErr})
+		}
+	}
+	return events, err
+}
+
+// actOnBudget takes the action of e on a session.
+func actOnBudget(s *Session, e protocol.BudgetExceeded) error {
+	switch e.Action {
+	case protocol.BudgetPause:
+		s.budget.mu.Lock()
+		paused := s.budget.paused
+		s.budget.mu.Unlock()
+		if paused {
+			return nil
+		}
+		if err := signalSession(s, syscall.SIGSTOP); err != nil {
+			return err
+		}
+		s.budget.mu.Lock()
+		s.budget.paused = true
+		s.budget.mu.Unlock()
+	case protocol.BudgetKill:
+		s.budget.mu.Lock()
+		s.budget.killed = fmt.Sprintf("%s budget of %ds exceeded", e.Limit, e.Allowed)
+		s.budget.mu.Unlock()
+		s.killed.Store(true)
+		return s.Process.Kill()
+	}
+	return nil
+}
+
+// Resume continues a session paused over its budget. If b is set it is
+// merged over the session's budget, whose limits are then checked afresh
+// (so a session still over one is paused again); otherwise the limits it
+// went over stay spent.
+func (m *Manager) Resume(processID string, b *protocol.Budget) error {
+	s, err := m.get(processID)
+	if err != nil {
+		return err
+	}
+
+	s.budget.mu.Lock()
+	paused := s.budget.paused
+	if b != nil {
+		s.budget.limits = budget.Merge(s.budget.limits, *b)
+		s.budget.spent = nil
+	}
+	s.budget.mu.Unlock()
+	if !paused {
+		if b == nil {
+			return fmt.Errorf("process %s isn't paused", processID)
+		}
+		return nil
+	}
+
+	if err := signalSession(s, syscall.SIGCONT); err != nil {
+		return err
+	}
+	s.budget.mu.Lock()
+	s.budget.paused = false
+	s.budget.mu.Unlock()
+	return nil
+}
+
+// sessionCPU returns the CPU time of each session's processes together,
+// by processID.
+func sessionCPU() (map[string]time.Duration, error) {
+	processes, err := markedProcesses()
+	if err != nil {
+		return nil, err
+	}
+	cpu := make(map[string]time.Duration)
+	for _, p := range processes {
+		cpu[p.processID] += p.cpu
+	}
+	return cpu, nil
+}
+
+// signalSession stops or continues the processes of a session. The shell
+// it runs in is stopped first and continued last, so that it doesn't see
+// its job stop and take the terminal back from the agent.
+func signalSession(s *Session, sig syscall.Signal) error {
+	processes, err := markedProcesses()
+	if err != nil {
+		return err
+	}
+	shell := 0
+	if p, ok := s.Process.(PIDer); ok {
+		shell = p.PID()
+	}
+	var pids []int
+	for _, p := range processes {
+		if p.processID == s.ID && p.pid != shell {
+			pids = append(pids, p.pid)
+		}
+	}
+	if shell > 0 {
+		if sig == syscall.SIGSTOP {
+			pids = append([]int{shell}, pids...)
+		} else {
+			pids = append(pids, shell)
+		}
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("no processes of %s to signal", s.ID)
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to signal process %d: %w", pid, err)
+		}
+	}
+	return nil
+}
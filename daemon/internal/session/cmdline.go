@@ -0,0 +1,41 @@
+package session
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// commandLine builds a bash command line for an agent. Words from the
+// agent's settings are written into the script as is, so they may hold
+// several flags; values (the task, model, profile arguments...) are passed
+// as positional parameters that the script only refers to, so no quoting
+// or escaping is involved and no value can be interpreted by the shell.
+type commandLine struct {
+	words  []string
+	values []string
+}
+
+// add appends shell words from the agent's settings; empty ones are skipped.
+func (c *commandLine) add(words string) {
+	if words != "" {
+		c.words = append(c.words, words)
+	}
+}
+
+// value appends a single argument the shell passes through untouched.
+func (c *commandLine) value(v string) {
+	c.values = append(c.values, v)
+	c.words = append(c.words, `"${`+strconv.Itoa(len(c.values))+`}"`)
+}
+
+// script returns the command to run with bash -c.
+func (c *commandLine) script() string {
+	return strings.Join(c.words, " ")
+}
+
+// bashArgs returns the arguments to run the command line with bash: flags,
+// "-c" and the script, then $0 and the values.
+func (c *commandLine) bashArgs(flags []string, script string) []string {
+	return slices.Concat(flags, []string{"-c", script, "bash"}, c.values)
+}
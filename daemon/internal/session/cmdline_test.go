@@ -0,0 +1,143 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/agenthq/daemon/internal/agent"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// hostileValues are arguments a shell would mangle or run if they were
+// quoted into the command line wrongly.
+var hostileValues = []string{
+	`it's a "quoted" task`,
+	"line one\nline two\n",
+	"$(touch pwned) `touch pwned` ${HOME} $HOME",
+	"; touch pwned && touch pwned || touch pwned | cat > pwned &",
+	`'; touch pwned; echo '`,
+	`"; touch pwned; echo "`,
+	`\' \" \\ \n`,
+	"* ? [a-z] ~ {a,b} !! #",
+	"",
+	"--not-a-flag",
+}
+
+// runArgs runs bash with args in dir and returns the arguments printed,
+// NUL-terminated, by the command line.
+func runArgs(t *testing.T, dir string, env []string, args []string) []string {
+	t.Helper()
+	cmd := exec.Command("bash", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("bash %q: %v", args, err)
+	}
+	printed := strings.Split(string(out), "\x00")
+	return printed[:len(printed)-1]
+}
+
+func TestCommandLinePassesValuesVerbatim(t *testing.T) {
+	var c commandLine
+	c.add(`printf '%s\0'`)
+	for _, v := range hostileValues {
+		c.value(v)
+	}
+	// More than nine, so the tenth and later need braces
+	c.value("eleventh")
+
+	dir := t.TempDir()
+	got := runArgs(t, dir, os.Environ(), c.bashArgs(nil, c.script()))
+	want := append(slices.Clone(hostileValues), "eleventh")
+	if !slices.Equal(got, want) {
+		t.Errorf("arguments = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+		t.Error("a value was run as a command")
+	}
+}
+
+func TestCommandLineKeepsAgentWords(t *testing.T) {
+	var c commandLine
+	c.add(`printf '%s\0' -a`)
+	c.add("")
+	c.add("--yolo --fast")
+	c.value("task")
+
+	got := runArgs(t, t.TempDir(), os.Environ(), c.bashArgs(nil, c.script()))
+	want := []string{"-a", "--yolo", "--fast", "task"}
+	if !slices.Equal(got, want) {
+		t.Errorf("arguments = %q, want %q", got, want)
+	}
+}
+
+// specBackend records the spec of a spawn and fails it.
+type specBackend struct {
+	spec TerminalSpec
+}
+
+var errNotSpawned = errors.New("not spawned")
+
+func (b *specBackend) Name() string     { return BackendPTY }
+func (b *specBackend) Persistent() bool { return false }
+func (b *specBackend) Spawn(spec TerminalSpec) (Terminal, error) {
+	b.spec = spec
+	return nil, errNotSpawned
+}
+
+func TestSpawnPassesTaskAsArgument(t *testing.T) {
+	for _, task := range hostileValues {
+		if task == "" {
+			continue // no task, no prompt
+		}
+		backend := &specBackend{}
+		m := NewManager(agent.NewRegistry(nil), nil, nil, nil)
+		m.backends[BackendPTY] = backend
+
+		dir := t.TempDir()
+		err := m.Spawn(SpawnOptions{
+			ProcessID:    "p1",
+			Agent:        protocol.AgentClaudeCode,
+			WorktreePath: dir,
+			Task:         task,
+			Model:        "model; touch pwned",
+			Headless:     true,
+			Cols:         80,
+			Rows:         24,
+		})
+		if !errors.Is(err, errNotSpawned) {
+			t.Fatalf("Spawn: %v", err)
+		}
+
+		spec := backend.spec
+		if spec.Command != "bash" || !slices.Equal(spec.Args[:2], []string{"-i", "-l"}) {
+			t.Fatalf("command = %s %q, want an interactive login bash", spec.Command, spec.Args)
+		}
+
+		// Run the command line without the login shell, with a stand-in
+		// agent that prints its arguments
+		bin := t.TempDir()
+		stub := "#!/bin/sh\nprintf '%s\\0' \"$@\"\n"
+		if err := os.WriteFile(filepath.Join(bin, protocol.AgentCommands[protocol.AgentClaudeCode]), []byte(stub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		env := append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		got := runArgs(t, dir, env, spec.Args[2:])
+
+		if len(got) == 0 || got[len(got)-1] != task {
+			t.Errorf("agent arguments = %q, want the task %q last", got, task)
+		}
+		if i := slices.Index(got, "--model"); i < 0 || i+1 >= len(got) || got[i+1] != "model; touch pwned" {
+			t.Errorf("agent arguments = %q, want the model after --model", got)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+			t.Errorf("task %q was run as a command", task)
+		}
+	}
+}
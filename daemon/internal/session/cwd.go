@@ -0,0 +1,39 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/agenthq/daemon/internal/agent"
+	"github.com/agenthq/daemon/internal/placeholder"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// startDir returns where an agent starts, given its cwd strategy (see
+// agent.Spec.Cwd) and dir, the targeted package's directory or the
+// worktree.
+func startDir(cwd, worktreePath, dir string, vars *placeholder.Vars) (string, error) {
+	switch cwd {
+	case "", agent.CwdPackageDir:
+		return dir, nil
+	case agent.CwdWorktreeRoot:
+		return worktreePath, nil
+	case agent.CwdRepoRoot:
+		top, err := worktree.TopLevel(dir)
+		if err != nil {
+			// Not in a git checkout: the worktree is the root there is
+			return worktreePath, nil
+		}
+		return top, nil
+	}
+
+	path := vars.Expand(cwd)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(worktreePath, path)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("agent working directory %s: not a directory", path)
+	}
+	return path, nil
+}
@@ -0,0 +1,173 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/pty"
+)
+
+// loginPathTimeout bounds asking a login shell for its PATH; a profile
+// that waits for input or starts something long-lived gives up then.
+const loginPathTimeout = 10 * time.Second
+
+// loginPathMarker precedes the PATH a login shell prints, telling it from
+// whatever its profile prints.
+const loginPathMarker = "__AGENTHQ_PATH__"
+
+// installDirs are where agent CLIs commonly get installed, besides the
+// daemon's PATH; ~ is the home directory.
+var installDirs = []string{
+	"~/.local/bin",
+	"~/.claude/local",
+	"~/.npm-global/bin",
+	"~/.bun/bin",
+	"~/.volta/bin",
+	"~/.yarn/bin",
+	"~/.cargo/bin",
+	"~/go/bin",
+	"~/.nvm/versions/node/*/bin",
+	"/opt/homebrew/bin",
+	"/usr/local/bin",
+}
+
+// diagnoser works out, once per session, why its wrapper shell couldn't
+// run a command.
+type diagnoser struct {
+	terminal TerminalSpec
+	docker   bool
+	// command and install are the agent's command and how to install it;
+	// empty for plugin launches
+	command, install string
+
+	once      sync.Once
+	diagnosis *protocol.AgentDiagnosis
+}
+
+func newDiagnoser(terminal TerminalSpec, backend, command, install string) *diagnoser {
+	return &diagnoser{terminal: terminal, docker: backend == BackendDocker, command: command, install: install}
+}
+
+// diagnose explains the wrapper shell failing to run command with message,
+// as diagnoseStart found them. Later calls return the first diagnosis.
+func (d *diagnoser) diagnose(command, message string) *protocol.AgentDiagnosis {
+	d.once.Do(func() {
+		d.diagnosis = d.run(command, message)
+	})
+	return d.diagnosis
+}
+
+func (d *diagnoser) run(command, message string) *protocol.AgentDiagnosis {
+	diagnosis := &protocol.AgentDiagnosis{Command: command}
+	switch message {
+	case "command not found":
+		diagnosis.Problem = protocol.DiagnosisNotFound
+	case "No such file or directory":
+		diagnosis.Problem = protocol.DiagnosisNoSuchFile
+	default:
+		diagnosis.Problem = protocol.DiagnosisNotPermitted
+	}
+	if agentCommand, _, _ := strings.Cut(d.command, " "); agentCommand != "" && filepath.Base(command) == agentCommand {
+		diagnosis.Install = d.install
+	}
+	// A container's PATH is the image's business
+	if d.docker || diagnosis.Problem != protocol.DiagnosisNotFound || strings.Contains(command, "/") {
+		return diagnosis
+	}
+
+	env := pty.Env(d.terminal.Env)
+	home := lookupEnv(env, "HOME")
+	daemonPath := filepath.SplitList(lookupEnv(env, "PATH"))
+	// Without the login shell's PATH, a command on the daemon's is still
+	// worth naming
+	loginPath, err := d.loginPath(env)
+	if err == nil {
+		for _, dir := range daemonPath {
+			if dir != "" && !slices.Contains(loginPath, dir) && !slices.Contains(diagnosis.DaemonOnlyPath, dir) {
+				diagnosis.DaemonOnlyPath = append(diagnosis.DaemonOnlyPath, dir)
+			}
+		}
+	}
+
+	dirs := slices.Clone(daemonPath)
+	for _, dir := range installDirs {
+		if rest, ok := strings.CutPrefix(dir, "~/"); ok {
+			if home == "" {
+				continue
+			}
+			dir = filepath.Join(home, rest)
+		}
+		matches, _ := filepath.Glob(dir)
+		dirs = append(dirs, matches...)
+	}
+	for _, dir := range dirs {
+		if dir == "" || slices.Contains(loginPath, dir) {
+			continue
+		}
+		file := filepath.Join(dir, command)
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() && info.Mode()&0o111 != 0 {
+			diagnosis.FoundAt = file
+			diagnosis.PathHint = fmt.Sprintf("%s isn't on the PATH of the login shell sessions run in; add `export PATH=\"%s:$PATH\"` to %s",
+				dir, dir, loginProfile(home))
+			break
+		}
+	}
+	return diagnosis
+}
+
+// loginPath returns the PATH of the interactive login shell a session's
+// agent runs in, started like the session's with env.
+func (d *diagnoser) loginPath(env []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), loginPathTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", "-i", "-l", "-c", `printf '\n`+loginPathMarker+`%s\n' "$PATH"`)
+	cmd.Dir = d.terminal.Dir
+	cmd.Env = env
+	// Without a terminal of its own, an interactive shell that found the
+	// daemon's would stop trying to take it over
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	// The profile may make the shell exit nonzero after printing it
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		if path, ok := bytes.CutPrefix(line, []byte(loginPathMarker)); ok {
+			return filepath.SplitList(string(bytes.TrimSpace(path))), nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no PATH in the login shell's output")
+	}
+	return nil, err
+}
+
+// loginProfile returns the profile bash reads as a login shell, for a user
+// to add to: the first of ~/.bash_profile, ~/.bash_login and ~/.profile
+// that exists, else ~/.profile.
+func loginProfile(home string) string {
+	for _, name := range []string{".bash_profile", ".bash_login", ".profile"} {
+		if _, err := os.Stat(filepath.Join(home, name)); err == nil {
+			return "~/" + name
+		}
+	}
+	return "~/.profile"
+}
+
+// lookupEnv returns the value of key in env, a list of KEY=value.
+func lookupEnv(env []string, key string) string {
+	for _, kv := range slices.Backward(env) {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"regexp"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Exit reasons reported in process-exit.
+const (
+	ExitCompleted     = "completed"       // exited with status 0
+	ExitError         = "error"           // exited with a nonzero status
+	ExitSignaled      = "signaled"        // terminated by a signal the daemon didn't send
+	ExitKilled        = "killed"          // terminated by a kill request
+	ExitCrashed       = "crashed"         // exited nonzero, output ending with a known crash signature
+	ExitInternalError = "internal-error"  // aborted after a daemon panic; see Manager.Abort
+	ExitBudget        = "budget-exceeded" // killed over its budget; see Manager.CheckBudgets
+)
+
+// ExitInfo describes how a session's process ended.
+type ExitInfo struct {
+	Code   int
+	Reason string
+	// Signal is the terminating signal name, if any.
+	Signal string
+	// Detail names the crash signature that matched, or the budget limit
+	// exceeded, if any.
+	Detail string
+	// Diagnosis explains an exit because the wrapper shell couldn't run
+	// the agent, if so.
+	Diagnosis *protocol.AgentDiagnosis
+}
+
+// Statuses shells exit with when they can't run a command.
+const (
+	commandNotExecutable = 126
+	commandNotFound      = 127
+)
+
+// crashTailSize is how much trailing output is scanned for crash signatures.
+const crashTailSize = 16 * 1024
+
+// crashSignature is a pattern in terminal output indicating why the agent
+// died abnormally. It only names the cause of an exit that failed: output
+// before a clean exit may show a traceback or API error the agent recovered
+// from, or its own code's.
+type crashSignature struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+var crashSignatures = []crashSignature{
+	{"go-panic", regexp.MustCompile(`(?m)^panic: .*\n(?s:.*)^goroutine \d+ \[`)},
+	{"node-fatal", regexp.MustCompile(`FATAL ERROR: |Unhandled(Promise)?Rejection|node:internal/`)},
+	{"node-stack-trace", regexp.MustCompile(`(?m)^\w*Error: .*\n\s+at .+\(.+:\d+:\d+\)`)},
+	{"python-traceback", regexp.MustCompile(`Traceback \(most recent call last\):`)},
+	{"rust-panic", regexp.MustCompile(`thread '.*' panicked at`)},
+	{"segfault", regexp.MustCompile(`Segmentation fault|core dumped`)},
+	{"api-error", regexp.MustCompile(`(?i)API Error[:\s]|overloaded_error|rate_limit_error|authentication_error|invalid_request_error`)},
+	{"out-of-memory", regexp.MustCompile(`JavaScript heap out of memory|Out of memory|MemoryError`)},
+}
+
+// ansiRe matches terminal escape sequences (CSI, OSC, and two-byte escapes).
+var ansiRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+var crlfRe = regexp.MustCompile(`\r\n?`)
+
+// detectCrash returns the name of the last crash signature found in output.
+func detectCrash(output []byte) string {
+	text := ansiRe.ReplaceAll(output, nil)
+	text = crlfRe.ReplaceAll(text, []byte("\n"))
+
+	match, pos := "", -1
+	for _, sig := range crashSignatures {
+		locs := sig.pattern.FindAllIndex(text, -1)
+		if len(locs) == 0 {
+			continue
+		}
+		if last := locs[len(locs)-1][0]; last > pos {
+			match, pos = sig.name, last
+		}
+	}
+	return match
+}
+
+// classifyExit determines why a session ended.
+func classifyExit(code int, signal string, killed bool, output []byte) ExitInfo {
+	info := ExitInfo{Code: code, Signal: signal}
+
+	if killed {
+		info.Reason = ExitKilled
+		return info
+	}
+
+	if signal == "" && code == 0 {
+		info.Reason = ExitCompleted
+		return info
+	}
+
+	info.Detail = detectCrash(output)
+	switch {
+	case signal != "":
+		info.Reason = ExitSignaled
+	case info.Detail != "":
+		info.Reason = ExitCrashed
+	default:
+		info.Reason = ExitError
+	}
+	return info
+}
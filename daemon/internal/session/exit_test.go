@@ -0,0 +1,43 @@
+package session
+
+import "testing"
+
+func TestClassifyExit(t *testing.T) {
+	const (
+		traceback = "Traceback (most recent call last):\n  File \"x.py\", line 1\nValueError: bad\n"
+		stack     = "TypeError: x is undefined\n    at main (/app/index.js:3:7)\n"
+		apiError  = "\x1b[31mAPI Error: 529 overloaded_error\x1b[0m\r\n"
+	)
+	tests := []struct {
+		name       string
+		code       int
+		signal     string
+		killed     bool
+		output     string
+		wantReason string
+		wantDetail string
+	}{
+		{"clean exit", 0, "", false, "done\n", ExitCompleted, ""},
+		{"clean exit after traceback", 0, "", false, traceback + "retrying\n", ExitCompleted, ""},
+		{"clean exit after stack trace", 0, "", false, stack, ExitCompleted, ""},
+		{"clean exit after api error", 0, "", false, apiError, ExitCompleted, ""},
+		{"error", 1, "", false, "usage: agent\n", ExitError, ""},
+		{"python crash", 1, "", false, traceback, ExitCrashed, "python-traceback"},
+		{"node crash", 1, "", false, stack, ExitCrashed, "node-stack-trace"},
+		{"api error", 2, "", false, apiError, ExitCrashed, "api-error"},
+		{"last signature wins", 1, "", false, apiError + traceback, ExitCrashed, "python-traceback"},
+		{"signal", -1, "SIGSEGV", false, "Segmentation fault\n", ExitSignaled, "segfault"},
+		{"killed", -1, "SIGKILL", true, traceback, ExitKilled, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyExit(tt.code, tt.signal, tt.killed, []byte(tt.output))
+			if got.Reason != tt.wantReason || got.Detail != tt.wantDetail {
+				t.Errorf("classifyExit(%d, %q) = %s (%q), want %s (%q)", tt.code, tt.signal, got.Reason, got.Detail, tt.wantReason, tt.wantDetail)
+			}
+			if got.Code != tt.code || got.Signal != tt.signal {
+				t.Errorf("classifyExit(%d, %q) kept code %d and signal %q", tt.code, tt.signal, got.Code, got.Signal)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// SetGroup moves a session into a group. An empty group removes it from its
+// current group.
+func (m *Manager) SetGroup(processID, group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[processID]
+	if !ok {
+		return fmt.Errorf("process %s not found", processID)
+	}
+
+	session.Group = group
+	return nil
+}
+
+// GroupMembers returns the processIDs in a group, sorted.
+func (m *Manager) GroupMembers(group string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var members []string
+	for id, session := range m.sessions {
+		if group != "" && session.Group == group {
+			members = append(members, id)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// BroadcastInput writes the same input to every session in a group and
+// returns the processIDs it was delivered to. Read-only members and
+// members whose input is leased are skipped. Write failures for individual members are joined into the
+// returned error; the rest still receive input.
+func (m *Manager) BroadcastInput(group string, data []byte) ([]string, error) {
+	if group == "" {
+		return nil, fmt.Errorf("group is required")
+	}
+
+	var delivered []string
+	var errs []error
+	for _, id := range m.GroupMembers(group) {
+		err := m.Input(id, data)
+		if errors.Is(err, ErrReadOnly) || errors.Is(err, ErrInputLeased) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		delivered = append(delivered, id)
+	}
+	return delivered, errors.Join(errs...)
+}
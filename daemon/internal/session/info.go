@@ -0,0 +1,96 @@
+package session
+
+import (
+	"sort"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Info describes a running session.
+type Info struct {
+	ID             string
+	Agent          protocol.AgentType
+	WorktreePath   string
+	AgentSessionID string
+	Group          string
+	Package        string
+	ReadOnly       bool
+	Started        time.Time
+	// InputBytes and OutputBytes count the terminal input and output so
+	// far.
+	InputBytes  int64
+	OutputBytes int64
+	// SpawnTime is how long the spawn took from being asked for to the
+	// process running, and FirstOutput until its first output; zero when
+	// not known (yet), as for adopted sessions.
+	SpawnTime   time.Duration
+	FirstOutput time.Duration
+}
+
+// List returns the running sessions, sorted by processID.
+func (m *Manager) List() []Info {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]Info, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		infos = append(infos, session.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Info describes one running session. It is still available from the
+// onExit callback.
+func (m *Manager) Info(processID string) (Info, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[processID]
+	if !ok {
+		return Info{}, false
+	}
+	return session.info(), true
+}
+
+func (s *Session) info() Info {
+	return Info{
+		ID:             s.ID,
+		Agent:          s.Agent,
+		WorktreePath:   s.WorktreePath,
+		AgentSessionID: s.AgentSessionID,
+		Group:          s.Group,
+		Package:        s.Package,
+		ReadOnly:       s.readOnly.Load(),
+		Started:        s.Started,
+		InputBytes:     s.inputBytes.Load(),
+		OutputBytes:    s.outputBytes.Load(),
+		SpawnTime:      s.spawnTime,
+		FirstOutput:    time.Duration(s.firstOutput.Load()),
+	}
+}
+
+// SetFirstOutputHook sets the function told when a spawned session first
+// outputs, with its timing.
+func (m *Manager) SetFirstOutputHook(fn func(Info)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onFirstOutput = fn
+}
+
+// noteFirstOutput records the time to a spawned session's first output,
+// if this is it. It is called from the session's read loop.
+func (m *Manager) noteFirstOutput(s *Session) {
+	if s.requested.IsZero() || s.firstOutput.Load() != 0 {
+		return
+	}
+	s.firstOutput.Store(int64(max(time.Since(s.requested), 1)))
+
+	m.mu.RLock()
+	hook := m.onFirstOutput
+	m.mu.RUnlock()
+	if hook != nil {
+		hook(s.info())
+	}
+}
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/agenthq/daemon/internal/pty"
+)
+
+// PIDer is implemented by terminals whose session runs a process on the
+// daemon's host.
+type PIDer interface {
+	// PID returns the process id of the session's command, or 0 if it is
+	// gone.
+	PID() int
+}
+
+// Details describes how a running session was started and the process it
+// runs, for debugging it ("why doesn't the agent find my tool?").
+type Details struct {
+	Info
+	Backend string
+	// Command, Args and Dir are the command line the session was started
+	// with; empty for sessions adopted from a previous daemon.
+	Command string
+	Args    []string
+	Dir     string
+	// Env is the process's environment, KEY=value, where the OS lets the
+	// daemon read it, and otherwise the environment it was started with.
+	// Nothing is masked.
+	Env []string
+	// PID and PGID are 0 when the process doesn't run on the daemon's
+	// host.
+	PID  int
+	PGID int
+}
+
+// Inspect describes a running session's command line and process.
+func (m *Manager) Inspect(processID string) (Details, error) {
+	session, err := m.get(processID)
+	if err != nil {
+		return Details{}, err
+	}
+
+	d := Details{
+		Info:    session.info(),
+		Backend: session.backend.Name(),
+		Command: session.spec.Command,
+		Args:    session.spec.Args,
+		Dir:     session.spec.Dir,
+	}
+	if p, ok := session.Process.(PIDer); ok {
+		d.PID = p.PID()
+	}
+	if d.PID > 0 {
+		d.PGID, _ = syscall.Getpgid(d.PID)
+		d.Env, _ = processEnv(d.PID)
+	}
+	if d.Env == nil && session.spec.Command != "" {
+		if d.Backend == BackendDocker {
+			// The image's and devcontainer's variables aren't known here
+			d.Env = session.spec.Env
+		} else {
+			d.Env = pty.Env(session.spec.Env)
+		}
+	}
+	return d, nil
+}
+
+// processEnv reads the environment of a process from /proc, where there is
+// one.
+func processEnv(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00"), nil
+}
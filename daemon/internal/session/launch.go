@@ -0,0 +1,54 @@
+package session
+
+import "github.com/agenthq/daemon/internal/protocol"
+
+// Launch is a command line that starts an agent in its session's directory,
+// with KEY=value variables added to the session's environment.
+type Launch struct {
+	Command string
+	Args    []string
+	Env     []string
+}
+
+// Launcher chooses how a spawn starts its agent (opts.Agent is resolved
+// from the profile). It returns nil to use the registry's command line.
+type Launcher func(opts SpawnOptions) (*Launch, error)
+
+// SetLauncher sets the launcher asked about every spawn, including
+// planned ones.
+func (m *Manager) SetLauncher(launcher Launcher) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.launcher = launcher
+}
+
+// launch sets opts.Launch from the launcher, if there is one and opts
+// doesn't have a launch yet.
+func (m *Manager) launch(opts *SpawnOptions) error {
+	m.mu.RLock()
+	launcher := m.launcher
+	m.mu.RUnlock()
+	if launcher == nil || opts.Launch != nil {
+		return nil
+	}
+
+	resolved := *opts
+	resolved.Agent = m.agentFor(*opts)
+	launch, err := launcher(resolved)
+	if err != nil {
+		return err
+	}
+	opts.Launch = launch
+	return nil
+}
+
+// agentFor returns the agent a spawn with opts starts: its Agent, or else
+// its profile's.
+func (m *Manager) agentFor(opts SpawnOptions) protocol.AgentType {
+	if opts.Agent == "" && opts.Profile != "" {
+		if profile, ok := m.registry.Profile(opts.Profile); ok {
+			return profile.Agent
+		}
+	}
+	return opts.Agent
+}
@@ -0,0 +1,174 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrInputLeased is returned when another user holds a session's input
+// lease.
+var ErrInputLeased = errors.New("input is leased to another user")
+
+// LeaseIdleTimeout is how long an input lease lasts without input or
+// renewal from its holder.
+const LeaseIdleTimeout = 30 * time.Second
+
+// burstGap separates input bursts in the audit log.
+const burstGap = 2 * time.Second
+
+// inputState arbitrates a session's input between several viewers and
+// attributes it for the audit log.
+type inputState struct {
+	mu sync.Mutex
+	// holder has the input lease until lastUsed+LeaseIdleTimeout; empty
+	// if nobody does.
+	holder   string
+	lastUsed time.Time
+
+	// lastUser and lastInput track the current input burst
+	lastUser  string
+	lastInput time.Time
+
+	// tokens is the input rate limit's bucket, last filled at bucketAt
+	tokens   float64
+	bucketAt time.Time
+}
+
+// leaseHolder returns the current lease holder. Callers hold s.mu.
+func (s *inputState) leaseHolder(now time.Time) string {
+	if s.holder != "" && now.Sub(s.lastUsed) > LeaseIdleTimeout {
+		s.holder = ""
+	}
+	return s.holder
+}
+
+// AcquireInput gives user the session's input lease, or renews it. If
+// another user holds it, it returns that user and ErrInputLeased.
+func (m *Manager) AcquireInput(processID, user string) (string, error) {
+	if user == "" {
+		return "", fmt.Errorf("sourceUser is required")
+	}
+	session, err := m.get(processID)
+	if err != nil {
+		return "", err
+	}
+
+	in := &session.input
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	now := time.Now()
+	if holder := in.leaseHolder(now); holder != "" && holder != user {
+		return holder, ErrInputLeased
+	}
+	in.holder = user
+	in.lastUsed = now
+	return user, nil
+}
+
+// ReleaseInput gives up user's input lease on a session. Releasing a lease
+// nobody holds is a no-op.
+func (m *Manager) ReleaseInput(processID, user string) error {
+	session, err := m.get(processID)
+	if err != nil {
+		return err
+	}
+
+	in := &session.input
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	switch in.leaseHolder(time.Now()) {
+	case "":
+	case user:
+		in.holder = ""
+	default:
+		return ErrInputLeased
+	}
+	return nil
+}
+
+// InputFrom writes input attributed to user (empty if unknown) to a
+// process. While a lease is held only its holder's input is accepted, and
+// that renews the lease. Input beyond the manager's InputLimits is
+// rejected. Each burst of input is logged with its user.
+func (m *Manager) InputFrom(processID, user string, data []byte) error {
+	session, err := m.get(processID)
+	if err != nil {
+		return err
+	}
+	if err := m.admitInput(session, user, len(data)); err != nil {
+		return err
+	}
+
+	n, err := session.writeInput(data)
+	session.inputBytes.Add(int64(n))
+	return err
+}
+
+// admitInput checks n bytes of input from user to a session against its
+// read-only state, input lease and the manager's InputLimits, as InputFrom
+// describes, and records it.
+func (m *Manager) admitInput(session *Session, user string, n int) error {
+	if session.readOnly.Load() {
+		return ErrReadOnly
+	}
+
+	limits := m.currentInputLimits()
+	in := &session.input
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	now := time.Now()
+	holder := in.leaseHolder(now)
+	if holder != "" && holder != user {
+		return ErrInputLeased
+	}
+	if err := in.admit(limits, n, now); err != nil {
+		return err
+	}
+	if holder != "" {
+		in.lastUsed = now
+	}
+	if user != in.lastUser || now.Sub(in.lastInput) > burstGap {
+		log.Printf("Input to %s from %s", session.ID, userLabel(user))
+	}
+	in.lastUser = user
+	in.lastInput = now
+	return nil
+}
+
+// get returns a running session.
+func (m *Manager) get(processID string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[processID]
+	if !ok {
+		return nil, fmt.Errorf("process %s not found", processID)
+	}
+	return session, nil
+}
+
+func userLabel(user string) string {
+	if user == "" {
+		return "unknown user"
+	}
+	return user
+}
+
+// InputLeaseHolder returns the user holding a session's input lease, or
+// "" if nobody does.
+func (m *Manager) InputLeaseHolder(processID string) (string, error) {
+	session, err := m.get(processID)
+	if err != nil {
+		return "", err
+	}
+
+	in := &session.input
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.leaseHolder(time.Now()), nil
+}
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInputLimit is returned (wrapped) for input beyond a session's limits.
+var ErrInputLimit = errors.New("input limit exceeded")
+
+// InputLimits caps the input a session accepts. Zero fields are unlimited.
+type InputLimits struct {
+	MaxMessage int // bytes per input message
+	Rate       int // sustained bytes per second
+	Burst      int // bytes accepted at once
+}
+
+// DefaultInputLimits allow large pastes but not a flood.
+var DefaultInputLimits = InputLimits{
+	MaxMessage: 1 << 20,
+	Rate:       256 << 10,
+	Burst:      1 << 20,
+}
+
+// SetInputLimits sets the limits applied to every session's input.
+func (m *Manager) SetInputLimits(limits InputLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputLimits = limits
+}
+
+// currentInputLimits returns the limits in force.
+func (m *Manager) currentInputLimits() InputLimits {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.inputLimits
+}
+
+// admit checks n bytes of input against limits with a token bucket, taking
+// them from the bucket if they fit. Callers hold s.mu.
+func (s *inputState) admit(limits InputLimits, n int, now time.Time) error {
+	if limits.MaxMessage > 0 && n > limits.MaxMessage {
+		return fmt.Errorf("%w: %d bytes in one message (max %d)", ErrInputLimit, n, limits.MaxMessage)
+	}
+	if limits.Rate <= 0 || limits.Burst <= 0 {
+		return nil
+	}
+
+	if s.bucketAt.IsZero() {
+		s.tokens = float64(limits.Burst)
+	} else {
+		s.tokens += now.Sub(s.bucketAt).Seconds() * float64(limits.Rate)
+	}
+	s.tokens = min(s.tokens, float64(limits.Burst))
+	s.bucketAt = now
+
+	if float64(n) > s.tokens {
+		return fmt.Errorf("%w: more than %d bytes/s", ErrInputLimit, limits.Rate)
+	}
+	s.tokens -= float64(n)
+	return nil
+}
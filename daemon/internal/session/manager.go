@@ -4,82 +4,494 @@ package session
 import (
 	"fmt"
 	"log"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
-
+	"sync/atomic"
+	"time"
+
+	"github.com/agenthq/daemon/internal/agent"
+	"github.com/agenthq/daemon/internal/budget"
+	"github.com/agenthq/daemon/internal/crash"
+	"github.com/agenthq/daemon/internal/mcp"
+	"github.com/agenthq/daemon/internal/placeholder"
 	"github.com/agenthq/daemon/internal/protocol"
-	"github.com/agenthq/daemon/internal/pty"
 )
 
 // Session represents an active agent session.
 type Session struct {
-	ID           string
+	ID             string
+	Agent          protocol.AgentType
+	WorktreePath   string
+	AgentSessionID string
+	// Group is an optional name shared by sessions that receive broadcast input.
+	Group string
+	// Package is the monorepo package the session works in, if any.
+	Package string
+	Process Terminal
+	// Started is when the session was spawned, or adopted.
+	Started time.Time
+
+	backend       Backend
+	mcpConfigPath string
+	output        *ringBuffer
+	killed        atomic.Bool
+	// readOnly makes the session ignore input
+	readOnly atomic.Bool
+	input    inputState
+	// writeMu keeps each input written whole
+	writeMu sync.Mutex
+	// paste follows the terminal's bracketed paste mode
+	paste pasteMode
+	// detached is set when the daemon lets go of a session that keeps
+	// running (persistent backends), so its end isn't reported as an exit.
+	detached atomic.Bool
+	// inputBytes and outputBytes count the session's terminal traffic
+	inputBytes  atomic.Int64
+	outputBytes atomic.Int64
+	// exited makes sure a session's exit is reported once, whether by its
+	// process ending or by Abort
+	exited sync.Once
+	// spec is what the session was started with; zero for adopted sessions
+	spec TerminalSpec
+	// startup watches a new session's first output; nil once spawned
+	// without Progress, or adopted
+	startup *startupWatch
+	// diagnoser explains the wrapper shell failing to run the agent; nil
+	// once adopted
+	diagnoser *diagnoser
+	// budget limits the session's compute; see CheckBudgets
+	budget budgetState
+	// requested is when the session's spawn was asked for, and spawnTime
+	// how long it took to start; zero for adopted sessions. firstOutput
+	// is the time from requested to the first output, in ns, once there
+	// was some.
+	requested   time.Time
+	spawnTime   time.Duration
+	firstOutput atomic.Int64
+}
+
+// SpawnOptions describes a session to start.
+type SpawnOptions struct {
+	ProcessID    string
 	Agent        protocol.AgentType
 	WorktreePath string
-	Process      *pty.Process
+	Task         string
+	Cols         int
+	Rows         int
+	YoloMode     bool
+	// Profile names an agent profile from the registry; it supplies the
+	// agent (when Agent is empty), model, and extra arguments.
+	Profile string
+	// Model overrides the model chosen by the agent or profile.
+	Model string
+	// MCPServers are added to (and override) the configured MCP servers
+	// for this session only.
+	MCPServers map[string]protocol.MCPServer
+	// Headless runs the agent non-interactively on Task; the process exits
+	// when the agent finishes instead of dropping into a shell.
+	Headless bool
+	// Group places the session in a broadcast group.
+	Group string
+	// ResumeOf is the processID of an earlier session whose agent
+	// conversation should be continued instead of starting a new one.
+	ResumeOf string
+	// Backend names the session backend to run on; empty means the
+	// manager's default.
+	Backend string
+	// Package names the monorepo package the session targets, and Dir is
+	// its directory relative to WorktreePath; the agent starts there.
+	Package string
+	Dir     string
+	// ReadOnly starts the session ignoring input; see SetReadOnly.
+	ReadOnly bool
+	// AllowShared lets an agent that edits its worktree (agent.Spec.Writes)
+	// start in one another such agent is running in.
+	AllowShared bool
+	// Image is the container image for container backends, overriding
+	// the backend's default.
+	Image string
+	// Sandbox overrides the container limits and network policy; only
+	// container backends accept it.
+	Sandbox *protocol.Sandbox
+	// Budget overrides the limits and action of the manager's budget.
+	Budget *protocol.Budget
+	// Placeholders, if set, are expanded in Task and the profile's
+	// arguments.
+	Placeholders *placeholder.Vars
+	// Env are KEY=value variables for the session (from the worktree's
+	// env files). Keys matching an EnvExclude glob are only given to
+	// sessions on the docker backend, which are sandboxed.
+	Env        []string
+	EnvExclude []string
+	// Launch, if set, starts the agent instead of the registry's command
+	// line; the manager's launcher sets it. See SetLauncher.
+	Launch *Launch
+	// Progress, if set, is told the stages the spawn reaches, from
+	// StageResolving to the agent's first output, or that it failed to
+	// start.
+	Progress Progress
+	// Requested is when the spawn was asked for, which the session's
+	// timing counts from; zero means when Spawn is called.
+	Requested time.Time
 }
 
 // Manager manages all active sessions (processes).
 type Manager struct {
-	sessions map[string]*Session
-	mu       sync.RWMutex
-	onData   func(processID string, data []byte)
-	onExit   func(processID string, exitCode int)
+	registry       *agent.Registry
+	sessions       map[string]*Session
+	agentSessions  map[string]AgentSessionRef
+	mu             sync.RWMutex
+	onData         func(processID string, data []byte)
+	onExit         func(processID string, exit ExitInfo)
+	onAgentSession func(processID, agentSessionID string)
+	backends       map[string]Backend
+	defaultBackend string
+	inputLimits    InputLimits
+	launcher       Launcher
+	// starting are the sessions being spawned while m.mu is released
+	starting map[string]TerminalSpec
+	// onFirstOutput, if set, is told when a spawned session first outputs
+	onFirstOutput func(Info)
+	// shellHistory gives sessions bash histories of their own, kept for
+	// shellHistoryRetention; see SetShellHistory
+	shellHistory          bool
+	shellHistoryRetention time.Duration
+	// budget is every session's budget unless its spawn overrides it
+	budget protocol.Budget
 }
 
 // NewManager creates a new session manager.
 func NewManager(
+	registry *agent.Registry,
 	onData func(processID string, data []byte),
-	onExit func(processID string, exitCode int),
+	onExit func(processID string, exit ExitInfo),
+	onAgentSession func(processID, agentSessionID string),
 ) *Manager {
 	return &Manager{
-		sessions: make(map[string]*Session),
-		onData:   onData,
-		onExit:   onExit,
+		registry:       registry,
+		sessions:       make(map[string]*Session),
+		agentSessions:  make(map[string]AgentSessionRef),
+		backends:       map[string]Backend{BackendPTY: ptyBackend{}},
+		defaultBackend: BackendPTY,
+		inputLimits:    DefaultInputLimits,
+		starting:       make(map[string]TerminalSpec),
+		onData:         onData,
+		onExit:         onExit,
+		onAgentSession: onAgentSession,
 	}
 }
 
-// Yolo mode flags for each agent CLI
-var agentYoloFlags = map[protocol.AgentType]string{
-	protocol.AgentClaudeCode:  "--dangerously-skip-permissions",
-	// `--full-auto` is still sandboxed (workspace-write). For YOLO mode we need
-	// unrestricted execution to match user expectation.
-	protocol.AgentCodexCLI:    "--ask-for-approval never --sandbox danger-full-access",
-	protocol.AgentCursorAgent: "--force",
-	protocol.AgentKimiCLI:     "--yolo",
+// Spawn creates a new session (process) and starts the agent.
+func (m *Manager) Spawn(opts SpawnOptions) error {
+	_, err := m.spawn(opts, false)
+	return err
 }
 
-// Spawn creates a new session (process) and starts the agent.
-func (m *Manager) Spawn(processID string, agent protocol.AgentType, worktreePath string, task string, cols, rows int, yoloMode bool) error {
+// SpawnPlan is what a spawn would start.
+type SpawnPlan struct {
+	Backend  string
+	Terminal TerminalSpec
+}
+
+// PlanSpawn checks opts and resolves the command line as Spawn would,
+// without starting anything or writing the agent's MCP config.
+func (m *Manager) PlanSpawn(opts SpawnOptions) (SpawnPlan, error) {
+	return m.spawn(opts, true)
+}
+
+// spawn starts a session, or with dryRun only returns what it would start.
+func (m *Manager) spawn(opts SpawnOptions, dryRun bool) (SpawnPlan, error) {
+	if opts.Requested.IsZero() {
+		opts.Requested = time.Now()
+	}
+	if opts.Progress != nil && !dryRun {
+		opts.Progress(StageResolving, "", nil)
+	}
+	// The launcher may take a while, so it's asked before locking
+	if err := m.launch(&opts); err != nil {
+		return SpawnPlan{}, err
+	}
+	historyEnv := m.shellHistoryEnv(opts, dryRun)
+
+	// A started session is reported once unlocked
+	var started *Session
+	defer func() {
+		if started != nil {
+			started.startup.start()
+		}
+	}()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, exists := m.sessions[processID]; exists {
-		return fmt.Errorf("process %s already exists", processID)
+	processID := opts.ProcessID
+	worktreePath := opts.WorktreePath
+	// dir is where the agent starts: the worktree or a package inside it,
+	// unless the agent's cwd strategy says otherwise
+	dir := filepath.Join(worktreePath, opts.Dir)
+	task := opts.Task
+	cols, rows := opts.Cols, opts.Rows
+
+	if _, exists := m.sessions[processID]; exists || m.isStarting(processID) {
+		return SpawnPlan{}, fmt.Errorf("process %s already exists", processID)
 	}
 
-	// Get the command for this agent
-	agentCmd, ok := protocol.AgentCommands[agent]
-	if !ok {
-		return fmt.Errorf("unknown agent type: %s", agent)
+	// Apply the profile, if any. Explicit spawn fields win over the profile.
+	model := opts.Model
+	var profileArgs []string
+	if opts.Profile != "" {
+		profile, ok := m.registry.Profile(opts.Profile)
+		if !ok {
+			return SpawnPlan{}, fmt.Errorf("unknown agent profile: %s", opts.Profile)
+		}
+		if opts.Agent == "" {
+			opts.Agent = profile.Agent
+		} else if opts.Agent != profile.Agent {
+			return SpawnPlan{}, fmt.Errorf("profile %s is for agent %s, not %s", opts.Profile, profile.Agent, opts.Agent)
+		}
+		if model == "" {
+			model = profile.Model
+		}
+		profileArgs = profile.Args
 	}
+	agent := opts.Agent
 
-	// Add yolo mode flag if enabled and agent supports it
-	if yoloMode {
-		if yoloFlag, hasYolo := agentYoloFlags[agent]; hasYolo {
-			agentCmd = agentCmd + " " + yoloFlag
+	if spec, ok := m.registry.Agent(agent); ok && spec.Cwd != "" {
+		start, err := startDir(spec.Cwd, worktreePath, dir, opts.Placeholders)
+		if err != nil {
+			return SpawnPlan{}, err
+		}
+		dir = start
+		if opts.Placeholders != nil {
+			vars := *opts.Placeholders
+			vars.Dir = dir
+			opts.Placeholders = &vars
+		}
+	}
+
+	// A shell task is a command line, so its values are quoted
+	if agent == protocol.AgentShell {
+		task = opts.Placeholders.ExpandShell(task)
+	} else {
+		task = opts.Placeholders.Expand(task)
+	}
+
+	backend, err := m.backend(opts.Backend)
+	if err != nil {
+		return SpawnPlan{}, err
+	}
+	if opts.Sandbox != nil && backend.Name() != BackendDocker {
+		return SpawnPlan{}, fmt.Errorf("sandbox requires the docker backend, not %s", backend.Name())
+	}
+	if backend.Name() == BackendDocker {
+		// Containers only have the worktree mounted
+		if rel, err := filepath.Rel(worktreePath, dir); err != nil || !filepath.IsLocal(rel) {
+			return SpawnPlan{}, fmt.Errorf("agent working directory %s is outside the worktree, which docker sessions can't reach", dir)
+		}
+	}
+
+	if spec, _ := m.registry.Agent(agent); spec.Writes && !opts.AllowShared {
+		if other, ok := m.writerInLocked(worktreePath); ok {
+			return SpawnPlan{}, fmt.Errorf("%w: %s is already editing %s; spawn with allowShared to share it", ErrWorktreeInUse, other, worktreePath)
 		}
 	}
 
-	// Build command and args
+	if cols <= 0 || rows <= 0 {
+		return SpawnPlan{}, fmt.Errorf("invalid initial terminal size cols=%d rows=%d", cols, rows)
+	}
+
+	// Build the command line, unless a plugin launches the agent: then the
+	// launch already has the task, model and flags applied.
 	var command string
-	var args []string
-	
-	if agent == protocol.AgentBash {
+	var args, agentEnv []string
+	var agentSessionID, mcpConfigPath string
+	// The agent's own command and how to install it, for a diagnosis
+	var agentCommand, install string
+	if opts.Launch != nil {
+		command, args = opts.Launch.Command, opts.Launch.Args
+	} else {
+		// Get the launch settings for this agent
+		spec, ok := m.registry.Agent(agent)
+		if !ok {
+			return SpawnPlan{}, fmt.Errorf("unknown agent type: %s", agent)
+		}
+		agentCommand, install = spec.Command, spec.Install
+		command, args, agentEnv, agentSessionID, mcpConfigPath, err = m.agentCommand(spec, opts, dir, task, model, profileArgs, dryRun)
+		if err != nil {
+			return SpawnPlan{}, err
+		}
+	}
+
+	// Spawn the process with initial terminal size. Backends may be slow
+	// (pulling a container image), so other sessions aren't held up.
+	terminal := TerminalSpec{
+		ProcessID:    processID,
+		Agent:        agent,
+		Command:      command,
+		Args:         args,
+		Dir:          dir,
+		Cols:         cols,
+		Rows:         rows,
+		WorktreePath: worktreePath,
+		Image:        opts.Image,
+		Sandbox:      opts.Sandbox,
+		Env:          sessionEnv(opts, backend),
+	}
+	if opts.Launch != nil {
+		terminal.Env = append(terminal.Env, opts.Launch.Env...)
+	}
+	terminal.Env = append(terminal.Env, agentEnv...)
+	terminal.Env = append(terminal.Env, historyEnv...)
+	terminal.Env = append(terminal.Env, EnvSessionID+"="+processID, EnvDaemonRun+"="+daemonRun)
+	plan := SpawnPlan{Backend: backend.Name(), Terminal: terminal}
+	if dryRun {
+		return plan, nil
+	}
+	m.starting[processID] = terminal
+	m.mu.Unlock()
+	if opts.Progress != nil {
+		opts.Progress(StageStarting, "", nil)
+	}
+	proc, err := backend.Spawn(terminal)
+	m.mu.Lock()
+	delete(m.starting, processID)
+	if err != nil {
+		releaseMCP(mcpConfigPath, processID)
+		return SpawnPlan{}, fmt.Errorf("failed to spawn process: %w", err)
+	}
+
+	session := &Session{
+		ID:             processID,
+		Agent:          agent,
+		WorktreePath:   worktreePath,
+		AgentSessionID: agentSessionID,
+		Group:          opts.Group,
+		Package:        opts.Package,
+		Process:        proc,
+		Started:        time.Now(),
+		backend:        backend,
+		mcpConfigPath:  mcpConfigPath,
+		requested:      opts.Requested,
+		spawnTime:      time.Since(opts.Requested),
+		output:         newRingBuffer(crashTailSize),
+		spec:           terminal,
+		diagnoser:      newDiagnoser(terminal, backend.Name(), agentCommand, install),
+	}
+	session.budget.limits = m.budget
+	if opts.Budget != nil {
+		session.budget.limits = budget.Merge(session.budget.limits, *opts.Budget)
+	}
+	session.startup = newStartupWatch(agent, opts.Progress, session.diagnoser)
+
+	session.readOnly.Store(opts.ReadOnly)
+	m.sessions[processID] = session
+
+	if agentSessionID != "" {
+		m.agentSessions[processID] = AgentSessionRef{
+			Agent:          agent,
+			WorktreePath:   worktreePath,
+			AgentSessionID: agentSessionID,
+		}
+		crash.Go("agent session", processID, func() { m.onAgentSession(processID, agentSessionID) })
+	} else if agent == protocol.AgentCodexCLI {
+		// Codex picks its own session id; find it in its session logs.
+		started := time.Now()
+		crash.Go("codex session discovery", processID, func() {
+			m.discoverCodexSession(processID, worktreePath, dir, started, proc.Done())
+		})
+	}
+
+	m.follow(session)
+	started = session
+
+	log.Printf("Spawned process %s: %s in %s", processID, command, dir)
+	return plan, nil
+}
+
+// agentCommand builds the command line that starts an agent with spec for
+// opts, giving the variables it needs set, its agent conversation id and
+// MCP config file, if any. The MCP config file is only written when not
+// dryRun.
+func (m *Manager) agentCommand(spec agent.Spec, opts SpawnOptions, dir, task, model string, profileArgs []string, dryRun bool) (command string, args, env []string, agentSessionID, mcpConfigPath string, err error) {
+	agentType := opts.Agent
+	var agentCmd commandLine
+	agentCmd.add(spec.Command)
+
+	yoloFlags := spec.YoloFlags
+	if opts.Headless && agentType != protocol.AgentBash && agentType != protocol.AgentShell {
+		if spec.HeadlessArgs == "" {
+			return "", nil, nil, "", "", fmt.Errorf("agent %s does not support headless mode", agentType)
+		}
+		if task == "" {
+			return "", nil, nil, "", "", fmt.Errorf("headless mode requires a task")
+		}
+		agentCmd.add(spec.HeadlessArgs)
+		if spec.HeadlessYoloFlags != "" {
+			yoloFlags = spec.HeadlessYoloFlags
+		}
+	}
+
+	// Resolve which agent conversation this session belongs to. Agents that
+	// accept a session id up front get a fresh one so it can be resumed later.
+	var resumeFlags string
+	resumeFlags, agentSessionID, err = m.resumeArgs(spec, opts)
+	if err != nil {
+		return "", nil, nil, "", "", err
+	}
+	agentCmd.add(resumeFlags)
+	if agentSessionID != "" {
+		agentCmd.value(agentSessionID)
+	}
+
+	// Add yolo mode flag if enabled and agent supports it
+	if opts.YoloMode {
+		agentCmd.add(yoloFlags)
+	}
+
+	if model != "" {
+		if spec.ModelFlag == "" {
+			return "", nil, nil, "", "", fmt.Errorf("agent %s does not support model selection", agentType)
+		}
+		agentCmd.add(spec.ModelFlag)
+		agentCmd.value(model)
+	}
+	for _, arg := range profileArgs {
+		agentCmd.value(opts.Placeholders.Expand(arg))
+	}
+
+	// Make MCP servers available, either via the agent's project config
+	// file (cleaned up on exit) or as config overrides on the command line.
+	mcpServers := mcp.Merge(m.registry.MCPServers(), opts.MCPServers)
+	if len(mcpServers) > 0 && spec.SupportsMCP() {
+		if spec.MCPConfigFile != "" {
+			mcpConfigPath = filepath.Join(dir, spec.MCPConfigFile)
+			if !dryRun {
+				if err := mcp.Install(mcpConfigPath, opts.ProcessID, mcpServers); err != nil {
+					return "", nil, nil, "", "", fmt.Errorf("failed to write MCP config: %w", err)
+				}
+			}
+		} else {
+			var overrides []string
+			overrides, env, err = mcp.ConfigOverrides(mcpServers)
+			if err != nil {
+				return "", nil, nil, "", "", err
+			}
+			for _, override := range overrides {
+				agentCmd.add(spec.ConfigOverrideFlag)
+				agentCmd.value(override)
+			}
+		}
+	} else if len(opts.MCPServers) > 0 {
+		return "", nil, nil, "", "", fmt.Errorf("agent %s does not support MCP servers", agentType)
+	}
+
+	if agentType == protocol.AgentBash {
 		// For bash, run an interactive login shell directly
-		command = agentCmd
+		command = spec.Command
 		args = []string{"-l"}
-	} else if agent == protocol.AgentShell {
+	} else if agentType == protocol.AgentShell {
 		// For shell, run the task as a one-shot command
 		// If no task provided, fall back to interactive shell
 		if task != "" {
@@ -95,79 +507,122 @@ func (m *Manager) Spawn(processID string, agent protocol.AgentType, worktreePath
 		// get in a normal terminal tab (.bashrc/.profile-driven PATH, aliases, etc).
 		// Keep terminal alive after agent exits by replacing with another shell.
 		command = "bash"
-		
-		// If task is provided, pass it as initial prompt to the agent (interactive mode)
-		fullCmd := agentCmd
+
+		// If task is provided, pass it as initial prompt to the agent
+		// (interactive mode). Different agents have different prompt
+		// flags; most accept the prompt as a positional arg.
 		if task != "" {
-			// Escape single quotes in task and wrap in single quotes
-			escapedTask := strings.ReplaceAll(task, "'", "'\\''")
-			// Different agents have different prompt flags
-			if agent == protocol.AgentKimiCLI {
-				// kimi uses -p or --prompt for initial prompt
-				fullCmd = agentCmd + " -p '" + escapedTask + "'"
-			} else {
-				// claude, codex, cursor-agent accept prompt as positional arg
-				fullCmd = agentCmd + " '" + escapedTask + "'"
-			}
+			agentCmd.add(spec.PromptFlag)
+			agentCmd.value(task)
 		}
-		
-		args = []string{"-i", "-l", "-c", fullCmd + "; exec bash -il"}
-	}
 
-	if cols <= 0 || rows <= 0 {
-		return fmt.Errorf("invalid initial terminal size cols=%d rows=%d", cols, rows)
-	}
-
-	// Spawn the process with initial terminal size
-	proc, err := pty.Spawn(command, args, worktreePath, nil, cols, rows)
-	if err != nil {
-		return fmt.Errorf("failed to spawn process: %w", err)
+		script := agentCmd.script()
+		if !opts.Headless {
+			script += "; exec bash -il"
+		}
+		args = agentCmd.bashArgs([]string{"-i", "-l"}, script)
 	}
 
-	session := &Session{
-		ID:           processID,
-		Agent:        agent,
-		WorktreePath: worktreePath,
-		Process:      proc,
-	}
+	return command, args, env, agentSessionID, mcpConfigPath, nil
+}
 
-	m.sessions[processID] = session
+// follow streams a session's output and reports its exit.
+func (m *Manager) follow(session *Session) {
+	processID := session.ID
+	proc := session.Process
 
 	// Start reading PTY output
 	// Note: We don't clear the buffer on clear screen sequences anymore.
 	// The clear sequences stay in the buffer and execute on replay, preserving
 	// terminal state (cursor visibility, colors, etc.) that was set before the clear.
 	proc.StartReadLoop(func(data []byte) {
+		defer crash.Recover("session output", processID)
+		session.outputBytes.Add(int64(len(data)))
+		session.output.Write(data)
+		session.paste.observe(data)
+		m.noteFirstOutput(session)
+		session.startup.write(data)
 		m.onData(processID, data)
 	})
 
 	// Wait for process exit in background
 	go func() {
+		defer crash.Recover("session wait", processID)
 		exitCode, err := proc.Wait()
 		if err != nil {
 			log.Printf("Process %s wait error: %v", processID, err)
 		}
 		proc.Close()
-		m.onExit(processID, exitCode)
-		m.remove(processID)
+		if session.detached.Load() {
+			return
+		}
+		exit := classifyExit(exitCode, proc.Signal(), session.killed.Load(), session.output.Bytes())
+		if detail := session.budget.killedOver(); detail != "" {
+			exit.Reason, exit.Detail = ExitBudget, detail
+		}
+		if (exit.Code == commandNotFound || exit.Code == commandNotExecutable) && session.diagnoser != nil && session.Agent != protocol.AgentBash {
+			if command, message := diagnoseStart(session.output.Bytes()); command != "" {
+				exit.Diagnosis = session.diagnoser.diagnose(command, message)
+			}
+		}
+		if exit.Reason != ExitCompleted {
+			log.Printf("Process %s exited: reason=%s code=%d signal=%s detail=%s", processID, exit.Reason, exit.Code, exit.Signal, exit.Detail)
+		}
+		m.exit(session, exit)
 	}()
+}
 
-	log.Printf("Spawned process %s: %s in %s", processID, command, worktreePath)
-	return nil
+// exit reports a session's exit and forgets it, unless that has already
+// happened.
+func (m *Manager) exit(session *Session, exit ExitInfo) {
+	session.exited.Do(func() {
+		releaseMCP(session.mcpConfigPath, session.ID)
+		m.onExit(session.ID, exit)
+		m.remove(session.ID)
+	})
 }
 
-// Input sends input to a process's PTY.
-func (m *Manager) Input(processID string, data []byte) error {
-	m.mu.RLock()
+// Abort ends a session the daemon can no longer look after, such as one
+// whose goroutine panicked: its process is killed and it is reported as
+// exited with ExitInternalError. A session still being spawned is
+// forgotten, so its processID can be used again.
+func (m *Manager) Abort(processID, detail string) {
+	m.mu.Lock()
 	session, ok := m.sessions[processID]
-	m.mu.RUnlock()
+	delete(m.starting, processID)
+	m.mu.Unlock()
 
 	if !ok {
-		return fmt.Errorf("process %s not found", processID)
+		return
 	}
+	session.killed.Store(true)
+	session.Process.Kill()
+	session.Process.Close()
+	log.Printf("Process %s aborted: %s", processID, detail)
+	m.exit(session, ExitInfo{Code: -1, Reason: ExitInternalError, Detail: detail})
 
-	_, err := session.Process.Write(data)
-	return err
+	// The panic may have cut an earlier exit report short
+	m.mu.Lock()
+	if m.sessions[processID] == session {
+		delete(m.sessions, processID)
+	}
+	m.mu.Unlock()
+}
+
+// Input sends unattributed input to a process's PTY; see InputFrom.
+func (m *Manager) Input(processID string, data []byte) error {
+	return m.InputFrom(processID, "", data)
+}
+
+// PasteImage types the path of an image file into a process the way its
+// agent expects images to be handed over.
+func (m *Manager) PasteImage(processID, user, path string) error {
+	session, err := m.get(processID)
+	if err != nil {
+		return err
+	}
+	spec, _ := m.registry.Agent(session.Agent)
+	return m.InputFrom(processID, user, []byte(spec.ImageInput(path)))
 }
 
 // Resize resizes a process's PTY.
@@ -206,9 +661,45 @@ func (m *Manager) Kill(processID string) error {
 		return fmt.Errorf("process %s not found", processID)
 	}
 
+	session.killed.Store(true)
 	return session.Process.Kill()
 }
 
+// releaseMCP removes a session's servers from an MCP config file, if any.
+func releaseMCP(path, processID string) {
+	if path == "" {
+		return
+	}
+	if err := mcp.Release(path, processID); err != nil {
+		log.Printf("Failed to clean up MCP config %s: %v", path, err)
+	}
+}
+
+// sessionEnv returns the variables to set for a session on backend.
+func sessionEnv(opts SpawnOptions, backend Backend) []string {
+	if backend.Name() == BackendDocker || len(opts.EnvExclude) == 0 {
+		return opts.Env
+	}
+	var env []string
+	for _, kv := range opts.Env {
+		key, _, _ := strings.Cut(kv, "=")
+		if !slices.ContainsFunc(opts.EnvExclude, func(pattern string) bool {
+			ok, _ := path.Match(pattern, key)
+			return ok
+		}) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// Ping takes and releases the manager's lock, so a watchdog can tell it
+// isn't deadlocked.
+func (m *Manager) Ping() {
+	m.mu.Lock()
+	m.mu.Unlock()
+}
+
 // remove removes a process from the manager.
 func (m *Manager) remove(processID string) {
 	m.mu.Lock()
@@ -216,14 +707,21 @@ func (m *Manager) remove(processID string) {
 	delete(m.sessions, processID)
 }
 
-// KillAll terminates all sessions.
+// KillAll terminates all sessions. Sessions on persistent backends are
+// detached instead and keep running, to be adopted by the next daemon.
 func (m *Manager) KillAll() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	for _, session := range m.sessions {
+		if session.backend.Persistent() {
+			session.detached.Store(true)
+			session.Process.Close()
+			continue
+		}
 		session.Process.Kill()
 		session.Process.Close()
+		releaseMCP(session.mcpConfigPath, session.ID)
 	}
 	m.sessions = make(map[string]*Session)
 }
@@ -0,0 +1,249 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Variables marking every session's processes, and those they start, so
+// processes left behind by an earlier run of the daemon can be found.
+const (
+	// EnvSessionID is the processID of the session.
+	EnvSessionID = "AGENTHQ_SESSION_ID"
+	// EnvDaemonRun identifies the daemon run that spawned the session.
+	EnvDaemonRun = "AGENTHQ_DAEMON_RUN"
+)
+
+// daemonRun identifies this run of the daemon: its PID, which a restart in
+// place keeps, and when it started.
+var daemonRun = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+
+// orphanKillGrace is how long orphans get to exit after SIGTERM before
+// they are killed.
+const orphanKillGrace = 5 * time.Second
+
+// Orphan is a process a session of an earlier daemon run left running.
+type Orphan struct {
+	PID int
+	// ProcessID is the session it belongs to
+	ProcessID string
+	Command   string
+	// Err is why it couldn't be killed, if it couldn't
+	Err error
+}
+
+// markedProcess is a process with a session's marker variables.
+type markedProcess struct {
+	pid                  int
+	processID, daemonRun string
+	command              string
+	// cpu is the CPU time it used, with that of its waited-for children
+	// on Linux
+	cpu time.Duration
+}
+
+// Orphans returns the processes that sessions of earlier daemon runs left
+// running: those marked by a run whose daemon is gone, except the
+// processes of running sessions, such as ones adopted from that run.
+func (m *Manager) Orphans() ([]Orphan, error) {
+	processes, err := markedProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var orphans []Orphan
+	for _, p := range processes {
+		if p.pid == os.Getpid() || p.daemonRun == daemonRun || daemonRunning(p.daemonRun) {
+			continue
+		}
+		if _, running := m.sessions[p.processID]; running || m.isStarting(p.processID) {
+			continue
+		}
+		orphans = append(orphans, Orphan{PID: p.pid, ProcessID: p.processID, Command: p.command})
+	}
+	return orphans, nil
+}
+
+// KillOrphans terminates orphans, killing those still running after
+// orphanKillGrace, and returns them with any errors set.
+func KillOrphans(orphans []Orphan) []Orphan {
+	for i := range orphans {
+		if err := syscall.Kill(orphans[i].PID, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+			orphans[i].Err = err
+		}
+	}
+
+	deadline := time.Now().Add(orphanKillGrace)
+	for {
+		alive := false
+		for _, o := range orphans {
+			if o.Err == nil && processAlive(o.PID) {
+				alive = true
+			}
+		}
+		if !alive || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for i, o := range orphans {
+		if o.Err != nil || !processAlive(o.PID) {
+			continue
+		}
+		if err := syscall.Kill(o.PID, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+			orphans[i].Err = err
+		}
+	}
+	return orphans
+}
+
+// daemonRunning reports whether the daemon of a run may still be running:
+// its process exists and hasn't been replaced by a restart in place.
+func daemonRunning(run string) bool {
+	pidText, _, _ := strings.Cut(run, "-")
+	pid, err := strconv.Atoi(pidText)
+	if err != nil || pid <= 0 {
+		return false
+	}
+	// This process is a later run of the daemon
+	if pid == os.Getpid() {
+		return false
+	}
+	return processAlive(pid)
+}
+
+// processAlive reports whether a process exists, zombies included.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// markedProcesses returns the daemon user's processes with a session's
+// marker variables.
+func markedProcesses() ([]markedProcess, error) {
+	if runtime.GOOS != "linux" {
+		return markedProcessesPS()
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var processes []markedProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Other users' processes can't be read, nor be the daemon's
+		env, err := processEnv(pid)
+		if err != nil {
+			continue
+		}
+		p := markedProcess{pid: pid, processID: lookupEnv(env, EnvSessionID), daemonRun: lookupEnv(env, EnvDaemonRun)}
+		if p.processID == "" || p.daemonRun == "" {
+			continue
+		}
+		if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+			p.command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		}
+		p.cpu = procCPU(pid)
+		processes = append(processes, p)
+	}
+	return processes, nil
+}
+
+// clockTicks is the unit of /proc's CPU times, USER_HZ, which is 100 on
+// every Linux architecture the daemon runs on.
+const clockTicks = 100
+
+// procCPU returns the user and system time a process and its waited-for
+// children used, or 0 if it can't be read.
+func procCPU(pid int) time.Duration {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name in parentheses may contain spaces; utime, stime,
+	// cutime and cstime are the 14th to 17th fields
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 15 {
+		return 0
+	}
+	var ticks int64
+	for _, f := range fields[11:15] {
+		n, _ := strconv.ParseInt(f, 10, 64)
+		ticks += n
+	}
+	return time.Duration(ticks) * time.Second / clockTicks
+}
+
+// parsePSTime parses ps(1)'s cputime, "[dd-]hh:mm:ss" or "mm:ss.cc".
+func parsePSTime(s string) time.Duration {
+	var d time.Duration
+	if days, rest, ok := strings.Cut(s, "-"); ok {
+		n, _ := strconv.Atoi(days)
+		d, s = time.Duration(n)*24*time.Hour, rest
+	}
+	s, frac, _ := strings.Cut(s, ".")
+	var secs int64
+	for _, part := range strings.Split(s, ":") {
+		n, _ := strconv.ParseInt(part, 10, 64)
+		secs = secs*60 + n
+	}
+	d += time.Duration(secs) * time.Second
+	if frac != "" {
+		n, _ := strconv.Atoi(frac)
+		for i := len(frac); i < 9; i++ {
+			n *= 10
+		}
+		d += time.Duration(n)
+	}
+	return d
+}
+
+// markedProcessesPS finds marked processes with ps(1), which shows the
+// environment after each command line for the user's own processes.
+func markedProcessesPS() ([]markedProcess, error) {
+	out, err := exec.Command("ps", "-E", "-ww", "-U", strconv.Itoa(os.Getuid()), "-o", "pid=", "-o", "time=", "-o", "command=").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ps: %w", err)
+	}
+	var processes []markedProcess
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		p := markedProcess{pid: pid, cpu: parsePSTime(fields[1]), command: fields[2]}
+		for _, field := range fields[3:] {
+			if v, ok := strings.CutPrefix(field, EnvSessionID+"="); ok {
+				p.processID = v
+			} else if v, ok := strings.CutPrefix(field, EnvDaemonRun+"="); ok {
+				p.daemonRun = v
+			}
+		}
+		if p.processID != "" && p.daemonRun != "" {
+			processes = append(processes, p)
+		}
+	}
+	return processes, nil
+}
@@ -0,0 +1,117 @@
+package session
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Large input is written to a terminal inputChunk bytes at a time, with
+// inputChunkPause between chunks, so that a program reading it can keep
+// up instead of the terminal's input buffer filling up.
+const (
+	inputChunk      = 4096
+	inputChunkPause = 2 * time.Millisecond
+)
+
+var (
+	// privateModeRe matches DECSET and DECRST, which set and reset DEC
+	// private modes, and a full reset (RIS)
+	privateModeRe = regexp.MustCompile(`\x1b\[\?([0-9;]*)([hl])|\x1bc`)
+	// partialModeRe matches the start of a DECSET or DECRST cut off at
+	// the end of a read
+	partialModeRe = regexp.MustCompile(`\x1b(\[(\?[0-9;]*)?)?$`)
+)
+
+// pasteMode follows whether the program in a session's terminal enabled
+// bracketed paste (DEC private mode 2004), from the session's output.
+type pasteMode struct {
+	mu sync.Mutex
+	on bool
+	// tail is the start of a mode change cut off at the end of the last
+	// output
+	tail []byte
+}
+
+// observe notes the mode changes in a session's output.
+func (p *pasteMode) observe(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buf := data
+	if len(p.tail) > 0 {
+		buf = append(p.tail, data...)
+	}
+	for _, m := range privateModeRe.FindAllSubmatch(buf, -1) {
+		if m[2] == nil {
+			p.on = false
+			continue
+		}
+		for _, mode := range bytes.Split(m[1], []byte{';'}) {
+			if string(mode) == "2004" {
+				p.on = m[2][0] == 'h'
+			}
+		}
+	}
+	p.tail = bytes.Clone(partialModeRe.Find(buf))
+}
+
+// enabled reports whether bracketed paste is on.
+func (p *pasteMode) enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.on
+}
+
+// BracketedPaste reports whether the program in a session's terminal
+// enabled bracketed paste, so pasted text should be wrapped in its
+// markers.
+func (m *Manager) BracketedPaste(processID string) (bool, error) {
+	session, err := m.get(processID)
+	if err != nil {
+		return false, err
+	}
+	return session.paste.enabled(), nil
+}
+
+// writeInput writes input to a session's terminal, in chunks if it is
+// large. Input is written whole before other input to the session.
+func (s *Session) writeInput(data []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	written := 0
+	for len(data) > 0 {
+		if written > 0 {
+			time.Sleep(inputChunkPause)
+		}
+		chunk := data[:chunkEnd(data)]
+		n, err := s.Process.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[len(chunk):]
+	}
+	return written, nil
+}
+
+// chunkEnd returns where the next chunk of data ends: after at most
+// inputChunk bytes, and not inside a character or a short escape sequence,
+// which a program could take for an Escape key press if the rest comes
+// later.
+func chunkEnd(data []byte) int {
+	if len(data) <= inputChunk {
+		return len(data)
+	}
+	end := inputChunk
+	if i := bytes.LastIndexByte(data[end-8:end], 0x1b); i >= 0 {
+		end -= 8 - i
+	}
+	for end > 1 && !utf8.RuneStart(data[end]) {
+		end--
+	}
+	return end
+}
@@ -0,0 +1,118 @@
+package session
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/agenthq/daemon/internal/crash"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Spawn stages, in the order a spawn reaches them. The daemon reports
+// StageSizePending, only for a spawn without a terminal size, StageQueued,
+// only for a spawn that has to wait for a free slot, and StagePreparing
+// itself; the manager reports the others to
+// SpawnOptions.Progress.
+const (
+	StageSizePending = "size-pending" // waiting for the terminal size the spawn left out
+	StageQueued      = "queued"       // waiting for a session to end, with why, in detail
+	StagePreparing   = "preparing"    // reading the worktree's config and env files
+	StageResolving   = "resolving"    // the launcher, profile, agent and command line
+	StageStarting    = "starting"     // the terminal on its backend (container images included)
+	StageStarted     = "started"      // the process runs
+	StageReady       = "ready"        // the agent printed its first output
+	StageFailed      = "failed"       // with why, in detail
+)
+
+// Progress is told each stage a spawn reaches, and for StageFailed why:
+// with a diagnosis if the wrapper shell couldn't run the agent.
+type Progress func(stage, detail string, diagnosis *protocol.AgentDiagnosis)
+
+// Output in the first startupWindow of a session, up to
+// startupOutputLimit, is checked for signs that its agent didn't start.
+const (
+	startupWindow      = 10 * time.Second
+	startupOutputLimit = 16 * 1024
+)
+
+// startFailure matches the wrapper shell failing to run a command, e.g.
+// "bash: line 1: claude: command not found"; the groups are the command and
+// the message.
+var startFailure = regexp.MustCompile(`(?m)^bash: (?:line \d+: )?(\S+): (command not found|No such file or directory|Permission denied)`)
+
+// diagnoseStart returns the command output shows the wrapper shell failed
+// to run and its message, or "" if none.
+func diagnoseStart(output []byte) (command, message string) {
+	text := ansiRe.ReplaceAll(output, nil)
+	text = crlfRe.ReplaceAll(text, []byte("\n"))
+	if m := startFailure.FindSubmatch(text); m != nil {
+		return string(m[1]), string(m[2])
+	}
+	return "", ""
+}
+
+// startupWatch reports that a new session started, then its first output
+// or that its agent failed to start.
+type startupWatch struct {
+	progress  Progress
+	diagnoser *diagnoser
+	// started is closed once StageStarted was reported, which the output
+	// waits for
+	started chan struct{}
+
+	// The rest is only used by the session's read loop. diagnose is unset
+	// for plain shells, where a mistyped command is no failure.
+	diagnose bool
+	until    time.Time
+	output   []byte
+	ready    bool
+}
+
+func newStartupWatch(agent protocol.AgentType, progress Progress, diagnoser *diagnoser) *startupWatch {
+	if progress == nil {
+		return nil
+	}
+	return &startupWatch{
+		progress:  progress,
+		diagnoser: diagnoser,
+		started:   make(chan struct{}),
+		diagnose:  agent != protocol.AgentBash,
+		until:     time.Now().Add(startupWindow),
+	}
+}
+
+// start reports the session started.
+func (w *startupWatch) start() {
+	if w == nil {
+		return
+	}
+	w.progress(StageStarted, "", nil)
+	close(w.started)
+}
+
+// write looks at a session's output.
+func (w *startupWatch) write(data []byte) {
+	if w == nil {
+		return
+	}
+	<-w.started
+	if w.diagnose && time.Now().Before(w.until) && len(w.output) < startupOutputLimit {
+		w.output = append(w.output, data...)
+		if command, message := diagnoseStart(w.output); command != "" {
+			// No ready follows, though the session runs on in its shell.
+			// Diagnosing asks a login shell, so output isn't held up.
+			w.diagnose, w.output, w.ready = false, nil, true
+			go func() {
+				defer crash.Recover("spawn progress", w.diagnoser.terminal.ProcessID)
+				w.progress(StageFailed, command+": "+message, w.diagnoser.diagnose(command, message))
+			}()
+			return
+		}
+	} else {
+		w.diagnose, w.output = false, nil
+	}
+	if !w.ready {
+		w.ready = true
+		w.progress(StageReady, "", nil)
+	}
+}
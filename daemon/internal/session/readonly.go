@@ -0,0 +1,24 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned by Input for a read-only session.
+var ErrReadOnly = errors.New("session is read-only")
+
+// SetReadOnly makes a session ignore input (or accept it again), e.g. while
+// it is shared with observers.
+func (m *Manager) SetReadOnly(processID string, readOnly bool) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[processID]
+	if !ok {
+		return fmt.Errorf("process %s not found", processID)
+	}
+
+	session.readOnly.Store(readOnly)
+	return nil
+}
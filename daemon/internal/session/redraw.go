@@ -0,0 +1,26 @@
+package session
+
+import "errors"
+
+// ErrNoRedraw is returned by Redraw for terminals that can't repaint.
+var ErrNoRedraw = errors.New("terminal can't redraw its screen")
+
+// Redrawer is implemented by terminals that can repaint their whole screen
+// on request; the repaint arrives through the read loop like other output.
+type Redrawer interface {
+	Redraw() error
+}
+
+// Redraw makes a session's terminal repaint its whole screen through its
+// output.
+func (m *Manager) Redraw(processID string) error {
+	session, err := m.get(processID)
+	if err != nil {
+		return err
+	}
+	r, ok := session.Process.(Redrawer)
+	if !ok {
+		return ErrNoRedraw
+	}
+	return r.Redraw()
+}
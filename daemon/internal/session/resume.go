@@ -0,0 +1,171 @@
+package session
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/agenthq/daemon/internal/agent"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/transcript"
+)
+
+// AgentSessionRef records which agent conversation a process ran so a later
+// spawn can resume it. Entries outlive the process itself.
+type AgentSessionRef struct {
+	Agent          protocol.AgentType
+	WorktreePath   string
+	AgentSessionID string
+}
+
+// codexDiscoveryTimeout bounds how long we look for a new codex session log.
+const codexDiscoveryTimeout = 2 * time.Minute
+
+// resumeArgs returns the extra agent flags needed to start or resume the
+// conversation for opts, and the agent session id the new process will use
+// (empty if not known yet), which is passed right after the flags. Must be
+// called with m.mu held.
+func (m *Manager) resumeArgs(spec agent.Spec, opts SpawnOptions) (string, string, error) {
+	if opts.ResumeOf == "" {
+		if spec.SessionIDFlag != "" {
+			id, err := newUUID()
+			if err != nil {
+				return "", "", fmt.Errorf("failed to generate agent session id: %w", err)
+			}
+			return spec.SessionIDFlag, id, nil
+		}
+		return "", "", nil
+	}
+
+	if !spec.CanResume() {
+		return "", "", fmt.Errorf("agent %s does not support resuming sessions", opts.Agent)
+	}
+
+	ref, known := m.agentSessions[opts.ResumeOf]
+	if !known {
+		if spec.ContinueArgs == "" {
+			return "", "", fmt.Errorf("no agent session recorded for process %s", opts.ResumeOf)
+		}
+		log.Printf("No agent session recorded for process %s, continuing most recent conversation", opts.ResumeOf)
+		return spec.ContinueArgs, "", nil
+	}
+
+	if ref.Agent != opts.Agent {
+		return "", "", fmt.Errorf("process %s ran %s, cannot resume it with %s", opts.ResumeOf, ref.Agent, opts.Agent)
+	}
+	if filepath.Clean(ref.WorktreePath) != filepath.Clean(opts.WorktreePath) {
+		return "", "", fmt.Errorf("process %s ran in %s, cannot resume it in %s", opts.ResumeOf, ref.WorktreePath, opts.WorktreePath)
+	}
+	if spec.ResumeArgs == "" {
+		return spec.ContinueArgs, "", nil
+	}
+
+	return spec.ResumeArgs, ref.AgentSessionID, nil
+}
+
+// AgentSession returns the agent conversation recorded for a process,
+// including processes that have already exited.
+func (m *Manager) AgentSession(processID string) (AgentSessionRef, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ref, ok := m.agentSessions[processID]
+	return ref, ok
+}
+
+// setAgentSession records a discovered agent session id for a process.
+func (m *Manager) setAgentSession(processID string, ref AgentSessionRef) {
+	m.mu.Lock()
+	m.agentSessions[processID] = ref
+	if session, ok := m.sessions[processID]; ok {
+		session.AgentSessionID = ref.AgentSessionID
+	}
+	m.mu.Unlock()
+
+	m.onAgentSession(processID, ref.AgentSessionID)
+}
+
+// discoverCodexSession polls codex's session log directory for the rollout
+// file created by a newly spawned process, which ran in dir, and records its
+// session id.
+func (m *Manager) discoverCodexSession(processID, worktreePath, dir string, since time.Time, done <-chan struct{}) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	timeout := time.After(codexDiscoveryTimeout)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			log.Printf("No codex session log found for process %s", processID)
+			return
+		case <-ticker.C:
+		}
+
+		id := findCodexSession(transcript.CodexSessionsDir(), dir, since)
+		if id == "" {
+			continue
+		}
+
+		log.Printf("Process %s is codex session %s", processID, id)
+		m.setAgentSession(processID, AgentSessionRef{
+			Agent:          protocol.AgentCodexCLI,
+			WorktreePath:   worktreePath,
+			AgentSessionID: id,
+		})
+		return
+	}
+}
+
+// findCodexSession returns the id of the newest codex session log modified
+// after since whose recorded cwd is worktreePath.
+func findCodexSession(dir, worktreePath string, since time.Time) string {
+	if dir == "" {
+		return ""
+	}
+
+	// Logs are laid out as sessions/YYYY/MM/DD/rollout-*.jsonl. Look at today
+	// and yesterday to cover spawns around midnight.
+	var candidates []string
+	for _, day := range []time.Time{since, since.AddDate(0, 0, -1)} {
+		pattern := filepath.Join(dir, day.Format("2006"), day.Format("01"), day.Format("02"), "rollout-*.jsonl")
+		matches, _ := filepath.Glob(pattern)
+		candidates = append(candidates, matches...)
+	}
+
+	var bestID string
+	var bestTime time.Time
+	for _, path := range candidates {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Before(since) {
+			continue
+		}
+		id, cwd := transcript.ReadCodexSessionMeta(path)
+		if id == "" {
+			continue
+		}
+		if cwd != "" && filepath.Clean(cwd) != filepath.Clean(worktreePath) {
+			continue
+		}
+		if info.ModTime().After(bestTime) {
+			bestID = id
+			bestTime = info.ModTime()
+		}
+	}
+	return bestID
+}
+
+// newUUID returns a random (version 4) UUID string.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
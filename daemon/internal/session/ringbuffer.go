@@ -0,0 +1,58 @@
+package session
+
+import "sync"
+
+// ringBuffer keeps the most recent bytes of a session's output.
+type ringBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+	// start is the index of the oldest byte once the buffer has wrapped.
+	start int
+	full  bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, 0, size), size: size}
+}
+
+// Write appends data, discarding the oldest bytes once capacity is reached.
+func (r *ringBuffer) Write(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(data) >= r.size {
+		r.buf = append(r.buf[:0], data[len(data)-r.size:]...)
+		r.start = 0
+		r.full = true
+		return
+	}
+
+	for len(data) > 0 {
+		if !r.full {
+			n := min(r.size-len(r.buf), len(data))
+			r.buf = append(r.buf, data[:n]...)
+			data = data[n:]
+			if len(r.buf) == r.size {
+				r.full = true
+			}
+			continue
+		}
+		n := copy(r.buf[r.start:], data)
+		r.start = (r.start + n) % r.size
+		data = data[n:]
+	}
+}
+
+// Bytes returns a copy of the buffered data, oldest first.
+func (r *ringBuffer) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]byte, 0, len(r.buf))
+	if !r.full {
+		return append(out, r.buf...)
+	}
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:r.start]...)
+}
@@ -0,0 +1,128 @@
+package session
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// DefaultShellHistoryRetention is how long a session's shell history is
+// kept after it was last written, unless SetShellHistory says otherwise.
+const DefaultShellHistoryRetention = 7 * 24 * time.Hour
+
+// SetShellHistory gives sessions spawned from now on a bash history of
+// their own (see ShellHistoryFile) instead of the user's, and sets how long
+// histories are kept after they were last written (0 for the default).
+func (m *Manager) SetShellHistory(enabled bool, retention time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shellHistory = enabled
+	m.shellHistoryRetention = cmp.Or(retention, DefaultShellHistoryRetention)
+}
+
+// ShellHistoryFile returns the file that holds the bash history of a
+// session in a worktree, in worktree.ShellHistoryDir, so that it goes away
+// with the worktree.
+func ShellHistoryFile(worktreePath, processID string) (string, error) {
+	name := url.PathEscape(processID)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid process ID %q", processID)
+	}
+	return filepath.Join(worktree.ShellHistoryDir(worktreePath), name), nil
+}
+
+// shellHistoryEnv returns the variables that point a session's shells at
+// its own history file, creating its directory and pruning the histories
+// there that are past retention, or nil if sessions share the user's
+// history. PROMPT_COMMAND appends each command as it runs, so the history
+// survives a session that is killed; a profile setting its own takes over
+// and the history is written when the shell exits.
+func (m *Manager) shellHistoryEnv(opts SpawnOptions, dryRun bool) []string {
+	m.mu.RLock()
+	enabled, retention := m.shellHistory, m.shellHistoryRetention
+	m.mu.RUnlock()
+	if !enabled || opts.WorktreePath == "" {
+		return nil
+	}
+
+	file, err := ShellHistoryFile(opts.WorktreePath, opts.ProcessID)
+	if err != nil {
+		log.Printf("Failed to set up shell history for %s: %v", opts.ProcessID, err)
+		return nil
+	}
+	if !dryRun {
+		dir := filepath.Dir(file)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			log.Printf("Failed to set up shell history for %s: %v", opts.ProcessID, err)
+			return nil
+		}
+		m.pruneShellHistories(dir, retention)
+	}
+	return []string{"HISTFILE=" + file, "PROMPT_COMMAND=history -a"}
+}
+
+// pruneShellHistories removes the histories in dir last written more than
+// retention ago, other than those of running sessions.
+func (m *Manager) pruneShellHistories(dir string, retention time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	m.mu.RLock()
+	running := make(map[string]bool, len(m.sessions))
+	for id := range m.sessions {
+		running[url.PathEscape(id)] = true
+	}
+	m.mu.RUnlock()
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || running[e.Name()] || time.Since(info.ModTime()) < retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove shell history %s: %v", e.Name(), err)
+		}
+	}
+}
+
+// ReadShellHistory returns the commands in a bash history file, oldest
+// first, with the times bash wrote as "#<seconds>" comments before them.
+func ReadShellHistory(path string) ([]protocol.ShellCommand, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var commands []protocol.ShellCommand
+	var at int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rest, ok := strings.CutPrefix(line, "#"); ok {
+			if secs, err := strconv.ParseInt(rest, 10, 64); err == nil {
+				at = secs * 1000
+				continue
+			}
+		}
+		if line == "" {
+			continue
+		}
+		commands = append(commands, protocol.ShellCommand{Command: line, Time: at})
+		at = 0
+	}
+	return commands, scanner.Err()
+}
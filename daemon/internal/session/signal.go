@@ -0,0 +1,52 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// ErrNoSignal is returned by SignalFrom for terminals that can't signal
+// their foreground process group.
+var ErrNoSignal = errors.New("terminal can't signal its foreground process")
+
+// ForegroundSignaler is implemented by terminals that can send a signal to
+// their foreground process group, as the terminal's signal keys would.
+type ForegroundSignaler interface {
+	SignalForeground(sig syscall.Signal) error
+}
+
+// inputSignals are the signals input can send, by name: those a terminal's
+// keys send, and the ones that end a program.
+var inputSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTSTP": syscall.SIGTSTP,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGHUP":  syscall.SIGHUP,
+}
+
+// SignalFrom sends a signal, by name (e.g. "SIGINT"), to the foreground
+// process group of a session's terminal as input attributed to user: a
+// read-only session or another user's input lease refuse it, as they do
+// InputFrom's input.
+func (m *Manager) SignalFrom(processID, user, signal string) error {
+	sig, ok := inputSignals[signal]
+	if !ok {
+		return fmt.Errorf("unsupported signal %q", signal)
+	}
+	session, err := m.get(processID)
+	if err != nil {
+		return err
+	}
+	if err := m.admitInput(session, user, 0); err != nil {
+		return err
+	}
+	s, ok := session.Process.(ForegroundSignaler)
+	if !ok {
+		return ErrNoSignal
+	}
+	log.Printf("Sending %s to the foreground of %s", signal, processID)
+	return s.SignalForeground(sig)
+}
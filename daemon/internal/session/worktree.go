@@ -0,0 +1,68 @@
+package session
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// ErrWorktreeInUse is returned for a spawn of an agent that edits its
+// worktree into one another such agent is running in, unless the spawn
+// allows sharing it.
+var ErrWorktreeInUse = errors.New("worktree in use")
+
+// SessionsIn returns the IDs of the sessions running, or being spawned, in
+// a worktree or a directory inside it, sorted.
+func (m *Manager) SessionsIn(worktreePath string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id, s := range m.sessions {
+		if within(s.WorktreePath, worktreePath) {
+			ids = append(ids, id)
+		}
+	}
+	for id, spec := range m.starting {
+		if within(spec.WorktreePath, worktreePath) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// writerInLocked returns a session running, or being spawned, in a
+// worktree with an agent that edits it; m.mu is held.
+func (m *Manager) writerInLocked(worktreePath string) (string, bool) {
+	writes := func(path string, agentType protocol.AgentType) bool {
+		spec, _ := m.registry.Agent(agentType)
+		return spec.Writes && filepath.Clean(path) == filepath.Clean(worktreePath)
+	}
+	for id, s := range m.sessions {
+		if writes(s.WorktreePath, s.Agent) {
+			return id, true
+		}
+	}
+	for id, spec := range m.starting {
+		if writes(spec.WorktreePath, spec.Agent) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// isStarting reports whether a session is being spawned; m.mu is held.
+func (m *Manager) isStarting(processID string) bool {
+	_, ok := m.starting[processID]
+	return ok
+}
+
+// within reports whether path is dir or inside it.
+func within(path, dir string) bool {
+	path, dir = filepath.Clean(path), filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
@@ -0,0 +1,103 @@
+// Package signing verifies server messages signed with a shared secret, so a
+// relay between server and daemon cannot forge or replay commands.
+//
+// A signed frame is an envelope around the original message:
+//
+//	{"type":"signed","payload":"<message JSON>","sig":"<hex HMAC-SHA256(secret, payload)>"}
+//
+// The payload must carry "ts" (Unix milliseconds) and a unique "nonce".
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// Window is how far a message's timestamp may be from the daemon's clock.
+const Window = 60 * time.Second
+
+type envelope struct {
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+	Sig     string `json:"sig"`
+}
+
+type freshness struct {
+	Timestamp int64  `json:"ts"`
+	Nonce     string `json:"nonce"`
+}
+
+// Verifier checks signatures and rejects replayed messages. It remembers
+// nonces for as long as their messages are within the window.
+type Verifier struct {
+	secret []byte
+	now    func() time.Time
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// NewVerifier creates a verifier for the shared secret.
+func NewVerifier(secret string) *Verifier {
+	return &Verifier{
+		secret: []byte(secret),
+		now:    time.Now,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Open verifies a signed frame and returns the message JSON it carries.
+func (v *Verifier) Open(data []byte) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("invalid frame: %w", err)
+	}
+	if env.Type != protocol.MsgTypeSigned {
+		return nil, fmt.Errorf("unsigned %q message", env.Type)
+	}
+
+	sig, err := hex.DecodeString(env.Sig)
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(env.Payload))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("bad signature")
+	}
+
+	var f freshness
+	if err := json.Unmarshal([]byte(env.Payload), &f); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	if f.Nonce == "" {
+		return nil, errors.New("missing nonce")
+	}
+	sent := time.UnixMilli(f.Timestamp)
+	now := v.now()
+	if sent.Before(now.Add(-Window)) || sent.After(now.Add(Window)) {
+		return nil, fmt.Errorf("timestamp %s outside the %s window", sent.Format(time.RFC3339), Window)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for nonce, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, nonce)
+		}
+	}
+	if _, seen := v.nonces[f.Nonce]; seen {
+		return nil, errors.New("replayed nonce")
+	}
+	v.nonces[f.Nonce] = sent.Add(Window)
+
+	return []byte(env.Payload), nil
+}
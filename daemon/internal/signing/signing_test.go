@@ -0,0 +1,102 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const secret = "s3cret"
+
+// sign returns a signed frame around payload, signed with key.
+func sign(t *testing.T, key, payload string) []byte {
+	t.Helper()
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	data, err := json.Marshal(envelope{Type: "signed", Payload: payload, Sig: hex.EncodeToString(mac.Sum(nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// payload returns a kill message sent at ts with nonce.
+func payload(ts time.Time, nonce string) string {
+	return fmt.Sprintf(`{"type":"kill","processId":"p1","ts":%d,"nonce":%q}`, ts.UnixMilli(), nonce)
+}
+
+func TestOpen(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	tests := []struct {
+		name    string
+		frame   []byte
+		wantErr string
+	}{
+		{"valid", sign(t, secret, payload(now, "n1")), ""},
+		{"clock behind", sign(t, secret, payload(now.Add(-Window+time.Second), "n1")), ""},
+		{"clock ahead", sign(t, secret, payload(now.Add(Window-time.Second), "n1")), ""},
+		{"too old", sign(t, secret, payload(now.Add(-Window-time.Second), "n1")), "outside"},
+		{"too new", sign(t, secret, payload(now.Add(Window+time.Second), "n1")), "outside"},
+		{"wrong secret", sign(t, "other", payload(now, "n1")), "bad signature"},
+		{"tampered", []byte(strings.Replace(string(sign(t, secret, payload(now, "n1"))), "p1", "p2", 1)), "bad signature"},
+		{"malformed signature", []byte(`{"type":"signed","payload":"{}","sig":"zz"}`), "malformed signature"},
+		{"unsigned", []byte(`{"type":"kill","processId":"p1"}`), "unsigned"},
+		{"not JSON", []byte(`kill`), "invalid frame"},
+		{"missing nonce", sign(t, secret, fmt.Sprintf(`{"type":"kill","ts":%d}`, now.UnixMilli())), "missing nonce"},
+		{"payload not JSON", sign(t, secret, "kill"), "invalid payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(secret)
+			v.now = func() time.Time { return now }
+			msg, err := v.Open(tt.frame)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Open: %v", err)
+			case tt.wantErr == "" && !strings.Contains(string(msg), `"processId":"p1"`):
+				t.Errorf("Open = %s, want the payload", msg)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Open error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenRejectsReplays(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	v := NewVerifier(secret)
+	v.now = func() time.Time { return now }
+
+	first := sign(t, secret, payload(now, "n1"))
+	if _, err := v.Open(first); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := v.Open(first); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("replay: error = %v, want replayed nonce", err)
+	}
+	// A new message may not reuse the nonce either
+	if _, err := v.Open(sign(t, secret, payload(now.Add(time.Second), "n1"))); err == nil {
+		t.Error("reused nonce: want an error")
+	}
+	if _, err := v.Open(sign(t, secret, payload(now, "n2"))); err != nil {
+		t.Errorf("new nonce: %v", err)
+	}
+
+	// Once the first message is outside the window its nonce is forgotten,
+	// and replaying it fails on its timestamp instead
+	now = now.Add(Window + time.Second)
+	if _, err := v.Open(sign(t, secret, payload(now, "n3"))); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, ok := v.nonces["n1"]; ok {
+		t.Error("nonce n1 kept after its window")
+	}
+	if _, err := v.Open(first); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("late replay: error = %v, want timestamp outside the window", err)
+	}
+}
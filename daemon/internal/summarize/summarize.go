@@ -0,0 +1,161 @@
+// Package summarize runs a configured command, such as a local LLM CLI, on
+// a session's transcript to get a human-readable digest of what its agent
+// did. The transcript is the command's stdin and the digest its stdout.
+package summarize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultTimeout bounds a summarizer run.
+const DefaultTimeout = 2 * time.Minute
+
+const (
+	// MaxInput is how much of a transcript is given to the command; of a
+	// longer one, only the end.
+	MaxInput = 4 << 20
+	// maxSummary caps the summary kept from the command's stdout.
+	maxSummary = 16 << 10
+	// stderrTail is how much of the command's stderr a failure reports.
+	stderrTail = 1024
+)
+
+// Transcript formats, told to the command in AGENTHQ_TRANSCRIPT_FORMAT
+const (
+	// FormatJSONL is the agent's own transcript, a JSON record a line.
+	FormatJSONL = "jsonl"
+	// FormatTerminal is the session's terminal output as plain text.
+	FormatTerminal = "terminal"
+)
+
+var (
+	// ansiRe matches terminal escape sequences (DCS, CSI, OSC, and short
+	// escapes such as DECSC and charset designations)
+	ansiRe = regexp.MustCompile(`\x1bP(?s:.*?)\x1b\\|\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[ -/]*[0-~]`)
+	// cursorForwardRe matches moves of the cursor along a line, which TUIs
+	// use instead of spaces between words
+	cursorForwardRe = regexp.MustCompile(`\x1b\[[0-9]*[CG]`)
+)
+
+// Command is a summarizer and the session it runs for.
+type Command struct {
+	Path string
+	Args []string
+	// Env is added to the daemon's environment.
+	Env []string
+	// Dir is the directory the command runs in.
+	Dir     string
+	Timeout time.Duration
+}
+
+// Run runs cmd with transcript on its stdin and returns what it printed,
+// trimmed. A command that fails, times out or prints nothing returns an
+// error, with the end of its stderr if it wrote any.
+func Run(cmd Command, transcript []byte) (string, error) {
+	timeout := cmd.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
+	c.Dir = cmd.Dir
+	c.Env = append(os.Environ(), cmd.Env...)
+	c.Stdin = bytes.NewReader(transcript)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	// Kill the whole process group, so a CLI's helpers die with it
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	c.WaitDelay = 5 * time.Second
+
+	err := c.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = fmt.Errorf("exited with code %d", exitErr.ExitCode())
+		}
+		if msg := lastBytes(strings.TrimSpace(stderr.String()), stderrTail); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+
+	summary := strings.TrimSpace(strings.ToValidUTF8(stdout.String(), "�"))
+	if summary == "" {
+		return "", errors.New("printed no summary")
+	}
+	if len(summary) > maxSummary {
+		cut := maxSummary
+		for cut > 0 && !utf8.RuneStart(summary[cut]) {
+			cut--
+		}
+		summary = summary[:cut] + "…"
+	}
+	return summary, nil
+}
+
+// Plain returns a session's terminal output as text: escape sequences and
+// other control characters are left out, and of a line redrawn with
+// carriage returns, such as a progress bar, only what it ended up as.
+func Plain(output []byte) []byte {
+	text := ansiRe.ReplaceAll(cursorForwardRe.ReplaceAll(output, []byte(" ")), nil)
+	var out []byte
+	for _, line := range bytes.Split(text, []byte{'\n'}) {
+		line = bytes.TrimRight(line, "\r")
+		if i := bytes.LastIndexByte(line, '\r'); i >= 0 {
+			line = line[i+1:]
+		}
+		line = bytes.Map(func(r rune) rune {
+			if r < ' ' && r != '\t' || r == 0x7f {
+				return -1
+			}
+			return r
+		}, line)
+		out = append(append(out, bytes.TrimRight(line, " \t")...), '\n')
+	}
+	return bytes.TrimLeft(out, "\n")
+}
+
+// Tail returns the last MaxInput bytes of a transcript, from the start of
+// a line.
+func Tail(transcript []byte) []byte {
+	if len(transcript) <= MaxInput {
+		return transcript
+	}
+	transcript = transcript[len(transcript)-MaxInput:]
+	if i := bytes.IndexByte(transcript, '\n'); i >= 0 {
+		transcript = transcript[i+1:]
+	}
+	return transcript
+}
+
+// lastBytes returns the end of s, at most n bytes, from the start of a
+// character.
+func lastBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	for len(s) > 0 && !utf8.RuneStart(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
@@ -0,0 +1,220 @@
+package telemetry
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startTime is when cumulative metrics started counting.
+var startTime = time.Now()
+
+// instruments are all metrics, in the order they were created.
+var (
+	instrumentsMu sync.Mutex
+	instruments   []instrument
+)
+
+type instrument interface {
+	collect(now time.Time) map[string]any
+}
+
+func register(i instrument) {
+	instrumentsMu.Lock()
+	defer instrumentsMu.Unlock()
+	instruments = append(instruments, i)
+}
+
+func collectMetrics(now time.Time) []map[string]any {
+	instrumentsMu.Lock()
+	defer instrumentsMu.Unlock()
+	var metrics []map[string]any
+	for _, i := range instruments {
+		if m := i.collect(now); m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
+
+// series is the data of one attribute set.
+type series[T any] struct {
+	attrs []Attr
+	value T
+}
+
+// seriesKey identifies an attribute set.
+func seriesKey(attrs []Attr) string {
+	var b strings.Builder
+	for _, a := range attrs {
+		fmt.Fprintf(&b, "%s=%v\x00", a.Key, a.Value)
+	}
+	return b.String()
+}
+
+// Counter is a cumulative count, per attribute set.
+type Counter struct {
+	name, unit, description string
+
+	mu     sync.Mutex
+	series map[string]*series[int64]
+}
+
+// NewCounter creates a counter and registers it for export.
+func NewCounter(name, unit, description string) *Counter {
+	c := &Counter{name: name, unit: unit, description: description, series: make(map[string]*series[int64])}
+	register(c)
+	return c
+}
+
+// Add adds n to the count for attrs. It does nothing while telemetry is
+// off.
+func (c *Counter) Add(n int64, attrs ...Attr) {
+	if current() == nil {
+		return
+	}
+	key := seriesKey(attrs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &series[int64]{attrs: slices.Clone(attrs)}
+		c.series[key] = s
+	}
+	s.value += n
+}
+
+func (c *Counter) collect(now time.Time) map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.series) == 0 {
+		return nil
+	}
+	points := make([]map[string]any, 0, len(c.series))
+	for _, s := range c.series {
+		points = append(points, map[string]any{
+			"attributes":        encodeAttrs(s.attrs),
+			"startTimeUnixNano": nanos(startTime),
+			"timeUnixNano":      nanos(now),
+			"asInt":             fmt.Sprint(s.value),
+		})
+	}
+	return map[string]any{
+		"name": c.name, "unit": c.unit, "description": c.description,
+		"sum": map[string]any{
+			"dataPoints":             points,
+			"aggregationTemporality": 2, // cumulative
+			"isMonotonic":            true,
+		},
+	}
+}
+
+// Gauge reports a value observed at export time.
+type Gauge struct {
+	name, unit, description string
+	observe                 func() int64
+}
+
+// NewGauge creates a gauge whose value observe returns, and registers it
+// for export.
+func NewGauge(name, unit, description string, observe func() int64) *Gauge {
+	g := &Gauge{name: name, unit: unit, description: description, observe: observe}
+	register(g)
+	return g
+}
+
+func (g *Gauge) collect(now time.Time) map[string]any {
+	return map[string]any{
+		"name": g.name, "unit": g.unit, "description": g.description,
+		"gauge": map[string]any{
+			"dataPoints": []map[string]any{{
+				"timeUnixNano": nanos(now),
+				"asInt":        fmt.Sprint(g.observe()),
+			}},
+		},
+	}
+}
+
+// DurationBounds are histogram bucket bounds for durations in
+// milliseconds, from 5ms to 10 minutes.
+var DurationBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 300000, 600000}
+
+// Histogram is a cumulative distribution of values, per attribute set.
+type Histogram struct {
+	name, unit, description string
+	bounds                  []float64
+
+	mu     sync.Mutex
+	series map[string]*series[*histogramData]
+}
+
+type histogramData struct {
+	count   int64
+	sum     float64
+	buckets []int64 // len(bounds)+1
+}
+
+// NewHistogram creates a histogram with the given bucket bounds and
+// registers it for export.
+func NewHistogram(name, unit, description string, bounds []float64) *Histogram {
+	h := &Histogram{name: name, unit: unit, description: description, bounds: bounds, series: make(map[string]*series[*histogramData])}
+	register(h)
+	return h
+}
+
+// Record adds a value for attrs. It does nothing while telemetry is off.
+func (h *Histogram) Record(v float64, attrs ...Attr) {
+	if current() == nil {
+		return
+	}
+	key := seriesKey(attrs)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &series[*histogramData]{attrs: slices.Clone(attrs), value: &histogramData{buckets: make([]int64, len(h.bounds)+1)}}
+		h.series[key] = s
+	}
+	i, _ := slices.BinarySearch(h.bounds, v)
+	s.value.buckets[i]++
+	s.value.count++
+	s.value.sum += v
+}
+
+// RecordDuration records the time since start in milliseconds.
+func (h *Histogram) RecordDuration(start time.Time, attrs ...Attr) {
+	h.Record(float64(time.Since(start).Microseconds())/1000, attrs...)
+}
+
+func (h *Histogram) collect(now time.Time) map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.series) == 0 {
+		return nil
+	}
+	points := make([]map[string]any, 0, len(h.series))
+	for _, s := range h.series {
+		buckets := make([]string, len(s.value.buckets))
+		for i, n := range s.value.buckets {
+			buckets[i] = fmt.Sprint(n)
+		}
+		points = append(points, map[string]any{
+			"attributes":        encodeAttrs(s.attrs),
+			"startTimeUnixNano": nanos(startTime),
+			"timeUnixNano":      nanos(now),
+			"count":             fmt.Sprint(s.value.count),
+			"sum":               s.value.sum,
+			"bucketCounts":      buckets,
+			"explicitBounds":    h.bounds,
+		})
+	}
+	return map[string]any{
+		"name": h.name, "unit": h.unit, "description": h.description,
+		"histogram": map[string]any{
+			"dataPoints":             points,
+			"aggregationTemporality": 2, // cumulative
+		},
+	}
+}
@@ -0,0 +1,304 @@
+// Package telemetry records OpenTelemetry traces and metrics and exports
+// them to an OTLP collector over HTTP, in OTLP's JSON encoding. Until Start
+// is called, spans and measurements are discarded at almost no cost.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config says where and how to export.
+type Config struct {
+	// Endpoint is the collector's OTLP/HTTP base URL (e.g.
+	// "http://localhost:4318"); traces go to /v1/traces and metrics to
+	// /v1/metrics.
+	Endpoint string
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string
+	// ServiceName names the daemon in traces (default "agenthq-daemon").
+	ServiceName string
+	// Attributes describe the daemon (service.instance.id, host.name, ...).
+	Attributes map[string]string
+	// MetricInterval is how often metrics are exported (default 30s).
+	MetricInterval time.Duration
+}
+
+// FromEnv fills the settings missing from cfg from the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS ("k=v,k2=v2") and
+// OTEL_SERVICE_NAME variables.
+func FromEnv(cfg Config) Config {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if cfg.Headers == nil {
+		for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+			if k, v, ok := strings.Cut(pair, "="); ok {
+				if cfg.Headers == nil {
+					cfg.Headers = make(map[string]string)
+				}
+				cfg.Headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = os.Getenv("OTEL_SERVICE_NAME")
+	}
+	return cfg
+}
+
+// Exported spans are batched: sent when maxBatch are queued or every
+// flushInterval, and dropped beyond maxQueue.
+const (
+	maxBatch      = 512
+	maxQueue      = 4096
+	flushInterval = 5 * time.Second
+)
+
+// exporter sends spans and metrics to the collector.
+type exporter struct {
+	endpoint string
+	headers  map[string]string
+	resource resource
+	interval time.Duration
+	http     *http.Client
+
+	mu      sync.Mutex
+	spans   []*Span
+	dropped int
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// active is the running exporter; nil until Start.
+var (
+	activeMu sync.RWMutex
+	active   *exporter
+)
+
+func current() *exporter {
+	activeMu.RLock()
+	defer activeMu.RUnlock()
+	return active
+}
+
+// Start begins recording and exporting. It returns a function that
+// flushes what's left and stops exporting.
+func Start(cfg Config) (shutdown func()) {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "agenthq-daemon"
+	}
+	if cfg.MetricInterval <= 0 {
+		cfg.MetricInterval = 30 * time.Second
+	}
+	attrs := map[string]string{"service.name": cfg.ServiceName}
+	maps.Copy(attrs, cfg.Attributes)
+
+	e := &exporter{
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+		headers:  cfg.Headers,
+		resource: resource{Attributes: stringAttrs(attrs)},
+		interval: cfg.MetricInterval,
+		http:     &http.Client{Timeout: 10 * time.Second},
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	startTime = time.Now()
+	activeMu.Lock()
+	active = e
+	activeMu.Unlock()
+	go e.run()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			activeMu.Lock()
+			active = nil
+			activeMu.Unlock()
+			close(e.stop)
+			<-e.done
+		})
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	spans := time.NewTicker(flushInterval)
+	defer spans.Stop()
+	metrics := time.NewTicker(e.interval)
+	defer metrics.Stop()
+	for {
+		select {
+		case <-spans.C:
+			e.flushSpans()
+		case <-e.kick:
+			e.flushSpans()
+		case <-metrics.C:
+			e.exportMetrics()
+		case <-e.stop:
+			e.flushSpans()
+			e.exportMetrics()
+			return
+		}
+	}
+}
+
+// enqueue queues an ended span for export.
+func (e *exporter) enqueue(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) >= maxQueue {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, s)
+	if len(e.spans) >= maxBatch {
+		select {
+		case e.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *exporter) flushSpans() {
+	e.mu.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Telemetry: dropped %d spans", dropped)
+	}
+
+	for batch := range slices.Chunk(spans, maxBatch) {
+		body := map[string]any{"resourceSpans": []any{map[string]any{
+			"resource":   e.resource,
+			"scopeSpans": []any{map[string]any{"scope": scope, "spans": encodeSpans(batch)}},
+		}}}
+		if err := e.post("/v1/traces", body); err != nil {
+			log.Printf("Telemetry: failed to export %d spans: %v", len(batch), err)
+		}
+	}
+}
+
+func (e *exporter) exportMetrics() {
+	metrics := collectMetrics(time.Now())
+	if len(metrics) == 0 {
+		return
+	}
+	body := map[string]any{"resourceMetrics": []any{map[string]any{
+		"resource":     e.resource,
+		"scopeMetrics": []any{map[string]any{"scope": scope, "metrics": metrics}},
+	}}}
+	if err := e.post("/v1/metrics", body); err != nil {
+		log.Printf("Telemetry: failed to export metrics: %v", err)
+	}
+}
+
+func (e *exporter) post(path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: HTTP %d: %s", path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// scope identifies the instrumentation in exports.
+var scope = map[string]string{"name": "github.com/agenthq/daemon"}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+// Attr is a span or metric attribute.
+type Attr struct {
+	Key   string
+	Value any // string, int, int64, bool or float64
+}
+
+// String, Int and Bool make attributes.
+func String(key, value string) Attr    { return Attr{key, value} }
+func Int(key string, value int) Attr   { return Attr{key, int64(value)} }
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// keyValue and anyValue are OTLP's JSON attribute encoding.
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	String *string  `json:"stringValue,omitempty"`
+	Int    *string  `json:"intValue,omitempty"` // int64s are strings in OTLP JSON
+	Bool   *bool    `json:"boolValue,omitempty"`
+	Double *float64 `json:"doubleValue,omitempty"`
+}
+
+func encodeAttrs(attrs []Attr) []keyValue {
+	kvs := make([]keyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v anyValue
+		switch value := a.Value.(type) {
+		case string:
+			v.String = &value
+		case int:
+			s := fmt.Sprint(value)
+			v.Int = &s
+		case int64:
+			s := fmt.Sprint(value)
+			v.Int = &s
+		case bool:
+			v.Bool = &value
+		case float64:
+			v.Double = &value
+		default:
+			s := fmt.Sprint(value)
+			v.String = &s
+		}
+		kvs = append(kvs, keyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
+
+func stringAttrs(m map[string]string) []keyValue {
+	attrs := make([]Attr, 0, len(m))
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		attrs = append(attrs, String(k, m[k]))
+	}
+	return encodeAttrs(attrs)
+}
+
+func nanos(t time.Time) string {
+	return fmt.Sprint(t.UnixNano())
+}
@@ -0,0 +1,197 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether the trace and span IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the W3C traceparent header value for the span.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+// ("00-<trace id>-<parent span id>-<flags>").
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || len(traceID) != 16 || len(spanID) != 8 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	return sc, sc.IsValid()
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// WithTraceparent returns a context whose spans continue the trace of a
+// traceparent from another process, such as the server. An invalid or
+// empty traceparent leaves ctx as is.
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	if sc, ok := ParseTraceparent(traceparent); ok {
+		return context.WithValue(ctx, remoteKey{}, sc)
+	}
+	return ctx
+}
+
+// parent returns the span context new spans in ctx are children of.
+func parent(ctx context.Context) (SpanContext, bool) {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok && span != nil {
+		return span.sc, true
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Span is an operation being traced. A nil Span, as StartSpan returns
+// while telemetry is off, ignores every call.
+type Span struct {
+	exporter *exporter
+	name     string
+	sc       SpanContext
+	parentID [8]byte
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []Attr
+	events []spanEvent
+	err    string
+	ended  bool
+}
+
+type spanEvent struct {
+	name  string
+	time  time.Time
+	attrs []Attr
+}
+
+// StartSpan starts a span, as a child of the span or remote parent in ctx
+// if it has one, and returns a context carrying it.
+func StartSpan(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	e := current()
+	if e == nil {
+		return ctx, nil
+	}
+	span := &Span{exporter: e, name: name, start: time.Now(), attrs: attrs}
+	if p, ok := parent(ctx); ok {
+		span.sc.TraceID, span.parentID = p.TraceID, p.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+	}
+	rand.Read(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the span ctx carries, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Context returns the span's identity, for propagation.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// AddEvent records something that happened during the span.
+func (s *Span) AddEvent(name string, attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, spanEvent{name: name, time: time.Now(), attrs: attrs})
+}
+
+// End ends the span, marking it failed if err is not nil, and queues it
+// for export. Only the first call counts.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	s.exporter.enqueue(s)
+}
+
+// encodeSpans encodes ended spans in OTLP's JSON encoding, in which IDs
+// are hex strings.
+func encodeSpans(spans []*Span) []map[string]any {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.sc.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.sc.SpanID[:]),
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": nanos(s.start),
+			"endTimeUnixNano":   nanos(s.end),
+			"attributes":        encodeAttrs(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if len(s.events) > 0 {
+			events := make([]map[string]any, 0, len(s.events))
+			for _, e := range s.events {
+				events = append(events, map[string]any{
+					"name":         e.name,
+					"timeUnixNano": nanos(e.time),
+					"attributes":   encodeAttrs(e.attrs),
+				})
+			}
+			span["events"] = events
+		}
+		if s.err != "" {
+			span["status"] = map[string]any{"code": 2, "message": s.err} // STATUS_CODE_ERROR
+		}
+		encoded = append(encoded, span)
+	}
+	return encoded
+}
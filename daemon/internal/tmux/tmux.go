@@ -0,0 +1,377 @@
+// Package tmux runs sessions inside a daemon-managed tmux server instead of
+// on raw PTYs. Sessions outlive the daemon, keep tmux's scrollback, and can be
+// attached to locally with `tmux -L agenthq attach -t agenthq-<processId>`.
+//
+// The daemon follows each tmux session through an attach client running on
+// its own PTY; input, resizes and output all go through that client.
+package tmux
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/agenthq/daemon/internal/pty"
+)
+
+// SocketName is the tmux socket (-L) of the daemon's tmux server.
+const SocketName = "agenthq"
+
+// sessionPrefix marks tmux sessions created by the daemon.
+const sessionPrefix = "agenthq-"
+
+// Server is a tmux server the daemon creates sessions in.
+type Server struct {
+	path   string
+	socket string
+
+	mu sync.Mutex
+	// watched are the sessions whose panes are polled for exit, by name
+	watched map[string]*Session
+	polling bool
+}
+
+// NewServer returns the tmux server on the given socket name. It fails if
+// tmux is not installed.
+func NewServer(socket string) (*Server, error) {
+	path, err := exec.LookPath("tmux")
+	if err != nil {
+		return nil, fmt.Errorf("tmux not found: %w", err)
+	}
+	return &Server{path: path, socket: socket, watched: make(map[string]*Session)}, nil
+}
+
+// Meta identifies the daemon session a tmux session belongs to. It is stored
+// in the tmux session so sessions can be adopted after a daemon restart.
+type Meta struct {
+	ProcessID    string
+	Agent        string
+	WorktreePath string
+}
+
+// SessionName returns the tmux session name for a processID. tmux reserves
+// '.' and ':' in target names.
+func SessionName(processID string) string {
+	return sessionPrefix + strings.NewReplacer(".", "_", ":", "_").Replace(processID)
+}
+
+// command builds a tmux invocation against the daemon's server.
+func (s *Server) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(s.path, append([]string{"-L", s.socket, "-f", "/dev/null"}, args...)...)
+	// The server inherits this environment when the first command starts it
+	cmd.Env = pty.Env(nil)
+	return cmd
+}
+
+// run runs a tmux command and returns its trimmed output.
+func (s *Server) run(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := s.command(args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tmux %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Start creates a tmux session running command in dir and attaches to it.
+func (s *Server) Start(meta Meta, command string, args []string, dir string, env []string, cols, rows int) (*Session, error) {
+	name := SessionName(meta.ProcessID)
+
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{command}, args...) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	newSession := []string{"new-session", "-d", "-s", name, "-x", strconv.Itoa(cols), "-y", strconv.Itoa(rows), "-c", dir}
+	for _, kv := range env {
+		newSession = append(newSession, "-e", kv)
+	}
+
+	// One command list, so the options are in place before the session's
+	// command can exit. Dead panes stay around until the daemon has read
+	// their exit status.
+	_, err := s.run(slices.Concat(newSession, []string{
+		// Record the exit status as a pane option before the pane dies
+		strings.Join(quoted, " ") + "; " + shellQuote(s.path) + " set-option -p @agenthq_exit $?",
+		";", "set-option", "-g", "remain-on-exit", "on",
+		";", "set-option", "-g", "status", "off",
+		";", "set-option", "-g", "history-limit", "50000",
+		";", "set-option", "-g", "default-terminal", "screen-256color",
+		";", "set-option", "-ga", "terminal-features", "xterm-256color:RGB",
+		";", "set-option", "-t", name, "@agenthq_process_id", meta.ProcessID,
+		";", "set-option", "-t", name, "@agenthq_agent", meta.Agent,
+		";", "set-option", "-t", name, "@agenthq_worktree", meta.WorktreePath,
+	})...)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.Attach(name, dir, cols, rows)
+	if err != nil {
+		s.run("kill-session", "-t", "="+name)
+		return nil, err
+	}
+	return session, nil
+}
+
+// Adoptable is a daemon-created tmux session found on the server.
+type Adoptable struct {
+	Meta
+	Name string
+	Cols int
+	Rows int
+}
+
+// Sessions lists the daemon-created sessions on the server, e.g. ones left
+// running by a previous daemon.
+func (s *Server) Sessions() ([]Adoptable, error) {
+	out, err := s.run("list-sessions", "-F",
+		"#{session_name}\t#{@agenthq_process_id}\t#{@agenthq_agent}\t#{@agenthq_worktree}\t#{window_width}\t#{window_height}")
+	if err != nil {
+		// No server running means no sessions
+		if strings.Contains(err.Error(), "no server running") || strings.Contains(err.Error(), "error connecting") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sessions []Adoptable
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 || !strings.HasPrefix(fields[0], sessionPrefix) || fields[1] == "" {
+			continue
+		}
+		cols, _ := strconv.Atoi(fields[4])
+		rows, _ := strconv.Atoi(fields[5])
+		sessions = append(sessions, Adoptable{
+			Meta: Meta{ProcessID: fields[1], Agent: fields[2], WorktreePath: fields[3]},
+			Name: fields[0],
+			Cols: cols,
+			Rows: rows,
+		})
+	}
+	return sessions, nil
+}
+
+// Attach starts an attach client for an existing session.
+func (s *Server) Attach(name, dir string, cols, rows int) (*Session, error) {
+	// Clear TMUX so a daemon started from inside tmux can still attach
+	client, err := pty.Spawn(s.path, []string{"-L", s.socket, "attach-session", "-t", "=" + name}, dir, []string{"TMUX="}, cols, rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to tmux session %s: %w", name, err)
+	}
+
+	session := &Session{Process: client, server: s, name: name}
+	s.watch(session)
+	return session, nil
+}
+
+// pollInterval is how often dead panes are looked for. tmux runs pane-died
+// hooks only when another command wakes the server, so exits are polled.
+const pollInterval = time.Second
+
+// watch adds a session to the exit poller, starting it if needed.
+func (s *Server) watch(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.watched[session.name] = session
+	if !s.polling {
+		s.polling = true
+		go s.poll()
+	}
+}
+
+// unwatch removes a session from the exit poller.
+func (s *Server) unwatch(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watched, name)
+}
+
+// poll checks all panes for dead ones until no session is watched.
+func (s *Server) poll() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		if len(s.watched) == 0 {
+			s.polling = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		out, err := s.run("list-panes", "-a", "-F", "#{session_name}\t#{pane_dead}\t#{@agenthq_exit}\t#{pane_dead_signal}")
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) != 4 || fields[1] != "1" {
+				continue
+			}
+
+			s.mu.Lock()
+			session := s.watched[fields[0]]
+			s.mu.Unlock()
+			if session == nil {
+				continue
+			}
+
+			code, signal, ok := exitStatus(fields[2], fields[3])
+			if !ok {
+				// The wrapper didn't record a status (e.g. it was killed);
+				// give it a few polls before reporting an unknown exit.
+				session.deadPolls++
+				if session.deadPolls < 3 {
+					continue
+				}
+			}
+
+			s.unwatch(session.name)
+			session.died(code, signal)
+		}
+	}
+}
+
+// exitStatus interprets a dead pane's recorded exit status ($? of the
+// session's command) and tmux's own signal number, the way a shell reports
+// a command killed by a signal as 128+n.
+func exitStatus(recorded, paneSignal string) (code int, signal string, ok bool) {
+	if code, err := strconv.Atoi(recorded); err == nil {
+		if code > 128 && code < 128+32 {
+			return -1, pty.SignalName(syscall.Signal(code - 128)), true
+		}
+		return code, "", true
+	}
+	if sig, err := strconv.Atoi(paneSignal); err == nil && sig > 0 {
+		return -1, pty.SignalName(syscall.Signal(sig)), true
+	}
+	return -1, "", false
+}
+
+// Session is a tmux session followed through an attach client. Reads,
+// writes and resizes go to the client; Wait, Kill and Close act on the tmux
+// session itself.
+type Session struct {
+	*pty.Process
+	server *Server
+	name   string
+
+	// deadPolls counts polls that found the pane dead without a status;
+	// only touched by the poller
+	deadPolls int
+
+	mu     sync.Mutex
+	code   int
+	signal string
+	dead   bool
+}
+
+// died records the exit status of the session's dead pane and ends the
+// session, which ends the attach client.
+func (s *Session) died(code int, signal string) {
+	s.mu.Lock()
+	s.dead = true
+	s.code = code
+	s.signal = signal
+	s.mu.Unlock()
+
+	s.server.run("kill-session", "-t", "="+s.name)
+}
+
+// PID returns the process id of the session's command (its pane's), or 0 if
+// the pane is gone.
+func (s *Session) PID() int {
+	out, err := s.server.run("display-message", "-p", "-t", "="+s.name+":", "#{pane_pid}")
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(out))
+	return pid
+}
+
+// SignalForeground sends sig to the foreground process group of the
+// session's pane, rather than that of the daemon's attach client.
+func (s *Session) SignalForeground(sig syscall.Signal) error {
+	pid := s.PID()
+	if pid == 0 {
+		return fmt.Errorf("tmux session %s has no pane", s.name)
+	}
+	out, err := exec.Command("ps", "-o", "tpgid=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return fmt.Errorf("foreground process group of %d: %w", pid, err)
+	}
+	pgrp, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	if pgrp <= 0 {
+		return fmt.Errorf("pane process %d has no foreground process group", pid)
+	}
+	return syscall.Kill(-pgrp, sig)
+}
+
+// Wait waits for the attach client to exit and returns the exit code of the
+// session's command, or -1 if the session ended without one (killed, or
+// Redraw makes tmux repaint the session's whole screen on its attach
+// clients, the daemon's among them.
+func (s *Session) Redraw() error {
+	ttys, err := s.server.run("list-clients", "-t", "="+s.name, "-F", "#{client_tty}")
+	if err != nil {
+		return err
+	}
+	for _, tty := range strings.Fields(ttys) {
+		if _, err := s.server.run("refresh-client", "-t", tty); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detached by Close).
+func (s *Session) Wait() (int, error) {
+	s.Process.Wait()
+	s.server.unwatch(s.name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dead {
+		return -1, nil
+	}
+	return s.code, nil
+}
+
+// Signal returns the name of the signal that killed the session's command.
+func (s *Session) Signal() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signal
+}
+
+// Kill ends the tmux session and its command.
+func (s *Session) Kill() error {
+	if _, err := s.server.run("kill-session", "-t", "="+s.name); err != nil {
+		// Fall back to dropping the attach client
+		s.Process.Kill()
+		return err
+	}
+	return nil
+}
+
+// Close detaches from the session, leaving it running in tmux.
+func (s *Session) Close() error {
+	return s.Process.Close()
+}
+
+// shellQuote wraps s in single quotes for tmux's shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
@@ -0,0 +1,117 @@
+// Package traffic records the protocol messages a daemon exchanges with its
+// servers, so a reported bug can be reproduced by replaying what the server
+// sent (agenthq-daemon replay).
+package traffic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directions of a recorded message.
+const (
+	// In is a message from a server to the daemon
+	In = "in"
+	// Out is a message from the daemon to a server
+	Out = "out"
+)
+
+// maxLineSize bounds a single record when reading (output and chunks of
+// large messages can be big).
+const maxLineSize = 64 * 1024 * 1024
+
+// Record is one recorded message. A recording is a file of records, one
+// JSON object per line.
+type Record struct {
+	// Time is when the message was received or sent, in Unix ms
+	Time int64  `json:"ts"`
+	Dir  string `json:"dir"`
+	// Server is the URL of the server, or "local" for a local client
+	Server string `json:"server"`
+	// Message is the message as sent, after reassembling chunks and
+	// checking signatures; data that isn't JSON is recorded as a string.
+	Message json.RawMessage `json:"message"`
+}
+
+// Raw returns the message as it was sent.
+func (r Record) Raw() []byte {
+	var s string
+	if len(r.Message) > 0 && r.Message[0] == '"' && json.Unmarshal(r.Message, &s) == nil {
+		return []byte(s)
+	}
+	return r.Message
+}
+
+// Recorder appends records to a recording. A nil Recorder records nothing.
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Create opens the recording at path, appending to it if it exists. It is
+// readable only by the user, as messages can carry secrets.
+func Create(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f}, nil
+}
+
+// Record appends a message. Each record is written at once, so a recording
+// survives the daemon crashing.
+func (r *Recorder) Record(dir, server string, data []byte) {
+	if r == nil {
+		return
+	}
+	msg := json.RawMessage(data)
+	if !json.Valid(data) {
+		msg, _ = json.Marshal(string(data))
+	}
+	line, err := json.Marshal(Record{Time: time.Now().UnixMilli(), Dir: dir, Server: server, Message: msg})
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Write(append(line, '\n'))
+}
+
+// Close closes the recording.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// Read reads a recording.
+func Read(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
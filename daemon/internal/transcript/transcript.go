@@ -0,0 +1,177 @@
+// Package transcript locates and reads the conversation logs agent CLIs write
+// locally (claude project sessions, codex rollout logs).
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// ErrNotFound is returned when no log exists for a conversation.
+var ErrNotFound = errors.New("transcript not found")
+
+// maxLineSize bounds a single JSONL record (tool results can be large).
+const maxLineSize = 16 * 1024 * 1024
+
+// Locate returns the path of the log for an agent conversation.
+func Locate(agent protocol.AgentType, worktreePath, agentSessionID string) (string, error) {
+	if agentSessionID == "" {
+		return "", ErrNotFound
+	}
+
+	switch agent {
+	case protocol.AgentClaudeCode:
+		return locateClaude(worktreePath, agentSessionID)
+	case protocol.AgentCodexCLI:
+		return locateCodex(agentSessionID)
+	default:
+		return "", fmt.Errorf("agent %s does not keep local transcripts", agent)
+	}
+}
+
+// Read parses a JSONL log into its records.
+func Read(path string) ([]json.RawMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []json.RawMessage
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// Skip a partially written trailing record rather than failing the
+		// whole export while the agent is still running.
+		if !json.Valid([]byte(line)) {
+			continue
+		}
+		records = append(records, json.RawMessage(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// claudeProjectsDir returns the directory claude stores project sessions in.
+func claudeProjectsDir() string {
+	dir := os.Getenv("CLAUDE_CONFIG_DIR")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".claude")
+	}
+	return filepath.Join(dir, "projects")
+}
+
+var claudeProjectNameRe = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// locateClaude finds ~/.claude/projects/<encoded cwd>/<session>.jsonl. Claude
+// encodes the cwd by replacing every non-alphanumeric character with '-'.
+func locateClaude(worktreePath, agentSessionID string) (string, error) {
+	projects := claudeProjectsDir()
+	if projects == "" {
+		return "", ErrNotFound
+	}
+
+	name := agentSessionID + ".jsonl"
+	path := filepath.Join(projects, claudeProjectNameRe.ReplaceAllString(worktreePath, "-"), name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	// Fall back to scanning all projects (symlinked or relocated worktrees).
+	matches, _ := filepath.Glob(filepath.Join(projects, "*", name))
+	if len(matches) > 0 {
+		return matches[0], nil
+	}
+	return "", ErrNotFound
+}
+
+// CodexSessionsDir returns the directory codex writes rollout logs to.
+func CodexSessionsDir() string {
+	home := os.Getenv("CODEX_HOME")
+	if home == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		home = filepath.Join(userHome, ".codex")
+	}
+	return filepath.Join(home, "sessions")
+}
+
+// locateCodex finds sessions/YYYY/MM/DD/rollout-<timestamp>-<id>.jsonl.
+func locateCodex(agentSessionID string) (string, error) {
+	dir := CodexSessionsDir()
+	if dir == "" {
+		return "", ErrNotFound
+	}
+
+	suffix := "-" + agentSessionID + ".jsonl"
+	var found string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), "rollout-") && strings.HasSuffix(d.Name(), suffix) {
+			found = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if found == "" {
+		return "", ErrNotFound
+	}
+	return found, nil
+}
+
+// ReadCodexSessionMeta reads the session id and cwd from the first line of a
+// codex rollout log. Older codex versions write the id at the top level and
+// don't record the cwd.
+func ReadCodexSessionMeta(path string) (id, cwd string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", ""
+	}
+
+	var meta struct {
+		ID      string `json:"id"`
+		Type    string `json:"type"`
+		Payload struct {
+			ID  string `json:"id"`
+			Cwd string `json:"cwd"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &meta); err != nil {
+		return "", ""
+	}
+
+	if meta.Type == "session_meta" {
+		return meta.Payload.ID, meta.Payload.Cwd
+	}
+	return meta.ID, ""
+}
@@ -0,0 +1,304 @@
+package vt
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// Frame is what a screen showed at one point, to draw only what has
+// changed since.
+type Frame struct {
+	d display
+}
+
+// Frame returns what the screen shows now.
+func (s *Screen) Frame() *Frame {
+	d := s.display
+	d.lines = make([][]cell, len(s.lines))
+	for y, line := range s.lines {
+		d.lines[y] = slices.Clone(line)
+	}
+	d.modes = make(map[int]bool, len(s.modes))
+	for mode, set := range s.modes {
+		d.modes[mode] = set
+	}
+	return &Frame{d: d}
+}
+
+// Redraw returns output that draws the screen, and sets its modes, on a
+// terminal of its size in any state: it starts with a reset (RIS).
+func (s *Screen) Redraw() []byte {
+	return s.Diff(nil)
+}
+
+// Diff returns output that changes a terminal showing prev to show the
+// screen. A terminal of another size, or a nil prev, is redrawn.
+func (s *Screen) Diff(prev *Frame) []byte {
+	var out bytes.Buffer
+	var old display
+	if prev == nil || prev.d.cols != s.cols || prev.d.rows != s.rows {
+		out.WriteString("\x1bc")
+		old = display{
+			cols: s.cols, rows: s.rows,
+			lines:  blankLines(s.cols, s.rows),
+			bottom: s.rows - 1, autowrap: true,
+		}
+	} else {
+		old = prev.d
+	}
+	r := renderer{out: &out}
+
+	// Drawing needs absolute positions, plain text and no inserting
+	if old.lineDrawing != [2]bool{} || old.shift != 0 {
+		out.WriteString("\x1b(B\x1b)B\x0f")
+	}
+	if old.insert {
+		out.WriteString("\x1b[4l")
+	}
+	if old.origin {
+		out.WriteString("\x1b[?6l")
+	}
+
+	lines := old.lines
+	switch {
+	case s.alt && !old.alt:
+		// The alternate screen starts blank
+		out.WriteString("\x1b[?1049h")
+		lines = blankLines(s.cols, s.rows)
+	case !s.alt && old.alt:
+		// What the main screen had is unknown
+		out.WriteString("\x1b[?1049l")
+		lines = nil
+	case old.top == 0 && old.bottom == s.rows-1:
+		lines = r.scroll(s.lines, lines)
+	}
+	for y, line := range s.lines {
+		var was []cell
+		if lines != nil {
+			was = lines[y]
+		}
+		r.line(y, line, was)
+	}
+
+	for _, mode := range sortedModes(s.modes, old.modes) {
+		if set := s.modes[mode]; set != old.modes[mode] {
+			fmt.Fprintf(&out, "\x1b[?%d%c", mode, setOrReset(set))
+		}
+	}
+	if s.keypad && !old.keypad {
+		out.WriteString("\x1b=")
+	} else if !s.keypad && old.keypad {
+		out.WriteString("\x1b>")
+	}
+	if s.cursorStyle != old.cursorStyle {
+		fmt.Fprintf(&out, "\x1b[%d q", s.cursorStyle)
+	}
+	if s.title != old.title {
+		fmt.Fprintf(&out, "\x1b]0;%s\x07", s.title)
+	}
+	if s.autowrap != old.autowrap {
+		fmt.Fprintf(&out, "\x1b[?7%c", setOrReset(s.autowrap))
+	}
+
+	if s.saved != old.saved {
+		fmt.Fprintf(&out, "\x1b[%d;%dH", s.saved.y+1, s.saved.x+1)
+		r.pen(s.saved.pen)
+		out.WriteString("\x1b7")
+	}
+
+	// Setting the scroll region and origin mode homes the cursor, so the
+	// cursor comes last
+	if s.top != old.top || s.bottom != old.bottom {
+		fmt.Fprintf(&out, "\x1b[%d;%dr", s.top+1, s.bottom+1)
+	}
+	if s.origin {
+		out.WriteString("\x1b[?6h")
+	}
+	r.cursor(s)
+	r.pen(s.pen)
+	if s.insert {
+		out.WriteString("\x1b[4h")
+	}
+	if s.lineDrawing[0] {
+		out.WriteString("\x1b(0")
+	}
+	if s.lineDrawing[1] {
+		out.WriteString("\x1b)0")
+	}
+	if s.shift == 1 {
+		out.WriteByte(0x0e)
+	}
+	if s.cursorHidden != old.cursorHidden {
+		fmt.Fprintf(&out, "\x1b[?25%c", setOrReset(!s.cursorHidden))
+	}
+	return out.Bytes()
+}
+
+func setOrReset(set bool) byte {
+	if set {
+		return 'h'
+	}
+	return 'l'
+}
+
+func sortedModes(a, b map[int]bool) []int {
+	var modes []int
+	for mode := range a {
+		modes = append(modes, mode)
+	}
+	for mode := range b {
+		if _, ok := a[mode]; !ok {
+			modes = append(modes, mode)
+		}
+	}
+	slices.Sort(modes)
+	return modes
+}
+
+// renderer writes the output that draws a screen, keeping track of the
+// terminal's pen.
+type renderer struct {
+	out *bytes.Buffer
+	// drawn is the terminal's pen once known
+	drawn *attrs
+}
+
+// scroll scrolls the terminal up if that leaves fewer lines to draw, and
+// returns what its lines are then.
+func (r *renderer) scroll(lines, was [][]cell) [][]cell {
+	rows := len(lines)
+	same := func(shift int) int {
+		n := 0
+		for y := range rows - shift {
+			if slices.Equal(lines[y], was[y+shift]) {
+				n++
+			}
+		}
+		return n
+	}
+	best, bestSame := 0, same(0)
+	for shift := 1; shift < rows; shift++ {
+		// Scrolling costs about a line
+		if n := same(shift); n > bestSame+1 {
+			best, bestSame = shift, n
+		}
+	}
+	if best == 0 {
+		return was
+	}
+	// Lines scrolled in are blank in the default colors
+	r.pen(attrs{})
+	fmt.Fprintf(r.out, "\x1b[%dS", best)
+	scrolled := append(slices.Clone(was[best:]), blankLines(len(lines[0]), best)...)
+	return scrolled
+}
+
+// line draws line y where it differs from was, or all of it if was is
+// nil.
+func (r *renderer) line(y int, line, was []cell) {
+	from := 0
+	if was != nil {
+		for from < len(line) && line[from] == was[from] {
+			from++
+		}
+		if from == len(line) {
+			return
+		}
+	}
+	if line[from].tail && from > 0 {
+		from--
+	}
+	// Trailing blanks are erased rather than drawn
+	end := len(line)
+	for end > from && line[end-1] == (cell{}) {
+		end--
+	}
+
+	fmt.Fprintf(r.out, "\x1b[%d;%dH", y+1, from+1)
+	for x := from; x < end; x++ {
+		c := line[x]
+		if c.tail {
+			continue
+		}
+		r.pen(c.attrs)
+		if c.text == "" {
+			r.out.WriteByte(' ')
+		} else {
+			r.out.WriteString(c.text)
+		}
+	}
+	if end < len(line) && (was == nil || !allBlank(was[end:])) {
+		r.pen(attrs{})
+		r.out.WriteString("\x1b[K")
+	}
+}
+
+func allBlank(cells []cell) bool {
+	for _, c := range cells {
+		if c != (cell{}) {
+			return false
+		}
+	}
+	return true
+}
+
+// cursor puts the cursor where the screen has it. A pending wrap is
+// restored by writing the last column again.
+func (r *renderer) cursor(s *Screen) {
+	y := s.y
+	if s.origin {
+		y -= s.top
+	}
+	if s.wrapNext {
+		if c := s.lines[s.y][s.x]; !c.tail && !c.wide {
+			fmt.Fprintf(r.out, "\x1b[%d;%dH", y+1, s.x+1)
+			r.pen(c.attrs)
+			if c.text == "" {
+				r.out.WriteByte(' ')
+			} else {
+				r.out.WriteString(c.text)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(r.out, "\x1b[%d;%dH", y+1, s.x+1)
+}
+
+// pen sets the terminal's pen to a.
+func (r *renderer) pen(a attrs) {
+	if r.drawn != nil && *r.drawn == a {
+		return
+	}
+	r.drawn = &a
+	b := []byte("\x1b[0")
+	for i, param := range []string{"1", "2", "3", "4", "5", "7", "8", "9"} {
+		if a.flags&(1<<i) != 0 {
+			b = append(b, ';')
+			b = append(b, param...)
+		}
+	}
+	b = appendColor(b, a.fg, 30)
+	b = appendColor(b, a.bg, 40)
+	r.out.Write(append(b, 'm'))
+}
+
+// appendColor appends the SGR parameters for a foreground (base 30) or
+// background (base 40) color.
+func appendColor(b []byte, c uint32, base int) []byte {
+	n := int(c & 0xffffff)
+	switch c &^ 0xffffff {
+	case paletteColor:
+		switch {
+		case n < 8:
+			return strconv.AppendInt(append(b, ';'), int64(base+n), 10)
+		case n < 16:
+			return strconv.AppendInt(append(b, ';'), int64(base+60+n-8), 10)
+		}
+		return fmt.Appendf(b, ";%d;5;%d", base+8, n)
+	case rgbColor:
+		return fmt.Appendf(b, ";%d;2;%d;%d;%d", base+8, n>>16, n>>8&0xff, n&0xff)
+	}
+	return b
+}
@@ -0,0 +1,1042 @@
+// Package vt emulates the part of an xterm that agent CLIs and the tools
+// they run use, to know what a session's screen shows without a terminal:
+// text, cursor movement, erasing, scroll regions, colors and attributes,
+// the alternate screen and the modes that change how later output and
+// input behave. What it shows can be drawn from scratch or as the changes
+// since an earlier Frame.
+package vt
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Text attributes
+const (
+	bold uint16 = 1 << iota
+	faint
+	italic
+	underline
+	blink
+	inverse
+	invisible
+	strikethrough
+)
+
+// Colors are 0 for the default, paletteColor|index for the 256 indexed
+// colors and rgbColor|0xRRGGBB for direct ones.
+const (
+	paletteColor uint32 = 1 << 24
+	rgbColor     uint32 = 2 << 24
+)
+
+// attrs are how text is drawn.
+type attrs struct {
+	fg, bg uint32
+	flags  uint16
+}
+
+// cell is one character cell. text is empty for a blank; a wide character
+// fills its cell and the next, marked as its tail.
+type cell struct {
+	text string
+	attrs
+	wide, tail bool
+}
+
+// maxSequence bounds the escape sequences and OSC strings kept; the rest
+// of a longer one is dropped.
+const maxSequence = 4096
+
+// Parser states
+const (
+	ground = iota
+	escape
+	escapeIntermediate
+	csi
+	osc
+	// ignored is a DCS, SOS, PM or APC string
+	ignored
+)
+
+// display is what the terminal shows and the modes that affect how it
+// shows later output.
+type display struct {
+	cols, rows int
+	lines      [][]cell
+	// alt is set while the alternate screen is shown
+	alt bool
+
+	x, y int
+	// wrapNext is set after writing the last column; the next character
+	// goes on the next line
+	wrapNext bool
+	pen      attrs
+
+	// top and bottom are the scroll region's lines
+	top, bottom  int
+	origin       bool
+	autowrap     bool
+	insert       bool
+	cursorHidden bool
+	// keypad is application keypad mode
+	keypad bool
+	// modes are the other DEC private modes that are set, e.g. application
+	// cursor keys (1), mouse reporting or bracketed paste (2004); they
+	// change what the terminal sends, so must be passed on
+	modes       map[int]bool
+	cursorStyle int
+	title       string
+	// lineDrawing is set for G0 and G1 when they are the DEC special
+	// graphics set; shift selects G1
+	lineDrawing [2]bool
+	shift       int
+	// saved is the cursor DECSC saved
+	saved savedCursor
+}
+
+// savedCursor is what DECSC saves.
+type savedCursor struct {
+	x, y        int
+	pen         attrs
+	origin      bool
+	lineDrawing [2]bool
+	shift       int
+}
+
+// Screen is a terminal screen. It is not safe for concurrent use.
+type Screen struct {
+	display
+	// other is the screen not shown: the main one while the alternate one
+	// is shown, and the other way around
+	other [][]cell
+	// last is the last character printed, for REP
+	last rune
+
+	state int
+	seq   []byte
+	utf8  []byte
+	reply func([]byte)
+}
+
+// New returns a blank screen of cols by rows.
+func New(cols, rows int) *Screen {
+	cols, rows = max(cols, 1), max(rows, 1)
+	s := &Screen{}
+	s.cols, s.rows = cols, rows
+	s.reset()
+	return s
+}
+
+// OnReply sets where answers to the queries in the output (cursor
+// position, device attributes) go; they are dropped without it.
+func (s *Screen) OnReply(fn func([]byte)) {
+	s.reply = fn
+}
+
+// Size returns the screen's size.
+func (s *Screen) Size() (cols, rows int) {
+	return s.cols, s.rows
+}
+
+// reset returns to the initial state (RIS), keeping the size and title.
+func (s *Screen) reset() {
+	title := s.title
+	s.display = display{
+		cols:     s.cols,
+		rows:     s.rows,
+		lines:    blankLines(s.cols, s.rows),
+		bottom:   s.rows - 1,
+		autowrap: true,
+		modes:    make(map[int]bool),
+		title:    title,
+	}
+	s.other = blankLines(s.cols, s.rows)
+}
+
+func blankLines(cols, rows int) [][]cell {
+	lines := make([][]cell, rows)
+	for y := range lines {
+		lines[y] = make([]cell, cols)
+	}
+	return lines
+}
+
+// Resize changes the screen's size, keeping the text at the top left and
+// the cursor on screen.
+func (s *Screen) Resize(cols, rows int) {
+	cols, rows = max(cols, 1), max(rows, 1)
+	if cols == s.cols && rows == s.rows {
+		return
+	}
+	// Lines above the cursor go first when the screen gets shorter, as in
+	// xterm
+	drop := max(s.y-(rows-1), 0)
+	s.lines = resizeLines(s.lines[drop:], cols, rows)
+	s.other = resizeLines(s.other[drop:], cols, rows)
+	s.y -= drop
+	s.cols, s.rows = cols, rows
+	s.x, s.y = min(s.x, cols-1), min(s.y, rows-1)
+	s.wrapNext = false
+	s.top, s.bottom = 0, rows-1
+	s.saved.x, s.saved.y = min(s.saved.x, cols-1), min(s.saved.y, rows-1)
+}
+
+func resizeLines(lines [][]cell, cols, rows int) [][]cell {
+	resized := blankLines(cols, rows)
+	for y := range min(len(lines), rows) {
+		copy(resized[y], lines[y])
+		if last := &resized[y][cols-1]; last.wide {
+			// Its tail is cut off
+			*last = cell{attrs: last.attrs}
+		}
+	}
+	return resized
+}
+
+// Write updates the screen with output.
+func (s *Screen) Write(p []byte) (int, error) {
+	for _, b := range p {
+		s.feed(b)
+	}
+	return len(p), nil
+}
+
+func (s *Screen) feed(b byte) {
+	switch s.state {
+	case osc, ignored:
+		switch b {
+		case 0x07:
+			s.endString()
+			s.state = ground
+		case 0x1b:
+			// ST, the string terminator, starts with ESC
+			s.endString()
+			s.state, s.seq = escape, s.seq[:0]
+		case 0x18, 0x1a:
+			s.state = ground
+		default:
+			if s.state == osc && len(s.seq) < maxSequence {
+				s.seq = append(s.seq, b)
+			}
+		}
+		return
+	}
+
+	// Controls are carried out even in the middle of a sequence
+	switch {
+	case b == 0x1b:
+		s.utf8 = s.utf8[:0]
+		s.state, s.seq = escape, s.seq[:0]
+		return
+	case b == 0x18 || b == 0x1a:
+		s.state = ground
+		return
+	case b == 0x7f:
+		return
+	case b < 0x20:
+		s.control(b)
+		return
+	}
+
+	switch s.state {
+	case ground:
+		s.text(b)
+	case escape:
+		switch {
+		case b <= 0x2f:
+			s.seq = append(s.seq, b)
+			s.state = escapeIntermediate
+		case b == '[':
+			s.state = csi
+		case b == ']':
+			s.state = osc
+		case b == 'P' || b == 'X' || b == '^' || b == '_':
+			s.state = ignored
+		default:
+			s.state = ground
+			s.escDispatch(b)
+		}
+	case escapeIntermediate:
+		if b <= 0x2f {
+			if len(s.seq) < maxSequence {
+				s.seq = append(s.seq, b)
+			}
+			return
+		}
+		s.state = ground
+		s.designate(b)
+	case csi:
+		if b >= 0x40 && b <= 0x7e {
+			s.state = ground
+			s.csiDispatch(b)
+		} else if len(s.seq) < maxSequence {
+			s.seq = append(s.seq, b)
+		}
+	}
+}
+
+// text decodes printed UTF-8.
+func (s *Screen) text(b byte) {
+	if b < 0x80 && len(s.utf8) == 0 {
+		s.print(rune(b))
+		return
+	}
+	s.utf8 = append(s.utf8, b)
+	if !utf8.FullRune(s.utf8) {
+		return
+	}
+	r, n := utf8.DecodeRune(s.utf8)
+	rest := append([]byte(nil), s.utf8[n:]...)
+	s.utf8 = s.utf8[:0]
+	s.print(r)
+	// An invalid sequence prints one replacement character, and what
+	// follows its first byte is decoded again
+	for _, b := range rest {
+		s.text(b)
+	}
+}
+
+func (s *Screen) control(b byte) {
+	switch b {
+	case '\b':
+		if s.wrapNext {
+			s.wrapNext = false
+		} else if s.x > 0 {
+			s.x--
+		}
+	case '\t':
+		s.tab(1)
+	case '\n', '\v', '\f':
+		s.index()
+	case '\r':
+		s.x, s.wrapNext = 0, false
+	case 0x0e:
+		s.shift = 1
+	case 0x0f:
+		s.shift = 0
+	}
+}
+
+func (s *Screen) escDispatch(b byte) {
+	switch b {
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.index()
+	case 'E':
+		s.index()
+		s.x = 0
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.reset()
+	case '=':
+		s.keypad = true
+	case '>':
+		s.keypad = false
+	}
+}
+
+// designate handles ESC sequences with intermediates: character set
+// designations, and DECALN.
+func (s *Screen) designate(final byte) {
+	switch string(s.seq) {
+	case "(":
+		s.lineDrawing[0] = final == '0'
+	case ")":
+		s.lineDrawing[1] = final == '0'
+	case "#":
+		if final == '8' {
+			for _, line := range s.lines {
+				for x := range line {
+					line[x] = cell{text: "E"}
+				}
+			}
+			s.x, s.y, s.wrapNext = 0, 0, false
+		}
+	}
+}
+
+// lineDrawingChars are the DEC special graphics for '`' to '~'.
+var lineDrawingChars = []rune("◆▒␉␌␍␊°±␤␋┘┐┌└┼⎺⎻─⎼⎽├┤┴┬│≤≥π≠£·")
+
+func (s *Screen) print(r rune) {
+	if s.lineDrawing[s.shift] && r >= '`' && r <= '~' {
+		r = lineDrawingChars[r-'`']
+	}
+	w := runeWidth(r)
+	if w == 0 {
+		s.combine(r)
+		return
+	}
+	s.last = r
+
+	if s.wrapNext && s.autowrap {
+		s.x = 0
+		s.index()
+	}
+	s.wrapNext = false
+	if w == 2 && s.x == s.cols-1 {
+		if !s.autowrap || s.cols < 2 {
+			return
+		}
+		// It doesn't fit on the line
+		s.erase(s.y, s.x, s.cols)
+		s.x = 0
+		s.index()
+	}
+	if s.insert {
+		s.insertChars(w)
+	}
+
+	c := cell{attrs: s.pen, wide: w == 2}
+	// A space is a blank, as far as drawing it goes
+	if r != ' ' {
+		c.text = string(r)
+	}
+	s.put(s.x, c)
+	if w == 2 {
+		line := s.lines[s.y]
+		if line[s.x+1].wide && s.x+2 < s.cols {
+			line[s.x+2] = cell{attrs: line[s.x+2].attrs}
+		}
+		line[s.x+1] = cell{attrs: s.pen, tail: true}
+	}
+	s.x += w
+	if s.x >= s.cols {
+		s.x = s.cols - 1
+		s.wrapNext = s.autowrap
+	}
+}
+
+// combine adds a zero-width character to the one before the cursor.
+func (s *Screen) combine(r rune) {
+	x := s.x - 1
+	if s.wrapNext {
+		x = s.x
+	}
+	if x < 0 {
+		return
+	}
+	line := s.lines[s.y]
+	if line[x].tail && x > 0 {
+		x--
+	}
+	if line[x].text != "" {
+		line[x].text += string(r)
+	}
+}
+
+// put sets a cell, blanking what is left of a wide character it
+// overwrites half of.
+func (s *Screen) put(x int, c cell) {
+	line := s.lines[s.y]
+	if line[x].tail && x > 0 {
+		line[x-1] = cell{attrs: line[x-1].attrs}
+	}
+	if line[x].wide && x+1 < s.cols && !c.wide {
+		line[x+1] = cell{attrs: line[x+1].attrs}
+	}
+	line[x] = c
+}
+
+// index moves the cursor down, scrolling at the bottom of the scroll
+// region.
+func (s *Screen) index() {
+	s.wrapNext = false
+	switch {
+	case s.y == s.bottom:
+		s.scrollUp(1)
+	case s.y < s.rows-1:
+		s.y++
+	}
+}
+
+// reverseIndex moves the cursor up, scrolling at the top of the scroll
+// region.
+func (s *Screen) reverseIndex() {
+	s.wrapNext = false
+	switch {
+	case s.y == s.top:
+		s.scrollDown(1)
+	case s.y > 0:
+		s.y--
+	}
+}
+
+// blank is an erased cell: erasing fills with the current background.
+func (s *Screen) blank() cell {
+	return cell{attrs: attrs{bg: s.pen.bg}}
+}
+
+func (s *Screen) blankLine() []cell {
+	line := make([]cell, s.cols)
+	if blank := s.blank(); blank != (cell{}) {
+		for x := range line {
+			line[x] = blank
+		}
+	}
+	return line
+}
+
+// scrollUp scrolls the scroll region up n lines.
+func (s *Screen) scrollUp(n int) {
+	s.deleteLines(s.top, n)
+}
+
+// scrollDown scrolls the scroll region down n lines.
+func (s *Screen) scrollDown(n int) {
+	s.insertLines(s.top, n)
+}
+
+// insertLines inserts n blank lines at y, pushing the lines below down
+// and out of the scroll region.
+func (s *Screen) insertLines(y, n int) {
+	n = min(n, s.bottom-y+1)
+	region := s.lines[y : s.bottom+1]
+	copy(region[n:], region)
+	for i := range n {
+		region[i] = s.blankLine()
+	}
+}
+
+// deleteLines deletes n lines at y, pulling the lines below up and blank
+// ones in at the bottom of the scroll region.
+func (s *Screen) deleteLines(y, n int) {
+	n = min(n, s.bottom-y+1)
+	region := s.lines[y : s.bottom+1]
+	copy(region, region[n:])
+	for i := len(region) - n; i < len(region); i++ {
+		region[i] = s.blankLine()
+	}
+}
+
+// erase blanks cells from to to on line y.
+func (s *Screen) erase(y, from, to int) {
+	line := s.lines[y]
+	from, to = max(from, 0), min(to, s.cols)
+	if from >= to {
+		return
+	}
+	// Erasing half of a wide character erases all of it
+	if line[from].tail && from > 0 {
+		line[from-1] = cell{attrs: line[from-1].attrs}
+	}
+	if to < s.cols && line[to].tail {
+		line[to] = cell{attrs: line[to].attrs}
+	}
+	blank := s.blank()
+	for x := from; x < to; x++ {
+		line[x] = blank
+	}
+}
+
+// insertChars inserts n blanks at the cursor, pushing the rest of the
+// line right and off its end.
+func (s *Screen) insertChars(n int) {
+	line := s.lines[s.y]
+	n = min(n, s.cols-s.x)
+	copy(line[s.x+n:], line[s.x:])
+	s.erase(s.y, s.x, s.x+n)
+	if last := &line[s.cols-1]; last.wide {
+		*last = cell{attrs: last.attrs}
+	}
+}
+
+// deleteChars deletes n characters at the cursor, pulling the rest of the
+// line left.
+func (s *Screen) deleteChars(n int) {
+	line := s.lines[s.y]
+	n = min(n, s.cols-s.x)
+	if line[s.x].tail && s.x > 0 {
+		line[s.x-1] = cell{attrs: line[s.x-1].attrs}
+	}
+	copy(line[s.x:], line[s.x+n:])
+	s.erase(s.y, s.cols-n, s.cols)
+	if line[s.x].tail {
+		line[s.x] = cell{attrs: line[s.x].attrs}
+	}
+}
+
+// tab moves the cursor n tab stops, every 8 columns, forward or, if
+// negative, back.
+func (s *Screen) tab(n int) {
+	s.wrapNext = false
+	for ; n > 0; n-- {
+		s.x = min((s.x/8+1)*8, s.cols-1)
+	}
+	for ; n < 0; n++ {
+		s.x = max((s.x-1)/8*8, 0)
+	}
+}
+
+// moveTo moves the cursor to column x and line y, which count from the
+// scroll region's top in origin mode.
+func (s *Screen) moveTo(x, y int) {
+	top, bottom := 0, s.rows-1
+	if s.origin {
+		top, bottom = s.top, s.bottom
+	}
+	s.x = min(max(x, 0), s.cols-1)
+	s.y = min(max(y+top, top), bottom)
+	s.wrapNext = false
+}
+
+// moveUpDown moves the cursor n lines down or, if negative, up, stopping
+// at the scroll region if it starts inside it.
+func (s *Screen) moveUpDown(n int) {
+	top, bottom := 0, s.rows-1
+	if s.y >= s.top {
+		top = s.top
+	}
+	if s.y <= s.bottom {
+		bottom = s.bottom
+	}
+	s.y = min(max(s.y+n, top), bottom)
+	s.wrapNext = false
+}
+
+func (s *Screen) saveCursor() {
+	s.saved = savedCursor{
+		x: s.x, y: s.y, pen: s.pen, origin: s.origin,
+		lineDrawing: s.lineDrawing, shift: s.shift,
+	}
+}
+
+func (s *Screen) restoreCursor() {
+	s.x, s.y, s.pen, s.origin = s.saved.x, s.saved.y, s.saved.pen, s.saved.origin
+	s.lineDrawing, s.shift = s.saved.lineDrawing, s.saved.shift
+	s.wrapNext = false
+}
+
+// params are a CSI sequence's parameters, each with its colon-separated
+// subparameters; missing ones are 0.
+type params [][]int
+
+func parseParams(b []byte) params {
+	if len(b) == 0 {
+		return nil
+	}
+	p := params{{0}}
+	for _, c := range b {
+		last := p[len(p)-1]
+		switch {
+		case c >= '0' && c <= '9':
+			n := &last[len(last)-1]
+			*n = min(*n*10+int(c-'0'), 1<<16)
+		case c == ':':
+			p[len(p)-1] = append(last, 0)
+		case c == ';':
+			p = append(p, []int{0})
+		}
+	}
+	return p
+}
+
+// get returns parameter i, or def if it is missing or 0.
+func (p params) get(i, def int) int {
+	if i < len(p) && p[i][0] > 0 {
+		return p[i][0]
+	}
+	return def
+}
+
+func (s *Screen) csiDispatch(final byte) {
+	seq := s.seq
+	var private byte
+	if len(seq) > 0 && seq[0] >= '<' && seq[0] <= '?' {
+		private, seq = seq[0], seq[1:]
+	}
+	i := len(seq)
+	for i > 0 && seq[i-1] >= 0x20 && seq[i-1] <= 0x2f {
+		i--
+	}
+	intermediate := string(seq[i:])
+	p := parseParams(seq[:i])
+
+	switch {
+	case private == '?' && intermediate == "":
+		switch final {
+		case 'h':
+			s.setPrivateModes(p, true)
+		case 'l':
+			s.setPrivateModes(p, false)
+		}
+		return
+	case private == '>' && intermediate == "" && final == 'c':
+		s.respond("\x1b[>0;276;0c")
+		return
+	case private == 0 && intermediate == "!" && final == 'p':
+		s.softReset()
+		return
+	case private == 0 && intermediate == " " && final == 'q':
+		s.cursorStyle = p.get(0, 0)
+		return
+	case private != 0 || intermediate != "":
+		return
+	}
+
+	n := p.get(0, 1)
+	switch final {
+	case 'A':
+		s.moveUpDown(-n)
+	case 'B', 'e':
+		s.moveUpDown(n)
+	case 'C', 'a':
+		s.x, s.wrapNext = min(s.x+n, s.cols-1), false
+	case 'D':
+		s.x, s.wrapNext = max(s.x-n, 0), false
+	case 'E':
+		s.moveUpDown(n)
+		s.x = 0
+	case 'F':
+		s.moveUpDown(-n)
+		s.x = 0
+	case 'G', '`':
+		s.x, s.wrapNext = min(n-1, s.cols-1), false
+	case 'H', 'f':
+		s.moveTo(p.get(1, 1)-1, n-1)
+	case 'd':
+		x := s.x
+		s.moveTo(x, n-1)
+	case 'I':
+		s.tab(n)
+	case 'Z':
+		s.tab(-n)
+	case 'J':
+		s.eraseDisplay(p.get(0, 0))
+	case 'K':
+		s.eraseLine(p.get(0, 0))
+	case 'L':
+		if s.y >= s.top && s.y <= s.bottom {
+			s.insertLines(s.y, n)
+			s.x, s.wrapNext = 0, false
+		}
+	case 'M':
+		if s.y >= s.top && s.y <= s.bottom {
+			s.deleteLines(s.y, n)
+			s.x, s.wrapNext = 0, false
+		}
+	case '@':
+		s.insertChars(n)
+		s.wrapNext = false
+	case 'P':
+		s.deleteChars(n)
+		s.wrapNext = false
+	case 'X':
+		s.erase(s.y, s.x, s.x+n)
+		s.wrapNext = false
+	case 'S':
+		s.scrollUp(n)
+	case 'T':
+		s.scrollDown(n)
+	case 'b':
+		if s.last != 0 {
+			for range min(n, s.cols*s.rows) {
+				s.print(s.last)
+			}
+		}
+	case 'm':
+		s.sgr(p)
+	case 'r':
+		top, bottom := p.get(0, 1)-1, min(p.get(1, s.rows), s.rows)-1
+		if top < bottom {
+			s.top, s.bottom = top, bottom
+			s.moveTo(0, 0)
+		}
+	case 's':
+		s.saveCursor()
+	case 'u':
+		s.restoreCursor()
+	case 'h', 'l':
+		for i := range p {
+			if p.get(i, 0) == 4 {
+				s.insert = final == 'h'
+			}
+		}
+	case 'n':
+		switch p.get(0, 0) {
+		case 5:
+			s.respond("\x1b[0n")
+		case 6:
+			y := s.y
+			if s.origin {
+				y -= s.top
+			}
+			s.respond(fmt.Sprintf("\x1b[%d;%dR", y+1, s.x+1))
+		}
+	case 'c':
+		if p.get(0, 0) == 0 {
+			s.respond("\x1b[?1;2c")
+		}
+	}
+}
+
+func (s *Screen) respond(answer string) {
+	if s.reply != nil {
+		s.reply([]byte(answer))
+	}
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.erase(s.y, s.x, s.cols)
+		for y := s.y + 1; y < s.rows; y++ {
+			s.erase(y, 0, s.cols)
+		}
+	case 1:
+		for y := range s.y {
+			s.erase(y, 0, s.cols)
+		}
+		s.erase(s.y, 0, s.x+1)
+	case 2:
+		for y := range s.rows {
+			s.erase(y, 0, s.cols)
+		}
+	}
+	s.wrapNext = false
+}
+
+func (s *Screen) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		s.erase(s.y, s.x, s.cols)
+	case 1:
+		s.erase(s.y, 0, s.x+1)
+	case 2:
+		s.erase(s.y, 0, s.cols)
+	}
+	s.wrapNext = false
+}
+
+func (s *Screen) setPrivateModes(p params, set bool) {
+	for i := range p {
+		switch mode := p.get(i, 0); mode {
+		case 0:
+		case 6:
+			s.origin = set
+			s.moveTo(0, 0)
+		case 7:
+			s.autowrap = set
+			if !set {
+				s.wrapNext = false
+			}
+		case 25:
+			s.cursorHidden = !set
+		case 47:
+			s.showAlt(set, false)
+		case 1047:
+			s.showAlt(set, !set)
+		case 1048:
+			if set {
+				s.saveCursor()
+			} else {
+				s.restoreCursor()
+			}
+		case 1049:
+			if set {
+				s.saveCursor()
+				s.showAlt(true, true)
+			} else {
+				s.showAlt(false, false)
+				s.restoreCursor()
+			}
+		default:
+			if set {
+				s.modes[mode] = true
+			} else {
+				delete(s.modes, mode)
+			}
+		}
+	}
+}
+
+// showAlt switches between the main and the alternate screen, clearing
+// the alternate one if clear is set.
+func (s *Screen) showAlt(alt, clear bool) {
+	if alt == s.alt {
+		return
+	}
+	if clear && alt {
+		s.other = blankLines(s.cols, s.rows)
+	}
+	if clear && !alt {
+		for y := range s.rows {
+			s.erase(y, 0, s.cols)
+		}
+	}
+	s.lines, s.other = s.other, s.lines
+	s.alt = alt
+	s.wrapNext = false
+}
+
+// softReset is DECSTR.
+func (s *Screen) softReset() {
+	s.pen = attrs{}
+	s.cursorHidden = false
+	s.insert, s.origin, s.keypad = false, false, false
+	s.autowrap = true
+	s.top, s.bottom = 0, s.rows-1
+	s.lineDrawing, s.shift = [2]bool{}, 0
+	delete(s.modes, 1)
+	s.saved = savedCursor{}
+}
+
+func (s *Screen) sgr(p params) {
+	if len(p) == 0 {
+		s.pen = attrs{}
+		return
+	}
+	for i := 0; i < len(p); i++ {
+		switch n := p[i][0]; {
+		case n == 0:
+			s.pen = attrs{}
+		case n == 1:
+			s.pen.flags |= bold
+		case n == 2:
+			s.pen.flags |= faint
+		case n == 3:
+			s.pen.flags |= italic
+		case n == 4:
+			// 4:0 is no underline; 4:2 and up are underline styles
+			if len(p[i]) > 1 && p[i][1] == 0 {
+				s.pen.flags &^= underline
+			} else {
+				s.pen.flags |= underline
+			}
+		case n == 5 || n == 6:
+			s.pen.flags |= blink
+		case n == 7:
+			s.pen.flags |= inverse
+		case n == 8:
+			s.pen.flags |= invisible
+		case n == 9:
+			s.pen.flags |= strikethrough
+		case n == 21:
+			s.pen.flags |= underline
+		case n == 22:
+			s.pen.flags &^= bold | faint
+		case n == 23:
+			s.pen.flags &^= italic
+		case n == 24:
+			s.pen.flags &^= underline
+		case n == 25:
+			s.pen.flags &^= blink
+		case n == 27:
+			s.pen.flags &^= inverse
+		case n == 28:
+			s.pen.flags &^= invisible
+		case n == 29:
+			s.pen.flags &^= strikethrough
+		case n >= 30 && n <= 37:
+			s.pen.fg = paletteColor | uint32(n-30)
+		case n == 38:
+			c, skip := extendedColor(p, i)
+			s.pen.fg, i = c, i+skip
+		case n == 39:
+			s.pen.fg = 0
+		case n >= 40 && n <= 47:
+			s.pen.bg = paletteColor | uint32(n-40)
+		case n == 48:
+			c, skip := extendedColor(p, i)
+			s.pen.bg, i = c, i+skip
+		case n == 49:
+			s.pen.bg = 0
+		case n == 58:
+			// Underline color isn't kept
+			_, skip := extendedColor(p, i)
+			i += skip
+		case n >= 90 && n <= 97:
+			s.pen.fg = paletteColor | uint32(n-90+8)
+		case n >= 100 && n <= 107:
+			s.pen.bg = paletteColor | uint32(n-100+8)
+		}
+	}
+}
+
+// extendedColor parses the color of SGR 38, 48 or 58 at p[i], as
+// subparameters (38:5:n, 38:2::r:g:b) or following parameters (38;5;n,
+// 38;2;r;g;b). It returns the color and how many parameters it used past
+// p[i].
+func extendedColor(p params, i int) (uint32, int) {
+	args, skip := p[i][1:], 0
+	if len(args) == 0 {
+		for _, param := range p[i+1:] {
+			args = append(args, param[0])
+		}
+	}
+	if len(args) == 0 {
+		return 0, 0
+	}
+	switch args[0] {
+	case 5:
+		if len(args) < 2 {
+			return 0, len(args)
+		}
+		if len(p[i]) == 1 {
+			skip = 2
+		}
+		return paletteColor | uint32(min(args[1], 255)), skip
+	case 2:
+		rgb := args[1:]
+		if len(p[i]) == 1 {
+			skip = min(4, len(args))
+		} else if len(rgb) > 3 {
+			// The color space ID comes first
+			rgb = rgb[1:]
+		}
+		if len(rgb) < 3 {
+			return 0, skip
+		}
+		r, g, b := min(rgb[0], 255), min(rgb[1], 255), min(rgb[2], 255)
+		return rgbColor | uint32(r<<16|g<<8|b), skip
+	}
+	if len(p[i]) == 1 {
+		skip = 1
+	}
+	return 0, skip
+}
+
+// endString finishes an OSC string; only titles are kept.
+func (s *Screen) endString() {
+	if s.state != osc {
+		return
+	}
+	cmd, text, ok := cutByte(s.seq, ';')
+	if !ok {
+		return
+	}
+	if n, err := strconv.Atoi(string(cmd)); err == nil && (n == 0 || n == 2) {
+		s.title = string(text)
+	}
+}
+
+func cutByte(b []byte, sep byte) ([]byte, []byte, bool) {
+	for i, c := range b {
+		if c == sep {
+			return b[:i], b[i+1:], true
+		}
+	}
+	return b, nil, false
+}
+
+// runeWidth returns how many cells r takes: 0 for combining marks and
+// other zero-width characters, 2 for wide East Asian characters and
+// emoji, otherwise 1.
+func runeWidth(r rune) int {
+	switch {
+	case r == 0x200b || r == 0x200c || r == 0x200d || r == 0x2060 || r == 0xfeff:
+		return 0
+	case unicode.In(r, unicode.Mn, unicode.Me):
+		return 0
+	case isWide(r):
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,269 @@
+package vt
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// text returns what the screen shows, one string per line without
+// trailing blanks.
+func text(s *Screen) []string {
+	lines := make([]string, len(s.lines))
+	for y, line := range s.lines {
+		var b strings.Builder
+		for _, c := range line {
+			switch {
+			case c.tail:
+			case c.text == "":
+				b.WriteByte(' ')
+			default:
+				b.WriteString(c.text)
+			}
+		}
+		lines[y] = strings.TrimRight(b.String(), " ")
+	}
+	return lines
+}
+
+func TestScreen(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		want  []string
+		x, y  int
+		check func(t *testing.T, s *Screen)
+	}{
+		{name: "text", in: "hello", want: []string{"hello", "", ""}, x: 5},
+		{name: "newline", in: "ab\r\ncd", want: []string{"ab", "cd", ""}, x: 2, y: 1},
+		{name: "wrap", in: "0123456789ab", want: []string{"0123456789", "ab", ""}, x: 2, y: 1},
+		{name: "no wrap at last column", in: "0123456789", want: []string{"0123456789", "", ""}, x: 9},
+		{name: "autowrap off", in: "\x1b[?7l0123456789ab", want: []string{"012345678b", "", ""}, x: 9},
+		{name: "scroll", in: "1\r\n2\r\n3\r\n4", want: []string{"2", "3", "4"}, x: 1, y: 2},
+		{name: "cursor position", in: "\x1b[2;4Hx", want: []string{"", "   x", ""}, x: 4, y: 1},
+		{name: "cursor clamped", in: "\x1b[99;99Hx", want: []string{"", "", "         x"}, x: 9, y: 2},
+		{name: "relative moves", in: "\x1b[3B\x1b[5Ca\x1b[2A\x1b[2Db", want: []string{"    b", "", "     a"}, x: 5},
+		{name: "backspace", in: "abc\b\bX", want: []string{"aXc", "", ""}, x: 2},
+		{name: "tab", in: "a\tb", want: []string{"a       b", "", ""}, x: 9},
+		{name: "erase line", in: "abcdef\x1b[3D\x1b[K", want: []string{"abc", "", ""}, x: 3},
+		{name: "erase line start", in: "abcdef\x1b[3D\x1b[1K", want: []string{"    ef", "", ""}, x: 3},
+		{name: "erase display", in: "ab\r\ncd\x1b[2J", want: []string{"", "", ""}, x: 2, y: 1},
+		{name: "erase chars", in: "abcdef\r\x1b[2X", want: []string{"  cdef", "", ""}},
+		{name: "insert chars", in: "abcdef\r\x1b[2@", want: []string{"  abcdef", "", ""}},
+		{name: "delete chars", in: "abcdef\r\x1b[2P", want: []string{"cdef", "", ""}},
+		{name: "insert mode", in: "abc\r\x1b[4hXY\x1b[4l", want: []string{"XYabc", "", ""}, x: 2},
+		{name: "insert lines", in: "1\r\n2\r\n3\x1b[2;1H\x1b[L", want: []string{"1", "", "2"}, y: 1},
+		{name: "delete lines", in: "1\r\n2\r\n3\x1b[1;1H\x1b[M", want: []string{"2", "3", ""}},
+		{name: "scroll region", in: "1\r\n2\r\n3\x1b[1;2r\x1b[2;1H\n", want: []string{"2", "", "3"}, y: 1},
+		{name: "reverse index", in: "1\r\n2\x1b[H\x1bM", want: []string{"", "1", "2"}},
+		{name: "repeat", in: "a\x1b[3b", want: []string{"aaaa", "", ""}, x: 4},
+		{name: "wide characters", in: "日本x", want: []string{"日本x", "", ""}, x: 5},
+		{name: "wide character wraps whole", in: "123456789日", want: []string{"123456789", "日", ""}, x: 2, y: 1},
+		{name: "combining character", in: "éx", want: []string{"éx", "", ""}, x: 2},
+		{name: "split UTF-8", in: "\xe6\x97", want: []string{"", "", ""}},
+		{name: "invalid UTF-8", in: "a\xffb", want: []string{"a�b", "", ""}, x: 3},
+		{name: "line drawing", in: "\x1b(0qx\x1b(Bq", want: []string{"─│q", "", ""}, x: 3},
+		{name: "shift out", in: "\x1b)0a\x0eq\x0fq", want: []string{"a─q", "", ""}, x: 3},
+		{name: "save and restore cursor", in: "ab\x1b7\r\ncd\x1b8e", want: []string{"abe", "cd", ""}, x: 3},
+		{name: "alternate screen", in: "main\x1b[?1049halt", want: []string{"    alt", "", ""}, x: 7,
+			check: func(t *testing.T, s *Screen) {
+				s.Write([]byte("\x1b[?1049l"))
+				if got := text(s); !reflect.DeepEqual(got, []string{"main", "", ""}) || s.x != 4 {
+					t.Errorf("after leaving the alternate screen: %q at x %d, want the main screen at x 4", got, s.x)
+				}
+			}},
+		{name: "OSC title", in: "\x1b]0;my title\x07ok", want: []string{"ok", "", ""}, x: 2,
+			check: func(t *testing.T, s *Screen) {
+				if s.title != "my title" {
+					t.Errorf("title = %q", s.title)
+				}
+			}},
+		{name: "OSC with ST", in: "\x1b]2;t\x1b\\ok", want: []string{"ok", "", ""}, x: 2},
+		{name: "DCS ignored", in: "\x1bPq#0;2;0;0;0\x1b\\ok", want: []string{"ok", "", ""}, x: 2},
+		{name: "cancelled sequence", in: "\x1b[3\x18ok", want: []string{"ok", "", ""}, x: 2},
+		{name: "control inside sequence", in: "a\x1b[\r2Cb", want: []string{"a b", "", ""}, x: 3},
+		{name: "modes", in: "\x1b[?1h\x1b[?2004h\x1b[?25l\x1b=", want: []string{"", "", ""},
+			check: func(t *testing.T, s *Screen) {
+				if !s.modes[1] || !s.modes[2004] || !s.cursorHidden || !s.keypad {
+					t.Errorf("modes %v, cursor hidden %v, keypad %v", s.modes, s.cursorHidden, s.keypad)
+				}
+			}},
+		{name: "colors", in: "\x1b[1;31;48;5;200mA\x1b[38;2;1;2;3mB\x1b[0mC", want: []string{"ABC", "", ""}, x: 3,
+			check: func(t *testing.T, s *Screen) {
+				a, b, c := s.lines[0][0].attrs, s.lines[0][1].attrs, s.lines[0][2].attrs
+				if a.flags != bold || a.fg != paletteColor|1 || a.bg != paletteColor|200 {
+					t.Errorf("A drawn with %+v", a)
+				}
+				if b.fg != rgbColor|0x010203 || b.bg != a.bg {
+					t.Errorf("B drawn with %+v", b)
+				}
+				if c != (attrs{}) {
+					t.Errorf("C drawn with %+v, want defaults", c)
+				}
+			}},
+		{name: "full reset", in: "abc\x1b[?25l\x1bc", want: []string{"", "", ""},
+			check: func(t *testing.T, s *Screen) {
+				if s.cursorHidden {
+					t.Error("cursor hidden after a reset")
+				}
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(10, 3)
+			s.Write([]byte(tt.in))
+			if got := text(s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("screen = %q, want %q", got, tt.want)
+			}
+			if s.x != tt.x || s.y != tt.y {
+				t.Errorf("cursor at %d,%d, want %d,%d", s.x, s.y, tt.x, tt.y)
+			}
+			if tt.check != nil {
+				tt.check(t, s)
+			}
+		})
+	}
+}
+
+func TestScreenSplitWrites(t *testing.T) {
+	in := "\x1b[1;32mgreen\x1b[0m 日本\r\n\x1b]0;title\x07\x1b[2;5Hx\x1b(0q"
+	whole := New(20, 4)
+	whole.Write([]byte(in))
+	for size := 1; size < 8; size++ {
+		s := New(20, 4)
+		for i := 0; i < len(in); i += size {
+			s.Write([]byte(in[i:min(i+size, len(in))]))
+		}
+		if !reflect.DeepEqual(s.display, whole.display) {
+			t.Errorf("in writes of %d bytes: screen = %q, want %q", size, text(s), text(whole))
+		}
+	}
+}
+
+func TestReplies(t *testing.T) {
+	s := New(10, 5)
+	var replies []string
+	s.OnReply(func(b []byte) { replies = append(replies, string(b)) })
+	s.Write([]byte("\x1b[3;4H\x1b[6n\x1b[5n\x1b[c"))
+	want := []string{"\x1b[3;4R", "\x1b[0n", "\x1b[?1;2c"}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("replies = %q, want %q", replies, want)
+	}
+}
+
+func TestResize(t *testing.T) {
+	s := New(10, 3)
+	s.Write([]byte("0123456789\r\nab\x1b[3;10H"))
+	s.Resize(4, 2)
+	if cols, rows := s.Size(); cols != 4 || rows != 2 {
+		t.Fatalf("Size = %d,%d, want 4,2", cols, rows)
+	}
+	if s.x >= 4 || s.y >= 2 {
+		t.Errorf("cursor at %d,%d, outside the resized screen", s.x, s.y)
+	}
+	s.Write([]byte("\x1b[Hz"))
+	if got := text(s)[0]; !strings.HasPrefix(got, "z") || len(got) > 4 {
+		t.Errorf("first line = %q after resizing to 4 columns", got)
+	}
+}
+
+// steps are output an agent might write, one step after another.
+var steps = []string{
+	"$ ls\r\nfile1  file2\r\n$ ",
+	"\x1b[1;31merror:\x1b[0m something failed\r\n",
+	"\x1b[?1049h\x1b[H\x1b[2J\x1b[?25l\x1b]0;editor\x07",
+	"\x1b[1;1H┌────┐\x1b[2;1H│ 日本 │\x1b[3;1H└────┘",
+	"\x1b[2;3r\x1b[2;1H\x1b[3L\x1b[r",
+	"\x1b[3;1H\x1b[38;2;10;20;30;48;5;17mcolored\x1b[0m\x1b[K",
+	"\x1b(0lqqk\x1b(B\x1b[?2004h\x1b[?1h\x1b=",
+	"\x1b[5;1H\n\n\nscrolled",
+	"\x1b[?1049l\x1b[?25h",
+	"\x1b[4hins\x1b[4l\x1b[2 q",
+	"\x1b[1;1H\x1b[2J",
+}
+
+// sameScreen reports what differs between what two screens show.
+func sameScreen(t *testing.T, got, want *Screen) {
+	t.Helper()
+	if g, w := text(got), text(want); !reflect.DeepEqual(g, w) {
+		t.Errorf("screen = %q, want %q", g, w)
+		return
+	}
+	if !reflect.DeepEqual(got.lines, want.lines) {
+		t.Errorf("cells differ in attributes")
+	}
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"cursor", [2]int{got.x, got.y}, [2]int{want.x, want.y}},
+		{"cursor hidden", got.cursorHidden, want.cursorHidden},
+		{"cursor style", got.cursorStyle, want.cursorStyle},
+		{"pen", got.pen, want.pen},
+		{"alternate screen", got.alt, want.alt},
+		{"scroll region", [2]int{got.top, got.bottom}, [2]int{want.top, want.bottom}},
+		{"keypad", got.keypad, want.keypad},
+		{"insert", got.insert, want.insert},
+		{"modes", enabled(got.modes), enabled(want.modes)},
+		{"title", got.title, want.title},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+// enabled returns the modes that are set.
+func enabled(modes map[int]bool) string {
+	var set []string
+	for mode := range 10000 {
+		if modes[mode] {
+			set = append(set, fmt.Sprint(mode))
+		}
+	}
+	return strings.Join(set, ",")
+}
+
+func TestRedraw(t *testing.T) {
+	s := New(12, 5)
+	for i, step := range steps {
+		s.Write([]byte(step))
+		drawn := New(12, 5)
+		drawn.Write(s.Redraw())
+		t.Run(fmt.Sprint("after step ", i+1), func(t *testing.T) {
+			sameScreen(t, drawn, s)
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	s, mirror := New(12, 5), New(12, 5)
+	for i, step := range steps {
+		prev := s.Frame()
+		s.Write([]byte(step))
+		mirror.Write(s.Diff(prev))
+		t.Run(fmt.Sprint("after step ", i+1), func(t *testing.T) {
+			sameScreen(t, mirror, s)
+		})
+	}
+
+	if diff := s.Diff(s.Frame()); len(diff) > 16 {
+		t.Errorf("Diff of an unchanged screen = %q, want next to nothing", diff)
+	}
+}
+
+func TestDiffOfResizedScreenRedraws(t *testing.T) {
+	s := New(12, 5)
+	s.Write([]byte("hello"))
+	prev := s.Frame()
+	s.Resize(20, 6)
+	s.Write([]byte("\x1b[6;1Hbottom"))
+	if diff := s.Diff(prev); !strings.HasPrefix(string(diff), "\x1bc") {
+		t.Errorf("Diff after a resize = %q, want a redraw", diff)
+	}
+	drawn := New(20, 6)
+	drawn.Write(s.Diff(prev))
+	sameScreen(t, drawn, s)
+}
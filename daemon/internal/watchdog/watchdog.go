@@ -0,0 +1,168 @@
+// Package watchdog notices when parts of the daemon stop making progress,
+// such as a read loop stuck on one message or a deadlocked session manager.
+// It runs a probe for each watched part on a timer; a probe that doesn't
+// return within the timeout, or that reports a stall, trips the watchdog.
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// DefaultTimeout is how long a watched part may go without progress.
+const DefaultTimeout = 2 * time.Minute
+
+// TripsEnv hands the trips that led to a restart over to the new process.
+const TripsEnv = "AGENTHQ_WATCHDOG_TRIPS"
+
+// maxTrips bounds the trips kept for heartbeats.
+const maxTrips = 10
+
+// A Probe returns promptly if its part of the daemon is healthy, or an
+// error describing the stall if it knows of one.
+type Probe func() error
+
+// Watchdog runs probes and reports trips.
+type Watchdog struct {
+	timeout time.Duration
+	onTrip  func(protocol.WatchdogTrip)
+
+	mu     sync.Mutex
+	checks []*check
+	trips  []protocol.WatchdogTrip
+}
+
+type check struct {
+	name  string
+	probe Probe
+	// running is set while a probe is outstanding, tripped once it has
+	// tripped the watchdog, so a stall is reported once
+	running bool
+	tripped bool
+}
+
+// New creates a watchdog that calls onTrip for each stall, on its own
+// goroutine. Trips handed over by a previous process are kept.
+func New(timeout time.Duration, onTrip func(protocol.WatchdogTrip)) *Watchdog {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	w := &Watchdog{timeout: timeout, onTrip: onTrip}
+	if data := os.Getenv(TripsEnv); data != "" {
+		if err := json.Unmarshal([]byte(data), &w.trips); err != nil {
+			log.Printf("Ignoring %s: %v", TripsEnv, err)
+		}
+		os.Unsetenv(TripsEnv)
+	}
+	return w
+}
+
+// Watch adds a probe to run.
+func (w *Watchdog) Watch(name string, probe Probe) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.checks = append(w.checks, &check{name: name, probe: probe})
+}
+
+// Trips returns the most recent trips, including ones from before a
+// restart, oldest first.
+func (w *Watchdog) Trips() []protocol.WatchdogTrip {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]protocol.WatchdogTrip(nil), w.trips...)
+}
+
+// Handoff returns the environment variable that hands the trips over to a
+// restarted daemon.
+func (w *Watchdog) Handoff() string {
+	data, _ := json.Marshal(w.Trips())
+	return TripsEnv + "=" + string(data)
+}
+
+// Run probes every quarter of the timeout until stop is closed.
+func (w *Watchdog) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			checks := append([]*check(nil), w.checks...)
+			w.mu.Unlock()
+			for _, c := range checks {
+				go w.probe(c)
+			}
+		}
+	}
+}
+
+// probe runs one check unless its last probe is still outstanding.
+func (w *Watchdog) probe(c *check) {
+	w.mu.Lock()
+	if c.running {
+		w.mu.Unlock()
+		return
+	}
+	c.running = true
+	w.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.probe()
+		w.mu.Lock()
+		c.running = false
+		w.mu.Unlock()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(w.timeout):
+		err = fmt.Errorf("no response in %s", w.timeout)
+	}
+
+	w.mu.Lock()
+	if err == nil {
+		c.tripped = false
+		w.mu.Unlock()
+		return
+	}
+	if c.tripped {
+		w.mu.Unlock()
+		return
+	}
+	c.tripped = true
+	trip := protocol.WatchdogTrip{
+		Time:   time.Now().UnixMilli(),
+		Check:  c.name,
+		Reason: err.Error(),
+	}
+	w.trips = append(w.trips, trip)
+	if len(w.trips) > maxTrips {
+		w.trips = w.trips[len(w.trips)-maxTrips:]
+	}
+	w.mu.Unlock()
+
+	log.Printf("Watchdog tripped: %s: %v", c.name, err)
+	w.onTrip(trip)
+}
+
+// Restarted marks the most recent trip as having restarted the daemon.
+func (w *Watchdog) Restarted() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := len(w.trips); n > 0 {
+		w.trips[n-1].Restarted = true
+	}
+}
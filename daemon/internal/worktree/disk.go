@@ -0,0 +1,73 @@
+package worktree
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrInsufficientDisk is returned (wrapped) by Add when the filesystem
+// doesn't have room for the checkout plus DiskMargin.
+var ErrInsufficientDisk = errors.New("insufficient-disk")
+
+// DefaultDiskMargin is the free space left after a checkout by default.
+const DefaultDiskMargin = 1 << 30
+
+// DiskMargin is the free space, in bytes, that must remain on the target
+// filesystem after a worktree is checked out. Negative disables the check.
+var DiskMargin int64 = DefaultDiskMargin
+
+// checkDisk verifies that dir's filesystem can hold a checkout of rev
+// (HEAD if empty) from repoPath with DiskMargin to spare.
+func checkDisk(repoPath, dir, rev string) error {
+	if DiskMargin < 0 {
+		return nil
+	}
+
+	needed, err := checkoutSize(repoPath, rev)
+	if err != nil {
+		// Let git report the problem, e.g. an unknown base
+		return nil
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return nil
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+
+	if needed+DiskMargin > free {
+		return fmt.Errorf("%w: checkout needs about %d MB plus a %d MB margin, but only %d MB is free on %s",
+			ErrInsufficientDisk, needed>>20, DiskMargin>>20, free>>20, dir)
+	}
+	return nil
+}
+
+// checkoutSize estimates the size of a checkout of rev as the total size of
+// the files in its tree.
+func checkoutSize(repoPath, rev string) (int64, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	output, err := git(repoPath, "ls-tree", "-r", "-l", "-z", rev)
+	if err != nil {
+		return 0, fmt.Errorf("git ls-tree: %w\n%s", err, output)
+	}
+
+	// Entries are "<mode> <type> <object> <size>\t<path>"; size is "-" for
+	// submodules
+	var total int64
+	for _, entry := range strings.Split(string(output), "\x00") {
+		meta, _, _ := strings.Cut(entry, "\t")
+		fields := strings.Fields(meta)
+		if len(fields) != 4 {
+			continue
+		}
+		if size, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			total += size
+		}
+	}
+	return total, nil
+}
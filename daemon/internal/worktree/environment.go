@@ -0,0 +1,210 @@
+package worktree
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// goDownloadTimeout bounds the check that a worktree's Go modules are in
+// the module cache.
+const goDownloadTimeout = 30 * time.Second
+
+// toolVersionsNames maps .tool-versions (asdf, mise) tool names to
+// toolchains.
+var toolVersionsNames = map[string]string{
+	"nodejs": "node",
+	"node":   "node",
+	"golang": "go",
+	"go":     "go",
+	"python": "python",
+}
+
+// Toolchains returns the node, go and python versions a worktree asks for
+// in its version files. Those in dir, a directory relative to the worktree
+// such as a monorepo package's, win over the worktree root's.
+func Toolchains(worktreePath, dir string) []protocol.Toolchain {
+	found := make(map[string]protocol.Toolchain)
+	for _, d := range searchDirs(dir) {
+		for _, t := range toolchainsIn(worktreePath, d) {
+			found[t.Name] = t
+		}
+	}
+
+	var toolchains []protocol.Toolchain
+	for _, name := range []string{"node", "go", "python"} {
+		if t, ok := found[name]; ok {
+			toolchains = append(toolchains, t)
+		}
+	}
+	return toolchains
+}
+
+// toolchainsIn reads the version files of one directory. A toolchain's
+// first file in the order below that names it wins.
+func toolchainsIn(worktreePath, dir string) []protocol.Toolchain {
+	var toolchains []protocol.Toolchain
+	seen := make(map[string]bool)
+	add := func(name, version, file string) {
+		version = strings.TrimSpace(version)
+		if version == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+		toolchains = append(toolchains, protocol.Toolchain{Name: name, Version: version, File: filepath.Join(dir, file)})
+	}
+	read := func(file string) string {
+		data, _ := os.ReadFile(filepath.Join(worktreePath, dir, file))
+		return string(data)
+	}
+	firstLine := func(s string) string {
+		line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+		return line
+	}
+
+	add("node", strings.TrimPrefix(firstLine(read(".nvmrc")), "v"), ".nvmrc")
+	add("node", strings.TrimPrefix(firstLine(read(".node-version")), "v"), ".node-version")
+	add("go", firstLine(read(".go-version")), ".go-version")
+	add("python", firstLine(read(".python-version")), ".python-version")
+
+	for _, line := range strings.Split(read(".tool-versions"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && toolVersionsNames[fields[0]] != "" {
+			add(toolVersionsNames[fields[0]], fields[1], ".tool-versions")
+		}
+	}
+
+	var pkg struct {
+		Engines struct {
+			Node string `json:"node"`
+		} `json:"engines"`
+	}
+	if json.Unmarshal([]byte(read("package.json")), &pkg) == nil {
+		add("node", pkg.Engines.Node, "package.json")
+	}
+	add("go", goModVersion(read("go.mod")), "go.mod")
+	add("python", requiresPython(read("pyproject.toml")), "pyproject.toml")
+	return toolchains
+}
+
+var (
+	goToolchainLine = regexp.MustCompile(`(?m)^toolchain\s+go(\S+)`)
+	goVersionLine   = regexp.MustCompile(`(?m)^go\s+(\S+)`)
+	requiresPyLine  = regexp.MustCompile(`(?m)^requires-python\s*=\s*["']([^"']+)["']`)
+)
+
+// goModVersion returns the Go version a go.mod needs: its toolchain line,
+// or else its go line.
+func goModVersion(gomod string) string {
+	if m := goToolchainLine.FindStringSubmatch(gomod); m != nil {
+		return m[1]
+	}
+	if m := goVersionLine.FindStringSubmatch(gomod); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// requiresPython returns a pyproject.toml's requires-python.
+func requiresPython(pyproject string) string {
+	if m := requiresPyLine.FindStringSubmatch(pyproject); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// Dependencies reports whether a worktree's node, python and Go
+// dependencies are installed, for each ecosystem it has a manifest of in
+// dir or the worktree root: node_modules for package.json, a virtualenv
+// (.venv or venv) for pyproject.toml, requirements.txt or Pipfile, and the
+// modules in the module cache, or vendored, for go.mod. Go modules are
+// only reported when go is on PATH.
+func Dependencies(worktreePath, dir string) []protocol.Dependency {
+	var deps []protocol.Dependency
+	if manifest, ok := findManifest(worktreePath, dir, "package.json"); ok {
+		deps = append(deps, protocol.Dependency{
+			Ecosystem: "node",
+			Manifest:  manifest,
+			Installed: existsNear(worktreePath, filepath.Dir(manifest), "node_modules"),
+		})
+	}
+	if manifest, ok := findManifest(worktreePath, dir, "pyproject.toml", "requirements.txt", "Pipfile"); ok {
+		d := filepath.Dir(manifest)
+		deps = append(deps, protocol.Dependency{
+			Ecosystem: "python",
+			Manifest:  manifest,
+			Installed: existsNear(worktreePath, d, ".venv/pyvenv.cfg") || existsNear(worktreePath, d, "venv/pyvenv.cfg"),
+		})
+	}
+	if manifest, ok := findManifest(worktreePath, dir, "go.mod"); ok {
+		if installed, known := goModulesInstalled(filepath.Join(worktreePath, filepath.Dir(manifest))); known {
+			deps = append(deps, protocol.Dependency{Ecosystem: "go", Manifest: manifest, Installed: installed})
+		}
+	}
+	return deps
+}
+
+// findManifest returns the first of names in dir, or else in the worktree
+// root, relative to the worktree.
+func findManifest(worktreePath, dir string, names ...string) (string, bool) {
+	dirs := searchDirs(dir)
+	slices.Reverse(dirs)
+	for _, d := range dirs {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(worktreePath, d, name)); err == nil {
+				return filepath.Join(d, name), true
+			}
+		}
+	}
+	return "", false
+}
+
+// existsNear reports whether name exists in dir or the worktree root, where
+// workspaces (npm, pnpm, uv) install for every package.
+func existsNear(worktreePath, dir, name string) bool {
+	for _, d := range searchDirs(dir) {
+		if _, err := os.Stat(filepath.Join(worktreePath, d, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// goModulesInstalled reports whether the module in dir has its
+// dependencies vendored or in the module cache, without downloading
+// them. known is false if that can't be told, as without go.
+func goModulesInstalled(dir string) (installed, known bool) {
+	if _, err := os.Stat(filepath.Join(dir, "vendor", "modules.txt")); err == nil {
+		return true, true
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		return false, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), goDownloadTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "go", "mod", "download")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOPROXY=off", "GOFLAGS=-mod=mod", "GOTOOLCHAIN=local")
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return false, false
+	}
+	return err == nil, true
+}
+
+// searchDirs returns the worktree root and then dir, if it is another
+// directory.
+func searchDirs(dir string) []string {
+	if dir = filepath.Clean(dir); dir == "." {
+		return []string{"."}
+	}
+	return []string{".", dir}
+}
@@ -0,0 +1,52 @@
+package worktree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExcludeWorktreesDir makes git ignore a repo's DirName, so its worktrees
+// don't show up in the repo's git status or get committed, by adding it to
+// the repo's .git/info/exclude rather than its tracked .gitignore. A repo
+// that already ignores it is left alone, as are all with Root set.
+func ExcludeWorktreesDir(repoPath string) error {
+	if Root != "" {
+		return nil
+	}
+	if _, err := git(repoPath, "check-ignore", "--quiet", DirName+"/"); err == nil {
+		return nil
+	}
+
+	out, err := git(repoPath, "rev-parse", "--git-path", "info/exclude")
+	if err != nil {
+		return fmt.Errorf("failed to find info/exclude: %w\n%s", err, out)
+	}
+	exclude := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(exclude) {
+		exclude = filepath.Join(repoPath, exclude)
+	}
+	if err := os.MkdirAll(filepath.Dir(exclude), 0o755); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(exclude)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	entry := "/" + DirName + "/\n"
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		entry = "\n" + entry
+	}
+	f, err := os.OpenFile(exclude, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
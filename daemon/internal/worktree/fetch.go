@@ -0,0 +1,112 @@
+package worktree
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// fetchTimeout bounds a fetch, which waits on the network.
+const fetchTimeout = 2 * time.Minute
+
+// Fetch fetches a repo's remotes and fast-forwards branch, usually its
+// default branch, to its upstream, so that worktrees created from it start
+// from what was pushed. The branch is only moved if that is a fast-forward
+// and, where it is checked out, the checkout has no changes; otherwise it
+// is left alone and the status says how far apart the two are.
+func Fetch(repoPath, branch string) (protocol.RepoSync, error) {
+	status := protocol.RepoSync{Branch: branch, FetchedAt: time.Now().UnixMilli()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "fetch", "--all", "--prune")
+	cmd.Dir = repoPath
+	// Fail rather than wait for credentials nobody will type
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return status, fmt.Errorf("git fetch: %w\n%s", err, output)
+	}
+
+	output, err := git(repoPath, "rev-parse", "--abbrev-ref", branch+"@{upstream}")
+	if err != nil {
+		// Nothing to follow
+		return status, nil
+	}
+	status.Upstream = strings.TrimSpace(string(output))
+
+	if status.Ahead, status.Behind, err = aheadBehind(repoPath, branch, status.Upstream); err != nil {
+		return status, err
+	}
+	if status.Behind == 0 || status.Ahead > 0 {
+		return status, nil
+	}
+	if err := fastForward(repoPath, branch, status.Upstream); err != nil {
+		return status, err
+	}
+	status.Ahead, status.Behind, err = aheadBehind(repoPath, branch, status.Upstream)
+	return status, err
+}
+
+// aheadBehind counts the commits on branch that upstream doesn't have, and
+// the other way round.
+func aheadBehind(repoPath, branch, upstream string) (ahead, behind int, err error) {
+	output, err := git(repoPath, "rev-list", "--left-right", "--count", branch+"..."+upstream)
+	if err != nil {
+		return 0, 0, fmt.Errorf("git rev-list: %w\n%s", err, output)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("git rev-list: unexpected output %q", output)
+	}
+	ahead, _ = strconv.Atoi(fields[0])
+	behind, _ = strconv.Atoi(fields[1])
+	return ahead, behind, nil
+}
+
+// fastForward moves branch, which is behind upstream and not ahead of it,
+// to upstream: with a merge where it is checked out, unless the checkout
+// has changes, and by moving the ref otherwise.
+func fastForward(repoPath, branch, upstream string) error {
+	checkout, err := checkedOutAt(repoPath, branch)
+	if err != nil {
+		return err
+	}
+	if checkout == "" {
+		if output, err := git(repoPath, "update-ref", "refs/heads/"+branch, upstream); err != nil {
+			return fmt.Errorf("git update-ref: %w\n%s", err, output)
+		}
+		return nil
+	}
+	if dirty, err := Dirty(checkout); err != nil || dirty {
+		// Left for the user, and reported as behind
+		return err
+	}
+	if output, err := git(checkout, "merge", "--ff-only", upstream); err != nil {
+		return fmt.Errorf("git merge --ff-only: %w\n%s", err, output)
+	}
+	return nil
+}
+
+// checkedOutAt returns the worktree of repoPath that has branch checked
+// out, if any.
+func checkedOutAt(repoPath, branch string) (string, error) {
+	output, err := git(repoPath, "worktree", "list", "--porcelain")
+	if err != nil {
+		return "", fmt.Errorf("git worktree list: %w\n%s", err, output)
+	}
+	var path string
+	for _, line := range strings.Split(string(output), "\n") {
+		if p, ok := strings.CutPrefix(line, "worktree "); ok {
+			path = p
+		} else if line == "branch refs/heads/"+branch {
+			return path, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,102 @@
+package worktree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// HookNames are the client-side git hooks InstallHooks can install.
+var HookNames = []string{
+	"applypatch-msg", "pre-applypatch", "post-applypatch",
+	"pre-commit", "pre-merge-commit", "prepare-commit-msg", "commit-msg", "post-commit",
+	"pre-rebase", "post-checkout", "post-merge", "pre-push", "post-rewrite",
+	"reference-transaction", "pre-auto-gc",
+}
+
+// hooksDirName is the directory in a worktree's private git directory
+// that holds its hooks; git removes it with the worktree.
+const hooksDirName = "agenthq-hooks"
+
+// InstallHooks makes hooks (hook name to shell command) the git hooks of
+// one worktree, leaving the repo and its other worktrees alone. Each
+// command runs with sh in the worktree, with the hook's arguments and
+// input; if it succeeds, the repo's own hook of that name runs after it.
+// The repo's other hooks keep running as before.
+func InstallHooks(worktreePath string, hooks map[string]string) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	out, err := git(worktreePath, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return fmt.Errorf("failed to find git directory: %w", err)
+	}
+	dir := filepath.Join(strings.TrimSpace(string(out)), hooksDirName)
+	out, err = git(worktreePath, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return fmt.Errorf("failed to find hooks: %w", err)
+	}
+	repoHooks := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(repoHooks) {
+		repoHooks = filepath.Join(worktreePath, repoHooks)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, name := range HookNames {
+		original := filepath.Join(repoHooks, name)
+		if info, err := os.Stat(original); err != nil || !info.Mode().IsRegular() || info.Mode()&0o111 == 0 {
+			original = ""
+		}
+		var script string
+		switch command, ok := hooks[name]; {
+		case ok:
+			script = hookScript(name, command, original)
+		case original != "":
+			script = "#!/bin/sh\nexec " + shellQuote(original) + " \"$@\"\n"
+		default:
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			return err
+		}
+	}
+
+	// Per-worktree config needs the extension; it changes nothing else
+	if _, err := git(worktreePath, "config", "extensions.worktreeConfig", "true"); err != nil {
+		return fmt.Errorf("failed to enable worktree config: %w", err)
+	}
+	if _, err := git(worktreePath, "config", "--worktree", "core.hooksPath", dir); err != nil {
+		return fmt.Errorf("failed to set hooks path: %w", err)
+	}
+	return nil
+}
+
+// hookScript returns a hook that runs command and then the repo's
+// original hook, if any, giving both the same input.
+func hookScript(name, command, original string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# %s hook installed by the agenthq daemon from .agenthq.yml\n", name)
+	b.WriteString("input=$(mktemp) || exit\n")
+	b.WriteString("trap 'rm -f \"$input\"' EXIT\n")
+	b.WriteString("cat >\"$input\"\n")
+	fmt.Fprintf(&b, "sh -c %s %s \"$@\" <\"$input\" || exit\n", shellQuote(command), name)
+	if original != "" {
+		fmt.Fprintf(&b, "%s \"$@\" <\"$input\"\n", shellQuote(original))
+	}
+	return b.String()
+}
+
+// ValidHookName reports whether name is a hook InstallHooks can install.
+func ValidHookName(name string) bool {
+	return slices.Contains(HookNames, name)
+}
+
+// shellQuote wraps s in single quotes for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
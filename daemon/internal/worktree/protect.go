@@ -0,0 +1,81 @@
+package worktree
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Protected returns the protected path (slash-separated, relative to the
+// worktree root) that rel is, or is inside, or "" if none.
+func Protected(rel string, protected []string) string {
+	rel = path.Clean(filepath.ToSlash(rel))
+	for _, p := range protected {
+		p = path.Clean(p)
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return p
+		}
+	}
+	return ""
+}
+
+// CheckProtected returns an error naming the first of files (relative to
+// the worktree root) that is protected.
+func CheckProtected(protected []string, files ...string) error {
+	for _, file := range files {
+		if p := Protected(file, protected); p != "" {
+			return fmt.Errorf("%s is protected (%s)", file, p)
+		}
+	}
+	return nil
+}
+
+// Fingerprint records the files under a worktree's protected paths, to
+// tell later which of them were touched.
+type Fingerprint map[string]string
+
+// TakeFingerprint records the size, modification time and mode of the
+// files under the protected paths in worktreePath.
+func TakeFingerprint(worktreePath string, protected []string) Fingerprint {
+	fp := Fingerprint{}
+	for _, p := range protected {
+		root := filepath.Join(worktreePath, filepath.FromSlash(p))
+		filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(worktreePath, file)
+			if err != nil {
+				return nil
+			}
+			fp[filepath.ToSlash(rel)] = fmt.Sprintf("%d %d %v", info.Size(), info.ModTime().UnixNano(), info.Mode())
+			return nil
+		})
+	}
+	return fp
+}
+
+// Touched returns the files, sorted, that were added, changed or removed
+// between the fingerprints.
+func (fp Fingerprint) Touched(now Fingerprint) []string {
+	var touched []string
+	for file, was := range fp {
+		if now[file] != was {
+			touched = append(touched, file)
+		}
+	}
+	for file := range now {
+		if _, ok := fp[file]; !ok {
+			touched = append(touched, file)
+		}
+	}
+	slices.Sort(touched)
+	return touched
+}
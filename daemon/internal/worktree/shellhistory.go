@@ -0,0 +1,21 @@
+package worktree
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// shellHistoryDirName is the directory in a worktree's private git
+// directory that holds its sessions' shell histories; git removes it with
+// the worktree.
+const shellHistoryDirName = "agenthq-shell-history"
+
+// ShellHistoryDir returns the directory that holds the shell histories of
+// a worktree's sessions: in its private git directory, or in
+// .agenthq/shell-history outside git.
+func ShellHistoryDir(worktreePath string) string {
+	if out, err := git(worktreePath, "rev-parse", "--absolute-git-dir"); err == nil {
+		return filepath.Join(strings.TrimSpace(string(out)), shellHistoryDirName)
+	}
+	return filepath.Join(worktreePath, ".agenthq", "shell-history")
+}
@@ -0,0 +1,52 @@
+package worktree
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// StageDir is the directory inside a worktree that holds files the server
+// stages for a task. It ignores itself, so staged files never show up in
+// git status or get committed.
+const StageDir = ".agenthq/files"
+
+// StagedFile is a file to write into StageDir.
+type StagedFile struct {
+	// Name is a slash-separated path relative to StageDir
+	Name string
+	Data []byte
+}
+
+// Stage writes files into the worktree's StageDir, replacing files of the
+// same name, and returns their paths relative to the worktree. Names must
+// stay inside StageDir.
+func Stage(worktreePath string, files []StagedFile) ([]string, error) {
+	for _, file := range files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Name)) {
+			return nil, fmt.Errorf("invalid file name %q", file.Name)
+		}
+	}
+
+	dir := filepath.Join(worktreePath, filepath.FromSlash(StageDir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	var staged []string
+	for _, file := range files {
+		dst := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return staged, err
+		}
+		if err := os.WriteFile(dst, file.Data, 0644); err != nil {
+			return staged, err
+		}
+		staged = append(staged, path.Join(StageDir, file.Name))
+	}
+	return staged, nil
+}
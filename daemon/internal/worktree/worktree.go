@@ -0,0 +1,422 @@
+// Package worktree wraps the git operations the daemon performs on
+// repositories and their agent worktrees.
+package worktree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// DirName is the directory inside a repo that holds agent worktrees,
+// unless Root is set.
+const DirName = ".agenthq-worktrees"
+
+// Root, if set, is the directory outside the repos that holds agent
+// worktrees instead, in a directory per repo named after it.
+var Root string
+
+// Dir returns the directory that holds a repo's agent worktrees.
+func Dir(repoPath string) string {
+	if Root == "" {
+		return filepath.Join(repoPath, DirName)
+	}
+	return filepath.Join(Root, filepath.Base(repoPath))
+}
+
+// BranchName returns the initial branch name for a worktree.
+func BranchName(worktreeID string) string {
+	return fmt.Sprintf("agent/%s", worktreeID)
+}
+
+// AddOptions customizes a new worktree.
+type AddOptions struct {
+	// Base is the commit to start from; the repo's HEAD if empty.
+	Base string
+	// SparsePaths, if set, checks out only these directories.
+	SparsePaths []string
+}
+
+// Add creates a git worktree for worktreeID on a new branch starting at
+// opts.Base. It returns the worktree path and branch, or an error wrapping
+// ErrInsufficientDisk if the checkout wouldn't fit.
+func Add(repoPath, worktreeID string, opts AddOptions) (string, string, error) {
+	worktreesDir := Dir(repoPath)
+	worktreePath := filepath.Join(worktreesDir, worktreeID)
+	branch := BranchName(worktreeID)
+
+	// Create the worktrees directory if it doesn't exist
+	if err := os.MkdirAll(worktreesDir, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create worktrees directory: %w", err)
+	}
+
+	// Fail early rather than with a half-written checkout
+	if err := checkDisk(repoPath, worktreesDir, opts.Base); err != nil {
+		return "", "", err
+	}
+
+	args := []string{"worktree", "add", worktreePath, "-b", branch}
+	if len(opts.SparsePaths) > 0 {
+		// Check out after narrowing the checkout
+		args = append(args, "--no-checkout")
+	}
+	if opts.Base != "" {
+		args = append(args, opts.Base)
+	}
+	if output, err := git(repoPath, args...); err != nil {
+		return "", "", fmt.Errorf("git worktree add: %w\n%s", err, output)
+	}
+
+	if len(opts.SparsePaths) > 0 {
+		sparse := append([]string{"sparse-checkout", "set", "--cone", "--"}, opts.SparsePaths...)
+		if output, err := git(worktreePath, sparse...); err != nil {
+			Remove(worktreePath)
+			return "", "", fmt.Errorf("git sparse-checkout: %w\n%s", err, output)
+		}
+		if output, err := git(worktreePath, "checkout"); err != nil {
+			Remove(worktreePath)
+			return "", "", fmt.Errorf("git checkout: %w\n%s", err, output)
+		}
+	}
+
+	return worktreePath, branch, nil
+}
+
+// Remove force-removes a worktree created by Add, from the repo git says
+// it belongs to, and reports how that went. Each of the removal steps is
+// tried in turn until the worktree's directory is gone and git no longer
+// lists it: git worktree remove, then again to get past a lock, then
+// deleting the directory and pruning git's record of it, which is only
+// done to directories Add would have created.
+func Remove(worktreePath string) (protocol.WorktreeRemoval, error) {
+	var removal protocol.WorktreeRemoval
+	if worktreePath == "" {
+		return removal, fmt.Errorf("empty worktree path")
+	}
+
+	repoPath, err := OwningRepo(worktreePath)
+	if err != nil {
+		// A worktree too broken for git to work in can still be removed
+		// from a repo that holds its worktrees in DirName
+		if filepath.Base(filepath.Dir(worktreePath)) != DirName {
+			return removal, err
+		}
+		repoPath = filepath.Dir(filepath.Dir(worktreePath))
+	}
+	removal.Repo = repoPath
+	if realPath(repoPath) == realPath(worktreePath) {
+		return removal, fmt.Errorf("%s is a repo, not a worktree", worktreePath)
+	}
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{protocol.RemovalRemove, func() error {
+			return gitStep(repoPath, "worktree", "remove", "--force", worktreePath)
+		}},
+		{protocol.RemovalForce, func() error {
+			return gitStep(repoPath, "worktree", "remove", "--force", "--force", worktreePath)
+		}},
+		{protocol.RemovalDelete, func() error {
+			if _, ok := managedDir(repoPath, worktreePath); !ok {
+				return fmt.Errorf("not in %s", Dir(repoPath))
+			}
+			if err := os.RemoveAll(worktreePath); err != nil {
+				return err
+			}
+			return gitStep(repoPath, "worktree", "prune")
+		}},
+	}
+	for _, step := range steps {
+		err := step.run()
+		if err == nil {
+			err = verifyRemoved(repoPath, worktreePath)
+		}
+		if err == nil {
+			removal.Steps = append(removal.Steps, protocol.RemovalStep{Step: step.name})
+			removal.Removed = true
+			return removal, nil
+		}
+		removal.Steps = append(removal.Steps, protocol.RemovalStep{Step: step.name, Error: err.Error()})
+	}
+	last := removal.Steps[len(removal.Steps)-1]
+	return removal, fmt.Errorf("failed to remove worktree %s: %s", worktreePath, last.Error)
+}
+
+// verifyRemoved checks that a worktree's directory is gone and that its
+// repo no longer lists it.
+func verifyRemoved(repoPath, worktreePath string) error {
+	if _, err := os.Lstat(worktreePath); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is still there", worktreePath)
+	}
+	worktrees, err := listPorcelain(repoPath)
+	if err != nil {
+		return err
+	}
+	want := filepath.Join(realPath(filepath.Dir(worktreePath)), filepath.Base(worktreePath))
+	for _, path := range worktrees {
+		if filepath.Join(realPath(filepath.Dir(path)), filepath.Base(path)) == want {
+			return fmt.Errorf("git still lists %s", worktreePath)
+		}
+	}
+	return nil
+}
+
+// gitStep runs a git command in dir, with its output in the error if it
+// fails.
+func gitStep(dir string, args ...string) error {
+	if output, err := git(dir, args...); err != nil {
+		return fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CopyFiles copies files (relative paths) from repoPath into the same
+// place in a worktree. Files missing from the repo or already present in
+// the worktree are skipped.
+func CopyFiles(repoPath, worktreePath string, files []string) error {
+	for _, file := range files {
+		src := filepath.Join(repoPath, file)
+		dst := filepath.Join(worktreePath, file)
+
+		data, err := os.ReadFile(src)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the paths of the worktrees created by Add in repoPath: the
+// repo's worktrees in Dir, or in DirName inside the repo from before Root
+// was set.
+func List(repoPath string) ([]string, error) {
+	worktrees, err := listPorcelain(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Paths are compared resolved, as git may list them, but returned as
+	// Add does
+	var paths []string
+	for _, path := range worktrees[1:] {
+		if dir, ok := managedDir(repoPath, path); ok {
+			paths = append(paths, filepath.Join(dir, filepath.Base(path)))
+		}
+	}
+	return paths, nil
+}
+
+// managedDir returns the directory of a repo's agent worktrees that path
+// is in, if it is in one: Dir, or DirName inside the repo.
+func managedDir(repoPath, path string) (string, bool) {
+	parent := realPath(filepath.Dir(path))
+	for _, dir := range []string{Dir(repoPath), filepath.Join(repoPath, DirName)} {
+		if parent == realPath(dir) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// realPath returns path with symlinks resolved, or as it is if it can't
+// be.
+func realPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// OwningRepo returns the repo a worktree belongs to: its main worktree, as
+// git lists it.
+func OwningRepo(worktreePath string) (string, error) {
+	worktrees, err := listPorcelain(worktreePath)
+	if err != nil {
+		return "", err
+	}
+	return worktrees[0], nil
+}
+
+// listPorcelain returns the paths of the worktrees of the repo dir is in,
+// the main worktree first.
+func listPorcelain(dir string) ([]string, error) {
+	output, err := git(dir, "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, fmt.Errorf("git worktree list: %w\n%s", err, output)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if path, ok := strings.CutPrefix(line, "worktree "); ok {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no worktrees found for %s", dir)
+	}
+	return paths, nil
+}
+
+// Dirty reports whether a worktree has uncommitted changes, including
+// untracked files.
+func Dirty(worktreePath string) (bool, error) {
+	output, err := git(worktreePath, "status", "--porcelain")
+	if err != nil {
+		return false, fmt.Errorf("git status: %w\n%s", err, output)
+	}
+	return strings.TrimSpace(string(output)) != "", nil
+}
+
+// Head returns the commit SHA checked out in dir.
+func Head(dir string) (string, error) {
+	return ResolveCommit(dir, "HEAD")
+}
+
+// Branch returns the branch checked out in dir, or "" if HEAD is
+// detached.
+func Branch(dir string) (string, error) {
+	output, err := git(dir, "symbolic-ref", "--quiet", "--short", "HEAD")
+	if err != nil {
+		if len(output) == 0 {
+			return "", nil
+		}
+		return "", fmt.Errorf("git symbolic-ref: %w\n%s", err, output)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// TopLevel returns the top directory of the git checkout dir is in.
+func TopLevel(dir string) (string, error) {
+	output, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse: %w\n%s", err, output)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// MainRepo returns the directory of the repository a worktree belongs to;
+// for a repository's own checkout that is dir's top level.
+func MainRepo(dir string) (string, error) {
+	output, err := git(dir, "rev-parse", "--path-format=absolute", "--git-common-dir")
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse: %w\n%s", err, output)
+	}
+	return filepath.Dir(strings.TrimSpace(string(output))), nil
+}
+
+// ResolveCommit returns the commit SHA a ref (branch, tag, SHA) points to.
+func ResolveCommit(dir, ref string) (string, error) {
+	output, err := git(dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown commit %q in %s", ref, dir)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// DiffStat summarizes how a worktree differs from a base commit.
+type DiffStat struct {
+	FilesChanged int `json:"filesChanged"`
+	Insertions   int `json:"insertions"`
+	Deletions    int `json:"deletions"`
+	// Untracked counts new files not yet added to git (not ignored).
+	Untracked int `json:"untracked"`
+}
+
+// Diff compares the worktree's working tree, including uncommitted changes,
+// against base.
+func Diff(worktreePath, base string) (DiffStat, error) {
+	var stat DiffStat
+
+	output, err := git(worktreePath, "diff", "--numstat", base)
+	if err != nil {
+		return stat, fmt.Errorf("git diff: %w\n%s", err, output)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		stat.FilesChanged++
+		// Binary files report "-" for both counts
+		if n, err := strconv.Atoi(fields[0]); err == nil {
+			stat.Insertions += n
+		}
+		if n, err := strconv.Atoi(fields[1]); err == nil {
+			stat.Deletions += n
+		}
+	}
+
+	output, err = git(worktreePath, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return stat, fmt.Errorf("git ls-files: %w\n%s", err, output)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) != "" {
+			stat.Untracked++
+		}
+	}
+
+	return stat, nil
+}
+
+// ChangedFiles returns the slash-separated paths, relative to the worktree
+// root, of the files that differ from base in the worktree's working tree,
+// and the untracked files not ignored. A renamed file is listed under both
+// its old and its new name.
+func ChangedFiles(worktreePath, base string) ([]string, error) {
+	var files []string
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--no-renames", "-z", base},
+		{"ls-files", "--others", "--exclude-standard", "-z"},
+	} {
+		output, err := git(worktreePath, args...)
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w\n%s", args[0], err, output)
+		}
+		for _, name := range strings.Split(string(output), "\x00") {
+			if name != "" {
+				files = append(files, name)
+			}
+		}
+	}
+	return files, nil
+}
+
+// git runs a git command in dir and returns its combined output.
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return cmd.CombinedOutput()
+}
@@ -0,0 +1,312 @@
+package agenthqd
+
+import (
+	"cmp"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/ptylog"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/vt"
+)
+
+// Adaptive output defaults
+const (
+	defaultCondenseAfter    = 5 * time.Second
+	defaultCondenseInterval = time.Second
+	defaultCondenseRecover  = 30 * time.Second
+)
+
+// backedUpShare is the share of the time a connection spends writing
+// above which it counts as backed up: the link can't keep up with what is
+// sent.
+const backedUpShare = 0.5
+
+// sessionScreen follows what a session's terminal shows, so that its
+// output can be condensed into updates of its screen at any time.
+type sessionScreen struct {
+	// sendMu keeps the session's output and updates in order
+	sendMu sync.Mutex
+
+	mu     sync.Mutex
+	screen *vt.Screen
+	// condensed is set while the output goes as updates of the screen
+	condensed bool
+	// seq is the last output on screen and sentSeq the last one sent
+	seq, sentSeq uint64
+	// sent is what the server's terminal shows, nil if unknown
+	sent *vt.Frame
+}
+
+// With adaptive output enabled, screens has each running session's screen.
+var (
+	screensMu  sync.Mutex
+	screens    map[string]*sessionScreen
+	screensMgr *session.Manager
+)
+
+// followScreens enables adaptive output: from now on, sessions' screens
+// are followed.
+func followScreens(mgr *session.Manager) {
+	screensMu.Lock()
+	defer screensMu.Unlock()
+	screens = make(map[string]*sessionScreen)
+	screensMgr = mgr
+}
+
+// screenOf returns a session's screen, starting to follow it if needed, or
+// nil without adaptive output.
+func screenOf(processID string) *sessionScreen {
+	screensMu.Lock()
+	defer screensMu.Unlock()
+	if screens == nil {
+		return nil
+	}
+	if ss, ok := screens[processID]; ok {
+		return ss
+	}
+	cols, rows, err := screensMgr.Size(processID)
+	if err != nil {
+		return nil
+	}
+	ss := &sessionScreen{screen: vt.New(cols, rows)}
+	mgr := screensMgr
+	ss.screen.OnReply(func(answer []byte) {
+		// The server's terminal answers queries unless the output is
+		// condensed
+		if ss.condensed {
+			mgr.Input(processID, answer)
+		}
+	})
+	screens[processID] = ss
+	return ss
+}
+
+func followedScreen(processID string) *sessionScreen {
+	screensMu.Lock()
+	defer screensMu.Unlock()
+	return screens[processID]
+}
+
+// sendOutputChunk sends a chunk of a session's output to its server, or
+// only puts it on the session's screen while its output is condensed.
+func sendOutputChunk(processID string, chunk ptylog.Chunk) {
+	ss := screenOf(processID)
+	if ss == nil {
+		sendToOwner(ptyData(processID, chunk.Seq, chunk.Data, false))
+		return
+	}
+	ss.mu.Lock()
+	ss.screen.Write(chunk.Data)
+	ss.seq = chunk.Seq
+	condensed := ss.condensed
+	ss.mu.Unlock()
+	if condensed {
+		return
+	}
+	ss.sendMu.Lock()
+	defer ss.sendMu.Unlock()
+	sendToOwner(ptyData(processID, chunk.Seq, chunk.Data, false))
+}
+
+// resizeScreen keeps a session's screen the size of its terminal.
+func resizeScreen(mgr *session.Manager, processID string) {
+	ss := followedScreen(processID)
+	if ss == nil {
+		return
+	}
+	cols, rows, err := mgr.Size(processID)
+	if err != nil {
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.screen.Resize(cols, rows)
+}
+
+// forgetScreen stops following an exited session's screen, first sending
+// what changed on it if its output was condensed.
+func forgetScreen(to link, processID string) {
+	screensMu.Lock()
+	ss := screens[processID]
+	delete(screens, processID)
+	screensMu.Unlock()
+	if ss != nil && to != nil {
+		ss.stream(to, processID)
+	}
+}
+
+// condense starts sending the session's output as updates of its screen.
+// The server's terminal shows the screen as it is now.
+func (ss *sessionScreen) condense() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.condensed {
+		ss.condensed = true
+		ss.sent, ss.sentSeq = ss.screen.Frame(), ss.seq
+	}
+}
+
+// stream sends what changed on the screen of a condensed session and
+// streams its output again.
+func (ss *sessionScreen) stream(to link, processID string) {
+	ss.sendMu.Lock()
+	defer ss.sendMu.Unlock()
+	ss.mu.Lock()
+	if !ss.condensed {
+		ss.mu.Unlock()
+		return
+	}
+	ss.condensed = false
+	msg, ok := ss.changes(processID, false)
+	ss.mu.Unlock()
+	if ok {
+		to.Send(msg)
+	}
+}
+
+// update sends the server what changed on the screen of a condensed
+// session since the last update, or all of it if redraw is set or the
+// server's terminal is unknown.
+func (ss *sessionScreen) update(to link, processID string, redraw bool) {
+	ss.sendMu.Lock()
+	defer ss.sendMu.Unlock()
+	ss.mu.Lock()
+	if !ss.condensed {
+		ss.mu.Unlock()
+		return
+	}
+	msg, ok := ss.changes(processID, redraw)
+	ss.mu.Unlock()
+	if ok {
+		to.Send(msg)
+	}
+}
+
+// changes returns the pty-data that updates the server's terminal, if
+// anything changed. ss.mu must be held.
+func (ss *sessionScreen) changes(processID string, redraw bool) (protocol.DaemonMessage, bool) {
+	if redraw {
+		ss.sent = nil
+	}
+	if ss.sent != nil && ss.seq == ss.sentSeq {
+		return protocol.DaemonMessage{}, false
+	}
+	snapshot := ss.sent == nil
+	msg := ptyData(processID, ss.seq, ss.screen.Diff(ss.sent), snapshot)
+	msg.Condensed = true
+	ss.sent, ss.sentSeq = ss.screen.Frame(), ss.seq
+	return msg, true
+}
+
+// condensedScreen returns a session's screen if its output is condensed.
+func condensedScreen(processID string) *sessionScreen {
+	ss := followedScreen(processID)
+	if ss == nil {
+		return nil
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.condensed {
+		return nil
+	}
+	return ss
+}
+
+// adaptOutput condenses the output of the connection's sessions while the
+// connection is backed up, until it has kept up for a while.
+func (c *connection) adaptOutput(cfg config.AdaptiveOutput, stop <-chan struct{}) {
+	after := cmp.Or(cfg.AfterDuration(), defaultCondenseAfter)
+	interval := cmp.Or(cfg.IntervalDuration(), defaultCondenseInterval)
+	recoverAfter := cmp.Or(cfg.RecoverDuration(), defaultCondenseRecover)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		cl               *client.Client
+		written          time.Duration
+		last             = time.Now()
+		backedUp, keptUp time.Duration
+		condensing       bool
+	)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		elapsed := now.Sub(last)
+		last = now
+
+		if current := c.current(); current != cl {
+			// A new connection starts over, and its server's terminals are
+			// unknown
+			cl, backedUp, keptUp = current, 0, 0
+			if cl != nil {
+				written = cl.Writing()
+			}
+			c.forEachScreen(func(_ string, ss *sessionScreen) {
+				ss.mu.Lock()
+				ss.sent = nil
+				ss.mu.Unlock()
+			})
+			continue
+		}
+		if cl == nil {
+			continue
+		}
+
+		w := cl.Writing()
+		if float64(w-written) >= backedUpShare*float64(elapsed) {
+			backedUp, keptUp = backedUp+elapsed, 0
+		} else {
+			backedUp, keptUp = 0, keptUp+elapsed
+		}
+		written = w
+
+		switch {
+		case !condensing && backedUp >= after:
+			condensing = true
+			log.Printf("[%s] Connection can't keep up; sending session output as screen updates every %s", c.label(), interval)
+		case condensing && keptUp >= recoverAfter:
+			condensing = false
+			log.Printf("[%s] Connection keeps up again; streaming session output", c.label())
+			c.forEachScreen(func(processID string, ss *sessionScreen) {
+				ss.stream(cl, processID)
+			})
+		}
+		if condensing {
+			c.forEachScreen(func(processID string, ss *sessionScreen) {
+				ss.condense()
+				ss.update(cl, processID, false)
+			})
+		}
+	}
+}
+
+// forEachScreen calls fn for the screen of each of the connection's
+// sessions.
+func (c *connection) forEachScreen(fn func(string, *sessionScreen)) {
+	type owned struct {
+		processID string
+		ss        *sessionScreen
+	}
+	var list []owned
+	screensMu.Lock()
+	for processID, ss := range screens {
+		if c.namespace == "" || strings.HasPrefix(processID, c.namespace+"/") {
+			list = append(list, owned{processID, ss})
+		}
+	}
+	screensMu.Unlock()
+	for _, o := range list {
+		fn(o.processID, o.ss)
+	}
+}
@@ -0,0 +1,338 @@
+package agenthqd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/agenthq/daemon/internal/localserver"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/scope"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// apiSession is a running session as returned by the REST API.
+type apiSession struct {
+	ProcessID      string             `json:"processId"`
+	Agent          protocol.AgentType `json:"agent"`
+	WorktreePath   string             `json:"worktreePath"`
+	AgentSessionID string             `json:"agentSessionId,omitempty"`
+	Group          string             `json:"group,omitempty"`
+	Package        string             `json:"package,omitempty"`
+	ReadOnly       bool               `json:"readOnly,omitempty"`
+}
+
+// apiWorktree is a created worktree as returned by the REST API.
+type apiWorktree struct {
+	WorktreeID string `json:"worktreeId"`
+	Path       string `json:"path"`
+	Branch     string `json:"branch"`
+	Package    string `json:"package,omitempty"`
+	SetupError string `json:"setupError,omitempty"`
+	// Environment is as in worktree-ready
+	Environment *protocol.WorktreeEnvironment `json:"environment,omitempty"`
+}
+
+// newAPIHandler serves the REST API under /api/. Request bodies use the same
+// field names as the equivalent WebSocket messages. Every request must carry
+// token, or one of the scoped tokens, as a bearer token; a scoped token must
+// allow the equivalent message. reload reloads the daemon's config, and
+// drain starts a drain.
+func newAPIHandler(mgr *session.Manager, token string, reload func() (ReloadResult, error), drain func() <-chan struct{}) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if apiOutOfScope(w, r, protocol.ServerMessage{Type: protocol.MsgTypeGetSessionInfo}) {
+			return
+		}
+		sessions := []apiSession{}
+		for _, info := range mgr.List() {
+			sessions = append(sessions, apiSession{
+				ProcessID:      info.ID,
+				Agent:          info.Agent,
+				WorktreePath:   info.WorktreePath,
+				AgentSessionID: info.AgentSessionID,
+				Group:          info.Group,
+				Package:        info.Package,
+				ReadOnly:       info.ReadOnly,
+			})
+		}
+		writeJSON(w, http.StatusOK, sessions)
+	})
+
+	// Body is a spawn message without its type
+	mux.HandleFunc("POST /api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		var msg protocol.ServerMessage
+		if !readJSON(w, r, &msg) {
+			return
+		}
+		if msg.ProcessID == "" {
+			msg.ProcessID = fmt.Sprintf("api-%d", time.Now().UnixNano())
+		}
+		if msg.Cols <= 0 || msg.Rows <= 0 {
+			msg.Cols, msg.Rows = defaultCols, defaultRows
+		}
+		msg.Type = protocol.MsgTypeSpawn
+		if apiOutOfScope(w, r, msg) || apiDraining(w, r, msg) || apiDeniedByPlugin(w, r, msg) {
+			return
+		}
+
+		log.Printf("API spawn request: processId=%s agent=%s profile=%s", msg.ProcessID, msg.Agent, msg.Profile)
+		if dryRun || msg.DryRun {
+			plan, err := planSpawn(mgr, msg)
+			writePlan(w, plan, err)
+			return
+		}
+		opts, err := spawnOptions(msg)
+		if err == nil {
+			err = spawns.claim(msg.ProcessID, opts.WorktreePath)
+		}
+		if err == nil {
+			err = startSession(mgr, msg.WorktreeID, opts)
+		}
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, session.ErrWorktreeInUse) {
+				status = http.StatusConflict
+			}
+			writeError(w, status, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"processId": msg.ProcessID})
+	})
+
+	mux.HandleFunc("DELETE /api/sessions/{processId}", func(w http.ResponseWriter, r *http.Request) {
+		processID := r.PathValue("processId")
+		msg := protocol.ServerMessage{Type: protocol.MsgTypeKill, ProcessID: processID}
+		if apiOutOfScope(w, r, msg) || apiDeniedByPlugin(w, r, msg) {
+			return
+		}
+		log.Printf("API kill request: processId=%s", processID)
+		if dryRun || apiDryRun(r) {
+			plan, err := planKill(mgr, processID)
+			writePlan(w, plan, err)
+			return
+		}
+		if err := mgr.Kill(processID); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /api/repos", func(w http.ResponseWriter, r *http.Request) {
+		if apiOutOfScope(w, r, protocol.ServerMessage{Type: protocol.MsgTypeListRepos}) {
+			return
+		}
+		repos := scanWorkspace()
+		if repos == nil {
+			repos = []protocol.RepoInfo{}
+		}
+		writeJSON(w, http.StatusOK, repos)
+	})
+
+	// Body is a create-worktree message, plus an optional base
+	mux.HandleFunc("POST /api/worktrees", func(w http.ResponseWriter, r *http.Request) {
+		var msg protocol.ServerMessage
+		if !readJSON(w, r, &msg) {
+			return
+		}
+		if msg.RepoPath == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("repoPath is required"))
+			return
+		}
+		if msg.WorktreeID == "" {
+			msg.WorktreeID = fmt.Sprintf("api-%d", time.Now().UnixNano())
+		}
+		msg.Type = protocol.MsgTypeCreateWorktree
+		if apiOutOfScope(w, r, msg) || apiDraining(w, r, msg) || apiDeniedByPlugin(w, r, msg) {
+			return
+		}
+
+		log.Printf("API create worktree request: worktreeId=%s repoPath=%s", msg.WorktreeID, msg.RepoPath)
+		wt, err := addWorktree(r.Context(), msg.RepoPath, msg.WorktreeID, msg.Base, msg.Package)
+		if errors.Is(err, worktree.ErrInsufficientDisk) {
+			writeError(w, http.StatusInsufficientStorage, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, apiWorktree{
+			WorktreeID:  msg.WorktreeID,
+			Path:        wt.path,
+			Branch:      wt.branch,
+			Package:     wt.pkg,
+			SetupError:  wt.setupError,
+			Environment: wt.environment,
+		})
+	})
+
+	// The worktree is identified by its path, as in remove-worktree
+	mux.HandleFunc("DELETE /api/worktrees", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("path is required"))
+			return
+		}
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+		msg := protocol.ServerMessage{Type: protocol.MsgTypeRemoveWorktree, WorktreePath: path, Force: force}
+		if apiOutOfScope(w, r, msg) || apiDraining(w, r, msg) || apiDeniedByPlugin(w, r, msg) {
+			return
+		}
+
+		log.Printf("API remove worktree request: path=%s force=%v", path, force)
+		if dryRun || apiDryRun(r) {
+			plan, err := planRemoveWorktree(mgr, path, force)
+			writePlan(w, plan, err)
+			return
+		}
+		if _, err := removeWorktree(r.Context(), mgr, path, force); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, session.ErrWorktreeInUse) {
+				status = http.StatusConflict
+			}
+			writeError(w, status, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Reloading changes what every client may do, so it takes the
+	// daemon's token or a scoped one allowing everything
+	mux.HandleFunc("POST /api/reload", func(w http.ResponseWriter, r *http.Request) {
+		if apiNotAll(w, r, "reload") {
+			return
+		}
+		result, err := reload()
+		if err != nil {
+			log.Printf("Config reload failed: %v", err)
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	// Draining ends with the daemon stopping, so it too takes the daemon's
+	// token or one allowing everything
+	mux.HandleFunc("POST /api/drain", func(w http.ResponseWriter, r *http.Request) {
+		if apiNotAll(w, r, "drain") {
+			return
+		}
+		log.Printf("API drain request")
+		drain()
+		writeJSON(w, http.StatusAccepted, drainStatus(mgr))
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settingsMu.RLock()
+		tokens := scopedTokens
+		settingsMu.RUnlock()
+		_, scopes, ok := localserver.Scopes(r, token, tokens)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiScopesKey{}, scopes)))
+	})
+}
+
+// apiScopesKey is the request context key of the scopes a request's token
+// allows.
+type apiScopesKey struct{}
+
+// apiOutOfScope responds with 403 if the request's token doesn't allow
+// msg, the equivalent WebSocket message. It reports whether it did.
+func apiOutOfScope(w http.ResponseWriter, r *http.Request, msg protocol.ServerMessage) bool {
+	scopes, _ := r.Context().Value(apiScopesKey{}).(scope.Scopes)
+	err := scopes.Check(msg, spawnAgent(msg))
+	if err == nil {
+		return false
+	}
+	log.Printf("Refusing API %s %s: %v", r.Method, r.URL.Path, err)
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error(), "errorCode": protocol.ErrorCodeOutOfScope})
+	return true
+}
+
+// apiNotAll responds with 403 if the request's token doesn't allow
+// everything, as what it does needs. It reports whether it did.
+func apiNotAll(w http.ResponseWriter, r *http.Request, what string) bool {
+	scopes, _ := r.Context().Value(apiScopesKey{}).(scope.Scopes)
+	if scopes.Has(scope.All) {
+		return false
+	}
+	log.Printf("Refusing API %s %s: out of scope", r.Method, r.URL.Path)
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": what + " is out of scope (" + scope.All + ")", "errorCode": protocol.ErrorCodeOutOfScope})
+	return true
+}
+
+// apiDraining responds with 503 if the daemon is draining and refuses msg,
+// the equivalent WebSocket message. It reports whether it did.
+func apiDraining(w http.ResponseWriter, r *http.Request, msg protocol.ServerMessage) bool {
+	err := drainingError(msg.Type)
+	if err == nil {
+		return false
+	}
+	log.Printf("Refusing API %s %s: %v", r.Method, r.URL.Path, err)
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error(), "errorCode": protocol.ErrorCodeDraining})
+	return true
+}
+
+// apiDeniedByPlugin responds with 403 if a plugin doesn't allow msg, the
+// equivalent WebSocket message. It reports whether it did.
+func apiDeniedByPlugin(w http.ResponseWriter, r *http.Request, msg protocol.ServerMessage) bool {
+	err := plugins.Check(r.Context(), msg)
+	if err == nil {
+		return false
+	}
+	log.Printf("Refusing API %s %s: %v", r.Method, r.URL.Path, err)
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error(), "errorCode": protocol.ErrorCodePolicyDenied})
+	return true
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writePlan responds with what a dry-run request would do, or the error it
+// would fail with.
+func writePlan(w http.ResponseWriter, plan *protocol.DryRunPlan, err error) {
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// apiDryRun reports whether a request without a body asks for a dry run
+// (?dryRun=true).
+func apiDryRun(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return v
+}
+
+// writeError responds with {"error": ..., "errorCode"?: ...}.
+func writeError(w http.ResponseWriter, status int, err error) {
+	body := map[string]string{"error": err.Error()}
+	if code := errorCode(err); code != "" {
+		body["errorCode"] = code
+	}
+	writeJSON(w, status, body)
+}
@@ -0,0 +1,130 @@
+package agenthqd
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/telemetry"
+	"github.com/agenthq/daemon/internal/traffic"
+)
+
+// Protocol bytes exchanged with servers, so users on metered links can see
+// which agent produces the traffic.
+var (
+	sessionBytes    = telemetry.NewCounter("agenthq.daemon.session.bytes", "By", "Protocol bytes exchanged with servers for sessions, by agent and direction")
+	connectionBytes = telemetry.NewCounter("agenthq.daemon.connection.bytes", "By", "Protocol bytes exchanged with servers, by server and direction")
+)
+
+// byteCounts are bytes received from and sent to servers.
+type byteCounts struct {
+	in, out atomic.Int64
+}
+
+func (b *byteCounts) add(dir string, n int) {
+	if dir == traffic.In {
+		b.in.Add(int64(n))
+	} else {
+		b.out.Add(int64(n))
+	}
+}
+
+// sessionTraffic counts each running session's bytes; agent labels its
+// metrics.
+type sessionTraffic struct {
+	byteCounts
+	agent string
+}
+
+var (
+	sessionTrafficMu sync.Mutex
+	sessionTrafficOf = make(map[string]*sessionTraffic)
+)
+
+// countTraffic counts a message exchanged with the connection's server,
+// for the connection and the session it is about.
+func (c *connection) countTraffic(mgr *session.Manager, dir, processID string, n int) {
+	c.bytes.add(dir, n)
+	connectionBytes.Add(int64(n), telemetry.String("server", c.label()), telemetry.String("direction", dir))
+	if processID == "" {
+		return
+	}
+
+	sessionTrafficMu.Lock()
+	t, ok := sessionTrafficOf[processID]
+	if !ok {
+		// Only running sessions are counted, so exited ones aren't revived
+		info, running := mgr.Info(processID)
+		if !running {
+			sessionTrafficMu.Unlock()
+			return
+		}
+		t = &sessionTraffic{agent: string(info.Agent)}
+		sessionTrafficOf[processID] = t
+	}
+	sessionTrafficMu.Unlock()
+	t.add(dir, n)
+	sessionBytes.Add(int64(n), telemetry.String("agent", t.agent), telemetry.String("direction", dir))
+}
+
+// forgetTraffic drops an exited session's counts.
+func forgetTraffic(processID string) {
+	sessionTrafficMu.Lock()
+	defer sessionTrafficMu.Unlock()
+	delete(sessionTrafficOf, processID)
+}
+
+// sendSessionStats sends the traffic of one session, or of every session
+// peer owns, and of peer's server connection.
+func sendSessionStats(wsClient, peer link, mgr *session.Manager, processID string) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeSessionStats,
+		ProcessID: processID,
+	}
+
+	var infos []session.Info
+	if processID != "" {
+		info, ok := mgr.Info(processID)
+		if !ok || !wsClient.Owns(processID) {
+			reply.Error = "process not found"
+			wsClient.Send(reply)
+			return
+		}
+		infos = []session.Info{info}
+	} else {
+		for _, info := range mgr.List() {
+			if wsClient.Owns(info.ID) {
+				infos = append(infos, info)
+			}
+		}
+	}
+
+	sessionTrafficMu.Lock()
+	for _, info := range infos {
+		stats := protocol.SessionStats{
+			ProcessID:   info.ID,
+			Agent:       info.Agent,
+			InputBytes:  info.InputBytes,
+			OutputBytes: info.OutputBytes,
+			StartedAt:   info.Started.UnixMilli(),
+		}
+		if t, ok := sessionTrafficOf[info.ID]; ok {
+			stats.BytesIn, stats.BytesOut = t.in.Load(), t.out.Load()
+		}
+		reply.Stats = append(reply.Stats, stats)
+	}
+	sessionTrafficMu.Unlock()
+
+	for _, conn := range connections {
+		if link(conn.current()) == peer {
+			reply.Connection = &protocol.ConnectionStats{
+				BytesIn:  conn.bytes.in.Load(),
+				BytesOut: conn.bytes.out.Load(),
+				Since:    conn.since.UnixMilli(),
+				Latency:  conn.current().Latency(),
+			}
+		}
+	}
+	wsClient.Send(reply)
+}
@@ -0,0 +1,91 @@
+package agenthqd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agenthq/daemon/internal/budget"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// budgetCheckInterval is how often sessions are checked against their
+// budgets, and so how far past one they can go.
+const budgetCheckInterval = 10 * time.Second
+
+// enforceBudgets checks sessions against their budgets every
+// budgetCheckInterval until stop is closed.
+func enforceBudgets(mgr *session.Manager, stop <-chan struct{}) {
+	ticker := time.NewTicker(budgetCheckInterval)
+	defer ticker.Stop()
+
+	measureFailed := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		events, err := mgr.CheckBudgets()
+		// Logged once until measuring works again, not every check
+		if err != nil && !measureFailed {
+			log.Printf("Failed to measure sessions' CPU time; only wall-clock budgets are enforced: %v", err)
+		}
+		measureFailed = err != nil
+		for _, e := range events {
+			reportBudgetExceeded(e)
+		}
+	}
+}
+
+// reportBudgetExceeded logs, records and tells the session's server that a
+// session went over its budget.
+func reportBudgetExceeded(e session.BudgetEvent) {
+	over := e.Exceeded
+	reason := fmt.Sprintf("%s: %ds of %ds", over.Limit, over.Used, over.Allowed)
+	log.Printf("Alert: process %s went over its %s budget (%ds of %ds); %s", e.ProcessID, over.Limit, over.Used, over.Allowed, budgetActed(over.Action))
+	if e.Err != nil {
+		log.Printf("Failed to %s process %s: %v", over.Action, e.ProcessID, e.Err)
+	}
+
+	event := protocol.HistoryEvent{
+		Kind:      protocol.HistoryBudgetExceeded,
+		ProcessID: e.ProcessID,
+		Reason:    reason,
+	}
+	if e.Err != nil {
+		event.Error = e.Err.Error()
+	}
+	recordEvent(event)
+
+	sendToOwner(protocol.DaemonMessage{
+		Type:      protocol.MsgTypeBudgetExceeded,
+		ProcessID: e.ProcessID,
+		Budget:    &over,
+		Error:     event.Error,
+	})
+}
+
+// resumeSession continues a session paused over its budget, with the new
+// budget resume-session may carry.
+func resumeSession(mgr *session.Manager, msg protocol.ServerMessage) error {
+	if msg.Budget != nil {
+		if err := budget.Validate(*msg.Budget); err != nil {
+			return fmt.Errorf("budget: %w", err)
+		}
+	}
+	return mgr.Resume(msg.ProcessID, msg.Budget)
+}
+
+// budgetActed says what a budget action does to a session.
+func budgetActed(action string) string {
+	switch action {
+	case protocol.BudgetPause:
+		return "pausing it"
+	case protocol.BudgetKill:
+		return "killing it"
+	}
+	return "letting it run"
+}
@@ -0,0 +1,210 @@
+package agenthqd
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/agenthq/daemon/internal/artifacts"
+	"github.com/agenthq/daemon/internal/checks"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/repoconfig"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// runTests runs the repo's configured test command in a worktree (or one of
+// its packages) and reports the parsed results.
+func runTests(wsClient link, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:    protocol.MsgTypeTestResults,
+		RunID:   msg.RunID,
+		Path:    msg.WorktreePath,
+		Package: msg.Package,
+	}
+
+	repoCfg, p, err := loadWorktreeConfig(msg.WorktreePath, msg.Package)
+	if err == nil && repoCfg.Test == "" {
+		err = fmt.Errorf("no test command configured in %s", repoconfig.FileName)
+	}
+	if err == nil {
+		reply.Package = p.Name
+		reply.Tests, err = checks.RunTests(filepath.Join(msg.WorktreePath, p.Dir), repoCfg.Test, repoCfg.TestReport, repoCfg.Coverage, checks.DefaultTimeout)
+	}
+
+	if err != nil {
+		log.Printf("Run tests %s: %v", msg.RunID, err)
+		reply.Error = err.Error()
+	} else {
+		log.Printf("Run tests %s: %d passed, %d failed, %d skipped (exit code %d)",
+			msg.RunID, reply.Tests.Passed, reply.Tests.Failed, reply.Tests.Skipped, reply.Tests.ExitCode)
+		if cov := reply.Tests.Coverage; cov != nil {
+			log.Printf("Run tests %s: %.1f%% coverage (%s)", msg.RunID, cov.Percent, cov.File)
+		}
+	}
+	wsClient.Send(reply)
+}
+
+// runLinter runs the repo's configured lint command in a worktree (or one
+// of its packages) and reports the parsed diagnostics.
+func runLinter(wsClient link, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:    protocol.MsgTypeLintResults,
+		RunID:   msg.RunID,
+		Path:    msg.WorktreePath,
+		Package: msg.Package,
+	}
+
+	repoCfg, p, err := loadWorktreeConfig(msg.WorktreePath, msg.Package)
+	if err == nil && repoCfg.Lint == "" {
+		err = fmt.Errorf("no lint command configured in %s", repoconfig.FileName)
+	}
+	if err == nil {
+		reply.Package = p.Name
+		reply.Lint, err = checks.RunLint(filepath.Join(msg.WorktreePath, p.Dir), repoCfg.Lint, checks.DefaultTimeout)
+	}
+
+	if err != nil {
+		log.Printf("Run linter %s: %v", msg.RunID, err)
+		reply.Error = err.Error()
+	} else {
+		// Diagnostics are relative to the package; the server wants them
+		// relative to the worktree.
+		for i := range reply.Lint.Diagnostics {
+			d := &reply.Lint.Diagnostics[i]
+			if !filepath.IsAbs(d.File) {
+				d.File = path.Join(filepath.ToSlash(p.Dir), d.File)
+			}
+		}
+		log.Printf("Run linter %s: %d errors, %d warnings (exit code %d)",
+			msg.RunID, reply.Lint.Errors, reply.Lint.Warnings, reply.Lint.ExitCode)
+	}
+	wsClient.Send(reply)
+}
+
+// afterSessionExit runs the worktree's verification pipeline when an agent
+// session exits successfully (plain shells are not verified), then
+// collects the session's artifacts.
+func afterSessionExit(mgr *session.Manager, processID string, exit session.ExitInfo) {
+	info, ok := mgr.Info(processID)
+	if !ok {
+		return
+	}
+	verify := exit.Reason == session.ExitCompleted &&
+		info.Agent != protocol.AgentBash && info.Agent != protocol.AgentShell
+
+	go func() {
+		repoCfg, p, err := loadWorktreeConfig(info.WorktreePath, info.Package)
+		if err != nil {
+			log.Printf("After exit of %s: %v", info.ID, err)
+			return
+		}
+		dir := filepath.Join(info.WorktreePath, p.Dir)
+		if verify && len(repoCfg.Verify) > 0 {
+			runVerification(info, repoCfg, dir)
+		}
+		if len(repoCfg.Artifacts) > 0 {
+			collectArtifacts(info, repoCfg.Artifacts, dir)
+		}
+	}()
+}
+
+// runVerification runs the verify steps from the worktree's .agenthq.yml in
+// order in dir, reporting each in a verification-result. Steps after a
+// failure are reported as skipped.
+func runVerification(info session.Info, repoCfg *repoconfig.Config, dir string) {
+	log.Printf("Verifying %s in %s (%d steps)", info.ID, dir, len(repoCfg.Verify))
+
+	failed := false
+	for i, step := range repoCfg.Verify {
+		result := &protocol.VerificationStep{
+			Name:  step.Name,
+			Index: i,
+			Total: len(repoCfg.Verify),
+		}
+		if failed {
+			result.Status = protocol.StepSkipped
+		} else {
+			runStep(repoCfg, step, dir, result)
+			failed = result.Status != protocol.StepPassed
+			log.Printf("Verification of %s: %s %s", info.ID, step.Name, result.Status)
+		}
+
+		sendToOwner(protocol.DaemonMessage{
+			Type:      protocol.MsgTypeVerification,
+			ProcessID: info.ID,
+			Path:      info.WorktreePath,
+			Package:   info.Package,
+			Step:      result,
+		})
+	}
+}
+
+// runStep runs one verification step in dir and records its outcome.
+func runStep(repoCfg *repoconfig.Config, step repoconfig.Step, dir string, result *protocol.VerificationStep) {
+	result.Status = protocol.StepFailed
+
+	if step.Tests {
+		tests, err := checks.RunTests(dir, repoCfg.Test, repoCfg.TestReport, repoCfg.Coverage, checks.DefaultTimeout)
+		if tests != nil {
+			result.Tests = tests
+			result.ExitCode = tests.ExitCode
+			result.DurationMs = tests.DurationMs
+			result.Output = tests.Output
+			// The full output is in the test results
+			tests.Output = ""
+		}
+		if err != nil {
+			result.Error = err.Error()
+		} else if tests.ExitCode == 0 && tests.Failed == 0 {
+			result.Status = protocol.StepPassed
+		}
+		return
+	}
+
+	res, err := checks.RunCommand(dir, step.Run, checks.DefaultTimeout)
+	result.ExitCode = res.ExitCode
+	result.DurationMs = res.Duration.Milliseconds()
+	result.Output = res.Output
+	if err != nil {
+		result.Error = err.Error()
+	} else if res.ExitCode == 0 {
+		result.Status = protocol.StepPassed
+	}
+}
+
+// collectArtifacts sends the files in dir matching the repo's artifact globs
+// to the server that spawned the session, then reports what was sent.
+func collectArtifacts(info session.Info, patterns []string, dir string) {
+	owner := ownerOf(info.ID)
+	if owner == nil {
+		return
+	}
+
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeArtifacts,
+		ProcessID: info.ID,
+		Path:      info.WorktreePath,
+		Package:   info.Package,
+	}
+
+	files, err := artifacts.Collect(dir, patterns)
+	if err != nil && !errors.Is(err, artifacts.ErrLimit) {
+		files = nil
+	}
+	chunk := reply
+	chunk.Type = protocol.MsgTypeArtifactChunk
+	idPrefix := fmt.Sprintf("%s-%d", info.ID, time.Now().UnixMilli())
+	sent, sendErr := artifacts.Send(owner.Send, chunk, idPrefix, dir, files)
+	reply.Artifacts = sent
+	if err = cmp.Or(err, sendErr); err != nil {
+		log.Printf("Artifacts of %s: %v", info.ID, err)
+		reply.Error = err.Error()
+	}
+
+	log.Printf("Artifacts of %s: sent %d of %d files", info.ID, len(sent), len(files))
+	owner.Send(reply)
+}
@@ -0,0 +1,127 @@
+package agenthqd
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/clipboard"
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// clipboardAccess is what servers may do with the host's clipboard: config
+// clipboard, if the host has a clipboard the daemon can use.
+var clipboardAccess config.Clipboard
+
+// setupClipboard enables the clipboard bridge as configured.
+func setupClipboard(cfg config.Clipboard) {
+	if !cfg.Get && !cfg.Set {
+		return
+	}
+	if err := clipboard.Available(); err != nil {
+		log.Printf("Clipboard bridge disabled: %v", err)
+		return
+	}
+	clipboardAccess = cfg
+	log.Printf("Clipboard bridge enabled: %s", strings.Join(clipboardOps(), ", "))
+}
+
+// clipboardOps returns the clipboard operations servers may ask for.
+func clipboardOps() []string {
+	var ops []string
+	if clipboardAccess.Get {
+		ops = append(ops, "get")
+	}
+	if clipboardAccess.Set {
+		ops = append(ops, "set")
+	}
+	return ops
+}
+
+// setClipboard puts text from the server on the host's clipboard.
+func setClipboard(wsClient link, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeClipboard,
+		ProcessID: msg.ProcessID,
+	}
+
+	var size int
+	err := func() error {
+		if !clipboardAccess.Set {
+			return errors.New("setting the clipboard is disabled (config clipboard.set)")
+		}
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			return fmt.Errorf("invalid base64: %w", err)
+		}
+		size = len(data)
+		return clipboard.Write(data)
+	}()
+
+	auditClipboard(protocol.HistoryClipboardSet, msg, size, err)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	wsClient.Send(reply)
+}
+
+// getClipboard sends the text on the host's clipboard to the server.
+func getClipboard(wsClient link, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeClipboard,
+		ProcessID: msg.ProcessID,
+	}
+
+	var size int
+	err := func() error {
+		if !clipboardAccess.Get {
+			return errors.New("reading the clipboard is disabled (config clipboard.get)")
+		}
+		data, err := clipboard.Read()
+		if err != nil {
+			return err
+		}
+		size = len(data)
+		reply.Data = base64.StdEncoding.EncodeToString(data)
+		return nil
+	}()
+
+	auditClipboard(protocol.HistoryClipboardGet, msg, size, err)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	wsClient.Send(reply)
+}
+
+// auditClipboard logs and records who used the host's clipboard, and how
+// much went through it, whether or not that worked.
+func auditClipboard(kind string, msg protocol.ServerMessage, size int, err error) {
+	what := fmt.Sprintf("Clipboard %s by %s", strings.TrimPrefix(kind, "clipboard-"), cmp.Or(msg.SourceUser, "unknown user"))
+	if msg.ProcessID != "" {
+		what += " for " + msg.ProcessID
+	}
+	if err != nil {
+		log.Printf("%s failed: %v", what, err)
+	} else {
+		log.Printf("%s: %d bytes", what, size)
+	}
+
+	e := protocol.HistoryEvent{
+		Kind:       kind,
+		ProcessID:  msg.ProcessID,
+		SourceUser: msg.SourceUser,
+	}
+	if kind == protocol.HistoryClipboardSet {
+		e.InputBytes = int64(size)
+	} else {
+		e.OutputBytes = int64(size)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	recordEvent(e)
+}
@@ -0,0 +1,89 @@
+package agenthqd
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCoalesced is how much output is held at most before it goes out,
+// however little of the coalescing interval has passed.
+const maxCoalesced = 64 * 1024
+
+// outputCoalescer holds each session's output for a while so that it goes
+// out in fewer, larger pty-data messages, which suits high-latency links.
+type outputCoalescer struct {
+	interval time.Duration
+	emit     func(processID string, data []byte)
+
+	mu      sync.Mutex
+	streams map[string]*coalescedStream
+}
+
+type coalescedStream struct {
+	mu      sync.Mutex
+	pending []byte
+	timer   *time.Timer
+}
+
+// newOutputCoalescer returns a coalescer that holds output for interval
+// before passing it to emit, or nil if interval is 0.
+func newOutputCoalescer(interval time.Duration, emit func(processID string, data []byte)) *outputCoalescer {
+	if interval <= 0 {
+		return nil
+	}
+	return &outputCoalescer{interval: interval, emit: emit, streams: make(map[string]*coalescedStream)}
+}
+
+// write adds a chunk of a session's output to what is held, sending it all
+// once the interval since the first held chunk is over or maxCoalesced is
+// held.
+func (c *outputCoalescer) write(processID string, data []byte) {
+	c.mu.Lock()
+	s, ok := c.streams[processID]
+	if !ok {
+		s = &coalescedStream{}
+		c.streams[processID] = s
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, data...)
+	if len(s.pending) >= maxCoalesced {
+		c.flushLocked(processID, s)
+		return
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(c.interval, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			c.flushLocked(processID, s)
+		})
+	}
+}
+
+// flushLocked sends a stream's held output; s.mu is held.
+func (c *outputCoalescer) flushLocked(processID string, s *coalescedStream) {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.pending) > 0 {
+		c.emit(processID, s.pending)
+		s.pending = nil
+	}
+}
+
+// close sends a session's held output and forgets the session.
+func (c *outputCoalescer) close(processID string) {
+	c.mu.Lock()
+	s, ok := c.streams[processID]
+	delete(c.streams, processID)
+	c.mu.Unlock()
+
+	if ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		c.flushLocked(processID, s)
+	}
+}
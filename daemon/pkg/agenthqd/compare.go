@@ -0,0 +1,265 @@
+package agenthqd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/placeholder"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/repoconfig"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// Default terminal size for compare-run sessions when the server omits one.
+const (
+	compareDefaultCols = 120
+	compareDefaultRows = 30
+)
+
+// compareRun tracks a compare-run until every contender has exited.
+type compareRun struct {
+	client  link
+	id      string
+	base    string
+	results []protocol.CompareResult
+	started []time.Time
+	// pending counts the contenders running, and the run itself while it
+	// starts them
+	pending int
+}
+
+var (
+	// compareMu guards compareRuns and the runs in it, not the git work
+	// of starting and ending contenders
+	compareMu sync.Mutex
+	// compareRuns maps each contender's processID to its run
+	compareRuns = make(map[string]*compareRun)
+)
+
+// startCompareRun creates one worktree per contender from the same base
+// commit and runs each agent headless on the same task. A compare-report is
+// sent once all of them have exited.
+func startCompareRun(ctx context.Context, wsClient link, mgr *session.Manager, msg protocol.ServerMessage) {
+	if msg.RunID == "" || msg.RepoPath == "" || msg.Task == "" || len(msg.Agents) == 0 {
+		log.Printf("Invalid compare-run request: runId, repoPath, task and agents are required")
+		return
+	}
+
+	baseRef := msg.Base
+	if baseRef == "" {
+		baseRef = "HEAD"
+	}
+	base, err := worktree.ResolveCommit(msg.RepoPath, baseRef)
+	if err != nil {
+		log.Printf("Compare run %s: %v", msg.RunID, err)
+		wsClient.Send(protocol.DaemonMessage{
+			Type:  protocol.MsgTypeCompareReport,
+			RunID: msg.RunID,
+			Error: err.Error(),
+		})
+		return
+	}
+
+	cols, rows := msg.Cols, msg.Rows
+	if cols <= 0 || rows <= 0 {
+		cols, rows = compareDefaultCols, compareDefaultRows
+	}
+
+	run := &compareRun{
+		client:  wsClient,
+		id:      msg.RunID,
+		base:    base,
+		results: make([]protocol.CompareResult, len(msg.Agents)),
+		started: make([]time.Time, len(msg.Agents)),
+		pending: 1,
+	}
+
+	// The run is only shared once its contenders are registered, so their
+	// worktrees are set up without the lock.
+	contenders := make([]*session.SpawnOptions, len(msg.Agents))
+	for i, contender := range msg.Agents {
+		worktreeID := fmt.Sprintf("%s-%d", msg.RunID, i+1)
+		result := &run.results[i]
+		*result = protocol.CompareResult{
+			Agent:      contender.Agent,
+			Profile:    contender.Profile,
+			Model:      contender.Model,
+			WorktreeID: worktreeID,
+		}
+
+		wt, err := addWorktree(ctx, msg.RepoPath, worktreeID, base, "")
+		if err != nil {
+			log.Printf("Compare run %s: failed to create worktree %s: %v", msg.RunID, worktreeID, err)
+			result.Error = err.Error()
+			continue
+		}
+		path := wt.path
+		result.Path = path
+		result.Branch = wt.branch
+		wsClient.Send(protocol.DaemonMessage{
+			Type:        protocol.MsgTypeWorktreeReady,
+			WorktreeID:  worktreeID,
+			Path:        path,
+			Branch:      wt.branch,
+			Environment: wt.environment,
+			Error:       wt.setupError,
+		})
+
+		processID := wsClient.LocalID(worktreeID)
+		opts := session.SpawnOptions{
+			ProcessID:    processID,
+			Agent:        contender.Agent,
+			Profile:      contender.Profile,
+			Model:        contender.Model,
+			WorktreePath: path,
+			Task:         msg.Task,
+			Cols:         cols,
+			Rows:         rows,
+			YoloMode:     msg.YoloMode,
+			Headless:     true,
+			Group:        msg.RunID,
+			Placeholders: &placeholder.Vars{
+				WorktreePath: path,
+				Branch:       wt.branch,
+				RepoName:     filepath.Base(msg.RepoPath),
+				RepoPath:     msg.RepoPath,
+				Dir:          path,
+				ProcessID:    worktreeID,
+				WorktreeID:   worktreeID,
+				Workspace:    workspace,
+			},
+		}
+		if repoCfg, err := repoconfig.Load(path); err == nil {
+			if err := loadDotenv(&opts, repoCfg); err != nil {
+				log.Printf("Compare run %s: failed to load env files for %s: %v", msg.RunID, processID, err)
+				result.Error = err.Error()
+				continue
+			}
+		}
+		if err := spawns.claim(processID, path); err != nil {
+			log.Printf("Compare run %s: %v", msg.RunID, err)
+			result.Error = err.Error()
+			continue
+		}
+		opts.Progress = spawnProgress(mgr, processID)
+		contenders[i] = &opts
+	}
+
+	// Registered before any is spawned, so a contender that exits at once
+	// is counted; the run's own count keeps it from finishing before the
+	// rest are spawned.
+	compareMu.Lock()
+	for i, opts := range contenders {
+		if opts != nil {
+			run.results[i].ProcessID = opts.ProcessID
+			compareRuns[opts.ProcessID] = run
+			run.pending++
+		}
+	}
+	compareMu.Unlock()
+
+	spawned := 0
+	for i, opts := range contenders {
+		if opts == nil {
+			continue
+		}
+		run.started[i] = time.Now()
+		opts.Requested = run.started[i]
+		if err := startSession(mgr, run.results[i].WorktreeID, *opts); err != nil {
+			log.Printf("Compare run %s: failed to spawn %s: %v", msg.RunID, opts.ProcessID, err)
+			compareMu.Lock()
+			delete(compareRuns, opts.ProcessID)
+			run.results[i].ProcessID = ""
+			run.results[i].Error = err.Error()
+			run.pending--
+			compareMu.Unlock()
+			continue
+		}
+		spawned++
+		started := protocol.DaemonMessage{
+			Type:      protocol.MsgTypeProcessStarted,
+			ProcessID: opts.ProcessID,
+		}
+		if info, ok := mgr.Info(opts.ProcessID); ok {
+			started.SpawnMs = info.SpawnTime.Milliseconds()
+		}
+		wsClient.Send(started)
+	}
+
+	log.Printf("Compare run %s started %d of %d agents from %s", msg.RunID, spawned, len(msg.Agents), base)
+	run.done(nil)
+}
+
+// compareProcessExited records a contender's exit and sends the report when
+// it was the last one running.
+func compareProcessExited(processID string, exit session.ExitInfo) {
+	compareMu.Lock()
+	run, ok := compareRuns[processID]
+	delete(compareRuns, processID)
+	i := -1
+	var path string
+	if ok {
+		i = slices.IndexFunc(run.results, func(r protocol.CompareResult) bool { return r.ProcessID == processID })
+		path = run.results[i].Path
+	}
+	compareMu.Unlock()
+	if !ok {
+		return
+	}
+
+	duration := time.Since(run.started[i])
+	stat, err := worktree.Diff(path, run.base)
+	if err != nil {
+		log.Printf("Compare run %s: diff failed for %s: %v", run.id, processID, err)
+	}
+
+	compareMu.Lock()
+	result := &run.results[i]
+	result.ExitCode = exit.Code
+	result.ExitReason = exit.Reason
+	result.DurationMs = duration.Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.FilesChanged = stat.FilesChanged
+		result.Insertions = stat.Insertions
+		result.Deletions = stat.Deletions
+		result.Untracked = stat.Untracked
+	}
+	compareMu.Unlock()
+
+	// The run's client may have been replaced by a reconnect since
+	run.done(ownerOf(processID))
+}
+
+// done counts one of the run's contenders, or the run itself, as done,
+// sending the report to the run's client, or to cl if not nil, when it was
+// the last.
+func (run *compareRun) done(cl link) {
+	compareMu.Lock()
+	run.pending--
+	last := run.pending == 0
+	if last && cl != nil {
+		run.client = cl
+	}
+	compareMu.Unlock()
+	if last {
+		sendCompareReport(run.client, run)
+	}
+}
+
+func sendCompareReport(wsClient link, run *compareRun) {
+	log.Printf("Compare run %s complete", run.id)
+	wsClient.Send(protocol.DaemonMessage{
+		Type:    protocol.MsgTypeCompareReport,
+		RunID:   run.id,
+		Base:    run.base,
+		Results: run.results,
+	})
+}
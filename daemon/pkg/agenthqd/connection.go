@@ -0,0 +1,349 @@
+package agenthqd
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/netwatch"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/signing"
+)
+
+// link is a peer that sends server messages to the daemon and receives
+// its replies: a server connection or the local hub.
+type link interface {
+	Send(protocol.DaemonMessage) error
+	// LocalID maps a processID or group used by the peer to the daemon's.
+	LocalID(id string) string
+	// Owns reports whether a daemon-side processID belongs to the peer.
+	Owns(id string) bool
+}
+
+// connection keeps one server connection alive, replacing its client after
+// every disconnect.
+type connection struct {
+	server    config.Server
+	namespace string
+	// generatedEnvID is set when the env ID isn't configured; a new one is
+	// generated for each reconnect.
+	generatedEnvID bool
+	hostname       string
+	// discover finds the server URL on the local network, again after
+	// repeated connection failures, as the server's address may change.
+	discover bool
+	// bytes counts the traffic with the server since since, over every
+	// reconnect
+	bytes byteCounts
+	since time.Time
+	// verifier checks message signatures; shared across reconnects so
+	// replayed nonces are caught on a new connection too. Nil if unsigned.
+	verifier *signing.Verifier
+
+	mu        sync.Mutex
+	client    *client.Client
+	reconnect chan struct{}
+	// redialing is set by redial so the reconnect skips its pause, and
+	// retry cuts short the wait after a failed attempt.
+	redialing bool
+	retry     chan struct{}
+
+	// urlIndex selects the server URL in use (0 is the primary) and
+	// failures counts consecutive failed attempts against it.
+	urlIndex int
+	failures int
+
+	// lastAck is when the server last acknowledged a heartbeat, or the
+	// client connected; acks is set once it has, over every reconnect.
+	// safeSince is when the connection entered safe mode, zero outside it.
+	lastAck   time.Time
+	acks      bool
+	safeSince time.Time
+}
+
+// Failover tuning
+const (
+	// failoverAfter is how many consecutive connection failures move on to
+	// the next URL.
+	failoverAfter = 3
+	// failbackProbeInterval is how often the primary is probed while
+	// connected to a failover URL.
+	failbackProbeInterval = 60 * time.Second
+)
+
+// All server connections; session output is routed to the one that owns
+// the process.
+var connections []*connection
+
+func newConnection(server config.Server, namespace, hostname string) *connection {
+	conn := &connection{
+		server:    server,
+		namespace: namespace,
+		hostname:  hostname,
+		since:     time.Now(),
+		reconnect: make(chan struct{}, 1),
+		retry:     make(chan struct{}, 1),
+	}
+	if conn.server.EnvName == "" {
+		conn.server.EnvName = hostname
+	}
+	if conn.server.EnvID == "" {
+		conn.generatedEnvID = true
+		conn.server.EnvID = conn.newEnvID()
+	}
+	if conn.server.SigningSecret != "" {
+		conn.verifier = signing.NewVerifier(conn.server.SigningSecret)
+	}
+	return conn
+}
+
+func (c *connection) newEnvID() string {
+	return fmt.Sprintf("daemon-%s-%d", c.hostname, time.Now().Unix())
+}
+
+// url returns the server URL currently in use.
+func (c *connection) url() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.server.URLs()[c.urlIndex]
+}
+
+// recordFailure counts a failed connection attempt and moves on to the next
+// URL after too many in a row.
+func (c *connection) recordFailure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	urls := c.server.URLs()
+	c.failures++
+	if len(urls) < 2 || c.failures < failoverAfter {
+		return
+	}
+	c.failures = 0
+	c.urlIndex = (c.urlIndex + 1) % len(urls)
+	log.Printf("[%s] Failing over to %s", c.label(), urls[c.urlIndex])
+}
+
+// failureCount returns the consecutive failed attempts on the current URL.
+func (c *connection) failureCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures
+}
+
+// probePrimary periodically checks whether the primary URL is reachable
+// again while a failover URL is in use, and if so drops the current
+// connection so run reconnects to the primary. It returns when done closes.
+func (c *connection) probePrimary(done <-chan struct{}) {
+	ticker := time.NewTicker(failbackProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := client.Probe(c.server.URL, c.server.Token); err != nil {
+			continue
+		}
+
+		log.Printf("[%s] Primary %s is reachable again, failing back", c.label(), c.server.URL)
+		c.mu.Lock()
+		c.urlIndex = 0
+		c.failures = 0
+		current := c.client
+		c.mu.Unlock()
+		// Closing triggers the disconnect callback and thus a reconnect
+		current.Close()
+		return
+	}
+}
+
+// label names the connection in logs.
+func (c *connection) label() string {
+	if c.server.Name != "" {
+		return c.server.Name
+	}
+	return c.server.URL
+}
+
+// current returns the connection's active client.
+func (c *connection) current() *client.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+func (c *connection) setClient(cl *client.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = cl
+}
+
+// run connects and reconnects until stop is closed. newClient builds the
+// client for each attempt.
+func (c *connection) run(stop <-chan struct{}, newClient func(*connection) *client.Client) {
+	if c.discover && !c.rediscover(stop) {
+		return
+	}
+	c.setClient(newClient(c))
+
+	for {
+		// Connect with retry
+		for {
+			if err := c.current().Connect(); err != nil {
+				log.Printf("[%s] Failed to connect to %s: %v. Retrying in 5s...", c.label(), c.current().URL(), err)
+				c.recordFailure()
+				select {
+				case <-time.After(5 * time.Second):
+				case <-c.retry:
+					c.mu.Lock()
+					c.redialing = false
+					c.mu.Unlock()
+				case <-stop:
+					return
+				}
+				if c.discover && c.failureCount() >= failoverAfter && !c.rediscover(stop) {
+					return
+				}
+				c.setClient(newClient(c))
+				continue
+			}
+			log.Printf("[%s] Connected to %s", c.label(), c.current().URL())
+			break
+		}
+
+		c.mu.Lock()
+		c.failures = 0
+		onFailover := c.urlIndex != 0
+		c.mu.Unlock()
+		c.connected()
+
+		connected := make(chan struct{})
+		if onFailover {
+			go c.probePrimary(connected)
+		}
+		go c.watchLiveness(connected)
+
+		// Wait for disconnection or shutdown
+		select {
+		case <-c.reconnect:
+			close(connected)
+			c.mu.Lock()
+			immediate := c.redialing
+			c.redialing = false
+			c.mu.Unlock()
+			select {
+			case <-c.retry:
+			default:
+			}
+			if immediate {
+				log.Printf("[%s] Disconnected. Reconnecting now...", c.label())
+			} else {
+				log.Printf("[%s] Disconnected. Reconnecting in 2s...", c.label())
+				time.Sleep(2 * time.Second)
+			}
+			// For sprites environments, keep the same ID
+			// For local, generate new one if not explicitly set
+			if c.generatedEnvID {
+				c.server.EnvID = c.newEnvID()
+			}
+			c.setClient(newClient(c))
+		case <-stop:
+			close(connected)
+			return
+		}
+	}
+}
+
+// redial drops the connection and connects again at once, or cuts short
+// the wait before the next attempt if it isn't connected: after a wake or
+// network change the connection is likely dead without knowing it yet.
+func (c *connection) redial() {
+	c.mu.Lock()
+	cl := c.client
+	c.redialing = true
+	c.mu.Unlock()
+	select {
+	case c.retry <- struct{}{}:
+	default:
+	}
+	if cl != nil {
+		// Closing triggers the disconnect callback and thus a reconnect
+		cl.Close()
+	}
+}
+
+// watchNetwork redials every connection when the machine wakes from sleep
+// or its network changes, until stop is closed.
+func watchNetwork(w *netwatch.Watcher, stop <-chan struct{}) {
+	defer w.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case change := <-w.Changes():
+			log.Printf("Reconnecting to the servers: %s", change)
+			for _, conn := range connections {
+				conn.redial()
+			}
+		}
+	}
+}
+
+// signalReconnect asks run to replace the client (non-blocking).
+func (c *connection) signalReconnect() {
+	select {
+	case c.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the active client.
+func (c *connection) Close() {
+	if cl := c.current(); cl != nil {
+		cl.Close()
+	}
+}
+
+// The local hub in standalone mode; nil when connected to servers
+var localHub link
+
+// ownerOf returns the peer that owns a daemon-side processID, or nil.
+func ownerOf(processID string) link {
+	if localHub != nil {
+		return localHub
+	}
+	for _, conn := range connections {
+		cl := conn.current()
+		if cl != nil && cl.Owns(processID) {
+			return cl
+		}
+	}
+	return nil
+}
+
+// sendToOwner sends a session message to the server that spawned the process.
+func sendToOwner(msg protocol.DaemonMessage) {
+	if cl := ownerOf(msg.ProcessID); cl != nil {
+		cl.Send(msg)
+	}
+}
+
+// broadcast sends a message that isn't tied to a session to every peer.
+func broadcast(msg protocol.DaemonMessage) {
+	if localHub != nil {
+		localHub.Send(msg)
+		return
+	}
+	for _, conn := range connections {
+		if cl := conn.current(); cl != nil {
+			cl.Send(msg)
+		}
+	}
+}
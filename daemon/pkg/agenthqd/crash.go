@@ -0,0 +1,28 @@
+package agenthqd
+
+import (
+	"fmt"
+
+	"github.com/agenthq/daemon/internal/crash"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// reportCrash tells the server about a recovered panic and ends the session
+// it affected, which can't be trusted to be in a sane state any more.
+func reportCrash(mgr *session.Manager, report crash.Report) {
+	msg := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeError,
+		ProcessID: report.ProcessID,
+		Error:     fmt.Sprintf("internal error in %s: %s", report.Where, report.Panic),
+		ErrorCode: protocol.ErrorCodeInternal,
+	}
+	if report.ProcessID == "" {
+		broadcast(msg)
+		return
+	}
+	// Sent before the session's process-exit, while it still has an owner
+	sendToOwner(msg)
+	// Not on the panicking goroutine, which may hold the manager's lock
+	go mgr.Abort(report.ProcessID, "panic in "+report.Where)
+}
@@ -0,0 +1,86 @@
+package agenthqd
+
+import (
+	"log"
+
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/config"
+)
+
+// withCredentials gives servers without a token the one stored for their
+// URL, by `agenthq-daemon pair` or a migration, and its environment ID if
+// they have none.
+func withCredentials(servers []config.Server) []config.Server {
+	path := client.DefaultCredentialsPath()
+	if path == "" {
+		return servers
+	}
+	for i, server := range servers {
+		if server.Token != "" {
+			continue
+		}
+		cred, ok, err := client.StoredCredential(path, server.URL)
+		if err != nil {
+			log.Printf("Warning: ignoring the stored credential for %s: %v", server.URL, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		servers[i].Token = cred.Token
+		if server.EnvID == "" {
+			servers[i].EnvID = cred.EnvID
+		}
+	}
+	return servers
+}
+
+// migrateCredentials moves the tokens given in AGENTHQ_AUTH_TOKEN or the
+// config file, and those pairing left in the credentials file, to the
+// keychain. Tokens already there are left alone; the daemon carries on
+// with the ones it was given if a move fails.
+func migrateCredentials(cfg *config.Config) {
+	path := client.DefaultCredentialsPath()
+	if path == "" {
+		return
+	}
+	source := "AGENTHQ_AUTH_TOKEN"
+	if len(cfg.Servers) > 0 {
+		source = "the config file"
+	}
+	for _, server := range declaredServers(cfg) {
+		if server.Token == "" {
+			continue
+		}
+		stored, ok, err := client.StoredCredential(path, server.URL)
+		if err != nil {
+			log.Printf("Warning: can't read the stored credential for %s: %v", server.URL, err)
+			continue
+		}
+		if ok && stored.Keychain && stored.Token == server.Token {
+			continue
+		}
+		cred := client.Credential{ServerURL: server.URL, Token: server.Token, EnvID: server.EnvID}
+		if err := client.SaveCredential(path, client.StoreKeychain, cred); err != nil {
+			log.Printf("Warning: can't move the auth token for %s to the keychain: %v", server.URL, err)
+			continue
+		}
+		log.Printf("Moved the auth token for %s to the keychain; it can be removed from %s", server.URL, source)
+	}
+
+	creds, err := client.LoadCredentials(path)
+	if err != nil {
+		log.Printf("Warning: can't read stored credentials: %v", err)
+		return
+	}
+	for _, cred := range creds {
+		if cred.Keychain || cred.Token == "" {
+			continue
+		}
+		if err := client.SaveCredential(path, client.StoreKeychain, cred); err != nil {
+			log.Printf("Warning: can't move the stored token for %s to the keychain: %v", cred.ServerURL, err)
+			continue
+		}
+		log.Printf("Moved the stored token for %s from %s to the keychain", cred.ServerURL, path)
+	}
+}
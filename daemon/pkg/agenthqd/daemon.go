@@ -0,0 +1,1851 @@
+// Package agenthqd is the Agent HQ daemon as a library: the session manager,
+// server connections and git worktree handling behind the agenthq-daemon
+// binary, for Go programs (IDE plugins, custom orchestrators) that run
+// agents themselves instead of shelling out to it.
+//
+// A program creates a Daemon with New, starts it with Start and stops it
+// with Stop. While it runs, the daemon serves the servers in its config
+// (or AGENTHQ_SERVER_URL) and, with Options.Local or Options.API, the
+// control listener, exactly as the binary does; Sessions gives direct
+// access to its sessions. The daemon keeps process-wide state, so only one
+// Daemon can run in a process at a time.
+package agenthqd
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agenthq/daemon/internal/agent"
+	"github.com/agenthq/daemon/internal/budget"
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/crash"
+	"github.com/agenthq/daemon/internal/docker"
+	"github.com/agenthq/daemon/internal/dotenv"
+	"github.com/agenthq/daemon/internal/gpu"
+	"github.com/agenthq/daemon/internal/history"
+	"github.com/agenthq/daemon/internal/keys"
+	"github.com/agenthq/daemon/internal/localserver"
+	"github.com/agenthq/daemon/internal/macro"
+	"github.com/agenthq/daemon/internal/netwatch"
+	"github.com/agenthq/daemon/internal/placeholder"
+	"github.com/agenthq/daemon/internal/plugin"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/pty"
+	"github.com/agenthq/daemon/internal/ptylog"
+	"github.com/agenthq/daemon/internal/redact"
+	"github.com/agenthq/daemon/internal/repoconfig"
+	"github.com/agenthq/daemon/internal/scope"
+	"github.com/agenthq/daemon/internal/sensitive"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/telemetry"
+	"github.com/agenthq/daemon/internal/tmux"
+	"github.com/agenthq/daemon/internal/traffic"
+	"github.com/agenthq/daemon/internal/transcript"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// Global workspace path
+var workspace string
+
+// Named input macros available to send-macro
+var macros *macro.Set
+
+// ErrRunning is returned by Start when another Daemon is running in the
+// process.
+var ErrRunning = errors.New("a daemon is already running in this process")
+
+// running is set while a Daemon runs.
+var running atomic.Bool
+
+// Options configure a Daemon. The zero value connects to the servers of the
+// default config file without a workspace.
+type Options struct {
+	// Config is the daemon's configuration; nil loads ConfigPath.
+	Config *Config
+	// ConfigPath is the config file, which Reload re-reads (default
+	// DefaultConfigPath when Config is nil; with Config set, empty means
+	// Config wasn't loaded from a file).
+	ConfigPath string
+	// Workspace is the directory containing the repositories worktrees are
+	// created in.
+	Workspace string
+	// Local serves the protocol on Listen instead of connecting to servers.
+	Local bool
+	// API serves the REST API on Listen; it requires Token.
+	API bool
+	// Listen is the control listener address for Local and API (default
+	// localhost:7777).
+	Listen string
+	// Token is what clients of the control listener must present.
+	Token string
+	// DryRun only reports what spawns, kills and worktree removals would do.
+	DryRun bool
+	// Discover finds the server by browsing the local network for an
+	// advertised _agenthq._tcp service, instead of using a server URL.
+	Discover bool
+	// RecordProtocol, if set, is a file every protocol message is appended
+	// to, for replay.
+	RecordProtocol string
+	// CredentialStore says where server tokens are kept: "keychain" moves
+	// those given in AGENTHQ_AUTH_TOKEN, the config file or the credentials
+	// file to the OS keychain at start; "auto" does so when a keychain is
+	// available; "file" or empty leaves them where they are.
+	CredentialStore string
+	// Version is reported in the log.
+	Version string
+
+	// OnOutput and OnExit, if set, are called with each session's output
+	// (after redaction) and exit, besides sending them to servers.
+	OnOutput func(processID string, data []byte)
+	OnExit   func(processID string, exit ExitInfo)
+}
+
+// Daemon is a running Agent HQ daemon.
+type Daemon struct {
+	opts Options
+	cfg  *Config
+	mgr  *session.Manager
+
+	started       bool
+	stop          chan struct{}
+	trips         chan WatchdogTrip
+	httpServer    *http.Server
+	hub           *localserver.Hub
+	dockerClient  *docker.Client
+	recorder      *traffic.Recorder
+	stopTelemetry func()
+
+	drainOnce sync.Once
+	// drained is closed when a drain is done
+	drained chan struct{}
+}
+
+// New checks opts and loads the config if needed; Start starts the daemon.
+func New(opts Options) (*Daemon, error) {
+	if opts.API && opts.Token == "" {
+		return nil, errors.New("the REST API requires a token")
+	}
+	if opts.Discover && opts.Local {
+		return nil, errors.New("discovery and local mode can't be combined")
+	}
+	if opts.CredentialStore != "" {
+		store, err := client.ResolveStore(opts.CredentialStore)
+		if err != nil {
+			return nil, fmt.Errorf("credential store: %w", err)
+		}
+		opts.CredentialStore = store
+	}
+	opts.Listen = cmp.Or(opts.Listen, "localhost:7777")
+	opts.Version = cmp.Or(opts.Version, "dev")
+
+	cfg := opts.Config
+	if cfg == nil {
+		opts.ConfigPath = cmp.Or(opts.ConfigPath, DefaultConfigPath())
+		var err error
+		if cfg, err = config.Load(opts.ConfigPath); err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+	// Without a token, clients could leave out a scoped one
+	if (opts.Local || opts.API) && len(cfg.Tokens) > 0 && opts.Token == "" {
+		return nil, errors.New("scoped tokens require a token")
+	}
+	return &Daemon{
+		opts:    opts,
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		trips:   make(chan WatchdogTrip, 1),
+		drained: make(chan struct{}),
+	}, nil
+}
+
+// Sessions returns the daemon's session manager, to spawn, list and kill
+// sessions directly. It is nil until Start.
+func (d *Daemon) Sessions() *SessionManager {
+	return d.mgr
+}
+
+// WatchdogTrips receives the watchdog's trip when it decides the daemon is
+// wedged and should be restarted (see config watchdog). The agenthq-daemon
+// binary stops and re-executes itself; an embedding program decides for
+// itself.
+func (d *Daemon) WatchdogTrips() <-chan WatchdogTrip {
+	return d.trips
+}
+
+// Start sets up the session backends, adopts sessions left running by a
+// previous daemon, connects to the servers and opens the control listener.
+// It doesn't block; Stop stops the daemon, which can't be started again.
+func (d *Daemon) Start() error {
+	if d.started {
+		return errors.New("daemon already started")
+	}
+	if !running.CompareAndSwap(false, true) {
+		return ErrRunning
+	}
+	d.started = true
+	if err := d.start(); err != nil {
+		d.Stop()
+		return err
+	}
+	return nil
+}
+
+func (d *Daemon) start() error {
+	opts, cfg := d.opts, d.cfg
+	workspace = opts.Workspace
+	dryRun = opts.DryRun
+	version = opts.Version
+	// Processes the daemon starts outside sessions mustn't pass for those
+	// of the session it may have been started from
+	os.Unsetenv(session.EnvSessionID)
+	os.Unsetenv(session.EnvDaemonRun)
+
+	registry = agent.NewRegistry(cfg)
+	macros = macro.NewSet(cfg.Macros)
+	protectedPaths = cfg.ProtectedPaths
+	scopedTokens = cfg.Tokens
+	summarizer = cfg.Summarizer
+	pendingRestart = nil
+	sensitivePaths = sensitive.Merge(sensitive.Defaults, cfg.SensitivePaths)
+	safeModeAfter = 0
+	drainDeadline = time.Time{}
+	if !cfg.SafeMode.Disabled {
+		safeModeAfter = cmp.Or(cfg.SafeMode.AfterDuration(), defaultSafeModeAfter)
+	}
+	setupClipboard(cfg.Clipboard)
+	if cfg.WorktreeDiskMarginMB != 0 {
+		worktree.DiskMargin = int64(cfg.WorktreeDiskMarginMB) << 20
+	}
+	worktree.Root = cfg.WorktreeRoot
+
+	var err error
+	if !cfg.History.Disabled {
+		path := cmp.Or(cfg.History.Path, history.DefaultPath())
+		if events, err = history.Open(path, cfg.History.RetentionDuration()); err != nil {
+			return fmt.Errorf("history: %w", err)
+		}
+	}
+
+	if plugins, err = plugin.Start(cfg.Plugins, plugin.InitializeParams{Version: opts.Version, Workspace: workspace}); err != nil {
+		return err
+	}
+
+	if opts.RecordProtocol != "" {
+		if d.recorder, err = traffic.Create(opts.RecordProtocol); err != nil {
+			return fmt.Errorf("recording protocol: %w", err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+
+	// Environment tags from the config file, plus any in AGENTHQ_TAGS
+	tags := append(cfg.Tags, trimAll(strings.Split(os.Getenv("AGENTHQ_TAGS"), ","))...)
+
+	if opts.CredentialStore == client.StoreKeychain && !opts.Local {
+		migrateCredentials(cfg)
+	}
+	servers := ConfiguredServers(cfg)
+	if opts.Local {
+		servers = nil
+	}
+	if opts.Discover {
+		if len(cfg.Servers) > 0 {
+			return errors.New("discovery can't be used with servers in the config file")
+		}
+		// Found on the network; the environment still has the token
+		servers[0].URL, servers[0].FailoverURLs = "", nil
+	}
+
+	log.Printf("Agent HQ Daemon %s", opts.Version)
+	for _, server := range servers {
+		if opts.Discover {
+			break
+		}
+		for _, u := range server.URLs() {
+			if _, err := client.ParseURL(u); err != nil {
+				return err
+			}
+		}
+	}
+	for _, server := range servers {
+		// Namespace processIDs only when several servers share the daemon
+		namespace := ""
+		if len(servers) > 1 {
+			namespace = server.Name
+		}
+		conn := newConnection(server, namespace, hostname)
+		conn.discover = opts.Discover
+		connections = append(connections, conn)
+
+		log.Printf("Environment: %s (%s)", conn.server.EnvName, conn.server.EnvID)
+		if conn.discover {
+			log.Printf("Discovering a server (%s) on the local network", discoverService)
+		} else {
+			log.Printf("Connecting to: %s", strings.Join(server.URLs(), ", "))
+		}
+		if server.Token != "" {
+			log.Printf("Auth token: configured")
+		}
+		if server.SigningSecret != "" {
+			log.Printf("Message signing: required")
+		}
+		if len(server.Scopes) > 0 {
+			log.Printf("Scopes: %s", strings.Join(server.Scopes, ", "))
+		}
+	}
+	if workspace != "" {
+		log.Printf("Workspace: %s", workspace)
+	}
+	if worktree.Root != "" {
+		log.Printf("Worktree root: %s", worktree.Root)
+	}
+	if dryRun {
+		log.Printf("Dry run: spawns, kills and worktree removals are only reported")
+	}
+	if d.recorder != nil {
+		log.Printf("Recording protocol to: %s", opts.RecordProtocol)
+	}
+
+	var sessionMgr *session.Manager
+
+	pty.SetReadBufferSize(cfg.Output.ReadBufferSize)
+	ptyLog = ptylog.New(cfg.Output.ReplayBufferSize)
+	sendOutput := func(processID string, data []byte) {
+		if opts.OnOutput != nil {
+			opts.OnOutput(processID, data)
+		}
+		ptyLog.Write(processID, data, func(chunk ptylog.Chunk) {
+			sendOutputChunk(processID, chunk)
+		})
+	}
+	coalescer := newOutputCoalescer(cfg.Output.CoalesceDuration(), sendOutput)
+	if coalescer != nil {
+		log.Printf("Coalescing session output for %s", cfg.Output.CoalesceDuration())
+		sendOutput = coalescer.write
+	}
+	redactor, err := newOutputRedactor(cfg.Redact, sendOutput)
+	if err != nil {
+		return fmt.Errorf("redaction: %w", err)
+	}
+	secrets = nil
+	if redactor != nil {
+		log.Printf("Redacting secrets in session output")
+		secrets = redactor.redactor
+	}
+
+	// Create session manager with callbacks
+	sessionMgr = session.NewManager(
+		registry,
+		// onData callback - send PTY output to server
+		func(processID string, data []byte) {
+			if redactor != nil {
+				redactor.write(processID, data)
+				return
+			}
+			sendOutput(processID, data)
+		},
+		// onExit callback - notify server of process exit
+		func(processID string, exit session.ExitInfo) {
+			if redactor != nil {
+				// Send held-back output before the exit
+				redactor.close(processID)
+			}
+			if coalescer != nil {
+				coalescer.close(processID)
+			}
+			forgetScreen(ownerOf(processID), processID)
+			touched := touchedProtected(processID)
+			sendToOwner(protocol.DaemonMessage{
+				Type:             protocol.MsgTypeProcessExit,
+				ProcessID:        processID,
+				ExitCode:         exit.Code,
+				ExitReason:       exit.Reason,
+				Signal:           exit.Signal,
+				ExitDetail:       exit.Detail,
+				TouchedProtected: touched,
+				Diagnosis:        exit.Diagnosis,
+			})
+			recordSessionExited(sessionMgr, processID, exit, touched)
+			recordExitMetrics(sessionMgr, processID, exit)
+			compareProcessExited(processID, exit)
+			forgetInputRejections(processID)
+			forgetOutput(processID)
+			forgetTraffic(processID)
+			spawns.release(processID)
+			afterSessionExit(sessionMgr, processID, exit)
+			summarizeSession(sessionMgr, processID, exit)
+			if opts.OnExit != nil {
+				opts.OnExit(processID, exit)
+			}
+		},
+		// onAgentSession callback - report the agent's own conversation id
+		func(processID, agentSessionID string) {
+			sendToOwner(protocol.DaemonMessage{
+				Type:           protocol.MsgTypeAgentSession,
+				ProcessID:      processID,
+				AgentSessionID: agentSessionID,
+			})
+			recordAgentSession(sessionMgr, processID, agentSessionID)
+		},
+	)
+	d.mgr = sessionMgr
+	daemonConfig = d.effectiveConfig
+	crash.SetHandler(func(report crash.Report) {
+		reportCrash(sessionMgr, report)
+	})
+
+	gpus := gpu.Detect()
+	for _, g := range gpus {
+		log.Printf("GPU: %s %s (%d MB)", g.Vendor, g.Model, g.MemoryMB)
+	}
+
+	// describe adds what this daemon offers to a register message
+	describe := func(msg *protocol.DaemonMessage) {
+		for _, p := range registry.Profiles() {
+			msg.Profiles = append(msg.Profiles, protocol.ProfileInfo{
+				Name:  p.Name,
+				Agent: p.Agent,
+				Model: p.Model,
+			})
+		}
+		msg.Macros = macros.Names()
+		msg.Backends = sessionMgr.Backends()
+		msg.Clipboard = clipboardOps()
+		msg.Tags = tags
+		msg.Metadata = cfg.Metadata
+		msg.WatchdogTrips = dog.Trips()
+		msg.GPUs = gpus
+		msg.Draining = drainStatus(sessionMgr)
+		for _, agent := range plugins.Launchers() {
+			if !slices.Contains(msg.Capabilities, string(agent)) {
+				msg.Capabilities = append(msg.Capabilities, string(agent))
+			}
+		}
+	}
+
+	sessionMgr.SetInputLimits(inputLimits(cfg.InputLimits))
+	sessionMgr.SetLauncher(pluginLauncher)
+	sessionMgr.SetBudget(cfg.Budget)
+	sessionMgr.SetFirstOutputHook(recordFirstOutput)
+	sessionMgr.SetShellHistory(!cfg.ShellHistory.Shared, cfg.ShellHistory.RetentionDuration())
+	if budget.Enabled(cfg.Budget) {
+		log.Printf("Session budget: cpuSeconds=%d wallClockSeconds=%d action=%s", cfg.Budget.CPUSeconds, cfg.Budget.WallClockSeconds, budget.Action(cfg.Budget))
+	}
+
+	// tmux is available whenever it's installed; the config picks the default
+	if tmuxServer, err := tmux.NewServer(tmux.SocketName); err == nil {
+		sessionMgr.RegisterBackend(session.TmuxBackend{Server: tmuxServer})
+	} else if cfg.SessionBackend == session.BackendTmux {
+		return fmt.Errorf("session backend: %w", err)
+	}
+	// So is docker whenever a container engine responds
+	dockerClient, err := docker.NewClient(cfg.Docker.Host, cfg.Docker.Engine, cfg.Docker.CertPath)
+	if err != nil {
+		return fmt.Errorf("session backend: %w", err)
+	}
+	d.dockerClient = dockerClient
+	if engine, err := dockerClient.Detect(); err == nil {
+		log.Printf("Container engine: %s at %s", engine, dockerClient.Host())
+		// Containers don't outlive the daemon; any still around are left
+		// over from a crash
+		orphans, err := dockerClient.RemoveOrphans()
+		for _, orphan := range orphans {
+			log.Printf("Removed orphaned container %.12s of session %s", orphan.ID, orphan.ProcessID)
+		}
+		if err != nil {
+			log.Printf("Failed to remove orphaned containers: %v", err)
+		}
+		sessionMgr.RegisterBackend(session.DockerBackend{
+			Client:       dockerClient,
+			Image:        cfg.Docker.Image,
+			Images:       cfg.Docker.Images,
+			Mounts:       cfg.Docker.Mounts,
+			PathMap:      cfg.Docker.PathMap,
+			Devcontainer: cfg.Docker.Devcontainer,
+			Sandbox:      cfg.Docker.Sandbox,
+			Sandboxes:    cfg.Docker.Sandboxes,
+			OnPull:       reportImagePull,
+		})
+	} else if cfg.SessionBackend == session.BackendDocker {
+		return fmt.Errorf("session backend: %w", err)
+	} else if cfg.Docker.Engine != "" || cfg.Docker.Host != "" {
+		log.Printf("Container engine unavailable: %v", err)
+	}
+	if cfg.SessionBackend != "" {
+		if err := sessionMgr.SetDefaultBackend(cfg.SessionBackend); err != nil {
+			return fmt.Errorf("session backend: %w", err)
+		}
+	}
+	log.Printf("Session backends: %s (default %s)", strings.Join(sessionMgr.Backends(), ", "), cmp.Or(cfg.SessionBackend, session.BackendPTY))
+	spawns.setMax(cfg.Scheduler.MaxSessions)
+	for _, processID := range sessionMgr.Adopt() {
+		log.Printf("Adopted running session %s", processID)
+		if info, ok := sessionMgr.Info(processID); ok {
+			spawns.track(processID, info.WorktreePath)
+		}
+	}
+	// What earlier runs left running, and couldn't be adopted, is killed
+	go sweepOrphans(sessionMgr, d.stop)
+	go enforceBudgets(sessionMgr, d.stop)
+	d.stopTelemetry = startTelemetry(cfg.Telemetry, hostname, sessionMgr)
+
+	// Sleep and network changes leave connections dead without noticing
+	var network *netwatch.Watcher
+	if len(connections) > 0 {
+		network = netwatch.Start()
+	}
+
+	// newClient creates a WebSocket client for a connection
+	newClient := func(conn *connection) *client.Client {
+		var c *client.Client
+		c = client.New(conn.url(), conn.server.Token, conn.server.EnvID, conn.server.EnvName, workspace,
+			func(msg protocol.ServerMessage) {
+				handleServerMessage(c, sessionMgr, msg, conn.server.Scopes)
+			},
+			// Signal reconnection needed
+			conn.signalReconnect,
+		)
+		c.SetNamespace(conn.namespace)
+		if cfg.MaxMessageSize != 0 {
+			c.SetMaxMessageSize(cfg.MaxMessageSize)
+		}
+		if conn.verifier != nil {
+			c.SetVerifier(conn.verifier)
+		}
+		c.SetRecorder(d.recorder)
+		c.SetOnline(network.Online)
+		c.OnTraffic(func(dir, processID string, n int) {
+			conn.countTraffic(sessionMgr, dir, processID, n)
+		})
+		c.OnRegister(describe)
+		c.OnHeartbeatAck(conn.heartbeatAcked)
+		c.OnRTT(func(rtt time.Duration) {
+			serverRTT.Record(float64(rtt.Microseconds())/1000, telemetry.String("server", conn.label()))
+		})
+		c.OnHeartbeat(func(msg *protocol.DaemonMessage) {
+			if len(gpus) > 0 {
+				msg.GPUs = gpu.Refresh(gpus)
+			}
+			msg.WatchdogTrips = dog.Trips()
+			msg.Draining = drainStatus(sessionMgr)
+		})
+		return c
+	}
+
+	// The control listener serves the protocol to local clients in
+	// standalone mode and/or the REST API
+	if opts.Local || opts.API {
+		ln, err := net.Listen("tcp", opts.Listen)
+		if err != nil {
+			return fmt.Errorf("control listener: %w", err)
+		}
+		listen := ln.Addr().String()
+		mux := http.NewServeMux()
+		if opts.Local {
+			var hub *localserver.Hub
+			hub = localserver.NewHub(opts.Token,
+				func() protocol.DaemonMessage {
+					msg := protocol.DaemonMessage{
+						Type:         protocol.MsgTypeRegister,
+						EnvID:        "local",
+						EnvName:      hostname,
+						Workspace:    workspace,
+						Capabilities: slices.Clone(client.Capabilities),
+					}
+					describe(&msg)
+					return msg
+				},
+				func(msg protocol.ServerMessage, scopes scope.Scopes) {
+					handleServerMessage(hub, sessionMgr, msg, scopes)
+				},
+			)
+			if cfg.MaxMessageSize != 0 {
+				hub.SetMaxMessageSize(cfg.MaxMessageSize)
+			}
+			hub.SetRecorder(d.recorder)
+			hub.SetTokens(cfg.Tokens)
+			localHub = hub
+			d.hub = hub
+
+			mux.Handle("/ws", hub)
+			mux.Handle("/view/", hub.ViewerHandler(viewerSessions{sessionMgr}))
+			log.Printf("Serving locally on ws://%s/ws", listen)
+			log.Printf("Session viewer: http://%s/view/", listen)
+		}
+		if opts.API {
+			mux.Handle("/api/", newAPIHandler(sessionMgr, opts.Token, d.Reload, d.Drain))
+			log.Printf("REST API: http://%s/api/", listen)
+		}
+		if opts.Token != "" {
+			log.Printf("Local token: configured")
+		}
+		for _, t := range cfg.Tokens {
+			log.Printf("Scoped token %s: %s", t.Name, strings.Join(t.Scopes, ", "))
+		}
+
+		d.httpServer = &http.Server{Handler: mux}
+		go func() {
+			if err := d.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Printf("Control listener failed: %v", err)
+			}
+		}()
+	}
+
+	// Connection loops with auto-reconnect
+	startWatchdog(cfg.Watchdog, sessionMgr, d.trips, d.stop)
+	if !cfg.Monitor.Disabled {
+		startMonitor(cfg.Monitor, d.stop)
+	}
+	for _, conn := range connections {
+		go conn.run(d.stop, newClient)
+	}
+	if network != nil {
+		crash.Go("netwatch", "", func() { watchNetwork(network, d.stop) })
+	}
+	if cfg.AdaptiveOutput.Enabled {
+		followScreens(sessionMgr)
+		for _, conn := range connections {
+			crash.Go("adaptive-output", "", func() { conn.adaptOutput(cfg.AdaptiveOutput, d.stop) })
+		}
+	}
+
+	if cfg.WorktreeRetention.Enabled() {
+		crash.Go("janitor", "", func() { newJanitor(cfg.WorktreeRetention, sessionMgr).run(d.stop) })
+	}
+	if workspace != "" {
+		crash.Go("repo-watch", "", func() { watchRepos(d.stop) })
+	}
+	if cfg.Fetch.IntervalDuration() > 0 {
+		crash.Go("repo-fetch", "", func() { fetchRepos(cfg.Fetch, d.stop) })
+	}
+
+	if cfg.LogShipping.Enabled {
+		setLogShipping(cfg.LogShipping)
+	}
+	return nil
+}
+
+// Stop disconnects from the servers, closes the control listener and ends
+// the sessions; persistent ones (tmux) are left running for the next
+// daemon to adopt.
+func (d *Daemon) Stop() {
+	if !d.started {
+		return
+	}
+	select {
+	case <-d.stop:
+		return
+	default:
+	}
+	close(d.stop)
+	if d.httpServer != nil {
+		d.httpServer.Close()
+	}
+
+	// Clean up
+	if d.mgr != nil {
+		d.mgr.KillAll()
+	}
+	if d.dockerClient != nil {
+		if err := d.dockerClient.Close(); err != nil {
+			log.Printf("Failed to remove containers: %v", err)
+		}
+	}
+	for _, conn := range connections {
+		conn.Close()
+	}
+	connections = nil
+	localHub = nil
+	daemonConfig = nil
+	if d.stopTelemetry != nil {
+		d.stopTelemetry()
+	}
+	if events != nil {
+		events.Close()
+		events = nil
+	}
+	plugins.Close()
+	plugins = nil
+	d.recorder.Close()
+	running.Store(false)
+}
+
+func trimAll(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func handleServerMessage(wsClient link, mgr *session.Manager, msg protocol.ServerMessage, scopes scope.Scopes) {
+	// peer is the sender itself, which replies may be wrapped around
+	peer := wsClient
+	// Acked after any crash report, which the deferred Recover sends
+	req := newRequest(wsClient, msg)
+	if req != nil {
+		wsClient = req
+		defer req.release()
+	}
+	defer crash.Recover(msg.Type, msg.ProcessID)
+	ctx, span := traceMessage(msg)
+	defer span.End(nil)
+
+	// async handles the message on its own goroutine, acking it when done
+	async := func(processID string, fn func()) {
+		req.hold()
+		crash.Go(msg.Type, processID, func() {
+			defer req.release()
+			fn()
+		})
+	}
+
+	if outOfScope(wsClient, scopes, msg) {
+		return
+	}
+	if refusedInSafeMode(peer, wsClient, msg) {
+		return
+	}
+	if refusedWhileDraining(wsClient, msg) {
+		return
+	}
+	if deniedByPlugin(ctx, wsClient, msg) {
+		return
+	}
+	if handleDryRun(wsClient, mgr, msg) {
+		return
+	}
+
+	switch msg.Type {
+	case protocol.MsgTypeCreateWorktree:
+		log.Printf("Create worktree request: worktreeId=%s repoName=%s", msg.WorktreeID, msg.RepoName)
+		if idempotent(req, msg) {
+			return
+		}
+		async("", func() {
+			createWorktree(ctx, wsClient, msg.WorktreeID, msg.RepoName, msg.RepoPath, msg.Package)
+		})
+
+	case protocol.MsgTypeSpawn:
+		log.Printf("Spawn request: processId=%s agent=%s profile=%s model=%s backend=%s package=%s cols=%d rows=%d yoloMode=%v resumeOf=%s", msg.ProcessID, msg.Agent, msg.Profile, msg.Model, msg.Backend, msg.Package, msg.Cols, msg.Rows, msg.YoloMode, msg.ResumeOf)
+		if idempotent(req, msg) {
+			return
+		}
+		// Spawns may wait minutes for a container image
+		sizes := expectSize(msg.ProcessID)
+		async(msg.ProcessID, func() { req.fail(spawnProcess(ctx, wsClient, mgr, msg, sizes)) })
+
+	case protocol.MsgTypePtyInput:
+		data, err := ptyInput(mgr, msg)
+		if err != nil {
+			log.Printf("Failed to decode input: %v", err)
+			req.fail(err)
+			return
+		}
+		// Input to a read-only session, or from a viewer without the
+		// session's input lease, is dropped quietly
+		if len(data) > 0 || msg.Signal == "" {
+			err = mgr.InputFrom(msg.ProcessID, msg.SourceUser, data)
+		}
+		if err == nil && msg.Signal != "" {
+			err = mgr.SignalFrom(msg.ProcessID, msg.SourceUser, msg.Signal)
+		}
+		switch {
+		case errors.Is(err, session.ErrInputLimit):
+			rejectInput(wsClient, msg.ProcessID, err)
+		case err != nil && !errors.Is(err, session.ErrReadOnly) && !errors.Is(err, session.ErrInputLeased):
+			log.Printf("Failed to send input: %v", err)
+			req.fail(err)
+		}
+
+	case protocol.MsgTypeAcquireInput, protocol.MsgTypeReleaseInput:
+		log.Printf("Input lease request: type=%s processId=%s sourceUser=%s", msg.Type, msg.ProcessID, msg.SourceUser)
+		updateInputLease(wsClient, mgr, msg)
+
+	case protocol.MsgTypePasteImage:
+		log.Printf("Paste image request: processId=%s", msg.ProcessID)
+		// In order with pty-input, so the path lands where the user typed
+		pasteImage(wsClient, mgr, msg)
+
+	case protocol.MsgTypeSetClipboard:
+		log.Printf("Set clipboard request: processId=%s sourceUser=%s", msg.ProcessID, msg.SourceUser)
+		async(msg.ProcessID, func() { setClipboard(wsClient, msg) })
+
+	case protocol.MsgTypeGetClipboard:
+		log.Printf("Get clipboard request: processId=%s sourceUser=%s", msg.ProcessID, msg.SourceUser)
+		async(msg.ProcessID, func() { getClipboard(wsClient, msg) })
+
+	case protocol.MsgTypeCompareRun:
+		log.Printf("Compare run request: runId=%s repo=%s agents=%d", msg.RunID, msg.RepoName, len(msg.Agents))
+		async("", func() { startCompareRun(ctx, wsClient, mgr, msg) })
+
+	case protocol.MsgTypeRunTests:
+		log.Printf("Run tests request: runId=%s worktreePath=%s package=%s", msg.RunID, msg.WorktreePath, msg.Package)
+		async("", func() { runTests(wsClient, msg) })
+
+	case protocol.MsgTypeRunLinter:
+		log.Printf("Run linter request: runId=%s worktreePath=%s package=%s", msg.RunID, msg.WorktreePath, msg.Package)
+		async("", func() { runLinter(wsClient, msg) })
+
+	case protocol.MsgTypeStageFiles:
+		log.Printf("Stage files request: runId=%s worktreePath=%s files=%d", msg.RunID, msg.WorktreePath, len(msg.Files))
+		// Not in a goroutine: a spawn sent after stage-files must see the files
+		stageFiles(wsClient, msg)
+
+	case protocol.MsgTypeSetReadOnly:
+		log.Printf("Set read-only request: processId=%s readOnly=%t", msg.ProcessID, msg.ReadOnly)
+		if err := mgr.SetReadOnly(msg.ProcessID, msg.ReadOnly); err != nil {
+			log.Printf("Failed to set read-only: %v", err)
+			req.fail(err)
+		}
+
+	case protocol.MsgTypeResumeSession:
+		log.Printf("Resume request: processId=%s", msg.ProcessID)
+		if err := resumeSession(mgr, msg); err != nil {
+			log.Printf("Failed to resume session: %v", err)
+			req.fail(err)
+		}
+
+	case protocol.MsgTypeGroup:
+		log.Printf("Group request: processId=%s group=%q", msg.ProcessID, msg.Group)
+		if err := mgr.SetGroup(msg.ProcessID, msg.Group); err != nil {
+			log.Printf("Failed to set group: %v", err)
+			req.fail(err)
+		}
+
+	case protocol.MsgTypeBroadcastInput:
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			log.Printf("Failed to decode broadcast input: %v", err)
+			req.fail(err)
+			return
+		}
+		if _, err := mgr.BroadcastInput(msg.Group, data); err != nil {
+			log.Printf("Failed to broadcast input to group %q: %v", msg.Group, err)
+			req.fail(err)
+		}
+
+	case protocol.MsgTypeSendMacro:
+		m, ok := macros.Get(msg.Macro)
+		if !ok {
+			log.Printf("Unknown macro %q for process %s", msg.Macro, msg.ProcessID)
+			req.fail(fmt.Errorf("unknown macro %q", msg.Macro))
+			return
+		}
+		log.Printf("Send macro request: processId=%s macro=%s", msg.ProcessID, msg.Macro)
+		async(msg.ProcessID, func() {
+			err := m.Run(context.Background(), func(data []byte) error {
+				return mgr.InputFrom(msg.ProcessID, msg.SourceUser, data)
+			})
+			if err != nil {
+				log.Printf("Macro %s failed for process %s: %v", msg.Macro, msg.ProcessID, err)
+				req.fail(err)
+			}
+		})
+
+	case protocol.MsgTypeResize:
+		if resizePending(msg.ProcessID, msg.Cols, msg.Rows) {
+			// The spawn reports the size once started
+			return
+		}
+		if err := mgr.Resize(msg.ProcessID, msg.Cols, msg.Rows); err != nil {
+			log.Printf("Failed to resize: %v", err)
+			req.fail(err)
+		} else {
+			resizeScreen(mgr, msg.ProcessID)
+			sendPtySize(wsClient, mgr, msg.ProcessID)
+		}
+
+	case protocol.MsgTypeQueryPtySize:
+		sendPtySize(wsClient, mgr, msg.ProcessID)
+
+	case protocol.MsgTypeResyncRequest:
+		log.Printf("Resync request: processId=%s seq=%d", msg.ProcessID, msg.Seq)
+		if err := resync(wsClient, mgr, msg.ProcessID, msg.Seq); err != nil {
+			log.Printf("Failed to resync: %v", err)
+			req.fail(err)
+		}
+
+	case protocol.MsgTypeKill:
+		log.Printf("Kill request: processId=%s", msg.ProcessID)
+		if spawns.cancel(msg.ProcessID) {
+			// Still waiting for a slot; its spawn reports it failed
+			return
+		}
+		if err := mgr.Kill(msg.ProcessID); err != nil {
+			log.Printf("Failed to kill process: %v", err)
+			req.fail(err)
+		}
+
+	case protocol.MsgTypeRemoveWorktree:
+		log.Printf("Remove worktree request: worktreeId=%s path=%s force=%v", msg.WorktreeID, msg.WorktreePath, msg.Force)
+		async("", func() { reportWorktreeRemoval(ctx, wsClient, mgr, msg) })
+
+	case protocol.MsgTypeFetchRepo:
+		log.Printf("Fetch repo request: repoName=%s repoPath=%s", msg.RepoName, msg.RepoPath)
+		async("", func() {
+			info, err := fetchRepo(ctx, msg.RepoPath)
+			req.fail(err)
+			wsClient.Send(repoFetched(info, err))
+		})
+
+	case protocol.MsgTypeListRepos:
+		log.Printf("List repos request")
+		repos := scanWorkspace()
+		wsClient.Send(protocol.DaemonMessage{
+			Type:  protocol.MsgTypeReposList,
+			Repos: repos,
+		})
+
+	case protocol.MsgTypeQueryHistory:
+		log.Printf("Query history request: runId=%s", msg.RunID)
+		async("", func() { sendHistory(wsClient, msg) })
+
+	case protocol.MsgTypeGetHistory:
+		log.Printf("Get history request: processId=%s", msg.ProcessID)
+		async("", func() { sendShellHistory(wsClient, mgr, msg) })
+
+	case protocol.MsgTypeGetAgentTranscript:
+		log.Printf("Get agent transcript request: processId=%s", msg.ProcessID)
+		async("", func() { sendAgentTranscript(wsClient, mgr, msg.ProcessID) })
+
+	case protocol.MsgTypeGetSessionInfo:
+		log.Printf("Get session info request: processId=%s", msg.ProcessID)
+		async("", func() { sendSessionInfo(wsClient, mgr, msg.ProcessID) })
+
+	case protocol.MsgTypeGetSessionStats:
+		sendSessionStats(wsClient, peer, mgr, msg.ProcessID)
+
+	case protocol.MsgTypeGetDaemonConfig:
+		log.Printf("Get daemon config request")
+		sendDaemonConfig(wsClient, peer, scopes)
+
+	case protocol.MsgTypeAnnotateSession:
+		if err := annotateSession(mgr, msg); err != nil {
+			log.Printf("Failed to annotate session %s: %v", msg.ProcessID, err)
+			req.fail(err)
+		}
+
+	default:
+		log.Printf("Unknown message type: %s", msg.Type)
+		req.fail(fmt.Errorf("unknown message type %q", msg.Type))
+	}
+}
+
+func sendPtySize(wsClient link, mgr *session.Manager, processID string) {
+	cols, rows, err := mgr.Size(processID)
+	if err != nil {
+		log.Printf("Failed to get PTY size for process %s: %v", processID, err)
+		return
+	}
+
+	wsClient.Send(protocol.DaemonMessage{
+		Type:      protocol.MsgTypePtySize,
+		ProcessID: processID,
+		Cols:      cols,
+		Rows:      rows,
+	})
+}
+
+// sendAgentTranscript sends the agent's own conversation log for a process.
+func sendAgentTranscript(wsClient link, mgr *session.Manager, processID string) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeAgentTranscript,
+		ProcessID: processID,
+		Markers:   sessionMarkers(processID),
+	}
+
+	ref, ok := mgr.AgentSession(processID)
+	if !ok {
+		reply.Error = "no agent session recorded for process"
+		wsClient.Send(reply)
+		return
+	}
+	reply.Agent = ref.Agent
+	reply.AgentSessionID = ref.AgentSessionID
+
+	path, err := transcript.Locate(ref.Agent, ref.WorktreePath, ref.AgentSessionID)
+	if err != nil {
+		reply.Error = err.Error()
+		wsClient.Send(reply)
+		return
+	}
+
+	records, err := transcript.Read(path)
+	if err != nil {
+		log.Printf("Failed to read transcript %s: %v", path, err)
+		reply.Error = err.Error()
+		wsClient.Send(reply)
+		return
+	}
+
+	reply.Transcript = records
+	wsClient.Send(reply)
+}
+
+// sendSessionInfo sends a session's command line, environment (secrets
+// masked) and process.
+func sendSessionInfo(wsClient link, mgr *session.Manager, processID string) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeSessionInfo,
+		ProcessID: processID,
+	}
+
+	d, err := mgr.Inspect(processID)
+	if err != nil {
+		reply.Error = err.Error()
+		wsClient.Send(reply)
+		return
+	}
+	reply.Session = &protocol.SessionInfo{
+		Agent:     d.Agent,
+		Backend:   d.Backend,
+		Command:   d.Command,
+		Args:      d.Args,
+		Cwd:       d.Dir,
+		Env:       redact.Env(d.Env),
+		PID:       d.PID,
+		PGID:      d.PGID,
+		StartedAt: d.Started.UnixMilli(),
+	}
+	wsClient.Send(reply)
+}
+
+// createWorktree creates a new git worktree
+func createWorktree(ctx context.Context, wsClient link, worktreeID, repoName, repoPath, pkg string) {
+	wt, err := addWorktree(ctx, repoPath, worktreeID, "", pkg)
+	if err != nil {
+		log.Printf("Failed to create worktree: %v", err)
+		wsClient.Send(protocol.DaemonMessage{
+			Type:       protocol.MsgTypeWorktreeError,
+			WorktreeID: worktreeID,
+			Error:      err.Error(),
+			ErrorCode:  errorCode(err),
+		})
+		return
+	}
+
+	log.Printf("Created worktree %s at %s", worktreeID, wt.path)
+
+	// Notify server that worktree is ready
+	wsClient.Send(protocol.DaemonMessage{
+		Type:        protocol.MsgTypeWorktreeReady,
+		WorktreeID:  worktreeID,
+		Path:        wt.path,
+		Branch:      wt.branch,
+		Package:     wt.pkg,
+		Environment: wt.environment,
+		Error:       wt.setupError,
+	})
+}
+
+// startSession starts the session opts describes in worktreeID, with the
+// bookkeeping every spawn shares. The caller holds the session's scheduler
+// slot, from acquire or claim, so no other session has the processId; the
+// protected files in its worktree and the commit it's at are noted. If it
+// doesn't start, these are undone and the slot released; if it does, it's
+// added to the history.
+func startSession(mgr *session.Manager, worktreeID string, opts session.SpawnOptions) error {
+	watchProtected(opts.ProcessID, opts.WorktreePath)
+	recordSessionBase(opts.ProcessID, opts.WorktreePath)
+	if err := mgr.Spawn(opts); err != nil {
+		touchedProtected(opts.ProcessID)
+		takeSessionBase(opts.ProcessID)
+		spawns.release(opts.ProcessID)
+		return err
+	}
+	recordSessionStarted(mgr, worktreeID, opts)
+	return nil
+}
+
+// spawnProcess starts a session for a spawn request and reports it started,
+// or returns why it couldn't. sizes has the resizes for it from expectSize.
+func spawnProcess(ctx context.Context, wsClient link, mgr *session.Manager, msg protocol.ServerMessage, sizes chan terminalSize) error {
+	defer forgetSize(msg.ProcessID, sizes)
+	// Not part of the time to start
+	if msg.Cols <= 0 || msg.Rows <= 0 {
+		msg.Cols, msg.Rows = awaitSize(msg.ProcessID, sizes)
+	}
+	if err := spawns.acquire(ctx, msg.ProcessID, msg.WorktreePath); err != nil {
+		log.Printf("Spawn of %s didn't start: %v", msg.ProcessID, err)
+		reportSpawnProgress(msg.ProcessID, session.StageFailed, err.Error(), nil)
+		return err
+	}
+	// Resized while it waited for its slot
+	if size, ok := latestSize(sizes); ok {
+		msg.Cols, msg.Rows = size.cols, size.rows
+	}
+	_, span := telemetry.StartSpan(ctx, "spawn",
+		telemetry.String("agenthq.process_id", msg.ProcessID),
+		telemetry.String("agenthq.agent", string(msg.Agent)),
+		telemetry.String("agenthq.profile", msg.Profile),
+		telemetry.String("agenthq.backend", msg.Backend))
+	start := time.Now()
+	reportSpawnProgress(msg.ProcessID, session.StagePreparing, "", nil)
+	opts, err := spawnOptions(msg)
+	if err == nil {
+		opts.Progress = spawnProgress(mgr, msg.ProcessID)
+		opts.Requested = start
+		err = startSession(mgr, msg.WorktreeID, opts)
+	}
+	span.End(err)
+	spawnDuration.RecordDuration(start,
+		telemetry.String("agent", string(msg.Agent)),
+		telemetry.String("backend", cmp.Or(msg.Backend, "default")),
+		telemetry.String("outcome", outcome(err)))
+	if err != nil {
+		log.Printf("Failed to spawn process: %v", err)
+		reportSpawnProgress(msg.ProcessID, session.StageFailed, err.Error(), nil)
+		spawns.release(msg.ProcessID)
+		return err
+	}
+
+	// Notify server that process started successfully
+	started := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeProcessStarted,
+		ProcessID: msg.ProcessID,
+		Package:   opts.Package,
+		ReadOnly:  opts.ReadOnly,
+	}
+	if info, ok := mgr.Info(msg.ProcessID); ok {
+		started.SpawnMs = info.SpawnTime.Milliseconds()
+	}
+	wsClient.Send(started)
+	// Resized while it started
+	if size, ok := forgetSize(msg.ProcessID, sizes); ok {
+		if err := mgr.Resize(msg.ProcessID, size.cols, size.rows); err != nil {
+			log.Printf("Failed to resize: %v", err)
+		} else {
+			resizeScreen(mgr, msg.ProcessID)
+		}
+	}
+	sendPtySize(wsClient, mgr, msg.ProcessID)
+	return nil
+}
+
+// spawnProgress returns the session.Progress that reports a spawn's stages
+// to the server, the ready stage with the time to the first output.
+func spawnProgress(mgr *session.Manager, processID string) session.Progress {
+	return func(stage, detail string, diagnosis *protocol.AgentDiagnosis) {
+		switch stage {
+		case session.StageFailed:
+			log.Printf("Agent of %s failed to start: %s%s", processID, detail, describeDiagnosis(diagnosis))
+		case session.StageReady:
+			if info, ok := mgr.Info(processID); ok && info.FirstOutput > 0 {
+				sendToOwner(protocol.DaemonMessage{
+					Type:          protocol.MsgTypeSpawnProgress,
+					ProcessID:     processID,
+					Stage:         stage,
+					FirstOutputMs: info.FirstOutput.Milliseconds(),
+				})
+			} else {
+				reportSpawnProgress(processID, stage, detail, diagnosis)
+			}
+			// Again, now that the agent drew at it, so the front end
+			// can check it matches the terminal it laid out
+			if owner := ownerOf(processID); owner != nil {
+				sendPtySize(owner, mgr, processID)
+			}
+			return
+		}
+		reportSpawnProgress(processID, stage, detail, diagnosis)
+	}
+}
+
+// describeDiagnosis returns the remedies in diagnosis for a log line.
+func describeDiagnosis(diagnosis *protocol.AgentDiagnosis) string {
+	if diagnosis == nil {
+		return ""
+	}
+	var s string
+	if diagnosis.FoundAt != "" {
+		s += fmt.Sprintf(" (found at %s)", diagnosis.FoundAt)
+	}
+	if diagnosis.Install != "" {
+		s += fmt.Sprintf(" (install with: %s)", diagnosis.Install)
+	}
+	return s
+}
+
+// reportSpawnProgress tells the server the stage a spawn reached, so it can
+// show more than a spinner until the agent's first output.
+func reportSpawnProgress(processID, stage, detail string, diagnosis *protocol.AgentDiagnosis) {
+	sendToOwner(protocol.DaemonMessage{
+		Type:      protocol.MsgTypeSpawnProgress,
+		ProcessID: processID,
+		Stage:     stage,
+		Error:     detail,
+		Diagnosis: diagnosis,
+	})
+}
+
+// reportImagePull tells the server why a spawn is taking long: the image it
+// needs is being pulled.
+func reportImagePull(processID string, pull *protocol.ImagePull) {
+	if pull.Status != protocol.ImagePullPulling {
+		log.Printf("Image pull for %s: %s %s", processID, pull.Image, pull.Status)
+	}
+	sendToOwner(protocol.DaemonMessage{
+		Type:      protocol.MsgTypeImagePull,
+		ProcessID: processID,
+		Pull:      pull,
+	})
+}
+
+// spawnOptions builds the session options for a spawn request, resolving
+// its package against the worktree's .agenthq.yml and workspace files.
+func spawnOptions(msg protocol.ServerMessage) (session.SpawnOptions, error) {
+	opts := session.SpawnOptions{
+		ProcessID:    msg.ProcessID,
+		Agent:        msg.Agent,
+		WorktreePath: msg.WorktreePath,
+		Task:         msg.Task,
+		Cols:         msg.Cols,
+		Rows:         msg.Rows,
+		YoloMode:     msg.YoloMode,
+		Profile:      msg.Profile,
+		Model:        msg.Model,
+		MCPServers:   msg.MCPServers,
+		Group:        msg.Group,
+		ResumeOf:     msg.ResumeOf,
+		Backend:      msg.Backend,
+		ReadOnly:     msg.ReadOnly,
+		AllowShared:  msg.AllowShared,
+		Sandbox:      msg.Sandbox,
+	}
+	if msg.Sandbox != nil {
+		if err := docker.ValidateSandbox(*msg.Sandbox); err != nil {
+			return opts, fmt.Errorf("sandbox: %w", err)
+		}
+	}
+	if msg.Budget != nil {
+		if err := budget.Validate(*msg.Budget); err != nil {
+			return opts, fmt.Errorf("budget: %w", err)
+		}
+		opts.Budget = msg.Budget
+	}
+	if msg.Package == "" {
+		// The repo's container image, for container backends
+		if repoCfg, err := repoconfig.Load(msg.WorktreePath); err == nil {
+			opts.Image = repoCfg.Image
+			if err := loadDotenv(&opts, repoCfg); err != nil {
+				return opts, err
+			}
+		}
+		opts.Placeholders = spawnPlaceholders(msg, opts)
+		return opts, nil
+	}
+
+	repoCfg, p, err := loadWorktreeConfig(msg.WorktreePath, msg.Package)
+	if err != nil {
+		return opts, err
+	}
+	opts.Package = p.Name
+	opts.Dir = p.Dir
+	opts.Image = repoCfg.Image
+	if err := loadDotenv(&opts, repoCfg); err != nil {
+		return opts, err
+	}
+	opts.Placeholders = spawnPlaceholders(msg, opts)
+	return opts, nil
+}
+
+// loadDotenv sets the session environment from the env files repoCfg's
+// dotenv names, if any, in the worktree.
+func loadDotenv(opts *session.SpawnOptions, repoCfg *repoconfig.Config) error {
+	if repoCfg.Dotenv == nil {
+		return nil
+	}
+	env, err := dotenv.Load(opts.WorktreePath, repoCfg.Dotenv.Files)
+	if err != nil {
+		return err
+	}
+	opts.Env = env
+	opts.EnvExclude = repoCfg.Dotenv.Exclude
+	return nil
+}
+
+// spawnPlaceholders returns the placeholder values for a spawn. Those git
+// can't tell, as outside a repo, are left empty.
+func spawnPlaceholders(msg protocol.ServerMessage, opts session.SpawnOptions) *placeholder.Vars {
+	vars := &placeholder.Vars{
+		WorktreePath: msg.WorktreePath,
+		Package:      opts.Package,
+		Dir:          filepath.Join(msg.WorktreePath, opts.Dir),
+		ProcessID:    msg.ProcessID,
+		WorktreeID:   msg.WorktreeID,
+		Workspace:    workspace,
+	}
+	vars.Branch, _ = worktree.Branch(msg.WorktreePath)
+	if repoPath, err := worktree.MainRepo(msg.WorktreePath); err == nil {
+		vars.RepoPath = repoPath
+		vars.RepoName = filepath.Base(repoPath)
+	}
+	return vars
+}
+
+// loadWorktreeConfig reads the .agenthq.yml checked out in a worktree and
+// resolves pkg, if set, to one of its packages. Without pkg the package is
+// the whole worktree (Dir ".").
+func loadWorktreeConfig(worktreePath, pkg string) (*repoconfig.Config, repoconfig.Package, error) {
+	root := repoconfig.Package{Dir: "."}
+	repoCfg, err := repoconfig.Load(worktreePath)
+	if err != nil {
+		return nil, root, err
+	}
+	if pkg == "" {
+		return repoCfg, root, nil
+	}
+	p, err := repoCfg.FindPackage(worktreePath, pkg)
+	if err != nil {
+		return nil, root, err
+	}
+	return repoCfg, p, nil
+}
+
+// newWorktree is a worktree created by addWorktree.
+type newWorktree struct {
+	path   string
+	branch string
+	// pkg is the monorepo package the worktree was narrowed to, if any,
+	// and dir its directory relative to path.
+	pkg string
+	dir string
+	// setupError describes a failed env file copy or setup command; the
+	// worktree exists but may be incomplete.
+	setupError string
+	// setup are the outcomes of the repo's setup commands
+	setup []protocol.SetupStep
+	// environment says how ready the worktree is; nil if creating it
+	// failed
+	environment *protocol.WorktreeEnvironment
+}
+
+// addWorktree creates a worktree and prepares it as the repo's .agenthq.yml
+// asks: sparse checkout, git hooks, copied env files and setup commands. A non-empty
+// pkg also limits the checkout to that monorepo package.
+func addWorktree(ctx context.Context, repoPath, worktreeID, base, pkg string) (newWorktree, error) {
+	ctx, span := telemetry.StartSpan(ctx, "worktree.create",
+		telemetry.String("agenthq.worktree_id", worktreeID),
+		telemetry.String("agenthq.repo_path", repoPath),
+		telemetry.String("agenthq.package", pkg))
+	start := time.Now()
+	wt, err := prepareWorktree(ctx, repoPath, worktreeID, base, pkg)
+	if err == nil {
+		wt.environment = describeEnvironment(wt)
+	}
+	span.SetAttributes(telemetry.String("agenthq.branch", wt.branch))
+	if err == nil && wt.setupError != "" {
+		span.End(errors.New(wt.setupError))
+	} else {
+		span.End(err)
+	}
+	worktreeDuration.RecordDuration(start, telemetry.String("operation", "create"), telemetry.String("outcome", outcome(err)))
+
+	e := protocol.HistoryEvent{
+		Kind:       protocol.HistoryWorktreeCreated,
+		WorktreeID: worktreeID,
+		Path:       wt.path,
+		Branch:     wt.branch,
+		Package:    wt.pkg,
+		Error:      wt.setupError,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	recordEvent(e)
+	return wt, err
+}
+
+// prepareWorktree does addWorktree's work.
+func prepareWorktree(ctx context.Context, repoPath, worktreeID, base, pkg string) (newWorktree, error) {
+	repoCfg, err := repoconfig.Load(repoPath)
+	if err != nil {
+		return newWorktree{}, err
+	}
+
+	wt := newWorktree{dir: "."}
+	sparsePaths := repoCfg.SparsePaths
+	if pkg != "" {
+		p, err := repoCfg.FindPackage(repoPath, pkg)
+		if err != nil {
+			return newWorktree{}, err
+		}
+		wt.pkg = p.Name
+		wt.dir = p.Dir
+		sparsePaths = append(slices.Clip(sparsePaths), p.Dir)
+	}
+
+	_, span := telemetry.StartSpan(ctx, "git worktree add")
+	wt.path, wt.branch, err = worktree.Add(repoPath, worktreeID, worktree.AddOptions{
+		Base:        base,
+		SparsePaths: sparsePaths,
+	})
+	span.End(err)
+	if err != nil {
+		return newWorktree{}, err
+	}
+	if err := worktree.ExcludeWorktreesDir(repoPath); err != nil {
+		log.Printf("Failed to exclude %s from git in %s: %v", worktree.DirName, repoPath, err)
+	}
+
+	if err := worktree.InstallHooks(wt.path, repoCfg.Hooks); err != nil {
+		log.Printf("Failed to install git hooks in %s: %v", wt.path, err)
+		wt.setupError = fmt.Sprintf("failed to install git hooks: %v", err)
+		return wt, nil
+	}
+
+	if err := worktree.CheckProtected(protectedIn(repoCfg), repoCfg.EnvFiles...); err != nil {
+		log.Printf("Not copying env files into %s: %v", wt.path, err)
+		wt.setupError = fmt.Sprintf("failed to copy env files: %v", err)
+		return wt, nil
+	}
+	if err := worktree.CopyFiles(repoPath, wt.path, repoCfg.EnvFiles); err != nil {
+		log.Printf("Failed to copy env files into %s: %v", wt.path, err)
+		wt.setupError = fmt.Sprintf("failed to copy env files: %v", err)
+		return wt, nil
+	}
+
+	vars := &placeholder.Vars{
+		WorktreePath: wt.path,
+		Branch:       wt.branch,
+		RepoName:     filepath.Base(repoPath),
+		RepoPath:     repoPath,
+		Package:      wt.pkg,
+		Dir:          filepath.Join(wt.path, wt.dir),
+		WorktreeID:   worktreeID,
+		Workspace:    workspace,
+	}
+	for _, command := range repoCfg.Setup {
+		command = vars.ExpandShell(command)
+		if wt.setupError != "" {
+			wt.setup = append(wt.setup, protocol.SetupStep{Command: command, Status: protocol.StepSkipped})
+			continue
+		}
+		log.Printf("Running setup in %s: %s", wt.path, command)
+		_, span := telemetry.StartSpan(ctx, "worktree.setup", telemetry.String("agenthq.command", command))
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Dir = wt.path
+		start := time.Now()
+		output, err := cmd.CombinedOutput()
+		span.End(err)
+		step := protocol.SetupStep{Command: command, Status: protocol.StepPassed, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			log.Printf("Setup command %q failed in %s: %v", command, wt.path, err)
+			wt.setupError = fmt.Sprintf("setup command %q: %v\n%s", command, err, output)
+			step.Status = protocol.StepFailed
+			step.ExitCode = -1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				step.ExitCode = exitErr.ExitCode()
+			}
+			step.Output = string(output[max(0, len(output)-setupOutputTail):])
+		}
+		wt.setup = append(wt.setup, step)
+	}
+
+	return wt, nil
+}
+
+// setupOutputTail is how much of a failed setup command's output
+// worktree-ready carries.
+const setupOutputTail = 8 * 1024
+
+// describeEnvironment says how ready a new worktree is for an agent to run
+// its tests in.
+func describeEnvironment(wt newWorktree) *protocol.WorktreeEnvironment {
+	env := &protocol.WorktreeEnvironment{
+		Setup:        wt.setup,
+		Toolchains:   worktree.Toolchains(wt.path, wt.dir),
+		Dependencies: worktree.Dependencies(wt.path, wt.dir),
+		Ready:        wt.setupError == "",
+	}
+	env.BaseCommit, _ = worktree.Head(wt.path)
+	for _, dep := range env.Dependencies {
+		env.Ready = env.Ready && dep.Installed
+	}
+	return env
+}
+
+// errorCode returns the protocol error code for err, if it has one.
+func errorCode(err error) string {
+	if errors.Is(err, worktree.ErrInsufficientDisk) {
+		return protocol.ErrorCodeInsufficientDisk
+	}
+	if errors.Is(err, session.ErrWorktreeInUse) {
+		return protocol.ErrorCodeWorktreeInUse
+	}
+	return ""
+}
+
+// sessionExitTimeout is how long removing a worktree waits for the
+// sessions in it that it killed to exit.
+const sessionExitTimeout = 5 * time.Second
+
+// reportWorktreeRemoval removes a worktree for remove-worktree and tells
+// the server how that went, with worktree-removed or worktree-error.
+func reportWorktreeRemoval(ctx context.Context, wsClient link, mgr *session.Manager, msg protocol.ServerMessage) {
+	worktreeID := cmp.Or(msg.WorktreeID, filepath.Base(msg.WorktreePath))
+	removal, err := removeWorktree(ctx, mgr, msg.WorktreePath, msg.Force)
+	if err != nil {
+		wsClient.Send(protocol.DaemonMessage{
+			Type:       protocol.MsgTypeWorktreeError,
+			WorktreeID: worktreeID,
+			Error:      err.Error(),
+			ErrorCode:  errorCode(err),
+			Removal:    &removal,
+		})
+		return
+	}
+	wsClient.Send(protocol.DaemonMessage{
+		Type:       protocol.MsgTypeWorktreeRemoved,
+		WorktreeID: worktreeID,
+		Path:       msg.WorktreePath,
+		Reason:     removedRequested,
+		Removal:    &removal,
+	})
+}
+
+// removeWorktree removes a git worktree. Sessions running in it are killed
+// first with force; otherwise they make it fail with ErrWorktreeInUse.
+func removeWorktree(ctx context.Context, mgr *session.Manager, worktreePath string, force bool) (protocol.WorktreeRemoval, error) {
+	if running := mgr.SessionsIn(worktreePath); len(running) > 0 && !force {
+		err := worktreeInUse(worktreePath, running)
+		log.Printf("Refusing to remove worktree: %v", err)
+		return protocol.WorktreeRemoval{}, err
+	}
+
+	_, span := telemetry.StartSpan(ctx, "worktree.remove", telemetry.String("agenthq.path", worktreePath))
+	start := time.Now()
+	killed := killSessionsIn(mgr, worktreePath)
+	removal, err := worktree.Remove(worktreePath)
+	removal.KilledSessions = killed
+	span.End(err)
+	worktreeDuration.RecordDuration(start, telemetry.String("operation", "remove"), telemetry.String("outcome", outcome(err)))
+	if err != nil {
+		log.Printf("Failed to remove worktree: %v", err)
+		return removal, err
+	}
+
+	log.Printf("Removed worktree at %s (%s)", worktreePath, removal.Steps[len(removal.Steps)-1].Step)
+	recordWorktreeRemoved(worktreePath, removedRequested)
+	return removal, nil
+}
+
+// worktreeInUse is the error for removing a worktree sessions are running
+// in without force.
+func worktreeInUse(worktreePath string, running []string) error {
+	return fmt.Errorf("%w: sessions %s are running in %s; remove it with force to kill them", session.ErrWorktreeInUse, strings.Join(running, ", "), worktreePath)
+}
+
+// killSessionsIn kills the sessions running in a worktree, so that nothing
+// writes to it while it is removed, and waits up to sessionExitTimeout for
+// them to exit. It returns the sessions it killed.
+func killSessionsIn(mgr *session.Manager, worktreePath string) []string {
+	ids := mgr.SessionsIn(worktreePath)
+	for _, id := range ids {
+		log.Printf("Killing process %s to remove worktree %s", id, worktreePath)
+		if err := mgr.Kill(id); err != nil {
+			log.Printf("Failed to kill process %s: %v", id, err)
+		}
+	}
+
+	deadline := time.Now().Add(sessionExitTimeout)
+	for _, id := range ids {
+		for time.Now().Before(deadline) {
+			if _, ok := mgr.Info(id); !ok {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return ids
+}
+
+// ptyInput returns the bytes a pty-input writes: its data, then its paste,
+// then its keys. While the session's program has bracketed paste on,
+// pastes are wrapped in its markers, and so is data that looks pasted, so
+// that newlines in a long prompt don't submit it early.
+func ptyInput(mgr *session.Manager, msg protocol.ServerMessage) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	bracketed, _ := mgr.BracketedPaste(msg.ProcessID)
+	if bracketed {
+		data = keys.AsPaste(data)
+	}
+	switch {
+	case msg.Paste == "":
+	case bracketed:
+		data = append(data, keys.Paste(msg.Paste)...)
+	default:
+		data = append(data, msg.Paste...)
+	}
+	typed, err := keys.Encode(msg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, typed...), nil
+}
+
+// updateInputLease acquires or releases a viewer's input lease on a session
+// and reports the lease's holder.
+func updateInputLease(wsClient link, mgr *session.Manager, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeInputLease,
+		ProcessID: msg.ProcessID,
+	}
+
+	var err error
+	if msg.Type == protocol.MsgTypeAcquireInput {
+		reply.Holder, err = mgr.AcquireInput(msg.ProcessID, msg.SourceUser)
+	} else if err = mgr.ReleaseInput(msg.ProcessID, msg.SourceUser); errors.Is(err, session.ErrInputLeased) {
+		reply.Holder, _ = mgr.InputLeaseHolder(msg.ProcessID)
+	}
+
+	if err != nil {
+		log.Printf("Failed to %s for %s: %v", msg.Type, msg.ProcessID, err)
+		reply.Error = err.Error()
+	}
+	wsClient.Send(reply)
+}
+
+// pasteImage saves an image sent by the server into the session's worktree
+// and types its path into the session.
+func pasteImage(wsClient link, mgr *session.Manager, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeImagePasted,
+		ProcessID: msg.ProcessID,
+	}
+
+	err := func() error {
+		info, ok := mgr.Info(msg.ProcessID)
+		if !ok {
+			return fmt.Errorf("process %s not found", msg.ProcessID)
+		}
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			return fmt.Errorf("invalid base64: %w", err)
+		}
+		ext, ok := imageExtensions[http.DetectContentType(data)]
+		if !ok {
+			return fmt.Errorf("not a supported image (%s)", http.DetectContentType(data))
+		}
+
+		name := fmt.Sprintf("images/paste-%d%s", time.Now().UnixMilli(), ext)
+		if err := worktree.CheckProtected(worktreeProtected(info.WorktreePath), path.Join(worktree.StageDir, name)); err != nil {
+			return err
+		}
+		staged, err := worktree.Stage(info.WorktreePath, []worktree.StagedFile{{Name: name, Data: data}})
+		if err != nil {
+			return err
+		}
+		reply.Path = filepath.Join(info.WorktreePath, filepath.FromSlash(staged[0]))
+		return mgr.PasteImage(msg.ProcessID, msg.SourceUser, reply.Path)
+	}()
+
+	if err != nil {
+		log.Printf("Failed to paste image into %s: %v", msg.ProcessID, err)
+		reply.Error = err.Error()
+	}
+	wsClient.Send(reply)
+}
+
+// imageExtensions maps the image types agents accept to file extensions.
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// stageFiles writes files sent by the server into a worktree's staging
+// directory and reports their paths.
+func stageFiles(wsClient link, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:  protocol.MsgTypeFilesStaged,
+		RunID: msg.RunID,
+		Path:  msg.WorktreePath,
+	}
+
+	files := make([]worktree.StagedFile, 0, len(msg.Files))
+	var err error
+	for _, f := range msg.Files {
+		data, decodeErr := base64.StdEncoding.DecodeString(f.Data)
+		if decodeErr != nil {
+			err = fmt.Errorf("%s: invalid base64: %w", f.Name, decodeErr)
+			break
+		}
+		files = append(files, worktree.StagedFile{Name: f.Name, Data: data})
+	}
+
+	if _, statErr := os.Stat(msg.WorktreePath); err == nil && statErr != nil {
+		err = fmt.Errorf("worktree: %w", statErr)
+	}
+	if err == nil {
+		protected := worktreeProtected(msg.WorktreePath)
+		for _, f := range files {
+			if err = worktree.CheckProtected(protected, path.Join(worktree.StageDir, f.Name)); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		reply.Files, err = worktree.Stage(msg.WorktreePath, files)
+	}
+
+	if err != nil {
+		log.Printf("Failed to stage files in %s: %v", msg.WorktreePath, err)
+		reply.Error = err.Error()
+	} else {
+		log.Printf("Staged %d files in %s", len(reply.Files), msg.WorktreePath)
+	}
+	wsClient.Send(reply)
+}
+
+// repoConfigSummary summarizes a repo's .agenthq.yml and packages for
+// RepoInfo, or returns nil if it has neither.
+func repoConfigSummary(repoPath string) *protocol.RepoConfig {
+	repoCfg, err := repoconfig.Load(repoPath)
+	if err != nil {
+		log.Printf("Invalid repo config in %s: %v", repoPath, err)
+		return &protocol.RepoConfig{Error: err.Error()}
+	}
+	summary := repoCfg.Summary(repoPath)
+	if reflect.ValueOf(*summary).IsZero() {
+		return nil
+	}
+	return summary
+}
+
+// configuredServers returns the servers to connect to: those in the config
+// file, or else the one in the environment, with stored tokens for those
+// given none.
+func configuredServers(cfg *config.Config) []config.Server {
+	return withCredentials(declaredServers(cfg))
+}
+
+// declaredServers returns the servers in cfg or the environment, with only
+// the tokens given there.
+func declaredServers(cfg *config.Config) []config.Server {
+	if len(cfg.Servers) > 0 {
+		return slices.Clone(cfg.Servers)
+	}
+	// Get server URL from environment; a comma-separated list adds
+	// failover URLs after the primary
+	serverURLs := strings.Split(os.Getenv("AGENTHQ_SERVER_URL"), ",")
+	if serverURLs[0] == "" {
+		serverURLs = []string{"ws://localhost:3000/ws/daemon"}
+	}
+	return []config.Server{{
+		URL:          strings.TrimSpace(serverURLs[0]),
+		FailoverURLs: trimAll(serverURLs[1:]),
+		// Get auth token for remote connections
+		Token: os.Getenv("AGENTHQ_AUTH_TOKEN"),
+		// Get environment ID from environment variable or generate one
+		EnvID:         os.Getenv("AGENTHQ_ENV_ID"),
+		SigningSecret: os.Getenv("AGENTHQ_SIGNING_SECRET"),
+	}}
+}
+
+// scanWorkspace scans the workspace directory for git repositories
+func scanWorkspace() []protocol.RepoInfo {
+	var repos []protocol.RepoInfo
+
+	if workspace == "" {
+		log.Printf("No workspace configured, returning empty repos list")
+		return repos
+	}
+
+	for _, repoPath := range workspaceRepos() {
+		repos = append(repos, repoInfo(repoPath))
+	}
+
+	log.Printf("Found %d repositories in workspace", len(repos))
+	return repos
+}
+
+// repoInfo describes a repo for repos-list, repo-added and repo-fetched.
+func repoInfo(repoPath string) protocol.RepoInfo {
+	info := protocol.RepoInfo{
+		Name:          filepath.Base(repoPath),
+		Path:          repoPath,
+		DefaultBranch: getDefaultBranch(repoPath),
+		Config:        repoConfigSummary(repoPath),
+	}
+	if s, ok := repoSync(repoPath); ok {
+		info.Sync = &s
+	}
+	return info
+}
+
+// workspaceRepos returns the paths of the git repositories in the workspace.
+func workspaceRepos() []string {
+	return reposIn(workspace)
+}
+
+// reposIn returns the git repositories directly inside dir.
+func reposIn(dir string) []string {
+	if dir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to read workspace directory: %v", err)
+		return nil
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		repoPath := filepath.Join(dir, entry.Name())
+		gitPath := filepath.Join(repoPath, ".git")
+
+		// Check if it's a git repo
+		if info, err := os.Stat(gitPath); err == nil && info.IsDir() {
+			paths = append(paths, repoPath)
+		}
+	}
+	return paths
+}
+
+// getDefaultBranch reads the default branch from .git/HEAD
+func getDefaultBranch(repoPath string) string {
+	headPath := filepath.Join(repoPath, ".git", "HEAD")
+	content, err := os.ReadFile(headPath)
+	if err != nil {
+		return "main"
+	}
+
+	line := strings.TrimSpace(string(content))
+	if strings.HasPrefix(line, "ref: refs/heads/") {
+		return strings.TrimPrefix(line, "ref: refs/heads/")
+	}
+
+	return "main"
+}
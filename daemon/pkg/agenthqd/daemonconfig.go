@@ -0,0 +1,165 @@
+package agenthqd
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"slices"
+
+	"github.com/agenthq/daemon/internal/budget"
+	"github.com/agenthq/daemon/internal/client"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/redact"
+	"github.com/agenthq/daemon/internal/scope"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/telemetry"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// daemonConfig returns the running daemon's effective configuration,
+// without the connection it's asked over; nil when the daemon isn't
+// running.
+var daemonConfig func() protocol.DaemonConfig
+
+// sendDaemonConfig sends the daemon's effective configuration, and how it
+// talks to peer, whose connection holds scopes.
+func sendDaemonConfig(wsClient, peer link, scopes scope.Scopes) {
+	if daemonConfig == nil {
+		return
+	}
+	cfg := daemonConfig()
+	cfg.Connection.Scopes = scopes
+	for _, conn := range connections {
+		if link(conn.current()) != peer {
+			continue
+		}
+		conn.mu.Lock()
+		cfg.Connection.Failover = conn.urlIndex > 0
+		cfg.Connection.HeartbeatAcks = conn.acks
+		cfg.Connection.SafeMode = !conn.safeSince.IsZero()
+		conn.mu.Unlock()
+		cfg.Connection.Server = conn.label()
+		cfg.Connection.Namespace = conn.namespace
+		cfg.Connection.Signed = conn.verifier != nil
+	}
+	wsClient.Send(protocol.DaemonMessage{
+		Type:         protocol.MsgTypeDaemonConfig,
+		DaemonConfig: &cfg,
+	})
+}
+
+// effectiveConfig returns the configuration the daemon runs with: its
+// config file's settings in effect, secrets masked, and what they and the
+// daemon's flags resolve to.
+func (d *Daemon) effectiveConfig() protocol.DaemonConfig {
+	settingsMu.RLock()
+	cfg := d.cfg
+	pending := slices.Clone(pendingRestart)
+	after := safeModeAfter
+	sum := summarizer
+	settingsMu.RUnlock()
+
+	settings, err := redactedSettings(cfg)
+	if err != nil {
+		log.Printf("Failed to describe config: %v", err)
+	}
+	maxMessage := cmp.Or(cfg.MaxMessageSize, protocol.DefaultMaxMessageSize)
+	if maxMessage < 0 {
+		maxMessage = 0
+	}
+	input := inputLimits(cfg.InputLimits)
+
+	features := []string{}
+	feature := func(name string, on bool) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	feature(protocol.FeatureLocal, d.opts.Local)
+	feature(protocol.FeatureAPI, d.opts.API)
+	feature(protocol.FeatureDiscover, d.opts.Discover)
+	feature(protocol.FeatureDryRun, dryRun)
+	feature(protocol.FeatureRecordProtocol, d.opts.RecordProtocol != "")
+	feature(protocol.FeatureHistory, events != nil)
+	feature(protocol.FeatureTelemetry, telemetry.FromEnv(telemetry.Config{Endpoint: cfg.Telemetry.Endpoint}).Endpoint != "")
+	feature(protocol.FeatureWatchdog, !cfg.Watchdog.Disabled)
+	feature(protocol.FeatureMonitor, !cfg.Monitor.Disabled)
+	feature(protocol.FeatureSafeMode, after > 0)
+	feature(protocol.FeatureAdaptiveOutput, cfg.AdaptiveOutput.Enabled)
+	feature(protocol.FeatureRedaction, cfg.Redact.Enabled())
+	feature(protocol.FeatureLogShipping, cfg.LogShipping.Enabled)
+	feature(protocol.FeatureSummarizer, sum.Command != "")
+	feature(protocol.FeatureBudget, budget.Enabled(cfg.Budget))
+	feature(protocol.FeatureSharedShellHistory, cfg.ShellHistory.Shared)
+	ops := clipboardOps()
+	feature(protocol.FeatureClipboardGet, slices.Contains(ops, "get"))
+	feature(protocol.FeatureClipboardSet, slices.Contains(ops, "set"))
+	feature(protocol.FeaturePlugins, len(cfg.Plugins) > 0)
+
+	capabilities := slices.Clone(client.Capabilities)
+	for _, agent := range plugins.Launchers() {
+		if !slices.Contains(capabilities, string(agent)) {
+			capabilities = append(capabilities, string(agent))
+		}
+	}
+
+	return protocol.DaemonConfig{
+		Version:        version,
+		Workspace:      workspace,
+		ConfigPath:     d.opts.ConfigPath,
+		Settings:       settings,
+		Pending:        pending,
+		Backends:       d.mgr.Backends(),
+		DefaultBackend: cmp.Or(cfg.SessionBackend, session.BackendPTY),
+		Capabilities:   capabilities,
+		Limits: protocol.DaemonLimits{
+			MaxSessions:          cfg.Scheduler.MaxSessions,
+			MaxMessageSize:       maxMessage,
+			InputMaxMessage:      input.MaxMessage,
+			InputRate:            input.Rate,
+			InputBurst:           input.Burst,
+			Budget:               cfg.Budget,
+			SafeModeAfterMs:      after.Milliseconds(),
+			DrainTimeoutMs:       cmp.Or(cfg.Drain.TimeoutDuration(), defaultDrainTimeout).Milliseconds(),
+			WorktreeDiskMarginMB: max(worktree.DiskMargin, 0) >> 20,
+		},
+		Features: features,
+	}
+}
+
+// redactedSettings returns cfg as JSON with secrets masked: values with
+// names that suggest secrets, such as tokens and signing secrets, every
+// header, and credentials recognizable by their format anywhere else.
+func redactedSettings(cfg *Config) (json.RawMessage, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return json.RawMessage("{}"), err
+	}
+	var settings any
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return json.RawMessage("{}"), err
+	}
+	return json.Marshal(redactSetting("", settings))
+}
+
+// redactSetting masks the secrets in v, the decoded value of the setting
+// called name.
+func redactSetting(name string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if s, ok := value.(string); ok && name == "headers" && s != "" {
+				v[key] = redact.Mask
+				continue
+			}
+			v[key] = redactSetting(key, value)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactSetting(name, value)
+		}
+	case string:
+		return redact.Value(name, v)
+	}
+	return v
+}
@@ -0,0 +1,81 @@
+package agenthqd
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/mdns"
+)
+
+// discoverService is the DNS-SD service type servers advertise.
+const discoverService = "_agenthq._tcp"
+
+const (
+	// discoverTimeout is how long each discovery round waits for answers
+	discoverTimeout = 3 * time.Second
+	// discoverRetry is the pause between rounds that found no server
+	discoverRetry = 5 * time.Second
+)
+
+// rediscover browses the local network until a server answers, and makes
+// it the connection's server. It returns false if stop closed first.
+func (c *connection) rediscover(stop <-chan struct{}) bool {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		services, err := mdns.Browse(ctx, discoverService)
+		cancel()
+
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		if err != nil {
+			log.Printf("Server discovery failed: %v", err)
+		}
+		if len(services) > 0 {
+			for _, s := range services[1:] {
+				log.Printf("Also discovered %s at %s; using the first server that answered", s.Instance, s.Addr())
+			}
+			serverURL := serviceURL(services[0])
+			log.Printf("Discovered %s at %s", services[0].Instance, serverURL)
+			c.mu.Lock()
+			c.server.URL = serverURL
+			c.failures = 0
+			c.mu.Unlock()
+			return true
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(discoverRetry):
+		}
+	}
+}
+
+// serviceURL returns the URL of a discovered server. Its TXT record may
+// give the scheme ("ws", the default, or "wss") and the path (default
+// /ws/daemon). wss connects by host name, so the certificate can match.
+func serviceURL(s mdns.Service) string {
+	u := url.URL{
+		Scheme: cmp.Or(s.Text["scheme"], "ws"),
+		Host:   s.Addr(),
+		Path:   cmp.Or(s.Text["path"], "/ws/daemon"),
+	}
+	if u.Scheme == "wss" && s.Host != "" {
+		u.Host = strings.TrimSuffix(s.Host, ".") + ":" + u.Port()
+	}
+	return u.String()
+}
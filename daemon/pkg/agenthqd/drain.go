@@ -0,0 +1,141 @@
+package agenthqd
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/crash"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// defaultDrainTimeout is how long a drain waits for sessions by default.
+const defaultDrainTimeout = 10 * time.Minute
+
+// drainCheckInterval is how often a drain checks for sessions left.
+const drainCheckInterval = time.Second
+
+// drainRefuses are the commands refused while draining: those that start
+// new work, or change worktrees that work may be going on in.
+var drainRefuses = map[string]bool{
+	protocol.MsgTypeSpawn:          true,
+	protocol.MsgTypeCreateWorktree: true,
+	protocol.MsgTypeRemoveWorktree: true,
+	protocol.MsgTypeCompareRun:     true,
+}
+
+var (
+	drainMu sync.Mutex
+	// drainDeadline is when a drain in progress gives up waiting for
+	// sessions; zero when not draining
+	drainDeadline time.Time
+)
+
+// Drain prepares the daemon for shutdown, e.g. before host maintenance:
+// spawns and worktree commands are refused from then on, as are spawns
+// still waiting for a slot, and the servers are told with daemon-draining.
+// It returns Drained, which is closed once no sessions are left, or
+// drain.timeout (default 10m) has passed, when the daemon can be stopped.
+// Drain doesn't block and doesn't stop the daemon; calling it again, or
+// POST /api/drain, only returns the same channel.
+func (d *Daemon) Drain() <-chan struct{} {
+	d.drainOnce.Do(func() {
+		if d.mgr == nil {
+			// Not started
+			close(d.drained)
+			return
+		}
+
+		settingsMu.RLock()
+		timeout := cmp.Or(d.cfg.Drain.TimeoutDuration(), defaultDrainTimeout)
+		settingsMu.RUnlock()
+		deadline := time.Now().Add(timeout)
+		drainMu.Lock()
+		drainDeadline = deadline
+		drainMu.Unlock()
+
+		status := drainStatus(d.mgr)
+		log.Printf("Draining: refusing spawns and worktree commands; waiting up to %s for %d session(s) to finish", timeout, status.Sessions)
+		broadcast(protocol.DaemonMessage{Type: protocol.MsgTypeDaemonDraining, Draining: status})
+		spawns.refuseQueued(drainingError(protocol.MsgTypeSpawn))
+		crash.Go("drain", "", func() { d.waitForSessions(deadline) })
+	})
+	return d.drained
+}
+
+// Drained is closed once a drain is done, whether Drain or POST /api/drain
+// started it. The agenthq-daemon binary then stops.
+func (d *Daemon) Drained() <-chan struct{} {
+	return d.drained
+}
+
+// waitForSessions closes d.drained once no sessions are left, deadline
+// passes or the daemon stops.
+func (d *Daemon) waitForSessions(deadline time.Time) {
+	defer close(d.drained)
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		left := len(d.mgr.List())
+		if left == 0 {
+			log.Printf("Drained: no sessions left")
+			return
+		}
+		if !time.Now().Before(deadline) {
+			log.Printf("Drain timed out with %d session(s) still running", left)
+			return
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainStatus returns how far along a drain is, or nil when not draining.
+func drainStatus(mgr *session.Manager) *protocol.Draining {
+	drainMu.Lock()
+	deadline := drainDeadline
+	drainMu.Unlock()
+	if deadline.IsZero() {
+		return nil
+	}
+	return &protocol.Draining{Deadline: deadline.UnixMilli(), Sessions: len(mgr.List())}
+}
+
+// drainingError returns why a message of type msgType is refused, if the
+// daemon is draining and refuses it.
+func drainingError(msgType string) error {
+	if !drainRefuses[msgType] {
+		return nil
+	}
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if drainDeadline.IsZero() {
+		return nil
+	}
+	return fmt.Errorf("the daemon is draining before it shuts down")
+}
+
+// refusedWhileDraining replies with a draining error if msg is a command
+// refused while draining and the daemon is draining. It reports whether
+// msg was refused.
+func refusedWhileDraining(wsClient link, msg protocol.ServerMessage) bool {
+	err := drainingError(msg.Type)
+	if err == nil {
+		return false
+	}
+	log.Printf("Refusing %s: %v", msg.Type, err)
+	wsClient.Send(protocol.DaemonMessage{
+		Type:      protocol.MsgTypeError,
+		ProcessID: msg.ProcessID,
+		Error:     err.Error(),
+		ErrorCode: protocol.ErrorCodeDraining,
+	})
+	return true
+}
@@ -0,0 +1,150 @@
+package agenthqd
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/redact"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// dryRun makes every spawn, kill, worktree removal and compare run report
+// what it would do instead of doing it (--dry-run), as the dryRun field
+// does for one message.
+var dryRun bool
+
+// dryRunTypes are the messages that can be dry-run.
+var dryRunTypes = map[string]bool{
+	protocol.MsgTypeSpawn:          true,
+	protocol.MsgTypeKill:           true,
+	protocol.MsgTypeRemoveWorktree: true,
+	protocol.MsgTypeCompareRun:     true,
+}
+
+// handleDryRun replies to msg with a dry-run report if it is to be dry-run,
+// returning whether it was. Its request is acked with the error the
+// message would have failed with, if any.
+func handleDryRun(wsClient link, mgr *session.Manager, msg protocol.ServerMessage) bool {
+	if !dryRunTypes[msg.Type] || !dryRun && !msg.DryRun {
+		return false
+	}
+
+	reply := protocol.DaemonMessage{Type: protocol.MsgTypeDryRun}
+	var err error
+	switch msg.Type {
+	case protocol.MsgTypeSpawn:
+		reply.ProcessID = msg.ProcessID
+		reply.WorktreeID = msg.WorktreeID
+		reply.Plan, err = planSpawn(mgr, msg)
+	case protocol.MsgTypeKill:
+		reply.ProcessID = msg.ProcessID
+		reply.Plan, err = planKill(mgr, msg.ProcessID)
+	case protocol.MsgTypeRemoveWorktree:
+		reply.WorktreeID = msg.WorktreeID
+		reply.Path = msg.WorktreePath
+		reply.Plan, err = planRemoveWorktree(mgr, msg.WorktreePath, msg.Force)
+	case protocol.MsgTypeCompareRun:
+		reply.RunID = msg.RunID
+		reply.Plan, err = planCompareRun(msg)
+	}
+
+	if err != nil {
+		log.Printf("Dry run of %s: would fail: %v", msg.Type, err)
+		reply.Error = err.Error()
+	} else {
+		log.Printf("Dry run of %s: %s", msg.Type, reply.Plan.Summary)
+	}
+	wsClient.Send(reply)
+	return true
+}
+
+// planSpawn resolves a spawn as it would run.
+func planSpawn(mgr *session.Manager, msg protocol.ServerMessage) (*protocol.DryRunPlan, error) {
+	// A dry run doesn't wait for a resize
+	if msg.Cols <= 0 || msg.Rows <= 0 {
+		msg.Cols, msg.Rows = defaultCols, defaultRows
+	}
+	opts, err := spawnOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := mgr.PlanSpawn(opts)
+	if err != nil {
+		return nil, err
+	}
+	t := plan.Terminal
+	return &protocol.DryRunPlan{
+		Action:  protocol.MsgTypeSpawn,
+		Summary: fmt.Sprintf("would start %s as process %s on the %s backend in %s", t.Agent, t.ProcessID, plan.Backend, t.Dir),
+		Backend: plan.Backend,
+		Command: t.Command,
+		Args:    t.Args,
+		Cwd:     t.Dir,
+		Env:     redact.Env(t.Env),
+	}, nil
+}
+
+// planKill describes the session a kill would end.
+func planKill(mgr *session.Manager, processID string) (*protocol.DryRunPlan, error) {
+	d, err := mgr.Inspect(processID)
+	if err != nil {
+		return nil, err
+	}
+	summary := fmt.Sprintf("would kill process %s (%s on the %s backend", processID, d.Agent, d.Backend)
+	if d.PID > 0 {
+		summary += fmt.Sprintf(", pid %d", d.PID)
+	}
+	return &protocol.DryRunPlan{Action: protocol.MsgTypeKill, Summary: summary + ")"}, nil
+}
+
+// planRemoveWorktree describes what removing a worktree would discard.
+func planRemoveWorktree(mgr *session.Manager, path string, force bool) (*protocol.DryRunPlan, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty worktree path")
+	}
+	dirty, err := worktree.Dirty(path)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := "would remove worktree " + path
+	if dirty {
+		summary += ", discarding its uncommitted changes"
+	}
+	if running := mgr.SessionsIn(path); len(running) > 0 {
+		if !force {
+			return nil, worktreeInUse(path, running)
+		}
+		summary += fmt.Sprintf(", killing running sessions %s", strings.Join(running, ", "))
+	}
+	return &protocol.DryRunPlan{Action: protocol.MsgTypeRemoveWorktree, Summary: summary}, nil
+}
+
+// planCompareRun describes the worktrees and sessions a compare run would
+// create.
+func planCompareRun(msg protocol.ServerMessage) (*protocol.DryRunPlan, error) {
+	if msg.RunID == "" || msg.RepoPath == "" || msg.Task == "" || len(msg.Agents) == 0 {
+		return nil, fmt.Errorf("runId, repoPath, task and agents are required")
+	}
+	base, err := worktree.ResolveCommit(msg.RepoPath, cmp.Or(msg.Base, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+
+	contenders := make([]string, len(msg.Agents))
+	for i, c := range msg.Agents {
+		contenders[i] = string(c.Agent)
+		if c.Profile != "" {
+			contenders[i] = c.Profile
+		}
+	}
+	return &protocol.DryRunPlan{
+		Action: protocol.MsgTypeCompareRun,
+		Summary: fmt.Sprintf("would create %d worktrees of %s at %.12s and run %s in them",
+			len(msg.Agents), msg.RepoPath, base, strings.Join(contenders, ", ")),
+	}, nil
+}
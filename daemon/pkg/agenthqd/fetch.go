@@ -0,0 +1,91 @@
+package agenthqd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/telemetry"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+var (
+	repoSyncsMu sync.Mutex
+	// repoSyncs is how each fetched repo's default branch compared to its
+	// upstream after its last fetch, by repo path
+	repoSyncs = make(map[string]protocol.RepoSync)
+)
+
+// repoSync returns what the last fetch of a repo found, if it was fetched.
+func repoSync(repoPath string) (protocol.RepoSync, bool) {
+	repoSyncsMu.Lock()
+	defer repoSyncsMu.Unlock()
+	s, ok := repoSyncs[repoPath]
+	return s, ok
+}
+
+// fetchRepo fetches a repo, fast-forwarding its default branch where it
+// can, and returns it as repos-list describes it, with what the fetch
+// found.
+func fetchRepo(ctx context.Context, repoPath string) (protocol.RepoInfo, error) {
+	if repoPath == "" {
+		return protocol.RepoInfo{}, fmt.Errorf("repoPath is required")
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, ".git")); err != nil {
+		return protocol.RepoInfo{Name: filepath.Base(repoPath), Path: repoPath}, fmt.Errorf("%s is not a git repo", repoPath)
+	}
+	_, span := telemetry.StartSpan(ctx, "repo.fetch", telemetry.String("agenthq.repo_path", repoPath))
+	status, err := worktree.Fetch(repoPath, getDefaultBranch(repoPath))
+	span.End(err)
+	if err != nil {
+		log.Printf("Failed to fetch repo %s: %v", repoPath, err)
+		status.Error = err.Error()
+	} else if status.Upstream != "" {
+		log.Printf("Fetched repo %s: %s is %d ahead of and %d behind %s", repoPath, status.Branch, status.Ahead, status.Behind, status.Upstream)
+	} else {
+		log.Printf("Fetched repo %s: %s has no upstream", repoPath, status.Branch)
+	}
+
+	repoSyncsMu.Lock()
+	repoSyncs[repoPath] = status
+	repoSyncsMu.Unlock()
+	return repoInfo(repoPath), err
+}
+
+// repoFetched is the repo-fetched message for a fetch.
+func repoFetched(info protocol.RepoInfo, err error) protocol.DaemonMessage {
+	msg := protocol.DaemonMessage{Type: protocol.MsgTypeRepoFetched, Repo: &info}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	return msg
+}
+
+// fetchRepos fetches the repos cfg names, or all of the workspace's, now
+// and every cfg.Interval until stop is closed, and tells the servers what
+// each fetch found.
+func fetchRepos(cfg config.Fetch, stop <-chan struct{}) {
+	ticker := time.NewTicker(cfg.IntervalDuration())
+	defer ticker.Stop()
+
+	for {
+		for _, repoPath := range workspaceRepos() {
+			if len(cfg.Repos) > 0 && !slices.Contains(cfg.Repos, filepath.Base(repoPath)) {
+				continue
+			}
+			broadcast(repoFetched(fetchRepo(context.Background(), repoPath)))
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
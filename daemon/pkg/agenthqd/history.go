@@ -0,0 +1,216 @@
+package agenthqd
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/history"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/transcript"
+)
+
+// events is the daemon's history; nil when disabled.
+var events *history.Store
+
+// maxNoteLength bounds the note of an annotate-session.
+const maxNoteLength = 1024
+
+// recordSessionStarted records a session the daemon spawned.
+func recordSessionStarted(mgr *session.Manager, worktreeID string, opts session.SpawnOptions) {
+	e := protocol.HistoryEvent{
+		Kind:       protocol.HistorySessionStarted,
+		ProcessID:  opts.ProcessID,
+		WorktreeID: worktreeID,
+		Agent:      opts.Agent,
+		Profile:    opts.Profile,
+		Model:      opts.Model,
+		Path:       opts.WorktreePath,
+		Package:    opts.Package,
+	}
+	// The profile may have picked the agent
+	if info, ok := mgr.Info(opts.ProcessID); ok {
+		e.Agent = info.Agent
+	}
+	recordEvent(e)
+}
+
+// recordSessionExited records how a session ended and what it used. It is
+// called from onExit, while the session's info is still available.
+func recordSessionExited(mgr *session.Manager, processID string, exit session.ExitInfo, touched []string) {
+	e := protocol.HistoryEvent{
+		Kind:             protocol.HistorySessionExited,
+		ProcessID:        processID,
+		ExitCode:         exit.Code,
+		ExitReason:       exit.Reason,
+		Signal:           exit.Signal,
+		TouchedProtected: touched,
+	}
+	if info, ok := mgr.Info(processID); ok {
+		e.Agent = info.Agent
+		e.Path = info.WorktreePath
+		e.Package = info.Package
+		e.AgentSessionID = info.AgentSessionID
+		e.DurationMs = time.Since(info.Started).Milliseconds()
+		e.InputBytes = info.InputBytes
+		e.OutputBytes = info.OutputBytes
+	}
+	recordEvent(e)
+}
+
+// recordAgentSession records the agent's own conversation id for a
+// session, with its transcript file if it can be found yet.
+func recordAgentSession(mgr *session.Manager, processID, agentSessionID string) {
+	e := protocol.HistoryEvent{
+		Kind:           protocol.HistoryAgentSession,
+		ProcessID:      processID,
+		AgentSessionID: agentSessionID,
+	}
+	if ref, ok := mgr.AgentSession(processID); ok {
+		e.Agent = ref.Agent
+		e.Path = ref.WorktreePath
+		if path, err := transcript.Locate(ref.Agent, ref.WorktreePath, agentSessionID); err == nil {
+			e.Transcript = path
+		}
+	}
+	recordEvent(e)
+}
+
+// recordWorktreeRemoved records a worktree's removal and why, if it wasn't
+// asked for.
+func recordWorktreeRemoved(path, reason string) {
+	recordEvent(protocol.HistoryEvent{
+		Kind:       protocol.HistoryWorktreeRemoved,
+		WorktreeID: filepath.Base(path),
+		Path:       path,
+		Reason:     reason,
+	})
+}
+
+// annotateSession records an annotate-session's note as a marker in the
+// session's history, at the session's output so far. A session that has
+// exited can still be annotated, if its spawn was recorded.
+func annotateSession(mgr *session.Manager, msg protocol.ServerMessage) error {
+	note := strings.TrimSpace(msg.Note)
+	switch {
+	case note == "":
+		return errors.New("note is required")
+	case len(note) > maxNoteLength:
+		return fmt.Errorf("note is longer than %d bytes", maxNoteLength)
+	case events == nil:
+		return errors.New("history is disabled")
+	}
+
+	e := protocol.HistoryEvent{
+		Kind:       protocol.HistorySessionAnnotated,
+		ProcessID:  msg.ProcessID,
+		Note:       note,
+		Seq:        ptyLog.Last(msg.ProcessID),
+		SourceUser: msg.SourceUser,
+	}
+	if info, ok := mgr.Info(msg.ProcessID); ok {
+		e.Agent = info.Agent
+		e.Path = info.WorktreePath
+		e.Package = info.Package
+	} else {
+		started, _ := events.Query(protocol.HistoryQuery{
+			Kinds:     []string{protocol.HistorySessionStarted},
+			ProcessID: msg.ProcessID,
+			Limit:     1,
+		})
+		if len(started) == 0 {
+			return fmt.Errorf("process %s not found", msg.ProcessID)
+		}
+		e.Agent = started[0].Agent
+		e.Path = started[0].Path
+		e.Package = started[0].Package
+	}
+	log.Printf("Session %s annotated by %s: %s", msg.ProcessID, cmp.Or(msg.SourceUser, "unknown user"), note)
+	recordEvent(e)
+	return nil
+}
+
+// sessionMarkers returns a session's annotations, oldest first.
+func sessionMarkers(processID string) []protocol.SessionMarker {
+	annotated, err := events.Query(protocol.HistoryQuery{
+		Kinds:     []string{protocol.HistorySessionAnnotated},
+		ProcessID: processID,
+		Limit:     history.MaxLimit,
+	})
+	if err != nil {
+		return nil
+	}
+	slices.Reverse(annotated)
+	markers := make([]protocol.SessionMarker, 0, len(annotated))
+	for _, e := range annotated {
+		markers = append(markers, protocol.SessionMarker{Time: e.Time, Note: e.Note, Seq: e.Seq, SourceUser: e.SourceUser})
+	}
+	return markers
+}
+
+// sendShellHistory answers a get-history with a session's shell history.
+// The session's worktree is the running session's, the request's, or that
+// of the session-started event recorded for it.
+func sendShellHistory(wsClient link, mgr *session.Manager, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeShellHistory,
+		ProcessID: msg.ProcessID,
+	}
+	worktreePath := msg.WorktreePath
+	if info, ok := mgr.Info(msg.ProcessID); ok {
+		worktreePath = info.WorktreePath
+	} else if worktreePath == "" {
+		started, _ := events.Query(protocol.HistoryQuery{
+			Kinds:     []string{protocol.HistorySessionStarted},
+			ProcessID: msg.ProcessID,
+			Limit:     1,
+		})
+		if len(started) > 0 {
+			worktreePath = started[0].Path
+		}
+	}
+	if worktreePath == "" {
+		reply.Error = "unknown process; name its worktreePath"
+		wsClient.Send(reply)
+		return
+	}
+
+	file, err := session.ShellHistoryFile(worktreePath, msg.ProcessID)
+	if err == nil {
+		reply.Commands, err = session.ReadShellHistory(file)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing was run in a shell, or the history is gone
+		err = nil
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	wsClient.Send(reply)
+}
+
+// sendHistory answers a query-history with the matching events.
+func sendHistory(wsClient link, msg protocol.ServerMessage) {
+	reply := protocol.DaemonMessage{
+		Type:  protocol.MsgTypeHistoryResults,
+		RunID: msg.RunID,
+	}
+	var query protocol.HistoryQuery
+	if msg.Query != nil {
+		query = *msg.Query
+	}
+	results, err := events.Query(query)
+	if err != nil {
+		log.Printf("Failed to query history: %v", err)
+		reply.Error = err.Error()
+	}
+	reply.History = results
+	wsClient.Send(reply)
+}
@@ -0,0 +1,172 @@
+package agenthqd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// janitorInterval is how often the retention policy is enforced.
+const janitorInterval = time.Minute
+
+// Reasons reported in worktree-removed
+const (
+	removedRequested  = "requested"
+	removedTTL        = "ttl"
+	removedMaxPerRepo = "max-per-repo"
+	removedMaxTotal   = "max-total"
+)
+
+// janitor enforces the worktree retention policy on the workspace's repos.
+type janitor struct {
+	policy config.Retention
+	mgr    *session.Manager
+	// lastUsed is when each worktree was last seen with a running session.
+	// Worktrees not seen in use since startup fall back to their mtime.
+	lastUsed map[string]time.Time
+}
+
+// worktreeUse is a worktree considered for removal.
+type worktreeUse struct {
+	path     string
+	repo     string
+	lastUsed time.Time
+	inUse    bool
+}
+
+func newJanitor(policy config.Retention, mgr *session.Manager) *janitor {
+	return &janitor{policy: policy, mgr: mgr, lastUsed: make(map[string]time.Time)}
+}
+
+// run enforces the policy every janitorInterval until stop is closed. The
+// first sweep waits an interval so servers are connected to hear about it.
+func (j *janitor) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		j.sweep(time.Now())
+	}
+}
+
+// sweep removes the worktrees the policy no longer allows.
+func (j *janitor) sweep(now time.Time) {
+	worktrees := j.collect(now)
+
+	// Oldest first, so limits remove the least recently used
+	sort.Slice(worktrees, func(a, b int) bool {
+		return worktrees[a].lastUsed.Before(worktrees[b].lastUsed)
+	})
+
+	perRepo := make(map[string]int)
+	for _, w := range worktrees {
+		perRepo[w.repo]++
+	}
+	total := len(worktrees)
+
+	ttl := j.policy.TTLDuration()
+	for _, w := range worktrees {
+		if w.inUse {
+			continue
+		}
+
+		var reason string
+		switch {
+		case ttl > 0 && now.Sub(w.lastUsed) > ttl:
+			reason = removedTTL
+		case j.policy.MaxPerRepo > 0 && perRepo[w.repo] > j.policy.MaxPerRepo:
+			reason = removedMaxPerRepo
+		case j.policy.MaxTotal > 0 && total > j.policy.MaxTotal:
+			reason = removedMaxTotal
+		default:
+			continue
+		}
+
+		if dirty, err := worktree.Dirty(w.path); err != nil || dirty {
+			if err != nil {
+				log.Printf("Janitor: skipping worktree %s: %v", w.path, err)
+			}
+			continue
+		}
+		if dryRun {
+			log.Printf("Janitor: would remove worktree %s (%s)", w.path, reason)
+			perRepo[w.repo]--
+			total--
+			continue
+		}
+		removal, err := worktree.Remove(w.path)
+		if err != nil {
+			log.Printf("Janitor: failed to remove worktree %s: %v", w.path, err)
+			continue
+		}
+
+		log.Printf("Janitor: removed worktree %s (%s)", w.path, reason)
+		recordWorktreeRemoved(w.path, reason)
+		delete(j.lastUsed, w.path)
+		perRepo[w.repo]--
+		total--
+		broadcast(protocol.DaemonMessage{
+			Type:       protocol.MsgTypeWorktreeRemoved,
+			WorktreeID: filepath.Base(w.path),
+			Path:       w.path,
+			Reason:     reason,
+			Removal:    &removal,
+		})
+	}
+}
+
+// collect lists the worktrees of the workspace's repos with when each was
+// last used.
+func (j *janitor) collect(now time.Time) []worktreeUse {
+	sessions := j.mgr.List()
+
+	var worktrees []worktreeUse
+	seen := make(map[string]bool)
+	for _, repo := range workspaceRepos() {
+		paths, err := worktree.List(repo)
+		if err != nil {
+			log.Printf("Janitor: failed to list worktrees of %s: %v", repo, err)
+			continue
+		}
+		for _, path := range paths {
+			seen[path] = true
+			w := worktreeUse{path: path, repo: repo}
+			for _, s := range sessions {
+				if s.WorktreePath == path || strings.HasPrefix(s.WorktreePath, path+string(filepath.Separator)) {
+					w.inUse = true
+				}
+			}
+			if w.inUse {
+				j.lastUsed[path] = now
+			}
+			w.lastUsed = j.lastUsed[path]
+			if w.lastUsed.IsZero() {
+				if info, err := os.Stat(path); err == nil {
+					w.lastUsed = info.ModTime()
+				}
+			}
+			worktrees = append(worktrees, w)
+		}
+	}
+
+	// Forget worktrees removed by other means
+	for path := range j.lastUsed {
+		if !seen[path] {
+			delete(j.lastUsed, path)
+		}
+	}
+	return worktrees
+}
@@ -0,0 +1,109 @@
+package agenthqd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// The daemon's core types, under names programs embedding it can use.
+type (
+	// Config is the daemon config file's contents.
+	Config = config.Config
+	// Server is a server the daemon connects to.
+	Server = config.Server
+	// SessionManager runs the daemon's sessions.
+	SessionManager = session.Manager
+	// SpawnOptions describe a session to start with SessionManager.Spawn.
+	SpawnOptions = session.SpawnOptions
+	// SessionInfo describes a running session.
+	SessionInfo = session.Info
+	// ExitInfo describes how a session ended.
+	ExitInfo = session.ExitInfo
+	// AgentType names an agent CLI.
+	AgentType = protocol.AgentType
+	// WatchdogTrip is a watchdog check that failed.
+	WatchdogTrip = protocol.WatchdogTrip
+	// WorktreeEnvironment describes a new worktree's setup, toolchains and
+	// dependencies.
+	WorktreeEnvironment = protocol.WorktreeEnvironment
+)
+
+// version is the daemon's version, for telemetry.
+var version = "dev"
+
+// DefaultConfigPath returns where the daemon config file is by default.
+func DefaultConfigPath() string {
+	return config.DefaultPath()
+}
+
+// LoadConfig reads a daemon config file; a missing file gives the defaults.
+func LoadConfig(path string) (*Config, error) {
+	return config.Load(path)
+}
+
+// ConfiguredServers returns the servers a daemon with cfg connects to: the
+// config's, or else the one in AGENTHQ_SERVER_URL (default
+// ws://localhost:3000/ws/daemon). Servers without a token get the one
+// stored by pairing, if any.
+func ConfiguredServers(cfg *Config) []Server {
+	return configuredServers(cfg)
+}
+
+// WorkspaceRepos returns the git repositories directly inside dir.
+func WorkspaceRepos(dir string) []string {
+	return reposIn(dir)
+}
+
+// Worktree is a worktree created by CreateWorktree.
+type Worktree struct {
+	Path   string
+	Branch string
+	// Package is the monorepo package the checkout was narrowed to, if any.
+	Package string
+	// SetupError describes a failed env file copy or setup command; the
+	// worktree exists but may be incomplete.
+	SetupError string
+	// Environment says how ready the worktree is for an agent to run its
+	// tests in.
+	Environment *WorktreeEnvironment
+}
+
+// CreateWorktree creates a worktree of the repo at repoPath for worktreeID,
+// from base (default HEAD), and prepares it as the repo's .agenthq.yml asks.
+// A non-empty pkg limits the checkout to that monorepo package.
+func (d *Daemon) CreateWorktree(ctx context.Context, repoPath, worktreeID, base, pkg string) (Worktree, error) {
+	wt, err := addWorktree(ctx, repoPath, worktreeID, base, pkg)
+	return Worktree{Path: wt.path, Branch: wt.branch, Package: wt.pkg, SetupError: wt.setupError, Environment: wt.environment}, err
+}
+
+// RemoveWorktree removes the worktree at path, discarding uncommitted
+// changes and killing the sessions running in it.
+func (d *Daemon) RemoveWorktree(ctx context.Context, path string) error {
+	if path == "" {
+		return errors.New("empty worktree path")
+	}
+	_, err := removeWorktree(ctx, d.mgr, path, true)
+	return err
+}
+
+// RestartProcess replaces the process with a fresh copy of itself, handing
+// over the watchdog's trips, after a trip from WatchdogTrips. Persistent
+// sessions were detached by Stop and are adopted by the new daemon. It is
+// meant for the agenthq-daemon binary and only returns on failure.
+func RestartProcess() error {
+	dog.Restarted()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	log.Printf("Restarting %s", exe)
+	env := append(os.Environ(), dog.Handoff())
+	return syscall.Exec(exe, os.Args, env)
+}
@@ -0,0 +1,67 @@
+package agenthqd
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// inputLimits converts the configured input limits: zero takes the default
+// and -1 removes the limit.
+func inputLimits(cfg config.InputLimits) session.InputLimits {
+	pick := func(v, def int) int {
+		switch {
+		case v < 0:
+			return 0
+		case v == 0:
+			return def
+		}
+		return v
+	}
+	def := session.DefaultInputLimits
+	return session.InputLimits{
+		MaxMessage: pick(cfg.MaxMessageBytes, def.MaxMessage),
+		Rate:       pick(cfg.BytesPerSecond, def.Rate),
+		Burst:      pick(cfg.BurstBytes, def.Burst),
+	}
+}
+
+// rejectNoticeInterval spaces input-rejected messages for one session, so a
+// flood of input doesn't turn into a flood of replies.
+const rejectNoticeInterval = time.Second
+
+var (
+	rejectNoticesMu sync.Mutex
+	rejectNotices   = make(map[string]time.Time)
+)
+
+// rejectInput logs and reports input refused for exceeding the session's
+// input limits.
+func rejectInput(wsClient link, processID string, err error) {
+	rejectNoticesMu.Lock()
+	now := time.Now()
+	if now.Sub(rejectNotices[processID]) < rejectNoticeInterval {
+		rejectNoticesMu.Unlock()
+		return
+	}
+	rejectNotices[processID] = now
+	rejectNoticesMu.Unlock()
+
+	log.Printf("Rejected input to %s: %v", processID, err)
+	wsClient.Send(protocol.DaemonMessage{
+		Type:      protocol.MsgTypeInputRejected,
+		ProcessID: processID,
+		Error:     err.Error(),
+	})
+}
+
+// forgetInputRejections drops a finished session's notice state.
+func forgetInputRejections(processID string) {
+	rejectNoticesMu.Lock()
+	defer rejectNoticesMu.Unlock()
+	delete(rejectNotices, processID)
+}
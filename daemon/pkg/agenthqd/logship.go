@@ -0,0 +1,46 @@
+package agenthqd
+
+import (
+	"cmp"
+	"io"
+	"log"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/logship"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// shipper forwards log records once log shipping was first enabled; it
+// stays in the log's output from then on, turned off if shipping is.
+var shipper *logship.Shipper
+
+// setLogShipping forwards log records at or above cfg's level to every
+// server as daemon-log messages, alongside the usual output, or stops
+// forwarding them.
+func setLogShipping(cfg config.LogShipping) {
+	if !cfg.Enabled {
+		if shipper != nil {
+			shipper.SetEnabled(false)
+			log.Printf("Stopped shipping logs")
+		}
+		return
+	}
+	if shipper == nil {
+		var err error
+		shipper, err = logship.New(cfg.Level, func(record protocol.LogRecord) {
+			broadcast(protocol.DaemonMessage{
+				Type: protocol.MsgTypeDaemonLog,
+				Log:  &record,
+			})
+		})
+		if err != nil {
+			log.Fatalf("Log shipping: %v", err)
+		}
+		log.SetOutput(io.MultiWriter(log.Writer(), shipper))
+	} else {
+		// Validated with the config
+		shipper.SetLevel(cfg.Level)
+		shipper.SetEnabled(true)
+	}
+	log.Printf("Shipping logs at level %s and above", cmp.Or(cfg.Level, protocol.LogLevelWarn))
+}
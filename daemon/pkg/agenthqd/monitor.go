@@ -0,0 +1,39 @@
+package agenthqd
+
+import (
+	"cmp"
+	"log"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/monitor"
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// startMonitor watches the daemon's goroutines, heap and server send
+// queues, alerting every server when one grows past its threshold.
+func startMonitor(cfg config.Monitor, stop <-chan struct{}) {
+	thresholds := monitor.Thresholds{
+		Goroutines: cfg.MaxGoroutines,
+		HeapMB:     cfg.MaxHeapMB,
+		SendQueue:  cfg.MaxSendQueue,
+	}
+	m := monitor.New(cfg.IntervalDuration(), thresholds, cmp.Or(cfg.DumpDir, monitor.DefaultDumpDir()), sendQueue, func(alert protocol.DaemonAlert) {
+		log.Printf("Alert: %s is %d, over the threshold of %d; diagnostics in %s", alert.Metric, alert.Value, alert.Threshold, cmp.Or(alert.Dump, "(none)"))
+		broadcast(protocol.DaemonMessage{
+			Type:  protocol.MsgTypeDaemonAlert,
+			Alert: &alert,
+		})
+	})
+	go m.Run(stop)
+}
+
+// sendQueue returns the messages waiting to be sent to all servers.
+func sendQueue() int {
+	n := 0
+	for _, conn := range connections {
+		if cl := conn.current(); cl != nil {
+			n += cl.Sending()
+		}
+	}
+	return n
+}
@@ -0,0 +1,64 @@
+package agenthqd
+
+import (
+	"log"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// orphanSweepInterval is how often processes left running by earlier
+// daemon runs are looked for, besides at start.
+const orphanSweepInterval = 5 * time.Minute
+
+// sweepOrphans kills the processes that sessions of earlier daemon runs
+// left running and weren't adopted, now and every orphanSweepInterval
+// until stop is closed.
+func sweepOrphans(mgr *session.Manager, stop <-chan struct{}) {
+	ticker := time.NewTicker(orphanSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		killOrphans(mgr)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// killOrphans kills the orphans found now, and logs and records each.
+func killOrphans(mgr *session.Manager) {
+	orphans, err := mgr.Orphans()
+	if err != nil {
+		log.Printf("Failed to look for orphaned processes: %v", err)
+		return
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	if dryRun {
+		for _, o := range orphans {
+			log.Printf("Would kill orphaned process %d of session %s: %s", o.PID, o.ProcessID, o.Command)
+		}
+		return
+	}
+
+	for _, o := range session.KillOrphans(orphans) {
+		e := protocol.HistoryEvent{
+			Kind:      protocol.HistoryOrphanKilled,
+			ProcessID: o.ProcessID,
+			PID:       o.PID,
+			Command:   o.Command,
+		}
+		if o.Err != nil {
+			log.Printf("Failed to kill orphaned process %d of session %s: %v", o.PID, o.ProcessID, o.Err)
+			e.Error = o.Err.Error()
+		} else {
+			log.Printf("Killed orphaned process %d of session %s: %s", o.PID, o.ProcessID, o.Command)
+		}
+		recordEvent(e)
+	}
+}
@@ -0,0 +1,70 @@
+package agenthqd
+
+import (
+	"context"
+	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/agenthq/daemon/internal/plugin"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// plugins are the configured plugins; nil when the daemon isn't running.
+var plugins *plugin.Host
+
+// pluginLauncher is the session manager's launcher: a plugin that launches
+// the spawn's agent chooses its command line.
+func pluginLauncher(opts session.SpawnOptions) (*session.Launch, error) {
+	launch, err := plugins.Launch(context.Background(), plugin.LaunchParams{
+		ProcessID:    opts.ProcessID,
+		Agent:        opts.Agent,
+		WorktreePath: opts.WorktreePath,
+		Dir:          filepath.Join(opts.WorktreePath, opts.Dir),
+		Task:         opts.Placeholders.Expand(opts.Task),
+		Profile:      opts.Profile,
+		Model:        opts.Model,
+		YoloMode:     opts.YoloMode,
+		Headless:     opts.Headless,
+		ResumeOf:     opts.ResumeOf,
+	})
+	if launch == nil || err != nil {
+		return nil, err
+	}
+	l := &session.Launch{Command: launch.Command, Args: launch.Args}
+	for _, k := range slices.Sorted(maps.Keys(launch.Env)) {
+		l.Env = append(l.Env, k+"="+launch.Env[k])
+	}
+	return l, nil
+}
+
+// deniedByPlugin asks the plugins whether to handle msg and, if one doesn't
+// allow it, replies with a policy-denied error. It reports whether msg was
+// denied.
+func deniedByPlugin(ctx context.Context, wsClient link, msg protocol.ServerMessage) bool {
+	err := plugins.Check(ctx, msg)
+	if err == nil {
+		return false
+	}
+	log.Printf("Refusing %s: %v", msg.Type, err)
+	wsClient.Send(protocol.DaemonMessage{
+		Type:      protocol.MsgTypeError,
+		ProcessID: msg.ProcessID,
+		Error:     err.Error(),
+		ErrorCode: protocol.ErrorCodePolicyDenied,
+	})
+	return true
+}
+
+// recordEvent adds e to the history and hands it to the plugins that asked
+// for events.
+func recordEvent(e protocol.HistoryEvent) {
+	if e.Time == 0 {
+		e.Time = time.Now().UnixMilli()
+	}
+	events.Record(e)
+	plugins.Notify(e)
+}
@@ -0,0 +1,81 @@
+package agenthqd
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/agenthq/daemon/internal/repoconfig"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// protectedPaths are the daemon's protected paths (config protectedPaths);
+// repos add their own in .agenthq.yml.
+var protectedPaths []string
+
+// protectedIn returns the protected paths of a worktree of a repo with
+// repoCfg, which may be nil if it couldn't be read.
+func protectedIn(repoCfg *repoconfig.Config) []string {
+	settingsMu.RLock()
+	paths := protectedPaths
+	settingsMu.RUnlock()
+	if repoCfg == nil {
+		return paths
+	}
+	return slices.Concat(paths, repoCfg.ProtectedPaths)
+}
+
+// worktreeProtected returns the protected paths of a worktree, as its
+// .agenthq.yml has them.
+func worktreeProtected(worktreePath string) []string {
+	repoCfg, _ := repoconfig.Load(worktreePath)
+	return protectedIn(repoCfg)
+}
+
+// protectedWatch is a session's protected files as they were when it
+// started.
+type protectedWatch struct {
+	root      string
+	protected []string
+	before    worktree.Fingerprint
+}
+
+var (
+	protectedWatchesMu sync.Mutex
+	protectedWatches   = make(map[string]protectedWatch)
+)
+
+// watchProtected records the protected files in a session's worktree
+// before it starts, to report which it touched when it exits.
+func watchProtected(processID, worktreePath string) {
+	protected := worktreeProtected(worktreePath)
+	if len(protected) == 0 {
+		return
+	}
+	w := protectedWatch{
+		root:      worktreePath,
+		protected: protected,
+		before:    worktree.TakeFingerprint(worktreePath, protected),
+	}
+	protectedWatchesMu.Lock()
+	defer protectedWatchesMu.Unlock()
+	protectedWatches[processID] = w
+}
+
+// touchedProtected stops watching a session's protected files and returns
+// those it added, changed or removed.
+func touchedProtected(processID string) []string {
+	protectedWatchesMu.Lock()
+	w, ok := protectedWatches[processID]
+	delete(protectedWatches, processID)
+	protectedWatchesMu.Unlock()
+	if !ok {
+		return nil
+	}
+	touched := w.before.Touched(worktree.TakeFingerprint(w.root, w.protected))
+	if len(touched) > 0 {
+		log.Printf("Session %s touched protected files: %s", processID, strings.Join(touched, ", "))
+	}
+	return touched
+}
@@ -0,0 +1,75 @@
+package agenthqd
+
+import (
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/redact"
+)
+
+// secrets masks the secrets redacted from session output in what else of a
+// session the daemon passes on, such as its transcript; nil if redaction
+// isn't configured.
+var secrets *redact.Redactor
+
+// outputRedactor masks secrets in each session's output stream before it
+// is sent.
+type outputRedactor struct {
+	redactor *redact.Redactor
+	emit     func(processID string, data []byte)
+
+	mu      sync.Mutex
+	streams map[string]*redact.Stream
+}
+
+// newOutputRedactor returns a redactor for the configured secrets that
+// passes masked output to emit, or nil if redaction isn't configured.
+func newOutputRedactor(cfg config.Redaction, emit func(processID string, data []byte)) (*outputRedactor, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	patterns := cfg.Patterns
+	if cfg.Builtin {
+		patterns = slices.Concat(redact.Builtin, patterns)
+	}
+	var values []string
+	for _, name := range cfg.EnvVars {
+		if v := os.Getenv(name); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	r, err := redact.New(patterns, values)
+	if err != nil {
+		return nil, err
+	}
+	return &outputRedactor{redactor: r, emit: emit, streams: make(map[string]*redact.Stream)}, nil
+}
+
+// write masks a chunk of a session's output.
+func (o *outputRedactor) write(processID string, data []byte) {
+	o.mu.Lock()
+	stream, ok := o.streams[processID]
+	if !ok {
+		stream = o.redactor.NewStream(func(data []byte) { o.emit(processID, data) })
+		o.streams[processID] = stream
+	}
+	o.mu.Unlock()
+
+	stream.Write(data)
+}
+
+// close emits a session's held-back output and forgets the session.
+func (o *outputRedactor) close(processID string) {
+	o.mu.Lock()
+	stream, ok := o.streams[processID]
+	delete(o.streams, processID)
+	o.mu.Unlock()
+
+	if ok {
+		stream.Flush()
+	}
+}
@@ -0,0 +1,172 @@
+package agenthqd
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/sensitive"
+)
+
+// liveSettings are the config file's keys a reload applies to the running
+// daemon. Changes to others take effect when it restarts: they set up
+// connections, listeners, backends and background work that can't be
+// swapped under running sessions.
+var liveSettings = map[string]bool{
+	"tokens":         true,
+	"profiles":       true,
+	"agents":         true,
+	"mcpServers":     true,
+	"macros":         true,
+	"protectedPaths": true,
+	"sensitivePaths": true,
+	"inputLimits":    true,
+	"budget":         true,
+	"safeMode":       true,
+	"drain":          true,
+	"scheduler":      true,
+	"summarizer":     true,
+	"logShipping":    true,
+	"shellHistory":   true,
+}
+
+var (
+	// reloadMu serializes reloads
+	reloadMu sync.Mutex
+	// settingsMu guards the settings a reload changes while the daemon
+	// runs: protectedPaths, sensitivePaths, summarizer, safeModeAfter,
+	// scopedTokens, pendingRestart and Daemon.cfg.
+	settingsMu sync.RWMutex
+	// pendingRestart are the config file's keys changed by the last
+	// reload that take effect when the daemon restarts
+	pendingRestart []string
+)
+
+// ReloadResult says what a config reload changed, by the config file's
+// keys.
+type ReloadResult struct {
+	// Applied are the changed settings now in effect.
+	Applied []string `json:"applied"`
+	// Restart are the changed settings that take effect when the daemon
+	// restarts.
+	Restart []string `json:"restart"`
+}
+
+// Reload re-reads the config file the daemon was started with (see
+// Options.ConfigPath) and applies it as ApplyConfig does. An invalid file
+// changes nothing.
+func (d *Daemon) Reload() (ReloadResult, error) {
+	if d.opts.ConfigPath == "" {
+		return ReloadResult{}, errors.New("the daemon's config wasn't loaded from a file")
+	}
+	cfg, err := config.Load(d.opts.ConfigPath)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	return d.ApplyConfig(cfg)
+}
+
+// ApplyConfig applies a new config to the running daemon without touching
+// its sessions: agents and profiles, macros, scoped tokens, policies,
+// limits and log shipping change at once, for sessions started from then
+// on where they are a session's settings. Other changes are reported for
+// a restart.
+func (d *Daemon) ApplyConfig(cfg *Config) (ReloadResult, error) {
+	if !d.started || d.mgr == nil {
+		return ReloadResult{}, errors.New("daemon not started")
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	settingsMu.RLock()
+	old := d.cfg
+	settingsMu.RUnlock()
+	if (d.opts.Local || d.opts.API) && len(cfg.Tokens) > 0 && d.opts.Token == "" {
+		return ReloadResult{}, errors.New("scoped tokens require a token")
+	}
+
+	result := ReloadResult{Applied: []string{}, Restart: []string{}}
+	for _, key := range changedSettings(old, cfg) {
+		if liveSettings[key] {
+			result.Applied = append(result.Applied, key)
+		} else {
+			result.Restart = append(result.Restart, key)
+		}
+	}
+
+	registry.Update(cfg)
+	macros.Update(cfg.Macros)
+	d.mgr.SetInputLimits(inputLimits(cfg.InputLimits))
+	d.mgr.SetBudget(cfg.Budget)
+	d.mgr.SetShellHistory(!cfg.ShellHistory.Shared, cfg.ShellHistory.RetentionDuration())
+	spawns.setMax(cfg.Scheduler.MaxSessions)
+	if d.hub != nil {
+		d.hub.SetTokens(cfg.Tokens)
+	}
+
+	settingsMu.Lock()
+	// Settings that need a restart keep their running values
+	next := *old
+	for _, key := range result.Applied {
+		setSetting(&next, cfg, key)
+	}
+	d.cfg = &next
+	protectedPaths = cfg.ProtectedPaths
+	sensitivePaths = sensitive.Merge(sensitive.Defaults, cfg.SensitivePaths)
+	summarizer = cfg.Summarizer
+	safeModeAfter = 0
+	if !cfg.SafeMode.Disabled {
+		safeModeAfter = cmp.Or(cfg.SafeMode.AfterDuration(), defaultSafeModeAfter)
+	}
+	scopedTokens = cfg.Tokens
+	pendingRestart = result.Restart
+	settingsMu.Unlock()
+
+	if old.LogShipping != cfg.LogShipping {
+		setLogShipping(cfg.LogShipping)
+	}
+
+	log.Printf("Reloaded config: applied %s; on restart %s", listOrNone(result.Applied), listOrNone(result.Restart))
+	return result, nil
+}
+
+// changedSettings returns the keys of the config file whose values differ
+// between a and b.
+func changedSettings(a, b *Config) []string {
+	var keys []string
+	av, bv := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := range av.NumField() {
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			keys = append(keys, settingKey(av.Type().Field(i)))
+		}
+	}
+	return keys
+}
+
+// setSetting sets the field of dst with key to its value in src.
+func setSetting(dst, src *Config, key string) {
+	dv, sv := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for i := range dv.NumField() {
+		if settingKey(dv.Type().Field(i)) == key {
+			dv.Field(i).Set(sv.Field(i))
+			return
+		}
+	}
+}
+
+// settingKey returns a config field's key in the config file.
+func settingKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return cmp.Or(name, field.Name)
+}
+
+func listOrNone(keys []string) string {
+	if len(keys) == 0 {
+		return "none"
+	}
+	return strings.Join(keys, ", ")
+}
@@ -0,0 +1,68 @@
+package agenthqd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// repoWatchInterval is how often the workspace is looked at for repos that
+// appeared or went away.
+const repoWatchInterval = 5 * time.Second
+
+// watchRepos tells the servers about repos that appear in the workspace
+// (repo-added) or leave it (repo-removed), checking every
+// repoWatchInterval until stop is closed, so that they needn't poll
+// list-repos. A directory counts once it has a .git directory, so a clone
+// is announced once git has created it.
+func watchRepos(stop <-chan struct{}) {
+	ticker := time.NewTicker(repoWatchInterval)
+	defer ticker.Stop()
+
+	known := make(map[string]bool)
+	for _, path := range currentRepos() {
+		known[path] = true
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := make(map[string]bool)
+		for _, path := range currentRepos() {
+			current[path] = true
+			if known[path] {
+				continue
+			}
+			log.Printf("Repo added to workspace: %s", path)
+			info := repoInfo(path)
+			broadcast(protocol.DaemonMessage{Type: protocol.MsgTypeRepoAdded, Repo: &info})
+		}
+		for path := range known {
+			if current[path] {
+				continue
+			}
+			log.Printf("Repo removed from workspace: %s", path)
+			broadcast(protocol.DaemonMessage{
+				Type:     protocol.MsgTypeRepoRemoved,
+				RepoName: filepath.Base(path),
+				Path:     path,
+			})
+		}
+		known = current
+	}
+}
+
+// currentRepos returns the workspace's repos, or none, without a log line,
+// if the workspace itself is gone.
+func currentRepos() []string {
+	if _, err := os.Stat(workspace); err != nil {
+		return nil
+	}
+	return workspaceRepos()
+}
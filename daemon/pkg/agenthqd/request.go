@@ -0,0 +1,183 @@
+package agenthqd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// idempotencyTTL is how long a spawn or create-worktree is remembered by
+// its idempotency key.
+const idempotencyTTL = time.Hour
+
+// request is a server message with a requestId or idempotency key. It is
+// the link its handlers reply through: replies are stamped with the
+// requestId, and once the handler and the goroutines it started are done
+// an ack ends them, carrying the first error if there was one.
+type request struct {
+	link
+	// id is the requestId; without one nothing is acked
+	id string
+
+	mu        sync.Mutex
+	pending   int
+	err       string
+	errorCode string
+	// attempt, if set, records the replies for an idempotency key
+	attempt *attempt
+	// duplicate is set for a retry, whose replies are replayed
+	duplicate bool
+}
+
+// newRequest returns the request for msg, or nil if it has neither a
+// requestId nor an idempotency key.
+func newRequest(wsClient link, msg protocol.ServerMessage) *request {
+	if msg.RequestID == "" && msg.IdempotencyKey == "" {
+		return nil
+	}
+	return &request{link: wsClient, id: msg.RequestID, pending: 1}
+}
+
+// Send stamps a reply with the requestId and notes the first error.
+func (r *request) Send(msg protocol.DaemonMessage) error {
+	msg.RequestID = r.id
+	r.mu.Lock()
+	if msg.Error != "" && r.err == "" {
+		r.err, r.errorCode = msg.Error, msg.ErrorCode
+	}
+	if r.attempt != nil {
+		r.attempt.replies = append(r.attempt.replies, msg)
+	}
+	r.mu.Unlock()
+	return r.link.Send(msg)
+}
+
+// fail records an error to be acked, unless one was already.
+func (r *request) fail(err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == "" {
+		r.err = err.Error()
+	}
+}
+
+// hold delays the ack until a matching release, for work that goes on
+// after the handler returns.
+func (r *request) hold() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending++
+}
+
+// release acks the request when nothing holds it any more.
+func (r *request) release() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.pending--
+	done := r.pending == 0
+	ack := protocol.DaemonMessage{
+		Type:      protocol.MsgTypeAck,
+		RequestID: r.id,
+		Error:     r.err,
+		ErrorCode: r.errorCode,
+		Duplicate: r.duplicate,
+	}
+	attempt := r.attempt
+	r.mu.Unlock()
+
+	if !done {
+		return
+	}
+	if attempt != nil {
+		attempt.finish(ack)
+	}
+	if r.id != "" {
+		r.link.Send(ack)
+	}
+}
+
+// attempt is the first spawn or create-worktree with an idempotency key;
+// retries get its replies.
+type attempt struct {
+	done    chan struct{}
+	expires time.Time
+	// replies and ack are complete once done is closed
+	replies []protocol.DaemonMessage
+	ack     protocol.DaemonMessage
+}
+
+var attempts = struct {
+	sync.Mutex
+	byKey map[string]*attempt
+}{byKey: make(map[string]*attempt)}
+
+// finish completes an attempt. A failed attempt is forgotten, so a retry
+// runs again: it produced no session or worktree to duplicate.
+func (a *attempt) finish(ack protocol.DaemonMessage) {
+	attempts.Lock()
+	a.ack = ack
+	if ack.Error != "" {
+		for key, other := range attempts.byKey {
+			if other == a {
+				delete(attempts.byKey, key)
+			}
+		}
+	}
+	attempts.Unlock()
+	close(a.done)
+}
+
+// idempotent handles the idempotency key of msg, whose request is req. It
+// returns true if msg is a retry, whose replies are replayed from the first
+// attempt once that is done; otherwise msg is to be handled, and its
+// replies are recorded for retries.
+func idempotent(req *request, msg protocol.ServerMessage) bool {
+	if msg.IdempotencyKey == "" {
+		return false
+	}
+	key := msg.Type + ":" + req.LocalID(msg.IdempotencyKey)
+
+	attempts.Lock()
+	now := time.Now()
+	for k, a := range attempts.byKey {
+		if now.After(a.expires) {
+			delete(attempts.byKey, k)
+		}
+	}
+	first, seen := attempts.byKey[key]
+	if !seen {
+		a := &attempt{done: make(chan struct{}), expires: now.Add(idempotencyTTL)}
+		attempts.byKey[key] = a
+		attempts.Unlock()
+		req.mu.Lock()
+		req.attempt = a
+		req.mu.Unlock()
+		return false
+	}
+	attempts.Unlock()
+
+	req.mu.Lock()
+	req.duplicate = true
+	req.mu.Unlock()
+	req.hold()
+	go func() {
+		defer req.release()
+		<-first.done
+		for _, reply := range first.replies {
+			req.Send(reply)
+		}
+		req.mu.Lock()
+		req.err, req.errorCode = first.ack.Error, first.ack.ErrorCode
+		req.mu.Unlock()
+	}()
+	return true
+}
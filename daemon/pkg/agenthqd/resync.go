@@ -0,0 +1,90 @@
+package agenthqd
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/ptylog"
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// resetTerminal (RIS) starts a snapshot from a blank terminal.
+const resetTerminal = "\x1bc"
+
+// ptyLog numbers session output and keeps it for resync requests.
+var ptyLog = ptylog.New(0)
+
+// forgetOutputAfter is how long a session's output is kept after it
+// exits; its last output may still be on the way, and a server may still
+// be catching up.
+const forgetOutputAfter = time.Minute
+
+// forgetOutput drops an exited session's output once it can't be needed.
+func forgetOutput(processID string) {
+	time.AfterFunc(forgetOutputAfter, func() { ptyLog.Forget(processID) })
+}
+
+// viewerSessions are the sessions the session viewer shows. Its replay is
+// the output as servers were sent it, after redaction, not the terminal's.
+type viewerSessions struct {
+	*session.Manager
+}
+
+// RecentOutput returns the output kept of a running session.
+func (v viewerSessions) RecentOutput(processID string) ([]byte, error) {
+	if _, ok := v.Info(processID); !ok {
+		return nil, fmt.Errorf("process %s not found", processID)
+	}
+	return ptyLog.Recent(processID), nil
+}
+
+func ptyData(processID string, seq uint64, data []byte, snapshot bool) protocol.DaemonMessage {
+	// Encode as base64 to safely transmit binary data
+	return protocol.DaemonMessage{
+		Type:      protocol.MsgTypePtyData,
+		ProcessID: processID,
+		Data:      base64.StdEncoding.EncodeToString(data),
+		Seq:       seq,
+		Snapshot:  snapshot,
+	}
+}
+
+// resync answers a resync-request: the missing output is sent again if it
+// is still kept. Otherwise the terminal is reset and redrawn, by the
+// session itself if its backend can, or from the output that is kept. A
+// condensed session's screen is redrawn.
+func resync(wsClient link, mgr *session.Manager, processID string, seq uint64) error {
+	if ss := condensedScreen(processID); ss != nil {
+		// The output that drew the screen isn't sent; the screen is
+		ss.update(wsClient, processID, true)
+		return nil
+	}
+	ok := ptyLog.Resync(processID, seq,
+		func(chunk ptylog.Chunk) {
+			wsClient.Send(ptyData(processID, chunk.Seq, chunk.Data, false))
+		},
+		func(kept []ptylog.Chunk, last uint64) {
+			// The repaint follows as new output once the resync is done
+			err := mgr.Redraw(processID)
+			if err == nil {
+				wsClient.Send(ptyData(processID, last, []byte(resetTerminal), true))
+				return
+			}
+			if !errors.Is(err, session.ErrNoRedraw) {
+				log.Printf("Failed to redraw %s: %v", processID, err)
+			}
+			data := []byte(resetTerminal)
+			for _, chunk := range kept {
+				data = append(data, chunk.Data...)
+			}
+			wsClient.Send(ptyData(processID, last, data, true))
+		})
+	if !ok {
+		return fmt.Errorf("no output for process %s", processID)
+	}
+	return nil
+}
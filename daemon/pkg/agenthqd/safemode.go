@@ -0,0 +1,132 @@
+package agenthqd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agenthq/daemon/internal/protocol"
+)
+
+// defaultSafeModeAfter is how long without a heartbeat-ack enters safe
+// mode by default: three heartbeats.
+const defaultSafeModeAfter = 90 * time.Second
+
+// livenessCheckInterval is how often connections check for overdue
+// heartbeat-acks.
+const livenessCheckInterval = 5 * time.Second
+
+// safeModeAfter is how long without a heartbeat-ack enters safe mode; 0
+// never does.
+var safeModeAfter time.Duration
+
+// safeModeRefuses are the commands refused in safe mode: those that start
+// or end sessions or worktrees, which a stale command must not do.
+var safeModeRefuses = map[string]bool{
+	protocol.MsgTypeSpawn:          true,
+	protocol.MsgTypeKill:           true,
+	protocol.MsgTypeCreateWorktree: true,
+	protocol.MsgTypeRemoveWorktree: true,
+	protocol.MsgTypeCompareRun:     true,
+}
+
+// connected restarts the wait for a heartbeat-ack on a new client.
+func (c *connection) connected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastAck = time.Now()
+}
+
+// heartbeatAcked records a heartbeat-ack, leaving safe mode if in it.
+func (c *connection) heartbeatAcked() {
+	c.mu.Lock()
+	now := time.Now()
+	c.lastAck = now
+	c.acks = true
+	since := c.safeSince
+	c.safeSince = time.Time{}
+	c.mu.Unlock()
+	if since.IsZero() {
+		return
+	}
+
+	log.Printf("[%s] Server acknowledged a heartbeat again; leaving safe mode after %s", c.label(), now.Sub(since).Round(time.Second))
+	recordEvent(protocol.HistoryEvent{
+		Kind:       protocol.HistorySafeModeLeft,
+		Server:     c.label(),
+		DurationMs: now.Sub(since).Milliseconds(),
+	})
+}
+
+// watchLiveness enters safe mode when a server that acknowledges
+// heartbeats stops doing so, until done closes.
+func (c *connection) watchLiveness(done <-chan struct{}) {
+	ticker := time.NewTicker(livenessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		// Read each time, as a config reload may change it
+		settingsMu.RLock()
+		after := safeModeAfter
+		settingsMu.RUnlock()
+		if after == 0 {
+			continue
+		}
+
+		c.mu.Lock()
+		// Only servers that acknowledged heartbeats before are expected to
+		silent := time.Since(c.lastAck)
+		enter := c.acks && c.safeSince.IsZero() && silent >= after
+		if enter {
+			c.safeSince = time.Now()
+		}
+		c.mu.Unlock()
+		if !enter {
+			continue
+		}
+
+		reason := fmt.Sprintf("no heartbeat-ack for %s", silent.Round(time.Second))
+		log.Printf("Alert: [%s] %s; entering safe mode: spawns, kills and worktree commands from it are refused until it acknowledges a heartbeat, and running sessions are kept", c.label(), reason)
+		recordEvent(protocol.HistoryEvent{
+			Kind:   protocol.HistorySafeModeEntered,
+			Server: c.label(),
+			Reason: reason,
+		})
+	}
+}
+
+// inSafeMode reports whether the connection is in safe mode.
+func (c *connection) inSafeMode() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.safeSince.IsZero()
+}
+
+// refusedInSafeMode replies with a safe-mode error if msg is a command
+// refused in safe mode and peer's connection is in it. It reports whether
+// msg was refused.
+func refusedInSafeMode(peer, wsClient link, msg protocol.ServerMessage) bool {
+	if !safeModeRefuses[msg.Type] {
+		return false
+	}
+	for _, conn := range connections {
+		if link(conn.current()) != peer || !conn.inSafeMode() {
+			continue
+		}
+		err := fmt.Errorf("the connection to %s is in safe mode until the server acknowledges a heartbeat", conn.label())
+		log.Printf("Refusing %s: %v", msg.Type, err)
+		wsClient.Send(protocol.DaemonMessage{
+			Type:      protocol.MsgTypeError,
+			ProcessID: msg.ProcessID,
+			Error:     err.Error(),
+			ErrorCode: protocol.ErrorCodeSafeMode,
+		})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package agenthqd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/agenthq/daemon/internal/repoconfig"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// errKilledWhileQueued ends a spawn killed while it waited for a slot.
+var errKilledWhileQueued = errors.New("killed while waiting for a free session slot")
+
+// queuedSpawn is a spawn waiting for a slot. done is told nil when it gets
+// one, or why it won't.
+type queuedSpawn struct {
+	processID string
+	done      chan error
+}
+
+// repoShare is what the scheduler knows of a repo: its sessions, its
+// limits from .agenthq.yml, and the spawns waiting.
+type repoShare struct {
+	running int
+	// max caps running, 0 is no cap; weight is the repo's share
+	max, weight int
+	waiting     []*queuedSpawn
+	// served orders repos by when they last got a slot, so that repos
+	// with the same share take turns
+	served uint64
+}
+
+// scheduler shares the daemon's sessions between repos. Spawns from
+// servers wait for a slot, within scheduler.maxSessions and the repo's
+// maxSessions; slots that free up go to the repo with the fewest sessions
+// for its weight, so a burst of tasks for one repo can't starve the others.
+// Spawns that don't wait (REST API, compare runs, adopted sessions) still
+// take their slot.
+type scheduler struct {
+	mu  sync.Mutex
+	max int
+	// running is the repo of each session holding a slot, by processId
+	running map[string]string
+	repos   map[string]*repoShare
+	turn    uint64
+}
+
+// spawns is the daemon's scheduler.
+var spawns = &scheduler{
+	running: make(map[string]string),
+	repos:   make(map[string]*repoShare),
+}
+
+// setMax sets how many sessions may run at once, 0 for no limit.
+func (s *scheduler) setMax(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.max = n
+	s.dispatchLocked()
+}
+
+// acquire waits until the spawn of processID in worktreePath may start,
+// reporting StageQueued if it has to wait. The slot is the spawn's until
+// release; acquire fails if the spawn is killed first or ctx ends.
+func (s *scheduler) acquire(ctx context.Context, processID, worktreePath string) error {
+	repo := repoOf(worktreePath)
+	limit, weight := repoLimits(repo)
+
+	s.mu.Lock()
+	if _, ok := s.running[processID]; ok || s.queuedLocked(processID) {
+		s.mu.Unlock()
+		return fmt.Errorf("process %s already exists", processID)
+	}
+	r := s.shareLocked(repo)
+	r.max, r.weight = limit, weight
+	q := &queuedSpawn{processID: processID, done: make(chan error, 1)}
+	r.waiting = append(r.waiting, q)
+	s.dispatchLocked()
+	var why string
+	if _, ok := s.running[processID]; !ok {
+		why = s.blockedLocked(repo)
+	}
+	s.mu.Unlock()
+
+	if why != "" {
+		log.Printf("Spawn of %s queued: %s", processID, why)
+		reportSpawnProgress(processID, session.StageQueued, why, nil)
+	}
+	select {
+	case err := <-q.done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.dequeueLocked(processID) {
+			return ctx.Err()
+		}
+		// Got its slot meanwhile
+		return <-q.done
+	}
+}
+
+// track gives an adopted session its slot, unless it holds one already.
+func (s *scheduler) track(processID, worktreePath string) {
+	repo := repoOf(worktreePath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[processID]; ok {
+		return
+	}
+	s.running[processID] = repo
+	s.shareLocked(repo).running++
+}
+
+// claim gives a spawn that doesn't wait its slot, failing if processID
+// holds one or waits for one already.
+func (s *scheduler) claim(processID, worktreePath string) error {
+	repo := repoOf(worktreePath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[processID]; ok || s.queuedLocked(processID) {
+		return fmt.Errorf("process %s already exists", processID)
+	}
+	s.running[processID] = repo
+	s.shareLocked(repo).running++
+	return nil
+}
+
+// release frees the slot of a session that ended, or of a spawn that
+// failed, for the next spawn waiting.
+func (s *scheduler) release(processID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo, ok := s.running[processID]
+	if !ok {
+		return
+	}
+	delete(s.running, processID)
+	r := s.repos[repo]
+	r.running--
+	if r.running == 0 && len(r.waiting) == 0 {
+		delete(s.repos, repo)
+	}
+	s.dispatchLocked()
+}
+
+// cancel ends the wait of a queued spawn, reporting whether there was one.
+func (s *scheduler) cancel(processID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dequeueLocked(processID)
+}
+
+// refuseQueued ends the wait of every queued spawn with err.
+func (s *scheduler) refuseQueued(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for repo, r := range s.repos {
+		for _, q := range r.waiting {
+			q.done <- err
+		}
+		r.waiting = nil
+		if r.running == 0 {
+			delete(s.repos, repo)
+		}
+	}
+}
+
+// queuedLocked reports whether a spawn is queued; s.mu is held.
+func (s *scheduler) queuedLocked(processID string) bool {
+	for _, r := range s.repos {
+		for _, q := range r.waiting {
+			if q.processID == processID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dequeueLocked removes a queued spawn, telling it it was killed, and
+// reports whether there was one; s.mu is held.
+func (s *scheduler) dequeueLocked(processID string) bool {
+	for repo, r := range s.repos {
+		for i, q := range r.waiting {
+			if q.processID != processID {
+				continue
+			}
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			if r.running == 0 && len(r.waiting) == 0 {
+				delete(s.repos, repo)
+			}
+			q.done <- errKilledWhileQueued
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchLocked gives free slots to queued spawns, each to the first
+// spawn of the repo with the fewest sessions for its weight; s.mu is held.
+func (s *scheduler) dispatchLocked() {
+	for s.max == 0 || len(s.running) < s.max {
+		var next string
+		var best *repoShare
+		for repo, r := range s.repos {
+			if len(r.waiting) == 0 || r.max > 0 && r.running >= r.max {
+				continue
+			}
+			if best == nil || fairer(r, best) {
+				next, best = repo, r
+			}
+		}
+		if best == nil {
+			return
+		}
+		q := best.waiting[0]
+		best.waiting = best.waiting[1:]
+		best.running++
+		s.turn++
+		best.served = s.turn
+		s.running[q.processID] = next
+		q.done <- nil
+	}
+}
+
+// blockedLocked returns why a repo's spawns wait; s.mu is held.
+func (s *scheduler) blockedLocked(repo string) string {
+	r := s.repos[repo]
+	if r.max > 0 && r.running >= r.max {
+		return fmt.Sprintf("%s has %d of its %d sessions running", filepath.Base(repo), r.running, r.max)
+	}
+	if s.max > 0 && len(s.running) >= s.max {
+		return fmt.Sprintf("%d of %d sessions running", len(s.running), s.max)
+	}
+	return "waiting for a free session slot"
+}
+
+// shareLocked returns a repo's share, adding it if needed; s.mu is held.
+func (s *scheduler) shareLocked(repo string) *repoShare {
+	r, ok := s.repos[repo]
+	if !ok {
+		r = &repoShare{weight: 1}
+		s.repos[repo] = r
+	}
+	return r
+}
+
+// fairer reports whether a should get the next slot before b: it has fewer
+// sessions for its weight, or as few and was served longer ago.
+func fairer(a, b *repoShare) bool {
+	if x, y := a.running*b.weight, b.running*a.weight; x != y {
+		return x < y
+	}
+	return a.served < b.served
+}
+
+// repoOf returns the repo a worktree belongs to, or the worktree itself
+// outside git.
+func repoOf(worktreePath string) string {
+	if repo, err := worktree.MainRepo(worktreePath); err == nil {
+		return repo
+	}
+	return worktreePath
+}
+
+// repoLimits returns a repo's session cap and weight from its .agenthq.yml.
+func repoLimits(repo string) (limit, weight int) {
+	repoCfg, err := repoconfig.Load(repo)
+	if err != nil {
+		return 0, 1
+	}
+	return repoCfg.MaxSessions, max(repoCfg.Weight, 1)
+}
@@ -0,0 +1,44 @@
+package agenthqd
+
+import (
+	"log"
+
+	"github.com/agenthq/daemon/internal/agent"
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/scope"
+)
+
+// registry is the daemon's agent registry, for resolving spawns' profiles.
+var registry *agent.Registry
+
+// scopedTokens are the tokens, each with its scopes, that control listener
+// clients may present instead of the daemon's token (config tokens).
+var scopedTokens []config.Token
+
+// outOfScope replies with an out-of-scope error if scopes don't allow msg.
+// It reports whether msg was refused.
+func outOfScope(wsClient link, scopes scope.Scopes, msg protocol.ServerMessage) bool {
+	err := scopes.Check(msg, spawnAgent(msg))
+	if err == nil {
+		return false
+	}
+	log.Printf("Refusing %s: %v", msg.Type, err)
+	wsClient.Send(protocol.DaemonMessage{
+		Type:      protocol.MsgTypeError,
+		ProcessID: msg.ProcessID,
+		Error:     err.Error(),
+		ErrorCode: protocol.ErrorCodeOutOfScope,
+	})
+	return true
+}
+
+// spawnAgent returns the agent a spawn message starts, taken from its
+// profile if it names none; empty if neither says.
+func spawnAgent(msg protocol.ServerMessage) protocol.AgentType {
+	if msg.Agent != "" || msg.Profile == "" || registry == nil {
+		return msg.Agent
+	}
+	profile, _ := registry.Profile(msg.Profile)
+	return profile.Agent
+}
@@ -0,0 +1,100 @@
+package agenthqd
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/session"
+)
+
+// The terminal size of a spawn that doesn't give one, if no resize for it
+// arrives within sizeWait.
+const (
+	defaultCols = 120
+	defaultRows = 30
+	sizeWait    = 2 * time.Second
+)
+
+// terminalSize is a resize kept for a spawn that hasn't started.
+type terminalSize struct {
+	cols, rows int
+}
+
+var (
+	pendingSizesMu sync.Mutex
+	// pendingSizes are the resizes kept for spawns that haven't started,
+	// by processId
+	pendingSizes = make(map[string]chan terminalSize)
+)
+
+// expectSize keeps the resizes for the spawn of processID until it starts,
+// rather than failing them for a process not found. It's called as the
+// spawn request is read, so that a resize sent right after it, or while it
+// waits for its size or a slot, isn't lost.
+func expectSize(processID string) chan terminalSize {
+	sizes := make(chan terminalSize, 1)
+	pendingSizesMu.Lock()
+	defer pendingSizesMu.Unlock()
+	pendingSizes[processID] = sizes
+	return sizes
+}
+
+// forgetSize stops keeping the resizes for the spawn of processID, and
+// returns the last one not yet taken, if any.
+func forgetSize(processID string, sizes chan terminalSize) (terminalSize, bool) {
+	pendingSizesMu.Lock()
+	if pendingSizes[processID] == sizes {
+		delete(pendingSizes, processID)
+	}
+	pendingSizesMu.Unlock()
+	return latestSize(sizes)
+}
+
+// latestSize returns the last resize kept in sizes and not yet taken, if any.
+func latestSize(sizes chan terminalSize) (terminalSize, bool) {
+	select {
+	case size := <-sizes:
+		return size, true
+	default:
+		return terminalSize{}, false
+	}
+}
+
+// awaitSize returns the terminal size for a spawn without one: that of the
+// first resize kept in sizes within sizeWait, or the default. A front end
+// often only knows the size once the terminal is laid out, after it asked
+// for the spawn; starting the agent at a guess would have a TUI draw at the
+// wrong size until the next resize.
+func awaitSize(processID string, sizes chan terminalSize) (cols, rows int) {
+	reportSpawnProgress(processID, session.StageSizePending, "", nil)
+	select {
+	case size := <-sizes:
+		log.Printf("Spawn of %s got its terminal size from a resize: cols=%d rows=%d", processID, size.cols, size.rows)
+		return size.cols, size.rows
+	case <-time.After(sizeWait):
+		log.Printf("Spawn of %s got no terminal size within %s; starting at cols=%d rows=%d", processID, sizeWait, defaultCols, defaultRows)
+		return defaultCols, defaultRows
+	}
+}
+
+// resizePending keeps a resize for the spawn of processID if it hasn't
+// started, and reports whether it hadn't.
+func resizePending(processID string, cols, rows int) bool {
+	if cols <= 0 || rows <= 0 {
+		return false
+	}
+	pendingSizesMu.Lock()
+	defer pendingSizesMu.Unlock()
+	sizes, ok := pendingSizes[processID]
+	if !ok {
+		return false
+	}
+	// A later resize replaces one not taken yet
+	select {
+	case <-sizes:
+	default:
+	}
+	sizes <- terminalSize{cols, rows}
+	return true
+}
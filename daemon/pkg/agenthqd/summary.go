@@ -0,0 +1,210 @@
+package agenthqd
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/repoconfig"
+	"github.com/agenthq/daemon/internal/sensitive"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/summarize"
+	"github.com/agenthq/daemon/internal/transcript"
+	"github.com/agenthq/daemon/internal/worktree"
+)
+
+// maxSummarizers is how many summarizers may run at once; sessions that
+// exit meanwhile wait their turn, as a local model may take a machine's
+// GPU or memory to itself.
+const maxSummarizers = 2
+
+var (
+	// summarizer is the command sessions are summarized with (config
+	// summarizer); its Command is unset if none
+	summarizer config.Summarizer
+	// summarizing holds a token for each summarizer running
+	summarizing = make(chan struct{}, maxSummarizers)
+	// sensitivePaths are the daemon's sensitive path categories (config
+	// sensitivePaths over the defaults); repos override them in
+	// .agenthq.yml.
+	sensitivePaths = sensitive.Defaults
+
+	sessionBasesMu sync.Mutex
+	// sessionBases are the commits sessions started at, by processId
+	sessionBases = make(map[string]string)
+)
+
+// recordSessionBase notes the commit a session's worktree is at as the
+// session starts, to diff what it changed against when it exits.
+func recordSessionBase(processID, worktreePath string) {
+	base, err := worktree.ResolveCommit(worktreePath, "HEAD")
+	if err != nil {
+		return
+	}
+	sessionBasesMu.Lock()
+	defer sessionBasesMu.Unlock()
+	sessionBases[processID] = base
+}
+
+// takeSessionBase forgets and returns the commit a session started at, if
+// it was noted.
+func takeSessionBase(processID string) string {
+	sessionBasesMu.Lock()
+	defer sessionBasesMu.Unlock()
+	base := sessionBases[processID]
+	delete(sessionBases, processID)
+	return base
+}
+
+// sessionDiff returns how a session changed its worktree since base, with
+// the changed files in the sensitive categories of the worktree's repo.
+func sessionDiff(worktreePath, base string) (*protocol.SessionDiff, error) {
+	stat, err := worktree.Diff(worktreePath, base)
+	if err != nil {
+		return nil, err
+	}
+	files, err := worktree.ChangedFiles(worktreePath, base)
+	if err != nil {
+		return nil, err
+	}
+	settingsMu.RLock()
+	categories := sensitivePaths
+	settingsMu.RUnlock()
+	if repoCfg, err := repoconfig.Load(worktreePath); err == nil {
+		categories = sensitive.Merge(categories, repoCfg.SensitivePaths)
+	}
+	return &protocol.SessionDiff{
+		Base:         base,
+		FilesChanged: stat.FilesChanged,
+		Insertions:   stat.Insertions,
+		Deletions:    stat.Deletions,
+		Untracked:    stat.Untracked,
+		Sensitive:    sensitive.Classify(categories, files),
+	}, nil
+}
+
+// summarizeSession sends the owner of an agent session that exited (plain
+// shells are not summarized) a session-summary: how the session changed
+// its worktree, flagging changes to sensitive files, and the summarizer's
+// digest of its transcript if one is configured. The transcript is the
+// agent's own if it can be found, and otherwise the session's recent
+// terminal output as it was sent, after redaction.
+func summarizeSession(mgr *session.Manager, processID string, exit session.ExitInfo) {
+	base := takeSessionBase(processID)
+	info, ok := mgr.Info(processID)
+	if !ok || info.Agent == protocol.AgentBash || info.Agent == protocol.AgentShell {
+		return
+	}
+	settingsMu.RLock()
+	sum := summarizer
+	settingsMu.RUnlock()
+	if base == "" && sum.Command == "" {
+		return
+	}
+	var path string
+	var output []byte
+	if sum.Command != "" {
+		if ref, ok := mgr.AgentSession(processID); ok {
+			path, _ = transcript.Locate(ref.Agent, ref.WorktreePath, ref.AgentSessionID)
+		}
+		if path == "" {
+			output = ptyLog.Recent(processID)
+		}
+	}
+
+	go func() {
+		reply := protocol.DaemonMessage{
+			Type:      protocol.MsgTypeSessionSummary,
+			ProcessID: info.ID,
+			Path:      info.WorktreePath,
+			Agent:     info.Agent,
+		}
+		if base != "" {
+			diff, err := sessionDiff(info.WorktreePath, base)
+			if err != nil {
+				log.Printf("Summary of %s: %v", info.ID, err)
+			} else if len(diff.Sensitive) > 0 {
+				log.Printf("Session %s changed sensitive files: %s", info.ID, describeSensitive(diff.Sensitive))
+			}
+			reply.Diff = diff
+		}
+		if sum.Command != "" {
+			reply.Summary, reply.Error = summarizeTranscript(sum, info, exit, path, output)
+		}
+		if reply.Diff != nil || reply.Summary != "" || reply.Error != "" {
+			sendToOwner(reply)
+		}
+	}()
+}
+
+// summarizeTranscript runs sum on a session's transcript: the agent's JSONL
+// transcript at path, or else the session's terminal output. It returns the
+// summary, or why there is none. Secrets are masked in either, as in
+// session output.
+func summarizeTranscript(sum config.Summarizer, info session.Info, exit session.ExitInfo, path string, output []byte) (summary, failure string) {
+	format, input := summarize.FormatTerminal, summarize.Plain(output)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Summary of %s: %v", info.ID, err)
+			return "", err.Error()
+		}
+		if secrets != nil {
+			data = secrets.Redact(data)
+		}
+		format, input = summarize.FormatJSONL, summarize.Tail(data)
+	}
+	if len(input) == 0 {
+		log.Printf("Summary of %s: no transcript to summarize", info.ID)
+		return "", "no transcript to summarize"
+	}
+
+	summarizing <- struct{}{}
+	defer func() { <-summarizing }()
+
+	cmd := summarize.Command{
+		Path: sum.Command,
+		Args: sum.Args,
+		Env: []string{
+			"AGENTHQ_PROCESS_ID=" + info.ID,
+			"AGENTHQ_AGENT=" + string(info.Agent),
+			"AGENTHQ_WORKTREE=" + info.WorktreePath,
+			"AGENTHQ_EXIT_CODE=" + strconv.Itoa(exit.Code),
+			"AGENTHQ_EXIT_REASON=" + exit.Reason,
+			"AGENTHQ_TRANSCRIPT=" + path,
+			"AGENTHQ_TRANSCRIPT_FORMAT=" + format,
+		},
+		Dir:     info.WorktreePath,
+		Timeout: sum.TimeoutDuration(),
+	}
+	for k, v := range sum.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if _, err := os.Stat(cmd.Dir); err != nil {
+		// The worktree was removed already
+		cmd.Dir = ""
+	}
+
+	start := time.Now()
+	summary, err := summarize.Run(cmd, input)
+	if err != nil {
+		log.Printf("Summary of %s: summarizer %v", info.ID, err)
+		return "", "summarizer " + err.Error()
+	}
+	log.Printf("Summary of %s: %d bytes from %d bytes of %s transcript in %s", info.ID, len(summary), len(input), format, time.Since(start).Round(time.Millisecond))
+	return summary, ""
+}
+
+// describeSensitive lists sensitive changes for the log.
+func describeSensitive(changes []protocol.SensitiveChange) string {
+	parts := make([]string, len(changes))
+	for i, c := range changes {
+		parts[i] = c.Path + " (" + c.Category + ")"
+	}
+	return strings.Join(parts, ", ")
+}
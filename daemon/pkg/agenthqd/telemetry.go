@@ -0,0 +1,94 @@
+package agenthqd
+
+import (
+	"context"
+	"log"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/telemetry"
+)
+
+var (
+	messagesReceived = telemetry.NewCounter("agenthq.daemon.messages", "{message}", "Server messages received, by type")
+	sessionsExited   = telemetry.NewCounter("agenthq.daemon.sessions.exited", "{session}", "Sessions that ended, by agent and exit reason")
+	spawnDuration    = telemetry.NewHistogram("agenthq.daemon.spawn.duration", "ms", "Time to start a session, including image pulls", telemetry.DurationBounds)
+	firstOutput      = telemetry.NewHistogram("agenthq.daemon.spawn.first_output", "ms", "Time from a spawn request to the session's first output", telemetry.DurationBounds)
+	serverRTT        = telemetry.NewHistogram("agenthq.daemon.connection.rtt", "ms", "Round-trip time to servers, measured with WebSocket pings", telemetry.DurationBounds)
+	worktreeDuration = telemetry.NewHistogram("agenthq.daemon.worktree.duration", "ms", "Time to create or remove a worktree, including setup", telemetry.DurationBounds)
+)
+
+// untracedMessages are too frequent to be worth a span each; they are
+// still counted.
+var untracedMessages = map[string]bool{
+	protocol.MsgTypePtyInput:       true,
+	protocol.MsgTypeResize:         true,
+	protocol.MsgTypeQueryPtySize:   true,
+	protocol.MsgTypeBroadcastInput: true,
+	protocol.MsgTypeAcquireInput:   true,
+}
+
+// startTelemetry starts exporting traces and metrics if an OTLP endpoint
+// is configured, returning the function that stops it.
+func startTelemetry(cfg config.Telemetry, hostname string, mgr *session.Manager) func() {
+	tc := telemetry.FromEnv(telemetry.Config{
+		Endpoint:       cfg.Endpoint,
+		Headers:        cfg.Headers,
+		ServiceName:    cfg.ServiceName,
+		Attributes:     map[string]string{"host.name": hostname, "service.version": version},
+		MetricInterval: cfg.MetricIntervalDuration(),
+	})
+	if tc.Endpoint == "" {
+		return func() {}
+	}
+	telemetry.NewGauge("agenthq.daemon.sessions.active", "{session}", "Running sessions", func() int64 {
+		return int64(len(mgr.List()))
+	})
+	log.Printf("Telemetry: exporting to %s", tc.Endpoint)
+	return telemetry.Start(tc)
+}
+
+// traceMessage counts a server message and starts its span, continuing
+// the server's trace if the message carries a traceparent. Work the
+// message starts in the background gets ctx for its own spans.
+func traceMessage(msg protocol.ServerMessage) (context.Context, *telemetry.Span) {
+	messagesReceived.Add(1, telemetry.String("type", msg.Type))
+	ctx := telemetry.WithTraceparent(context.Background(), msg.Traceparent)
+	if untracedMessages[msg.Type] {
+		return ctx, nil
+	}
+	attrs := []telemetry.Attr{telemetry.String("agenthq.message.type", msg.Type)}
+	for _, a := range []telemetry.Attr{
+		telemetry.String("agenthq.process_id", msg.ProcessID),
+		telemetry.String("agenthq.worktree_id", msg.WorktreeID),
+		telemetry.String("agenthq.run_id", msg.RunID),
+	} {
+		if a.Value != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	return telemetry.StartSpan(ctx, "message "+msg.Type, attrs...)
+}
+
+// recordExitMetrics counts a session's end.
+func recordExitMetrics(mgr *session.Manager, processID string, exit session.ExitInfo) {
+	var agent string
+	if info, ok := mgr.Info(processID); ok {
+		agent = string(info.Agent)
+	}
+	sessionsExited.Add(1, telemetry.String("agent", agent), telemetry.String("reason", exit.Reason))
+}
+
+// recordFirstOutput records the time a session took to first output.
+func recordFirstOutput(info session.Info) {
+	firstOutput.Record(float64(info.FirstOutput.Microseconds())/1000, telemetry.String("agent", string(info.Agent)))
+}
+
+// outcome labels an operation's result in metrics.
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,55 @@
+package agenthqd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/agenthq/daemon/internal/config"
+	"github.com/agenthq/daemon/internal/protocol"
+	"github.com/agenthq/daemon/internal/session"
+	"github.com/agenthq/daemon/internal/watchdog"
+)
+
+// dog is the daemon's watchdog; nil when disabled.
+var dog *watchdog.Watchdog
+
+// startWatchdog watches the server read loops and the session manager.
+// Unless it only logs, a trip is sent on restart.
+func startWatchdog(cfg config.Watchdog, mgr *session.Manager, restart chan<- protocol.WatchdogTrip, stop <-chan struct{}) {
+	if cfg.Disabled {
+		// A previous daemon in the process may have left one
+		dog = nil
+		return
+	}
+	dog = watchdog.New(cfg.TimeoutDuration(), func(trip protocol.WatchdogTrip) {
+		if cfg.LogOnly {
+			return
+		}
+		select {
+		case restart <- trip:
+		default:
+		}
+	})
+	timeout := cfg.TimeoutDuration()
+	if timeout == 0 {
+		timeout = watchdog.DefaultTimeout
+	}
+
+	dog.Watch("session manager", func() error {
+		mgr.Ping()
+		return nil
+	})
+	for _, conn := range connections {
+		dog.Watch("read loop "+conn.server.URL, func() error {
+			cl := conn.current()
+			if cl == nil {
+				return nil
+			}
+			if msgType, d := cl.Handling(); d > timeout {
+				return fmt.Errorf("stuck handling %s for %s", msgType, d.Round(time.Second))
+			}
+			return nil
+		})
+	}
+	go dog.Run(stop)
+}